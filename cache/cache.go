@@ -18,7 +18,11 @@ package cache
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -61,6 +65,17 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// FsVerity enables fs-verity on committed cache files and verifies their
+	// digests when they are opened. This is silently disabled if the filesystem
+	// of the cache directory doesn't support fs-verity.
+	FsVerity bool
+
+	// ReflinkIndex enables sharing extents of identical contents among the cache
+	// files recorded in the index (FICLONE) instead of storing copies. This is
+	// silently disabled if the filesystem of the cache directory doesn't support
+	// reflink (e.g. only XFS and btrfs support it) or fs-verity is enabled.
+	ReflinkIndex *ReflinkIndex
 }
 
 // TODO: contents validation.
@@ -78,6 +93,16 @@ type BlobCache interface {
 	Close() error
 }
 
+// FileCache is a BlobCache which stores the contents in files.
+type FileCache interface {
+	BlobCache
+
+	// OpenFile opens the file of the committed contents. The caller must close
+	// the returned file. This is useful for passing the contents to the kernel
+	// without copying them to the user space (e.g. splice(2)).
+	OpenFile(key string) (*os.File, error)
+}
+
 // Reader provides the data cached.
 type Reader interface {
 	io.ReaderAt
@@ -162,6 +187,20 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		direct:       config.Direct,
 	}
 	dc.syncAdd = config.SyncAdd
+	if config.FsVerity {
+		if err := verityTest(wipdir); err == nil {
+			dc.verity = &verityDigests{digests: make(map[string][]byte)}
+		} else if !errors.Is(err, errVerityNotSupported) {
+			return nil, fmt.Errorf("failed to test fs-verity: %w", err)
+		}
+	}
+	if config.ReflinkIndex != nil && dc.verity == nil {
+		if err := reflinkTest(wipdir); err == nil {
+			dc.reflinks = config.ReflinkIndex
+		} else if !errors.Is(err, errReflinkNotSupported) {
+			return nil, fmt.Errorf("failed to test reflink: %w", err)
+		}
+	}
 	return dc, nil
 }
 
@@ -178,6 +217,12 @@ type directoryCache struct {
 	syncAdd bool
 	direct  bool
 
+	// verity is non-nil if fs-verity is enabled on the cache files.
+	verity *verityDigests
+
+	// reflinks is non-nil if the cache files share extents of identical contents.
+	reflinks *ReflinkIndex
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -223,6 +268,12 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
 	}
+	if dc.verity != nil {
+		if err := dc.verity.verify(key, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 
 	// If "direct" option is specified, do not cache the file on memory.
 	// This option is useful for preventing memory cache from being polluted by data
@@ -250,6 +301,23 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	}, nil
 }
 
+func (dc *directoryCache) OpenFile(key string) (*os.File, error) {
+	if dc.isClosed() {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	file, err := os.Open(dc.cachePath(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
+	}
+	if dc.verity != nil {
+		if err := dc.verity.verify(key, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
 func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if dc.isClosed() {
 		return nil, fmt.Errorf("cache is already closed")
@@ -264,8 +332,22 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if err != nil {
 		return nil, err
 	}
+	var closeOnce sync.Once
+	var closeErr error
+	closeWip := func() error {
+		closeOnce.Do(func() { closeErr = wip.Close() })
+		return closeErr
+	}
+	var (
+		wipW io.Writer = wip
+		h    hash.Hash
+	)
+	if dc.reflinks != nil {
+		h = sha256.New()
+		wipW = io.MultiWriter(wip, h)
+	}
 	w := &writer{
-		WriteCloser: wip,
+		WriteCloser: &writeCloser{wipW, closeWip},
 		commitFunc: func() error {
 			if dc.isClosed() {
 				return fmt.Errorf("cache is already closed")
@@ -280,7 +362,30 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return multierror.Append(allErr,
 					fmt.Errorf("failed to create cache directory %q: %w", c, err))
 			}
-			return os.Rename(wip.Name(), c)
+			if dc.verity != nil {
+				// fs-verity can't be enabled while the file is opened for writing.
+				var err error
+				if err = closeWip(); err == nil {
+					err = dc.verity.seal(key, wip.Name())
+				}
+				if err != nil {
+					os.Remove(wip.Name())
+					return err
+				}
+			}
+			if h == nil {
+				return os.Rename(wip.Name(), c)
+			}
+			dgst := hex.EncodeToString(h.Sum(nil))
+			if err := dc.shareExtents(wip, dgst); err != nil {
+				os.Remove(wip.Name())
+				return err
+			}
+			if err := os.Rename(wip.Name(), c); err != nil {
+				return err
+			}
+			dc.reflinks.add(dgst, c)
+			return nil
 		},
 		abortFunc: func() error {
 			return os.Remove(wip.Name())
@@ -337,6 +442,94 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	return memW, nil
 }
 
+// remove removes the contents from the cache. Readers already opened can still read
+// the contents.
+func (dc *directoryCache) remove(key string) {
+	dc.cache.Remove(key)
+	dc.fileCache.Remove(key)
+	if dc.reflinks != nil {
+		dc.reflinks.remove(dc.cachePath(key))
+	}
+	os.Remove(dc.cachePath(key))
+}
+
+// shareExtents replaces the extents of the wip file with the ones of a cache file
+// which has the same contents, if any.
+func (dc *directoryCache) shareExtents(wip *os.File, dgst string) error {
+	fi, err := wip.Stat()
+	if err != nil {
+		return err
+	}
+	src := dc.reflinks.open(dgst, fi.Size())
+	if src == nil {
+		return nil
+	}
+	defer src.Close()
+	if err := reflink(wip, src); err != nil && !errors.Is(err, errReflinkNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// addFile adds the contents of the file to the cache. The extents of the file are
+// shared with the cache file if possible. Otherwise, the contents are copied.
+func (dc *directoryCache) addFile(key string, f *os.File) (int64, error) {
+	if dc.isClosed() {
+		return 0, fmt.Errorf("cache is already closed")
+	}
+	if dc.reflinks != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		wip, err := dc.wipFile(key)
+		if err != nil {
+			return 0, err
+		}
+		err = reflink(wip, f)
+		if err == nil {
+			err = dc.commitFile(key, wip)
+		} else {
+			wip.Close()
+			os.Remove(wip.Name())
+		}
+		if err == nil {
+			return fi.Size(), nil
+		} else if !errors.Is(err, errReflinkNotSupported) {
+			return 0, err
+		}
+	}
+	w, err := dc.Add(key, Direct())
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+	n, err := io.Copy(w, f)
+	if err != nil {
+		w.Abort()
+		return 0, err
+	}
+	if err := w.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// commitFile commits the wip file which shares extents with another cache file. The
+// digest of the contents isn't known so it isn't recorded to the index.
+func (dc *directoryCache) commitFile(key string, wip *os.File) error {
+	if err := wip.Close(); err != nil {
+		os.Remove(wip.Name())
+		return err
+	}
+	c := dc.cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
+		os.Remove(wip.Name())
+		return fmt.Errorf("failed to create cache directory %q: %w", c, err)
+	}
+	return os.Rename(wip.Name(), c)
+}
+
 func (dc *directoryCache) putBuffer(b *bytes.Buffer) {
 	b.Reset()
 	dc.bufPool.Put(b)
@@ -414,6 +607,16 @@ type reader struct {
 
 func (r *reader) Close() error { return r.closeFunc() }
 
+// OnMemory returns true if the reader returned by the cache reads contents cached on memory.
+func OnMemory(r Reader) bool {
+	cr, ok := r.(*reader)
+	if !ok {
+		return false
+	}
+	_, ok = cr.ReaderAt.(*bytes.Reader)
+	return ok
+}
+
 type writer struct {
 	io.WriteCloser
 	commitFunc func() error
@@ -24,9 +24,11 @@ package cache
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -71,10 +73,163 @@ func TestDirectoryCache(t *testing.T) {
 	testCache(t, "dir-with-small-mem", newCache)
 }
 
+func TestDirectoryCacheFsVerity(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := verityTest(tmp); errors.Is(err, errVerityNotSupported) {
+		t.Skip("fs-verity isn't supported on the temporary directory")
+	} else if err != nil {
+		t.Fatalf("failed to test fs-verity: %v", err)
+	}
+
+	newCache := func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:  true,
+			Direct:   true,
+			FsVerity: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-fs-verity", newCache)
+
+	// A file which isn't committed through the cache must not be used.
+	c, clean := newCache()
+	defer clean()
+	key := digestFor(sampleData)
+	p := c.(*directoryCache).cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(sampleData), 0600); err != nil {
+		t.Fatal(err)
+	}
+	miss(sampleData)(t, c)
+}
+
+func TestDirectoryCacheReflink(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := reflinkTest(tmp); errors.Is(err, errReflinkNotSupported) {
+		t.Skip("reflink isn't supported on the temporary directory")
+	} else if err != nil {
+		t.Fatalf("failed to test reflink: %v", err)
+	}
+
+	index := NewReflinkIndex()
+	newCache := func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:      true,
+			Direct:       true,
+			ReflinkIndex: index,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-reflink", newCache)
+
+	// Identical contents added to caches sharing the index must be readable from
+	// all of them.
+	c1, clean1 := newCache()
+	defer clean1()
+	c2, clean2 := newCache()
+	defer clean2()
+	for i, c := range []BlobCache{c1, c1, c2} {
+		key := fmt.Sprintf("%s-%d", digestFor(sampleData), i)
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			t.Fatalf("failed to write %q: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", key, err)
+		}
+		w.Close()
+		data, err := os.ReadFile(c.(*directoryCache).cachePath(key))
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", key, err)
+		}
+		if string(data) != sampleData {
+			t.Errorf("contents of %q = %q; want %q", key, string(data), sampleData)
+		}
+	}
+}
+
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func() (BlobCache, cleanFunc) { return NewMemoryCache(), func() {} })
 }
 
+func TestOnMemory(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dc, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+		MaxLRUCacheEntry: 10,
+		SyncAdd:          true,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	mc := NewMemoryCache()
+	key := digestFor(sampleData)
+	for _, c := range []BlobCache{dc, mc} {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			t.Fatalf("failed to write %q: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", key, err)
+		}
+		w.Close()
+	}
+	for _, tt := range []struct {
+		name     string
+		c        BlobCache
+		opts     []Option
+		onMemory bool
+	}{
+		{name: "directory", c: dc, onMemory: true},
+		{name: "directory-direct", c: dc, opts: []Option{Direct()}, onMemory: false},
+		{name: "memory", c: mc, onMemory: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.c.Get(key, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", key, err)
+			}
+			defer r.Close()
+			if got := OnMemory(r); got != tt.onMemory {
+				t.Errorf("OnMemory = %v; want %v", got, tt.onMemory)
+			}
+		})
+	}
+}
+
 type cleanFunc func()
 
 func testCache(t *testing.T, name string, newCache func() (BlobCache, cleanFunc)) {
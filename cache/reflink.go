@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// errReflinkNotSupported is returned when the filesystem doesn't support sharing
+// extents between files.
+var errReflinkNotSupported = errors.New("reflink isn't supported")
+
+// reflink shares all extents of src with dst instead of copying them. The size of
+// dst becomes the same as src.
+func reflink(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) ||
+			errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) {
+			return errReflinkNotSupported
+		}
+		return fmt.Errorf("failed to reflink %q to %q: %w", src.Name(), dst.Name(), err)
+	}
+	return nil
+}
+
+// reflinkTest tests if files in the directory can share extents.
+func reflinkTest(dir string) error {
+	src, err := os.CreateTemp(dir, "reflink-test-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		src.Close()
+		os.Remove(src.Name())
+	}()
+	if _, err := src.Write([]byte("test")); err != nil {
+		return err
+	}
+	dst, err := os.CreateTemp(dir, "reflink-test-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		dst.Close()
+		os.Remove(dst.Name())
+	}()
+	return reflink(dst, src)
+}
+
+// ReflinkIndex indexes committed cache files by the digest of their contents so that
+// a directory cache can share extents of identical contents (e.g. the same chunk in
+// multiple layers) instead of storing copies. An index can be shared among caches
+// on the same filesystem.
+type ReflinkIndex struct {
+	files   map[string]string // digest of the contents -> path of the file
+	digests map[string]string // path of the file -> digest of the contents
+	mu      sync.Mutex
+}
+
+// NewReflinkIndex returns an empty index.
+func NewReflinkIndex() *ReflinkIndex {
+	return &ReflinkIndex{
+		files:   make(map[string]string),
+		digests: make(map[string]string),
+	}
+}
+
+// open opens a file which has the contents of the digest and the size. nil is
+// returned if no such file is known.
+func (ri *ReflinkIndex) open(dgst string, size int64) *os.File {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	p, ok := ri.files[dgst]
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		ri.removeLocked(p) // the file has been removed
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		f.Close()
+		ri.removeLocked(p)
+		return nil
+	}
+	return f
+}
+
+// add records the path of the file which has the contents of the digest.
+func (ri *ReflinkIndex) add(dgst, path string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.removeLocked(path) // the file may have been replaced
+	ri.files[dgst], ri.digests[path] = path, dgst
+}
+
+// remove forgets the file.
+func (ri *ReflinkIndex) remove(path string) {
+	ri.mu.Lock()
+	ri.removeLocked(path)
+	ri.mu.Unlock()
+}
+
+func (ri *ReflinkIndex) removeLocked(path string) {
+	if dgst, ok := ri.digests[path]; ok {
+		if ri.files[dgst] == path {
+			delete(ri.files, dgst)
+		}
+		delete(ri.digests, path)
+	}
+}
@@ -0,0 +1,402 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// MemoryTierName is the name of the tier reported by TieredCacheConfig.OnHit when
+// the contents are served from the memory of the first tier.
+const MemoryTierName = "memory"
+
+// Tier is a level of a tiered cache.
+type Tier struct {
+	// Name is the name of the tier (e.g. "nvme").
+	Name string
+
+	// Cache stores the contents of the tier. This must be created by NewDirectoryCache.
+	Cache BlobCache
+
+	// Usage accounts the size of the tier shared among tiered caches. nil means
+	// the tier is unlimited.
+	Usage *TierUsage
+}
+
+// TieredCacheConfig is config of a tiered cache.
+type TieredCacheConfig struct {
+	// PromoteOnHit moves contents found in a lower tier to the first tier.
+	PromoteOnHit bool
+
+	// OnHit is called with the name of the tier when Get finds the contents.
+	OnHit func(tier string)
+
+	// OnMiss is called when Get doesn't find the contents in any tier.
+	OnMiss func()
+}
+
+// TierUsage is the total size of the contents stored in a tier by tiered caches.
+// When the tier exceeds the limit, the least recently used contents are demoted to
+// the next tier or removed if the tier is the last one.
+type TierUsage struct {
+	limit int64
+	used  int64
+	lru   *list.List // *tierEntry; the front is the most recently used
+	elems map[tierEntryKey]*list.Element
+	mu    sync.Mutex
+}
+
+type tierEntryKey struct {
+	c   *tieredCache
+	key string
+}
+
+type tierEntry struct {
+	tierEntryKey
+	size int64
+}
+
+// NewTierUsage returns the usage of a tier limited to limit bytes.
+func NewTierUsage(limit int64) *TierUsage {
+	return &TierUsage{
+		limit: limit,
+		lru:   list.New(),
+		elems: make(map[tierEntryKey]*list.Element),
+	}
+}
+
+// Used returns the size of the contents stored in the tier.
+func (u *TierUsage) Used() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.used
+}
+
+// add records the contents and returns the contents evicted from the tier.
+func (u *TierUsage) add(k tierEntryKey, size int64) (evicted []*tierEntry) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.elems[k]; ok {
+		u.used -= e.Value.(*tierEntry).size
+		u.lru.Remove(e)
+	}
+	u.elems[k] = u.lru.PushFront(&tierEntry{k, size})
+	u.used += size
+	for u.used > u.limit && u.lru.Len() > 1 {
+		e := u.lru.Back()
+		ent := e.Value.(*tierEntry)
+		u.lru.Remove(e)
+		delete(u.elems, ent.tierEntryKey)
+		u.used -= ent.size
+		evicted = append(evicted, ent)
+	}
+	return
+}
+
+func (u *TierUsage) touch(k tierEntryKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.elems[k]; ok {
+		u.lru.MoveToFront(e)
+	}
+}
+
+func (u *TierUsage) has(k tierEntryKey) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, ok := u.elems[k]
+	return ok
+}
+
+func (u *TierUsage) remove(k tierEntryKey) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e, ok := u.elems[k]
+	if ok {
+		u.used -= e.Value.(*tierEntry).size
+		u.lru.Remove(e)
+		delete(u.elems, k)
+	}
+	return ok
+}
+
+func (u *TierUsage) removeCache(c *tieredCache) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for k, e := range u.elems {
+		if k.c == c {
+			u.used -= e.Value.(*tierEntry).size
+			u.lru.Remove(e)
+			delete(u.elems, k)
+		}
+	}
+}
+
+// NewTieredCache returns a cache storing contents in the tiers. Contents are added
+// to the first tier and demoted to the next tier when the tier exceeds its limit.
+// Get looks up the tiers in order. Demotion is done by a background worker so that
+// adding contents doesn't wait for copying the evicted contents between tiers.
+func NewTieredCache(tiers []Tier, config TieredCacheConfig) (FileCache, error) {
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no cache tier is specified")
+	}
+	for _, t := range tiers {
+		if _, ok := t.Cache.(*directoryCache); !ok {
+			return nil, fmt.Errorf("cache of tier %q must be a directory cache", t.Name)
+		}
+	}
+	tc := &tieredCache{
+		tiers:         tiers,
+		config:        config,
+		moving:        make(map[string]struct{}),
+		demoteQueued:  make(chan struct{}, 1),
+		demoteStopped: make(chan struct{}),
+	}
+	go tc.demoteWorker()
+	return tc, nil
+}
+
+type tieredCache struct {
+	tiers  []Tier
+	config TieredCacheConfig
+
+	moving   map[string]struct{} // contents being promoted
+	movingMu sync.Mutex
+
+	demoteQueue   []demotion // contents waiting to be demoted
+	demoteQueueMu sync.Mutex
+	demoteQueued  chan struct{} // notifies the worker of the queued contents
+	demoteStopped chan struct{} // closed on Close to stop the worker
+
+	closed   bool
+	closedMu sync.RWMutex // held while moving contents between tiers
+}
+
+func (tc *tieredCache) Get(key string, opts ...Option) (Reader, error) {
+	for i, t := range tc.tiers {
+		r, err := t.Cache.Get(key, opts...)
+		if err != nil {
+			continue
+		}
+		if tc.config.OnHit != nil {
+			name := t.Name
+			if i == 0 && OnMemory(r) {
+				name = MemoryTierName
+			}
+			tc.config.OnHit(name)
+		}
+		if t.Usage != nil {
+			t.Usage.touch(tierEntryKey{tc, key})
+		}
+		if i > 0 && tc.config.PromoteOnHit {
+			go tc.promote(i, key)
+		}
+		return r, nil
+	}
+	if tc.config.OnMiss != nil {
+		tc.config.OnMiss()
+	}
+	return nil, fmt.Errorf("%q isn't cached in any tier", key)
+}
+
+func (tc *tieredCache) OpenFile(key string) (*os.File, error) {
+	var allErr error
+	for _, t := range tc.tiers {
+		f, err := t.Cache.(*directoryCache).OpenFile(key)
+		if err == nil {
+			return f, nil
+		}
+		allErr = multierror.Append(allErr, err)
+	}
+	return nil, allErr
+}
+
+func (tc *tieredCache) Add(key string, opts ...Option) (Writer, error) {
+	w, err := tc.tiers[0].Cache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	cw := &countingWriter{Writer: w}
+	return &writer{
+		WriteCloser: cw,
+		commitFunc: func() error {
+			if err := w.Commit(); err != nil {
+				return err
+			}
+			tc.added(0, key, cw.n)
+			return nil
+		},
+		abortFunc: w.Abort,
+	}, nil
+}
+
+// demotion is the contents queued for being demoted from the tier.
+type demotion struct {
+	tier int
+	key  string
+}
+
+// added records the contents added to the tier and queues the contents evicted from
+// the tier for demotion.
+func (tc *tieredCache) added(tier int, key string, size int64) {
+	u := tc.tiers[tier].Usage
+	if u == nil {
+		return
+	}
+	for _, e := range u.add(tierEntryKey{tc, key}, size) {
+		e.c.queueDemotion(tier, e.key)
+	}
+}
+
+func (tc *tieredCache) queueDemotion(tier int, key string) {
+	tc.demoteQueueMu.Lock()
+	tc.demoteQueue = append(tc.demoteQueue, demotion{tier, key})
+	tc.demoteQueueMu.Unlock()
+	select {
+	case tc.demoteQueued <- struct{}{}:
+	default: // the worker has already been notified
+	}
+}
+
+// demoteWorker demotes the queued contents in order until the cache is closed.
+func (tc *tieredCache) demoteWorker() {
+	for {
+		select {
+		case <-tc.demoteQueued:
+		case <-tc.demoteStopped:
+			return
+		}
+		for {
+			tc.demoteQueueMu.Lock()
+			if len(tc.demoteQueue) == 0 {
+				tc.demoteQueueMu.Unlock()
+				break
+			}
+			e := tc.demoteQueue[0]
+			tc.demoteQueue = tc.demoteQueue[1:]
+			tc.demoteQueueMu.Unlock()
+			tc.demote(e.tier, e.key)
+		}
+	}
+}
+
+// demote moves the contents evicted from the tier to the next tier. The contents are
+// removed if the tier is the last one.
+func (tc *tieredCache) demote(tier int, key string) {
+	tc.closedMu.RLock()
+	if tc.closed {
+		tc.closedMu.RUnlock()
+		return
+	}
+	if u := tc.tiers[tier].Usage; u != nil && u.has(tierEntryKey{tc, key}) {
+		// The contents have been added to the tier again after queued.
+		tc.closedMu.RUnlock()
+		return
+	}
+	var (
+		size int64
+		err  = fmt.Errorf("no tier to demote %q", key)
+	)
+	if tier+1 < len(tc.tiers) {
+		size, err = tc.copy(tier, tier+1, key)
+	}
+	tc.tiers[tier].Cache.(*directoryCache).remove(key)
+	tc.closedMu.RUnlock()
+	if err == nil {
+		tc.added(tier+1, key, size) // this can demote contents so must be done after unlocking
+	}
+}
+
+// promote moves the contents from the tier to the first tier.
+func (tc *tieredCache) promote(tier int, key string) {
+	tc.movingMu.Lock()
+	if _, ok := tc.moving[key]; ok {
+		tc.movingMu.Unlock()
+		return
+	}
+	tc.moving[key] = struct{}{}
+	tc.movingMu.Unlock()
+	defer func() {
+		tc.movingMu.Lock()
+		delete(tc.moving, key)
+		tc.movingMu.Unlock()
+	}()
+
+	tc.closedMu.RLock()
+	if tc.closed {
+		tc.closedMu.RUnlock()
+		return
+	}
+	size, err := tc.copy(tier, 0, key)
+	if err == nil {
+		if u := tc.tiers[tier].Usage; u != nil {
+			u.remove(tierEntryKey{tc, key})
+		}
+		tc.tiers[tier].Cache.(*directoryCache).remove(key)
+	}
+	tc.closedMu.RUnlock()
+	if err == nil {
+		tc.added(0, key, size) // this can demote contents so must be done after unlocking
+	}
+}
+
+// copy copies the contents from a tier to another tier and returns the size.
+func (tc *tieredCache) copy(from, to int, key string) (int64, error) {
+	f, err := tc.tiers[from].Cache.(*directoryCache).OpenFile(key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return tc.tiers[to].Cache.(*directoryCache).addFile(key, f)
+}
+
+func (tc *tieredCache) Close() error {
+	tc.closedMu.Lock()
+	if tc.closed {
+		tc.closedMu.Unlock()
+		return nil
+	}
+	tc.closed = true
+	tc.closedMu.Unlock()
+	close(tc.demoteStopped)
+	var allErr error
+	for _, t := range tc.tiers {
+		if t.Usage != nil {
+			t.Usage.removeCache(tc)
+		}
+		if err := t.Cache.Close(); err != nil {
+			allErr = multierror.Append(allErr, err)
+		}
+	}
+	return allErr
+}
+
+type countingWriter struct {
+	Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTiers(t *testing.T, limits ...int64) []Tier {
+	var tiers []Tier
+	for i, l := range limits {
+		c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{
+			MaxLRUCacheEntry: 10,
+			SyncAdd:          true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		tiers = append(tiers, Tier{Name: fmt.Sprintf("tier%d", i), Cache: c, Usage: NewTierUsage(l)})
+	}
+	return tiers
+}
+
+func TestTieredCache(t *testing.T) {
+	testCache(t, "tiered", func() (BlobCache, cleanFunc) {
+		c, err := NewTieredCache(newTestTiers(t, math.MaxInt64, math.MaxInt64), TieredCacheConfig{})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { c.Close() }
+	})
+}
+
+func TestTieredCacheDemotion(t *testing.T) {
+	var (
+		hits   = make(map[string]int)
+		misses int
+		mu     sync.Mutex
+	)
+	tiers := newTestTiers(t, 15, 15)
+	c, err := NewTieredCache(tiers, TieredCacheConfig{
+		PromoteOnHit: true,
+		OnHit: func(tier string) {
+			mu.Lock()
+			hits[tier]++
+			mu.Unlock()
+		},
+		OnMiss: func() {
+			mu.Lock()
+			misses++
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+
+	add := func(key string) {
+		w, err := c.Add(key, Direct())
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		defer w.Close()
+		if _, err := io.WriteString(w, sampleData); err != nil {
+			t.Fatalf("failed to write %q: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", key, err)
+		}
+	}
+	inTier := func(tier int, key string) bool {
+		r, err := tiers[tier].Cache.Get(key)
+		if err != nil {
+			return false
+		}
+		r.Close()
+		return true
+	}
+	// Contents are moved between tiers in background.
+	waitFor := func(cond func() bool, msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// "a" is demoted to the second tier.
+	add("aa")
+	add("bb")
+	waitFor(func() bool {
+		return !inTier(0, "aa") && inTier(1, "aa") && inTier(0, "bb")
+	}, "aa must be demoted to the second tier")
+	if u := tiers[0].Usage.Used(); u != int64(len(sampleData)) {
+		t.Errorf("usage of the first tier must be %d; got %d", len(sampleData), u)
+	}
+
+	// "a" is promoted to the first tier and "b" is demoted on hit.
+	testChunk(t, c, "aa", 0, sampleData)
+	waitFor(func() bool {
+		return inTier(0, "aa") && inTier(1, "bb")
+	}, "aa must be promoted to the first tier")
+	if inTier(1, "aa") {
+		t.Errorf("aa must be removed from the second tier after promotion")
+	}
+
+	// Contents evicted from the last tier are removed.
+	add("cc")
+	add("dd")
+	waitFor(func() bool {
+		return !inTier(0, "bb") && !inTier(1, "bb") && inTier(1, "cc")
+	}, "bb must be evicted from the last tier")
+	if _, err := c.Get("bb"); err == nil {
+		t.Errorf("bb must not be cached")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["tier1"] != 1 || misses != 1 {
+		t.Errorf("unexpected hits %v and misses %d", hits, misses)
+	}
+}
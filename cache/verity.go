@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	verityBlockSize  = 4096
+	verityDigestSize = 32 // sha256
+)
+
+// errVerityNotSupported is returned when the filesystem doesn't support fs-verity.
+var errVerityNotSupported = errors.New("fs-verity isn't supported")
+
+// enableVerity enables fs-verity on the file. The file must not be opened
+// for writing by anyone.
+func enableVerity(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256,
+		Block_size:     verityBlockSize,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		if errno == unix.EOPNOTSUPP || errno == unix.ENOTTY {
+			return errVerityNotSupported
+		}
+		if errno == unix.EEXIST {
+			return nil // already enabled
+		}
+		return fmt.Errorf("failed to enable fs-verity on %q: %w", path, errno)
+	}
+	return nil
+}
+
+// measureVerity returns the fs-verity digest of the file.
+func measureVerity(f *os.File) ([]byte, error) {
+	var d struct {
+		unix.FsverityDigest
+		digest [64]byte
+	}
+	d.Size = uint16(len(d.digest))
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&d))); errno != 0 {
+		if errno == unix.ENODATA || errno == unix.EOPNOTSUPP || errno == unix.ENOTTY {
+			return nil, fmt.Errorf("fs-verity isn't enabled on %q", f.Name())
+		}
+		return nil, fmt.Errorf("failed to measure fs-verity digest of %q: %w", f.Name(), errno)
+	}
+	if d.Algorithm != unix.FS_VERITY_HASH_ALG_SHA256 || d.Size != verityDigestSize {
+		return nil, fmt.Errorf("unexpected fs-verity digest of %q (algorithm %d)", f.Name(), d.Algorithm)
+	}
+	return append([]byte{}, d.digest[:d.Size]...), nil
+}
+
+// verityTest checks if fs-verity can be enabled on files in the directory.
+func verityTest(dir string) error {
+	f, err := os.CreateTemp(dir, "verity-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("test")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return enableVerity(f.Name())
+}
+
+// verityDigests records fs-verity digests of committed cache files.
+type verityDigests struct {
+	digests map[string][]byte
+	mu      sync.Mutex
+}
+
+func (v *verityDigests) add(key string, digest []byte) {
+	v.mu.Lock()
+	v.digests[key] = digest
+	v.mu.Unlock()
+}
+
+// verify checks that fs-verity is enabled on the opened cache file and that its
+// digest equals to the one recorded on commit.
+func (v *verityDigests) verify(key string, f *os.File) error {
+	v.mu.Lock()
+	want, ok := v.digests[key]
+	v.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("fs-verity digest of %q isn't recorded", key)
+	}
+	got, err := measureVerity(f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("fs-verity digest of %q doesn't match: %x; want %x", key, got, want)
+	}
+	return nil
+}
+
+// seal enables fs-verity on the written cache file and records its digest.
+func (v *verityDigests) seal(key, path string) error {
+	if err := enableVerity(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	digest, err := measureVerity(f)
+	if err != nil {
+		return err
+	}
+	v.add(key, digest)
+	return nil
+}
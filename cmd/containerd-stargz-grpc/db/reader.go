@@ -17,7 +17,6 @@
 package db
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -34,6 +33,7 @@ import (
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/util/bufpool"
 	"github.com/goccy/go-json"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
@@ -821,10 +821,16 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 		bufSize = int(compressedBytesRemain)
 	}
 
-	br := bufio.NewReaderSize(io.NewSectionReader(fr.r.sr, ent.offset, compressedBytesRemain), bufSize)
-	if _, err := br.Peek(bufSize); err != nil {
+	sr := io.NewSectionReader(fr.r.sr, ent.offset, compressedBytesRemain)
+	buf := bufpool.Get(bufSize)
+	defer bufpool.Put(buf)
+	if _, err := io.ReadFull(sr, *buf); err != nil {
 		return 0, fmt.Errorf("failed to peek read file payload: %v", err)
 	}
+	var br io.Reader = bytes.NewReader(*buf)
+	if compressedBytesRemain > int64(bufSize) {
+		br = io.MultiReader(br, sr)
+	}
 	dr, err := fr.r.decompressor.Reader(br)
 	if err != nil {
 		return 0, fmt.Errorf("fileReader.ReadAt.decompressor.Reader: %v", err)
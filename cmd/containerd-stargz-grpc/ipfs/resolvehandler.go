@@ -21,22 +21,77 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/containerd/containerd/log"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/ipfs"
+	"github.com/hashicorp/go-multierror"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-type ResolveHandler struct{}
+const (
+	daemonSource  = "daemon"
+	gatewaySource = "gateway"
+
+	// gatewayTimeout is the timeout of checking blobs on HTTP gateways.
+	gatewayTimeout = 30 * time.Second
+)
+
+// ResolveHandler provides layers stored in IPFS. Layers are fetched from the local
+// IPFS daemon and from HTTP gateways when the daemon is unavailable.
+type ResolveHandler struct {
+	// Pin pins the layers on the local IPFS daemon while the snapshotter uses them.
+	Pin bool
+
+	// Gateways are URLs of HTTP gateways (e.g. "https://ipfs.io") tried in order
+	// when the local IPFS daemon is unavailable.
+	Gateways []string
+
+	pins   map[string]int // reference counts of pinned paths
+	pinsMu sync.Mutex
+}
 
 func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
 	p, err := ipfs.GetPath(desc)
 	if err != nil {
 		return nil, 0, err
 	}
+	f, s, err := r.handleDaemon(ctx, desc, p)
+	if err == nil {
+		return f, s, nil
+	}
+	if len(r.Gateways) == 0 {
+		return nil, 0, err
+	}
+	log.G(ctx).WithError(err).WithField("path", p.String()).Debug("IPFS daemon is unavailable; trying gateways")
+	rErr := multierror.Append(nil, err)
+	gf := &gatewayFetcher{
+		gateways: r.Gateways,
+		path:     p,
+		layer:    desc.Digest,
+		client:   http.DefaultClient,
+	}
+	for _, gw := range r.Gateways {
+		s, err := gf.size(ctx, gw)
+		if err != nil {
+			rErr = multierror.Append(rErr, err)
+			continue
+		}
+		return gf, s, nil
+	}
+	return nil, 0, rErr
+}
+
+func (r *ResolveHandler) handleDaemon(ctx context.Context, desc ocispec.Descriptor, p ipath.Path) (remote.Fetcher, int64, error) {
 	client, err := httpapi.NewLocalApi()
 	if err != nil {
 		return nil, 0, err
@@ -55,12 +110,60 @@ func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (r
 	if err != nil {
 		return nil, 0, err
 	}
-	return &fetcher{client, p}, s, nil
+	f := &fetcher{api: client, path: p, layer: desc.Digest}
+	if r.Pin {
+		r.pin(client, p)
+		f.release = func() { r.unpin(client, p) }
+	}
+	return f, s, nil
+}
+
+// pin pins the path on the daemon unless it's already pinned by this handler.
+// Pinning fetches the entire layer to the daemon so this is done in background.
+func (r *ResolveHandler) pin(api iface.CoreAPI, p ipath.Path) {
+	r.pinsMu.Lock()
+	defer r.pinsMu.Unlock()
+	if r.pins == nil {
+		r.pins = make(map[string]int)
+	}
+	r.pins[p.String()]++
+	if r.pins[p.String()] > 1 {
+		return
+	}
+	go func() {
+		if err := api.Pin().Add(context.Background(), p); err != nil {
+			log.L.WithError(err).WithField("path", p.String()).Warn("failed to pin layer")
+			return
+		}
+		log.L.WithField("path", p.String()).Debug("pinned layer")
+	}()
+}
+
+// unpin unpins the path when it isn't used anymore.
+func (r *ResolveHandler) unpin(api iface.CoreAPI, p ipath.Path) {
+	r.pinsMu.Lock()
+	defer r.pinsMu.Unlock()
+	r.pins[p.String()]--
+	if r.pins[p.String()] > 0 {
+		return
+	}
+	delete(r.pins, p.String())
+	go func() {
+		if err := api.Pin().Rm(context.Background(), p); err != nil {
+			log.L.WithError(err).WithField("path", p.String()).Warn("failed to unpin layer")
+			return
+		}
+		log.L.WithField("path", p.String()).Debug("unpinned layer")
+	}()
 }
 
 type fetcher struct {
-	api  iface.CoreAPI
-	path ipath.Path
+	api     iface.CoreAPI
+	path    ipath.Path
+	layer   digest.Digest
+	release func() // nil if the path isn't pinned
+
+	closeOnce sync.Once
 }
 
 func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
@@ -75,7 +178,7 @@ func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadClos
 		return nil, fmt.Errorf("ReaderAt is not implemented")
 	}
 	return &readCloser{
-		Reader:    io.NewSectionReader(ra, off, size),
+		Reader:    &countingReader{io.NewSectionReader(ra, off, size), daemonSource, f.layer},
 		closeFunc: n.Close,
 	}, nil
 }
@@ -94,10 +197,132 @@ func (f *fetcher) Check() error {
 }
 
 func (f *fetcher) GenID(off int64, size int64) string {
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.path.String(), off, size)))
+	return genID(f.path, off, size)
+}
+
+// Close unpins the layer if it's pinned.
+func (f *fetcher) Close() error {
+	f.closeOnce.Do(func() {
+		if f.release != nil {
+			f.release()
+		}
+	})
+	return nil
+}
+
+// gatewayFetcher fetches layers from HTTP gateways ("<gateway>/ipfs/<cid>").
+type gatewayFetcher struct {
+	gateways []string
+	path     ipath.Path
+	layer    digest.Digest
+	client   *http.Client
+}
+
+func (f *gatewayFetcher) url(gw string) string {
+	return strings.TrimSuffix(gw, "/") + f.path.String()
+}
+
+func (f *gatewayFetcher) size(ctx context.Context, gw string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.url(gw), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %v from %q", resp.Status, gw)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("size of %q is unknown on %q", f.path.String(), gw)
+	}
+	return resp.ContentLength, nil
+}
+
+func (f *gatewayFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	var rErr error
+	for _, gw := range f.gateways {
+		rc, err := f.fetch(ctx, gw, off, size)
+		if err != nil {
+			rErr = multierror.Append(rErr, err)
+			continue
+		}
+		return rc, nil
+	}
+	return nil, rErr
+}
+
+func (f *gatewayFetcher) fetch(ctx context.Context, gw string, off int64, size int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url(gw), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The gateway ignored the range so skip to the offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d on %q: %w", off, gw, err)
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %v from %q", resp.Status, gw)
+	}
+	return &readCloser{
+		Reader:    &countingReader{io.LimitReader(r, size), gatewaySource, f.layer},
+		closeFunc: resp.Body.Close,
+	}, nil
+}
+
+func (f *gatewayFetcher) Check() error {
+	var rErr error
+	for _, gw := range f.gateways {
+		_, err := f.size(context.Background(), gw)
+		if err == nil {
+			return nil
+		}
+		rErr = multierror.Append(rErr, err)
+	}
+	return rErr
+}
+
+func (f *gatewayFetcher) GenID(off int64, size int64) string {
+	return genID(f.path, off, size)
+}
+
+// genID returns the cache ID of the chunk. This is the same between the daemon and
+// gateways so the chunks cached from either are shared.
+func genID(p ipath.Path, off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", p.String(), off, size)))
 	return fmt.Sprintf("%x", sum)
 }
 
+// countingReader records the bytes read from the source in the metrics.
+type countingReader struct {
+	io.Reader
+	source string
+	layer  digest.Digest
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		commonmetrics.AddIPFSBytesServed(r.source, r.layer, int64(n))
+	}
+	return n, err
+}
+
 type readCloser struct {
 	io.Reader
 	closeFunc func() error
@@ -30,7 +30,9 @@ import (
 	"path/filepath"
 	"time"
 
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	contentproxy "github.com/containerd/containerd/content/proxy"
 	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/log"
@@ -40,11 +42,15 @@ import (
 	dbmetadata "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/db"
 	ipfs "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/ipfs"
 	"github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/source/contentstore"
+	"github.com/containerd/stargz-snapshotter/fs/source/ocilayout"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
 	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/keychain/credentialprovider"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
 	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/keychain/ecr"
 	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	"github.com/containerd/stargz-snapshotter/version"
@@ -69,10 +75,11 @@ const (
 )
 
 var (
-	address      = flag.String("address", defaultAddress, "address for the snapshotter's GRPC server")
-	configPath   = flag.String("config", defaultConfigPath, "path to the configuration file")
+	pathDefaults = defaultPaths()
+	address      = flag.String("address", pathDefaults.address, "address for the snapshotter's GRPC server")
+	configPath   = flag.String("config", pathDefaults.configPath, "path to the configuration file")
 	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
-	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
+	rootDir      = flag.String("root", pathDefaults.rootDir, "path to the root directory for this snapshotter")
 	printVersion = flag.Bool("version", false, "print the version")
 )
 
@@ -88,9 +95,35 @@ type snapshotterConfig struct {
 	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
 	DebugAddress string `toml:"debug_address"`
 
+	// AdminAddress is a Unix domain socket address where the snapshotter exposes the admin API
+	// used by "ctr-remote cache" commands.
+	AdminAddress string `toml:"admin_address"`
+
 	// IPFS is a flag to enbale lazy pulling from IPFS.
 	IPFS bool `toml:"ipfs"`
 
+	// IPFSPin is a flag to pin layers on the local IPFS daemon while the snapshotter uses them.
+	IPFSPin bool `toml:"ipfs_pin"`
+
+	// IPFSGateways are URLs of HTTP gateways (e.g. "https://ipfs.io") from which layers are
+	// fetched when the local IPFS daemon is unavailable.
+	IPFSGateways []string `toml:"ipfs_gateways"`
+
+	// OCILayout is a flag to enable lazy pulling from OCI layout directories
+	// ("oci-layout://<dir>[:<tag>]").
+	OCILayout bool `toml:"oci_layout"`
+
+	// ContentStorePath is the path to the local containerd content store
+	// (e.g. "/var/lib/containerd/io.containerd.content.v1.content"). If specified, blobs
+	// existing in the content store are served from there instead of the network.
+	ContentStorePath string `toml:"content_store_path"`
+
+	// KeepFetchedBlobsMB is the max total size (in MiB) of blobs of layers fully fetched
+	// by background fetches, which are kept under the root directory and served from
+	// there instead of the network when the layers are resolved again (e.g. after the
+	// restart). 0 disables keeping blobs.
+	KeepFetchedBlobsMB int64 `toml:"keep_fetched_blobs_mb"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"memory"`
 }
@@ -122,7 +155,7 @@ func main() {
 
 	// Get configuration from specified file
 	tree, err := toml.LoadFile(*configPath)
-	if err != nil && !(os.IsNotExist(err) && *configPath == defaultConfigPath) {
+	if err != nil && !(os.IsNotExist(err) && *configPath == pathDefaults.configPath) {
 		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
 	}
 	if err := tree.Unmarshal(&config); err != nil {
@@ -138,13 +171,37 @@ func main() {
 
 	// Configure keychain
 	credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
+	var (
+		imageNamespaces  *cri.ImageNamespaces
+		imageAnnotations *cri.ImageAnnotations
+	)
 	if config.Config.KubeconfigKeychainConfig.EnableKeychain {
 		var opts []kubeconfig.Option
 		if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
 			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
 		}
+		if ns := config.Config.KubeconfigKeychainConfig.Namespace; ns != "" {
+			opts = append(opts, kubeconfig.WithNamespace(ns))
+		}
+		if config.Config.KubeconfigKeychainConfig.ScopeToImageNamespace {
+			if !(config.Config.CRIKeychainConfig.EnableKeychain) {
+				log.G(ctx).Warn("scope_to_image_namespace requires CRI-based keychain; kubeconfig-based keychain provides no creds")
+			}
+			imageNamespaces = cri.NewImageNamespaces()
+			opts = append(opts, kubeconfig.WithImageNamespaces(imageNamespaces.Namespaces))
+		}
 		credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
 	}
+	if config.Config.ECRKeychainConfig.EnableKeychain {
+		credsFuncs = append(credsFuncs, ecr.NewECRKeychain(ctx))
+	}
+	if cpc := config.Config.CredentialProviderKeychainConfig; cpc.EnableKeychain {
+		f, err := credentialprovider.NewCredentialProviderKeychain(ctx, cpc.ConfigPath, cpc.BinDir)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to configure credential provider keychain")
+		}
+		credsFuncs = append(credsFuncs, f)
+	}
 	if config.Config.CRIKeychainConfig.EnableKeychain {
 		// connects to the backend CRI service (defaults to containerd socket)
 		criAddr := defaultImageServiceAddress
@@ -152,45 +209,78 @@ func main() {
 			criAddr = cp
 		}
 		connectCRI := func() (runtime.ImageServiceClient, error) {
-			// TODO: make gRPC options configurable from config.toml
-			backoffConfig := backoff.DefaultConfig
-			backoffConfig.MaxDelay = 3 * time.Second
-			connParams := grpc.ConnectParams{
-				Backoff: backoffConfig,
-			}
-			gopts := []grpc.DialOption{
-				grpc.WithTransportCredentials(insecure.NewCredentials()),
-				grpc.WithConnectParams(connParams),
-				grpc.WithContextDialer(dialer.ContextDialer),
-				grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(defaults.DefaultMaxRecvMsgSize)),
-				grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(defaults.DefaultMaxSendMsgSize)),
-			}
-			conn, err := grpc.Dial(dialer.DialAddress(criAddr), gopts...)
+			conn, err := grpc.Dial(dialer.DialAddress(criAddr), containerdDialOptions()...)
 			if err != nil {
 				return nil, err
 			}
 			return runtime.NewImageServiceClient(conn), nil
 		}
-		f, criServer := cri.NewCRIKeychain(ctx, connectCRI)
+		if config.PodFetchPriorityConfig.Enable {
+			imageAnnotations = cri.NewImageAnnotations()
+		}
+		f, criServer := cri.NewCRIKeychain(ctx, connectCRI, cri.WithImageNamespaces(imageNamespaces), cri.WithImageAnnotations(imageAnnotations))
 		runtime.RegisterImageServiceServer(rpc, criServer)
 		credsFuncs = append(credsFuncs, f)
 	}
 	fsOpts := []fs.Option{fs.WithMetricsLogLevel(logrus.InfoLevel)}
 	if config.IPFS {
-		fsOpts = append(fsOpts, fs.WithResolveHandler("ipfs", new(ipfs.ResolveHandler)))
+		fsOpts = append(fsOpts, fs.WithResolveHandler("ipfs", &ipfs.ResolveHandler{
+			Pin:      config.IPFSPin,
+			Gateways: config.IPFSGateways,
+		}))
+	}
+	if config.OCILayout {
+		fsOpts = append(fsOpts, fs.WithResolveHandler("oci-layout", new(ocilayout.ResolveHandler)))
+	}
+	if config.ContentStorePath != "" || config.KeepFetchedBlobsMB > 0 {
+		var csOpts []contentstore.Option
+		if config.KeepFetchedBlobsMB > 0 {
+			csOpts = append(csOpts, contentstore.WithKeptBlobs(filepath.Join(*rootDir, "kept-blobs"), config.KeepFetchedBlobsMB<<20))
+		}
+		h, err := contentstore.NewResolveHandler(config.ContentStorePath, csOpts...)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to configure content store")
+		}
+		fsOpts = append(fsOpts, fs.WithResolveHandler("content-store", h))
+		if config.KeepFetchedBlobsMB > 0 {
+			fsOpts = append(fsOpts, fs.WithBlobKeeper(h))
+		}
 	}
 	mt, err := getMetadataStore(*rootDir, config)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure metadata store")
 	}
 	fsOpts = append(fsOpts, fs.WithMetadataStore(mt))
-	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config,
-		service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
+	var adminMux *http.ServeMux
+	sOpts := []service.Option{service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...)}
+	if imageAnnotations != nil {
+		sOpts = append(sOpts, service.WithPodAnnotations(imageAnnotations.Annotations))
+	} else if config.PodFetchPriorityConfig.Enable {
+		log.G(ctx).Fatal("pod_fetch_priority requires CRI-based keychain")
+	}
+	if config.TransferServiceConfig.ReconstructLabels {
+		// connects to containerd serving the content store (defaults to containerd socket)
+		addr := defaultImageServiceAddress
+		if a := config.TransferServiceConfig.ContainerdAddress; a != "" {
+			addr = a
+		}
+		conn, err := grpc.Dial(dialer.DialAddress(addr), containerdDialOptions()...)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to connect to containerd")
+		}
+		defer conn.Close()
+		sOpts = append(sOpts, service.WithContainerdContentStore(contentproxy.NewContentStore(contentapi.NewContentClient(conn))))
+	}
+	if config.AdminAddress != "" {
+		adminMux = http.NewServeMux()
+		sOpts = append(sOpts, service.WithAdminMux(adminMux))
+	}
+	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config, sOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
 
-	cleanup, err := serve(ctx, rpc, *address, rs, config)
+	cleanup, err := serve(ctx, rpc, *address, rs, config, adminMux)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
@@ -202,21 +292,51 @@ func main() {
 	log.G(ctx).Info("Exiting")
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig) (bool, error) {
+// containerdDialOptions returns the options to connect to the gRPC API of containerd.
+func containerdDialOptions() []grpc.DialOption {
+	// TODO: make gRPC options configurable from config.toml
+	backoffConfig := backoff.DefaultConfig
+	backoffConfig.MaxDelay = 3 * time.Second
+	connParams := grpc.ConnectParams{
+		Backoff: backoffConfig,
+	}
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(connParams),
+		grpc.WithContextDialer(dialer.ContextDialer),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(defaults.DefaultMaxRecvMsgSize)),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(defaults.DefaultMaxSendMsgSize)),
+	}
+}
+
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig, adminMux *http.ServeMux) (bool, error) {
 	// Convert the snapshotter to a gRPC service,
 	snsvc := snapshotservice.FromSnapshotter(rs)
 
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
 
-	// Prepare the directory for the socket
-	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
-		return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+	// Use the socket passed by the service manager (e.g. systemd socket unit) if any
+	l, err := activatedListener()
+	if err != nil {
+		return false, err
 	}
+	if l != nil {
+		log.G(ctx).Infof("serving on the activated socket %q", l.Addr())
+	} else {
+		// Prepare the directory for the socket
+		if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+			return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+		}
+
+		// Try to remove the socket file to avoid EADDRINUSE
+		if err := os.RemoveAll(addr); err != nil {
+			return false, fmt.Errorf("failed to remove %q: %w", addr, err)
+		}
 
-	// Try to remove the socket file to avoid EADDRINUSE
-	if err := os.RemoveAll(addr); err != nil {
-		return false, fmt.Errorf("failed to remove %q: %w", addr, err)
+		if l, err = net.Listen("unix", addr); err != nil {
+			return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
+		}
 	}
 
 	errCh := make(chan error, 1)
@@ -249,11 +369,20 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}()
 	}
 
-	// Listen and serve
-	l, err := net.Listen("unix", addr)
-	if err != nil {
-		return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
+	if config.AdminAddress != "" && adminMux != nil {
+		log.G(ctx).Infof("listen %q for admin API", config.AdminAddress)
+		l, err := sys.GetLocalListener(config.AdminAddress, 0, 0)
+		if err != nil {
+			return false, fmt.Errorf("failed to listen %q: %w", config.AdminAddress, err)
+		}
+		go func() {
+			if err := http.Serve(l, adminMux); err != nil {
+				errCh <- fmt.Errorf("error on serving the admin API via socket %q: %w", config.AdminAddress, err)
+			}
+		}()
 	}
+
+	// Serve
 	go func() {
 		if err := rpc.Serve(l); err != nil {
 			errCh <- fmt.Errorf("error on serving via socket %q: %w", addr, err)
@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/pkg/userns"
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+const snapshotterName = "containerd-stargz-grpc"
+
+// isRootless reports if the snapshotter runs as a non-root user or in a user namespace.
+var isRootless = func() bool {
+	return os.Geteuid() != 0 || userns.RunningInUserNS()
+}
+
+type paths struct {
+	address    string
+	configPath string
+	rootDir    string
+}
+
+// defaultPaths returns the default paths of the socket, the config file and the
+// root directory. If the snapshotter runs rootless (i.e. as a non-root user or
+// in a user namespace like RootlessKit's one) and XDG_RUNTIME_DIR is set, paths
+// under XDG base directories are used as rootless containerd does.
+func defaultPaths() paths {
+	p := paths{
+		address:    defaultAddress,
+		configPath: defaultConfigPath,
+		rootDir:    defaultRootDir,
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if !isRootless() || runtimeDir == "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" && home != "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	p.address = filepath.Join(runtimeDir, snapshotterName, snapshotterName+".sock")
+	if configHome != "" {
+		p.configPath = filepath.Join(configHome, snapshotterName, "config.toml")
+	}
+	if dataHome != "" {
+		p.rootDir = filepath.Join(dataHome, snapshotterName)
+	}
+	return p
+}
+
+// activatedListener returns the listener of the socket passed with socket
+// activation (LISTEN_FDS), if any.
+func activatedListener() (net.Listener, error) {
+	ls, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activated sockets: %w", err)
+	}
+	var l net.Listener
+	for _, sl := range ls {
+		if sl == nil {
+			continue // not a stream socket
+		}
+		if l != nil {
+			return nil, fmt.Errorf("only one activated socket is supported")
+		}
+		l = sl
+	}
+	return l, nil
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDefaultPaths(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("home directory is unknown: %v", err)
+	}
+	rootPaths := paths{address: defaultAddress, configPath: defaultConfigPath, rootDir: defaultRootDir}
+	for _, tt := range []struct {
+		name     string
+		rootless bool
+		env      map[string]string
+		want     paths
+	}{
+		{
+			name: "root",
+			env:  map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000"},
+			want: rootPaths,
+		},
+		{
+			name:     "rootless_without_runtime_dir",
+			rootless: true,
+			want:     rootPaths,
+		},
+		{
+			name:     "rootless",
+			rootless: true,
+			env:      map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000"},
+			want: paths{
+				address:    "/run/user/1000/containerd-stargz-grpc/containerd-stargz-grpc.sock",
+				configPath: filepath.Join(home, ".config", "containerd-stargz-grpc", "config.toml"),
+				rootDir:    filepath.Join(home, ".local", "share", "containerd-stargz-grpc"),
+			},
+		},
+		{
+			name:     "rootless_xdg_dirs",
+			rootless: true,
+			env: map[string]string{
+				"XDG_RUNTIME_DIR": "/run/user/1000",
+				"XDG_CONFIG_HOME": "/tmp/config",
+				"XDG_DATA_HOME":   "/tmp/data",
+			},
+			want: paths{
+				address:    "/run/user/1000/containerd-stargz-grpc/containerd-stargz-grpc.sock",
+				configPath: "/tmp/config/containerd-stargz-grpc/config.toml",
+				rootDir:    "/tmp/data/containerd-stargz-grpc",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRootless(tt.rootless)()
+			for _, k := range []string{"XDG_RUNTIME_DIR", "XDG_CONFIG_HOME", "XDG_DATA_HOME"} {
+				defer setenv(t, k, tt.env[k])()
+			}
+			if got := defaultPaths(); got != tt.want {
+				t.Errorf("defaultPaths() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func setRootless(rootless bool) (restore func()) {
+	orig := isRootless
+	isRootless = func() bool { return rootless }
+	return func() { isRootless = orig }
+}
+
+// setenv sets the environment variable (or unsets it if v is empty) and
+// returns the function to restore it.
+func setenv(t *testing.T, k, v string) (restore func()) {
+	orig, ok := os.LookupEnv(k)
+	var err error
+	if v == "" {
+		err = os.Unsetenv(k)
+	} else {
+		err = os.Setenv(k, v)
+	}
+	if err != nil {
+		t.Fatalf("failed to set %s: %v", k, err)
+	}
+	return func() {
+		if ok {
+			os.Setenv(k, orig)
+		} else {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestActivatedListener(t *testing.T) {
+	defer setenv(t, "LISTEN_PID", "")()
+	defer setenv(t, "LISTEN_FDS", "")()
+	if l, err := activatedListener(); err != nil || l != nil {
+		t.Fatalf("no listener must be returned without socket activation; got %v, %v", l, err)
+	}
+
+	tmp := t.TempDir()
+	listen := func(name string) *os.File {
+		l, err := net.Listen("unix", filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer l.Close()
+		f, err := l.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatalf("failed to get the file of the listener: %v", err)
+		}
+		return f
+	}
+	packetConn := func() *os.File {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen packets: %v", err)
+		}
+		defer c.Close()
+		f, err := c.(*net.UDPConn).File()
+		if err != nil {
+			t.Fatalf("failed to get the file of the packet conn: %v", err)
+		}
+		return f
+	}
+	for _, tt := range []struct {
+		name     string
+		files    []*os.File
+		wantAddr string
+		wantErr  bool
+	}{
+		{name: "single", files: []*os.File{listen("single.sock")}, wantAddr: filepath.Join(tmp, "single.sock")},
+		{name: "with_packet_conn", files: []*os.File{packetConn(), listen("stream.sock")}, wantAddr: filepath.Join(tmp, "stream.sock")},
+		{name: "multiple", files: []*os.File{listen("a.sock"), listen("b.sock")}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The sockets are passed to a child process as systemd does because
+			// they must start from fd 3.
+			cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedListenerHelper$")
+			cmd.Env = append(os.Environ(), "TEST_ACTIVATED_LISTENER=1", "LISTEN_FDS="+strconv.Itoa(len(tt.files)))
+			cmd.ExtraFiles = tt.files
+			out, err := cmd.CombinedOutput()
+			for _, f := range tt.files {
+				f.Close()
+			}
+			if err != nil {
+				t.Fatalf("helper failed: %v: %s", err, out)
+			}
+			got := strings.TrimSpace(string(out))
+			if tt.wantErr {
+				if !strings.HasPrefix(got, "error:") {
+					t.Errorf("activatedListener must fail; got %q", got)
+				}
+				return
+			}
+			if got != "addr:"+tt.wantAddr {
+				t.Errorf("activated listener %q; want %q", got, "addr:"+tt.wantAddr)
+			}
+		})
+	}
+}
+
+// TestActivatedListenerHelper prints the result of activatedListener in the child
+// process of TestActivatedListener.
+func TestActivatedListenerHelper(t *testing.T) {
+	if os.Getenv("TEST_ACTIVATED_LISTENER") != "1" {
+		t.Skip("only run by TestActivatedListener")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	l, err := activatedListener()
+	switch {
+	case err != nil:
+		os.Stdout.WriteString("error:" + err.Error() + "\n")
+	case l == nil:
+		os.Stdout.WriteString("none\n")
+	default:
+		os.Stdout.WriteString("addr:" + l.Addr().String() + "\n")
+		l.Close()
+	}
+	os.Exit(0)
+}
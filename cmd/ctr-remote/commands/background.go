@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/urfave/cli"
+)
+
+// BackgroundFetchCommand pauses and resumes background fetches of the snapshotter
+var BackgroundFetchCommand = cli.Command{
+	Name:  "background-fetch",
+	Usage: "pause and resume background fetches of stargz snapshotter",
+	Subcommands: []cli.Command{
+		backgroundFetchPauseCommand,
+		backgroundFetchResumeCommand,
+		backgroundFetchStatusCommand,
+	},
+}
+
+var backgroundFetchPauseCommand = cli.Command{
+	Name:      "pause",
+	Usage:     "pause background fetches of all layers or of the layers of an image",
+	ArgsUsage: "[flags] [<ref>]",
+	Description: `Pause background fetches of the layers of the image or of all layers if no image
+is specified. Fetches for reading files of the layers aren't affected. The pause lasts
+until it's resumed or the snapshotter restarts.
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		st, err := admin.NewClient(clicontext.String("admin-address")).PauseBackgroundFetch(ctx,
+			admin.BackgroundFetchRequest{Reference: clicontext.Args().First()})
+		if err != nil {
+			return err
+		}
+		printBackgroundFetchStatus(st)
+		return nil
+	},
+}
+
+var backgroundFetchResumeCommand = cli.Command{
+	Name:      "resume",
+	Usage:     "resume paused background fetches",
+	ArgsUsage: "[flags] [<ref>]",
+	Description: `Resume background fetches of the layers of the image. If no image is specified,
+all pauses including ones of specific images are lifted.
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		st, err := admin.NewClient(clicontext.String("admin-address")).ResumeBackgroundFetch(ctx,
+			admin.BackgroundFetchRequest{Reference: clicontext.Args().First()})
+		if err != nil {
+			return err
+		}
+		printBackgroundFetchStatus(st)
+		return nil
+	},
+}
+
+var backgroundFetchStatusCommand = cli.Command{
+	Name:  "status",
+	Usage: "show paused background fetches",
+	Flags: []cli.Flag{
+		adminAddressFlag,
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		st, err := admin.NewClient(clicontext.String("admin-address")).BackgroundFetchStatus(ctx)
+		if err != nil {
+			return err
+		}
+		printBackgroundFetchStatus(st)
+		return nil
+	},
+}
+
+func printBackgroundFetchStatus(st layer.BackgroundFetchStatus) {
+	switch {
+	case st.Paused:
+		fmt.Println("background fetch: paused for all images")
+	case len(st.PausedImages) > 0:
+		fmt.Printf("background fetch: paused for %s\n", strings.Join(st.PausedImages, ", "))
+	default:
+		fmt.Println("background fetch: running")
+	}
+}
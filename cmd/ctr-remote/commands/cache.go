@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/urfave/cli"
+)
+
+const defaultAdminAddress = "/run/containerd-stargz-grpc/admin.sock"
+
+var adminAddressFlag = cli.StringFlag{
+	Name:  "admin-address",
+	Usage: "address of the admin API of the snapshotter (\"admin_address\" in the snapshotter config)",
+	Value: defaultAdminAddress,
+}
+
+// CacheCommand manages the layer caches of the snapshotter
+var CacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "manage the layer caches of stargz snapshotter",
+	Subcommands: []cli.Command{
+		cacheUsageCommand,
+		cachePruneCommand,
+	},
+}
+
+var cacheUsageCommand = cli.Command{
+	Name:  "usage",
+	Usage: "show the disk usage of the layer caches per image",
+	Flags: []cli.Flag{
+		adminAddressFlag,
+		cli.BoolFlag{
+			Name:  "layers",
+			Usage: "show the usage of each layer",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		usage, err := admin.NewClient(clicontext.String("admin-address")).CacheUsage(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		if clicontext.Bool("layers") {
+			sort.Slice(usage, func(i, j int) bool { return usage[i].Reference < usage[j].Reference })
+			fmt.Fprintln(tw, "IMAGE\tDIGEST\tTYPE\tIN USE\tSIZE\tMODIFIED")
+			for _, u := range usage {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\t%s\n", imageName(u.Reference), u.Digest, u.Type, u.InUse,
+					progress.Bytes(u.Size), u.ModTime.Format("2006-01-02 15:04:05"))
+			}
+			return tw.Flush()
+		}
+		type imageUsage struct {
+			total, unused int64
+			layers        map[string]struct{}
+		}
+		images := make(map[string]*imageUsage)
+		var names []string
+		for _, u := range usage {
+			name := imageName(u.Reference)
+			iu, ok := images[name]
+			if !ok {
+				iu = &imageUsage{layers: make(map[string]struct{})}
+				images[name] = iu
+				names = append(names, name)
+			}
+			iu.total += u.Size
+			if !u.InUse {
+				iu.unused += u.Size
+			}
+			iu.layers[u.Digest.String()] = struct{}{}
+		}
+		sort.Strings(names)
+		fmt.Fprintln(tw, "IMAGE\tLAYERS\tTOTAL\tUNREFERENCED")
+		for _, name := range names {
+			iu := images[name]
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", name, len(iu.layers), progress.Bytes(iu.total), progress.Bytes(iu.unused))
+		}
+		return tw.Flush()
+	},
+}
+
+var cachePruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "remove layer caches that aren't referenced by the snapshotter",
+	Description: `Remove layer caches that aren't used by any layer currently resolved by
+the snapshotter (e.g. caches left by a previous run of the snapshotter).
+Caches in use are never removed.
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+		cli.StringFlag{
+			Name:  "image",
+			Usage: "remove only caches of the specified image reference",
+		},
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "remove only caches not modified for the specified duration (e.g. 24h)",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		pruned, err := admin.NewClient(clicontext.String("admin-address")).PruneCache(ctx, admin.PruneRequest{
+			Reference: clicontext.String("image"),
+			OlderThan: clicontext.Duration("older-than"),
+		})
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, u := range pruned {
+			fmt.Printf("removed %s (%s, %s)\n", u.Directory, imageName(u.Reference), progress.Bytes(u.Size))
+			total += u.Size
+		}
+		fmt.Printf("total reclaimed space: %s\n", progress.Bytes(total))
+		return nil
+	},
+}
+
+func imageName(ref string) string {
+	if ref == "" {
+		return "<unknown>"
+	}
+	return ref
+}
@@ -0,0 +1,196 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// CheckCommand reports whether layers of an image can be lazily pulled
+var CheckCommand = cli.Command{
+	Name:      "check",
+	Usage:     "check whether layers of an image can be lazily pulled",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Inspect each layer of an image stored in a registry and report whether
+it can be lazily pulled by stargz snapshotter.
+
+Only the manifest and the footer of each layer are fetched from the registry
+(using range requests) so the image doesn't need to be pulled beforehand.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "check the manifest of the specified platform (default: the current platform)",
+		},
+	),
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return errors.New("image reference need to be specified")
+		}
+		platform := platforms.DefaultSpec()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platform = p
+		}
+
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+
+		manifest, fetcher, err := fetchManifest(ctx, clicontext, ref, platform)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "DIGEST\tFORMAT\tLAZY\tREASON")
+		for _, desc := range manifest.Layers {
+			res := checkLayer(ctx, fetcher, desc)
+			fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", desc.Digest, res.format, res.lazy, res.reason)
+		}
+		return tw.Flush()
+	},
+}
+
+// fetchManifest resolves the reference against the registry and fetches the manifest
+// of the specified platform.
+func fetchManifest(ctx context.Context, clicontext *cli.Context, ref string, platform ocispec.Platform) (ocispec.Manifest, remotes.Fetcher, error) {
+	resolver, err := commands.GetResolver(ctx, clicontext)
+	if err != nil {
+		return ocispec.Manifest{}, nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return ocispec.Manifest{}, nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return ocispec.Manifest{}, nil, err
+	}
+	manifest, err := containerdutil.FetchManifestPlatform(ctx, fetcher, desc, platform)
+	if err != nil {
+		return ocispec.Manifest{}, nil, fmt.Errorf("failed to fetch manifest of %q: %w", ref, err)
+	}
+	return manifest, fetcher, nil
+}
+
+type layerCheckResult struct {
+	format string
+	lazy   bool
+	reason string
+}
+
+func checkLayer(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) layerCheckResult {
+	compression, err := images.DiffCompression(ctx, desc.MediaType)
+	if err != nil {
+		return layerCheckResult{format: "unknown", reason: fmt.Sprintf("unsupported media type %q", desc.MediaType)}
+	}
+	var decompressors []estargz.Decompressor
+	switch compression {
+	case "gzip":
+		decompressors = []estargz.Decompressor{new(estargz.GzipDecompressor), new(estargz.LegacyGzipDecompressor)}
+	case "zstd":
+		decompressors = []estargz.Decompressor{new(zstdchunked.Decompressor)}
+	case "":
+		return layerCheckResult{format: "tar", reason: "layer is not compressed; convert it to eStargz"}
+	default:
+		return layerCheckResult{format: compression, reason: fmt.Sprintf("unsupported compression %q", compression)}
+	}
+
+	var footerSize int64
+	for _, d := range decompressors {
+		if s := d.FooterSize(); footerSize < s && s <= desc.Size {
+			footerSize = s
+		}
+	}
+	if footerSize == 0 {
+		return layerCheckResult{format: compression, reason: "layer is too small to contain a footer"}
+	}
+	footer, err := fetchRange(ctx, fetcher, desc, desc.Size-footerSize, footerSize)
+	if err != nil {
+		return layerCheckResult{format: compression, reason: fmt.Sprintf("failed to fetch footer: %v", err)}
+	}
+	var found estargz.Decompressor
+	for _, d := range decompressors {
+		fSize := d.FooterSize()
+		if fSize > footerSize {
+			continue
+		}
+		if _, _, _, err := d.ParseFooter(footer[footerSize-fSize:]); err == nil {
+			found = d
+			break
+		}
+	}
+	if found == nil {
+		return layerCheckResult{format: compression, reason: "footer not found; convert the layer to eStargz or zstd:chunked"}
+	}
+
+	format := "estargz"
+	switch found.(type) {
+	case *estargz.LegacyGzipDecompressor:
+		format = "stargz"
+	case *zstdchunked.Decompressor:
+		format = "zstd:chunked"
+	}
+	if _, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; !ok {
+		return layerCheckResult{
+			format: format,
+			reason: fmt.Sprintf("no %q annotation; lazily pullable only when verification is skipped", estargz.TOCJSONDigestAnnotation),
+		}
+	}
+	return layerCheckResult{format: format, lazy: true, reason: "TOC digest is available for verification"}
+}
+
+// fetchRange reads the specified range of the blob. The underlying fetcher issues
+// a range request if it supports seeking.
+func fetchRange(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, offset, size int64) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if rs, ok := rc.(io.Seeker); ok {
+		if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+		return nil, err
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(rc, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -17,7 +17,9 @@
 package commands
 
 import (
+	"bytes"
 	"compress/gzip"
+	gocontext "context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,13 +27,20 @@ import (
 	"os/signal"
 
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/images/converter/uncompress"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/profile"
 	"github.com/containerd/stargz-snapshotter/recorder"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -48,8 +57,9 @@ e.g., 'ctr-remote convert --estargz --oci example.com/foo:orig example.com/foo:e
 
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
+Attestation manifests (e.g. provenance and SBOM) of the converted images are kept in the output index.
 `,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// estargz flags
 		cli.BoolFlag{
 			Name:  "estargz",
@@ -59,6 +69,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "estargz-record-in",
 			Usage: "Read 'ctr-remote optimize --record-out=<FILE>' record file",
 		},
+		cli.BoolFlag{
+			Name:  "estargz-profile",
+			Usage: "Fetch the profile pushed by 'ctr-remote optimize --push-profile' from the repository of the source image and prioritize the recorded files",
+		},
 		cli.IntFlag{
 			Name:  "estargz-compression-level",
 			Usage: "eStargz compression level",
@@ -93,7 +107,15 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "all-platforms",
 			Usage: "Convert content for all platforms",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "keep-unconverted-platforms",
+			Usage: "Keep images of platforms not specified by '--platform' in the output index as they are, instead of removing them",
+		},
+		cli.BoolFlag{
+			Name:  "copy-referrers",
+			Usage: "Copy referrers (e.g. signatures and SBOMs) of the source images to the target repository, attaching them to the converted images",
+		},
+	}, commands.RegistryFlags...),
 	Action: func(context *cli.Context) error {
 		var (
 			convertOpts = []converter.Opt{}
@@ -122,7 +144,6 @@ When '--all-platforms' is given all images in a manifest list must be available.
 				platformMC = platforms.DefaultStrict()
 			}
 		}
-		convertOpts = append(convertOpts, converter.WithPlatform(platformMC))
 
 		var layerConvertFunc converter.ConvertFunc
 		if context.Bool("estargz") {
@@ -163,17 +184,87 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		if layerConvertFunc == nil {
 			return errors.New("specify layer converter")
 		}
-		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
 
-		if context.Bool("oci") {
-			convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
+		srcLocal, err := parseLocalImage(srcRef)
+		if err != nil {
+			return err
 		}
-
-		client, ctx, cancel, err := commands.NewClient(context)
+		dstLocal, err := parseLocalImage(targetRef)
 		if err != nil {
 			return err
 		}
+		var (
+			client converter.Client
+			ctx    gocontext.Context
+			cancel gocontext.CancelFunc
+		)
+		if srcLocal != nil && dstLocal != nil {
+			// Both images are local so containerd isn't needed.
+			root, err := os.MkdirTemp("", "ctr-remote-convert-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(root)
+			client, err = newLocalClient(root)
+			if err != nil {
+				return err
+			}
+			ctx, cancel = commands.AppContext(context)
+		} else {
+			c, cctx, ccancel, err := commands.NewClient(context)
+			if err != nil {
+				return err
+			}
+			client, ctx, cancel = c, cctx, ccancel
+		}
 		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		if context.Bool("estargz-profile") {
+			if !context.Bool("estargz") && !context.Bool("zstdchunked") {
+				return errors.New("option --estargz-profile must be used in conjunction with --estargz or --zstdchunked")
+			}
+			if context.String("estargz-record-in") != "" {
+				return errors.New("option --estargz-profile conflicts with --estargz-record-in")
+			}
+			if srcLocal != nil {
+				return errors.New("option --estargz-profile can't be used for local images")
+			}
+			layerOpts, err := getProfileLayerOpts(ctx, context, client, srcRef)
+			if err != nil {
+				return fmt.Errorf("failed to get profile: %w", err)
+			}
+			esgzOpts, err := getESGZConvertOpts(context)
+			if err != nil {
+				return err
+			}
+			if context.Bool("zstdchunked") {
+				layerConvertFunc = func(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+					return zstdchunkedconvert.LayerConvertFunc(append(esgzOpts, layerOpts[desc.Digest]...)...)(ctx, cs, desc)
+				}
+			} else {
+				layerConvertFunc = estargzconvert.LayerConvertWithLayerAndCommonOptsFunc(layerOpts, esgzOpts...)
+			}
+		}
+		var indexOpts []nativeconverter.Option
+		if context.Bool("keep-unconverted-platforms") {
+			indexOpts = append(indexOpts, nativeconverter.WithKeepUnconvertedPlatforms())
+		}
+		converted := make(map[digest.Digest]ocispec.Descriptor) // source digest -> converted descriptor
+		if context.Bool("copy-referrers") {
+			if srcLocal != nil || dstLocal != nil {
+				return errors.New("option --copy-referrers can't be used for local images")
+			}
+			indexOpts = append(indexOpts, nativeconverter.WithConvertHook(func(orig, c ocispec.Descriptor) {
+				converted[orig.Digest] = c
+			}))
+		}
+		convertOpts = append(convertOpts, converter.WithIndexConvertFunc(
+			nativeconverter.IndexConvertFunc(layerConvertFunc, context.Bool("oci"), platformMC, indexOpts...)))
 
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, os.Interrupt)
@@ -186,15 +277,63 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			case <-ctx.Done():
 			}
 		}()
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
+		srcName, cleanup, err := importSourceImage(ctx, client, srcRef)
+		if err != nil {
+			return fmt.Errorf("failed to import %q: %w", srcRef, err)
+		}
+		defer cleanup()
+		dstName := targetRef
+		if dstLocal != nil {
+			dstName = dstLocal.String()
+		}
+		newImg, err := converter.Convert(ctx, client, dstName, srcName, convertOpts...)
 		if err != nil {
 			return err
 		}
+		if err := exportTargetImage(ctx, client, targetRef, newImg, platformMC); err != nil {
+			return fmt.Errorf("failed to export %q: %w", targetRef, err)
+		}
+		if context.Bool("copy-referrers") {
+			if err := copyReferrers(ctx, context, srcRef, targetRef, converted); err != nil {
+				return fmt.Errorf("failed to copy referrers: %w", err)
+			}
+		}
 		fmt.Fprintln(context.App.Writer, newImg.Target.Digest.String())
 		return nil
 	},
 }
 
+// copyReferrers copies referrers of the source manifests to the target repository as
+// referrers of the converted manifests. converted maps digests of the source manifests
+// to the converted ones.
+func copyReferrers(ctx gocontext.Context, context *cli.Context, srcRef, targetRef string, converted map[digest.Digest]ocispec.Descriptor) error {
+	srcSpec, err := reference.Parse(srcRef)
+	if err != nil {
+		return err
+	}
+	targetSpec, err := reference.Parse(targetRef)
+	if err != nil {
+		return err
+	}
+	resolver, opts, err := referrersResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+	for orig, desc := range converted {
+		if orig == desc.Digest && srcSpec.Locator == targetSpec.Locator {
+			continue // already attached
+		}
+		copied, err := referrers.Copy(ctx, resolver, srcRef, orig, targetRef, desc, opts...)
+		if err != nil {
+			return err
+		}
+		if len(copied) > 0 {
+			logrus.WithField("subject", desc.Digest).Infof("copied %d referrers of %v", len(copied), orig)
+		}
+	}
+	return nil
+}
+
 func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 	esgzOpts := []estargz.Option{
 		estargz.WithCompressionLevel(context.Int("estargz-compression-level")),
@@ -212,6 +351,50 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 	return esgzOpts, nil
 }
 
+// getProfileLayerOpts fetches the profile of the source image from the registry and
+// returns options to prioritize the recorded files of each layer. Only the manifest
+// for the current platform is profiled.
+func getProfileLayerOpts(ctx gocontext.Context, context *cli.Context, client converter.Client, srcRef string) (map[digest.Digest][]estargz.Option, error) {
+	cs := client.ContentStore()
+	srcImg, err := client.ImageService().Get(ctx, srcRef)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, srcImg.Target, platforms.DefaultStrict())
+	if err != nil {
+		return nil, err
+	}
+	p, err := content.ReadBlob(ctx, cs, manifestDesc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return nil, err
+	}
+	resolver, opts, err := referrersResolver(ctx, context)
+	if err != nil {
+		return nil, err
+	}
+	record, err := profile.Fetch(ctx, resolver, srcRef, manifestDesc.Digest, opts...)
+	if err != nil {
+		return nil, err
+	}
+	layerFiles, err := profile.LayerFiles(bytes.NewReader(record), manifestDesc.Digest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	layerOpts := make(map[digest.Digest][]estargz.Option, len(layerFiles))
+	for dgst, files := range layerFiles {
+		var ignored []string
+		layerOpts[dgst] = []estargz.Option{
+			estargz.WithPrioritizedFiles(files),
+			estargz.WithAllowPrioritizeNotFound(&ignored),
+		}
+	}
+	return layerOpts, nil
+}
+
 func readPathsFromRecordFile(filename string) ([]string, error) {
 	r, err := os.Open(filename)
 	if err != nil {
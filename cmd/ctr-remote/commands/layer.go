@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+// LayerCommand manages layers mounted by the snapshotter
+var LayerCommand = cli.Command{
+	Name:  "layer",
+	Usage: "manage layers mounted by stargz snapshotter",
+	Subcommands: []cli.Command{
+		layerResidentCommand,
+		layerMountCommand,
+		layerUmountCommand,
+	},
+}
+
+var layerResidentCommand = cli.Command{
+	Name:      "resident",
+	Usage:     "fetch all remaining contents of mounted layers",
+	ArgsUsage: "[flags] [<ref>]",
+	Description: `Fetch, verify and cache all contents of the mounted layers of the image which
+aren't cached yet, so that containers keep working during outages of the registry.
+Layers can be selected by the layer digest (--digest) as well. This waits until all
+layers are cached and reports the progress.
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+		cli.StringFlag{
+			Name:  "digest",
+			Usage: "digest of the layer to fetch",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		req := admin.ResidentRequest{Reference: clicontext.Args().First()}
+		if d := clicontext.String("digest"); d != "" {
+			dgst, err := digest.Parse(d)
+			if err != nil {
+				return err
+			}
+			req.Digest = dgst
+		}
+		if req.Reference == "" && req.Digest == "" {
+			return errors.New("image reference or --digest must be specified")
+		}
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		var failed int
+		if err := admin.NewClient(clicontext.String("admin-address")).MakeResident(ctx, req, func(p admin.ResidentProgress) {
+			status := "fetching"
+			if p.Error != "" {
+				status = "failed: " + p.Error
+				failed++
+			} else if p.Done {
+				status = "done"
+			}
+			fmt.Printf("%s (%s): %s/%s %s\n", p.Digest, imageName(p.Reference), progress.Bytes(p.Fetched), progress.Bytes(p.Size), status)
+		}); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to fetch %d layers", failed)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,277 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service"
+	dockerconfigkeychain "github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/moby/sys/mountinfo"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pelletier/go-toml"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const defaultSnapshotterConfigPath = "/etc/containerd-stargz-grpc/config.toml"
+
+var layerMountCommand = cli.Command{
+	Name:      "mount",
+	Usage:     "mount a layer standalone for debugging",
+	ArgsUsage: "[flags] <ref> <digest> <mountpoint>",
+	Description: `Mount a layer of the image read-only at the mountpoint with the filesystem of
+stargz snapshotter but without containerd and the snapshotter. This prints the stats
+of the TOC of the layer and serves reads until it's interrupted or the layer is
+unmounted by "ctr-remote layer umount". Each fetch from the registry is logged with
+the path and the range of the read file.
+
+The filesystem and registry hosts are configured by the config file of the
+snapshotter (--config) and credentials are read from the docker config file.
+Background fetch is disabled unless --background-fetch is specified so that all
+fetches are caused by reads.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the config file of stargz snapshotter",
+			Value: defaultSnapshotterConfigPath,
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "directory to store the cache of the layer (default: a temporary directory removed on exit)",
+		},
+		cli.BoolFlag{
+			Name:  "background-fetch",
+			Usage: "fetch the entire layer in background",
+		},
+		cli.BoolFlag{
+			Name:  "no-prefetch",
+			Usage: "don't prefetch the prioritized files of the layer",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		if clicontext.NArg() != 3 {
+			return errors.New("image reference, layer digest and mountpoint must be specified")
+		}
+		ref, mountpoint := clicontext.Args().Get(0), clicontext.Args().Get(2)
+		dgst, err := digest.Parse(clicontext.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			return err
+		}
+		if mountpoint, err = filepath.Abs(mountpoint); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logrus.SetLevel(logrus.DebugLevel)
+		golog.SetOutput(log.G(ctx).WriterLevel(logrus.DebugLevel)) // go-fuse logs
+
+		var config service.Config
+		configPath := clicontext.String("config")
+		tree, err := toml.LoadFile(configPath)
+		if err != nil && !(os.IsNotExist(err) && configPath == defaultSnapshotterConfigPath) {
+			return fmt.Errorf("failed to load config file %q: %w", configPath, err)
+		} else if err == nil {
+			if err := tree.Unmarshal(&config); err != nil {
+				return fmt.Errorf("failed to unmarshal config file %q: %w", configPath, err)
+			}
+		}
+		config.NoBackgroundFetch = !clicontext.Bool("background-fetch")
+		config.NoPrefetch = config.NoPrefetch || clicontext.Bool("no-prefetch")
+		config.NoPrometheus = true
+		config.FetchAuditConfig.Enable = true // log all fetches
+		config.FetchAuditConfig.Path = ""
+		config.FetchAuditConfig.SampleRate = 1
+		config.FetchAuditConfig.MinLatencyMSec = 0
+
+		root := clicontext.String("root")
+		if root == "" {
+			if root, err = os.MkdirTemp("", "ctr-remote-layer-mount"); err != nil {
+				return err
+			}
+			defer os.RemoveAll(root)
+		}
+
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), dockerconfigkeychain.NewDockerconfigKeychain(ctx))
+		desc, unmount, err := mountLayer(ctx, root, config, hosts, refspec, dgst, mountpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := unmount(); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to unmount %q", mountpoint)
+			}
+		}()
+
+		fmt.Printf("mounted layer %s (%s) of %s at %s\n", dgst, progress.Bytes(desc.Size), refspec, mountpoint)
+		if err := printTOCStats(os.Stdout, mountpoint); err != nil {
+			return err
+		}
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case s := <-sigCh:
+				fmt.Printf("received %v; unmounting %s\n", s, mountpoint)
+				return nil
+			case <-t.C:
+				if mounted, err := mountinfo.Mounted(mountpoint); err == nil && !mounted {
+					fmt.Printf("%s is unmounted\n", mountpoint)
+					return nil
+				}
+			}
+		}
+	},
+}
+
+var layerUmountCommand = cli.Command{
+	Name:      "umount",
+	Usage:     "unmount a layer mounted by \"ctr-remote layer mount\"",
+	ArgsUsage: "<mountpoint>",
+	Action: func(clicontext *cli.Context) error {
+		mountpoint := clicontext.Args().First()
+		if mountpoint == "" {
+			return errors.New("mountpoint must be specified")
+		}
+		if err := syscall.Unmount(mountpoint, 0); err != nil {
+			// Unprivileged users need fusermount to unmount FUSE filesystems
+			if out, ferr := exec.Command("fusermount", "-u", mountpoint).CombinedOutput(); ferr != nil {
+				return fmt.Errorf("failed to unmount %q: %v: %v: %s", mountpoint, err, ferr, string(out))
+			}
+		}
+		return nil
+	},
+}
+
+// mountLayer mounts the layer of the image at the mountpoint with the filesystem
+// of stargz snapshotter. This returns the descriptor of the layer and the function
+// to unmount it.
+func mountLayer(ctx context.Context, root string, config service.Config, hosts source.RegistryHosts, refspec reference.Spec, dgst digest.Digest, mountpoint string) (ocispec.Descriptor, func() error, error) {
+	desc, labels, err := layerLabels(ctx, hosts, refspec, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	fs, err := stargzfs.NewFilesystem(root, config.Config, stargzfs.WithGetSources(source.FromDefaultLabels(hosts)))
+	if err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to configure filesystem: %w", err)
+	}
+	if err := fs.Mount(ctx, mountpoint, labels); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to mount layer %v: %w", dgst, err)
+	}
+	return desc, func() error { return fs.Unmount(ctx, mountpoint) }, nil
+}
+
+// layerLabels returns the descriptor of the layer in the image and the labels passed
+// to the filesystem for mounting the layer, which are passed by containerd during
+// lazy pulling.
+func layerLabels(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, dgst digest.Digest) (ocispec.Descriptor, map[string]string, error) {
+	r := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != refspec.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, refspec.String())
+			}
+			return hosts(refspec)
+		},
+	})
+	_, img, err := r.Resolve(ctx, refspec.String())
+	if err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to resolve %q: %w", refspec, err)
+	}
+	fetcher, err := r.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	manifest, err := containerdutil.FetchManifestPlatform(ctx, fetcher, img, platforms.DefaultSpec())
+	if err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to fetch manifest of %q: %w", refspec, err)
+	}
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest}
+	if img.MediaType == ocispec.MediaTypeImageManifest || img.MediaType == images.MediaTypeDockerSchema2Manifest {
+		manifestDesc.Digest = img.Digest
+	}
+	layers, err := source.AppendDefaultLabelsHandlerWrapper(refspec.String(), 0)(
+		images.HandlerFunc(func(context.Context, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			return manifest.Layers, nil
+		}),
+	).Handle(ctx, manifestDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	for _, l := range layers {
+		if l.Digest == dgst {
+			return l, l.Annotations, nil
+		}
+	}
+	return ocispec.Descriptor{}, nil, fmt.Errorf("layer %v isn't contained in %q", dgst, refspec)
+}
+
+// printTOCStats prints the stats of the entries in the mounted layer. This doesn't
+// fetch file contents because only the metadata in the TOC is read.
+func printTOCStats(w io.Writer, mountpoint string) error {
+	var dirs, files, symlinks, others, size int64
+	if err := filepath.Walk(mountpoint, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			dirs++
+		case info.Mode().IsRegular():
+			files++
+			size += info.Size()
+		case info.Mode()&os.ModeSymlink != 0:
+			symlinks++
+		default:
+			others++
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to walk the layer: %w", err)
+	}
+	fmt.Fprintf(w, "%d directories, %d files (%s), %d symlinks, %d other entries\n", dirs, files, progress.Bytes(size), symlinks, others)
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMountLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting FUSE requires root")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("FUSE is unavailable: %v", err)
+	}
+
+	// zstd:chunked is used so the layer doesn't depend on the gzip footer.
+	sr, tocDigest, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("a/"),
+		testutil.File("a/foo", "hello"),
+		testutil.Symlink("a/link", "../bar"),
+		testutil.File("bar", "world!"),
+		testutil.Fifo("fifo"),
+	}, testutil.WithEStargzOptions(estargz.WithCompression(&zstdCompression{&zstdchunked.Compressor{CompressionLevel: zstd.SpeedDefault}, &zstdchunked.Decompressor{}})))
+	if err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	blob, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDesc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerZstd,
+		Digest:      digest.FromBytes(blob),
+		Size:        int64(len(blob)),
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest.String()},
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("{}"), Size: 2},
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifest)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/manifests/latest"), strings.HasSuffix(req.URL.Path, "/manifests/"+manifestDigest.String()):
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(manifest))
+		case strings.Contains(req.URL.Path, "/blobs/") && name == layerDesc.Digest.String():
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       srv.Client(),
+			Host:         srv.Listener.Addr().String(),
+			Scheme:       "http",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+		}}, nil
+	}
+	refspec, err := reference.Parse(srv.Listener.Addr().String() + "/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config service.Config
+	config.NoBackgroundFetch = true
+	config.NoPrometheus = true
+	mountpoint := t.TempDir()
+	ctx := context.Background()
+	desc, unmount, err := mountLayer(ctx, t.TempDir(), config, hosts, refspec, layerDesc.Digest, mountpoint)
+	if err != nil {
+		t.Fatalf("failed to mount layer: %v", err)
+	}
+	defer func() {
+		if err := unmount(); err != nil {
+			t.Errorf("failed to unmount: %v", err)
+		}
+	}()
+	if desc.Digest != layerDesc.Digest || desc.Size != layerDesc.Size {
+		t.Errorf("mounted layer %v (%d bytes); want %v (%d bytes)", desc.Digest, desc.Size, layerDesc.Digest, layerDesc.Size)
+	}
+
+	var out bytes.Buffer
+	if err := printTOCStats(&out, mountpoint); err != nil {
+		t.Fatalf("failed to print TOC stats: %v", err)
+	}
+	if want := "2 directories, 2 files (11.0 B), 1 symlinks, 1 other entries\n"; out.String() != want {
+		t.Errorf("TOC stats = %q; want %q", out.String(), want)
+	}
+	if data, err := os.ReadFile(filepath.Join(mountpoint, "a", "foo")); err != nil || string(data) != "hello" {
+		t.Errorf("a/foo = %q, %v; want %q", string(data), err, "hello")
+	}
+}
+
+type zstdCompression struct {
+	*zstdchunked.Compressor
+	*zstdchunked.Decompressor
+}
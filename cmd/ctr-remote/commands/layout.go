@@ -0,0 +1,499 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	ociLayoutScheme     = "oci-layout://"
+	dockerArchiveScheme = "docker-archive://"
+)
+
+// localImage is an image stored in a local OCI layout directory or a docker archive
+// ("docker save" format) instead of a containerd image store.
+//
+// It's specified as "oci-layout://<dir>[:<tag>]" or "docker-archive://<file>[:<name>]".
+type localImage struct {
+	scheme string
+	path   string
+
+	// name is the tag in the OCI layout or the image name in the docker archive.
+	// This can be empty if the source contains only one image.
+	name string
+}
+
+// parseLocalImage parses the reference of a local image. nil is returned if
+// the reference doesn't point to a local image.
+func parseLocalImage(ref string) (*localImage, error) {
+	var li localImage
+	for _, s := range []string{ociLayoutScheme, dockerArchiveScheme} {
+		if strings.HasPrefix(ref, s) {
+			li.scheme = s
+			break
+		}
+	}
+	if li.scheme == "" {
+		return nil, nil
+	}
+	li.path = strings.TrimPrefix(ref, li.scheme)
+	if li.scheme == ociLayoutScheme {
+		// The directory can contain ':' so the tag follows the last ':' of the last element.
+		if i := strings.LastIndex(li.path, ":"); i > strings.LastIndex(li.path, "/") {
+			li.path, li.name = li.path[:i], li.path[i+1:]
+		}
+	} else if i := strings.Index(li.path, ":"); i >= 0 {
+		// The image name in the docker archive can contain ':' and '/' (e.g. "example.com:5000/foo:1").
+		li.path, li.name = li.path[:i], li.path[i+1:]
+	}
+	if li.path == "" {
+		return nil, fmt.Errorf("path must be specified in %q", ref)
+	}
+	return &li, nil
+}
+
+func (li *localImage) String() string {
+	if li.name == "" {
+		return li.scheme + li.path
+	}
+	return li.scheme + li.path + ":" + li.name
+}
+
+// importSourceImage imports the source image into the content store of the client if it's
+// a local image. This returns the name of the source image in the image store of the
+// client and the function to remove the imported image from the image store.
+func importSourceImage(ctx context.Context, client converter.Client, srcRef string) (string, func(), error) {
+	li, err := parseLocalImage(srcRef)
+	if err != nil || li == nil {
+		return srcRef, func() {}, err
+	}
+	desc, err := importLocalImage(ctx, client.ContentStore(), li)
+	if err != nil {
+		return "", nil, err
+	}
+	is := client.ImageService()
+	name := li.String()
+	_ = is.Delete(ctx, name)
+	if _, err := is.Create(ctx, images.Image{Name: name, Target: desc}); err != nil {
+		return "", nil, err
+	}
+	return name, func() { is.Delete(ctx, name) }, nil
+}
+
+// exportTargetImage writes the converted image to the target if it's a local image. The
+// converted image is removed from the image store of the client in that case.
+func exportTargetImage(ctx context.Context, client converter.Client, targetRef string, img *images.Image, platformMC platforms.MatchComparer) error {
+	li, err := parseLocalImage(targetRef)
+	if err != nil || li == nil {
+		return err
+	}
+	defer client.ImageService().Delete(ctx, img.Name)
+	return exportLocalImage(ctx, client.ContentStore(), li, img.Target, platformMC)
+}
+
+// newLocalClient returns a client for converting images without containerd. Contents
+// are stored in the specified directory and images are stored in memory.
+func newLocalClient(root string) (converter.Client, error) {
+	cs, err := local.NewLabeledStore(root, &memoryLabelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		return nil, err
+	}
+	return &localClient{cs: cs, is: &memoryImageStore{images: make(map[string]images.Image)}}, nil
+}
+
+type localClient struct {
+	cs content.Store
+	is images.Store
+}
+
+func (c *localClient) WithLease(ctx context.Context, opts ...leases.Opt) (context.Context, func(context.Context) error, error) {
+	// contents are never garbage collected
+	return ctx, func(context.Context) error { return nil }, nil
+}
+
+func (c *localClient) ContentStore() content.Store { return c.cs }
+
+func (c *localClient) ImageService() images.Store { return c.is }
+
+// memoryLabelStore is a label store of the local content store on memory.
+type memoryLabelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func (s *memoryLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyLabels(s.labels[dgst]), nil
+}
+
+func (s *memoryLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = copyLabels(labels)
+	return nil
+}
+
+func (s *memoryLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return copyLabels(labels), nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// memoryImageStore is an image store on memory.
+type memoryImageStore struct {
+	images map[string]images.Image
+	mu     sync.Mutex
+}
+
+func (s *memoryImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", name, errdefs.ErrNotFound)
+	}
+	return img, nil
+}
+
+func (s *memoryImageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []images.Image
+	for _, img := range s.images {
+		res = append(res, img)
+	}
+	return res, nil
+}
+
+func (s *memoryImageStore) Create(ctx context.Context, image images.Image) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[image.Name]; ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", image.Name, errdefs.ErrAlreadyExists)
+	}
+	s.images[image.Name] = image
+	return image, nil
+}
+
+func (s *memoryImageStore) Update(ctx context.Context, image images.Image, fieldpaths ...string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[image.Name]; !ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", image.Name, errdefs.ErrNotFound)
+	}
+	s.images[image.Name] = image
+	return image, nil
+}
+
+func (s *memoryImageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[name]; !ok {
+		return fmt.Errorf("image %q: %w", name, errdefs.ErrNotFound)
+	}
+	delete(s.images, name)
+	return nil
+}
+
+// importLocalImage stores the contents of the local image into the content store and
+// returns the descriptor of the image.
+func importLocalImage(ctx context.Context, cs content.Store, li *localImage) (ocispec.Descriptor, error) {
+	switch li.scheme {
+	case ociLayoutScheme:
+		provider := layoutProvider(li.path)
+		var index ocispec.Index
+		if err := readJSONFile(filepath.Join(li.path, "index.json"), &index); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to read index of OCI layout: %w", err)
+		}
+		desc, err := selectManifest(index.Manifests, li)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		copyHandler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			ra, err := provider.ReaderAt(ctx, desc)
+			if err != nil {
+				if errdefs.IsNotFound(err) && !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+					// Blobs of unused platforms can be missing
+					return nil, images.ErrSkipDesc
+				}
+				return nil, err
+			}
+			defer ra.Close()
+			if err := content.WriteBlob(ctx, cs, "import-"+desc.Digest.String(), io.NewSectionReader(ra, 0, ra.Size()), desc); err != nil {
+				return nil, fmt.Errorf("failed to import %v: %w", desc.Digest, err)
+			}
+			return nil, nil
+		})
+		if err := images.Walk(ctx, images.Handlers(copyHandler, images.ChildrenHandler(cs)), desc); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		return desc, nil
+	case dockerArchiveScheme:
+		f, err := os.Open(li.path)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer f.Close()
+		idxDesc, err := archive.ImportIndex(ctx, cs, f)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to import %q: %w", li.path, err)
+		}
+		p, err := content.ReadBlob(ctx, cs, idxDesc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(p, &index); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		return selectManifest(index.Manifests, li)
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("unknown scheme %q", li.scheme)
+}
+
+// selectManifest selects the image specified by the local image from the manifests in an index.
+func selectManifest(manifests []ocispec.Descriptor, li *localImage) (ocispec.Descriptor, error) {
+	if li.name == "" {
+		if len(manifests) != 1 {
+			return ocispec.Descriptor{}, fmt.Errorf("%q contains %d images; specify the image name", li.path, len(manifests))
+		}
+		return manifests[0], nil
+	}
+	for _, m := range manifests {
+		if m.Annotations[ocispec.AnnotationRefName] == li.name || m.Annotations[images.AnnotationImageName] == li.name {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image %q not found in %q: %w", li.name, li.path, errdefs.ErrNotFound)
+}
+
+// exportLocalImage writes the image in the content store to the local image.
+func exportLocalImage(ctx context.Context, cs content.Provider, li *localImage, desc ocispec.Descriptor, platformMC platforms.MatchComparer) error {
+	switch li.scheme {
+	case ociLayoutScheme:
+		copyHandler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			return nil, writeLayoutBlob(ctx, cs, li.path, desc)
+		})
+		if err := images.Walk(ctx, images.Handlers(copyHandler, images.ChildrenHandler(cs)), desc); err != nil {
+			return err
+		}
+		layoutFile, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(li.path, ocispec.ImageLayoutFile), layoutFile, 0644); err != nil {
+			return err
+		}
+		// Add the image to the index, replacing the existing one with the same name.
+		indexPath := filepath.Join(li.path, "index.json")
+		index := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+		if err := readJSONFile(indexPath, &index); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read index of OCI layout: %w", err)
+		}
+		var manifests []ocispec.Descriptor
+		for _, m := range index.Manifests {
+			if li.name == "" || m.Annotations[ocispec.AnnotationRefName] != li.name {
+				manifests = append(manifests, m)
+			}
+		}
+		if li.name != "" {
+			annotations := make(map[string]string)
+			for k, v := range desc.Annotations {
+				annotations[k] = v
+			}
+			annotations[ocispec.AnnotationRefName] = li.name
+			desc.Annotations = annotations
+		}
+		index.Manifests = append(manifests, desc)
+		p, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(indexPath, p, 0644)
+	case dockerArchiveScheme:
+		f, err := os.Create(li.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var names []string
+		if li.name != "" {
+			names = append(names, li.name)
+		}
+		return archive.Export(ctx, cs, f, archive.WithManifest(desc, names...), archive.WithPlatform(platformMC))
+	}
+	return fmt.Errorf("unknown scheme %q", li.scheme)
+}
+
+func writeLayoutBlob(ctx context.Context, cs content.Provider, root string, desc ocispec.Descriptor) error {
+	dir := filepath.Join(root, "blobs", desc.Digest.Algorithm().String())
+	target := filepath.Join(dir, desc.Digest.Encoded())
+	if _, err := os.Stat(target); err == nil {
+		return nil // already exists
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	f, err := os.CreateTemp(dir, ".tmp-"+desc.Digest.Encoded())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, io.NewSectionReader(ra, 0, ra.Size()))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+// layoutProvider provides blobs stored in an OCI layout directory.
+type layoutProvider string
+
+func (p layoutProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	f, err := os.Open(filepath.Join(string(p), "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %v: %w", desc.Digest, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReaderAt{f, fi.Size()}, nil
+}
+
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (r *fileReaderAt) Size() int64 { return r.size }
+
+// layoutResolver resolves images stored in OCI layout directories. References must be
+// "oci-layout://<dir>[:<tag>]".
+type layoutResolver struct{}
+
+func (layoutResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	li, err := parseLocalImage(ref)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if li == nil || li.scheme != ociLayoutScheme {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%q isn't an image in OCI layout", ref)
+	}
+	var index ocispec.Index
+	if err := readJSONFile(filepath.Join(li.path, "index.json"), &index); err != nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("failed to read index of OCI layout: %w", err)
+	}
+	desc, err := selectManifest(index.Manifests, li)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	return ref, desc, nil
+}
+
+func (layoutResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	li, err := parseLocalImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	if li == nil || li.scheme != ociLayoutScheme {
+		return nil, fmt.Errorf("%q isn't an image in OCI layout", ref)
+	}
+	return layoutFetcher{layoutProvider(li.path)}, nil
+}
+
+func (layoutResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return nil, fmt.Errorf("pushing to OCI layout isn't supported: %w", errdefs.ErrNotImplemented)
+}
+
+type layoutFetcher struct {
+	p layoutProvider
+}
+
+func (f layoutFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := f.p.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return ra.(*fileReaderAt).File, nil
+}
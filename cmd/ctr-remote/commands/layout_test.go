@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import "testing"
+
+func TestParseLocalImage(t *testing.T) {
+	for _, tt := range []struct {
+		ref  string
+		want *localImage
+	}{
+		{ref: "oci-layout://./foo", want: &localImage{scheme: ociLayoutScheme, path: "./foo"}},
+		{ref: "oci-layout://./foo:v1", want: &localImage{scheme: ociLayoutScheme, path: "./foo", name: "v1"}},
+		{ref: "oci-layout:///images/2023-01-01T00:00:00/foo", want: &localImage{scheme: ociLayoutScheme, path: "/images/2023-01-01T00:00:00/foo"}},
+		{ref: "oci-layout:///images/a:b/foo:v1", want: &localImage{scheme: ociLayoutScheme, path: "/images/a:b/foo", name: "v1"}},
+		{ref: "docker-archive://foo.tar", want: &localImage{scheme: dockerArchiveScheme, path: "foo.tar"}},
+		{ref: "docker-archive://foo.tar:example.com:5000/foo:v1", want: &localImage{scheme: dockerArchiveScheme, path: "foo.tar", name: "example.com:5000/foo:v1"}},
+		{ref: "example.com/foo:v1"},
+	} {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseLocalImage(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseLocalImage(%q) = %+v; want %+v", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
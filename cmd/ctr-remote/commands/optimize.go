@@ -35,10 +35,12 @@ import (
 	"github.com/containerd/stargz-snapshotter/analyzer"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
-	"github.com/containerd/stargz-snapshotter/recorder"
+	"github.com/containerd/stargz-snapshotter/profile"
 	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
@@ -78,6 +80,14 @@ var OptimizeCommand = cli.Command{
 			Name:  "record-out",
 			Usage: "record the monitor log to the specified file",
 		},
+		cli.BoolFlag{
+			Name:  "push-profile",
+			Usage: "push the recorded file access profile to the repository of the source image as an artifact referring to it",
+		},
+		cli.BoolFlag{
+			Name:  "profile-plain-http",
+			Usage: "allow connections using plain HTTP when pushing the profile",
+		},
 		cli.BoolFlag{
 			Name:  "oci",
 			Usage: "convert Docker media types to OCI media types",
@@ -118,11 +128,7 @@ var OptimizeCommand = cli.Command{
 				platformMC = platforms.DefaultStrict()
 			}
 		}
-		convertOpts = append(convertOpts, converter.WithPlatform(platformMC))
-
-		if clicontext.Bool("oci") {
-			convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
-		} else if clicontext.Bool("zstdchunked") {
+		if !clicontext.Bool("oci") && clicontext.Bool("zstdchunked") {
 			return errors.New("option --zstdchunked must be used in conjunction with --oci")
 		}
 
@@ -138,7 +144,20 @@ var OptimizeCommand = cli.Command{
 		}
 		defer done(ctx)
 
-		recordOut, esgzOptsPerLayer, wrapper, err := analyze(ctx, clicontext, client, srcRef)
+		// Local images are imported to containerd because the analyzer needs to run them
+		srcName, cleanup, err := importSourceImage(ctx, client, srcRef)
+		if err != nil {
+			return fmt.Errorf("failed to import %q: %w", srcRef, err)
+		}
+		defer cleanup()
+		dstName := targetRef
+		if dstLocal, err := parseLocalImage(targetRef); err != nil {
+			return err
+		} else if dstLocal != nil {
+			dstName = dstLocal.String()
+		}
+
+		recordOut, esgzOptsPerLayer, wrapper, err := analyze(ctx, clicontext, client, srcName)
 		if err != nil {
 			return err
 		}
@@ -147,6 +166,17 @@ var OptimizeCommand = cli.Command{
 				return fmt.Errorf("failed output record file: %w", err)
 			}
 		}
+		if clicontext.Bool("push-profile") {
+			if recordOut == "" {
+				return errors.New("no profile is recorded; --push-profile can't be used with --no-optimize or non-default platforms")
+			}
+			if srcName != srcRef {
+				return errors.New("option --push-profile can't be used for local images")
+			}
+			if err := pushProfile(ctx, clicontext, client, srcRef, recordOut); err != nil {
+				return fmt.Errorf("failed to push profile: %w", err)
+			}
+		}
 		var f converter.ConvertFunc
 		if clicontext.Bool("zstdchunked") {
 			f = zstdchunkedconvert.LayerConvertWithLayerOptsFunc(esgzOptsPerLayer)
@@ -170,11 +200,15 @@ var OptimizeCommand = cli.Command{
 			case <-ctx.Done():
 			}
 		}()
-		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
+		convertOpts = append(convertOpts, converter.WithIndexConvertFunc(
+			nativeconverter.IndexConvertFunc(layerConvertFunc, clicontext.Bool("oci"), platformMC)))
+		newImg, err := converter.Convert(ctx, client, dstName, srcName, convertOpts...)
 		if err != nil {
 			return err
 		}
+		if err := exportTargetImage(ctx, client, targetRef, newImg, platformMC); err != nil {
+			return fmt.Errorf("failed to export %q: %w", targetRef, err)
+		}
 		fmt.Fprintln(clicontext.App.Writer, newImg.Target.Digest.String())
 		return nil
 	},
@@ -195,6 +229,33 @@ func writeContentFile(ctx context.Context, client *containerd.Client, dgst diges
 	return err
 }
 
+// pushProfile pushes the record to the repository of the source image as a profile of
+// the manifest of the current platform.
+func pushProfile(ctx context.Context, clicontext *cli.Context, client *containerd.Client, srcRef string, recordOut digest.Digest) error {
+	cs := client.ContentStore()
+	srcImg, err := client.ImageService().Get(ctx, srcRef)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, srcImg.Target, platforms.DefaultStrict())
+	if err != nil {
+		return err
+	}
+	record, err := content.ReadBlob(ctx, cs, ocispec.Descriptor{Digest: recordOut})
+	if err != nil {
+		return err
+	}
+	// "--user" of this command is the user of the container so registry credentials
+	// are taken from the docker config.
+	resolver, hosts := dockerconfigResolver(ctx, clicontext.Bool("profile-plain-http"))
+	desc, err := profile.Push(ctx, resolver, srcRef, manifestDesc, record, referrers.WithRegistryHosts(hosts))
+	if err != nil {
+		return err
+	}
+	logrus.WithField("digest", desc.Digest).Infof("pushed profile of %v", manifestDesc.Digest)
+	return nil
+}
+
 func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Client, srcRef string) (digest.Digest, map[digest.Digest][]estargz.Option, func(converter.ConvertFunc) converter.ConvertFunc, error) {
 	if clicontext.Bool("no-optimize") {
 		return "", nil, nil, nil
@@ -264,31 +325,14 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 	if err := json.Unmarshal(p, &manifest); err != nil {
 		return "", nil, nil, err
 	}
-	// TODO: this should be indexed by layer "index" (not "digest")
-	layerLogs := make(map[digest.Digest][]string, len(manifest.Layers))
 	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
 	if err != nil {
 		return "", nil, nil, err
 	}
 	defer ra.Close()
-	dec := json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size()))
-	added := make(map[digest.Digest]map[string]struct{}, len(manifest.Layers))
-	for dec.More() {
-		var e recorder.Entry
-		if err := dec.Decode(&e); err != nil {
-			return "", nil, nil, err
-		}
-		if *e.LayerIndex < len(manifest.Layers) &&
-			e.ManifestDigest == manifestDesc.Digest.String() {
-			dgst := manifest.Layers[*e.LayerIndex].Digest
-			if added[dgst] == nil {
-				added[dgst] = map[string]struct{}{}
-			}
-			if _, ok := added[dgst][e.Path]; !ok {
-				added[dgst][e.Path] = struct{}{}
-				layerLogs[dgst] = append(layerLogs[dgst], e.Path)
-			}
-		}
+	layerLogs, err := profile.LayerFiles(io.NewSectionReader(ra, 0, ra.Size()), manifestDesc.Digest, manifest)
+	if err != nil {
+		return "", nil, nil, err
 	}
 
 	// Create a converter wrapper for skipping layer conversion. This skip occurs
@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/urfave/cli"
+)
+
+// OrphanCommand manages leftovers of crashes of the snapshotter
+var OrphanCommand = cli.Command{
+	Name:  "orphans",
+	Usage: "manage leftovers of crashes of stargz snapshotter",
+	Subcommands: []cli.Command{
+		orphanCleanupCommand,
+	},
+}
+
+var orphanCleanupCommand = cli.Command{
+	Name:  "cleanup",
+	Usage: "clean up mounts, directories and caches that don't belong to live snapshots",
+	Description: `Unmount and remove mounts and snapshot directories that don't belong to live
+snapshots (e.g. left by a crash), and remove layer caches that aren't used by the
+snapshotter. Dead FUSE mounts of live snapshots are unmounted and mounted again.
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		res, err := admin.NewClient(clicontext.String("admin-address")).CleanupOrphans(ctx)
+		if err != nil {
+			return err
+		}
+		for _, mp := range res.Unmounted {
+			fmt.Printf("unmounted %s\n", mp)
+		}
+		for _, key := range res.Restored {
+			fmt.Printf("restored %s\n", key)
+		}
+		for _, dir := range res.Removed {
+			fmt.Printf("removed %s\n", dir)
+		}
+		var total int64
+		for _, u := range res.Caches {
+			fmt.Printf("removed %s (%s, %s)\n", u.Directory, imageName(u.Reference), progress.Bytes(u.Size))
+			total += u.Size
+		}
+		fmt.Printf("total reclaimed cache space: %s\n", progress.Bytes(total))
+		return nil
+	},
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
+	dockerconfigkeychain "github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	"github.com/urfave/cli"
+)
+
+// dockerconfigResolver returns a resolver which uses credentials stored in the docker config
+// file (~/.docker/config.json). This is used by commands whose "--user" flag isn't
+// for registry credentials. The hosts of the resolver are also returned for the
+// Referrers API.
+func dockerconfigResolver(ctx context.Context, plainHTTP bool) (remotes.Resolver, docker.RegistryHosts) {
+	keychain := dockerconfigkeychain.NewDockerconfigKeychain(ctx)
+	hostOptions := dockerconfig.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			// The docker config is keyed only by the host
+			return keychain(host, reference.Spec{})
+		},
+	}
+	if plainHTTP {
+		hostOptions.DefaultScheme = "http"
+	}
+	hosts := dockerconfig.ConfigureHosts(ctx, hostOptions)
+	return docker.NewResolver(docker.ResolverOptions{Hosts: hosts}), hosts
+}
+
+// referrersResolver returns a resolver configured by the registry flags of ctr and
+// the options to use the Referrers API with the same configuration. Unlike ctr, the
+// password must be passed as "--user <user>:<password>" if the user is specified;
+// otherwise credentials stored in the docker config file are used.
+func referrersResolver(ctx context.Context, clicontext *cli.Context) (remotes.Resolver, []referrers.Option, error) {
+	var credentials func(host string) (string, string, error)
+	if username := clicontext.String("user"); username != "" {
+		i := strings.IndexByte(username, ':')
+		if i <= 0 {
+			return nil, nil, errors.New("password must be specified as --user <user>:<password>")
+		}
+		credentials = func(string) (string, string, error) { return username[:i], username[i+1:], nil }
+	} else if rt := clicontext.String("refresh"); rt != "" {
+		credentials = func(string) (string, string, error) { return "", rt, nil }
+	} else {
+		keychain := dockerconfigkeychain.NewDockerconfigKeychain(ctx)
+		credentials = func(host string) (string, string, error) {
+			return keychain(host, reference.Spec{})
+		}
+	}
+	hostOptions := dockerconfig.HostOptions{Credentials: credentials}
+	if clicontext.Bool("plain-http") {
+		hostOptions.DefaultScheme = "http"
+	}
+	defaultTLS, err := registryDefaultTLS(clicontext)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostOptions.DefaultTLS = defaultTLS
+	if hostDir := clicontext.String("hosts-dir"); hostDir != "" {
+		hostOptions.HostDir = dockerconfig.HostDirFromRoot(hostDir)
+	}
+	hosts := dockerconfig.ConfigureHosts(ctx, hostOptions)
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts, Tracker: commands.PushTracker})
+	return resolver, []referrers.Option{referrers.WithRegistryHosts(hosts)}, nil
+}
+
+// registryDefaultTLS returns the TLS config specified by the registry flags of ctr.
+func registryDefaultTLS(clicontext *cli.Context) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: clicontext.Bool("skip-verify")}
+	if tlsRootPath := clicontext.String("tlscacert"); tlsRootPath != "" {
+		tlsRootData, err := os.ReadFile(tlsRootPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", tlsRootPath, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(tlsRootData) {
+			return nil, fmt.Errorf("failed to load TLS CAs from %q: invalid data", tlsRootPath)
+		}
+	}
+	tlsCertPath, tlsKeyPath := clicontext.String("tlscert"), clicontext.String("tlskey")
+	if tlsCertPath != "" || tlsKeyPath != "" {
+		if tlsCertPath == "" || tlsKeyPath == "" {
+			return nil, errors.New("flags --tlscert and --tlskey must be set together")
+		}
+		keyPair, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client credentials (cert=%q, key=%q): %w", tlsCertPath, tlsKeyPath, err)
+		}
+		config.Certificates = []tls.Certificate{keyPair}
+	}
+	return config, nil
+}
@@ -18,7 +18,10 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
@@ -30,6 +33,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/ipfs"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
@@ -45,6 +49,7 @@ var RpullCommand = cli.Command{
 	Usage:     "pull an image from a registry levaraging stargz snapshotter",
 	ArgsUsage: "[flags] <ref>",
 	Description: `Fetch and prepare an image for use in containerd levaraging stargz snapshotter.
+The reference can be an image in an OCI layout directory ("oci-layout://<dir>[:<tag>]").
 
 After pulling an image, it should be ready to use the same reference in a run
 command. 
@@ -58,6 +63,22 @@ command.
 			Name:  "ipfs",
 			Usage: "Pull image from IPFS. Specify an IPFS CID as a reference. (experimental)",
 		},
+		cli.StringFlag{
+			Name:  "ztoc-index",
+			Usage: "Lazily pull gzip layers using the ztoc index created by 'ctr-remote image ztoc'. The index must be in the same repository as the image.",
+		},
+		cli.BoolFlag{
+			Name:  "ztoc-referrer",
+			Usage: "Lazily pull gzip layers using the ztoc index pushed by 'ctr-remote image ztoc --push-referrer' as a referrer of the image",
+		},
+		cli.DurationFlag{
+			Name:  "record-profile",
+			Usage: "Record files read during the specified duration after the layers are mounted as a file access profile on the snapshotter's node (e.g. 60s)",
+		},
+		cli.StringFlag{
+			Name:  "background-fetch",
+			Usage: "Background fetch of the layers overriding the snapshotter's config (\"off\", \"on\" or \"full\" to fetch the entire layers at the mount)",
+		},
 	), commands.SnapshotterFlags...),
 	Action: func(context *cli.Context) error {
 		var (
@@ -89,6 +110,29 @@ command.
 		if context.Bool(skipContentVerifyOpt) {
 			config.skipVerify = true
 		}
+		config.recordProfile = context.Duration("record-profile")
+		switch bf := context.String("background-fetch"); bf {
+		case "", "off", "on", "full":
+			config.backgroundFetch = bf
+		default:
+			return fmt.Errorf("invalid background fetch mode %q", bf)
+		}
+
+		li, err := parseLocalImage(ref)
+		if err != nil {
+			return err
+		}
+		if li != nil {
+			if li.scheme != ociLayoutScheme {
+				return fmt.Errorf("lazy pulling from %q isn't supported", li.scheme)
+			}
+			// The snapshotter reads blobs from the directory so the path must be absolute.
+			if li.path, err = filepath.Abs(li.path); err != nil {
+				return err
+			}
+			ref = li.String()
+			config.Resolver = layoutResolver{}
+		}
 
 		if context.Bool("ipfs") {
 			ipfsClient, err := httpapi.NewLocalApi()
@@ -103,6 +147,21 @@ command.
 			}
 			config.Resolver = r
 		}
+		if indexRef := context.String("ztoc-index"); indexRef != "" {
+			if context.Bool("ztoc-referrer") {
+				return errors.New("option --ztoc-index conflicts with --ztoc-referrer")
+			}
+			if config.ztocs, err = fetchZtocIndex(ctx, config.Resolver, indexRef); err != nil {
+				return err
+			}
+		} else if context.Bool("ztoc-referrer") {
+			if li != nil || context.Bool("ipfs") {
+				return errors.New("option --ztoc-referrer can't be used for local or IPFS images")
+			}
+			if config.ztocs, err = fetchZtocReferrer(ctx, context, ref); err != nil {
+				return fmt.Errorf("failed to fetch ztoc index: %w", err)
+			}
+		}
 		config.snapshotter = remoteSnapshotterName
 		if sn := context.String("snapshotter"); sn != "" {
 			config.snapshotter = sn
@@ -114,8 +173,11 @@ command.
 
 type rPullConfig struct {
 	*content.FetchConfig
-	skipVerify  bool
-	snapshotter string
+	skipVerify      bool
+	recordProfile   time.Duration
+	backgroundFetch string
+	snapshotter     string
+	ztocs           map[digest.Digest]digest.Digest
 }
 
 func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
@@ -135,6 +197,27 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		}))
 	}
 
+	if config.recordProfile > 0 {
+		snOpts = append(snOpts, snapshots.WithLabels(map[string]string{
+			fsconfig.TargetRecordProfileLabel: config.recordProfile.String(),
+		}))
+	}
+
+	if config.backgroundFetch != "" {
+		snOpts = append(snOpts, snapshots.WithLabels(map[string]string{
+			fsconfig.TargetBackgroundFetchLabel: config.backgroundFetch,
+		}))
+	}
+
+	wrapper := source.AppendDefaultLabelsHandlerWrapper(ref, 10*1024*1024)
+	if len(config.ztocs) > 0 {
+		appendZtocLabels := appendZtocLabelsHandlerWrapper(config.ztocs)
+		appendDefaultLabels := wrapper
+		wrapper = func(f images.Handler) images.Handler {
+			return appendZtocLabels(appendDefaultLabels(f))
+		}
+	}
+
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
 	labels := commands.LabelArgs(config.Labels)
 	if _, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
@@ -144,7 +227,7 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		containerd.WithSchema1Conversion,
 		containerd.WithPullUnpack,
 		containerd.WithPullSnapshotter(config.snapshotter, snOpts...),
-		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(ref, 10*1024*1024)),
+		containerd.WithImageHandlerWrapper(wrapper),
 	}...); err != nil {
 		return err
 	}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/urfave/cli"
+)
+
+// ImageStatsCommand shows the statistics of fetches and cache hits per image
+var ImageStatsCommand = cli.Command{
+	Name:  "stats",
+	Usage: "show the bytes fetched and the cache hit ratio of lazily pulled images",
+	Description: `Show the statistics of the images whose layers are mounted by stargz snapshotter.
+HIT RATIO is the ratio of bytes read from files served from the cache in the last 5 minutes
+("-" if nothing is read).
+`,
+	Flags: []cli.Flag{
+		adminAddressFlag,
+	},
+	Action: func(clicontext *cli.Context) error {
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		stats, err := admin.NewClient(clicontext.String("admin-address")).ImageStats(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "IMAGE\tNAMESPACE\tSIZE\tON DEMAND\tPREFETCH\tBACKGROUND\tHIT RATIO")
+		for _, st := range stats {
+			ratio := "-"
+			if st.CacheHitRatio != nil {
+				ratio = fmt.Sprintf("%.1f%%", *st.CacheHitRatio*100)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", imageName(st.Image), st.Namespace, progress.Bytes(st.Size),
+				progress.Bytes(st.OnDemandBytes), progress.Bytes(st.PrefetchBytes), progress.Bytes(st.BackgroundBytes), ratio)
+		}
+		return tw.Flush()
+	},
+}
@@ -0,0 +1,228 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// VerifyCommand verifies TOCs of an image stored in a registry
+var VerifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify TOCs of eStargz layers in an image without pulling it",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Verify the TOC of each eStargz layer of an image stored in a registry against
+the TOC digest annotation in the manifest.
+
+Only the manifest, footers and TOCs are fetched from the registry (using range
+requests). When --sample is specified, the specified number of chunks are
+randomly chosen from each layer and verified against the chunk digests in the TOC.
+
+This command fails if any layer fails the verification.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "verify the manifest of the specified platform (default: the current platform)",
+		},
+		cli.IntFlag{
+			Name:  "sample",
+			Usage: "number of chunks to verify per layer",
+		},
+	),
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return errors.New("image reference need to be specified")
+		}
+		platform := platforms.DefaultSpec()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platform = p
+		}
+
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+
+		manifest, fetcher, err := fetchManifest(ctx, clicontext, ref, platform)
+		if err != nil {
+			return err
+		}
+
+		var failed int
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "DIGEST\tRESULT\tCHUNKS\tDETAIL")
+		for _, desc := range manifest.Layers {
+			res := verifyLayer(ctx, fetcher, desc, clicontext.Int("sample"))
+			if res.result == verifyFailed {
+				failed++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", desc.Digest, res.result, res.chunks, res.detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d layer(s) failed verification", failed)
+		}
+		return nil
+	},
+}
+
+const (
+	verifyOK      = "OK"
+	verifyFailed  = "FAILED"
+	verifySkipped = "SKIPPED"
+)
+
+type layerVerifyResult struct {
+	result string
+	chunks int // number of verified chunks
+	detail string
+}
+
+func verifyLayer(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, sample int) layerVerifyResult {
+	tocDgstStr, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]
+	if !ok {
+		return layerVerifyResult{result: verifySkipped, detail: fmt.Sprintf("no %q annotation", estargz.TOCJSONDigestAnnotation)}
+	}
+	tocDgst, err := digest.Parse(tocDgstStr)
+	if err != nil {
+		return layerVerifyResult{result: verifyFailed, detail: fmt.Sprintf("invalid TOC digest %q: %v", tocDgstStr, err)}
+	}
+	sr := io.NewSectionReader(&remoteReaderAt{ctx, fetcher, desc}, 0, desc.Size)
+	r, err := estargz.Open(sr, estargz.WithDecompressors(new(zstdchunked.Decompressor)))
+	if err != nil {
+		return layerVerifyResult{result: verifyFailed, detail: fmt.Sprintf("failed to parse TOC: %v", err)}
+	}
+	v, err := r.VerifyTOC(tocDgst)
+	if err != nil {
+		return layerVerifyResult{result: verifyFailed, detail: err.Error()}
+	}
+	if sample <= 0 {
+		return layerVerifyResult{result: verifyOK, detail: "TOC digest matched"}
+	}
+
+	chunks := sampleChunks(r, sample)
+	for i, c := range chunks {
+		if err := verifyChunk(r, v, c); err != nil {
+			return layerVerifyResult{result: verifyFailed, chunks: i, detail: err.Error()}
+		}
+	}
+	return layerVerifyResult{result: verifyOK, chunks: len(chunks), detail: "TOC digest and sampled chunks matched"}
+}
+
+type chunk struct {
+	name  string
+	entry *estargz.TOCEntry
+}
+
+// sampleChunks randomly chooses n chunks from the layer.
+func sampleChunks(r *estargz.Reader, n int) []chunk {
+	var all []chunk
+	var walk func(dir string, e *estargz.TOCEntry)
+	walk = func(dir string, e *estargz.TOCEntry) {
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			name := path.Join(dir, baseName)
+			switch ent.Type {
+			case "dir":
+				walk(name, ent)
+			case "reg":
+				for off := int64(0); off < ent.Size; {
+					ce, ok := r.ChunkEntryForOffset(name, off)
+					if !ok || ce.ChunkSize <= 0 {
+						break
+					}
+					all = append(all, chunk{name, ce})
+					off = ce.ChunkOffset + ce.ChunkSize
+				}
+			}
+			return true
+		})
+	}
+	if root, ok := r.Lookup(""); ok {
+		walk("", root)
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func verifyChunk(r *estargz.Reader, v estargz.TOCEntryVerifier, c chunk) error {
+	dv, err := v.Verifier(c.entry)
+	if err != nil {
+		return fmt.Errorf("no digest for chunk of %q at %d: %w", c.name, c.entry.ChunkOffset, err)
+	}
+	fr, err := r.OpenFile(c.name)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", c.name, err)
+	}
+	if _, err := io.Copy(dv, io.NewSectionReader(fr, c.entry.ChunkOffset, c.entry.ChunkSize)); err != nil {
+		return fmt.Errorf("failed to read chunk of %q at %d: %w", c.name, c.entry.ChunkOffset, err)
+	}
+	if !dv.Verified() {
+		return fmt.Errorf("invalid chunk of %q at %d: digest mismatch", c.name, c.entry.ChunkOffset)
+	}
+	return nil
+}
+
+// remoteReaderAt reads the blob in a registry using range requests.
+type remoteReaderAt struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+}
+
+func (ra *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= ra.desc.Size {
+		return 0, io.EOF
+	}
+	size := int64(len(p))
+	if remain := ra.desc.Size - off; remain < size {
+		size = remain
+	}
+	b, err := fetchRange(ra.ctx, ra.fetcher, ra.desc, off, size)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,399 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	"github.com/containerd/stargz-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// ZtocCommand creates the ztoc index of an image
+var ZtocCommand = cli.Command{
+	Name:      "ztoc",
+	Usage:     "create the ztoc index for lazily pulling an image without converting it",
+	ArgsUsage: "[flags] <image_ref> [<index_ref>]",
+	Description: `Create the ztoc index of the gzip layers of an image stored in containerd.
+
+The index is stored as <index_ref>. Push it to the same repository as the image
+and pull the image with 'ctr-remote image rpull --ztoc-index <index_ref> <image_ref>'.
+The layers of the image don't need to be converted.
+
+e.g., 'ctr-remote image ztoc example.com/foo:1 example.com/foo:1-ztoc'
+
+With '--push-referrer', the index is pushed to the repository of the image as a
+referrer of the image manifest instead and <index_ref> isn't needed. Pull the image
+with 'ctr-remote image rpull --ztoc-referrer <image_ref>'.
+`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Create the index for a specific platform",
+		},
+		cli.Int64Flag{
+			Name:  "span-size",
+			Usage: "Approximate distance between checkpoints in the uncompressed layer",
+			Value: 4 << 20,
+		},
+		cli.Int64Flag{
+			Name:  "chunk-size",
+			Usage: "Size of chunks of file contents to be verified",
+			Value: 4 << 20,
+		},
+		cli.BoolFlag{
+			Name:  "push-referrer",
+			Usage: "Push the index to the repository of the image as a referrer of the image manifest",
+		},
+	}, commands.RegistryFlags...),
+	Action: func(clicontext *cli.Context) error {
+		srcRef := clicontext.Args().Get(0)
+		indexRef := clicontext.Args().Get(1)
+		pushReferrer := clicontext.Bool("push-referrer")
+		if srcRef == "" || (indexRef == "" && !pushReferrer) {
+			return errors.New("image and index need to be specified")
+		}
+		if indexRef != "" && pushReferrer {
+			return errors.New("index can't be specified with --push-referrer")
+		}
+		platformMC := platforms.DefaultStrict()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platformMC = platforms.OnlyStrict(p)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		is := client.ImageService()
+		cs := client.ContentStore()
+		img, err := is.Get(ctx, srcRef)
+		if err != nil {
+			return err
+		}
+		indexDesc, err := createZtocIndex(ctx, cs, img.Target, platformMC,
+			ztoc.WithSpanSize(clicontext.Int64("span-size")), ztoc.WithChunkSize(clicontext.Int64("chunk-size")))
+		if err != nil {
+			return err
+		}
+		if pushReferrer {
+			manifestDesc, err := manifestDescriptor(ctx, cs, img.Target, platformMC)
+			if err != nil {
+				return err
+			}
+			desc, err := pushZtocReferrer(ctx, clicontext, cs, srcRef, manifestDesc, indexDesc)
+			if err != nil {
+				return fmt.Errorf("failed to push ztoc index: %w", err)
+			}
+			fmt.Println(desc.Digest.String())
+			return nil
+		}
+		index := images.Image{Name: indexRef, Target: indexDesc}
+		if _, err := is.Create(ctx, index); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, index); err != nil {
+				return err
+			}
+		}
+		fmt.Println(indexDesc.Digest.String())
+		return nil
+	},
+}
+
+// createZtocIndex builds ztocs of the gzip layers of the image and stores the index to the
+// content store.
+func createZtocIndex(ctx context.Context, cs content.Store, target ocispec.Descriptor, platformMC platforms.MatchComparer, opts ...ztoc.Option) (ocispec.Descriptor, error) {
+	manifest, err := images.Manifest(ctx, cs, target, platformMC)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	manifestDesc, err := manifestDescriptor(ctx, cs, target, platformMC)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	gcLabels := make(map[string]string)
+	var ztocs []ocispec.Descriptor
+	for _, l := range manifest.Layers {
+		if l.MediaType != ocispec.MediaTypeImageLayerGzip && l.MediaType != images.MediaTypeDockerSchema2LayerGzip {
+			continue
+		}
+		if _, ok := l.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+			continue // eStargz layers can be lazily pulled without ztoc.
+		}
+		desc, err := writeZtoc(ctx, cs, l, opts...)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to create ztoc of %v: %w", l.Digest, err)
+		}
+		gcLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", len(ztocs))] = desc.Digest.String()
+		ztocs = append(ztocs, desc)
+	}
+	if len(ztocs) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no gzip layer to be indexed")
+	}
+
+	configDesc, err := writeJSON(ctx, cs, ztoc.MediaTypeIndexConfig, struct{}{}, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	gcLabels["containerd.io/gc.ref.content.config"] = configDesc.Digest.String()
+	return writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    ztocs,
+		Annotations: map[string]string{
+			ztoc.ImageManifestAnnotation: manifestDesc.Digest.String(),
+		},
+	}, gcLabels)
+}
+
+func writeZtoc(ctx context.Context, cs content.Store, layer ocispec.Descriptor, opts ...ztoc.Option) (ocispec.Descriptor, error) {
+	ra, err := cs.ReaderAt(ctx, layer)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+	z, err := ztoc.Build(io.NewSectionReader(ra, 0, ra.Size()), opts...)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	p, err := ztoc.Marshal(z)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ztoc.MediaTypeZtoc,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+		Annotations: map[string]string{
+			ztoc.LayerDigestAnnotation: layer.Digest.String(),
+		},
+	}
+	if err := content.WriteBlob(ctx, cs, "ztoc-"+desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v interface{}, labels map[string]string) (ocispec.Descriptor, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	if err := content.WriteBlob(ctx, cs, "ztoc-index-"+desc.Digest.String(), bytes.NewReader(p), desc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// manifestDescriptor returns the descriptor of the platform-specific manifest of the image.
+func manifestDescriptor(ctx context.Context, cs content.Store, target ocispec.Descriptor, platformMC platforms.MatchComparer) (ocispec.Descriptor, error) {
+	if !images.IsIndexType(target.MediaType) {
+		return target, nil
+	}
+	manifests, err := images.Children(ctx, cs, target)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, m := range manifests {
+		if images.IsManifestType(m.MediaType) && (m.Platform == nil || platformMC.Match(*m.Platform)) {
+			return m, nil
+		}
+		if images.IsIndexType(m.MediaType) {
+			if d, err := manifestDescriptor(ctx, cs, m, platformMC); err == nil {
+				return d, nil
+			}
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("manifest not found: %w", errdefs.ErrNotFound)
+}
+
+// pushZtocReferrer pushes the ztoc index stored in the content store to the repository of
+// the image as a referrer of the image manifest.
+func pushZtocReferrer(ctx context.Context, clicontext *cli.Context, cs content.Store, ref string, manifestDesc, indexDesc ocispec.Descriptor) (referrers.Descriptor, error) {
+	var index ocispec.Manifest
+	p, err := content.ReadBlob(ctx, cs, indexDesc)
+	if err != nil {
+		return referrers.Descriptor{}, err
+	}
+	if err := json.Unmarshal(p, &index); err != nil {
+		return referrers.Descriptor{}, err
+	}
+	blobs := make(map[digest.Digest][]byte)
+	for _, b := range append([]ocispec.Descriptor{index.Config}, index.Layers...) {
+		if blobs[b.Digest], err = content.ReadBlob(ctx, cs, b); err != nil {
+			return referrers.Descriptor{}, err
+		}
+	}
+	resolver, opts, err := referrersResolver(ctx, clicontext)
+	if err != nil {
+		return referrers.Descriptor{}, err
+	}
+	annotations := make(map[string]string)
+	for k, v := range index.Annotations {
+		annotations[k] = v
+	}
+	annotations[ocispec.AnnotationCreated] = time.Now().UTC().Format(time.RFC3339)
+	return referrers.Push(ctx, resolver, ref, referrers.Manifest{
+		ArtifactType: ztoc.IndexArtifactType,
+		Config:       index.Config,
+		Layers:       index.Layers,
+		Subject:      &ocispec.Descriptor{MediaType: manifestDesc.MediaType, Digest: manifestDesc.Digest, Size: manifestDesc.Size},
+		Annotations:  annotations,
+	}, blobs, opts...)
+}
+
+// fetchZtocReferrer fetches the latest ztoc index pushed as a referrer of the manifest of
+// the image for the current platform and returns the digests of ztocs keyed by the
+// digests of the layers.
+func fetchZtocReferrer(ctx context.Context, clicontext *cli.Context, ref string) (map[digest.Digest]digest.Digest, error) {
+	resolver, opts, err := referrersResolver(ctx, clicontext)
+	if err != nil {
+		return nil, err
+	}
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	if images.IsIndexType(desc.MediaType) {
+		p, err := referrers.Fetch(ctx, resolver, ref, desc)
+		if err != nil {
+			return nil, err
+		}
+		var idx ocispec.Index
+		if err := json.Unmarshal(p, &idx); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, m := range idx.Manifests {
+			if images.IsManifestType(m.MediaType) && (m.Platform == nil || platforms.Default().Match(*m.Platform)) {
+				desc, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("manifest for the current platform isn't found in %q", ref)
+		}
+	}
+	ztocs, err := ztoc.FetchReferrer(ctx, resolver, ref, desc.Digest, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(ztocs) == 0 {
+		return nil, fmt.Errorf("ztoc index of %v: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return ztocs, nil
+}
+
+// fetchZtocIndex fetches the ztoc index from the remote and returns the digests of ztocs
+// keyed by the digests of the layers.
+func fetchZtocIndex(ctx context.Context, resolver remotes.Resolver, ref string) (map[digest.Digest]digest.Digest, error) {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ztoc index %q: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ztoc index %q: %w", ref, err)
+	}
+	defer rc.Close()
+	p, err := io.ReadAll(io.LimitReader(rc, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if desc.Digest.Algorithm().FromBytes(p) != desc.Digest {
+		return nil, fmt.Errorf("invalid ztoc index %q: digest mismatch", ref)
+	}
+	var index ocispec.Manifest
+	if err := json.Unmarshal(p, &index); err != nil {
+		return nil, err
+	}
+	if index.Config.MediaType != ztoc.MediaTypeIndexConfig {
+		return nil, fmt.Errorf("%q isn't a ztoc index; config media type is %q", ref, index.Config.MediaType)
+	}
+	return ztoc.IndexedLayers(index.Layers)
+}
+
+// appendZtocLabelsHandlerWrapper makes a handler which appends the digest of ztoc to each
+// layer descriptor indexed by ztocs.
+func appendZtocLabelsHandlerWrapper(ztocs map[digest.Digest]digest.Digest) func(f images.Handler) images.Handler {
+	return func(f images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := f.Handle(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			switch desc.MediaType {
+			case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+				for i := range children {
+					c := &children[i]
+					if z, ok := ztocs[c.Digest]; ok && images.IsLayerType(c.MediaType) {
+						if c.Annotations == nil {
+							c.Annotations = make(map[string]string)
+						}
+						c.Annotations[fsconfig.TargetZtocDigestLabel] = z.String()
+					}
+				}
+			}
+			return children, nil
+		})
+	}
+}
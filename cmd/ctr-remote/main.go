@@ -36,7 +36,11 @@ func main() {
 		commands.OptimizeCommand,
 		commands.ConvertCommand,
 		commands.GetTOCDigestCommand,
+		commands.CheckCommand,
+		commands.VerifyCommand,
 		commands.IPFSPushCommand,
+		commands.ZtocCommand,
+		commands.ImageStatsCommand,
 	}
 	app := app.New()
 	for i := range app.Commands {
@@ -63,7 +67,7 @@ func main() {
 			break
 		}
 	}
-	app.Commands = append(app.Commands, commands.FanotifyCommand)
+	app.Commands = append(app.Commands, commands.FanotifyCommand, commands.CacheCommand, commands.OrphanCommand, commands.LayerCommand, commands.BackgroundFetchCommand)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "ctr-remote: %v\n", err)
 		os.Exit(1)
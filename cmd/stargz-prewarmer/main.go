@@ -0,0 +1,324 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// stargz-prewarmer is a controller running on each node (e.g. as a DaemonSet)
+// which lets the snapshotter on the node resolve and fetch images listed in
+// ImagePrefetch resources or in the annotation of the node in background,
+// before pods using these images are scheduled.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/containerd/stargz-snapshotter/version"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	defaultAdminAddress = "/run/containerd-stargz-grpc/admin.sock"
+	defaultLogLevel     = logrus.InfoLevel
+
+	// prefetchImagesAnnotation is the annotation of the node which lists images
+	// to prewarm on the node as a comma-separated list.
+	prefetchImagesAnnotation = "stargz.containerd.io/prefetch-images"
+
+	// syncKey is the only key of the work queue. All images are synced at once.
+	syncKey = "sync"
+)
+
+// imagePrefetchResource is the resource of the cluster-scoped ImagePrefetch CRD.
+//
+//	apiVersion: stargz.containerd.io/v1alpha1
+//	kind: ImagePrefetch
+//	spec:
+//	  images: ["ghcr.io/stargz-containers/python:3.9-esgz"]
+//	  nodeSelector: {"node-role.kubernetes.io/worker": ""}
+var imagePrefetchResource = schema.GroupVersionResource{
+	Group:    "stargz.containerd.io",
+	Version:  "v1alpha1",
+	Resource: "imageprefetches",
+}
+
+var (
+	adminAddress = flag.String("admin-address", defaultAdminAddress, "address of the admin API of the snapshotter")
+	kubeconfig   = flag.String("kubeconfig", "", "path to the kubeconfig file (in-cluster config is used if empty)")
+	nodeName     = flag.String("node-name", os.Getenv("NODE_NAME"), "name of the node where this controller runs (default: $NODE_NAME)")
+	resyncPeriod = flag.Duration("resync-period", time.Hour, "period to prewarm all listed images again")
+	keepDuration = flag.Duration("keep-duration", 2*time.Hour, "minimum duration for the snapshotter to keep prewarmed layers")
+	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
+	printVersion = flag.Bool("version", false, "print the version")
+)
+
+func main() {
+	flag.Parse()
+	lvl, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.L.WithError(err).Fatal("failed to prepare logger")
+	}
+	if *printVersion {
+		fmt.Println("stargz-prewarmer", version.Version, version.Revision)
+		return
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetFormatter(&logrus.JSONFormatter{
+		TimestampFormat: log.RFC3339NanoFixed,
+	})
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.L))
+	defer cancel()
+
+	if *nodeName == "" {
+		log.G(ctx).Fatal("node name must be specified with --node-name or $NODE_NAME")
+	}
+	var cfg *rest.Config
+	if *kubeconfig != "" {
+		cfg, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		cfg, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to get kubernetes config")
+	}
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to create kubernetes client")
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to create dynamic client")
+	}
+
+	c, err := newController(ctx, kc, dc, admin.NewClient(*adminAddress), *nodeName, *resyncPeriod, *keepDuration)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to create controller")
+	}
+	go c.run(ctx)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
+	log.G(ctx).Infof("Got %v", <-sigCh)
+}
+
+// prewarmClient prewarms images on the snapshotter. This is implemented by *admin.Client.
+type prewarmClient interface {
+	PrewarmImage(ctx context.Context, req admin.PrewarmRequest) (admin.PrewarmResult, error)
+}
+
+type controller struct {
+	client       prewarmClient
+	nodeName     string
+	resyncPeriod time.Duration
+	keepDuration time.Duration
+
+	nodeInformer     cache.SharedIndexInformer
+	prefetchInformer cache.SharedIndexInformer // nil if ImagePrefetch CRD isn't installed
+	queue            workqueue.RateLimitingInterface
+
+	// prewarmed records when images were prewarmed successfully.
+	prewarmed map[string]time.Time
+}
+
+// newController creates the controller for the node. If ImagePrefetch CRD isn't
+// installed, only the annotation of the node is watched.
+func newController(ctx context.Context, kc kubernetes.Interface, dc dynamic.Interface, client prewarmClient, nodeName string, resyncPeriod, keepDuration time.Duration) (*controller, error) {
+	installed, err := isResourceInstalled(kc.Discovery(), imagePrefetchResource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover ImagePrefetch CRD: %w", err)
+	}
+	nodeFactory := informers.NewSharedInformerFactoryWithOptions(kc, resyncPeriod,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", nodeName).String()
+		}))
+	c := &controller{
+		client:       client,
+		nodeName:     nodeName,
+		resyncPeriod: resyncPeriod,
+		keepDuration: keepDuration,
+		nodeInformer: nodeFactory.Core().V1().Nodes().Informer(),
+		queue:        workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		prewarmed:    make(map[string]time.Time),
+	}
+	if installed {
+		dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dc, resyncPeriod)
+		c.prefetchInformer = dynamicFactory.ForResource(imagePrefetchResource).Informer()
+	} else {
+		log.G(ctx).Warnf("%s isn't installed; only %q annotation of the node is used", imagePrefetchResource, prefetchImagesAnnotation)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.queue.Add(syncKey) },
+		UpdateFunc: func(interface{}, interface{}) { c.queue.Add(syncKey) },
+		DeleteFunc: func(interface{}) { c.queue.Add(syncKey) },
+	}
+	c.nodeInformer.AddEventHandler(handler)
+	if c.prefetchInformer != nil {
+		c.prefetchInformer.AddEventHandler(handler)
+	}
+	return c, nil
+}
+
+// isResourceInstalled returns true if the API server serves the resource.
+func isResourceInstalled(d discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (bool, error) {
+	list, err := d.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, r := range list.APIResources {
+		if r.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *controller) run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	go c.nodeInformer.Run(ctx.Done())
+	synced := []cache.InformerSynced{c.nodeInformer.HasSynced}
+	if c.prefetchInformer != nil {
+		go c.prefetchInformer.Run(ctx.Done())
+		synced = append(synced, c.prefetchInformer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		log.G(ctx).Warn("failed to sync informers")
+		return
+	}
+	log.G(ctx).WithField("node", c.nodeName).Info("started prewarm controller")
+	for {
+		key, quit := c.queue.Get()
+		if quit {
+			return
+		}
+		if err := c.sync(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to prewarm some images; retrying")
+			c.queue.AddRateLimited(key)
+		} else {
+			c.queue.Forget(key)
+		}
+		c.queue.Done(key)
+	}
+}
+
+// sync prewarms images listed for this node which aren't prewarmed recently.
+func (c *controller) sync(ctx context.Context) error {
+	images, err := c.images()
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, ref := range images {
+		// Nodes are updated frequently (e.g. heartbeats) so recently prewarmed
+		// images are skipped until the next resync.
+		if t, ok := c.prewarmed[ref]; ok && time.Since(t) < c.resyncPeriod/2 {
+			continue
+		}
+		res, err := c.client.PrewarmImage(ctx, admin.PrewarmRequest{Reference: ref, Keep: c.keepDuration})
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("ref", ref).Warn("failed to prewarm image")
+			failed = append(failed, ref)
+			continue
+		}
+		log.G(ctx).WithField("ref", ref).Infof("prewarming %d layers", len(res.Layers))
+		c.prewarmed[ref] = time.Now()
+	}
+	// Forget images which aren't listed anymore so that they are prewarmed when listed again.
+	listed := make(map[string]struct{}, len(images))
+	for _, ref := range images {
+		listed[ref] = struct{}{}
+	}
+	for ref := range c.prewarmed {
+		if _, ok := listed[ref]; !ok {
+			delete(c.prewarmed, ref)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to prewarm %v", failed)
+	}
+	return nil
+}
+
+// images returns images listed for this node.
+func (c *controller) images() ([]string, error) {
+	obj, ok, err := c.nodeInformer.GetStore().GetByKey(c.nodeName)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("node %q not found", c.nodeName)
+	}
+	node := obj.(*corev1.Node)
+	set := make(map[string]struct{})
+	for _, ref := range strings.Split(node.Annotations[prefetchImagesAnnotation], ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			set[ref] = struct{}{}
+		}
+	}
+	var prefetches []interface{}
+	if c.prefetchInformer != nil {
+		prefetches = c.prefetchInformer.GetStore().List()
+	}
+	for _, obj := range prefetches {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		selector, _, err := unstructured.NestedStringMap(u.Object, "spec", "nodeSelector")
+		if err != nil {
+			return nil, fmt.Errorf("invalid nodeSelector of ImagePrefetch %q: %w", u.GetName(), err)
+		}
+		if !labels.SelectorFromSet(selector).Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		refs, _, err := unstructured.NestedStringSlice(u.Object, "spec", "images")
+		if err != nil {
+			return nil, fmt.Errorf("invalid images of ImagePrefetch %q: %w", u.GetName(), err)
+		}
+		for _, ref := range refs {
+			set[ref] = struct{}{}
+		}
+	}
+	images := make([]string, 0, len(set))
+	for ref := range set {
+		images = append(images, ref)
+	}
+	sort.Strings(images)
+	return images, nil
+}
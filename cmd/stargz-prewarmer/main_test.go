@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNodeName = "node0"
+
+func TestController(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        testNodeName,
+		Labels:      map[string]string{"role": "worker"},
+		Annotations: map[string]string{prefetchImagesAnnotation: "example.com/a:1, example.com/b:1"},
+	}}
+	for _, tt := range []struct {
+		name         string
+		crdInstalled bool
+		prefetches   []*unstructured.Unstructured
+		want         []string
+	}{
+		{
+			name: "annotation_only_without_crd",
+			want: []string{"example.com/a:1", "example.com/b:1"},
+		},
+		{
+			name:         "annotation_only_with_crd",
+			crdInstalled: true,
+			want:         []string{"example.com/a:1", "example.com/b:1"},
+		},
+		{
+			name:         "image_prefetch",
+			crdInstalled: true,
+			prefetches: []*unstructured.Unstructured{
+				testImagePrefetch("worker", map[string]interface{}{"role": "worker"}, "example.com/b:1", "example.com/c:1"),
+				testImagePrefetch("all", nil, "example.com/d:1"),
+				testImagePrefetch("gpu", map[string]interface{}{"role": "gpu"}, "example.com/e:1"),
+			},
+			want: []string{"example.com/a:1", "example.com/b:1", "example.com/c:1", "example.com/d:1"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			kc := fake.NewSimpleClientset(node)
+			if tt.crdInstalled {
+				kc.Fake.Resources = []*metav1.APIResourceList{{
+					GroupVersion: imagePrefetchResource.GroupVersion().String(),
+					APIResources: []metav1.APIResource{{Name: imagePrefetchResource.Resource, Kind: "ImagePrefetch"}},
+				}}
+			}
+			dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{imagePrefetchResource: "ImagePrefetchList"})
+			for _, p := range tt.prefetches {
+				// Created through the resource because the fake client can't guess the plural of the kind.
+				if _, err := dc.Resource(imagePrefetchResource).Create(ctx, p, metav1.CreateOptions{}); err != nil {
+					t.Fatalf("failed to create ImagePrefetch: %v", err)
+				}
+			}
+			client := &testPrewarmClient{}
+			c, err := newController(ctx, kc, dc, client, testNodeName, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatalf("failed to create controller: %v", err)
+			}
+			if (c.prefetchInformer != nil) != tt.crdInstalled {
+				t.Errorf("ImagePrefetch must be watched only if the CRD is installed")
+			}
+			go c.run(ctx)
+
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				got := client.prewarmed()
+				if reflect.DeepEqual(got, tt.want) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("prewarmed %v; want %v", got, tt.want)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func testImagePrefetch(name string, nodeSelector map[string]interface{}, images ...string) *unstructured.Unstructured {
+	refs := make([]interface{}, len(images))
+	for i, ref := range images {
+		refs[i] = ref
+	}
+	spec := map[string]interface{}{"images": refs}
+	if nodeSelector != nil {
+		spec["nodeSelector"] = nodeSelector
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": imagePrefetchResource.GroupVersion().String(),
+		"kind":       "ImagePrefetch",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+}
+
+// testPrewarmClient records the prewarmed images.
+type testPrewarmClient struct {
+	refs map[string]struct{}
+	mu   sync.Mutex
+}
+
+func (c *testPrewarmClient) PrewarmImage(ctx context.Context, req admin.PrewarmRequest) (admin.PrewarmResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refs == nil {
+		c.refs = make(map[string]struct{})
+	}
+	c.refs[req.Reference] = struct{}{}
+	return admin.PrewarmResult{}, nil
+}
+
+func (c *testPrewarmClient) prewarmed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refs := make([]string, 0, len(c.refs))
+	for ref := range c.refs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
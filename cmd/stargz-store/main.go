@@ -23,6 +23,8 @@ import (
 	"io"
 	golog "log"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -30,15 +32,21 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/sys"
 	dbmetadata "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/db"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/containerd/stargz-snapshotter/service/keychain/authjson"
 	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/keychain/ecr"
 	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	"github.com/containerd/stargz-snapshotter/store"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+	metrics "github.com/docker/go-metrics"
 	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
@@ -62,22 +70,67 @@ type Config struct {
 	// KubeconfigKeychainConfig is config for kubeconfig-based keychain.
 	KubeconfigKeychainConfig `toml:"kubeconfig_keychain"`
 
+	// ECRKeychainConfig is config for Amazon ECR keychain.
+	ECRKeychainConfig `toml:"ecr_keychain"`
+
 	// ResolverConfig is config for resolving registries.
 	ResolverConfig `toml:"resolver"`
 
+	// ContainersConfig is config for using the configuration files of containers/image
+	// (used by Podman and CRI-O) for resolving registries.
+	ContainersConfig `toml:"containers"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"memory"`
+
+	// MetricsAddress is address for the metrics API
+	MetricsAddress string `toml:"metrics_address"`
+
+	// AdminAddress is a Unix domain socket address where stargz-store exposes the admin API
+	// (e.g. for pruning unused layers).
+	AdminAddress string `toml:"admin_address"`
+
+	// GCConfig is config for the garbage collection of unused layers.
+	GCConfig store.GCConfig `toml:"gc"`
 }
 
 type KubeconfigKeychainConfig struct {
 	EnableKeychain bool   `toml:"enable_keychain"`
 	KubeconfigPath string `toml:"kubeconfig_path"`
+	Namespace      string `toml:"namespace"`
+}
+
+type ECRKeychainConfig struct {
+	EnableKeychain bool `toml:"enable_keychain"`
 }
 
 type ResolverConfig resolver.Config
 
+type ContainersConfig struct {
+	// EnableRegistriesConf enables mirrors and rewrites of registries configured in
+	// registries.conf. Registries not configured there are resolved based on ResolverConfig.
+	EnableRegistriesConf bool `toml:"enable_registries_conf"`
+
+	// RegistriesConfPath is the path to registries.conf. Default is /etc/containers/registries.conf.
+	RegistriesConfPath string `toml:"registries_conf_path"`
+
+	// EnableAuthFile enables credentials stored in auth.json.
+	EnableAuthFile bool `toml:"enable_auth_file"`
+
+	// AuthFilePath is the path to auth.json. By default, the same paths as Podman are searched
+	// (e.g. ${XDG_RUNTIME_DIR}/containers/auth.json).
+	AuthFilePath string `toml:"auth_file_path"`
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
+	if len(os.Args) > 1 && os.Args[1] == pruneCommand {
+		if err := prune(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to prune: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 	mountPoint := flag.Arg(0)
 	lvl, err := logrus.ParseLevel(*logLevel)
@@ -102,29 +155,15 @@ func main() {
 	}
 
 	// Get configuration from specified file
-	if *configPath != "" {
-		tree, err := toml.LoadFile(*configPath)
-		if err != nil && !(os.IsNotExist(err) && *configPath == defaultConfigPath) {
-			log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
-		}
-		if err := tree.Unmarshal(&config); err != nil {
-			log.G(ctx).WithError(err).Fatalf("failed to unmarshal config file %q", *configPath)
-		}
+	if err := loadConfig(*configPath, &config); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
 	}
-
-	// Prepare kubeconfig-based keychain if required
-	credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
-	if config.KubeconfigKeychainConfig.EnableKeychain {
-		var opts []kubeconfig.Option
-		if kcp := config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
-			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
-		}
-		credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
+	kc := newKeychains(ctx)
+	hosts, err := kc.registryHosts(config)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to configure registries")
 	}
 
-	// Use RegistryHosts based on ResolverConfig and keychain
-	hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...)
-
 	// Configure and mount filesystem
 	if _, err := os.Stat(mountPoint); err != nil {
 		if err2 := os.MkdirAll(mountPoint, 0755); err2 != nil && !os.IsExist(err2) {
@@ -132,18 +171,19 @@ func main() {
 				Fatalf("failed to prepare mountpoint %q", mountPoint)
 		}
 	}
-	if !config.Config.DisableVerification {
-		log.G(ctx).Warnf("content verification is not supported; switching to non-verification mode")
-		config.Config.DisableVerification = true
-	}
+	checkVerification(ctx, &config)
 	mt, err := getMetadataStore(*rootDir, config)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure metadata store")
 	}
-	layerManager, err := store.NewLayerManager(ctx, *rootDir, hosts, mt, config.Config)
+	layerManager, err := store.NewLayerManager(ctx, *rootDir, hosts, mt, config.Config, store.WithMetricsLogLevel(logrus.InfoLevel))
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to prepare pool")
 	}
+	layerManager.SetGCConfig(config.GCConfig)
+	gcCtx, gcCancel := context.WithCancel(ctx)
+	defer gcCancel()
+	go layerManager.RunGC(gcCtx)
 	if err := store.Mount(ctx, mountPoint, layerManager, config.Config.Debug); err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to mount fs at %q", mountPoint)
 	}
@@ -152,6 +192,36 @@ func main() {
 		log.G(ctx).Info("Exiting")
 	}()
 
+	// We need to consider both the existence of MetricsAddress as well as NoPrometheus flag not set
+	if config.MetricsAddress != "" && !config.Config.NoPrometheus {
+		l, err := net.Listen("tcp", config.MetricsAddress)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to get listener for metrics endpoint")
+		}
+		m := http.NewServeMux()
+		m.Handle("/metrics", metrics.Handler())
+		go func() {
+			if err := http.Serve(l, m); err != nil {
+				log.G(ctx).WithError(err).Errorf("error on serving metrics via %q", config.MetricsAddress)
+			}
+		}()
+	}
+
+	if config.AdminAddress != "" {
+		log.G(ctx).Infof("listen %q for admin API", config.AdminAddress)
+		l, err := sys.GetLocalListener(config.AdminAddress, 0, 0)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to listen %q", config.AdminAddress)
+		}
+		m := http.NewServeMux()
+		admin.Register(ctx, m, layerManager)
+		go func() {
+			if err := http.Serve(l, m); err != nil {
+				log.G(ctx).WithError(err).Errorf("error on serving the admin API via socket %q", config.AdminAddress)
+			}
+		}()
+	}
+
 	if os.Getenv("NOTIFY_SOCKET") != "" {
 		notified, notifyErr := sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
 		log.G(ctx).Debugf("SdNotifyReady notified=%v, err=%v", notified, notifyErr)
@@ -163,14 +233,166 @@ func main() {
 		}
 	}()
 
-	waitForSIGINT()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP)
+	for s := range c {
+		if s != syscall.SIGHUP {
+			break
+		}
+		// Reload the configuration. This is applied only to layers mounted after
+		// this point so running containers aren't disturbed.
+		log.G(ctx).Info("Got SIGHUP; reloading config")
+		var newConfig Config
+		if err := loadConfig(*configPath, &newConfig); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to reload config file %q; keeping the current config", *configPath)
+			continue
+		}
+		checkVerification(ctx, &newConfig)
+		if newConfig.MetadataStore != config.MetadataStore {
+			log.G(ctx).Warnf("metadata_store can't be changed by reloading; keeping %q", config.MetadataStore)
+		}
+		if newConfig.MetricsAddress != config.MetricsAddress {
+			log.G(ctx).Warnf("metrics_address can't be changed by reloading; keeping %q", config.MetricsAddress)
+		}
+		if newConfig.AdminAddress != config.AdminAddress {
+			log.G(ctx).Warnf("admin_address can't be changed by reloading; keeping %q", config.AdminAddress)
+		}
+		newHosts, err := kc.registryHosts(newConfig)
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to configure registries; keeping the current config")
+			continue
+		}
+		if err := layerManager.Reload(ctx, newHosts, newConfig.Config); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to reload config; keeping the current config")
+			continue
+		}
+		layerManager.SetGCConfig(newConfig.GCConfig)
+		config = newConfig
+		log.G(ctx).Info("Reloaded config")
+	}
 	log.G(ctx).Info("Got SIGINT")
 }
 
-func waitForSIGINT() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+const (
+	pruneCommand        = "prune"
+	defaultAdminAddress = "/run/stargz-store/admin.sock"
+)
+
+// prune requests the running stargz-store to release unused layers and remove unused caches.
+func prune(args []string) error {
+	fs := flag.NewFlagSet(pruneCommand, flag.ExitOnError)
+	adminAddress := fs.String("admin-address", defaultAdminAddress, "address of the admin API of stargz-store (\"admin_address\" in the config)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	res, err := admin.NewClient(*adminAddress).PruneLayers(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, l := range res.Layers {
+		fmt.Printf("released layer %s %s (%s)\n", l.Reference, l.Digest, l.Reason)
+	}
+	var size int64
+	for _, c := range res.Caches {
+		size += c.Size
+	}
+	fmt.Printf("released %d layers; removed %d caches (%d bytes)\n", len(res.Layers), len(res.Caches), size)
+	return nil
+}
+
+// loadConfig reads the configuration file into config. The default configuration
+// file is allowed to be missing.
+func loadConfig(path string, config *Config) error {
+	if path == "" {
+		return nil
+	}
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == defaultConfigPath {
+			return nil
+		}
+		return err
+	}
+	return tree.Unmarshal(config)
+}
+
+func checkVerification(ctx context.Context, config *Config) {
+	if !config.Config.DisableVerification {
+		log.G(ctx).Warnf("content verification is not supported; switching to non-verification mode")
+		config.Config.DisableVerification = true
+	}
+}
+
+// keychains manages keychains used for resolving registries. The kubeconfig-based keychain
+// is kept across reloads as long as its configuration isn't changed.
+type keychains struct {
+	ctx context.Context
+
+	kubeconfig       resolver.Credential
+	kubeconfigConfig KubeconfigKeychainConfig
+	kubeconfigCancel context.CancelFunc
+
+	// ecr is kept among reloads for reusing cached credentials
+	ecr resolver.Credential
+}
+
+func newKeychains(ctx context.Context) *keychains {
+	return &keychains{ctx: ctx}
+}
+
+// registryHosts returns RegistryHosts based on ResolverConfig, ContainersConfig and keychains.
+func (kc *keychains) registryHosts(config Config) (source.RegistryHosts, error) {
+	// Docker config and auth.json are read on each authentication so these always
+	// reflect the latest ones.
+	credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(kc.ctx)}
+	if config.ContainersConfig.EnableAuthFile {
+		var opts []authjson.Option
+		if p := config.ContainersConfig.AuthFilePath; p != "" {
+			opts = append(opts, authjson.WithAuthFilePath(p))
+		}
+		credsFuncs = append(credsFuncs, authjson.NewAuthJSONKeychain(kc.ctx, opts...))
+	}
+
+	// Prepare kubeconfig-based keychain if required
+	kcfg := config.KubeconfigKeychainConfig
+	if kc.kubeconfig != nil && kcfg != kc.kubeconfigConfig {
+		kc.kubeconfigCancel()
+		kc.kubeconfig, kc.kubeconfigCancel = nil, nil
+	}
+	if kcfg.EnableKeychain && kc.kubeconfig == nil {
+		var opts []kubeconfig.Option
+		if kcp := kcfg.KubeconfigPath; kcp != "" {
+			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
+		}
+		if ns := kcfg.Namespace; ns != "" {
+			opts = append(opts, kubeconfig.WithNamespace(ns))
+		}
+		ctx, cancel := context.WithCancel(kc.ctx)
+		kc.kubeconfig, kc.kubeconfigCancel = kubeconfig.NewKubeconfigKeychain(ctx, opts...), cancel
+	}
+	kc.kubeconfigConfig = kcfg
+	if kc.kubeconfig != nil {
+		credsFuncs = append(credsFuncs, kc.kubeconfig)
+	}
+	if config.ECRKeychainConfig.EnableKeychain {
+		if kc.ecr == nil {
+			kc.ecr = ecr.NewECRKeychain(kc.ctx)
+		}
+		credsFuncs = append(credsFuncs, kc.ecr)
+	}
+
+	if config.ContainersConfig.EnableRegistriesConf {
+		path := config.ContainersConfig.RegistriesConfPath
+		if path == "" {
+			path = resolver.DefaultRegistriesConfPath
+		}
+		rc, err := resolver.LoadRegistriesConf(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registries.conf %q: %w", path, err)
+		}
+		return resolver.RegistryHostsFromRegistriesConf(rc, resolver.Config(config.ResolverConfig), credsFuncs...), nil
+	}
+	return resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...), nil
 }
 
 const (
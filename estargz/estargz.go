@@ -526,6 +526,34 @@ type fileReader struct {
 	ents []*TOCEntry // 1 or more reg/chunk entries
 }
 
+// maxRead is the max size of compressed bytes read from the blob at once by
+// fileReader.ReadAt.
+const maxRead = 2 << 20
+
+// readBufSizes are sizes of buffered readers of compressed bytes pooled for
+// fileReader.ReadAt. The smallest one enough for a read is used so that small
+// reads don't hold large buffers.
+var readBufSizes = [...]int{64 << 10, 256 << 10, 1 << 20, maxRead}
+
+var readBufPools [len(readBufSizes)]sync.Pool
+
+func getReadBuf(r io.Reader, size int) (br *bufio.Reader, release func()) {
+	i := sort.SearchInts(readBufSizes[:], size)
+	if i == len(readBufSizes) {
+		return bufio.NewReaderSize(r, size), func() {}
+	}
+	if v := readBufPools[i].Get(); v != nil {
+		br = v.(*bufio.Reader)
+		br.Reset(r)
+	} else {
+		br = bufio.NewReaderSize(r, readBufSizes[i])
+	}
+	return br, func() {
+		br.Reset(nil)
+		readBufPools[i].Put(br)
+	}
+}
+
 func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 	if off >= fr.size {
 		return 0, io.EOF
@@ -562,13 +590,13 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 
 	sr := io.NewSectionReader(fr.r.sr, compressedOff, compressedBytesRemain)
 
-	const maxRead = 2 << 20
 	var bufSize = maxRead
 	if compressedBytesRemain < maxRead {
 		bufSize = int(compressedBytesRemain)
 	}
 
-	br := bufio.NewReaderSize(sr, bufSize)
+	br, release := getReadBuf(sr, bufSize)
+	defer release()
 	if _, err := br.Peek(bufSize); err != nil {
 		return 0, fmt.Errorf("fileReader.ReadAt.peek: %v", err)
 	}
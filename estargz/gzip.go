@@ -32,6 +32,7 @@ import (
 	"hash"
 	"io"
 	"strconv"
+	"sync"
 
 	digest "github.com/opencontainers/go-digest"
 )
@@ -120,7 +121,7 @@ func gzipFooterBytes(tocOff int64) []byte {
 type GzipDecompressor struct{}
 
 func (gz *GzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	return gzip.NewReader(r)
+	return newPooledGzipReader(r)
 }
 
 func (gz *GzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
@@ -165,7 +166,7 @@ func (gz *GzipDecompressor) DecompressTOC(r io.Reader) (tocJSON io.ReadCloser, e
 type LegacyGzipDecompressor struct{}
 
 func (gz *LegacyGzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	return gzip.NewReader(r)
+	return newPooledGzipReader(r)
 }
 
 func (gz *LegacyGzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
@@ -235,3 +236,37 @@ func decompressTOCEStargz(r io.Reader) (tocJSON io.ReadCloser, err error) {
 	}
 	return readCloser{tr, zr.Close}, nil
 }
+
+// gzipReaderPool pools gzip readers to reuse their decompression states which
+// are costly to allocate on each read.
+var gzipReaderPool sync.Pool
+
+// newPooledGzipReader returns a gzip reader which is returned to the pool on Close.
+func newPooledGzipReader(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			gzipReaderPool.Put(zr)
+			return nil, err
+		}
+		return &pooledGzipReader{zr}, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledGzipReader{zr}, nil
+}
+
+type pooledGzipReader struct {
+	*gzip.Reader
+}
+
+func (r *pooledGzipReader) Close() error {
+	if r.Reader == nil {
+		return nil // already closed
+	}
+	err := r.Reader.Close()
+	gzipReaderPool.Put(r.Reader)
+	r.Reader = nil
+	return err
+}
@@ -53,11 +53,20 @@ var (
 type Decompressor struct{}
 
 func (zz *Decompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	decoder, err := zstd.NewReader(r)
+	if d, ok := decoderPool.Get().(*zstd.Decoder); ok {
+		if err := d.Reset(r); err != nil {
+			d.Close()
+			return nil, err
+		}
+		return &poolDecoder{d}, nil
+	}
+	// Decoders are pooled so they must decode synchronously without goroutines
+	// which would leak when the pool drops them.
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
 	if err != nil {
 		return nil, err
 	}
-	return &zstdReadCloser{decoder}, nil
+	return &poolDecoder{decoder}, nil
 }
 
 func (zz *Decompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
@@ -107,10 +116,21 @@ type reader struct {
 
 func (r *reader) Close() error { r.closeFunc(); return nil }
 
-type zstdReadCloser struct{ *zstd.Decoder }
+// decoderPool pools decoders returned by Decompressor.Reader.
+var decoderPool sync.Pool
+
+type poolDecoder struct{ *zstd.Decoder }
 
-func (z *zstdReadCloser) Close() error {
-	z.Decoder.Close()
+func (d *poolDecoder) Close() error {
+	if d.Decoder == nil {
+		return nil // already closed
+	}
+	if err := d.Decoder.Reset(nil); err != nil {
+		d.Decoder.Close()
+	} else {
+		decoderPool.Put(d.Decoder)
+	}
+	d.Decoder = nil
 	return nil
 }
 
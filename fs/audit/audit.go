@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package audit records on-demand fetches from remote layers as a stream of
+// JSON events.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Event is a record of a read of a file which fetched contents from the remote layer.
+type Event struct {
+	Time      time.Time     `json:"time"`
+	Image     string        `json:"image,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	Layer     digest.Digest `json:"layer"`
+
+	// Path is the path of the read file in the layer.
+	Path string `json:"path"`
+
+	// Offset and Size are the range of the file read.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+
+	// LatencyMilliseconds is the duration of the read including the fetch.
+	LatencyMilliseconds float64 `json:"latency_ms"`
+
+	// PID is the process which triggered the fetch.
+	PID uint32 `json:"pid,omitempty"`
+
+	// Container is the ID of the container of the process. This is detected from
+	// the cgroup of the process and empty if it's unknown.
+	Container string `json:"container,omitempty"`
+}
+
+// Logger writes sampled events.
+type Logger struct {
+	w          io.Writer // nil writes events to the log of the snapshotter
+	sampleRate float64
+	minLatency time.Duration
+	procRoot   string
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewLogger returns a logger configured by cfg. nil is returned if the fetch audit
+// isn't enabled.
+func NewLogger(cfg config.FetchAuditConfig) (*Logger, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	sampleRate := cfg.SampleRate
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("sample rate must be in (0, 1] but got %v", cfg.SampleRate)
+	}
+	l := &Logger{
+		sampleRate: sampleRate,
+		minLatency: time.Duration(cfg.MinLatencyMSec) * time.Millisecond,
+		procRoot:   "/proc",
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if cfg.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open fetch audit file: %w", err)
+		}
+		l.w = f
+	}
+	return l, nil
+}
+
+// Record writes the event if it's sampled. The container of the event is filled
+// from the PID.
+func (l *Logger) Record(e Event, latency time.Duration) {
+	if latency < l.minLatency {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sampleRate < 1 && l.rand.Float64() >= l.sampleRate {
+		return
+	}
+	e.LatencyMilliseconds = float64(latency.Nanoseconds()) / 1e6
+	if e.Container == "" && e.PID != 0 {
+		e.Container = containerOfPID(l.procRoot, e.PID)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.L.WithError(err).Warn("failed to marshal fetch audit event")
+		return
+	}
+	if l.w == nil {
+		log.L.WithField("audit", "fetch").Info(string(data))
+		return
+	}
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		log.L.WithError(err).Warn("failed to write fetch audit event")
+	}
+}
+
+// containerIDRegexp matches 64-hex container IDs in cgroup paths (e.g.
+// "/kubepods/.../cri-containerd-<id>.scope" or "/default/<id>").
+var containerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerOfPID returns the ID of the container of the process detected from its
+// cgroup. Empty string is returned if it's unknown.
+func containerOfPID(procRoot string, pid uint32) string {
+	data, err := os.ReadFile(filepath.Join(procRoot, fmt.Sprintf("%d", pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	ids := containerIDRegexp.FindAllString(string(data), -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
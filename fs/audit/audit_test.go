@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestLogger(t *testing.T) {
+	if l, err := NewLogger(config.FetchAuditConfig{}); err != nil || l != nil {
+		t.Fatalf("logger must be nil if disabled: %v", err)
+	}
+	if _, err := NewLogger(config.FetchAuditConfig{Enable: true, SampleRate: 2}); err == nil {
+		t.Fatalf("invalid sample rate must be rejected")
+	}
+
+	tmp := t.TempDir()
+	p := filepath.Join(tmp, "audit", "fetch.log")
+	l, err := NewLogger(config.FetchAuditConfig{Enable: true, Path: p, MinLatencyMSec: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.procRoot = filepath.Join(tmp, "proc")
+	id := strings.Repeat("a", 64)
+	if err := os.MkdirAll(filepath.Join(l.procRoot, "100"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(l.procRoot, "100", "cgroup"),
+		[]byte("0::/system.slice/containerd.service/kubepods-pod1.slice:cri-containerd:"+id+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := digest.FromString("layer")
+	l.Record(Event{Layer: layer, Path: "/fast", PID: 100}, time.Millisecond) // too fast; not recorded
+	l.Record(Event{Layer: layer, Path: "/a", Offset: 10, Size: 20, PID: 100}, 20*time.Millisecond)
+	l.Record(Event{Layer: layer, Path: "/b", PID: 200}, 20*time.Millisecond)
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []Event
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", s.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("want 2 events; got %+v", events)
+	}
+	if e := events[0]; e.Path != "/a" || e.Offset != 10 || e.Size != 20 || e.Container != id || e.LatencyMilliseconds != 20 || e.Layer != layer {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if e := events[1]; e.Path != "/b" || e.Container != "" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "fetch.log")
+	l, err := NewLogger(config.FetchAuditConfig{Enable: true, Path: p, SampleRate: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 1000
+	for i := 0; i < total; i++ {
+		l.Record(Event{Path: "/a"}, time.Millisecond)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n < total/4 || n > total*3/4 {
+		t.Errorf("about half of events must be recorded; got %d/%d", n, total)
+	}
+}
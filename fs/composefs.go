@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	composefsDirName                 = "composefs"
+	composefsImageName               = "image.cfs"
+	composefsObjectsDirName          = "objects"
+	defaultMkcomposefsBin            = "mkcomposefs"
+	defaultComposefsCheckIntervalSec = 10
+)
+
+// composefsExporter exports fully fetched layers as composefs images and mounts them
+// over the FUSE mounts of the layers.
+type composefsExporter struct {
+	dir         string // directory of the exported images
+	mkcomposefs string
+	interval    time.Duration
+
+	// mounted is the export directories of the composefs images mounted over the
+	// mountpoints.
+	mounted map[string]string
+	mu      sync.Mutex
+
+	// run runs the command. This can be replaced by tests.
+	run func(ctx context.Context, name string, args ...string) error
+}
+
+func newComposefsExporter(root string, cfg config.ComposefsConfig) (*composefsExporter, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	mkcomposefs := cfg.MkcomposefsPath
+	if mkcomposefs == "" {
+		mkcomposefs = defaultMkcomposefsBin
+	}
+	if _, err := exec.LookPath(mkcomposefs); err != nil {
+		return nil, fmt.Errorf("composefs export requires %q: %w", mkcomposefs, err)
+	}
+	interval := time.Duration(cfg.CheckIntervalSec) * time.Second
+	if interval == 0 {
+		interval = defaultComposefsCheckIntervalSec * time.Second
+	}
+	// Images exported by the previous run aren't mounted anymore because all mounts
+	// of the snapshots are cleaned up at startup.
+	dir := filepath.Join(root, composefsDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &composefsExporter{
+		dir:         dir,
+		mkcomposefs: mkcomposefs,
+		interval:    interval,
+		mounted:     make(map[string]string),
+		run:         runCommand,
+	}, nil
+}
+
+func runCommand(ctx context.Context, name string, args ...string) error {
+	if out, err := exec.CommandContext(ctx, name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run %s: %v: %q", name, err, string(out))
+	}
+	return nil
+}
+
+// watch waits until the layer mounted at the mountpoint is fully fetched and mounts
+// the composefs image of the layer over the mountpoint. mounted reports whether the
+// layer is still mounted at the mountpoint.
+func (e *composefsExporter) watch(ctx context.Context, mountpoint string, l layer.Layer, mounted func() bool) {
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for range t.C {
+		if !mounted() {
+			return
+		}
+		if info := l.Info(); info.FetchedSize < info.Size {
+			continue
+		}
+		start := time.Now()
+		if err := e.export(ctx, mountpoint, mounted); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to export layer as composefs image")
+			return
+		}
+		log.G(ctx).Infof("mounted composefs image of the layer in %v", time.Since(start))
+		return
+	}
+}
+
+// export creates the composefs image of the contents of the mountpoint and mounts
+// the image over the mountpoint.
+func (e *composefsExporter) export(ctx context.Context, mountpoint string, mounted func() bool) (retErr error) {
+	dir := filepath.Join(e.dir, digest.FromString(mountpoint).Encoded())
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	objects := filepath.Join(dir, composefsObjectsDirName)
+	if err := os.MkdirAll(objects, 0700); err != nil {
+		return err
+	}
+	image := filepath.Join(dir, composefsImageName)
+	// This reads all files of the layer through FUSE, which are served from the cache.
+	if err := e.run(ctx, e.mkcomposefs, "--digest-store="+objects, mountpoint, image); err != nil {
+		return err
+	}
+
+	// The layer must not be unmounted until the image is mounted over it. Otherwise,
+	// the image is left mounted on the snapshot directory.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !mounted() {
+		return fmt.Errorf("layer is unmounted")
+	}
+	if err := e.run(ctx, "mount", "-t", "composefs", "-o", "ro,basedir="+objects, image, mountpoint); err != nil {
+		return err
+	}
+	e.mounted[mountpoint] = dir
+	return nil
+}
+
+// unmount unmounts the composefs image mounted over the mountpoint, if any, and
+// removes it.
+func (e *composefsExporter) unmount(mountpoint string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dir, ok := e.mounted[mountpoint]
+	if !ok {
+		return nil
+	}
+	delete(e.mounted, mountpoint)
+	if err := syscall.Unmount(mountpoint, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount composefs image: %w", err)
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+)
+
+type sizedLayer struct {
+	breakableLayer
+	size, fetched int64
+}
+
+func (l *sizedLayer) Info() layer.Info {
+	return layer.Info{Size: l.size, FetchedSize: atomic.LoadInt64(&l.fetched)}
+}
+
+func TestComposefsExport(t *testing.T) {
+	var (
+		cmds   []string
+		cmdsMu sync.Mutex
+		done   = make(chan struct{})
+	)
+	e := &composefsExporter{
+		dir:         t.TempDir(),
+		mkcomposefs: "mkcomposefs",
+		interval:    time.Millisecond,
+		mounted:     make(map[string]string),
+		run: func(ctx context.Context, name string, args ...string) error {
+			cmdsMu.Lock()
+			defer cmdsMu.Unlock()
+			cmds = append(cmds, name+" "+strings.Join(args, " "))
+			if name == "mount" {
+				close(done)
+			}
+			return nil
+		},
+	}
+	const mountpoint = "/snapshots/1/fs"
+	l := &sizedLayer{size: 100, fetched: 10}
+	go e.watch(context.TODO(), mountpoint, l, func() bool { return true })
+
+	time.Sleep(20 * time.Millisecond)
+	cmdsMu.Lock()
+	if len(cmds) != 0 {
+		t.Fatalf("layer must not be exported until it's fully fetched: %v", cmds)
+	}
+	cmdsMu.Unlock()
+	atomic.StoreInt64(&l.fetched, 100)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("layer isn't exported")
+	}
+
+	e.mu.Lock()
+	dir, ok := e.mounted[mountpoint]
+	e.mu.Unlock()
+	if !ok {
+		t.Fatalf("composefs image isn't recorded as mounted")
+	}
+	objects, image := filepath.Join(dir, composefsObjectsDirName), filepath.Join(dir, composefsImageName)
+	cmdsMu.Lock()
+	defer cmdsMu.Unlock()
+	want := []string{
+		"mkcomposefs --digest-store=" + objects + " " + mountpoint + " " + image,
+		"mount -t composefs -o ro,basedir=" + objects + " " + image + " " + mountpoint,
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q; want %q", cmds, want)
+	}
+}
+
+func TestComposefsExportUnmounted(t *testing.T) {
+	var mounted bool
+	e := &composefsExporter{
+		dir:     t.TempDir(),
+		mounted: make(map[string]string),
+		run: func(ctx context.Context, name string, args ...string) error {
+			if name == "mount" {
+				mounted = true
+			}
+			return nil
+		},
+	}
+	const mountpoint = "/snapshots/1/fs"
+	// The layer is unmounted while the image is created.
+	if err := e.export(context.TODO(), mountpoint, func() bool { return false }); err == nil {
+		t.Errorf("image must not be mounted over the unmounted layer")
+	}
+	if mounted || len(e.mounted) != 0 {
+		t.Errorf("image must not be mounted")
+	}
+	if entries, err := os.ReadDir(e.dir); err != nil || len(entries) != 0 {
+		t.Errorf("image must be removed: %v: %v", entries, err)
+	}
+}
@@ -31,6 +31,50 @@ const (
 	// the layer. If the layer is eStargz and contains prefetch landmarks, these config
 	// will be respeced.
 	TargetPrefetchSizeLabel = "containerd.io/snapshot/remote/stargz.prefetch"
+
+	// TargetZtocDigestLabel is a snapshot label key that contains the digest of the
+	// ztoc of the layer. If this is specified, the layer is treated as an ordinary
+	// gzip-compressed tar layer indexed by the ztoc.
+	TargetZtocDigestLabel = "containerd.io/snapshot/remote/stargz.ztoc.digest"
+
+	// TargetSELinuxContextLabel is a snapshot label key that contains the SELinux
+	// context applied to all files in the layer ("context=" mount option). This
+	// overrides FuseConfig.SELinuxContext and FuseConfig.SELinuxFSContext.
+	TargetSELinuxContextLabel = "containerd.io/snapshot/remote/selinux.context"
+
+	// TargetSELinuxFSContextLabel is a snapshot label key that contains the SELinux
+	// context of the filesystem of the layer ("fscontext=" mount option). This
+	// overrides FuseConfig.SELinuxContext and FuseConfig.SELinuxFSContext.
+	TargetSELinuxFSContextLabel = "containerd.io/snapshot/remote/selinux.fscontext"
+
+	// TargetMissThresholdLabel is a snapshot label key that contains the threshold of
+	// on-demand fetches of the layer (e.g. "bytes=104857600,count=1000,window=1m").
+	// This overrides MissThresholdConfig. "off" disables the threshold for the layer.
+	TargetMissThresholdLabel = "containerd.io/snapshot/remote/stargz.miss-threshold"
+
+	// TargetBackgroundFetchLabel is a snapshot label key that controls the background
+	// fetch of the layer, overriding NoBackgroundFetch. "off" disables it, "on" enables
+	// it and "full" fetches the entire layer at the mount with the priority over
+	// background fetches of other layers (e.g. for batch jobs reading most of the image).
+	TargetBackgroundFetchLabel = "containerd.io/snapshot/remote/stargz.background-fetch"
+
+	// TargetEncryptionLabelPrefix is the prefix of snapshot labels which contain the
+	// annotations of encrypted layers ("org.opencontainers.image.enc.*") such as the
+	// wrapped keys. "org.opencontainers.image.enc." is replaced by this prefix.
+	TargetEncryptionLabelPrefix = "containerd.io/snapshot/remote/stargz.enc."
+
+	// TargetRecordProfileLabel is a snapshot label key that enables recording files
+	// read from the layer during the specified duration after the mount (e.g. "60s").
+	// The files read from the layers of the image are written as a file access profile.
+	TargetRecordProfileLabel = "containerd.io/snapshot/remote/stargz.record-profile"
+
+	// TargetManifestDigestLabel is a snapshot label key that contains the digest of the
+	// manifest of the image which contains the layer.
+	TargetManifestDigestLabel = "containerd.io/snapshot/remote/stargz.manifest-digest"
+
+	// TargetLayerIndexLabel is a snapshot label key that contains the index of the layer
+	// in the manifest.
+	TargetLayerIndexLabel = "containerd.io/snapshot/remote/stargz.layer-index"
 )
 
 type Config struct {
@@ -50,6 +94,34 @@ type Config struct {
 	MaxConcurrency           int64 `toml:"max_concurrency"`
 	NoPrometheus             bool  `toml:"no_prometheus"`
 
+	// StrictVerification mounts only the layers whose TOC digest is recorded in the
+	// annotations of the layer descriptor in the image manifest, which is fetched from
+	// the registry by the snapshotter. TOC digests passed through labels must match it.
+	// Layers without the annotation (e.g. legacy stargz, ztoc-indexed or nydus layers)
+	// are refused instead of trusting the TOC in the blob.
+	StrictVerification bool `toml:"strict_verification"`
+
+	// RegistryTrust overrides how layers of images are verified per registry host.
+	// The first entry matching the host of an image is used. Images of hosts not
+	// matching any entry are verified according to the other options.
+	RegistryTrust []RegistryTrustConfig `toml:"registry_trust"`
+
+	// MaxResolveConcurrency is the max number of layers resolved in parallel
+	// when the other layers of the image are resolved (and prefetched) at the
+	// mount of a layer. 0 means no limit.
+	MaxResolveConcurrency int64 `toml:"max_resolve_concurrency"`
+
+	// UnpackNonLazyLayers makes the snapshotter unpack layers which can't be
+	// lazily pulled (e.g. non-eStargz layers) by itself so that the other layers
+	// of the image can still be lazily pulled.
+	UnpackNonLazyLayers bool `toml:"unpack_non_lazy_layers"`
+
+	// ZtocReferrers makes the snapshotter look up the ztoc index pushed as a referrer
+	// of the image manifest for layers passed without TOC or ztoc digests, so that
+	// ordinary gzip images are lazily pulled without passing the ztoc digests through
+	// labels (i.e. by clients other than `ctr-remote image rpull`).
+	ZtocReferrers bool `toml:"ztoc_referrers"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
@@ -57,6 +129,110 @@ type Config struct {
 	DirectoryCacheConfig `toml:"directory_cache"`
 
 	FuseConfig `toml:"fuse"`
+
+	// AccessHistoryConfig is config for learning access patterns of layers.
+	AccessHistoryConfig `toml:"access_history"`
+
+	// MissThresholdConfig is config for fetching entire layers which miss the
+	// cache too often.
+	MissThresholdConfig `toml:"miss_threshold"`
+
+	// EncryptionConfig is config for decrypting encrypted layers.
+	EncryptionConfig `toml:"encryption"`
+
+	// FetchAuditConfig is config for recording on-demand fetches as events.
+	FetchAuditConfig `toml:"fetch_audit"`
+
+	// BackgroundFetchConfig is config for limiting resources used by background fetches.
+	BackgroundFetchConfig `toml:"background_fetch"`
+
+	// ComposefsConfig is config for exporting fully fetched layers as composefs images.
+	ComposefsConfig `toml:"composefs"`
+}
+
+// ComposefsConfig is config for mounting fully fetched layers with composefs instead
+// of FUSE. Once all contents of a mounted layer are fetched, the layer is exported as
+// a composefs image and the image is mounted over the FUSE mount so that the following
+// containers read the layer through the kernel (and share its page cache) without the
+// snapshotter. This requires mkcomposefs and mount.composefs on the host.
+type ComposefsConfig struct {
+	// Enable enables exporting fully fetched layers as composefs images.
+	Enable bool `toml:"enable"`
+
+	// MkcomposefsPath is the path to mkcomposefs. (default: "mkcomposefs" in $PATH)
+	MkcomposefsPath string `toml:"mkcomposefs_path"`
+
+	// CheckIntervalSec is the interval (in sec) to check whether mounted layers are
+	// fully fetched. (default 10s)
+	CheckIntervalSec int64 `toml:"check_interval_sec"`
+}
+
+// BackgroundFetchConfig limits CPU and I/O used by background fetches so that the
+// decompression of layers doesn't steal them from containers. These are applied
+// to all layers of the snapshotter. 0 disables each limit.
+type BackgroundFetchConfig struct {
+	// MaxConcurrentLayers is the max number of layers fetched and decompressed in
+	// background in parallel.
+	MaxConcurrentLayers int64 `toml:"max_concurrent_layers"`
+
+	// BytesPerSec is the max rate (bytes/sec) of layer blobs read by background
+	// fetches, which bounds both decompression and writes to the cache.
+	BytesPerSec int64 `toml:"bytes_per_sec"`
+}
+
+// FetchAuditConfig is config for recording reads of files which fetch contents
+// from remote layers as JSON events (one per line).
+type FetchAuditConfig struct {
+	// Enable enables recording the events.
+	Enable bool `toml:"enable"`
+
+	// Path is the file the events are appended to. If empty, the events are
+	// written to the log of the snapshotter.
+	Path string `toml:"path"`
+
+	// SampleRate is the fraction of the events recorded (0 < rate <= 1). (default 1)
+	SampleRate float64 `toml:"sample_rate"`
+
+	// MinLatencyMSec records only the reads taking at least this duration.
+	MinLatencyMSec int64 `toml:"min_latency_msec"`
+}
+
+// EncryptionConfig is config for lazily pulling layers encrypted by ocicrypt.
+type EncryptionConfig struct {
+	// Keys are the keys to decrypt layers in the same format as the --key option of
+	// ctr (e.g. "<path to the private key>[:<password>]" or "provider:<name>" for
+	// key providers configured by $OCICRYPT_KEYPROVIDER_CONFIG).
+	Keys []string `toml:"keys"`
+
+	// AllowPlaintextCache allows writing decrypted contents of encrypted layers to
+	// the filesystem cache on disk. Otherwise, they are cached only in memory.
+	AllowPlaintextCache bool `toml:"allow_plaintext_cache"`
+}
+
+// MissThresholdConfig is the threshold of on-demand fetches of a layer. When the
+// fetches in the window exceed either of the limits, the entire layer is fetched
+// and decompressed to the cache with the priority over background tasks so that
+// the following reads are served locally. 0 disables each limit.
+type MissThresholdConfig struct {
+	// Bytes is the max bytes fetched on demand in the window.
+	Bytes int64 `toml:"bytes"`
+
+	// Count is the max number of on-demand fetches in the window.
+	Count int64 `toml:"count"`
+
+	// WindowSec is the length of the window in seconds. (default 60s)
+	WindowSec int64 `toml:"window_sec"`
+}
+
+// AccessHistoryConfig is config for recording files read from layers on disk
+// and prefetching them when the layers are mounted next time.
+type AccessHistoryConfig struct {
+	// Enable enables recording and prefetching the access history.
+	Enable bool `toml:"enable"`
+
+	// MaxFiles is the max number of files recorded per layer. Older entries are
+	// dropped first. (default 10000)
+	MaxFiles int `toml:"max_files"`
 }
 
 type BlobConfig struct {
@@ -72,10 +248,58 @@ type BlobConfig struct {
 	// If PrefetchChunkSize < ChunkSize prefetch bytes will be fetched as a single http GET,
 	// else total GET requests for prefetch = ceil(PrefetchSize / PrefetchChunkSize).
 	PrefetchChunkSize int64 `toml:"prefetch_chunk_size"`
+	// MaxParallelRangeFetches is the max number of parallel GET requests issued when
+	// a read misses non-contiguous chunks of a blob. 0 or 1 fetches them with
+	// one request.
+	MaxParallelRangeFetches int `toml:"max_parallel_range_fetches"`
+	// CoalesceGapSize is the max bytes between missed chunks of a blob fetched
+	// together as a single range. The gap is fetched (and cached) as well, which
+	// reduces the number of ranges and requests for small non-contiguous chunks.
+	// 0 coalesces only contiguous chunks.
+	CoalesceGapSize int64 `toml:"coalesce_gap_size"`
 
 	MaxRetries  int `toml:"max_retries"`
 	MinWaitMSec int `toml:"min_wait_msec"`
 	MaxWaitMSec int `toml:"max_wait_msec"`
+
+	// MirrorHealthCheckIntervalSec is the interval of health checks of registry hosts
+	// (mirrors and registries) which failed to serve blobs. Unhealthy hosts are tried
+	// only after healthy ones until they pass the health check.
+	MirrorHealthCheckIntervalSec int64 `toml:"mirror_health_check_interval_sec"`
+
+	// MirrorHedgeDelayMSec enables hedging of requests to mirrors. When a host doesn't
+	// respond in this duration, the same request is also sent to the next host and
+	// the first response is used. 0 disables hedging.
+	MirrorHedgeDelayMSec int64 `toml:"mirror_hedge_delay_msec"`
+
+	// BandwidthLimit is the max download rate from each registry host. The key is the
+	// hostname of the registry or the mirror (e.g. "docker.io").
+	BandwidthLimit map[string]BandwidthLimitConfig `toml:"bandwidth_limit"`
+
+	// P2P is configuration of the node-local P2P proxy from which blobs are fetched first.
+	P2P P2PConfig `toml:"p2p"`
+}
+
+// P2PConfig is configuration of a node-local P2P proxy (e.g. Dragonfly or Spegel).
+type P2PConfig struct {
+	// Endpoint is the URL of the P2P proxy (e.g. "http://127.0.0.1:65001"). Blobs are
+	// requested as "<endpoint>/v2/<repository>/blobs/<digest>" and fetched from the
+	// registry (and mirrors) when the proxy fails. Empty disables the P2P proxy.
+	Endpoint string `toml:"endpoint"`
+
+	// TimeoutSec is the timeout of connecting to the P2P proxy and waiting for its
+	// response headers. Default is 10 sec.
+	TimeoutSec int64 `toml:"timeout_sec"`
+}
+
+type BandwidthLimitConfig struct {
+	// OnDemandBytesPerSec is the max download rate (bytes/sec) of on-demand fetches
+	// and prefetch. 0 means no limit.
+	OnDemandBytesPerSec int64 `toml:"on_demand_bytes_per_sec"`
+
+	// BackgroundBytesPerSec is the max download rate (bytes/sec) of background fetches.
+	// 0 means no limit.
+	BackgroundBytesPerSec int64 `toml:"background_bytes_per_sec"`
 }
 
 type DirectoryCacheConfig struct {
@@ -83,6 +307,55 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct" default:"true"`
+
+	// FsVerity enables fs-verity on cache files (decompressed file contents and
+	// fetched layer blob chunks) and verifies them when they are opened. This is
+	// disabled automatically if the filesystem doesn't support fs-verity.
+	FsVerity bool `toml:"fs_verity"`
+
+	// Reflink shares extents of identical cache files (e.g. the same chunk in
+	// multiple layers) and of contents copied between tiers instead of storing
+	// copies. This requires a filesystem supporting reflink (e.g. XFS and btrfs) and
+	// is disabled automatically otherwise or if FsVerity is enabled.
+	Reflink bool `toml:"reflink"`
+
+	// Tiers are disk tiers of the cache in the order of lookup (e.g. local NVMe
+	// then a shared volume). Contents are added to the first tier and demoted to the
+	// next tier when a tier exceeds its size. The in-memory cache configured by
+	// MaxLRUCacheEntry stays in front of the first tier. If this is empty, the
+	// cache is stored under the root directory of the snapshotter.
+	Tiers []CacheTierConfig `toml:"tier"`
+
+	// PromoteOnHit moves contents found in a lower tier back to the first tier.
+	PromoteOnHit bool `toml:"promote_on_hit"`
+}
+
+// RegistryTrustConfig is config of the trust of registry hosts.
+type RegistryTrustConfig struct {
+	// Hosts is a list of registry host patterns (e.g. "registry.example.com" or
+	// "*.example.com") matched with path.Match.
+	Hosts []string `toml:"hosts"`
+
+	// Trust is how layers of images from the hosts are verified.
+	// "signed" requires the TOC digest recorded in the image manifest as
+	// strict_verification does, and a signature of the manifest if signature
+	// verification is enabled. "embedded" trusts the TOC digest passed through the
+	// labels or embedded in the blob as usual even if strict_verification is enabled.
+	// "untrusted" disables lazy pull so that containerd pulls the layers normally.
+	Trust string `toml:"trust"`
+}
+
+// CacheTierConfig is config of a disk tier of the cache.
+type CacheTierConfig struct {
+	// Name is the name of the tier used in metrics.
+	Name string `toml:"name"`
+
+	// Path is the directory where the tier stores the cache.
+	Path string `toml:"path"`
+
+	// MaxSizeBytes is the maximum size of the contents stored in the tier. 0 means
+	// unlimited. The last tier evicts contents instead of demoting them.
+	MaxSizeBytes int64 `toml:"max_size_bytes"`
 }
 
 type FuseConfig struct {
@@ -91,4 +364,30 @@ type FuseConfig struct {
 
 	// EntryTimeout defines TTL for directory, name lookup in seconds.
 	EntryTimeout int64 `toml:"entry_timeout"`
+
+	// SELinuxContext is the SELinux context applied to all files in the mounted
+	// layers ("context=" mount option). Ignored when SELinux is disabled on the host.
+	SELinuxContext string `toml:"selinux_context"`
+
+	// SELinuxFSContext is the SELinux context of the filesystem of the mounted
+	// layers ("fscontext=" mount option). File labels are then taken from the
+	// security.selinux xattrs recorded in the layer if the policy labels FUSE
+	// filesystems with xattrs. This can't be used with SELinuxContext.
+	SELinuxFSContext string `toml:"selinux_fscontext"`
+
+	// DisableSplice disables passing file contents cached on disk to the kernel
+	// with splice(2). Reads are then served by copying the contents through the
+	// user space.
+	DisableSplice bool `toml:"disable_splice"`
+
+	// ReadDeadlineMSec is the max duration of a read of a file in milliseconds.
+	// Reads exceeding it are handled according to ReadDeadlinePolicy instead of
+	// blocking until the fetch from the registry completes. 0 disables the deadline.
+	ReadDeadlineMSec int64 `toml:"read_deadline_msec"`
+
+	// ReadDeadlinePolicy is the behaviour on reads exceeding the deadline. "eio"
+	// (default) fails the read with EIO. "mirror" aborts the fetch from the slow
+	// host, retries the read on the other mirrors or the registry and fails the
+	// read with EIO if it doesn't complete within another deadline.
+	ReadDeadlinePolicy string `toml:"read_deadline_policy"`
 }
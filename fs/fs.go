@@ -39,16 +39,23 @@ package fs
 import (
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
+	"sort"
 	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/userns"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/audit"
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
@@ -57,6 +64,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/nydus"
 	"github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
 	metrics "github.com/docker/go-metrics"
@@ -65,6 +73,8 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -81,6 +91,9 @@ type options struct {
 	metadataStore     metadata.Store
 	metricsLogLevel   *logrus.Level
 	overlayOpaqueType layer.OverlayOpaqueType
+	backgroundFetch   func(image reference.Spec) (mode string, ok bool)
+	namespaceConfigs  map[string]NamespaceConfig
+	blobKeeper        BlobKeeper
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -116,6 +129,31 @@ func WithOverlayOpaqueType(overlayOpaqueType layer.OverlayOpaqueType) Option {
 	}
 }
 
+// WithBackgroundFetchModeFunc specifies the function which returns the mode of the
+// background fetch ("off", "on" or "full") of the layers of the image. This is used
+// for layers without config.TargetBackgroundFetchLabel. If the function returns
+// false, the mode follows the configuration.
+func WithBackgroundFetchModeFunc(f func(image reference.Spec) (mode string, ok bool)) Option {
+	return func(opts *options) {
+		opts.backgroundFetch = f
+	}
+}
+
+// BlobKeeper keeps blobs of layers fully fetched by the filesystem so that they are
+// served locally when the layers are resolved again (e.g. after the restart of the
+// filesystem). ra provides the contents of the blob.
+type BlobKeeper interface {
+	Keep(ctx context.Context, desc ocispec.Descriptor, ra io.ReaderAt) error
+}
+
+// WithBlobKeeper lets the filesystem pass blobs of layers fully fetched by background
+// fetches to the keeper.
+func WithBlobKeeper(k BlobKeeper) Option {
+	return func(opts *options) {
+		opts.blobKeeper = k
+	}
+}
+
 func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
@@ -136,6 +174,13 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		entryTimeout = defaultFuseTimeout
 	}
 
+	selinuxEnabled := isSELinuxEnabled()
+	if _, err := selinuxMountOptions(cfg.FuseConfig.SELinuxContext, cfg.FuseConfig.SELinuxFSContext); err != nil {
+		return nil, err
+	} else if !selinuxEnabled && (cfg.FuseConfig.SELinuxContext != "" || cfg.FuseConfig.SELinuxFSContext != "") {
+		log.L.Warn("SELinux is disabled on this host; ignoring SELinux context options")
+	}
+
 	metadataStore := fsOpts.metadataStore
 	if metadataStore == nil {
 		metadataStore = memorymetadata.NewReader
@@ -147,6 +192,33 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(refspec.Hostname())
 		})
 	}
+	var resolveSem *semaphore.Weighted
+	if cfg.MaxResolveConcurrency > 0 {
+		resolveSem = semaphore.NewWeighted(cfg.MaxResolveConcurrency)
+	}
+
+	if cfg.StrictVerification && (cfg.DisableVerification || cfg.AllowNoVerification) {
+		return nil, fmt.Errorf("strict_verification can't be enabled with disable_verification or allow_no_verification")
+	}
+	if err := ValidateRegistryTrust(cfg.RegistryTrust); err != nil {
+		return nil, fmt.Errorf("invalid registry_trust: %w", err)
+	}
+
+	var ztocIndexes *ztocIndexCache
+	if cfg.ZtocReferrers {
+		ztocIndexes = &ztocIndexCache{entries: make(map[string]*ztocIndexEntry)}
+	}
+
+	fetchAudit, err := audit.NewLogger(cfg.FetchAuditConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup fetch audit: %w", err)
+	}
+
+	composefs, err := newComposefsExporter(root, cfg.ComposefsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup composefs export: %w", err)
+	}
+
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
 	r, err := layer.NewResolver(root, tm, cfg, fsOpts.resolveHandlers, metadataStore, fsOpts.overlayOpaqueType)
 	if err != nil {
@@ -173,14 +245,35 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		prefetchSize:          cfg.PrefetchSize,
 		noprefetch:            cfg.NoPrefetch,
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
+		imageBackgroundFetch:  fsOpts.backgroundFetch,
 		debug:                 cfg.Debug,
 		layer:                 make(map[string]layer.Layer),
+		layerImage:            make(map[string]string),
 		backgroundTaskManager: tm,
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
+		strictVerification:    cfg.StrictVerification,
+		registryTrust:         cfg.RegistryTrust,
+		manifests:             &manifestCache{entries: make(map[string]*manifestEntry)},
+		ztocIndexes:           ztocIndexes,
 		metricsController:     c,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
+		selinuxEnabled:        selinuxEnabled,
+		selinuxContext:        cfg.FuseConfig.SELinuxContext,
+		selinuxFSContext:      cfg.FuseConfig.SELinuxFSContext,
+		inUserNS:              userns.RunningInUserNS(),
+		resolveSem:            resolveSem,
+		preResolving:          make(map[string]struct{}),
+		unpackNonLazyLayers:   cfg.UnpackNonLazyLayers,
+		resolveHandlers:       fsOpts.resolveHandlers,
+		missThreshold:         layer.MissThresholdFromConfig(cfg.MissThresholdConfig),
+		fetchAudit:            fetchAudit,
+		composefs:             composefs,
+		root:                  root,
+		profiles:              make(map[string]*profileRecorder),
+		namespaceConfigs:      fsOpts.namespaceConfigs,
+		blobKeeper:            fsOpts.blobKeeper,
 	}, nil
 }
 
@@ -189,16 +282,39 @@ type filesystem struct {
 	prefetchSize          int64
 	noprefetch            bool
 	noBackgroundFetch     bool
+	imageBackgroundFetch  func(image reference.Spec) (mode string, ok bool) // nil if not specified
 	debug                 bool
 	layer                 map[string]layer.Layer
+	layerImage            map[string]string // image references of the layers keyed by the mountpoint
 	layerMu               sync.Mutex
 	backgroundTaskManager *task.BackgroundTaskManager
 	allowNoVerification   bool
 	disableVerification   bool
+	strictVerification    bool
+	registryTrust         []config.RegistryTrustConfig
+	manifests             *manifestCache
+	ztocIndexes           *ztocIndexCache // nil if ztoc indexes aren't discovered through referrers
 	getSources            source.GetSources
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
+	selinuxEnabled        bool
+	selinuxContext        string
+	selinuxFSContext      string
+	inUserNS              bool
+	resolveSem            *semaphore.Weighted // nil if max_resolve_concurrency is unlimited
+	preResolving          map[string]struct{}
+	preResolvingMu        sync.Mutex
+	unpackNonLazyLayers   bool
+	resolveHandlers       map[string]remote.Handler
+	missThreshold         layer.MissThreshold
+	fetchAudit            *audit.Logger      // nil if the fetch audit is disabled
+	composefs             *composefsExporter // nil if the composefs export is disabled
+	root                  string
+	profiles              map[string]*profileRecorder // recorders of images keyed by the reference
+	profilesMu            sync.Mutex
+	namespaceConfigs      map[string]NamespaceConfig // overridden configuration keyed by the containerd namespace
+	blobKeeper            BlobKeeper                 // nil if blobs of fully fetched layers aren't kept
 }
 
 func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
@@ -211,15 +327,36 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	fs.backgroundTaskManager.DoPrioritizedTask()
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+	namespace, _ := namespaces.Namespace(ctx)
+	ctx = fs.namespaceContext(ctx, namespace)
 
 	// Get source information of this layer.
-	src, err := fs.getSources(labels)
+	src, err := fs.sources(ctx, labels)
 	if err != nil {
 		return err
 	} else if len(src) == 0 {
 		return fmt.Errorf("source must be passed")
 	}
 
+	// Record how the layer of the image is pulled. If this fails, containerd
+	// falls back to downloading the layer.
+	image := src[0].Name.String()
+	defer func() {
+		mode := commonmetrics.LazyPull
+		if retErr != nil {
+			mode = commonmetrics.FallbackPull
+		}
+		commonmetrics.IncImageLayerPullCount(image, namespace, mode)
+	}()
+
+	// Layers of untrusted registries aren't lazily pulled so containerd falls back
+	// to downloading them.
+	host := src[0].Name.Hostname()
+	if RegistryTrustOf(fs.registryTrust, host) == RegistryTrustUntrusted {
+		log.G(ctx).WithField("host", host).Info("refusing to lazily pull layer from untrusted registry")
+		return fmt.Errorf("lazy pull from untrusted registry %q is disabled", host)
+	}
+
 	defaultPrefetchSize := fs.prefetchSize
 	if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
 		if ps, err := strconv.ParseInt(psStr, 10, 64); err == nil {
@@ -227,6 +364,13 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	}
 
+	src, labels = fs.withDiscoveredZtoc(ctx, src, labels)
+
+	bgFetch, err := fs.backgroundFetchMode(ctx, labels, src[0].Name)
+	if err != nil {
+		return err
+	}
+
 	// Resolve the target layer
 	var (
 		resultChan = make(chan layer.Layer)
@@ -238,7 +382,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target)
 			if err == nil {
 				resultChan <- l
-				fs.prefetch(ctx, l, defaultPrefetchSize, start)
+				fs.prefetch(ctx, l, defaultPrefetchSize, bgFetch, start)
 				return
 			}
 			rErr = fmt.Errorf("failed to resolve layer %q from %q: %v: %w", s.Target.Digest, s.Name, err, rErr)
@@ -247,24 +391,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}()
 
 	// Also resolve and cache other layers in parallel
-	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
-	for _, desc := range neighboringLayers(preResolve.Manifest, preResolve.Target) {
-		desc := desc
-		go func() {
-			// Avoids to get canceled by client.
-			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
-			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc)
-			if err != nil {
-				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
-				return
-			}
-			fs.prefetch(ctx, l, defaultPrefetchSize, start)
-
-			// Release this layer because this isn't target and we don't use it anymore here.
-			// However, this will remain on the resolver cache until eviction.
-			l.Done()
-		}()
-	}
+	// Avoids to get canceled by client.
+	preResolveCtx := fs.namespaceContext(log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint)), namespace)
+	go fs.preResolve(preResolveCtx, src[0], defaultPrefetchSize, bgFetch, start) // TODO: should we pre-resolve blobs in other sources as well?
 
 	// Wait for resolving completion
 	var l layer.Layer
@@ -284,7 +413,19 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}()
 
 	// Verify layer's content
-	if fs.disableVerification {
+	if fs.strictVerificationOf(host) {
+		// Verify this layer using the TOC JSON digest recorded in the image manifest.
+		dgst, err := fs.manifestTOCDigest(ctx, src, labels)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("refusing to mount layer in strict verification mode")
+			return fmt.Errorf("strict verification failed: %w", err)
+		}
+		if err := l.Verify(dgst); err != nil {
+			log.G(ctx).WithError(err).Debugf("invalid layer")
+			return fmt.Errorf("invalid stargz layer: %w", err)
+		}
+		log.G(ctx).Debugf("verified with TOC digest in the manifest")
+	} else if fs.disableVerification {
 		// Skip if verification is disabled completely
 		l.SkipVerify()
 		log.G(ctx).Infof("Verification forcefully skipped")
@@ -300,17 +441,92 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			return fmt.Errorf("invalid stargz layer: %w", err)
 		}
 		log.G(ctx).Debugf("verified")
+	} else if ztocDigest, ok := labels[config.TargetZtocDigestLabel]; ok {
+		// Verify this layer using the digest of the ztoc. The ztoc contains the
+		// digests of the file contents.
+		dgst, err := digest.Parse(ztocDigest)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to parse passed ztoc digest %q", ztocDigest)
+			return fmt.Errorf("invalid ztoc digest: %v: %w", ztocDigest, err)
+		}
+		if err := l.Verify(dgst); err != nil {
+			log.G(ctx).WithError(err).Debugf("invalid layer")
+			return fmt.Errorf("invalid ztoc-indexed layer: %w", err)
+		}
+		log.G(ctx).Debugf("verified")
 	} else if _, ok := labels[config.TargetSkipVerifyLabel]; ok && fs.allowNoVerification {
 		// If unverified layer is allowed, use it with warning.
 		// This mode is for legacy stargz archives which don't contain digests
 		// necessary for layer verification.
 		l.SkipVerify()
 		log.G(ctx).Warningf("No verification is held for layer")
+	} else if _, ok := labels[nydus.LayerAnnotationNydusBootstrap]; ok {
+		// Verify this Nydus bootstrap layer using the layer digest. The bootstrap contains
+		// the digests of the chunks in the blob layers.
+		if err := l.Verify(l.Info().Digest); err != nil {
+			log.G(ctx).WithError(err).Debugf("invalid layer")
+			return fmt.Errorf("invalid nydus bootstrap layer (only sha256 digester is supported for verification): %w", err)
+		}
+		log.G(ctx).Debugf("verified")
+	} else if _, ok := labels[nydus.LayerAnnotationNydusBlob]; ok {
+		// Nydus blob layer is mounted as an empty directory so there is nothing to verify.
+		// The contents are verified through the bootstrap layer.
+		l.SkipVerify()
 	} else {
 		// Verification must be done. Don't mount this layer.
 		return fmt.Errorf("digest of TOC JSON must be passed")
 	}
-	node, err := l.RootNode(0)
+	missThreshold := fs.missThreshold
+	if s, ok := labels[config.TargetMissThresholdLabel]; ok {
+		if missThreshold, err = layer.ParseMissThreshold(s); err != nil {
+			return err
+		}
+	}
+	l.WatchMisses(missThreshold)
+	idMap, err := layer.ParseIDMap(labels[snapshot.LabelUIDMapping], labels[snapshot.LabelGIDMapping])
+	if err != nil {
+		return err
+	}
+	var selinuxOpts []string
+	if fs.selinuxEnabled {
+		context, fscontext := fs.selinuxContext, fs.selinuxFSContext
+		lContext, okContext := labels[config.TargetSELinuxContextLabel]
+		lFSContext, okFSContext := labels[config.TargetSELinuxFSContextLabel]
+		if okContext || okFSContext {
+			context, fscontext = lContext, lFSContext
+		}
+		if selinuxOpts, err = selinuxMountOptions(context, fscontext); err != nil {
+			return err
+		}
+	}
+	nodeOpts := []layer.NodeOption{layer.WithFirstReadHook(func() {
+		commonmetrics.MeasureTimeToFirstRead(image, namespace, start)
+	}), layer.WithReadOutcomeHook(func(outcome string, size int64) {
+		fs.metricsController.RecordRead(image, namespace, outcome, size)
+	})}
+	if fs.fetchAudit != nil {
+		layerDigest := l.Info().Digest
+		nodeOpts = append(nodeOpts, layer.WithOnDemandFetchHook(func(path string, offset, size int64, pid uint32, latency time.Duration) {
+			fs.fetchAudit.Record(audit.Event{
+				Time:      time.Now(),
+				Image:     image,
+				Namespace: namespace,
+				Layer:     layerDigest,
+				Path:      path,
+				Offset:    offset,
+				Size:      size,
+				PID:       pid,
+			}, latency)
+		}))
+	}
+	if windowStr, ok := labels[config.TargetRecordProfileLabel]; ok {
+		if opt, err := fs.recordProfile(image, windowStr, labels); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to record profile")
+		} else {
+			nodeOpts = append(nodeOpts, opt)
+		}
+	}
+	node, err := l.RootNode(0, idMap, nodeOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
 		return fmt.Errorf("failed to get root node: %w", err)
@@ -323,8 +539,10 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.layerImage[mountpoint] = image
 	fs.layerMu.Unlock()
 	fs.metricsController.Add(mountpoint, l)
+	fs.metricsController.AddImage(mountpoint, image, namespace)
 
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
@@ -338,12 +556,19 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		FsName:     "stargz", // name this filesystem as "stargz"
 		Debug:      fs.debug,
 	}
-	if _, err := exec.LookPath(fusermountBin); err == nil {
+	if fs.inUserNS {
+		// Rootless mode (e.g. in RootlessKit's namespaces). The root of the user
+		// namespace can mount FUSE without fusermount (unless the kernel is older
+		// than 4.18, in which case go-fuse falls back to fusermount). setuid can't
+		// be allowed here.
+		mountOpts.DirectMount = true
+	} else if _, err := exec.LookPath(fusermountBin); err == nil {
 		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
 	} else {
 		log.G(ctx).WithError(err).Infof("%s not installed; trying direct mount", fusermountBin)
 		mountOpts.DirectMount = true
 	}
+	mountOpts.Options = append(mountOpts.Options, selinuxOpts...)
 	server, err := fuse.NewServer(rawFS, mountpoint, mountOpts)
 	if err != nil {
 		log.G(ctx).WithError(err).Debug("failed to make filesystem server")
@@ -351,7 +576,24 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}
 
 	go server.Serve()
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		return err
+	}
+	if fs.composefs != nil {
+		if len(selinuxOpts) > 0 {
+			// composefs mounts can't be labeled with the SELinux contexts.
+			log.G(ctx).Debug("composefs export is disabled for layers with SELinux contexts")
+		} else {
+			// Avoids to get canceled by client.
+			watchCtx := log.WithLogger(context.Background(), log.G(ctx))
+			go fs.composefs.watch(watchCtx, mountpoint, l, func() bool {
+				fs.layerMu.Lock()
+				defer fs.layerMu.Unlock()
+				return fs.layer[mountpoint] == l
+			})
+		}
+	}
+	return nil
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -380,7 +622,7 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	}
 
 	// Wait for prefetch compeletion
-	if !fs.noprefetch {
+	if !fs.noPrefetch(ctx) {
 		if err := l.WaitForPrefetchCompletion(); err != nil {
 			log.G(ctx).WithError(err).Warn("failed to sync with prefetch completion")
 		}
@@ -397,7 +639,7 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	log.G(ctx).WithError(err).Warn("failed to connect to blob")
 
 	// Check failed. Try to refresh the connection with fresh source information
-	src, err := fs.getSources(labels)
+	src, err := fs.sources(ctx, labels)
 	if err != nil {
 		return err
 	}
@@ -429,9 +671,15 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
 	delete(fs.layer, mountpoint) // unregisters the corresponding layer
+	delete(fs.layerImage, mountpoint)
 	l.Done()
 	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
+	if fs.composefs != nil {
+		if err := fs.composefs.unmount(mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to unmount composefs image from %q", mountpoint)
+		}
+	}
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
@@ -440,23 +688,271 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
-func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, defaultPrefetchSize int64, start time.Time) {
+// MountedLayer is a layer mounted by the filesystem.
+type MountedLayer struct {
+	Mountpoint string
+	Reference  string // reference of the image which contains the layer
+	Layer      layer.Layer
+}
+
+// MountedLayers returns the layers currently mounted.
+func (fs *filesystem) MountedLayers() []MountedLayer {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	var layers []MountedLayer
+	for mp, l := range fs.layer {
+		layers = append(layers, MountedLayer{Mountpoint: mp, Reference: fs.layerImage[mp], Layer: l})
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].Mountpoint < layers[j].Mountpoint })
+	return layers
+}
+
+// Prewarm resolves all layers in the manifest and fetches them in background so
+// that the image can be mounted quickly later. Resolved layers are kept at least
+// for the keep duration after the fetch completes and then remain in the
+// resolver cache until eviction.
+func (fs *filesystem) Prewarm(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, manifest ocispec.Manifest, keep time.Duration) error {
+	var (
+		eg    errgroup.Group
+		start = time.Now()
+	)
+	for _, desc := range manifest.Layers {
+		desc := desc
+		eg.Go(func() error {
+			// Avoids to get canceled by client.
+			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("ref", refspec.String()))
+			release := fs.acquireResolve(ctx)
+			l, err := fs.resolver.Resolve(ctx, hosts, refspec, desc)
+			release()
+			if err != nil {
+				return fmt.Errorf("failed to resolve layer %q: %w", desc.Digest, err)
+			}
+			if !fs.noprefetch {
+				go l.Prefetch(fs.prefetchSize)
+			}
+			go func() {
+				if err := l.BackgroundFetch(); err != nil {
+					log.G(ctx).WithError(err).Debugf("failed to prewarm layer %q", desc.Digest)
+					l.Done()
+					return
+				}
+				log.G(ctx).WithField("digest", desc.Digest).
+					WithField("latency", time.Since(start).Milliseconds()).Debugf("prewarmed layer")
+				time.AfterFunc(keep, l.Done)
+			}()
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// Usage returns the disk usage of the caches of the layer mounted at the mountpoint.
+func (fs *filesystem) Usage(ctx context.Context, mountpoint string) (snapshots.Usage, error) {
+	fs.layerMu.Lock()
+	l := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if l == nil {
+		return snapshots.Usage{}, fmt.Errorf("layer not registered")
+	}
+	u, err := fs.resolver.LayerCacheUsage(ctx, l.Info().Digest)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	return snapshots.Usage(u), nil
+}
+
+// ImageStats returns the statistics of the images whose layers have been mounted.
+func (fs *filesystem) ImageStats(ctx context.Context) ([]layermetrics.ImageStats, error) {
+	return fs.metricsController.ImageStats(), nil
+}
+
+// PauseBackgroundFetch pauses background fetches of the layers of the image or of
+// all layers if ref is empty.
+func (fs *filesystem) PauseBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error) {
+	image, err := backgroundFetchImage(ref)
+	if err != nil {
+		return layer.BackgroundFetchStatus{}, err
+	}
+	fs.resolver.PauseBackgroundFetch(image)
+	log.G(ctx).WithField("ref", image).Info("paused background fetch")
+	return fs.resolver.BackgroundFetchStatus(), nil
+}
+
+// ResumeBackgroundFetch resumes background fetches of the layers of the image. If ref
+// is empty, background fetches of all layers are resumed.
+func (fs *filesystem) ResumeBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error) {
+	image, err := backgroundFetchImage(ref)
+	if err != nil {
+		return layer.BackgroundFetchStatus{}, err
+	}
+	fs.resolver.ResumeBackgroundFetch(image)
+	log.G(ctx).WithField("ref", image).Info("resumed background fetch")
+	return fs.resolver.BackgroundFetchStatus(), nil
+}
+
+// BackgroundFetchStatus returns the status of the pause of background fetches.
+func (fs *filesystem) BackgroundFetchStatus(ctx context.Context) (layer.BackgroundFetchStatus, error) {
+	return fs.resolver.BackgroundFetchStatus(), nil
+}
+
+// backgroundFetchImage returns the image reference in the form used by the layers.
+func backgroundFetchImage(ref string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	return refspec.String(), nil
+}
+
+// CacheUsage returns the disk usage of the layer caches of this filesystem.
+func (fs *filesystem) CacheUsage(ctx context.Context) ([]layer.CacheUsage, error) {
+	return fs.resolver.CacheUsage()
+}
+
+// PruneCache removes layer caches which aren't used by this filesystem and match the filter.
+func (fs *filesystem) PruneCache(ctx context.Context, filter func(layer.CacheUsage) bool) ([]layer.CacheUsage, error) {
+	pruned, err := fs.resolver.PruneCache(filter)
+	for _, u := range pruned {
+		log.G(ctx).WithField("directory", u.Directory).WithField("ref", u.Reference).
+			WithField("digest", u.Digest).Debugf("pruned cache")
+	}
+	return pruned, err
+}
+
+const (
+	backgroundFetchOff  = "off"
+	backgroundFetchOn   = "on"
+	backgroundFetchFull = "full"
+)
+
+// backgroundFetchMode returns the mode of the background fetch of the layer ("off",
+// "on" or "full") specified by config.TargetBackgroundFetchLabel or the mode of the
+// image. If neither is specified, the mode follows the configuration of the
+// containerd namespace of the context.
+func (fs *filesystem) backgroundFetchMode(ctx context.Context, labels map[string]string, image reference.Spec) (string, error) {
+	mode, ok := labels[config.TargetBackgroundFetchLabel]
+	if !ok && fs.imageBackgroundFetch != nil {
+		mode, ok = fs.imageBackgroundFetch(image)
+	}
+	if !ok {
+		if fs.noBackgroundFetchOf(ctx) {
+			return backgroundFetchOff, nil
+		}
+		return backgroundFetchOn, nil
+	}
+	switch mode {
+	case backgroundFetchOff, backgroundFetchOn, backgroundFetchFull:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid background fetch mode %q", mode)
+}
+
+func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, defaultPrefetchSize int64, bgFetch string, start time.Time) {
 	// Prefetch a layer. The first Check() for this layer waits for the prefetch completion.
-	if !fs.noprefetch {
+	if !fs.noPrefetch(ctx) {
 		go l.Prefetch(defaultPrefetchSize)
 	}
 
-	// Fetch whole layer aggressively in background.
-	if !fs.noBackgroundFetch {
+	switch bgFetch {
+	case backgroundFetchFull:
+		// Fetch whole layer immediately with the priority over background fetches.
+		go func() {
+			if err := l.MakeResident(); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to fetch entire layer %q", l.Info().Digest)
+				return
+			}
+			fs.keepBlob(ctx, l)
+		}()
+	case backgroundFetchOn:
+		// Fetch whole layer aggressively in background.
 		go func() {
 			if err := l.BackgroundFetch(); err == nil {
 				// write log record for the latency between mount start and last on demand fetch
 				commonmetrics.LogLatencyForLastOnDemandFetch(ctx, l.Info().Digest, start, l.Info().ReadTime)
+				fs.keepBlob(ctx, l)
+			}
+		}()
+	}
+}
+
+// keepBlob passes the blob of the layer to the blob keeper if the entire blob has been
+// fetched to the cache.
+func (fs *filesystem) keepBlob(ctx context.Context, l layer.Layer) {
+	if fs.blobKeeper == nil {
+		return
+	}
+	info := l.Info()
+	if info.FetchedSize < info.Size {
+		return // reading the blob would fetch the rest
+	}
+	desc := ocispec.Descriptor{Digest: info.Digest, Size: info.Size}
+	if err := fs.blobKeeper.Keep(ctx, desc, &layerReaderAt{l}); err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to keep blob of layer %q", info.Digest)
+	}
+}
+
+// layerReaderAt reads the blob of the layer without polluting the memory cache.
+type layerReaderAt struct {
+	l layer.Layer
+}
+
+func (r *layerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.l.ReadAt(p, off, remote.WithCacheOpts(cache.Direct()))
+}
+
+// preResolve resolves, caches and prefetches the layers of the image other than
+// the target. Layers are started in the order of the manifest (i.e. from the
+// lowest one), which is also the order containerd mounts them, and each one is
+// prefetched as soon as it's resolved. Layers already being pre-resolved (e.g.
+// by mounts of other layers of the image) are skipped.
+func (fs *filesystem) preResolve(ctx context.Context, src source.Source, prefetchSize int64, bgFetch string, start time.Time) {
+	for _, desc := range neighboringLayers(src.Manifest, src.Target) {
+		desc := desc
+		key := src.Name.String() + "/" + desc.Digest.String()
+		fs.preResolvingMu.Lock()
+		if _, ok := fs.preResolving[key]; ok {
+			fs.preResolvingMu.Unlock()
+			continue
+		}
+		fs.preResolving[key] = struct{}{}
+		fs.preResolvingMu.Unlock()
+		release := fs.acquireResolve(ctx)
+		go func() {
+			defer func() {
+				release()
+				fs.preResolvingMu.Lock()
+				delete(fs.preResolving, key)
+				fs.preResolvingMu.Unlock()
+			}()
+			l, err := fs.resolver.Resolve(ctx, src.Hosts, src.Name, desc)
+			if err != nil {
+				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
+				return
 			}
+			fs.prefetch(ctx, l, prefetchSize, bgFetch, start)
+
+			// Release this layer because this isn't target and we don't use it anymore here.
+			// However, this will remain on the resolver cache until eviction.
+			l.Done()
 		}()
 	}
 }
 
+// acquireResolve waits until a layer can be resolved under max_resolve_concurrency.
+// The returned function must be called when the resolution completes.
+func (fs *filesystem) acquireResolve(ctx context.Context) (release func()) {
+	if fs.resolveSem == nil {
+		return func() {}
+	}
+	if err := fs.resolveSem.Acquire(ctx, 1); err != nil {
+		return func() {}
+	}
+	return func() { fs.resolveSem.Release(1) }
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
@@ -23,13 +23,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
@@ -65,14 +69,18 @@ type breakableLayer struct {
 	success bool
 }
 
-func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
-func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       { return nil, nil }
+func (l *breakableLayer) Info() layer.Info { return layer.Info{} }
+func (l *breakableLayer) RootNode(uint32, layer.IDMap, ...layer.NodeOption) (fusefs.InodeEmbedder, error) {
+	return nil, nil
+}
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) Prefetch(prefetchSize int64) error                   { return fmt.Errorf("fail") }
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
 func (l *breakableLayer) WaitForPrefetchCompletion() error                    { return fmt.Errorf("fail") }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) WatchMisses(layer.MissThreshold)                     {}
+func (l *breakableLayer) MakeResident() error                                 { return nil }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -86,3 +94,215 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	return nil
 }
 func (l *breakableLayer) Done() {}
+
+func TestSELinuxMountOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		context   string
+		fscontext string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "none"},
+		{
+			name:    "context",
+			context: "system_u:object_r:container_ro_file_t:s0",
+			want:    []string{"context=system_u:object_r:container_ro_file_t:s0"},
+		},
+		{
+			name:      "fscontext",
+			fscontext: "system_u:object_r:fusefs_t:s0",
+			want:      []string{"fscontext=system_u:object_r:fusefs_t:s0"},
+		},
+		{
+			name:    "categories",
+			context: "system_u:object_r:container_file_t:s0:c1,c2",
+			want:    []string{`context="system_u:object_r:container_file_t:s0:c1,c2"`},
+		},
+		{
+			name:      "both",
+			context:   "system_u:object_r:container_ro_file_t:s0",
+			fscontext: "system_u:object_r:fusefs_t:s0",
+			wantErr:   true,
+		},
+		{name: "invalid", context: "container_file_t", wantErr: true},
+		{name: "quote", context: `system_u:object_r:container_file_t:s0",suid`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selinuxMountOptions(tt.context, tt.fscontext)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("must fail but got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("options = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackgroundFetchMode(t *testing.T) {
+	tests := []struct {
+		name              string
+		noBackgroundFetch bool
+		nsBackgroundFetch *bool // no_background_fetch of the namespace
+		label             string
+		image             string
+		want              string
+		wantErr           bool
+	}{
+		{name: "default", want: backgroundFetchOn},
+		{name: "disabled", noBackgroundFetch: true, want: backgroundFetchOff},
+		{name: "label-off", label: "off", want: backgroundFetchOff},
+		{name: "label-on", noBackgroundFetch: true, label: "on", want: backgroundFetchOn},
+		{name: "label-full", noBackgroundFetch: true, label: "full", want: backgroundFetchFull},
+		{name: "image", noBackgroundFetch: true, image: "full", want: backgroundFetchFull},
+		{name: "label-over-image", label: "off", image: "full", want: backgroundFetchOff},
+		{name: "invalid", label: "always", wantErr: true},
+		{name: "namespace-disabled", nsBackgroundFetch: boolPtr(true), want: backgroundFetchOff},
+		{name: "namespace-enabled", noBackgroundFetch: true, nsBackgroundFetch: boolPtr(false), want: backgroundFetchOn},
+		{name: "label-over-namespace", nsBackgroundFetch: boolPtr(true), label: "on", want: backgroundFetchOn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{noBackgroundFetch: tt.noBackgroundFetch, noprefetch: true}
+			ctx := namespaces.WithNamespace(context.TODO(), "test")
+			if tt.nsBackgroundFetch != nil {
+				fs.namespaceConfigs = map[string]NamespaceConfig{"test": {NoBackgroundFetch: tt.nsBackgroundFetch}}
+			}
+			labels := make(map[string]string)
+			if tt.label != "" {
+				labels[config.TargetBackgroundFetchLabel] = tt.label
+			}
+			refspec := reference.Spec{Locator: "example.com/test", Object: "latest"}
+			fs.imageBackgroundFetch = func(image reference.Spec) (string, bool) {
+				if image != refspec {
+					t.Errorf("unexpected image %q", image)
+				}
+				return tt.image, tt.image != ""
+			}
+			got, err := fs.backgroundFetchMode(ctx, labels, refspec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("must fail but got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("mode = %q; want %q", got, tt.want)
+			}
+
+			l := &fetchRecordingLayer{fetched: make(chan string, 1)}
+			fs.prefetch(ctx, l, 0, got, time.Now())
+			var fetched string
+			select {
+			case fetched = <-l.fetched:
+			case <-time.After(100 * time.Millisecond):
+			}
+			switch {
+			case got == backgroundFetchOff && fetched != "":
+				t.Errorf("layer must not be fetched but got %q", fetched)
+			case got == backgroundFetchOn && fetched != "background":
+				t.Errorf("layer must be fetched in background but got %q", fetched)
+			case got == backgroundFetchFull && fetched != "resident":
+				t.Errorf("entire layer must be fetched but got %q", fetched)
+			}
+		})
+	}
+}
+
+type fetchRecordingLayer struct {
+	breakableLayer
+	fetched chan string
+}
+
+func (l *fetchRecordingLayer) BackgroundFetch() error {
+	l.fetched <- "background"
+	return nil
+}
+
+func (l *fetchRecordingLayer) MakeResident() error {
+	l.fetched <- "resident"
+	return nil
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestKeepBlob(t *testing.T) {
+	blob := []byte("dummy blob")
+	for _, tt := range []struct {
+		name        string
+		mode        string
+		fetchedSize int64
+		want        bool
+	}{
+		{name: "background", mode: backgroundFetchOn, fetchedSize: int64(len(blob)), want: true},
+		{name: "full", mode: backgroundFetchFull, fetchedSize: int64(len(blob)), want: true},
+		{name: "partially_fetched", mode: backgroundFetchOn, fetchedSize: 1},
+		{name: "off", mode: backgroundFetchOff, fetchedSize: int64(len(blob))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keeper := &testBlobKeeper{kept: make(chan []byte, 1)}
+			fs := &filesystem{noprefetch: true, blobKeeper: keeper}
+			l := &blobLayer{
+				fetchRecordingLayer: fetchRecordingLayer{fetched: make(chan string, 1)},
+				blob:                blob,
+				info:                layer.Info{Digest: digest.FromBytes(blob), Size: int64(len(blob)), FetchedSize: tt.fetchedSize},
+			}
+			fs.prefetch(context.TODO(), l, 0, tt.mode, time.Now())
+			var kept []byte
+			select {
+			case kept = <-keeper.kept:
+			case <-time.After(100 * time.Millisecond):
+			}
+			if !tt.want {
+				if kept != nil {
+					t.Errorf("blob must not be kept")
+				}
+				return
+			}
+			if string(kept) != string(blob) {
+				t.Errorf("kept blob = %q; want %q", string(kept), string(blob))
+			}
+			if keeper.desc.Digest != l.info.Digest || keeper.desc.Size != l.info.Size {
+				t.Errorf("kept descriptor = %+v; want digest %v and size %d", keeper.desc, l.info.Digest, l.info.Size)
+			}
+		})
+	}
+}
+
+type blobLayer struct {
+	fetchRecordingLayer
+	blob []byte
+	info layer.Info
+}
+
+func (l *blobLayer) Info() layer.Info { return l.info }
+
+func (l *blobLayer) ReadAt(p []byte, off int64, _ ...remote.Option) (int, error) {
+	return bytes.NewReader(l.blob).ReadAt(p, off)
+}
+
+type testBlobKeeper struct {
+	desc ocispec.Descriptor
+	kept chan []byte
+}
+
+func (k *testBlobKeeper) Keep(ctx context.Context, desc ocispec.Descriptor, ra io.ReaderAt) error {
+	p := make([]byte, desc.Size)
+	if _, err := ra.ReadAt(p, 0); err != nil {
+		return err
+	}
+	k.desc = desc
+	k.kept <- p
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// minBackgroundBurstBytes is the minimal burst of the limiter of background fetches.
+const minBackgroundBurstBytes = 64 * 1024
+
+// backgroundBudget limits the resources used by background fetches of all layers
+// of a resolver. Decompression of the fetched contents (CPU) and writes to the cache
+// (I/O) are proportional to the bytes read from the blobs so these are limited by
+// the rate of the reads. nil fields mean no limit.
+type backgroundBudget struct {
+	sem *semaphore.Weighted
+	lim *rate.Limiter
+}
+
+func newBackgroundBudget(cfg config.BackgroundFetchConfig) *backgroundBudget {
+	b := &backgroundBudget{}
+	if cfg.MaxConcurrentLayers > 0 {
+		b.sem = semaphore.NewWeighted(cfg.MaxConcurrentLayers)
+	}
+	if cfg.BytesPerSec > 0 {
+		burst := cfg.BytesPerSec
+		if burst < minBackgroundBurstBytes {
+			burst = minBackgroundBurstBytes
+		}
+		b.lim = rate.NewLimiter(rate.Limit(cfg.BytesPerSec), int(burst))
+	}
+	return b
+}
+
+// acquire waits until the layer can be fetched in background.
+func (b *backgroundBudget) acquire(ctx context.Context) (release func(), _ error) {
+	if b.sem == nil {
+		return func() {}, nil
+	}
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { b.sem.Release(1) }, nil
+}
+
+// wait waits until n bytes read from a blob can be processed.
+func (b *backgroundBudget) wait(ctx context.Context, n int) error {
+	if b.lim == nil {
+		return nil
+	}
+	for n > 0 {
+		c := n
+		if burst := b.lim.Burst(); c > burst {
+			c = burst
+		}
+		if err := b.lim.WaitN(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// backgroundPause pauses background fetches of all layers of a resolver or of the
+// layers of specific images. Background fetches already running stop before reading
+// the next chunk from the blob.
+type backgroundPause struct {
+	all     bool
+	images  map[string]struct{}
+	resumed chan struct{} // closed when any pause is lifted
+	mu      sync.Mutex
+}
+
+func newBackgroundPause() *backgroundPause {
+	return &backgroundPause{
+		images:  make(map[string]struct{}),
+		resumed: make(chan struct{}),
+	}
+}
+
+// pause pauses background fetches of the image or of all images if it's empty.
+func (p *backgroundPause) pause(image string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if image == "" {
+		p.all = true
+		return
+	}
+	p.images[image] = struct{}{}
+}
+
+// resume resumes background fetches of the image. If image is empty, all pauses
+// including ones of specific images are lifted.
+func (p *backgroundPause) resume(image string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if image == "" {
+		p.all = false
+		p.images = make(map[string]struct{})
+	} else {
+		delete(p.images, image)
+	}
+	close(p.resumed)
+	p.resumed = make(chan struct{})
+}
+
+// paused returns whether background fetches of the image are paused and the channel
+// closed when any pause is lifted.
+func (p *backgroundPause) paused(image string) (bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.images[image]
+	return p.all || ok, p.resumed
+}
+
+// wait waits until background fetches of the image aren't paused. An error is
+// returned if done is closed or ctx is done while waiting.
+func (p *backgroundPause) wait(ctx context.Context, image string, done <-chan struct{}) error {
+	for {
+		paused, resumed := p.paused(image)
+		if !paused {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-done:
+			return context.Canceled
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *backgroundPause) status() BackgroundFetchStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := BackgroundFetchStatus{Paused: p.all}
+	for i := range p.images {
+		st.PausedImages = append(st.PausedImages, i)
+	}
+	sort.Strings(st.PausedImages)
+	return st
+}
+
+// BackgroundFetchStatus is the status of the pause of background fetches.
+type BackgroundFetchStatus struct {
+	// Paused is true if background fetches of all layers are paused.
+	Paused bool `json:"paused"`
+
+	// PausedImages are the references of the images whose background fetches are
+	// paused.
+	PausedImages []string `json:"pausedImages,omitempty"`
+}
+
+// PauseBackgroundFetch pauses background fetches of the layers of the image or of
+// all layers if image is empty. Fetches for reading files aren't affected.
+func (r *Resolver) PauseBackgroundFetch(image string) {
+	r.backgroundPause.pause(image)
+}
+
+// ResumeBackgroundFetch resumes background fetches of the layers of the image. If
+// image is empty, all pauses including ones of specific images are lifted.
+func (r *Resolver) ResumeBackgroundFetch(image string) {
+	r.backgroundPause.resume(image)
+}
+
+// BackgroundFetchStatus returns the status of the pause of background fetches.
+func (r *Resolver) BackgroundFetchStatus() BackgroundFetchStatus {
+	return r.backgroundPause.status()
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestBackgroundBudget(t *testing.T) {
+	ctx := context.Background()
+
+	// No limit
+	b := newBackgroundBudget(config.BackgroundFetchConfig{})
+	release, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := b.wait(ctx, 100*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrency limit
+	b = newBackgroundBudget(config.BackgroundFetchConfig{MaxConcurrentLayers: 1})
+	release, err = b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquire(tctx); err == nil {
+		t.Fatalf("second layer must wait for the first one")
+	}
+	release()
+	release, err = b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// Rate limit; reads larger than the burst are allowed but take time
+	b = newBackgroundBudget(config.BackgroundFetchConfig{BytesPerSec: 1024})
+	if burst := b.lim.Burst(); burst != minBackgroundBurstBytes {
+		t.Fatalf("burst = %d; want %d", burst, minBackgroundBurstBytes)
+	}
+	if err := b.wait(ctx, minBackgroundBurstBytes); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := b.wait(tctx, 2*minBackgroundBurstBytes); err == nil {
+		t.Fatalf("read exceeding the rate must wait")
+	}
+}
+
+func TestBackgroundPause(t *testing.T) {
+	ctx := context.Background()
+	p := newBackgroundPause()
+	done := make(chan struct{})
+	if err := p.wait(ctx, "a", done); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pause an image
+	p.pause("a")
+	if paused, _ := p.paused("a"); !paused {
+		t.Errorf("image a must be paused")
+	}
+	if paused, _ := p.paused("b"); paused {
+		t.Errorf("image b must not be paused")
+	}
+	waitErr := make(chan error)
+	go func() { waitErr <- p.wait(ctx, "a", done) }()
+	select {
+	case err := <-waitErr:
+		t.Fatalf("wait must block while paused: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.resume("a")
+	if err := <-waitErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// Pause all images; resuming an image doesn't lift it
+	p.pause("")
+	p.pause("b")
+	if st := p.status(); !st.Paused || len(st.PausedImages) != 1 || st.PausedImages[0] != "b" {
+		t.Errorf("unexpected status %+v", st)
+	}
+	p.resume("a")
+	if paused, _ := p.paused("a"); !paused {
+		t.Errorf("image a must be paused while all images are paused")
+	}
+	go func() { waitErr <- p.wait(ctx, "a", done) }()
+	close(done)
+	if err := <-waitErr; err == nil {
+		t.Errorf("wait must fail when done is closed")
+	}
+	p.resume("")
+	if st := p.status(); st.Paused || len(st.PausedImages) != 0 {
+		t.Errorf("all pauses must be lifted; %+v", st)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	continuityfs "github.com/containerd/continuity/fs"
+	"github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	fsCacheDirName   = "fscache"
+	httpCacheDirName = "httpcache"
+
+	// cacheOwnerFile is the file in each cache directory which records the layer
+	// that the directory caches.
+	cacheOwnerFile = "owner.json"
+)
+
+// CacheUsage is the disk usage of a cache directory.
+type CacheUsage struct {
+	// Directory is the path to the cache directory.
+	Directory string `json:"directory"`
+
+	// Type is the type of the cache ("fscache" or "httpcache").
+	Type string `json:"type"`
+
+	// Reference is the image reference of the cached layer. This can be empty if
+	// the directory was created by an older snapshotter.
+	Reference string `json:"reference,omitempty"`
+
+	// Digest is the digest of the cached layer.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Size is the size of the cached contents in bytes.
+	Size int64 `json:"size"`
+
+	// ModTime is the last time the cache contents were modified.
+	ModTime time.Time `json:"modTime"`
+
+	// InUse is true if the cache is used by a layer resolved by this process.
+	// Unused caches are leftovers (e.g. of a previous run) and can be safely removed.
+	InUse bool `json:"inUse"`
+}
+
+// liveCacheDirs are the cache directories currently used in this process and their
+// owners. This is shared among resolvers so that a resolver doesn't remove caches used by
+// another resolver on the same root directory (e.g. the one replaced by reloading
+// the configuration).
+var (
+	liveCacheDirs   = make(map[string]cacheOwner)
+	liveCacheDirsMu sync.Mutex
+)
+
+type cacheOwner struct {
+	Reference string        `json:"reference"`
+	Digest    digest.Digest `json:"digest"`
+}
+
+func writeCacheOwner(dir string, owner cacheOwner) error {
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, cacheOwnerFile), b, 0600)
+}
+
+// liveCache is a cache which marks its directory as unused when it's closed.
+type liveCache struct {
+	cache.BlobCache
+	onClose func()
+}
+
+func (c *liveCache) Close() error {
+	c.onClose()
+	return c.BlobCache.Close()
+}
+
+func (c *liveCache) OpenFile(key string) (*os.File, error) {
+	fc, ok := c.BlobCache.(cache.FileCache)
+	if !ok {
+		return nil, fmt.Errorf("cache doesn't support opening files")
+	}
+	return fc.OpenFile(key)
+}
+
+// cacheRoots returns the directories where the caches of this resolver are created.
+// These are the root directory and the paths of the cache tiers.
+func (r *Resolver) cacheRoots() []string {
+	roots := []string{r.rootDir}
+	for _, t := range r.config.DirectoryCacheConfig.Tiers {
+		roots = append(roots, t.Path)
+	}
+	return roots
+}
+
+// CacheUsage returns the disk usage of all cache directories managed by this resolver
+// including ones that aren't used anymore.
+func (r *Resolver) CacheUsage() ([]CacheUsage, error) {
+	var usage []CacheUsage
+	for _, cacheRoot := range r.cacheRoots() {
+		for _, typ := range []string{fsCacheDirName, httpCacheDirName} {
+			root := filepath.Join(cacheRoot, typ)
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, e := range entries {
+				if !e.IsDir() {
+					continue
+				}
+				u, err := r.cacheUsage(filepath.Join(root, e.Name()), typ)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue // removed in the meantime
+					}
+					return nil, err
+				}
+				usage = append(usage, u)
+			}
+		}
+	}
+	return usage, nil
+}
+
+func (r *Resolver) cacheUsage(dir, typ string) (CacheUsage, error) {
+	u := CacheUsage{Directory: dir, Type: typ}
+	liveCacheDirsMu.Lock()
+	_, u.InUse = liveCacheDirs[dir]
+	liveCacheDirsMu.Unlock()
+	if b, err := os.ReadFile(filepath.Join(dir, cacheOwnerFile)); err == nil {
+		var owner cacheOwner
+		if err := json.Unmarshal(b, &owner); err == nil {
+			u.Reference, u.Digest = owner.Reference, owner.Digest
+		}
+	}
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil // can be removed by the cache in the meantime
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(u.ModTime) {
+			u.ModTime = info.ModTime()
+		}
+		if info.Mode().IsRegular() && d.Name() != cacheOwnerFile {
+			u.Size += info.Size()
+		}
+		return nil
+	})
+	return u, err
+}
+
+// LayerCacheUsage returns the total disk usage of the cache directories of the layer
+// which are used in this process.
+func (r *Resolver) LayerCacheUsage(ctx context.Context, dgst digest.Digest) (continuityfs.Usage, error) {
+	roots := make(map[string]struct{})
+	for _, root := range r.cacheRoots() {
+		roots[filepath.Clean(root)] = struct{}{}
+	}
+	var dirs []string
+	liveCacheDirsMu.Lock()
+	for dir, owner := range liveCacheDirs {
+		if _, ok := roots[filepath.Dir(filepath.Dir(dir))]; ok && owner.Digest == dgst {
+			dirs = append(dirs, dir)
+		}
+	}
+	liveCacheDirsMu.Unlock()
+	var usage continuityfs.Usage
+	for _, dir := range dirs {
+		du, err := continuityfs.DiskUsage(ctx, dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // released in the meantime
+			}
+			return continuityfs.Usage{}, err
+		}
+		usage.Inodes += du.Inodes
+		usage.Size += du.Size
+	}
+	return usage, nil
+}
+
+// PruneCache removes cache directories which aren't used by this process and
+// match the filter. Removed caches are returned. If filter is nil, all unused
+// caches are removed.
+func (r *Resolver) PruneCache(filter func(CacheUsage) bool) ([]CacheUsage, error) {
+	usage, err := r.CacheUsage()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []CacheUsage
+	for _, u := range usage {
+		if u.InUse || (filter != nil && !filter(u)) {
+			continue
+		}
+		liveCacheDirsMu.Lock()
+		_, inUse := liveCacheDirs[u.Directory] // can be reused in the meantime
+		if !inUse {
+			err = os.RemoveAll(u.Directory)
+		}
+		liveCacheDirsMu.Unlock()
+		if inUse {
+			continue
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to remove cache %q: %w", u.Directory, err)
+		}
+		pruned = append(pruned, u)
+	}
+	return pruned, nil
+}
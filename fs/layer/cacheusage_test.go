@@ -0,0 +1,207 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestCacheUsageAndPrune(t *testing.T) {
+	root := t.TempDir()
+	r, err := NewResolver(root, nil, config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{SyncAdd: true}}, nil, nil, OverlayOpaqueAll)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	dgstA, dgstB := digest.FromString("a"), digest.FromString("b")
+	live, err := r.newCache(filepath.Join(root, fsCacheDirName), "", cacheOwner{"example.com/a:latest", dgstA})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer live.Close()
+	stale, err := r.newCache(filepath.Join(root, httpCacheDirName), "", cacheOwner{"example.com/b:latest", dgstB})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	// Emulate a cache left by a previous run.
+	stale.(*liveCache).onClose()
+	addData(t, live.(*liveCache), dgstA.Encoded(), "aaaa")
+	addData(t, stale.(*liveCache), dgstB.Encoded(), "bbbbbbbb")
+
+	usage, err := r.CacheUsage()
+	if err != nil {
+		t.Fatalf("failed to get cache usage: %v", err)
+	}
+	if len(usage) != 2 {
+		t.Fatalf("unexpected number of caches %d; want 2", len(usage))
+	}
+	for _, u := range usage {
+		switch u.Digest {
+		case dgstA:
+			if !u.InUse || u.Reference != "example.com/a:latest" || u.Size != 4 || u.Type != fsCacheDirName {
+				t.Errorf("unexpected usage of live cache: %+v", u)
+			}
+		case dgstB:
+			if u.InUse || u.Reference != "example.com/b:latest" || u.Size != 8 || u.Type != httpCacheDirName {
+				t.Errorf("unexpected usage of stale cache: %+v", u)
+			}
+		default:
+			t.Errorf("unexpected cache: %+v", u)
+		}
+	}
+
+	pruned, err := r.PruneCache(func(u CacheUsage) bool { return u.Reference == "example.com/a:latest" })
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if len(pruned) != 0 {
+		t.Fatalf("live cache or unmatched cache must not be pruned: %+v", pruned)
+	}
+	pruned, err = r.PruneCache(nil)
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].Digest != dgstB {
+		t.Fatalf("unexpected pruned caches: %+v", pruned)
+	}
+	if _, err := os.Stat(pruned[0].Directory); !os.IsNotExist(err) {
+		t.Errorf("pruned cache still exists: %v", err)
+	}
+}
+
+func TestLayerCacheUsage(t *testing.T) {
+	root := t.TempDir()
+	r, err := NewResolver(root, nil, config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{SyncAdd: true}}, nil, nil, OverlayOpaqueAll)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	dgstA, dgstB := digest.FromString("a"), digest.FromString("b")
+	var caches []*liveCache
+	for _, c := range []struct {
+		typ   string
+		owner cacheOwner
+		data  string
+	}{
+		{fsCacheDirName, cacheOwner{"example.com/a:latest", dgstA}, "aaaa"},
+		{httpCacheDirName, cacheOwner{"example.com/a:latest", dgstA}, "aaaaaaaa"},
+		{httpCacheDirName, cacheOwner{"example.com/b:latest", dgstB}, "bbbb"},
+	} {
+		lc, err := r.newCache(filepath.Join(root, c.typ), "", c.owner)
+		if err != nil {
+			t.Fatalf("failed to create cache: %v", err)
+		}
+		defer lc.Close()
+		addData(t, lc.(*liveCache), c.owner.Digest.Encoded(), c.data)
+		caches = append(caches, lc.(*liveCache))
+	}
+
+	usageA, err := r.LayerCacheUsage(context.TODO(), dgstA)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	usageB, err := r.LayerCacheUsage(context.TODO(), dgstB)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usageA.Size <= usageB.Size || usageB.Size <= 0 {
+		t.Errorf("unexpected usage %+v of %v (usage of %v: %+v)", usageA, dgstA, dgstB, usageB)
+	}
+	if usageA.Inodes <= usageB.Inodes {
+		t.Errorf("caches of %v must have more inodes (%d) than %v (%d)", dgstA, usageA.Inodes, dgstB, usageB.Inodes)
+	}
+
+	// Released caches aren't counted.
+	caches[2].onClose()
+	if u, err := r.LayerCacheUsage(context.TODO(), dgstB); err != nil || u.Size != 0 || u.Inodes != 0 {
+		t.Errorf("released cache must not be counted; got %+v: %v", u, err)
+	}
+}
+
+func addData(t *testing.T, c *liveCache, key, data string) {
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %q: %v", key, err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to write %q: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %q: %v", key, err)
+	}
+}
+
+func TestTieredCacheUsage(t *testing.T) {
+	root, nvme, shared := t.TempDir(), t.TempDir(), t.TempDir()
+	r, err := NewResolver(root, nil, config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{
+		SyncAdd: true,
+		Tiers: []config.CacheTierConfig{
+			{Name: "nvme", Path: nvme, MaxSizeBytes: 4},
+			{Name: "shared", Path: shared},
+		},
+	}}, nil, nil, OverlayOpaqueAll)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	dgst := digest.FromString("a")
+	lc, err := r.newCache(filepath.Join(root, fsCacheDirName), "", cacheOwner{"example.com/a:latest", dgst})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer lc.Close()
+	addData(t, lc.(*liveCache), digest.FromString("1").Encoded(), "aaaa")
+	addData(t, lc.(*liveCache), digest.FromString("2").Encoded(), "aaaa") // demotes the first one
+
+	var usage []CacheUsage
+	sizes := make(map[string]int64)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) { // demoted in background
+		usage, err = r.CacheUsage()
+		if err != nil {
+			t.Fatalf("failed to get cache usage: %v", err)
+		}
+		sizes = make(map[string]int64)
+		for _, u := range usage {
+			sizes[filepath.Dir(filepath.Dir(u.Directory))] += u.Size
+		}
+		if sizes[shared] > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, u := range usage {
+		if !u.InUse || u.Digest != dgst || u.Type != fsCacheDirName {
+			t.Errorf("unexpected usage: %+v", u)
+		}
+	}
+	if len(usage) != 2 || sizes[nvme] != 4 || sizes[shared] != 4 {
+		t.Errorf("each tier must have a cache of 4 bytes; got %+v", usage)
+	}
+	if u, err := r.LayerCacheUsage(context.TODO(), dgst); err != nil || u.Size <= 0 {
+		t.Errorf("caches in tiers must be counted; got %+v: %v", u, err)
+	}
+
+	if _, err := NewResolver(root, nil, config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{
+		Tiers: []config.CacheTierConfig{{Name: "relative", Path: "cache"}},
+	}}, nil, nil, OverlayOpaqueAll); err == nil {
+		t.Errorf("relative path of a tier must be rejected")
+	}
+}
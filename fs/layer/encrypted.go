@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers"
+	"github.com/hashicorp/go-multierror"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// encAnnotationPrefix is the prefix of annotations of encrypted layers defined by ocicrypt.
+const encAnnotationPrefix = "org.opencontainers.image.enc."
+
+// newDecryptConfig returns the config to decrypt layers with the keys. keys are in
+// the same format as the --key option of ctr (e.g. "<path to the private key>[:<password>]"
+// or "provider:<key provider name>"). nil is returned if no key is specified.
+func newDecryptConfig(keys []string) (*encconfig.DecryptConfig, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	cc, err := helpers.CreateDecryptCryptoConfig(keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	return cc.DecryptConfig, nil
+}
+
+// encryptedLayer returns the annotations of the encrypted layer passed through
+// labels prefixed by config.TargetEncryptionLabelPrefix. false is returned if the
+// layer isn't encrypted.
+func encryptedLayer(desc ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	var (
+		enc       = ocispec.Descriptor{Digest: desc.Digest, Annotations: make(map[string]string)}
+		encrypted bool
+	)
+	for k, v := range desc.Annotations {
+		if strings.HasPrefix(k, config.TargetEncryptionLabelPrefix) {
+			enc.Annotations[encAnnotationPrefix+strings.TrimPrefix(k, config.TargetEncryptionLabelPrefix)] = v
+			encrypted = true
+		}
+	}
+	return enc, encrypted
+}
+
+// layerDecrypter decrypts arbitrary ranges of a layer encrypted by ocicrypt. The
+// layer is encrypted with AES-CTR so offsets in the encrypted layer equal ones in
+// the plain layer.
+//
+// The HMAC of the layer can't be checked without reading the entire layer so the
+// contents must be verified by the TOC digest.
+type layerDecrypter struct {
+	block cipher.Block
+	nonce []byte
+}
+
+func newLayerDecrypter(dc *encconfig.DecryptConfig, desc ocispec.Descriptor) (*layerDecrypter, error) {
+	if dc == nil {
+		return nil, fmt.Errorf("no key to decrypt the layer is configured")
+	}
+	privOpts, err := unwrapLayerKey(dc, desc)
+	if err != nil {
+		return nil, err
+	}
+	var pubOpts blockcipher.PublicLayerBlockCipherOptions
+	if s, ok := desc.Annotations[encAnnotationPrefix+"pubopts"]; ok {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pubopts: %w", err)
+		}
+		if err := json.Unmarshal(data, &pubOpts); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pubopts: %w", err)
+		}
+	}
+	if pubOpts.CipherType != "" && pubOpts.CipherType != blockcipher.AES256CTR {
+		return nil, fmt.Errorf("unsupported cipher %q", pubOpts.CipherType)
+	}
+	opts := blockcipher.LayerBlockCipherOptions{Public: pubOpts, Private: privOpts}
+	nonce, ok := opts.GetOpt("nonce")
+	if !ok || len(nonce) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	block, err := aes.NewCipher(privOpts.SymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	return &layerDecrypter{block: block, nonce: nonce}, nil
+}
+
+// unwrapLayerKey returns the key of the layer unwrapped with one of the configured keys.
+func unwrapLayerKey(dc *encconfig.DecryptConfig, desc ocispec.Descriptor) (opts blockcipher.PrivateLayerBlockCipherOptions, err error) {
+	var rErr error
+	for scheme, b64Keys := range ocicrypt.GetWrappedKeysMap(desc) {
+		kw := ocicrypt.GetKeyWrapper(scheme)
+		if kw == nil || kw.NoPossibleKeys(dc.Parameters) {
+			continue
+		}
+		for _, b64Key := range strings.Split(b64Keys, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64Key)
+			if err != nil {
+				return opts, fmt.Errorf("failed to decode wrapped key of %q: %w", scheme, err)
+			}
+			data, err := kw.UnwrapKey(dc, wrapped)
+			if err != nil {
+				rErr = multierror.Append(rErr, fmt.Errorf("%s: %w", scheme, err))
+				continue
+			}
+			if err := json.Unmarshal(data, &opts); err != nil {
+				return opts, fmt.Errorf("failed to unmarshal layer key: %w", err)
+			}
+			return opts, nil
+		}
+	}
+	if rErr == nil {
+		rErr = errors.New("no wrapped key can be unwrapped by the configured keys")
+	}
+	return opts, fmt.Errorf("failed to unwrap layer key: %w", rErr)
+}
+
+// decryptAt decrypts p which is read from the offset of the encrypted layer.
+func (d *layerDecrypter) decryptAt(p []byte, offset int64) {
+	// Advance the counter to the block containing the offset.
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, d.nonce)
+	carry := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(iv[i]) + carry&0xff
+		iv[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(d.block, iv)
+	if skip := int(offset % aes.BlockSize); skip > 0 {
+		var buf [aes.BlockSize]byte
+		stream.XORKeyStream(buf[:skip], buf[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// decryptedBlob is a blob of an encrypted layer which returns decrypted contents.
+// Contents cached in the blob remain encrypted.
+type decryptedBlob struct {
+	remote.Blob
+	d *layerDecrypter
+}
+
+func (b *decryptedBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	n, err := b.Blob.ReadAt(p, offset, opts...)
+	b.d.decryptAt(p[:n], offset)
+	return n, err
+}
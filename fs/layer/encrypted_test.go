@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLayerDecrypter(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := make([]byte, 10000)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := encconfig.EncryptWithJwe([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, fin, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(plain), ocispec.Descriptor{Digest: digest.FromBytes(plain)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := fin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Annotations are passed as labels.
+	labels := make(map[string]string)
+	for k, v := range annotations {
+		labels[config.TargetEncryptionLabelPrefix+strings.TrimPrefix(k, encAnnotationPrefix)] = v
+	}
+	desc, ok := encryptedLayer(ocispec.Descriptor{Annotations: labels})
+	if !ok {
+		t.Fatalf("layer must be encrypted")
+	}
+	if _, err := newLayerDecrypter(nil, desc); err == nil {
+		t.Fatalf("decryption must fail without keys")
+	}
+	dc, err := newDecryptConfig([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newLayerDecrypter(dc, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reg := range []struct{ off, size int64 }{{0, 10000}, {0, 1}, {15, 2}, {16, 16}, {4097, 3000}, {9999, 1}} {
+		p := append([]byte{}, encrypted[reg.off:reg.off+reg.size]...)
+		d.decryptAt(p, reg.off)
+		if !bytes.Equal(p, plain[reg.off:reg.off+reg.size]) {
+			t.Errorf("invalid contents at offset %d (size %d)", reg.off, reg.size)
+		}
+	}
+}
+
+func TestLayerDecrypterCounterCarry(t *testing.T) {
+	key := make([]byte, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	nonce[0] = 0
+	plain := make([]byte, 1000)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCTR(block, nonce).XORKeyStream(encrypted, plain)
+	d := &layerDecrypter{block: block, nonce: nonce}
+	for _, off := range []int64{0, 16, 17, 500} {
+		p := append([]byte{}, encrypted[off:]...)
+		d.decryptAt(p, off)
+		if !bytes.Equal(p, plain[off:]) {
+			t.Errorf("invalid contents at offset %d", off)
+		}
+	}
+}
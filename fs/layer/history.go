@@ -0,0 +1,211 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	historyDirName         = "accesshistory"
+	historyFileVersion     = 1
+	defaultMaxHistoryFiles = 10000
+
+	// historyFlushDelay is the delay to write the history after a file is read
+	// so that files read in a burst (e.g. during a container startup) are
+	// written at once.
+	historyFlushDelay = time.Minute
+)
+
+// accessHistory stores files read from layers in the past. Files are recorded by
+// their offsets in the layer blob, which don't change among metadata stores and
+// among nodes, so the history is independent of the prioritized files of the layer.
+type accessHistory struct {
+	dir      string
+	maxFiles int
+}
+
+// historyFile is the on-disk format of the history of a layer.
+type historyFile struct {
+	Version int `json:"version"`
+
+	// Offsets are offsets of files read from the layer. Newer entries come last.
+	Offsets []int64 `json:"offsets"`
+}
+
+func newAccessHistory(root string, maxFiles int) (*accessHistory, error) {
+	dir := filepath.Join(root, historyDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxHistoryFiles
+	}
+	return &accessHistory{dir: dir, maxFiles: maxFiles}, nil
+}
+
+func (h *accessHistory) path(dgst digest.Digest) string {
+	return filepath.Join(h.dir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// load returns the offsets of files read from the layer in the past.
+func (h *accessHistory) load(dgst digest.Digest) ([]int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(h.path(dgst))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f historyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid access history of %v: %w", dgst, err)
+	}
+	if f.Version != historyFileVersion {
+		return nil, fmt.Errorf("unknown version %d of access history of %v", f.Version, dgst)
+	}
+	return f.Offsets, nil
+}
+
+func (h *accessHistory) store(dgst digest.Digest, offsets []int64) error {
+	p := h.path(dgst)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(historyFile{Version: historyFileVersion, Offsets: offsets})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// accessRecorder records files read from a layer and writes them to the history.
+type accessRecorder struct {
+	h    *accessHistory
+	dgst digest.Digest
+	m    metadata.Reader
+
+	past      []int64             // offsets in the history
+	read      map[uint32]struct{} // IDs of files read since the layer was resolved
+	readOrder []uint32            // IDs of files read but not written to the history yet
+	dirty     bool
+	mu        sync.Mutex
+}
+
+func (h *accessHistory) newRecorder(dgst digest.Digest, m metadata.Reader, past []int64) *accessRecorder {
+	return &accessRecorder{
+		h:    h,
+		dgst: dgst,
+		m:    m,
+		past: past,
+		read: make(map[uint32]struct{}),
+	}
+}
+
+// record records that the file is read. The history is written after
+// historyFlushDelay or when the layer is closed.
+func (r *accessRecorder) record(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.read[id]; ok {
+		return
+	}
+	r.read[id] = struct{}{}
+	r.readOrder = append(r.readOrder, id)
+	if !r.dirty {
+		r.dirty = true
+		time.AfterFunc(historyFlushDelay, func() {
+			if err := r.flush(); err != nil {
+				log.L.WithError(err).Warnf("failed to write access history of %v", r.dgst)
+			}
+		})
+	}
+}
+
+// offsets returns offsets of files in the history.
+func (r *accessRecorder) offsets() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.past
+}
+
+// flush writes files read so far to the history. Entries of the past history are
+// kept unless the history exceeds the max number of files.
+func (r *accessRecorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	var (
+		recent   []int64
+		recorded = make(map[int64]struct{})
+	)
+	for _, id := range r.readOrder {
+		off, err := r.m.GetOffset(id)
+		if err != nil {
+			continue
+		}
+		if _, ok := recorded[off]; !ok {
+			recorded[off] = struct{}{}
+			recent = append(recent, off)
+		}
+	}
+	var offsets []int64
+	for _, off := range r.past {
+		if _, ok := recorded[off]; !ok {
+			offsets = append(offsets, off)
+		}
+	}
+	offsets = append(offsets, recent...)
+	if len(offsets) > r.h.maxFiles {
+		offsets = offsets[len(offsets)-r.h.maxFiles:]
+	}
+	if err := r.h.store(r.dgst, offsets); err != nil {
+		return err
+	}
+	r.past, r.readOrder = offsets, nil
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type offsetReader struct {
+	metadata.Reader
+	offsets map[uint32]int64
+}
+
+func (r *offsetReader) GetOffset(id uint32) (int64, error) {
+	off, ok := r.offsets[id]
+	if !ok {
+		return 0, fmt.Errorf("file %d not found", id)
+	}
+	return off, nil
+}
+
+func TestAccessHistory(t *testing.T) {
+	h, err := newAccessHistory(t.TempDir(), 3)
+	if err != nil {
+		t.Fatalf("failed to create access history: %v", err)
+	}
+	dgst := digest.FromString("layer")
+	m := &offsetReader{offsets: map[uint32]int64{1: 100, 2: 200, 3: 300, 4: 400}}
+
+	past, err := h.load(dgst)
+	if err != nil || len(past) != 0 {
+		t.Fatalf("history must be empty at first; got %v (%v)", past, err)
+	}
+
+	r := h.newRecorder(dgst, m, past)
+	r.record(1)
+	r.record(2)
+	r.record(1)
+	r.record(5) // unknown files are ignored
+	if err := r.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if past, err = h.load(dgst); err != nil || !reflect.DeepEqual(past, []int64{100, 200}) {
+		t.Fatalf("unexpected history %v (%v); want [100 200]", past, err)
+	}
+
+	// New entries come last and older entries are dropped when exceeding the max.
+	r = h.newRecorder(dgst, m, past)
+	r.record(3)
+	r.record(4)
+	r.record(1)
+	if err := r.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	want := []int64{300, 400, 100}
+	if past, err = h.load(dgst); err != nil || !reflect.DeepEqual(past, want) {
+		t.Fatalf("unexpected history %v (%v); want %v", past, err, want)
+	}
+	if got := r.offsets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected offsets %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// overflowID is the ID shown for IDs that aren't mapped (same as the kernel's
+// default overflowuid and overflowgid).
+const overflowID = 65534
+
+// IDMapping maps a range of IDs in the layer (i.e. in the container) to the host.
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// IDMap is a set of UID and GID mappings applied to the owners of files in the
+// layer. The zero value doesn't shift IDs.
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// ParseIDMap parses UID and GID mappings formatted as
+// "<container ID>:<host ID>:<size>[,<container ID>:<host ID>:<size>...]".
+// Empty strings mean no mapping.
+func ParseIDMap(uidmap, gidmap string) (m IDMap, err error) {
+	if m.UIDs, err = parseIDMappings(uidmap); err != nil {
+		return IDMap{}, fmt.Errorf("invalid uid mapping %q: %w", uidmap, err)
+	}
+	if m.GIDs, err = parseIDMappings(gidmap); err != nil {
+		return IDMap{}, fmt.Errorf("invalid gid mapping %q: %w", gidmap, err)
+	}
+	return m, nil
+}
+
+func parseIDMappings(s string) (mappings []IDMapping, _ error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		f := strings.Split(e, ":")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("mapping must be <container ID>:<host ID>:<size>")
+		}
+		var v [3]uint32
+		for i := range f {
+			n, err := strconv.ParseUint(f[i], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = uint32(n)
+		}
+		if v[2] == 0 || uint64(v[0])+uint64(v[2]) > 1<<32 || uint64(v[1])+uint64(v[2]) > 1<<32 {
+			return nil, fmt.Errorf("invalid range %q", e)
+		}
+		mappings = append(mappings, IDMapping{ContainerID: v[0], HostID: v[1], Size: v[2]})
+	}
+	return mappings, nil
+}
+
+func (m IDMap) owner(uid, gid int) fuse.Owner {
+	return fuse.Owner{Uid: mapID(m.UIDs, uid), Gid: mapID(m.GIDs, gid)}
+}
+
+func mapID(mappings []IDMapping, id int) uint32 {
+	if len(mappings) == 0 {
+		return uint32(id)
+	}
+	for _, m := range mappings {
+		if id >= int(m.ContainerID) && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return m.HostID + uint32(id-int(m.ContainerID))
+		}
+	}
+	return overflowID
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestIDMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		uidmap  string
+		gidmap  string
+		uid     int
+		gid     int
+		want    fuse.Owner
+		wantErr bool
+	}{
+		{name: "empty", uid: 10, gid: 20, want: fuse.Owner{Uid: 10, Gid: 20}},
+		{name: "root", uidmap: "0:1000:65536", gidmap: "0:2000:65536", want: fuse.Owner{Uid: 1000, Gid: 2000}},
+		{name: "shifted", uidmap: "0:1000:65536", gidmap: "0:2000:65536", uid: 10, gid: 20, want: fuse.Owner{Uid: 1010, Gid: 2020}},
+		{name: "uid_only", uidmap: "0:1000:65536", uid: 10, gid: 20, want: fuse.Owner{Uid: 1010, Gid: 20}},
+		{name: "multiple", uidmap: "0:1000:1,1:5000:100", gidmap: "0:2000:1,1:6000:100", uid: 10, gid: 20, want: fuse.Owner{Uid: 5009, Gid: 6019}},
+		{name: "unmapped", uidmap: "0:1000:10", gidmap: "0:2000:10", uid: 10, gid: 20, want: fuse.Owner{Uid: overflowID, Gid: overflowID}},
+		{name: "invalid_format", uidmap: "0:1000", wantErr: true},
+		{name: "invalid_number", gidmap: "0:a:1", wantErr: true},
+		{name: "zero_size", uidmap: "0:1000:0", wantErr: true},
+		{name: "overflow", uidmap: "0:4294967295:2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseIDMap(tt.uidmap, tt.gidmap)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.owner(tt.uid, tt.gid); got != tt.want {
+				t.Errorf("owner = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
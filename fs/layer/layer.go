@@ -27,8 +27,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -43,9 +46,12 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/nydus"
 	"github.com/containerd/stargz-snapshotter/task"
 	"github.com/containerd/stargz-snapshotter/util/cacheutil"
 	"github.com/containerd/stargz-snapshotter/util/namedmutex"
+	"github.com/containerd/stargz-snapshotter/ztoc"
+	encconfig "github.com/containers/ocicrypt/config"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -65,8 +71,9 @@ type Layer interface {
 	// Info returns the information of this layer.
 	Info() Info
 
-	// RootNode returns the root node of this layer.
-	RootNode(baseInode uint32) (fusefs.InodeEmbedder, error)
+	// RootNode returns the root node of this layer. Owners of files are shifted
+	// by idMap.
+	RootNode(baseInode uint32, idMap IDMap, opts ...NodeOption) (fusefs.InodeEmbedder, error)
 
 	// Check checks if the layer is still connectable.
 	Check() error
@@ -96,6 +103,16 @@ type Layer interface {
 	// Fetching contents is done as a background task.
 	BackgroundFetch() error
 
+	// WatchMisses makes the layer fetch the entire contents to the cache with the
+	// priority over background tasks once on-demand fetches exceed the threshold.
+	// Nop if the threshold is disabled or the layer is already watched.
+	WatchMisses(t MissThreshold)
+
+	// MakeResident fetches, verifies and caches all contents of the layer which
+	// aren't cached yet with the priority over background tasks so that the layer
+	// can be read without the registry. This blocks until the layer is cached.
+	MakeResident() error
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -103,11 +120,12 @@ type Layer interface {
 
 // Info is the current status of a layer.
 type Info struct {
-	Digest       digest.Digest
-	Size         int64     // layer size in bytes
-	FetchedSize  int64     // layer fetched size in bytes
-	PrefetchSize int64     // layer prefetch size in bytes
-	ReadTime     time.Time // last time the layer was read
+	Digest                digest.Digest
+	Size                  int64     // layer size in bytes
+	FetchedSize           int64     // layer fetched size in bytes
+	PrefetchSize          int64     // layer prefetch size in bytes
+	BackgroundFetchedSize int64     // layer size fetched in background in bytes
+	ReadTime              time.Time // last time the layer was read
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -123,7 +141,13 @@ type Resolver struct {
 	resolveLock           *namedmutex.NamedMutex
 	config                config.Config
 	metadataStore         metadata.Store
+	history               *accessHistory // nil if the access history is disabled
 	overlayOpaqueType     OverlayOpaqueType
+	decryptConfig         *encconfig.DecryptConfig // nil if no decryption key is configured
+	backgroundBudget      *backgroundBudget
+	tierUsage             []*cache.TierUsage  // usage of each cache tier shared among layers
+	reflinkIndex          *cache.ReflinkIndex // nil if reflink is disabled
+	backgroundPause       *backgroundPause
 }
 
 // NewResolver returns a new layer resolver.
@@ -160,13 +184,56 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		logrus.WithField("key", key).Debugf("cleaned up blob")
 	}
 
+	var tierUsage []*cache.TierUsage
+	for _, t := range cfg.DirectoryCacheConfig.Tiers {
+		if !filepath.IsAbs(t.Path) {
+			return nil, fmt.Errorf("path of cache tier %q must be an absolute path; got %q", t.Name, t.Path)
+		}
+		limit := t.MaxSizeBytes
+		if limit == 0 {
+			limit = math.MaxInt64
+		}
+		tierUsage = append(tierUsage, cache.NewTierUsage(limit))
+	}
+
+	// Caches of all layers share the index so that identical contents among layers
+	// share extents.
+	var reflinkIndex *cache.ReflinkIndex
+	if cfg.DirectoryCacheConfig.Reflink {
+		reflinkIndex = cache.NewReflinkIndex()
+	}
+
+	switch cfg.ReadDeadlinePolicy {
+	case "", ReadDeadlinePolicyEIO, ReadDeadlinePolicyMirror:
+	default:
+		return nil, fmt.Errorf("unknown read deadline policy %q", cfg.ReadDeadlinePolicy)
+	}
+
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
 
+	blobResolver, err := remote.NewResolver(cfg.BlobConfig, resolveHandlers)
+	if err != nil {
+		return nil, err
+	}
+
+	var history *accessHistory
+	if cfg.AccessHistoryConfig.Enable {
+		history, err = newAccessHistory(root, cfg.AccessHistoryConfig.MaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup access history: %w", err)
+		}
+	}
+
+	decryptConfig, err := newDecryptConfig(cfg.EncryptionConfig.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup decryption keys: %w", err)
+	}
+
 	return &Resolver{
 		rootDir:               root,
-		resolver:              remote.NewResolver(cfg.BlobConfig, resolveHandlers),
+		resolver:              blobResolver,
 		layerCache:            layerCache,
 		blobCache:             blobCache,
 		prefetchTimeout:       prefetchTimeout,
@@ -175,15 +242,125 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		resolveLock:           new(namedmutex.NamedMutex),
 		metadataStore:         metadataStore,
 		overlayOpaqueType:     overlayOpaqueType,
+		history:               history,
+		decryptConfig:         decryptConfig,
+		backgroundBudget:      newBackgroundBudget(cfg.BackgroundFetchConfig),
+		backgroundPause:       newBackgroundPause(),
+		tierUsage:             tierUsage,
+		reflinkIndex:          reflinkIndex,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
+// CachePolicy overrides the types of the caches ("memory" or "directory") of layers.
+// Empty fields follow the config of the resolver.
+type CachePolicy struct {
+	HTTPCacheType string
+	FSCacheType   string
+}
+
+type cachePolicyKey struct{}
+
+// WithCachePolicy returns a context which lets the resolver use the cache policy
+// for layers resolved with the context. Layers resolved with different policies
+// aren't shared.
+func WithCachePolicy(ctx context.Context, p CachePolicy) context.Context {
+	return context.WithValue(ctx, cachePolicyKey{}, p)
+}
+
+func cachePolicyOf(ctx context.Context) CachePolicy {
+	p, _ := ctx.Value(cachePolicyKey{}).(CachePolicy)
+	return p
+}
+
+type resolveScopeKey struct{}
+
+// WithResolveScope returns a context which lets the resolver share layers resolved
+// with the context only among the same scope. This is used when layers are resolved
+// with the registry hosts and credentials of the scope (e.g. a containerd namespace)
+// so that they aren't reused by other scopes which could be unauthorized to them.
+func WithResolveScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, resolveScopeKey{}, scope)
+}
+
+func resolveScopeOf(ctx context.Context) string {
+	s, _ := ctx.Value(resolveScopeKey{}).(string)
+	return s
+}
+
+// resolveKey returns the key of the layer (or the blob) in the resolver caches.
+func resolveKey(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) string {
+	name := refspec.String() + "/" + desc.Digest.String()
+	var params []string
+	if p := cachePolicyOf(ctx); p != (CachePolicy{}) {
+		params = append(params, fmt.Sprintf("http=%s&fs=%s", p.HTTPCacheType, p.FSCacheType))
+	}
+	if s := resolveScopeOf(ctx); s != "" {
+		params = append(params, "scope="+url.QueryEscape(s))
+	}
+	if len(params) > 0 {
+		name += "?" + strings.Join(params, "&")
+	}
+	return name
+}
+
+func (r *Resolver) newCache(root string, cacheType string, owner cacheOwner) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
 	}
 
-	dcc := cfg.DirectoryCacheConfig
+	dcc := r.config.DirectoryCacheConfig
+	if len(dcc.Tiers) == 0 {
+		c, release, err := r.newDirectoryCache(root, owner)
+		if err != nil {
+			return nil, err
+		}
+		return &liveCache{c, release}, nil
+	}
+
+	// The cache of each tier is created on the directory of the same type (fscache or
+	// httpcache) under the path of the tier.
+	typ := filepath.Base(root)
+	var (
+		tiers    []cache.Tier
+		releases []func()
+	)
+	release := func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	for i, t := range dcc.Tiers {
+		c, rel, err := r.newDirectoryCache(filepath.Join(t.Path, typ), owner)
+		if err != nil {
+			for _, t := range tiers {
+				t.Cache.Close()
+			}
+			release()
+			return nil, fmt.Errorf("failed to initialize cache tier %q: %w", t.Name, err)
+		}
+		tiers = append(tiers, cache.Tier{Name: t.Name, Cache: c, Usage: r.tierUsage[i]})
+		releases = append(releases, rel)
+	}
+	c, err := cache.NewTieredCache(tiers, cache.TieredCacheConfig{
+		PromoteOnHit: dcc.PromoteOnHit,
+		OnHit:        func(tier string) { commonmetrics.IncCacheTierLookupCount(typ, tier) },
+		OnMiss:       func() { commonmetrics.IncCacheTierLookupCount(typ, commonmetrics.CacheTierMiss) },
+	})
+	if err != nil {
+		for _, t := range tiers {
+			t.Cache.Close()
+		}
+		release()
+		return nil, err
+	}
+	return &liveCache{c, release}, nil
+}
+
+// newDirectoryCache creates a directory cache on an unique directory under root. The
+// returned function must be called when the cache is closed to mark the directory as
+// unused.
+func (r *Resolver) newDirectoryCache(root string, owner cacheOwner) (cache.BlobCache, func(), error) {
+	dcc := r.config.DirectoryCacheConfig
 	maxDataEntry := dcc.MaxLRUCacheEntry
 	if maxDataEntry == 0 {
 		maxDataEntry = defaultMaxLRUCacheEntry
@@ -208,27 +385,63 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	}
 	// create a cache on an unique directory
 	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	cachePath, err := os.MkdirTemp(root, "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
+		return nil, nil, fmt.Errorf("failed to initialize directory cache: %w", err)
 	}
-	return cache.NewDirectoryCache(
+	// Mark this directory as used as soon as possible so that it won't be pruned.
+	liveCacheDirsMu.Lock()
+	liveCacheDirs[cachePath] = owner
+	liveCacheDirsMu.Unlock()
+	release := func() {
+		liveCacheDirsMu.Lock()
+		delete(liveCacheDirs, cachePath)
+		liveCacheDirsMu.Unlock()
+	}
+	if err := writeCacheOwner(cachePath, owner); err != nil {
+		release()
+		os.RemoveAll(cachePath)
+		return nil, nil, fmt.Errorf("failed to record owner of directory cache: %w", err)
+	}
+	c, err := cache.NewDirectoryCache(
 		cachePath,
 		cache.DirectoryCacheConfig{
-			SyncAdd:   dcc.SyncAdd,
-			DataCache: dCache,
-			FdCache:   fCache,
-			BufPool:   bufPool,
-			Direct:    dcc.Direct,
+			SyncAdd:      dcc.SyncAdd,
+			DataCache:    dCache,
+			FdCache:      fCache,
+			BufPool:      bufPool,
+			Direct:       dcc.Direct,
+			FsVerity:     dcc.FsVerity,
+			ReflinkIndex: r.reflinkIndex,
 		},
 	)
+	if err != nil {
+		release()
+		os.RemoveAll(cachePath)
+		return nil, nil, err
+	}
+	return c, release, nil
+}
+
+// Close evicts all layers and blobs cached by the resolver. Each of them is closed
+// when it's no longer used (i.e. Done is called on all layers using it). The health
+// checks of registry hosts are stopped as well. The resolver must not be used after
+// Close.
+func (r *Resolver) Close() error {
+	r.layerCacheMu.Lock()
+	r.layerCache.RemoveAll()
+	r.layerCacheMu.Unlock()
+	r.blobCacheMu.Lock()
+	r.blobCache.RemoveAll()
+	r.blobCacheMu.Unlock()
+	return r.resolver.Close()
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, esgzOpts ...metadata.Option) (_ Layer, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name := resolveKey(ctx, refspec, desc)
 
 	// Wait if resolving this layer is already running. The result
 	// can hopefully get from the cache.
@@ -266,7 +479,22 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	fsCache, err := newCache(filepath.Join(r.rootDir, "fscache"), r.config.FSCacheType, r.config)
+	fsCacheType := r.config.FSCacheType
+	if t := cachePolicyOf(ctx).FSCacheType; t != "" {
+		fsCacheType = t
+	}
+	if enc, ok := encryptedLayer(desc); ok {
+		d, err := newLayerDecrypter(r.decryptConfig, enc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt layer: %w", err)
+		}
+		blobR = &blobRef{&decryptedBlob{blobR.Blob, d}, blobR.done}
+		if !r.config.EncryptionConfig.AllowPlaintextCache {
+			fsCacheType = memoryCacheType // don't write decrypted contents to the disk
+		}
+	}
+
+	fsCache, err := r.newCache(filepath.Join(r.rootDir, fsCacheDirName), fsCacheType, cacheOwner{refspec.String(), desc.Digest})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fs cache: %w", err)
 	}
@@ -297,8 +525,18 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 			commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.DeserializeTocJSON, desc.Digest, start)
 		},
 	}
-	meta, err := r.metadataStore(sr,
-		append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(new(zstdchunked.Decompressor)))...)
+	var meta metadata.Reader
+	if ztocDigest, ok := desc.Annotations[config.TargetZtocDigestLabel]; ok {
+		// This is an ordinary gzip layer indexed by a ztoc.
+		meta, err = r.resolveZtoc(ctx, hosts, refspec, desc, ztocDigest, sr)
+	} else if _, ok := desc.Annotations[nydus.LayerAnnotationNydusBootstrap]; ok {
+		meta, err = r.resolveNydusBootstrap(ctx, hosts, refspec, desc, sr)
+	} else if _, ok := desc.Annotations[nydus.LayerAnnotationNydusBlob]; ok {
+		meta, err = nydus.NewBlobLayerReader(sr)
+	} else {
+		meta, err = r.metadataStore(sr,
+			append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(new(zstdchunked.Decompressor)))...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -309,6 +547,15 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 
 	// Combine layer information together and cache it.
 	l := newLayer(r, desc, blobR, vr)
+	l.image = refspec.String()
+	vr.SetOnDemandFetchHook(l.onDemandFetched)
+	if r.history != nil {
+		past, err := r.history.load(desc.Digest)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to load access history; ignoring")
+		}
+		l.history = r.history.newRecorder(desc.Digest, vr.Metadata(), past)
+	}
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
 	r.layerCacheMu.Unlock()
@@ -320,9 +567,99 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	return &layerRef{cachedL.(*layer), done2}, nil
 }
 
+// resolveZtoc fetches the ztoc of the layer and returns the metadata reader based on it.
+func (r *Resolver) resolveZtoc(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, ztocDigest string, sr *io.SectionReader) (metadata.Reader, error) {
+	dgst, err := digest.Parse(ztocDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ztoc digest %q: %w", ztocDigest, err)
+	}
+	zR, err := r.resolveBlob(ctx, hosts, refspec, ocispec.Descriptor{
+		MediaType:   ztoc.MediaTypeZtoc,
+		Digest:      dgst,
+		Annotations: desc.Annotations,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ztoc %v: %w", dgst, err)
+	}
+	defer zR.done()
+	data, err := io.ReadAll(io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return zR.ReadAt(p, offset)
+	}), 0, zR.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ztoc %v: %w", dgst, err)
+	}
+	if dgst.Algorithm().FromBytes(data) != dgst {
+		return nil, fmt.Errorf("invalid ztoc %v: digest mismatch", dgst)
+	}
+	z, err := ztoc.Unmarshal(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ztoc.NewReader(sr, z, dgst)
+}
+
+// resolveNydusBootstrap reads the bootstrap in the Nydus bootstrap layer and returns the
+// metadata reader of the whole filesystem of the image. File contents are read from the blob
+// layers referred by the bootstrap.
+func (r *Resolver) resolveNydusBootstrap(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, sr *io.SectionReader) (_ metadata.Reader, retErr error) {
+	data, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap layer: %w", err)
+	}
+	if desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("invalid bootstrap layer %v: digest mismatch", desc.Digest)
+	}
+	p, err := nydus.ReadBootstrapLayer(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bs, err := nydus.ParseBootstrap(io.NewSectionReader(bytes.NewReader(p), 0, int64(len(p))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bootstrap: %w", err)
+	}
+	var blobs []nydus.Blob
+	defer func() {
+		if retErr != nil {
+			for _, b := range blobs {
+				b.Close()
+			}
+		}
+	}()
+	for _, id := range bs.BlobIDs() {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, id)
+		if err := dgst.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid blob ID %q: %w", id, err)
+		}
+		b, err := r.resolveBlob(ctx, hosts, refspec, ocispec.Descriptor{
+			MediaType:   nydus.MediaTypeNydusBlob,
+			Digest:      dgst,
+			Annotations: desc.Annotations,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve nydus blob %v: %w", dgst, err)
+		}
+		blobs = append(blobs, &nydusBlob{b})
+	}
+	return nydus.NewReader(sr, bs, blobs, desc.Digest)
+}
+
+// nydusBlob is a Nydus blob layer referred by the bootstrap layer.
+type nydusBlob struct {
+	*blobRef
+}
+
+func (b *nydusBlob) ReadAt(p []byte, offset int64) (int, error) {
+	return b.blobRef.ReadAt(p, offset)
+}
+
+func (b *nydusBlob) Close() error {
+	b.done()
+	return nil
+}
+
 // resolveBlob resolves a blob based on the passed layer blob information.
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name := resolveKey(ctx, refspec, desc)
 
 	// Try to retrieve the blob from the underlying cache.
 	r.blobCacheMu.Lock()
@@ -339,7 +676,11 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
+	httpCacheType := r.config.HTTPCacheType
+	if t := cachePolicyOf(ctx).HTTPCacheType; t != "" {
+		httpCacheType = t
+	}
+	httpCache, err := r.newCache(filepath.Join(r.rootDir, httpCacheDirName), httpCacheType, cacheOwner{refspec.String(), desc.Digest})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http cache: %w", err)
 	}
@@ -375,6 +716,7 @@ func newLayer(
 		blob:             blob,
 		verifiableReader: vr,
 		prefetchWaiter:   newWaiter(),
+		closedCh:         make(chan struct{}),
 	}
 }
 
@@ -390,11 +732,21 @@ type layer struct {
 
 	r reader.Reader
 
+	history *accessRecorder // nil if the access history is disabled
+
+	// image is the reference of the image the layer is resolved for.
+	image string
+
 	closed   bool
+	closedCh chan struct{} // closed when the layer is closed
 	closedMu sync.Mutex
 
 	prefetchOnce        sync.Once
 	backgroundFetchOnce sync.Once
+
+	missWatcher   *missWatcher // nil if the layer isn't watched
+	missWatcherMu sync.Mutex
+	fullFetchOnce sync.Once
 }
 
 func (l *layer) Info() Info {
@@ -403,11 +755,12 @@ func (l *layer) Info() Info {
 		readTime = l.r.LastOnDemandReadTime()
 	}
 	return Info{
-		Digest:       l.desc.Digest,
-		Size:         l.blob.Size(),
-		FetchedSize:  l.blob.FetchedSize(),
-		PrefetchSize: l.prefetchedSize(),
-		ReadTime:     readTime,
+		Digest:                l.desc.Digest,
+		Size:                  l.blob.Size(),
+		FetchedSize:           l.blob.FetchedSize(),
+		PrefetchSize:          l.prefetchedSize(),
+		BackgroundFetchedSize: l.blob.BackgroundFetchedSize(),
+		ReadTime:              readTime,
 	}
 }
 
@@ -476,6 +829,11 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	// Files read in the past come first, regardless of the prefetch landmark.
+	if err := l.prefetchHistory(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to prefetch files in the access history")
+	}
+
 	rootID := l.verifiableReader.Metadata().RootID()
 	if _, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.NoPrefetchLandmark); err == nil {
 		// do not prefetch this layer
@@ -519,6 +877,28 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	return nil
 }
 
+// prefetchHistory caches files which were read from this layer in the past.
+func (l *layer) prefetchHistory(ctx context.Context) error {
+	if l.history == nil {
+		return nil
+	}
+	offsets := l.history.offsets()
+	if len(offsets) == 0 {
+		return nil
+	}
+	past := make(map[int64]struct{}, len(offsets))
+	for _, off := range offsets {
+		past[off] = struct{}{}
+	}
+	start := time.Now()
+	err := l.verifiableReader.Cache(reader.WithFilter(func(offset int64) bool {
+		_, ok := past[offset]
+		return ok
+	}))
+	log.G(ctx).WithField("files", len(past)).Debugf("prefetched files in the access history in %v", time.Since(start))
+	return err
+}
+
 func (l *layer) WaitForPrefetchCompletion() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -544,7 +924,29 @@ func (l *layer) backgroundFetch(ctx context.Context) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	budget, pause := l.resolver.backgroundBudget, l.resolver.backgroundPause
+	if err := pause.wait(ctx, l.image, l.closedCh); err != nil {
+		return fmt.Errorf("layer is closed while background fetch is paused: %w", err)
+	}
+	release, err := budget.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { release() }()
 	br := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (retN int, retErr error) {
+		if paused, _ := pause.paused(l.image); paused {
+			// Give the budget to other layers until the fetch is resumed.
+			release()
+			release = func() {}
+			log.G(ctx).WithField("digest", l.desc.Digest).Debug("background fetch is paused")
+			if err := pause.wait(ctx, l.image, l.closedCh); err != nil {
+				return 0, fmt.Errorf("layer is closed while background fetch is paused: %w", err)
+			}
+			if release, err = budget.acquire(ctx); err != nil {
+				release = func() {}
+				return 0, err
+			}
+		}
 		l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
 			// Measuring the time to download background fetch data (in milliseconds)
 			defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.BackgroundFetchDownload, l.Info().Digest, time.Now()) // time to download background fetch data
@@ -553,8 +955,14 @@ func (l *layer) backgroundFetch(ctx context.Context) error {
 				offset,
 				remote.WithContext(ctx),              // Make cancellable
 				remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
+				remote.WithBackgroundFetch(),         // Apply background bandwidth limit
 			)
 		}, 120*time.Second)
+		if retN > 0 {
+			if err := budget.wait(ctx, retN); err != nil {
+				return 0, err
+			}
+		}
 		return
 	}), 0, l.blob.Size())
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchDecompress, time.Now()) // time to decompress background fetch data (in milliseconds)
@@ -564,18 +972,82 @@ func (l *layer) backgroundFetch(ctx context.Context) error {
 	)
 }
 
+func (l *layer) WatchMisses(t MissThreshold) {
+	if !t.Enabled() {
+		return
+	}
+	l.missWatcherMu.Lock()
+	if l.missWatcher == nil {
+		l.missWatcher = newMissWatcher(t)
+	}
+	l.missWatcherMu.Unlock()
+}
+
+func (l *layer) onDemandFetched(size int64) {
+	l.missWatcherMu.Lock()
+	w := l.missWatcher
+	l.missWatcherMu.Unlock()
+	if w != nil && w.add(time.Now(), size) {
+		go l.fetchAll()
+	}
+}
+
+// fetchAll fetches and decompresses the entire layer to the cache once.
+func (l *layer) fetchAll() {
+	l.fullFetchOnce.Do(func() {
+		ctx := log.WithLogger(context.Background(), log.L.WithField("digest", l.desc.Digest))
+		log.G(ctx).Info("on-demand fetches exceeded the threshold; fetching the entire layer")
+		start := time.Now()
+		if err := l.MakeResident(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to fetch the entire layer")
+			return
+		}
+		log.G(ctx).Infof("fetched the entire layer in %v", time.Since(start))
+	})
+}
+
+// MakeResident fetches and decompresses the entire layer to the cache. Unlike
+// background fetch, this is a prioritized task so background tasks are stopped
+// until it completes. Chunks are verified when they are cached.
+func (l *layer) MakeResident() error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	l.resolver.backgroundTaskManager.DoPrioritizedTask()
+	defer l.resolver.backgroundTaskManager.DonePrioritizedTask()
+	if err := l.blob.Cache(0, l.blob.Size()); err != nil {
+		return fmt.Errorf("failed to fetch the entire layer: %w", err)
+	}
+	if err := l.verifiableReader.Cache(); err != nil {
+		return fmt.Errorf("failed to cache the entire layer: %w", err)
+	}
+	return nil
+}
+
 func (l *layerRef) Done() {
 	l.done()
 }
 
-func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
+func (l *layer) RootNode(baseInode uint32, idMap IDMap, opts ...NodeOption) (fusefs.InodeEmbedder, error) {
 	if l.isClosed() {
 		return nil, fmt.Errorf("layer is already closed")
 	}
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType)
+	var nodeOpts nodeOptions
+	for _, o := range opts {
+		o(&nodeOpts)
+	}
+	if l.history != nil {
+		nodeOpts.onRead = l.history.record
+	}
+	nodeOpts.splice = !l.resolver.config.DisableSplice
+	nodeOpts.readDeadline = time.Duration(l.resolver.config.ReadDeadlineMSec) * time.Millisecond
+	if l.resolver.config.ReadDeadlinePolicy == ReadDeadlinePolicyMirror {
+		nodeOpts.failOver = l.blob.FailOver
+	}
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, idMap, nodeOpts)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -589,6 +1061,12 @@ func (l *layer) close() error {
 		return nil
 	}
 	l.closed = true
+	close(l.closedCh)
+	if l.history != nil {
+		if err := l.history.flush(); err != nil {
+			log.L.WithError(err).Warnf("failed to write access history of %v", l.desc.Digest)
+		}
+	}
 	defer l.blob.done() // Close reader first, then close the blob
 	l.verifiableReader.Close()
 	if l.r != nil {
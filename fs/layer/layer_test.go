@@ -23,10 +23,16 @@
 package layer
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestLayer(t *testing.T) {
@@ -59,3 +65,73 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestResolverClose(t *testing.T) {
+	r, err := NewResolver(t.TempDir(), nil, config.Config{}, nil, nil, OverlayOpaqueAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, used := &closeCountBlob{}, &closeCountBlob{}
+	_, done, _ := r.blobCache.Add("unused", unused)
+	done()
+	_, done, _ = r.blobCache.Add("used", used)
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if unused.closed != 1 || used.closed != 0 {
+		t.Fatalf("only unused blob must be closed; unused=%d, used=%d", unused.closed, used.closed)
+	}
+	done()
+	if used.closed != 1 {
+		t.Fatalf("blob must be closed once it's released; closed=%d", used.closed)
+	}
+}
+
+type closeCountBlob struct {
+	remote.Blob
+	closed int
+}
+
+func (b *closeCountBlob) Close() error {
+	b.closed++
+	return nil
+}
+
+func TestResolveKey(t *testing.T) {
+	refspec, err := reference.Parse("example.com/foo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("layer")}
+	memory := CachePolicy{FSCacheType: memoryCacheType}
+	ctxs := map[string]context.Context{
+		"default":          context.Background(),
+		"memory":           WithCachePolicy(context.Background(), memory),
+		"directory":        WithCachePolicy(context.Background(), CachePolicy{HTTPCacheType: "directory"}),
+		"scope_a":          WithResolveScope(context.Background(), "namespace/a"),
+		"scope_b":          WithResolveScope(context.Background(), "namespace/b"),
+		"scope_a_memory":   WithResolveScope(WithCachePolicy(context.Background(), memory), "namespace/a"),
+		"scope_a_memory_2": WithCachePolicy(WithResolveScope(context.Background(), "namespace/a"), memory),
+	}
+	keys := make(map[string]string)
+	for name, ctx := range ctxs {
+		key := resolveKey(ctx, refspec, desc)
+		if name == "scope_a_memory_2" {
+			if key != resolveKey(ctxs["scope_a_memory"], refspec, desc) {
+				t.Errorf("key must be the same for the same scope and policy; got %q", key)
+			}
+			continue
+		}
+		if other, ok := keys[key]; ok {
+			t.Errorf("layers of %q and %q must not share the key %q", name, other, key)
+		}
+		keys[key] = name
+	}
+
+	// Empty policy and scope are the same as the default.
+	ctx := WithResolveScope(WithCachePolicy(context.Background(), CachePolicy{}), "")
+	if got, want := resolveKey(ctx, refspec, desc), resolveKey(context.Background(), refspec, desc); got != want {
+		t.Errorf("key = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+const defaultMissThresholdWindow = time.Minute
+
+// MissThreshold is the threshold of on-demand fetches of a layer in a window.
+// 0 disables each limit.
+type MissThreshold struct {
+	Bytes  int64
+	Count  int64
+	Window time.Duration
+}
+
+// Enabled returns true if any of the limits is specified.
+func (t MissThreshold) Enabled() bool {
+	return t.Bytes > 0 || t.Count > 0
+}
+
+// MissThresholdFromConfig returns the threshold specified in the config.
+func MissThresholdFromConfig(cfg config.MissThresholdConfig) MissThreshold {
+	return MissThreshold{
+		Bytes:  cfg.Bytes,
+		Count:  cfg.Count,
+		Window: time.Duration(cfg.WindowSec) * time.Second,
+	}
+}
+
+// ParseMissThreshold parses the threshold specified by config.TargetMissThresholdLabel
+// (e.g. "bytes=104857600,count=1000,window=1m"). "off" disables the threshold.
+func ParseMissThreshold(s string) (MissThreshold, error) {
+	var t MissThreshold
+	if s == "off" {
+		return t, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return MissThreshold{}, fmt.Errorf("invalid miss threshold %q", s)
+		}
+		var err error
+		switch kv[0] {
+		case "bytes":
+			t.Bytes, err = strconv.ParseInt(kv[1], 10, 64)
+		case "count":
+			t.Count, err = strconv.ParseInt(kv[1], 10, 64)
+		case "window":
+			t.Window, err = time.ParseDuration(kv[1])
+		default:
+			return MissThreshold{}, fmt.Errorf("unknown key %q in miss threshold %q", kv[0], s)
+		}
+		if err != nil {
+			return MissThreshold{}, fmt.Errorf("invalid %s in miss threshold %q: %w", kv[0], s, err)
+		}
+	}
+	return t, nil
+}
+
+// missWatcher counts on-demand fetches of a layer in the sliding window.
+type missWatcher struct {
+	threshold MissThreshold
+
+	fetches  []missedFetch // fetches in the window; older ones come first
+	bytes    int64         // total size of fetches
+	exceeded bool
+	mu       sync.Mutex
+}
+
+type missedFetch struct {
+	time time.Time
+	size int64
+}
+
+func newMissWatcher(t MissThreshold) *missWatcher {
+	if t.Window <= 0 {
+		t.Window = defaultMissThresholdWindow
+	}
+	return &missWatcher{threshold: t}
+}
+
+// add records an on-demand fetch and returns true when the fetches exceed the
+// threshold for the first time.
+func (w *missWatcher) add(now time.Time, size int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.exceeded {
+		return false
+	}
+	w.fetches = append(w.fetches, missedFetch{now, size})
+	w.bytes += size
+	var i int
+	for ; i < len(w.fetches) && !w.fetches[i].time.After(now.Add(-w.threshold.Window)); i++ {
+		w.bytes -= w.fetches[i].size
+	}
+	w.fetches = w.fetches[i:]
+	if (w.threshold.Bytes > 0 && w.bytes > w.threshold.Bytes) ||
+		(w.threshold.Count > 0 && int64(len(w.fetches)) > w.threshold.Count) {
+		w.exceeded, w.fetches = true, nil
+		return true
+	}
+	return false
+}
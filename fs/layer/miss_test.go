@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMissThreshold(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    MissThreshold
+		wantErr bool
+	}{
+		{name: "off", in: "off", want: MissThreshold{}},
+		{name: "bytes", in: "bytes=1024", want: MissThreshold{Bytes: 1024}},
+		{name: "all", in: "bytes=1024, count=10,window=30s", want: MissThreshold{Bytes: 1024, Count: 10, Window: 30 * time.Second}},
+		{name: "unknown_key", in: "size=1024", wantErr: true},
+		{name: "invalid_number", in: "count=a", wantErr: true},
+		{name: "invalid_format", in: "bytes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMissThreshold(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("threshold = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissWatcher(t *testing.T) {
+	type fetch struct {
+		after time.Duration // since the first fetch
+		size  int64
+		want  bool
+	}
+	tests := []struct {
+		name      string
+		threshold MissThreshold
+		fetches   []fetch
+	}{
+		{
+			name:      "bytes",
+			threshold: MissThreshold{Bytes: 100, Window: 10 * time.Second},
+			fetches:   []fetch{{0, 60, false}, {time.Second, 40, false}, {2 * time.Second, 1, true}, {3 * time.Second, 1000, false}},
+		},
+		{
+			name:      "bytes_out_of_window",
+			threshold: MissThreshold{Bytes: 100, Window: 10 * time.Second},
+			fetches:   []fetch{{0, 60, false}, {10 * time.Second, 60, false}, {15 * time.Second, 41, true}},
+		},
+		{
+			name:      "count",
+			threshold: MissThreshold{Count: 2},
+			fetches:   []fetch{{0, 1, false}, {time.Second, 1, false}, {2 * time.Minute, 1, false}, {2*time.Minute + time.Second, 1, false}, {2*time.Minute + 2*time.Second, 1, true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newMissWatcher(tt.threshold)
+			start := time.Now()
+			for i, f := range tt.fetches {
+				if got := w.add(start.Add(f.after), f.size); got != f.want {
+					t.Errorf("fetch %d: exceeded = %v; want %v", i, got, f.want)
+				}
+			}
+		})
+	}
+}
@@ -73,7 +73,71 @@ var opaqueXattrs = map[OverlayOpaqueType][]string{
 	OverlayOpaqueUser:    {"user.overlay.opaque"},
 }
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType) (fusefs.InodeEmbedder, error) {
+// NodeOption is an option of the root node of a layer.
+type NodeOption func(*nodeOptions)
+
+type nodeOptions struct {
+	onFirstRead func()
+	onRead      func(id uint32)
+	onFetch     OnDemandFetchHook
+	onFileRead  func(path string)
+	onOutcome   func(outcome string, size int64)
+	splice      bool
+
+	readDeadline time.Duration
+	failOver     func() bool // nil if reads exceeding the deadline aren't retried
+}
+
+const (
+	// ReadDeadlinePolicyEIO fails reads exceeding the deadline with EIO.
+	ReadDeadlinePolicyEIO = "eio"
+
+	// ReadDeadlinePolicyMirror retries reads exceeding the deadline on the other
+	// hosts serving the layer.
+	ReadDeadlinePolicyMirror = "mirror"
+)
+
+// errReadDeadline is returned when a read of a file doesn't complete within the
+// deadline.
+var errReadDeadline = errors.New("read deadline exceeded")
+
+// OnDemandFetchHook is called when a read of the file at path fetches contents from
+// the remote layer. pid is the process which issued the read (0 if unknown).
+type OnDemandFetchHook func(path string, offset, size int64, pid uint32, latency time.Duration)
+
+// WithFirstReadHook lets the root node call f when a file in the node is read
+// for the first time.
+func WithFirstReadHook(f func()) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.onFirstRead = f
+	}
+}
+
+// WithOnDemandFetchHook lets the root node call f when a read of a file in the node
+// fetches contents from the remote layer.
+func WithOnDemandFetchHook(f OnDemandFetchHook) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.onFetch = f
+	}
+}
+
+// WithFileReadHook lets the root node call f with the path of a file in the node
+// (relative to the root) when the opened file is read for the first time.
+func WithFileReadHook(f func(path string)) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.onFileRead = f
+	}
+}
+
+// WithReadOutcomeHook lets the root node call f with the outcome of each read of a
+// file in the node (e.g. commonmetrics.FuseOutcomeDisk) and the size of the read.
+func WithReadOutcomeHook(f func(outcome string, size int64)) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.onOutcome = f
+	}
+}
+
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, idMap IDMap, opts nodeOptions) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -89,6 +153,15 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		baseInode:    baseInode,
 		rootID:       rootID,
 		opaqueXattrs: opq,
+		idMap:        idMap,
+		onFirstRead:  opts.onFirstRead,
+		onRead:       opts.onRead,
+		onFetch:      opts.onFetch,
+		onFileRead:   opts.onFileRead,
+		onOutcome:    opts.onOutcome,
+		splice:       opts.splice,
+		readDeadline: opts.readDeadline,
+		failOver:     opts.failOver,
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -106,6 +179,16 @@ type fs struct {
 	baseInode    uint32
 	rootID       uint32
 	opaqueXattrs []string
+	idMap        IDMap
+	onFirstRead  func()
+	firstRead    sync.Once
+	onRead       func(id uint32)
+	onFetch      OnDemandFetchHook
+	onFileRead   func(path string)
+	onOutcome    func(outcome string, size int64)
+	splice       bool // serve reads from the cache files with splice(2) if possible
+	readDeadline time.Duration
+	failOver     func() bool
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -235,7 +318,8 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 
 var _ = (fusefs.NodeLookuper)((*node)(nil))
 
-func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (_ *fusefs.Inode, errno syscall.Errno) {
+	defer measureMetadataOperation(commonmetrics.FuseLookup, time.Now(), &errno)
 
 	isRoot := n.isRootNode()
 
@@ -263,14 +347,14 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 				n.fs.s.report(fmt.Errorf("node.Lookup: %v", err))
 				return nil, syscall.EIO
 			}
-			entryToAttr(ino, tn.attr, &out.Attr)
+			n.fs.entryToAttr(ino, tn.attr, &out.Attr)
 		case *whiteout:
 			ino, err := n.fs.inodeOfID(tn.id)
 			if err != nil {
 				n.fs.s.report(fmt.Errorf("node.Lookup: %v", err))
 				return nil, syscall.EIO
 			}
-			entryToAttr(ino, tn.attr, &out.Attr)
+			n.fs.entryToAttr(ino, tn.attr, &out.Attr)
 		default:
 			n.fs.s.report(fmt.Errorf("node.Lookup: uknown node type detected"))
 			return nil, syscall.EIO
@@ -304,7 +388,7 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 				id:   whID,
 				fs:   n.fs,
 				attr: wh,
-			}, entryToWhAttr(ino, wh, &out.Attr)), 0
+			}, n.fs.entryToWhAttr(ino, wh, &out.Attr)), 0
 		}
 		n.readdir() // This code path is very expensive. Cache child entries here so that the next call don't reach here.
 		return nil, syscall.ENOENT
@@ -319,12 +403,13 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 		id:   id,
 		fs:   n.fs,
 		attr: ce,
-	}, entryToAttr(ino, ce, &out.Attr)), 0
+	}, n.fs.entryToAttr(ino, ce, &out.Attr)), 0
 }
 
 var _ = (fusefs.NodeOpener)((*node)(nil))
 
 func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer measureMetadataOperation(commonmetrics.FuseOpen, time.Now(), &errno)
 	ra, err := n.fs.r.OpenFile(n.id)
 	if err != nil {
 		n.fs.s.report(fmt.Errorf("node.Open: %v", err))
@@ -338,13 +423,14 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
 
-func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer measureMetadataOperation(commonmetrics.FuseGetattr, time.Now(), &errno)
 	ino, err := n.fs.inodeOfID(n.id)
 	if err != nil {
 		n.fs.s.report(fmt.Errorf("node.Getattr: %v", err))
 		return syscall.EIO
 	}
-	entryToAttr(ino, n.attr, &out.Attr)
+	n.fs.entryToAttr(ino, n.attr, &out.Attr)
 	return 0
 }
 
@@ -408,35 +494,170 @@ func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 
 // file is a file abstraction which implements file handle in go-fuse.
 type file struct {
-	n  *node
-	ra io.ReaderAt
+	n        *node
+	ra       io.ReaderAt
+	readOnce sync.Once
+}
+
+// outcomeReaderAt is a file which reports where the read contents come from
+// (e.g. memory, disk or network).
+type outcomeReaderAt interface {
+	ReadAtWithOutcome(p []byte, offset int64) (int, string, error)
+}
+
+// fdReaderAt is a file which can pass the contents cached on disk to the kernel
+// without copying them to the user space.
+type fdReaderAt interface {
+	ReadAtFd(size int, offset int64) (fd uintptr, fdOffset int64, n int, ok bool)
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
 
 func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	start := time.Now()
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.ReadOnDemand, f.n.fs.layerDigest, time.Now()) // measure time for on-demand file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.OnDemandReadAccessCount, f.n.fs.layerDigest)             // increment the counter for on-demand file accesses
-	n, err := f.ra.ReadAt(dest, off)
+	if f.n.fs.onFirstRead != nil {
+		f.n.fs.firstRead.Do(f.n.fs.onFirstRead)
+	}
+	if f.n.fs.onRead != nil {
+		f.n.fs.onRead(f.n.id)
+	}
+	if f.n.fs.onFileRead != nil {
+		f.readOnce.Do(func() { f.n.fs.onFileRead(f.n.Path(nil)) })
+	}
+	if fr, ok := f.ra.(fdReaderAt); ok && f.n.fs.splice {
+		// go-fuse splices the cached contents to the reply if possible.
+		if fd, fdOff, n, ok := fr.ReadAtFd(len(dest), off); ok {
+			commonmetrics.MeasureFuseOperationLatency(commonmetrics.FuseRead, commonmetrics.FuseOutcomeDisk, start)
+			if f.n.fs.onOutcome != nil {
+				f.n.fs.onOutcome(commonmetrics.FuseOutcomeDisk, int64(n))
+			}
+			return fuse.ReadResultFd(fd, fdOff, n), 0
+		}
+	}
+	var (
+		n       int
+		outcome string
+		err     error
+	)
+	if f.n.fs.readDeadline > 0 {
+		n, outcome, err = f.readAtWithDeadline(dest, off)
+	} else {
+		n, outcome, err = f.readAt(dest, off)
+	}
 	if err != nil && err != io.EOF {
+		commonmetrics.MeasureFuseOperationLatency(commonmetrics.FuseRead, commonmetrics.FuseOutcomeError, start)
 		f.n.fs.s.report(fmt.Errorf("file.Read: %v", err))
 		return nil, syscall.EIO
 	}
+	commonmetrics.MeasureFuseOperationLatency(commonmetrics.FuseRead, outcome, start)
+	if f.n.fs.onOutcome != nil {
+		f.n.fs.onOutcome(outcome, int64(n))
+	}
+	if outcome == commonmetrics.FuseOutcomeNetwork && f.n.fs.onFetch != nil {
+		var pid uint32
+		if c, ok := fuse.FromContext(ctx); ok {
+			pid = c.Pid
+		}
+		f.n.fs.onFetch("/"+f.n.Path(nil), off, int64(n), pid, time.Since(start))
+	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+func (f *file) readAt(p []byte, off int64) (int, string, error) {
+	if or, ok := f.ra.(outcomeReaderAt); ok {
+		return or.ReadAtWithOutcome(p, off)
+	}
+	n, err := f.ra.ReadAt(p, off)
+	return n, commonmetrics.FuseOutcomeUnknown, err
+}
+
+// readAtWithDeadline reads the file but returns errReadDeadline if the read doesn't
+// complete within the deadline. If the filesystem can fail over, slow fetches are
+// aborted on the deadline and the read (retried if failed) is given another deadline.
+// The fetch of the timed out read continues in background and caches the contents.
+func (f *file) readAtWithDeadline(dest []byte, off int64) (int, string, error) {
+	type result struct {
+		p       []byte
+		n       int
+		outcome string
+		err     error
+	}
+	read := func() <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			// dest can't be passed because the read can complete after returning.
+			p := make([]byte, len(dest))
+			n, outcome, err := f.readAt(p, off)
+			ch <- result{p, n, outcome, err}
+		}()
+		return ch
+	}
+	var (
+		resCh      = read()
+		timer      = time.NewTimer(f.n.fs.readDeadline)
+		failedOver bool
+		retried    bool
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-resCh:
+			if res.err != nil && res.err != io.EOF && failedOver && !retried {
+				// The aborted fetch failed; retry on the next host
+				retried = true
+				resCh = read()
+				continue
+			}
+			return copy(dest, res.p[:res.n]), res.outcome, res.err
+		case <-timer.C:
+			if !failedOver && f.n.fs.failOver != nil && f.n.fs.failOver() {
+				failedOver = true
+				timer.Reset(f.n.fs.readDeadline)
+				continue
+			}
+			return 0, commonmetrics.FuseOutcomeError, errReadDeadline
+		}
+	}
+}
+
+var _ = (fusefs.FileReleaser)((*file)(nil))
+
+func (f *file) Release(ctx context.Context) syscall.Errno {
+	if c, ok := f.ra.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			f.n.fs.s.report(fmt.Errorf("file.Release: %v", err))
+			return syscall.EIO
+		}
+	}
+	return 0
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
-func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer measureMetadataOperation(commonmetrics.FuseGetattr, time.Now(), &errno)
 	ino, err := f.n.fs.inodeOfID(f.n.id)
 	if err != nil {
 		f.n.fs.s.report(fmt.Errorf("file.Getattr: %v", err))
 		return syscall.EIO
 	}
-	entryToAttr(ino, f.n.attr, &out.Attr)
+	f.n.fs.entryToAttr(ino, f.n.attr, &out.Attr)
 	return 0
 }
 
+// measureMetadataOperation records the latency of the FUSE operation served from the
+// metadata of the layer. ENOENT isn't counted as an error because it's a usual result
+// of lookups.
+func measureMetadataOperation(operation string, start time.Time, errno *syscall.Errno) {
+	outcome := commonmetrics.FuseOutcomeMetadata
+	if *errno != 0 && *errno != syscall.ENOENT {
+		outcome = commonmetrics.FuseOutcomeError
+	}
+	commonmetrics.MeasureFuseOperationLatency(operation, outcome, start)
+}
+
 // whiteout is a whiteout abstraction compliant to overlayfs.
 type whiteout struct {
 	fusefs.Inode
@@ -453,7 +674,7 @@ func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.A
 		w.fs.s.report(fmt.Errorf("whiteout.Getattr: %v", err))
 		return syscall.EIO
 	}
-	entryToWhAttr(ino, w.attr, &out.Attr)
+	w.fs.entryToWhAttr(ino, w.attr, &out.Attr)
 	return 0
 }
 
@@ -634,7 +855,7 @@ func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 }
 
 // entryToAttr converts metadata.Attr to go-fuse's Attr.
-func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
+func (fs *fs) entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = ino
 	out.Size = uint64(e.Size)
 	if e.Mode&os.ModeSymlink != 0 {
@@ -648,7 +869,7 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 	mtime := e.ModTime
 	out.SetTimes(nil, &mtime, nil)
 	out.Mode = fileModeToSystemMode(e.Mode)
-	out.Owner = fuse.Owner{Uid: uint32(e.UID), Gid: uint32(e.GID)}
+	out.Owner = fs.idMap.owner(e.UID, e.GID)
 	out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
 	out.Nlink = uint32(e.NumLink)
 	if out.Nlink == 0 {
@@ -666,7 +887,7 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 }
 
 // entryToWhAttr converts metadata.Attr to go-fuse's Attr of whiteouts.
-func entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
+func (fs *fs) entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = ino
 	out.Size = 0
 	out.Blksize = blockSize
@@ -674,7 +895,7 @@ func entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAtt
 	mtime := e.ModTime
 	out.SetTimes(nil, &mtime, nil)
 	out.Mode = syscall.S_IFCHR
-	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
+	out.Owner = fs.idMap.owner(0, 0)
 	out.Rdev = uint32(unix.Mkdev(0, 0))
 	out.Nlink = 1
 	out.Padding = 0 // TODO
@@ -698,7 +919,7 @@ func (fs *fs) stateToAttr(out *fuse.Attr) fusefs.StableAttr {
 
 	// root can read and open it (dr-x------ root root).
 	out.Mode = stateDirMode
-	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
+	out.Owner = fs.idMap.owner(0, 0)
 
 	// dummy
 	out.Mtime = 0
@@ -726,7 +947,7 @@ func (fs *fs) statFileToAttr(size uint64, out *fuse.Attr) fusefs.StableAttr {
 
 	// Root can read it ("-r-------- root root").
 	out.Mode = statFileMode
-	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
+	out.Owner = fs.idMap.owner(0, 0)
 
 	// dummy
 	out.Mtime = 0
@@ -0,0 +1,100 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowReaderAt returns "test" after receiving nil from resume or fails with the
+// received error.
+type slowReaderAt struct {
+	resume chan error
+}
+
+func (r *slowReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if err := <-r.resume; err != nil {
+		return 0, err
+	}
+	return copy(p, "test"), nil
+}
+
+func TestReadDeadline(t *testing.T) {
+	const deadline = 50 * time.Millisecond
+	newFile := func(failOver func() bool) (*file, *slowReaderAt) {
+		ra := &slowReaderAt{resume: make(chan error, 2)}
+		return &file{n: &node{fs: &fs{readDeadline: deadline, failOver: failOver}}, ra: ra}, ra
+	}
+	readAndCheck := func(f *file, wantErr error) {
+		dest := make([]byte, 4)
+		n, _, err := f.readAtWithDeadline(dest, 0)
+		if wantErr != nil {
+			if !errors.Is(err, wantErr) {
+				t.Fatalf("read must fail with %v; got %v", wantErr, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if got := string(dest[:n]); got != "test" {
+			t.Errorf("read %q; want %q", got, "test")
+		}
+	}
+
+	// Reads completing within the deadline
+	f, ra := newFile(nil)
+	ra.resume <- nil
+	readAndCheck(f, nil)
+
+	// Reads exceeding the deadline fail
+	f, ra = newFile(nil)
+	start := time.Now()
+	readAndCheck(f, errReadDeadline)
+	if d := time.Since(start); d < deadline {
+		t.Errorf("read failed before the deadline: %v", d)
+	}
+	ra.resume <- nil
+
+	// Aborted read is retried
+	var failedOver int
+	f, ra = newFile(func() bool {
+		failedOver++
+		ra.resume <- errors.New("aborted")
+		ra.resume <- nil
+		return true
+	})
+	readAndCheck(f, nil)
+	if failedOver != 1 {
+		t.Errorf("failed over %d times; want 1", failedOver)
+	}
+
+	// The retried read also exceeds the deadline
+	failedOver = 0
+	f, ra = newFile(func() bool {
+		failedOver++
+		ra.resume <- errors.New("aborted")
+		return true
+	})
+	readAndCheck(f, errReadDeadline)
+	if failedOver != 1 {
+		t.Errorf("failed over %d times; want 1", failedOver)
+	}
+	ra.resume <- nil
+}
@@ -246,6 +246,8 @@ func (sb *sampleBlob) Authn(tr http.RoundTripper) (http.RoundTripper, error) { r
 func (sb *sampleBlob) Check() error                                          { return nil }
 func (sb *sampleBlob) Size() int64                                           { return sb.r.Size() }
 func (sb *sampleBlob) FetchedSize() int64                                    { return 0 }
+func (sb *sampleBlob) BackgroundFetchedSize() int64                          { return 0 }
+func (sb *sampleBlob) FailOver() bool                                        { return false }
 func (sb *sampleBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	sb.readCalled = true
 	return sb.r.ReadAt(p, offset)
@@ -542,7 +544,7 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 }
 
 func getRootNode(t *testing.T, r metadata.Reader, opaque OverlayOpaqueType) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque)
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, IDMap{}, nodeOptions{})
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -565,9 +567,11 @@ type testBlobState struct {
 	fetchedSize int64
 }
 
-func (tb *testBlobState) Check() error       { return nil }
-func (tb *testBlobState) Size() int64        { return tb.size }
-func (tb *testBlobState) FetchedSize() int64 { return tb.fetchedSize }
+func (tb *testBlobState) Check() error                 { return nil }
+func (tb *testBlobState) Size() int64                  { return tb.size }
+func (tb *testBlobState) FetchedSize() int64           { return tb.fetchedSize }
+func (tb *testBlobState) BackgroundFetchedSize() int64 { return 0 }
+func (tb *testBlobState) FailOver() bool               { return false }
 func (tb *testBlobState) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return 0, nil
 }
@@ -40,6 +40,30 @@ const (
 	// BytesServedKey is the key for any metric related to counting bytes served as the part of specific operation.
 	BytesServedKey = "bytes_served"
 
+	// RemoteHostFetchCountKey is the key for the count of fetches served by each registry host.
+	RemoteHostFetchCountKey = "remote_host_fetch_count"
+
+	// RemoteHostHealthyKey is the key for the health of registry hosts.
+	RemoteHostHealthyKey = "remote_host_healthy"
+
+	// ImageLayerPullCountKey is the key for the count of layer pulls per image and containerd namespace.
+	ImageLayerPullCountKey = "image_layer_pull_count"
+
+	// ImageTimeToFirstReadKey is the key for the time from mounting a layer to the first read of a file.
+	ImageTimeToFirstReadKey = "image_time_to_first_read_milliseconds"
+
+	// IPFSBytesServedKey is the key for the bytes of layers served from IPFS.
+	IPFSBytesServedKey = "ipfs_bytes_served"
+
+	// FuseOperationLatencyKey is the key for the latency of FUSE operations in microseconds.
+	FuseOperationLatencyKey = "fuse_operation_duration_microseconds"
+
+	// CacheTierLookupCountKey is the key for the count of lookups of tiered caches.
+	CacheTierLookupCountKey = "cache_tier_lookup_count"
+
+	// CacheTierMiss is the tier of lookups which didn't hit any tier.
+	CacheTierMiss = "miss"
+
 	// Keep namespace as stargz and subsystem as fs.
 	namespace = "stargz"
 	subsystem = "fs"
@@ -74,11 +98,46 @@ const (
 	PrefetchSize              = "prefetch_size"
 )
 
+// Lists how layers of images are pulled.
+const (
+	// LazyPull means the layer is mounted as a remote snapshot.
+	LazyPull = "lazy"
+	// FallbackPull means the layer couldn't be (or wasn't allowed to be) lazily
+	// pulled so containerd downloads the layer.
+	FallbackPull = "fallback"
+	// RejectedPull means the layer is rejected by the lazy pull policy.
+	RejectedPull = "rejected"
+)
+
+// Lists FUSE operations and where they are served from.
+const (
+	FuseLookup  = "lookup"
+	FuseGetattr = "getattr"
+	FuseOpen    = "open"
+	FuseRead    = "read"
+
+	// FuseOutcomeMetadata means the operation is served from the metadata of the layer.
+	FuseOutcomeMetadata = "metadata"
+	// FuseOutcomeMemory means the contents are read from the cache on memory.
+	FuseOutcomeMemory = "memory"
+	// FuseOutcomeDisk means the contents are read from the cache on disk.
+	FuseOutcomeDisk = "disk"
+	// FuseOutcomeNetwork means the contents are fetched from the layer blob on demand.
+	FuseOutcomeNetwork = "network"
+	// FuseOutcomeError means the operation failed.
+	FuseOutcomeError = "error"
+	// FuseOutcomeUnknown means the file doesn't report where the contents are read from.
+	FuseOutcomeUnknown = "unknown"
+)
+
 var (
 	// Buckets for OperationLatency metrics.
 	latencyBucketsMilliseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384} // in milliseconds
 	latencyBucketsMicroseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}                          // in microseconds
 
+	// Buckets for FUSE operations covering from memory cache hits to fetches from registries.
+	fuseLatencyBucketsMicroseconds = prometheus.ExponentialBuckets(1, 4, 13) // 1us to about 16s
+
 	// operationLatencyMilliseconds collects operation latency numbers in milliseconds grouped by
 	// operation, type and layer digest.
 	operationLatencyMilliseconds = prometheus.NewHistogramVec(
@@ -129,6 +188,101 @@ var (
 	)
 )
 
+var (
+	// remoteHostFetchCount counts fetches served by each registry host (mirror or registry)
+	// per layer sha.
+	remoteHostFetchCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      RemoteHostFetchCountKey,
+			Help:      "The count of fetches served by registry hosts. Broken down by host and layer sha.",
+		},
+		[]string{"host", "layer"},
+	)
+
+	// remoteHostHealthy is 1 if the registry host is healthy and 0 if the host failed to
+	// serve blobs and hasn't passed the health check yet.
+	remoteHostHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      RemoteHostHealthyKey,
+			Help:      "The health of registry hosts (1 means healthy). Broken down by host.",
+		},
+		[]string{"host"},
+	)
+)
+
+var (
+	// imageLayerPullCount counts layers which are lazily pulled or not per image and containerd namespace.
+	imageLayerPullCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      ImageLayerPullCountKey,
+			Help:      "The count of layer pulls. Broken down by image, containerd namespace and pull mode (lazy, fallback or rejected).",
+		},
+		[]string{"image", "namespace", "mode"},
+	)
+
+	// imageTimeToFirstRead collects the time from mounting layers to the first read of files in them
+	// per image and containerd namespace.
+	imageTimeToFirstRead = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      ImageTimeToFirstReadKey,
+			Help:      "Time in milliseconds from mounting a layer to the first read of a file in it. Broken down by image and containerd namespace.",
+			Buckets:   latencyBucketsMilliseconds,
+		},
+		[]string{"image", "namespace"},
+	)
+)
+
+var (
+	// ipfsBytesServed counts bytes of layers served from the local IPFS daemon or HTTP
+	// gateways per layer sha.
+	ipfsBytesServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      IPFSBytesServedKey,
+			Help:      "The number of bytes of layers served from IPFS. Broken down by source (daemon or gateway) and layer sha.",
+		},
+		[]string{"source", "layer"},
+	)
+)
+
+var (
+	// fuseOperationLatency collects the latency of FUSE operations in microseconds grouped
+	// by operation and outcome.
+	fuseOperationLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FuseOperationLatencyKey,
+			Help:      "Latency in microseconds of FUSE operations. Broken down by operation and outcome (metadata, memory, disk, network or error).",
+			Buckets:   fuseLatencyBucketsMicroseconds,
+		},
+		[]string{"operation", "outcome"},
+	)
+)
+
+var (
+	// cacheTierLookupCount counts lookups of tiered caches per cache type and the tier
+	// which served the contents.
+	cacheTierLookupCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheTierLookupCountKey,
+			Help:      "The count of lookups of tiered caches. Broken down by cache type (fscache or httpcache) and the tier which served the contents (memory, the name of the tier or miss).",
+		},
+		[]string{"type", "tier"},
+	)
+)
+
 var register sync.Once
 var logLevel logrus.Level = logrus.DebugLevel
 
@@ -154,9 +308,52 @@ func Register(l logrus.Level) {
 		prometheus.MustRegister(operationLatencyMicroseconds)
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
+		prometheus.MustRegister(remoteHostFetchCount)
+		prometheus.MustRegister(remoteHostHealthy)
+		prometheus.MustRegister(imageLayerPullCount)
+		prometheus.MustRegister(imageTimeToFirstRead)
+		prometheus.MustRegister(ipfsBytesServed)
+		prometheus.MustRegister(fuseOperationLatency)
+		prometheus.MustRegister(cacheTierLookupCount)
 	})
 }
 
+// IncRemoteHostFetchCount increments the count of fetches of the layer served by the registry host.
+func IncRemoteHostFetchCount(host string, layer digest.Digest) {
+	remoteHostFetchCount.WithLabelValues(host, layer.String()).Inc()
+}
+
+// SetRemoteHostHealthy records the health of the registry host.
+func SetRemoteHostHealthy(host string, healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	remoteHostHealthy.WithLabelValues(host).Set(v)
+}
+
+// AddIPFSBytesServed adds the bytes of the layer served from the IPFS source
+// ("daemon" or "gateway").
+func AddIPFSBytesServed(source string, layer digest.Digest, bytes int64) {
+	ipfsBytesServed.WithLabelValues(source, layer.String()).Add(float64(bytes))
+}
+
+// IncCacheTierLookupCount increments the count of lookups of the cache type served by the
+// tier. CacheTierMiss is passed as the tier if the lookup didn't hit any tier.
+func IncCacheTierLookupCount(typ, tier string) {
+	cacheTierLookupCount.WithLabelValues(typ, tier).Inc()
+}
+
+// IncImageLayerPullCount increments the count of layers of the image pulled in the specified mode.
+func IncImageLayerPullCount(image, namespace, mode string) {
+	imageLayerPullCount.WithLabelValues(image, namespace, mode).Inc()
+}
+
+// MeasureTimeToFirstRead records the time since the layer of the image was mounted.
+func MeasureTimeToFirstRead(image, namespace string, mounted time.Time) {
+	imageTimeToFirstRead.WithLabelValues(image, namespace).Observe(sinceInMilliseconds(mounted))
+}
+
 // MeasureLatencyInMilliseconds wraps the labels attachment as well as calling Observe into a single method.
 // Right now we attach the operation and layer digest, so it's possible to see the breakdown for latency
 // by operation and individual layers.
@@ -175,6 +372,11 @@ func MeasureLatencyInMicroseconds(operation string, layer digest.Digest, start t
 	operationLatencyMicroseconds.WithLabelValues(operation, layer.String()).Observe(sinceInMicroseconds(start))
 }
 
+// MeasureFuseOperationLatency records the latency of the FUSE operation with its outcome.
+func MeasureFuseOperationLatency(operation, outcome string, start time.Time) {
+	fuseOperationLatency.WithLabelValues(operation, outcome).Observe(sinceInMicroseconds(start))
+}
+
 // IncOperationCount wraps the labels attachment as well as calling Inc into a single method.
 func IncOperationCount(operation string, layer digest.Digest) {
 	operationCount.WithLabelValues(operation, layer.String()).Inc()
@@ -0,0 +1,334 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"sort"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	metrics "github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Types of fetches reported by the image_fetched_bytes metric.
+const (
+	onDemandFetch   = "on_demand"
+	prefetchFetch   = "prefetch"
+	backgroundFetch = "background"
+)
+
+const (
+	// HitRatioWindow is the window of the cache hit ratio of images.
+	HitRatioWindow = 5 * time.Minute
+
+	// hitWindowBuckets is the number of the buckets of the window. Reads older
+	// than the window are dropped per bucket.
+	hitWindowBuckets = 30
+)
+
+// ImageStats is the statistics of the layers of an image.
+type ImageStats struct {
+	Image     string `json:"image"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// Size is the total size of the layers of the image currently mounted.
+	Size int64 `json:"size"`
+
+	// OnDemandBytes, PrefetchBytes and BackgroundBytes are the bytes fetched for
+	// the layers of the image on demand, by prefetch and in background.
+	OnDemandBytes   int64 `json:"onDemandBytes"`
+	PrefetchBytes   int64 `json:"prefetchBytes"`
+	BackgroundBytes int64 `json:"backgroundBytes"`
+
+	// CacheHitBytes and CacheMissBytes are the bytes of files read in the last
+	// HitRatioWindow which were served from the cache and which needed fetches
+	// from the registry.
+	CacheHitBytes  int64 `json:"cacheHitBytes"`
+	CacheMissBytes int64 `json:"cacheMissBytes"`
+
+	// CacheHitRatio is the ratio of CacheHitBytes to the bytes read in the window.
+	// This is nil if nothing is read in the window.
+	CacheHitRatio *float64 `json:"cacheHitRatio,omitempty"`
+}
+
+type imageKey struct {
+	image     string
+	namespace string
+}
+
+type fetchedBytes struct {
+	onDemand   int64
+	prefetch   int64
+	background int64
+}
+
+func fetchedBytesOf(info layer.Info) fetchedBytes {
+	onDemand := info.FetchedSize - info.PrefetchSize - info.BackgroundFetchedSize
+	if onDemand < 0 {
+		onDemand = 0
+	}
+	return fetchedBytes{
+		onDemand:   onDemand,
+		prefetch:   info.PrefetchSize,
+		background: info.BackgroundFetchedSize,
+	}
+}
+
+func (b fetchedBytes) add(o fetchedBytes) fetchedBytes {
+	return fetchedBytes{
+		onDemand:   b.onDemand + o.onDemand,
+		prefetch:   b.prefetch + o.prefetch,
+		background: b.background + o.background,
+	}
+}
+
+func (b fetchedBytes) sub(o fetchedBytes) fetchedBytes {
+	return fetchedBytes{
+		onDemand:   nonNegative(b.onDemand - o.onDemand),
+		prefetch:   nonNegative(b.prefetch - o.prefetch),
+		background: nonNegative(b.background - o.background),
+	}
+}
+
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// imageLayer is a layer mounted for an image.
+type imageLayer struct {
+	key imageKey
+	l   layer.Layer
+
+	// base is the bytes which had already been fetched for the layer when it
+	// was mounted. Layers can be shared among images so only bytes fetched
+	// after the mount are counted for the image.
+	base fetchedBytes
+}
+
+// AddImage records the image and the containerd namespace of the layer added
+// with Add. Bytes fetched for the layer from now on are reported per image.
+func (c *Controller) AddImage(key string, image, namespace string) {
+	c.layerMu.Lock()
+	defer c.layerMu.Unlock()
+	l, ok := c.layer[key]
+	if !ok {
+		return
+	}
+	c.imageLayer[key] = &imageLayer{
+		key:  imageKey{image: image, namespace: namespace},
+		l:    l,
+		base: fetchedBytesOf(l.Info()),
+	}
+}
+
+// retireImageLayer keeps the bytes fetched for the image by the layer being
+// removed so that the metric of the image doesn't decrease. layerMu must be held.
+func (c *Controller) retireImageLayer(key string) {
+	il, ok := c.imageLayer[key]
+	if !ok {
+		return
+	}
+	delete(c.imageLayer, key)
+	c.retiredImages[il.key] = c.retiredImages[il.key].add(il.fetched())
+}
+
+func (il *imageLayer) fetched() fetchedBytes {
+	return fetchedBytesOf(il.l.Info()).sub(il.base)
+}
+
+func imageFetchedBytesDesc(ns *metrics.Namespace) *prometheus.Desc {
+	return ns.NewDesc("image_fetched", "Total bytes fetched for layers of the image. Broken down by image, containerd namespace and type of the fetch (on_demand, prefetch or background)", metrics.Bytes, "image", "namespace", "type")
+}
+
+func imageSizeDesc(ns *metrics.Namespace) *prometheus.Desc {
+	return ns.NewDesc("image_size", "Total size of the layers of the image currently mounted. Broken down by image and containerd namespace", metrics.Bytes, "image", "namespace")
+}
+
+func imageCacheHitRatioDesc(ns *metrics.Namespace) *prometheus.Desc {
+	return ns.NewDesc("image_cache_hit_ratio", "Ratio of bytes read from files of the image served from the cache in the last 5 minutes. Broken down by image and containerd namespace", "", "image", "namespace")
+}
+
+// RecordRead records a read of a file in a layer of the image. outcome is where the
+// contents are read from (e.g. commonmetrics.FuseOutcomeDisk).
+func (c *Controller) RecordRead(image, namespace, outcome string, size int64) {
+	var hit bool
+	switch outcome {
+	case commonmetrics.FuseOutcomeMemory, commonmetrics.FuseOutcomeDisk:
+		hit = true
+	case commonmetrics.FuseOutcomeNetwork:
+	default:
+		return // the source of the contents is unknown
+	}
+	key := imageKey{image: image, namespace: namespace}
+	c.imageReadsMu.Lock()
+	defer c.imageReadsMu.Unlock()
+	w, ok := c.imageReads[key]
+	if !ok {
+		w = &hitWindow{}
+		c.imageReads[key] = w
+	}
+	w.add(hitWindowBucketOf(c.now()), hit, size)
+}
+
+// ImageStats returns the statistics of the images whose layers have been mounted.
+func (c *Controller) ImageStats() []ImageStats {
+	c.layerMu.RLock()
+	stats := c.imageStats()
+	c.layerMu.RUnlock()
+	res := make([]ImageStats, 0, len(stats))
+	for _, st := range stats {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		return res[i].Image < res[j].Image
+	})
+	return res
+}
+
+// imageStats returns the statistics of each image. layerMu must be held.
+func (c *Controller) imageStats() map[imageKey]*ImageStats {
+	stats := make(map[imageKey]*ImageStats)
+	get := func(k imageKey) *ImageStats {
+		st, ok := stats[k]
+		if !ok {
+			st = &ImageStats{Image: k.image, Namespace: k.namespace}
+			stats[k] = st
+		}
+		return st
+	}
+	addFetched := func(st *ImageStats, b fetchedBytes) {
+		st.OnDemandBytes += b.onDemand
+		st.PrefetchBytes += b.prefetch
+		st.BackgroundBytes += b.background
+	}
+	for k, b := range c.retiredImages {
+		addFetched(get(k), b)
+	}
+	mounted := make(map[imageKey]map[string]struct{}) // digests of the mounted layers
+	for _, il := range c.imageLayer {
+		st := get(il.key)
+		addFetched(st, il.fetched())
+		info := il.l.Info()
+		if mounted[il.key] == nil {
+			mounted[il.key] = make(map[string]struct{})
+		}
+		// The same layer can be mounted for the image at multiple mountpoints.
+		if _, ok := mounted[il.key][info.Digest.String()]; !ok {
+			mounted[il.key][info.Digest.String()] = struct{}{}
+			st.Size += info.Size
+		}
+	}
+
+	now := hitWindowBucketOf(c.now())
+	c.imageReadsMu.Lock()
+	defer c.imageReadsMu.Unlock()
+	for k, w := range c.imageReads {
+		r := w.sum(now)
+		if r.hit+r.miss == 0 {
+			if _, ok := mounted[k]; !ok {
+				delete(c.imageReads, k) // no longer read
+			}
+			continue
+		}
+		st := get(k)
+		st.CacheHitBytes, st.CacheMissBytes = r.hit, r.miss
+		ratio := float64(r.hit) / float64(r.hit+r.miss)
+		st.CacheHitRatio = &ratio
+	}
+	return stats
+}
+
+// collectImages reports the statistics per image. layerMu must be held.
+func (c *Controller) collectImages(ch chan<- prometheus.Metric) {
+	var (
+		fetchedDesc = imageFetchedBytesDesc(c.ns)
+		sizeDesc    = imageSizeDesc(c.ns)
+		ratioDesc   = imageCacheHitRatioDesc(c.ns)
+	)
+	for k, st := range c.imageStats() {
+		for typ, v := range map[string]int64{
+			onDemandFetch:   st.OnDemandBytes,
+			prefetchFetch:   st.PrefetchBytes,
+			backgroundFetch: st.BackgroundBytes,
+		} {
+			ch <- prometheus.MustNewConstMetric(fetchedDesc, prometheus.CounterValue, float64(v), k.image, k.namespace, typ)
+		}
+		ch <- prometheus.MustNewConstMetric(sizeDesc, prometheus.GaugeValue, float64(st.Size), k.image, k.namespace)
+		if st.CacheHitRatio != nil {
+			ch <- prometheus.MustNewConstMetric(ratioDesc, prometheus.GaugeValue, *st.CacheHitRatio, k.image, k.namespace)
+		}
+	}
+}
+
+// readBytes is the bytes read from the cache (hit) and from the registry (miss).
+type readBytes struct {
+	hit  int64
+	miss int64
+}
+
+// hitWindow is the bytes read in the last HitRatioWindow. The window consists of
+// buckets indexed by hitWindowBucketOf.
+type hitWindow struct {
+	buckets [hitWindowBuckets]readBytes
+	last    int64 // the bucket of the last record
+}
+
+func hitWindowBucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(HitRatioWindow/hitWindowBuckets)
+}
+
+// advance drops the reads out of the window ending at the bucket.
+func (w *hitWindow) advance(bucket int64) {
+	if bucket <= w.last {
+		return
+	}
+	n := bucket - w.last
+	if n > hitWindowBuckets {
+		n = hitWindowBuckets
+	}
+	for i := int64(1); i <= n; i++ {
+		w.buckets[(w.last+i)%hitWindowBuckets] = readBytes{}
+	}
+	w.last = bucket
+}
+
+func (w *hitWindow) add(bucket int64, hit bool, size int64) {
+	w.advance(bucket)
+	b := &w.buckets[w.last%hitWindowBuckets]
+	if hit {
+		b.hit += size
+	} else {
+		b.miss += size
+	}
+}
+
+func (w *hitWindow) sum(bucket int64) (r readBytes) {
+	w.advance(bucket)
+	for _, b := range w.buckets {
+		r.hit += b.hit
+		r.miss += b.miss
+	}
+	return r
+}
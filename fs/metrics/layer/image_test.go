@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testLayer struct {
+	layer.Layer
+	info layer.Info
+}
+
+func (l *testLayer) Info() layer.Info { return l.info }
+
+func TestImageStats(t *testing.T) {
+	c := NewLayerMetrics(nil)
+	now := time.Unix(1000000, 0)
+	c.now = func() time.Time { return now }
+
+	l1 := &testLayer{info: layer.Info{Digest: digest.FromString("l1"), Size: 100, FetchedSize: 10}}
+	l2 := &testLayer{info: layer.Info{Digest: digest.FromString("l2"), Size: 200}}
+	c.Add("/mnt/1", l1)
+	c.AddImage("/mnt/1", "example.com/a:1", "default")
+	c.Add("/mnt/2", l2)
+	c.AddImage("/mnt/2", "example.com/a:1", "default")
+
+	// Bytes fetched before the mount aren't counted
+	l1.info.FetchedSize, l1.info.BackgroundFetchedSize = 60, 30
+	c.Add("/mnt/3", l1) // the same layer mounted twice for the image
+	c.AddImage("/mnt/3", "example.com/a:1", "default")
+	c.RecordRead("example.com/a:1", "default", commonmetrics.FuseOutcomeDisk, 30)
+	c.RecordRead("example.com/a:1", "default", commonmetrics.FuseOutcomeMemory, 30)
+	c.RecordRead("example.com/a:1", "default", commonmetrics.FuseOutcomeNetwork, 20)
+	c.RecordRead("example.com/a:1", "default", commonmetrics.FuseOutcomeUnknown, 100)
+
+	stats := c.ImageStats()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	st := stats[0]
+	if st.Size != 300 {
+		t.Errorf("size must be 300; got %d", st.Size)
+	}
+	if st.OnDemandBytes != 20 || st.BackgroundBytes != 30 {
+		t.Errorf("unexpected fetched bytes %+v", st)
+	}
+	if st.CacheHitBytes != 60 || st.CacheMissBytes != 20 || st.CacheHitRatio == nil || *st.CacheHitRatio != 0.75 {
+		t.Errorf("unexpected cache hits %+v", st)
+	}
+
+	// The window slides
+	now = now.Add(HitRatioWindow / 2)
+	c.RecordRead("example.com/a:1", "default", commonmetrics.FuseOutcomeNetwork, 60)
+	now = now.Add(HitRatioWindow/2 + time.Second)
+	if st := c.ImageStats()[0]; st.CacheHitBytes != 0 || st.CacheMissBytes != 60 || *st.CacheHitRatio != 0 {
+		t.Errorf("old reads must be dropped from the window; got %+v", st)
+	}
+	now = now.Add(HitRatioWindow)
+	if st := c.ImageStats()[0]; st.CacheHitRatio != nil {
+		t.Errorf("ratio must be nil without reads in the window; got %v", *st.CacheHitRatio)
+	}
+
+	// Fetched bytes remain after the unmount
+	c.Remove("/mnt/1")
+	c.Remove("/mnt/2")
+	c.Remove("/mnt/3")
+	if st := c.ImageStats()[0]; st.Size != 0 || st.OnDemandBytes != 20 || st.BackgroundBytes != 30 {
+		t.Errorf("unexpected stats after unmount %+v", st)
+	}
+}
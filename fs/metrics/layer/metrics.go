@@ -18,22 +18,28 @@ package layermetrics
 
 import (
 	"sync"
+	"time"
 
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	metrics "github.com/docker/go-metrics"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// NewLayerMetrics returns a controller of the metrics of layers. The metrics are
+// exported to ns but layers are tracked for ImageStats even if ns is nil.
 func NewLayerMetrics(ns *metrics.Namespace) *Controller {
-	if ns == nil {
-		return &Controller{}
-	}
 	c := &Controller{
-		ns:    ns,
-		layer: make(map[string]layer.Layer),
+		ns:            ns,
+		layer:         make(map[string]layer.Layer),
+		imageLayer:    make(map[string]*imageLayer),
+		retiredImages: make(map[imageKey]fetchedBytes),
+		imageReads:    make(map[imageKey]*hitWindow),
+		now:           time.Now,
+	}
+	if ns != nil {
+		c.metrics = append(c.metrics, layerMetrics...)
+		ns.Add(c)
 	}
-	c.metrics = append(c.metrics, layerMetrics...)
-	ns.Add(c)
 	return c
 }
 
@@ -43,12 +49,27 @@ type Controller struct {
 
 	layer   map[string]layer.Layer
 	layerMu sync.RWMutex
+
+	// imageLayer is the image (and containerd namespace) of each mounted layer.
+	// retiredImages holds bytes fetched for images by layers which have been
+	// unmounted. Both are guarded by layerMu.
+	imageLayer    map[string]*imageLayer
+	retiredImages map[imageKey]fetchedBytes
+
+	// imageReads is the bytes read from the layers of each image in the recent
+	// window, broken down by whether they hit the cache.
+	imageReads   map[imageKey]*hitWindow
+	imageReadsMu sync.Mutex
+	now          func() time.Time
 }
 
 func (c *Controller) Describe(ch chan<- *prometheus.Desc) {
 	for _, e := range c.metrics {
 		ch <- e.desc(c.ns)
 	}
+	ch <- imageFetchedBytesDesc(c.ns)
+	ch <- imageSizeDesc(c.ns)
+	ch <- imageCacheHitRatioDesc(c.ns)
 }
 
 func (c *Controller) Collect(ch chan<- prometheus.Metric) {
@@ -64,25 +85,21 @@ func (c *Controller) Collect(ch chan<- prometheus.Metric) {
 			}
 		}()
 	}
+	c.collectImages(ch)
 	c.layerMu.RUnlock()
 	wg.Wait()
 }
 
 func (c *Controller) Add(key string, l layer.Layer) {
-	if c.ns == nil {
-		return
-	}
 	c.layerMu.Lock()
 	c.layer[key] = l
 	c.layerMu.Unlock()
 }
 
 func (c *Controller) Remove(key string) {
-	if c.ns == nil {
-		return
-	}
 	c.layerMu.Lock()
 	delete(c.layer, key)
+	c.retireImageLayer(key)
 	c.layerMu.Unlock()
 }
 
@@ -0,0 +1,88 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+// NamespaceConfig overrides the configuration of the filesystem for snapshots of a
+// containerd namespace. Unset fields follow the configuration of the filesystem.
+type NamespaceConfig struct {
+	// GetSources gets the sources of layers (e.g. with the registry hosts of the
+	// namespace).
+	GetSources source.GetSources
+
+	NoPrefetch        *bool
+	NoBackgroundFetch *bool
+
+	// CachePolicy is the types of the caches of layers mounted for the namespace.
+	CachePolicy layer.CachePolicy
+}
+
+// WithNamespaceConfigs overrides the configuration of the filesystem per containerd namespace.
+func WithNamespaceConfigs(cfgs map[string]NamespaceConfig) Option {
+	return func(opts *options) {
+		opts.namespaceConfigs = cfgs
+	}
+}
+
+// namespaceContext returns the context of the containerd namespace which lets the
+// resolver use the cache policy of the namespace. If the namespace has its own sources
+// (i.e. registry hosts and credentials), layers resolved for the namespace aren't
+// shared with other namespaces.
+func (fs *filesystem) namespaceContext(ctx context.Context, namespace string) context.Context {
+	ctx = namespaces.WithNamespace(ctx, namespace)
+	cfg := fs.namespaceConfigs[namespace]
+	if p := cfg.CachePolicy; p != (layer.CachePolicy{}) {
+		ctx = layer.WithCachePolicy(ctx, p)
+	}
+	if cfg.GetSources != nil {
+		ctx = layer.WithResolveScope(ctx, "namespace/"+namespace)
+	}
+	return ctx
+}
+
+func (fs *filesystem) namespaceConfig(ctx context.Context) NamespaceConfig {
+	namespace, _ := namespaces.Namespace(ctx)
+	return fs.namespaceConfigs[namespace]
+}
+
+func (fs *filesystem) sources(ctx context.Context, labels map[string]string) ([]source.Source, error) {
+	if getSources := fs.namespaceConfig(ctx).GetSources; getSources != nil {
+		return getSources(labels)
+	}
+	return fs.getSources(labels)
+}
+
+func (fs *filesystem) noPrefetch(ctx context.Context) bool {
+	if b := fs.namespaceConfig(ctx).NoPrefetch; b != nil {
+		return *b
+	}
+	return fs.noprefetch
+}
+
+func (fs *filesystem) noBackgroundFetchOf(ctx context.Context) bool {
+	if b := fs.namespaceConfig(ctx).NoBackgroundFetch; b != nil {
+		return *b
+	}
+	return fs.noBackgroundFetch
+}
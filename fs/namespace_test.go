@@ -0,0 +1,72 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNamespaceConfig(t *testing.T) {
+	sourcesOf := func(name string) source.GetSources {
+		return func(map[string]string) ([]source.Source, error) {
+			return []source.Source{{Manifest: ocispec.Manifest{Annotations: map[string]string{"name": name}}}}, nil
+		}
+	}
+	fs := &filesystem{
+		getSources: sourcesOf("default"),
+		noprefetch: true,
+		namespaceConfigs: map[string]NamespaceConfig{
+			"sources":  {GetSources: sourcesOf("sources")},
+			"prefetch": {NoPrefetch: boolPtr(false)},
+		},
+	}
+	for _, tt := range []struct {
+		namespace      string
+		wantSources    string
+		wantNoPrefetch bool
+	}{
+		{namespace: "", wantSources: "default", wantNoPrefetch: true},
+		{namespace: "unknown", wantSources: "default", wantNoPrefetch: true},
+		{namespace: "sources", wantSources: "sources", wantNoPrefetch: true},
+		{namespace: "prefetch", wantSources: "default", wantNoPrefetch: false},
+	} {
+		t.Run(tt.namespace, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.namespace != "" {
+				ctx = fs.namespaceContext(ctx, tt.namespace)
+				if ns, _ := namespaces.Namespace(ctx); ns != tt.namespace {
+					t.Errorf("namespace = %q; want %q", ns, tt.namespace)
+				}
+			}
+			src, err := fs.sources(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := src[0].Manifest.Annotations["name"]; got != tt.wantSources {
+				t.Errorf("sources of %q are used; want %q", got, tt.wantSources)
+			}
+			if got := fs.noPrefetch(ctx); got != tt.wantNoPrefetch {
+				t.Errorf("noPrefetch = %v; want %v", got, tt.wantNoPrefetch)
+			}
+		})
+	}
+}
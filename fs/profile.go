@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/recorder"
+)
+
+const (
+	profileDirName = "profiles"
+
+	// criManifestDigestLabel is a label which contains the digest of the manifest
+	// passed by CRI plugin of containerd.
+	criManifestDigestLabel = "containerd.io/snapshot/cri.manifest-digest"
+)
+
+// profileRecorder records files read from the layers of an image while any of the
+// layers is in its record window and writes them as a file access profile, which is
+// newline-delimited JSON of recorder.Entry in the same format as the record file of
+// `ctr-remote image optimize --record-out`.
+type profileRecorder struct {
+	path           string
+	f              *os.File
+	r              *recorder.Recorder
+	manifestDigest string
+
+	recorded map[string]struct{} // layer index and path of recorded files
+	windows  int                 // number of layers in the record window
+	closed   bool
+	mu       sync.Mutex
+}
+
+// profilePath returns the path of the profile of the image.
+func profilePath(root, image string) string {
+	return filepath.Join(root, profileDirName, url.PathEscape(image)+".json")
+}
+
+// recordProfile starts recording files read from the layer to the profile of the
+// image during the window (e.g. "60s") and returns the node option to record them.
+func (fs *filesystem) recordProfile(image, windowStr string, labels map[string]string) (layer.NodeOption, error) {
+	window, err := time.ParseDuration(windowStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record window %q: %w", windowStr, err)
+	}
+	manifestDigest, ok := labels[config.TargetManifestDigestLabel]
+	if !ok {
+		manifestDigest = labels[criManifestDigestLabel]
+	}
+	layerIndex := -1
+	if s, ok := labels[config.TargetLayerIndexLabel]; ok {
+		if i, err := strconv.Atoi(s); err == nil {
+			layerIndex = i
+		}
+	}
+	r, err := fs.acquireProfileRecorder(image, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	time.AfterFunc(window, func() { fs.releaseProfileRecorder(image, r) })
+	return layer.WithFileReadHook(func(path string) { r.record(layerIndex, path) }), nil
+}
+
+// acquireProfileRecorder returns the recorder of the image and starts a record
+// window. The window must be ended by releaseProfileRecorder. The profile is
+// overwritten when a window starts while no layer of the image is recorded.
+func (fs *filesystem) acquireProfileRecorder(image, manifestDigest string) (*profileRecorder, error) {
+	fs.profilesMu.Lock()
+	defer fs.profilesMu.Unlock()
+	if r, ok := fs.profiles[image]; ok {
+		r.mu.Lock()
+		r.windows++
+		r.mu.Unlock()
+		return r, nil
+	}
+	p := profilePath(fs.root, image)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create profile: %w", err)
+	}
+	r := &profileRecorder{
+		path:           p,
+		f:              f,
+		r:              recorder.New(f),
+		manifestDigest: manifestDigest,
+		recorded:       make(map[string]struct{}),
+		windows:        1,
+	}
+	fs.profiles[image] = r
+	return r, nil
+}
+
+// releaseProfileRecorder ends a record window. The profile is completed when all
+// windows of the image end.
+func (fs *filesystem) releaseProfileRecorder(image string, r *profileRecorder) {
+	fs.profilesMu.Lock()
+	defer fs.profilesMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.windows--
+	if r.windows > 0 {
+		return
+	}
+	r.closed = true
+	delete(fs.profiles, image)
+	if err := r.f.Close(); err != nil {
+		log.L.WithError(err).Warnf("failed to write profile of %q", image)
+		return
+	}
+	log.L.WithField("image", image).Infof("recorded %d files to profile %q", len(r.recorded), r.path)
+}
+
+// record records the file read from the layer. layerIndex is the index of the layer
+// in the manifest or -1 if it's unknown.
+func (r *profileRecorder) record(layerIndex int, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	key := fmt.Sprintf("%d:%s", layerIndex, path)
+	if _, ok := r.recorded[key]; ok {
+		return
+	}
+	r.recorded[key] = struct{}{}
+	e := &recorder.Entry{Path: path}
+	if layerIndex >= 0 && r.manifestDigest != "" {
+		index := layerIndex
+		e.ManifestDigest, e.LayerIndex = r.manifestDigest, &index
+	}
+	if err := r.r.Record(e); err != nil {
+		log.L.WithError(err).Warnf("failed to record %q to profile %q", path, r.path)
+	}
+}
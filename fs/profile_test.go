@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/recorder"
+)
+
+func TestProfileRecorder(t *testing.T) {
+	const (
+		image          = "example.com/foo:latest"
+		manifestDigest = "sha256:75d2fd6b8d1b3c1dbc6fd8dd3b1c2b38e87a6d62bf1a1b3ab6e0d8e7cc1a3b66"
+	)
+	fs := &filesystem{
+		root:     t.TempDir(),
+		profiles: make(map[string]*profileRecorder),
+	}
+	r1, err := fs.acquireProfileRecorder(image, manifestDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := fs.acquireProfileRecorder(image, manifestDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1 != r2 {
+		t.Fatalf("layers of the same image must share the recorder")
+	}
+	r1.record(0, "bin/sh")
+	r2.record(1, "etc/passwd")
+	r1.record(0, "bin/sh") // duplicated
+	r1.record(-1, "lib/libc.so")
+	fs.releaseProfileRecorder(image, r1)
+	r2.record(1, "usr/bin/env") // r2 is still in the window
+	fs.releaseProfileRecorder(image, r2)
+	r2.record(1, "tmp/late") // after the window
+
+	f, err := os.Open(profilePath(fs.root, image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []recorder.Entry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e recorder.Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	index := func(i int) *int { return &i }
+	want := []recorder.Entry{
+		{Path: "bin/sh", ManifestDigest: manifestDigest, LayerIndex: index(0)},
+		{Path: "etc/passwd", ManifestDigest: manifestDigest, LayerIndex: index(1)},
+		{Path: "lib/libc.so"},
+		{Path: "usr/bin/env", ManifestDigest: manifestDigest, LayerIndex: index(1)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected profile %+v; want %+v", got, want)
+	}
+	if len(fs.profiles) != 0 {
+		t.Errorf("recorder must be released")
+	}
+}
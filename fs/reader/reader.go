@@ -23,8 +23,6 @@
 package reader
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
@@ -38,13 +36,20 @@ import (
 	"github.com/containerd/stargz-snapshotter/estargz"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/util/bufpool"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
-const maxWalkDepth = 10000
+const (
+	maxWalkDepth = 10000
+
+	// maxFileFds is the max number of cache files kept opened by a file for
+	// ReadAtFd.
+	maxFileFds = 16
+)
 
 type Reader interface {
 	OpenFile(id uint32) (io.ReaderAt, error)
@@ -81,6 +86,13 @@ func (vr *VerifiableReader) loadLastVerifyErr() error {
 	return err
 }
 
+// SetOnDemandFetchHook sets the function called with the size of each chunk
+// fetched on demand (i.e. not found in the cache) by the reader. This must be
+// called before the reader is used.
+func (vr *VerifiableReader) SetOnDemandFetchHook(f func(size int64)) {
+	vr.r.onDemandFetchHook = f
+}
+
 func (vr *VerifiableReader) SkipVerify() Reader {
 	return vr.r
 }
@@ -221,9 +233,12 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 					return r.Close()
 				}
 
-				// missed cache, needs to fetch and add it to the cache
-				br := bufio.NewReaderSize(io.NewSectionReader(fr, chunkOffset, chunkSize), int(chunkSize))
-				if _, err := br.Peek(int(chunkSize)); err != nil {
+				// missed cache, needs to fetch and add it to the cache.
+				// The chunk is decompressed into the buffer once and written to the
+				// verifier and the cache from it without further copies.
+				buf := bufpool.Get(int(chunkSize))
+				defer bufpool.Put(buf)
+				if _, err := io.ReadFull(io.NewSectionReader(fr, chunkOffset, chunkSize), *buf); err != nil {
 					return fmt.Errorf("cacheWithReader.peek: %v", err)
 				}
 				w, err := gr.cache.Add(cacheID, opts...)
@@ -241,12 +256,14 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 					vr.storeLastVerifyErr(err)
 					vr.prohibitVerifyFailureMu.RUnlock()
 				}
-				tee := io.Discard
 				if v != nil {
-					tee = io.Writer(v) // verification is required
+					v.Write(*buf) // verification is required
 				}
-				if _, err := io.CopyN(w, io.TeeReader(br, tee), chunkSize); err != nil {
+				if n, err := w.Write(*buf); err != nil || n != len(*buf) {
 					w.Abort()
+					if err == nil {
+						err = io.ErrShortWrite
+					}
 					return fmt.Errorf("failed to cache file payload of %q (offset:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
 				}
 				if v != nil && !v.Verified() {
@@ -293,13 +310,8 @@ func (vr *VerifiableReader) isClosed() bool {
 // to use for verifying file or chunk contained in this stargz blob.
 func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest) (*VerifiableReader, error) {
 	vr := &reader{
-		r:     r,
-		cache: cache,
-		bufPool: sync.Pool{
-			New: func() interface{} {
-				return new(bytes.Buffer)
-			},
-		},
+		r:        r,
+		cache:    cache,
 		layerSha: layerSha,
 		verifier: digestVerifier,
 	}
@@ -307,15 +319,16 @@ func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest)
 }
 
 type reader struct {
-	r       metadata.Reader
-	cache   cache.BlobCache
-	bufPool sync.Pool
+	r     metadata.Reader
+	cache cache.BlobCache
 
 	layerSha digest.Digest
 
 	lastReadTime   time.Time
 	lastReadTimeMu sync.Mutex
 
+	onDemandFetchHook func(size int64) // called with the size of each on-demand fetch; can be nil
+
 	closed   bool
 	closedMu sync.Mutex
 
@@ -327,10 +340,14 @@ func (gr *reader) Metadata() metadata.Reader {
 	return gr.r
 }
 
-func (gr *reader) setLastReadTime(lastReadTime time.Time) {
+// onDemandFetched records an on-demand fetch of the specified size.
+func (gr *reader) onDemandFetched(size int64) {
 	gr.lastReadTimeMu.Lock()
-	gr.lastReadTime = lastReadTime
+	gr.lastReadTime = time.Now()
 	gr.lastReadTimeMu.Unlock()
+	if gr.onDemandFetchHook != nil {
+		gr.onDemandFetchHook(size)
+	}
 }
 
 func (gr *reader) LastOnDemandReadTime() time.Time {
@@ -379,21 +396,96 @@ func (gr *reader) isClosed() bool {
 	return closed
 }
 
-func (gr *reader) putBuffer(b *bytes.Buffer) {
-	b.Reset()
-	gr.bufPool.Put(b)
-}
-
 type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+
+	fds    map[string]*os.File // cache files opened by ReadAtFd
+	closed bool
+	fdsMu  sync.Mutex
+}
+
+// ReadAtFd returns the file descriptor of the cache file where the region of
+// the file is stored and the offset of the region in that cache file. This lets
+// the caller pass the contents to the kernel without copying them (e.g. splice(2)).
+// ok is false unless the region is in a single chunk cached on disk. The
+// descriptor is valid until the file is closed.
+func (sf *file) ReadAtFd(size int, offset int64) (fd uintptr, fdOffset int64, n int, ok bool) {
+	fc, isFileCache := sf.gr.cache.(cache.FileCache)
+	if !isFileCache || sf.gr.isClosed() {
+		return 0, 0, 0, false
+	}
+	chunkOffset, chunkSize, _, found := sf.fr.ChunkEntryForOffset(offset)
+	if !found {
+		return 0, 0, 0, false
+	}
+	lowerDiscard := offset - chunkOffset
+	n = size
+	if lowerDiscard+int64(size) > chunkSize {
+		if _, _, _, hasNext := sf.fr.ChunkEntryForOffset(chunkOffset + chunkSize); hasNext {
+			return 0, 0, 0, false // requires multiple chunks
+		}
+		n = int(chunkSize - lowerDiscard) // the last chunk of the file
+	}
+
+	id := genID(sf.id, chunkOffset, chunkSize)
+	sf.fdsMu.Lock()
+	defer sf.fdsMu.Unlock()
+	if sf.closed {
+		return 0, 0, 0, false
+	}
+	f, cached := sf.fds[id]
+	if !cached {
+		if len(sf.fds) >= maxFileFds {
+			return 0, 0, 0, false
+		}
+		var err error
+		f, err = fc.OpenFile(id)
+		if err != nil {
+			return 0, 0, 0, false // not on disk (yet)
+		}
+		if fi, err := f.Stat(); err != nil || fi.Size() != chunkSize {
+			f.Close()
+			return 0, 0, 0, false
+		}
+		if sf.fds == nil {
+			sf.fds = make(map[string]*os.File)
+		}
+		sf.fds[id] = f
+	}
+	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(n)) // measure the number of on demand bytes served
+	return f.Fd(), lowerDiscard, n, true
+}
+
+// Close closes the cache files opened by ReadAtFd.
+func (sf *file) Close() error {
+	sf.fdsMu.Lock()
+	defer sf.fdsMu.Unlock()
+	sf.closed = true
+	var errs error
+	for id, f := range sf.fds {
+		if err := f.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		delete(sf.fds, id)
+	}
+	return errs
 }
 
 // ReadAt reads chunks from the stargz file with trying to fetch as many chunks
 // as possible from the cache.
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	n, _, err := sf.ReadAtWithOutcome(p, offset)
+	return n, err
+}
+
+// ReadAtWithOutcome is the same as ReadAt but also returns where the contents are
+// read from (commonmetrics.FuseOutcomeMemory, FuseOutcomeDisk or FuseOutcomeNetwork).
+// If chunks are read from several places, the slowest one is returned.
+func (sf *file) ReadAtWithOutcome(p []byte, offset int64) (int, string, error) {
 	nr := 0
+	outcome := commonmetrics.FuseOutcomeMetadata // nothing is read
 	for nr < len(p) {
 		chunkOffset, chunkSize, chunkDigestStr, ok := sf.fr.ChunkEntryForOffset(offset + int64(nr))
 		if !ok {
@@ -411,6 +503,11 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			n, err := r.ReadAt(p[nr:int64(nr)+expectedSize], lowerDiscard)
 			if (err == nil || err == io.EOF) && int64(n) == expectedSize {
 				nr += n
+				if cache.OnMemory(r) {
+					outcome = slowerOutcome(outcome, commonmetrics.FuseOutcomeMemory)
+				} else {
+					outcome = slowerOutcome(outcome, commonmetrics.FuseOutcomeDisk)
+				}
 				r.Close()
 				continue
 			}
@@ -425,16 +522,17 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			ip := p[nr : int64(nr)+chunkSize]
 			n, err := sf.fr.ReadAt(ip, chunkOffset)
 			if err != nil && err != io.EOF {
-				return 0, fmt.Errorf("failed to read data: %w", err)
+				return 0, "", fmt.Errorf("failed to read data: %w", err)
 			}
+			outcome = commonmetrics.FuseOutcomeNetwork
 
 			commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
 			commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(n))       // record total bytes fetched
-			sf.gr.setLastReadTime(time.Now())
+			sf.gr.onDemandFetched(int64(n))
 
 			// Verify this chunk
 			if err := sf.verify(sf.id, ip, chunkDigestStr); err != nil {
-				return 0, fmt.Errorf("invalid chunk: %w", err)
+				return 0, "", fmt.Errorf("invalid chunk: %w", err)
 			}
 
 			// Cache this chunk
@@ -451,24 +549,23 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		}
 
 		// Use temporally buffer for aligning this chunk
-		b := sf.gr.bufPool.Get().(*bytes.Buffer)
-		b.Reset()
-		b.Grow(int(chunkSize))
-		ip := b.Bytes()[:chunkSize]
+		b := bufpool.Get(int(chunkSize))
+		ip := *b
 		if _, err := sf.fr.ReadAt(ip, chunkOffset); err != nil && err != io.EOF {
-			sf.gr.putBuffer(b)
-			return 0, fmt.Errorf("failed to read data: %w", err)
+			bufpool.Put(b)
+			return 0, "", fmt.Errorf("failed to read data: %w", err)
 		}
+		outcome = commonmetrics.FuseOutcomeNetwork
 
 		// We can end up doing on demand registry fetch when aligning the chunk
 		commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
 		commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(len(ip))) // record total bytes fetched
-		sf.gr.setLastReadTime(time.Now())
+		sf.gr.onDemandFetched(int64(len(ip)))
 
 		// Verify this chunk
 		if err := sf.verify(sf.id, ip, chunkDigestStr); err != nil {
-			sf.gr.putBuffer(b)
-			return 0, fmt.Errorf("invalid chunk: %w", err)
+			bufpool.Put(b)
+			return 0, "", fmt.Errorf("invalid chunk: %w", err)
 		}
 
 		// Cache this chunk
@@ -481,16 +578,35 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			w.Close()
 		}
 		n := copy(p[nr:], ip[lowerDiscard:chunkSize-upperDiscard])
-		sf.gr.putBuffer(b)
+		bufpool.Put(b)
 		if int64(n) != expectedSize {
-			return 0, fmt.Errorf("unexpected final data size %d; want %d", n, expectedSize)
+			return 0, "", fmt.Errorf("unexpected final data size %d; want %d", n, expectedSize)
 		}
 		nr += n
 	}
 
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(nr)) // measure the number of on demand bytes served
 
-	return nr, nil
+	return nr, outcome, nil
+}
+
+// slowerOutcome returns the slower one of the outcomes of reads.
+func slowerOutcome(a, b string) string {
+	rank := func(o string) int {
+		switch o {
+		case commonmetrics.FuseOutcomeMemory:
+			return 1
+		case commonmetrics.FuseOutcomeDisk:
+			return 2
+		case commonmetrics.FuseOutcomeNetwork:
+			return 3
+		}
+		return 0
+	}
+	if rank(a) < rank(b) {
+		return b
+	}
+	return a
 }
 
 func (sf *file) verify(id uint32, p []byte, chunkDigestStr string) error {
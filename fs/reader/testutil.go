@@ -30,6 +30,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -54,6 +55,123 @@ func TestSuiteReader(t *testing.T, store metadata.Store) {
 	testFileReadAt(t, store)
 	testCacheVerify(t, store)
 	testFailReader(t, store)
+	testReadAtFd(t, store)
+	testCacheHardlinks(t, store)
+}
+
+// testCacheHardlinks checks that the contents shared among hardlinks are fetched from
+// the blob only once regardless of the number of the link names.
+func testCacheHardlinks(t *testing.T, factory metadata.Store) {
+	data := strings.Repeat(sampleData1, 1000)
+	open := func(ents ...testutil.TarEntry) (*VerifiableReader, *countingReaderAt) {
+		sr, tocDgst, err := testutil.BuildEStargz(ents, testutil.WithEStargzOptions(estargz.WithChunkSize(1000)))
+		if err != nil {
+			t.Fatalf("failed to build sample estargz")
+		}
+		cr := &countingReaderAt{r: sr}
+		mr, err := factory(io.NewSectionReader(cr, 0, sr.Size()))
+		if err != nil {
+			t.Fatalf("failed to prepare metadata reader: %v", err)
+		}
+		t.Cleanup(func() { mr.Close() })
+		vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+		if err != nil {
+			t.Fatalf("failed to make new reader: %v", err)
+		}
+		t.Cleanup(func() { vr.Close() })
+		if _, err := vr.VerifyTOC(tocDgst); err != nil {
+			t.Fatalf("failed to verify TOC: %v", err)
+		}
+		cr.reset()
+		return vr, cr
+	}
+	cached := func(ents ...testutil.TarEntry) int64 {
+		vr, cr := open(ents...)
+		if err := vr.Cache(); err != nil {
+			t.Fatalf("failed to cache: %v", err)
+		}
+		return cr.fetched()
+	}
+	readFile := func(vr *VerifiableReader, name string, numLink int) {
+		r := vr.r
+		id := r.r.RootID()
+		for _, base := range strings.Split(name, "/") {
+			var err error
+			if id, _, err = r.r.GetChild(id, base); err != nil {
+				t.Fatalf("failed to lookup %q: %v", name, err)
+			}
+		}
+		if attr, err := r.r.GetAttr(id); err != nil || attr.NumLink != numLink {
+			t.Errorf("%q must have %d links; got %+v: %v", name, numLink, attr, err)
+		}
+		fr, err := r.OpenFile(id)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		b := make([]byte, len(data))
+		if _, err := fr.ReadAt(b, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		} else if string(b) != data {
+			t.Errorf("unexpected contents of %q: %q", name, string(b))
+		}
+	}
+	linked := []testutil.TarEntry{
+		testutil.File("a", data),
+		testutil.Dir("dir/"),
+		testutil.Link("dir/b", "a"),
+		testutil.Link("c", "a"),
+	}
+
+	// Background fetch fetches the contents shared among hardlinks once.
+	single := cached(testutil.File("a", data), testutil.Dir("dir/"))
+	copies := cached(testutil.File("a", data), testutil.Dir("dir/"),
+		testutil.File("dir/b", data), testutil.File("c", data))
+	links := cached(linked...)
+	// Each copy fetches its own contents. The hardlinks must not fetch even one more copy
+	// (some more bytes are read around the entries of the link names).
+	if perCopy := (copies - single) / 2; links-single >= perCopy/2 {
+		t.Errorf("hardlinks fetched %d bytes more than the single file; each copy fetches %d bytes", links-single, perCopy)
+	}
+
+	// On-demand reads through other link names are served from the cache.
+	vr, cr := open(linked...)
+	readFile(vr, "c", 3)
+	if cr.fetched() == 0 {
+		t.Fatalf("contents must be fetched on the first read")
+	}
+	cr.reset()
+	readFile(vr, "dir/b", 3)
+	readFile(vr, "a", 3)
+	if n := cr.fetched(); n != 0 {
+		t.Errorf("contents of hardlinks must be fetched once; fetched %d bytes again", n)
+	}
+}
+
+// countingReaderAt counts the bytes read from the underlying reader.
+type countingReaderAt struct {
+	r  io.ReaderAt
+	n  int64
+	mu sync.Mutex
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.mu.Lock()
+	r.n += int64(n)
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *countingReaderAt) fetched() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+func (r *countingReaderAt) reset() {
+	r.mu.Lock()
+	r.n = 0
+	r.mu.Unlock()
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -207,6 +325,10 @@ func (er *exceptFile) ChunkEntryForOffset(offset int64) (off int64, size int64,
 }
 
 func makeFile(t *testing.T, contents []byte, chunkSize int, factory metadata.Store) (*file, func() error) {
+	return makeFileWithCache(t, contents, chunkSize, factory, cache.NewMemoryCache())
+}
+
+func makeFileWithCache(t *testing.T, contents []byte, chunkSize int, factory metadata.Store, c cache.BlobCache) (*file, func() error) {
 	testName := "test"
 	sr, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
 		testutil.File(testName, string(contents)),
@@ -218,7 +340,7 @@ func makeFile(t *testing.T, contents []byte, chunkSize int, factory metadata.Sto
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+	vr, err := NewReader(mr, c, digest.FromString(""))
 	if err != nil {
 		mr.Close()
 		t.Fatalf("failed to make new reader: %v", err)
@@ -246,6 +368,55 @@ func makeFile(t *testing.T, contents []byte, chunkSize int, factory metadata.Sto
 	return f, vr.Close
 }
 
+func testReadAtFd(t *testing.T, factory metadata.Store) {
+	contents := []byte("0123456789")
+	c, err := cache.NewDirectoryCache(t.TempDir(), cache.DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	f, closeFn := makeFileWithCache(t, contents, 4, factory, c)
+	defer closeFn()
+	if _, _, _, ok := f.ReadAtFd(2, 1); ok {
+		t.Fatalf("uncached region must not be read from the cache file")
+	}
+	if _, err := f.ReadAt(make([]byte, len(contents)), 0); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	for _, tt := range []struct {
+		size   int
+		offset int64
+		want   string // empty if the region can't be read from a cache file
+	}{
+		{size: 2, offset: 1, want: "12"},
+		{size: 4, offset: 4, want: "4567"},
+		{size: 4, offset: 2},
+		{size: 10, offset: 8, want: "89"},
+	} {
+		fd, fdOffset, n, ok := f.ReadAtFd(tt.size, tt.offset)
+		if !ok {
+			if tt.want != "" {
+				t.Errorf("failed to read (size=%d,offset=%d) from the cache file", tt.size, tt.offset)
+			}
+			continue
+		} else if tt.want == "" {
+			t.Errorf("(size=%d,offset=%d) must not be read from a cache file", tt.size, tt.offset)
+			continue
+		}
+		p := make([]byte, n)
+		if _, err := syscall.Pread(int(fd), p, fdOffset); err != nil {
+			t.Errorf("failed to read the cache file: %v", err)
+		} else if string(p) != tt.want {
+			t.Errorf("read %q from (size=%d,offset=%d); want %q", string(p), tt.size, tt.offset, tt.want)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file: %v", err)
+	}
+	if _, _, _, ok := f.ReadAtFd(2, 1); ok {
+		t.Errorf("closed file must not be read from the cache file")
+	}
+}
+
 func testCacheVerify(t *testing.T, factory metadata.Store) {
 	sr, tocDgst, err := testutil.BuildEStargz([]testutil.TarEntry{
 		testutil.File("a", sampleData1+"a"),
@@ -32,9 +32,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/bufpool"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
@@ -42,13 +44,18 @@ import (
 
 var contentRangeRegexp = regexp.MustCompile(`bytes ([0-9]+)-([0-9]+)/([0-9]+|\\*)`)
 
+// copyBufferSize is the size of the buffer for copying the fetched chunks.
+const copyBufferSize = 32 * 1024
+
 type Blob interface {
 	Check() error
 	Size() int64
 	FetchedSize() int64
+	BackgroundFetchedSize() int64
 	ReadAt(p []byte, offset int64, opts ...Option) (int, error)
 	Cache(offset int64, size int64, opts ...Option) error
 	Refresh(ctx context.Context, host source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
+	FailOver() bool
 	Close() error
 }
 
@@ -67,9 +74,18 @@ type blob struct {
 
 	fetchedRegionSet    regionSet
 	fetchedRegionSetMu  sync.Mutex
+	backgroundFetched   int64 // size of chunks fetched in background; guarded by fetchedRegionSetMu
 	fetchedRegionGroup  singleflight.Group
 	fetchedRegionCopyMu sync.Mutex
 
+	// maxParallelFetches is the max number of parallel requests for fetching
+	// non-contiguous regions at once.
+	maxParallelFetches int
+
+	// coalesceGap is the max size of gaps between regions fetched with a single
+	// range.
+	coalesceGap int64
+
 	resolver *Resolver
 
 	closed   bool
@@ -78,17 +94,19 @@ type blob struct {
 
 func makeBlob(fetcher fetcher, size int64, chunkSize int64, prefetchChunkSize int64,
 	blobCache cache.BlobCache, lastCheck time.Time, checkInterval time.Duration,
-	r *Resolver, fetchTimeout time.Duration) *blob {
+	r *Resolver, fetchTimeout time.Duration, maxParallelFetches int, coalesceGap int64) *blob {
 	return &blob{
-		fetcher:           fetcher,
-		size:              size,
-		chunkSize:         chunkSize,
-		prefetchChunkSize: prefetchChunkSize,
-		cache:             blobCache,
-		lastCheck:         lastCheck,
-		checkInterval:     checkInterval,
-		resolver:          r,
-		fetchTimeout:      fetchTimeout,
+		fetcher:            fetcher,
+		size:               size,
+		chunkSize:          chunkSize,
+		prefetchChunkSize:  prefetchChunkSize,
+		cache:              blobCache,
+		lastCheck:          lastCheck,
+		checkInterval:      checkInterval,
+		resolver:           r,
+		fetchTimeout:       fetchTimeout,
+		maxParallelFetches: maxParallelFetches,
+		coalesceGap:        coalesceGap,
 	}
 }
 
@@ -99,7 +117,13 @@ func (b *blob) Close() error {
 		return nil
 	}
 	b.closed = true
-	return b.cache.Close()
+	b.fetcherMu.Lock()
+	fErr := closeFetcher(b.fetcher)
+	b.fetcherMu.Unlock()
+	if err := b.cache.Close(); err != nil {
+		return err
+	}
+	return fErr
 }
 
 func (b *blob) isClosed() bool {
@@ -125,8 +149,12 @@ func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec
 
 	// update the blob's fetcher with new one
 	b.fetcherMu.Lock()
+	old := b.fetcher
 	b.fetcher = f
 	b.fetcherMu.Unlock()
+	if err := closeFetcher(old); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to close old fetcher")
+	}
 	b.lastCheckMu.Lock()
 	b.lastCheck = time.Now()
 	b.lastCheckMu.Unlock()
@@ -134,6 +162,19 @@ func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec
 	return nil
 }
 
+// FailOver aborts on-demand fetches in flight so that these are retried on the other
+// hosts (mirrors or the registry) serving the blob. Fetches which already started
+// receiving contents fail. false is returned if the blob can't fail over.
+func (b *blob) FailOver() bool {
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+	if f, ok := fr.(interface{ failOver() bool }); ok {
+		return f.failOver()
+	}
+	return false
+}
+
 func (b *blob) Check() error {
 	if b.isClosed() {
 		return fmt.Errorf("blob is already closed")
@@ -173,6 +214,14 @@ func (b *blob) FetchedSize() int64 {
 	return sz
 }
 
+// BackgroundFetchedSize returns the size of chunks fetched with WithBackgroundFetch.
+func (b *blob) BackgroundFetchedSize() int64 {
+	b.fetchedRegionSetMu.Lock()
+	sz := b.backgroundFetched
+	b.fetchedRegionSetMu.Unlock()
+	return sz
+}
+
 func makeSyncKey(allData map[region]io.Writer) string {
 	keys := make([]string, len(allData))
 	keysIndex := 0
@@ -331,8 +380,99 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 	if opts.ctx != nil {
 		fetchCtx = opts.ctx
 	}
-	mr, err := fr.fetch(fetchCtx, req, true)
+	if opts.background {
+		fetchCtx = withBackgroundFetch(fetchCtx)
+	}
+
+	// Non-contiguous regions can be fetched with parallel requests.
+	var (
+		eg        errgroup.Group
+		fetchedMu sync.Mutex
+	)
+	cached := func(chunk region) bool {
+		r, err := b.cache.Get(fr.genID(chunk), opts.cacheOpts...)
+		if err != nil {
+			return false
+		}
+		r.Close()
+		return true
+	}
+	for _, chunks := range b.splitRequests(req, cached) {
+		chunks := chunks
+		eg.Go(func() error {
+			return b.fetchChunks(fetchCtx, fr, chunks, allData, fetched, &fetchedMu, opts)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// Check all chunks are fetched
+	var unfetched []region
+	for c, b := range fetched {
+		if !b {
+			unfetched = append(unfetched, c)
+		}
+	}
+	if unfetched != nil {
+		return fmt.Errorf("failed to fetch region %v", unfetched)
+	}
+
+	return nil
+}
+
+// splitRequests splits the chunks into requests fetched in parallel. Contiguous
+// chunks are kept in the same request and at most maxParallelFetches requests
+// are made. Chunks separated by gaps not larger than coalesceGap are fetched as
+// a single range together with the gaps (which are also cached). Gaps are split
+// into chunks and ones already in the cache aren't fetched again.
+func (b *blob) splitRequests(chunks []region, cached func(region) bool) [][]region {
+	if len(chunks) <= 1 {
+		return [][]region{chunks}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].b < chunks[j].b })
+	var runs [][]region
+	for i, c := range chunks {
+		if i == 0 || c.b-chunks[i-1].e-1 > b.coalesceGap {
+			runs = append(runs, nil)
+		} else if prev := chunks[i-1]; c.b > prev.e+1 {
+			// The gap is aligned by chunk size as it's between chunks.
+			b.walkChunks(region{prev.e + 1, c.b - 1}, func(gc region) error {
+				if !cached(gc) {
+					runs[len(runs)-1] = append(runs[len(runs)-1], gc)
+				}
+				return nil
+			})
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], c)
+	}
+	n := b.maxParallelFetches
+	if n < 1 {
+		n = 1
+	}
+	if len(runs) < n {
+		n = len(runs)
+	}
+	// Neighboring runs are put in the same request so that the request stays
+	// small even in the single range mode.
+	reqs := make([][]region, n)
+	for i, r := range runs {
+		g := i * n / len(runs)
+		reqs[g] = append(reqs[g], r...)
+	}
+	return reqs
+}
 
+// fetchChunks fetches the regions with a request and puts them in the local cache.
+// Target chunks are written to allData as well.
+func (b *blob) fetchChunks(ctx context.Context, fr fetcher, chunks []region, allData map[region]io.Writer, fetched map[region]bool, fetchedMu *sync.Mutex, opts *options) error {
+	targets := make(map[region]struct{}, len(chunks))
+	for _, c := range chunks {
+		if _, ok := allData[c]; ok {
+			targets[c] = struct{}{} // not a coalesced gap
+		}
+	}
+	mr, err := fr.fetch(ctx, chunks, true)
 	if err != nil {
 		return err
 	}
@@ -343,6 +483,9 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 	b.lastCheck = time.Now()
 	b.lastCheckMu.Unlock()
 
+	buf := bufpool.Get(copyBufferSize)
+	defer bufpool.Put(buf)
+
 	// chunk and cache responsed data. Regions must be aligned by chunk size.
 	// TODO: Reorganize remoteData to make it be aligned by chunk size
 	for {
@@ -363,14 +506,17 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 
 			// If this chunk is one of the targets, write the content to the
 			// passed reader too.
-			if _, ok := fetched[chunk]; ok {
+			if _, ok := targets[chunk]; ok {
 				w = io.MultiWriter(w, allData[chunk])
 			}
 
 			// Copy the target chunk
-			if _, err := io.CopyN(w, p, chunk.size()); err != nil {
+			if n, err := io.CopyBuffer(w, io.LimitReader(p, chunk.size()), *buf); err != nil {
 				cw.Abort()
 				return err
+			} else if n != chunk.size() {
+				cw.Abort()
+				return io.ErrUnexpectedEOF
 			}
 
 			// Add the target chunk to the cache
@@ -379,26 +525,21 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 			}
 
 			b.fetchedRegionSetMu.Lock()
+			before := b.fetchedRegionSet.totalSize()
 			b.fetchedRegionSet.add(chunk)
+			if opts.background {
+				// Count only bytes not fetched yet
+				b.backgroundFetched += b.fetchedRegionSet.totalSize() - before
+			}
 			b.fetchedRegionSetMu.Unlock()
+			fetchedMu.Lock()
 			fetched[chunk] = true
+			fetchedMu.Unlock()
 			return nil
 		}); err != nil {
 			return fmt.Errorf("failed to get chunks: %w", err)
 		}
 	}
-
-	// Check all chunks are fetched
-	var unfetched []region
-	for c, b := range fetched {
-		if !b {
-			unfetched = append(unfetched, c)
-		}
-	}
-	if unfetched != nil {
-		return fmt.Errorf("failed to fetch region %v", unfetched)
-	}
-
 	return nil
 }
 
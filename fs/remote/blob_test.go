@@ -24,6 +24,7 @@ package remote
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"mime"
@@ -300,6 +301,110 @@ func checkBrokenHeader(t *testing.T, allowMultiRange bool) {
 	}
 }
 
+// Tests non-contiguous chunks are fetched with parallel requests.
+func TestParallelRangeFetches(t *testing.T) {
+	for _, multiRange := range []bool{true, false} {
+		for _, maxParallel := range []int{0, 2, 3, 10} {
+			t.Run(fmt.Sprintf("multirange_%v_parallel_%d", multiRange, maxParallel), func(t *testing.T) {
+				var (
+					count  int64
+					except []region
+				)
+				if multiRange || maxParallel > 1 {
+					// Cached chunks mustn't be fetched unless the super region of the
+					// missed chunks is fetched in the single range mode.
+					except = []region{{3, 5}, {9, 9}}
+				}
+				tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(multiRange), exceptChunks(except))
+				b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+					atomic.AddInt64(&count, 1)
+					return tr(req)
+				})
+				if !multiRange {
+					b.fetcher.(*httpFetcher).singleRangeMode()
+				}
+				b.maxParallelFetches = maxParallel
+
+				// chunks {0, 2} and {6, 8} are missed.
+				cacheAll(t, b, []region{{3, 5}, {9, 9}})
+				checkRead(t, []byte(sampleData1), b, 0, int64(len(sampleData1)))
+				wantCount := int64(2)
+				if maxParallel <= 1 {
+					wantCount = 1
+				}
+				if count != wantCount {
+					t.Errorf("%d requests are made; want %d", count, wantCount)
+				}
+			})
+		}
+	}
+}
+
+func TestCoalesceRangeFetches(t *testing.T) {
+	for _, tt := range []struct {
+		gap       int64
+		wantCount int64
+	}{
+		{gap: 0, wantCount: 2},
+		{gap: sampleChunkSize - 1, wantCount: 2},
+		{gap: sampleChunkSize, wantCount: 1}, // chunk {3, 5} is fetched as well
+	} {
+		t.Run(fmt.Sprintf("gap_%d", tt.gap), func(t *testing.T) {
+			var count int64
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(true))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				atomic.AddInt64(&count, 1)
+				return tr(req)
+			})
+			b.maxParallelFetches = 10
+			b.coalesceGap = tt.gap
+
+			// chunks {0, 2} and {6, 8} are missed.
+			cacheAll(t, b, []region{{3, 5}, {9, 9}})
+			checkRead(t, []byte(sampleData1), b, 0, int64(len(sampleData1)))
+			if count != tt.wantCount {
+				t.Errorf("%d requests are made; want %d", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestCoalesceMultiChunkGap(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		cached    []region
+		wantRange string
+		wantSize  int64
+	}{
+		{name: "uncached", wantRange: "bytes=0-9", wantSize: 10},
+		{name: "partially_cached", cached: []region{{3, 5}}, wantRange: "bytes=0-2,6-9", wantSize: 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(true))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				ranges = append(ranges, req.Header.Get("Range"))
+				return tr(req)
+			})
+			b.maxParallelFetches = 10
+			b.coalesceGap = 2 * sampleChunkSize
+			cacheAll(t, b, tt.cached)
+
+			// chunks {0, 2} and {9, 9} are targets and {3, 5} and {6, 8} are the gap.
+			if err := b.fetchRange(map[region]io.Writer{{0, 2}: io.Discard, {9, 9}: io.Discard}, &options{background: true}); err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) != 1 || ranges[0] != tt.wantRange {
+				t.Errorf("requested ranges %v; want [%s]", ranges, tt.wantRange)
+			}
+			checkAllCached(t, b, 0, int64(len(sampleData1)))
+			if sz := b.BackgroundFetchedSize(); sz != tt.wantSize {
+				t.Errorf("background fetched size = %d; want %d", sz, tt.wantSize)
+			}
+		})
+	}
+}
+
 func TestParallelDownloadingBehavior(t *testing.T) {
 	type regionsBoundaries struct {
 		regions []region
@@ -576,7 +681,8 @@ func makeTestBlob(t *testing.T, size int64, chunkSize int64, prefetchChunkSize i
 		lastCheck,
 		checkInterval,
 		&Resolver{},
-		time.Duration(defaultFetchTimeoutSec)*time.Second)
+		time.Duration(defaultFetchTimeoutSec)*time.Second,
+		0, 0)
 }
 
 func TestCheckInterval(t *testing.T) {
@@ -631,6 +737,31 @@ func TestCheckInterval(t *testing.T) {
 	}
 }
 
+type closableFetcher struct {
+	closed bool
+}
+
+func (f *closableFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+func (f *closableFetcher) Check() error                       { return nil }
+func (f *closableFetcher) GenID(off int64, size int64) string { return "" }
+func (f *closableFetcher) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestCloseFetcher(t *testing.T) {
+	f := &closableFetcher{}
+	b := &blob{fetcher: &remoteFetcher{f}, cache: cache.NewMemoryCache()}
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close blob: %v", err)
+	}
+	if !f.closed {
+		t.Errorf("fetcher must be closed with the blob")
+	}
+}
+
 type callsCountRoundTripper struct {
 	count   int64
 	content string
@@ -0,0 +1,419 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	"github.com/hashicorp/go-multierror"
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	defaultMirrorHealthCheckIntervalSec = 30
+	healthCheckTimeout                  = 10 * time.Second
+)
+
+// hostHealth tracks registry hosts that failed to serve blobs. An unhealthy host is
+// checked periodically and becomes healthy again once it passes the check. This is
+// shared among blobs of a resolver so that a dead host found by a blob isn't tried
+// first by other blobs. The checks stop when the hostHealth is closed.
+type hostHealth struct {
+	unhealthy map[string]struct{}
+	mu        sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHostHealth() *hostHealth {
+	return &hostHealth{
+		unhealthy: make(map[string]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (h *hostHealth) isHealthy(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.unhealthy[host]
+	return !ok
+}
+
+// markUnhealthy marks the host as unhealthy and starts the health check of the host.
+func (h *hostHealth) markUnhealthy(ctx context.Context, host docker.RegistryHost, interval time.Duration) {
+	if host.Host == "" || strings.Contains(host.Host, "/") {
+		return // invalid host; never recovers
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.unhealthy[host.Host]; ok {
+		return // already checking
+	}
+	select {
+	case <-h.done:
+		return // closed
+	default:
+	}
+	h.unhealthy[host.Host] = struct{}{}
+	commonmetrics.SetRemoteHostHealthy(host.Host, false)
+	log.G(ctx).WithField("host", host.Host).Warnf("registry host is marked as unhealthy")
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-t.C:
+			}
+			if err := checkHost(host); err != nil {
+				log.G(ctx).WithField("host", host.Host).WithError(err).Debugf("registry host is still unhealthy")
+				continue
+			}
+			h.mu.Lock()
+			delete(h.unhealthy, host.Host)
+			h.mu.Unlock()
+			commonmetrics.SetRemoteHostHealthy(host.Host, true)
+			log.G(ctx).WithField("host", host.Host).Infof("registry host is healthy again")
+			return
+		}
+	}()
+}
+
+// close stops the health checks of all hosts.
+func (h *hostHealth) close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// checkHost checks if the host serves the registry API. Any response other than
+// 5xx (including 401) means the host is alive.
+func checkHost(host docker.RegistryHost) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s://%s%s/", host.Scheme, host.Host, host.Path), nil)
+	if err != nil {
+		return err
+	}
+	var tr http.RoundTripper
+	if host.Client != nil {
+		tr = host.Client.Transport
+	}
+	if rt, ok := tr.(*rhttp.RoundTripper); ok {
+		tr = rt.Client.HTTPClient.Transport // don't retry
+	}
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode/100 == 5 {
+		return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// mirroredFetcher fetches a blob from a list of registry hosts (mirrors and the
+// registry). Hosts are tried in the configured order but unhealthy hosts are tried
+// only when all healthy hosts fail. When a host recovers, that host is preferred again.
+type mirroredFetcher struct {
+	fc         *fetcherConfig
+	endpoints  []*endpoint
+	size       int64
+	hedgeDelay time.Duration
+
+	// idFetcher is the fetcher used for generating IDs of chunks. This is fixed during
+	// the lifetime of this fetcher so that the IDs don't change on failover.
+	idFetcher *httpFetcher
+
+	// attempts are on-demand requests in flight including ones streaming the
+	// response. These can be aborted by failOver.
+	attempts    map[int]attempt
+	nextAttempt int
+	attemptsMu  sync.Mutex
+}
+
+// attempt is a request to an endpoint.
+type attempt struct {
+	ep     *endpoint
+	cancel context.CancelFunc
+}
+
+// endpoint is a registry host serving the blob. The fetcher of the endpoint is lazily
+// resolved on the first use.
+type endpoint struct {
+	host docker.RegistryHost
+	f    *httpFetcher
+	mu   sync.Mutex
+
+	// p2p is true if this is the P2P proxy. The proxy isn't marked as unhealthy on
+	// resolution failures because they are usually caused by blobs not shared by peers.
+	// Instead, the failure is recorded in err and the proxy isn't used for the blob
+	// until the health check interval passes since errTime.
+	p2p     bool
+	err     error
+	errTime time.Time
+}
+
+func newMirroredFetcher(ctx context.Context, fc *fetcherConfig, reghosts []docker.RegistryHost) (*mirroredFetcher, int64, error) {
+	mf := &mirroredFetcher{
+		fc:         fc,
+		hedgeDelay: fc.hedgeDelay,
+		attempts:   make(map[int]attempt),
+	}
+	if fc.p2pHost != nil {
+		mf.endpoints = append(mf.endpoints, &endpoint{host: *fc.p2pHost, p2p: true})
+	}
+	for _, h := range reghosts {
+		mf.endpoints = append(mf.endpoints, &endpoint{host: h})
+	}
+	var rErr error
+	for _, ep := range mf.candidates() {
+		f, size, err := mf.resolve(ctx, ep)
+		if err != nil {
+			rErr = multierror.Append(rErr, err)
+			continue
+		}
+		mf.size, mf.idFetcher = size, f
+		return mf, size, nil
+	}
+	return nil, 0, fmt.Errorf("cannot resolve layer: %w", rErr)
+}
+
+// candidates returns endpoints in the order to try.
+func (mf *mirroredFetcher) candidates() []*endpoint {
+	var healthy, unhealthy []*endpoint
+	for _, ep := range mf.endpoints {
+		if mf.fc.health.isHealthy(ep.host.Host) {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (mf *mirroredFetcher) resolve(ctx context.Context, ep *endpoint) (*httpFetcher, int64, error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.f != nil {
+		return ep.f, mf.size, nil
+	}
+	if ep.err != nil {
+		if time.Since(ep.errTime) < mf.fc.healthCheckInterval {
+			return nil, 0, ep.err
+		}
+		ep.err = nil // peers may share the blob now
+	}
+	fc := *mf.fc
+	host := ep.host
+	fc.hosts = func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{host}, nil
+	}
+	f, size, err := newHTTPFetcher(ctx, &fc)
+	if err != nil {
+		if ctx.Err() == nil {
+			if ep.p2p {
+				ep.err, ep.errTime = err, time.Now() // don't retry resolving the blob for a while
+			} else {
+				mf.fc.health.markUnhealthy(ctx, host, mf.fc.healthCheckInterval)
+			}
+		}
+		return nil, 0, err
+	}
+	if mf.size != 0 && size != mf.size {
+		return nil, 0, fmt.Errorf("invalid size of blob %d on host %q; want %d", size, host.Host, mf.size)
+	}
+	if fc.forceSingleRange {
+		f.singleRangeMode()
+	}
+	ep.f = f
+	return f, size, nil
+}
+
+func (mf *mirroredFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	type result struct {
+		r   multipartReadCloser
+		ep  *endpoint
+		err error
+		idx int
+
+		resolveErr bool // resolve() already handled the error
+	}
+	var (
+		candidates = mf.candidates()
+		resCh      = make(chan result, len(candidates))
+		cancels    []context.CancelFunc
+		next       int
+		pending    int
+		allErr     error
+	)
+	start := func() {
+		idx, ep := next, candidates[next]
+		next++
+		pending++
+		fctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, mf.addAttempt(ctx, ep, cancel))
+		go func() {
+			f, _, err := mf.resolve(fctx, ep)
+			if err != nil {
+				resCh <- result{err: err, ep: ep, idx: idx, resolveErr: true}
+				return
+			}
+			r, err := f.fetch(fctx, rs, retry)
+			resCh <- result{r: r, ep: ep, err: err, idx: idx}
+		}()
+	}
+	var hedge <-chan time.Time
+	start()
+	for pending > 0 {
+		if mf.hedgeDelay > 0 && next < len(candidates) {
+			hedge = time.After(mf.hedgeDelay)
+		} else {
+			hedge = nil
+		}
+		select {
+		case res := <-resCh:
+			pending--
+			if res.err == nil {
+				// Use this response and abort others
+				for i, c := range cancels {
+					if i != res.idx {
+						c()
+					}
+				}
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if o := <-resCh; o.r != nil {
+							o.r.Close()
+						}
+					}
+				}(pending)
+				commonmetrics.IncRemoteHostFetchCount(res.ep.host.Host, mf.fc.desc.Digest)
+				return &cancelOnClose{res.r, cancels[res.idx]}, nil
+			}
+			cancels[res.idx]()
+			allErr = multierror.Append(allErr, fmt.Errorf("host %q: %w", res.ep.host.Host, res.err))
+			if ctx.Err() != nil {
+				for _, c := range cancels {
+					c()
+				}
+				return nil, allErr
+			}
+			if !res.resolveErr {
+				mf.fc.health.markUnhealthy(ctx, res.ep.host, mf.fc.healthCheckInterval)
+			}
+			if next < len(candidates) {
+				start() // fail over to the next host
+			}
+		case <-hedge:
+			log.G(ctx).WithField("digest", mf.fc.desc.Digest).Debugf("hedging request to %q", candidates[next].host.Host)
+			start()
+		}
+	}
+	return nil, fmt.Errorf("failed to fetch from all hosts: %w", allErr)
+}
+
+// addAttempt records the on-demand request to the endpoint so that it can be aborted
+// by failOver. The returned function cancels the request and must be called when the
+// request completes.
+func (mf *mirroredFetcher) addAttempt(ctx context.Context, ep *endpoint, cancel context.CancelFunc) context.CancelFunc {
+	if isBackgroundFetch(ctx) {
+		return cancel // background fetches don't have read deadlines
+	}
+	mf.attemptsMu.Lock()
+	id := mf.nextAttempt
+	mf.nextAttempt++
+	mf.attempts[id] = attempt{ep, cancel}
+	mf.attemptsMu.Unlock()
+	return func() {
+		mf.attemptsMu.Lock()
+		delete(mf.attempts, id)
+		mf.attemptsMu.Unlock()
+		cancel()
+	}
+}
+
+// failOver aborts on-demand requests in flight and marks their hosts as unhealthy
+// so that the requests are retried on the other hosts. Requests still waiting for
+// the response fail over to the next host immediately and ones streaming the
+// response fail and need to be retried by the caller. false is returned if there
+// is no other host or no request to abort.
+func (mf *mirroredFetcher) failOver() bool {
+	if len(mf.endpoints) < 2 {
+		return false
+	}
+	mf.attemptsMu.Lock()
+	attempts := mf.attempts
+	mf.attempts = make(map[int]attempt)
+	mf.attemptsMu.Unlock()
+	for _, a := range attempts {
+		log.L.WithField("digest", mf.fc.desc.Digest).Infof("aborting slow request to %q", a.ep.host.Host)
+		if !a.ep.p2p {
+			mf.fc.health.markUnhealthy(context.Background(), a.ep.host, mf.fc.healthCheckInterval)
+		}
+		a.cancel()
+	}
+	return len(attempts) > 0
+}
+
+func (mf *mirroredFetcher) check() error {
+	var allErr error
+	for _, ep := range mf.candidates() {
+		f, _, err := mf.resolve(context.Background(), ep)
+		if err == nil {
+			if err = f.check(); err == nil {
+				return nil
+			}
+			mf.fc.health.markUnhealthy(context.Background(), ep.host, mf.fc.healthCheckInterval)
+		}
+		allErr = multierror.Append(allErr, fmt.Errorf("host %q: %w", ep.host.Host, err))
+	}
+	return allErr
+}
+
+func (mf *mirroredFetcher) genID(reg region) string {
+	return mf.idFetcher.genID(reg)
+}
+
+// cancelOnClose cancels the context of the request when the reader is closed.
+type cancelOnClose struct {
+	multipartReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.multipartReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,311 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	refspec, err := reference.Parse("failoverregistry.example.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	const mirror = "failovermirror.example.com"
+	tr := &switchRoundTripper{broken: make(map[string]bool)}
+	hosts := func(refspec reference.Spec) (reghosts []docker.RegistryHost, _ error) {
+		for _, h := range []string{mirror, refspec.Hostname()} {
+			reghosts = append(reghosts, docker.RegistryHost{
+				Client:       &http.Client{Transport: tr},
+				Host:         h,
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			})
+		}
+		return
+	}
+	health := newHostHealth()
+	defer health.close()
+	mf, size, err := newMirroredFetcher(context.Background(), &fetcherConfig{
+		hosts:               hosts,
+		refspec:             refspec,
+		desc:                ocispec.Descriptor{Digest: digest.FromString("test")},
+		healthCheckInterval: 10 * time.Millisecond,
+		health:              health,
+	}, mustHosts(t, hosts, refspec))
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if size != 4 {
+		t.Fatalf("unexpected size %d; want 4", size)
+	}
+	fetchAndCheck := func(wantHost string) {
+		r, err := mf.fetch(context.Background(), []region{{b: 0, e: 3}}, false)
+		if err != nil {
+			t.Fatalf("failed to fetch blob: %v", err)
+		}
+		r.Close()
+		if got := tr.lastHost(); got != wantHost {
+			t.Errorf("blob is served by %q; want %q", got, wantHost)
+		}
+	}
+
+	// The mirror serves the blob
+	fetchAndCheck(mirror)
+
+	// The mirror is down so the registry serves the blob
+	tr.setBroken(mirror, true)
+	fetchAndCheck(refspec.Hostname())
+	if health.isHealthy(mirror) {
+		t.Errorf("mirror must be marked as unhealthy")
+	}
+	if c := mf.candidates(); c[0].host.Host != refspec.Hostname() {
+		t.Errorf("unhealthy mirror must not be preferred; got %q", c[0].host.Host)
+	}
+
+	// The mirror recovers and is preferred again
+	tr.setBroken(mirror, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !health.isHealthy(mirror) {
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror must be healthy again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fetchAndCheck(mirror)
+}
+
+func TestMirrorFailOverSlowHost(t *testing.T) {
+	refspec, err := reference.Parse("slowregistry.example.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	const mirror = "slowmirror.example.com"
+	tr := &switchRoundTripper{broken: make(map[string]bool), slow: make(map[string]bool)}
+	hosts := func(refspec reference.Spec) (reghosts []docker.RegistryHost, _ error) {
+		for _, h := range []string{mirror, refspec.Hostname()} {
+			reghosts = append(reghosts, docker.RegistryHost{
+				Client:       &http.Client{Transport: tr},
+				Host:         h,
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			})
+		}
+		return
+	}
+	health := newHostHealth()
+	defer health.close()
+	mf, _, err := newMirroredFetcher(context.Background(), &fetcherConfig{
+		hosts:               hosts,
+		refspec:             refspec,
+		desc:                ocispec.Descriptor{Digest: digest.FromString("test")},
+		healthCheckInterval: 10 * time.Millisecond,
+		health:              health,
+	}, mustHosts(t, hosts, refspec))
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if mf.failOver() {
+		t.Errorf("nothing must be aborted without requests")
+	}
+
+	// The mirror doesn't respond so the request is aborted and sent to the registry
+	tr.setSlow(mirror, true)
+	errCh := make(chan error, 1)
+	go func() {
+		r, err := mf.fetch(context.Background(), []region{{b: 0, e: 3}}, false)
+		if err == nil {
+			r.Close()
+		}
+		errCh <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !mf.failOver() {
+		if time.Now().After(deadline) {
+			t.Fatalf("request to the mirror must be aborted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to fetch blob: %v", err)
+	}
+	if got := tr.lastHost(); got != refspec.Hostname() {
+		t.Errorf("blob is served by %q; want %q", got, refspec.Hostname())
+	}
+	if health.isHealthy(mirror) {
+		t.Errorf("slow mirror must be marked as unhealthy")
+	}
+
+	// The mirror recovers
+	tr.setSlow(mirror, false)
+	deadline = time.Now().Add(15 * time.Second)
+	for !health.isHealthy(mirror) {
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror must be healthy again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostHealthClose(t *testing.T) {
+	const host = "closedmirror.example.com"
+	var (
+		checked int
+		mu      sync.Mutex
+	)
+	tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		checked++
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			Request:    req,
+		}, nil
+	})
+	checkedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return checked
+	}
+	health := newHostHealth()
+	health.markUnhealthy(context.Background(), docker.RegistryHost{
+		Client: &http.Client{Transport: tr},
+		Host:   host,
+		Scheme: "https",
+		Path:   "/v2",
+	}, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for checkedCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unhealthy host must be checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The checks stop after close
+	health.close()
+	time.Sleep(50 * time.Millisecond)
+	n := checkedCount()
+	time.Sleep(100 * time.Millisecond)
+	if got := checkedCount(); got != n {
+		t.Errorf("host must not be checked after close; checked %d times more", got-n)
+	}
+	health.markUnhealthy(context.Background(), docker.RegistryHost{Host: "other" + host}, 10*time.Millisecond)
+	if !health.isHealthy("other" + host) {
+		t.Errorf("host must not be marked as unhealthy after close")
+	}
+}
+
+func TestCheckHostDefaultTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*http.Client{nil, {}} {
+		if err := checkHost(docker.RegistryHost{Client: client, Host: u.Host, Scheme: "http", Path: "/v2"}); err != nil {
+			t.Errorf("host must be healthy with client %+v: %v", client, err)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func mustHosts(t *testing.T, hosts func(reference.Spec) ([]docker.RegistryHost, error), refspec reference.Spec) []docker.RegistryHost {
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	return reghosts
+}
+
+// switchRoundTripper serves "test" from all hosts except broken ones.
+type switchRoundTripper struct {
+	broken map[string]bool
+	slow   map[string]bool // don't respond until the request is cancelled
+	last   string
+	mu     sync.Mutex
+}
+
+func (tr *switchRoundTripper) setBroken(host string, broken bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.broken[host] = broken
+}
+
+func (tr *switchRoundTripper) setSlow(host string, slow bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.slow[host] = slow
+}
+
+func (tr *switchRoundTripper) lastHost() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.last
+}
+
+func (tr *switchRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.mu.Lock()
+	slow := tr.slow[req.URL.Host]
+	tr.mu.Unlock()
+	if slow {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.broken[req.URL.Host] {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			Request:    req,
+		}, nil
+	}
+	tr.last = req.URL.Host
+	header := make(http.Header)
+	header.Add("Content-Length", "4")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte("test"))),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+const (
+	defaultP2PTimeoutSec = 10
+
+	// dragonflyRegistryHeader tells Dragonfly the registry where the blob comes from.
+	dragonflyRegistryHeader = "X-Dragonfly-Registry"
+)
+
+// p2pProxy is a node-local P2P proxy which serves blobs in the registry API
+// ("/v2/<repository>/blobs/<digest>") with range request support.
+type p2pProxy struct {
+	scheme string
+	host   string
+	path   string
+	client *http.Client
+}
+
+func newP2PProxy(cfg config.P2PConfig) (*p2pProxy, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse P2P proxy endpoint %q: %w", cfg.Endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("P2P proxy endpoint %q must be an URL with scheme and host", cfg.Endpoint)
+	}
+	timeout := cfg.TimeoutSec
+	if timeout == 0 {
+		timeout = defaultP2PTimeoutSec
+	}
+	// The timeout doesn't cover reading bodies because large chunks served by the proxy
+	// can take longer than resolving blobs. Fetching bodies is bounded by the fetch timeout.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(timeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	tr.ResponseHeaderTimeout = time.Duration(timeout) * time.Second
+	return &p2pProxy{
+		scheme: u.Scheme,
+		host:   u.Host,
+		path:   path.Join("/", u.Path, "v2"),
+		client: &http.Client{Transport: tr},
+	}, nil
+}
+
+// registryHost returns the proxy as a registry host of the blob. reghosts are the
+// hosts of the registry and the mirrors. The last host is the origin registry.
+func (p *p2pProxy) registryHost(refspec reference.Spec, reghosts []docker.RegistryHost) docker.RegistryHost {
+	tr := &p2pTransport{
+		inner: p.client.Transport,
+		ns:    refspec.Hostname(),
+	}
+	var auth docker.Authorizer
+	if len(reghosts) > 0 {
+		origin := reghosts[len(reghosts)-1]
+		tr.registry = fmt.Sprintf("%s://%s", origin.Scheme, origin.Host)
+		auth = origin.Authorizer // the proxy forwards creds to the registry
+	}
+	return docker.RegistryHost{
+		Client:       &http.Client{Transport: tr},
+		Authorizer:   auth,
+		Host:         p.host,
+		Scheme:       p.scheme,
+		Path:         p.path,
+		Capabilities: docker.HostCapabilityPull,
+	}
+}
+
+// p2pTransport tells the proxy the origin registry of the blob. Dragonfly reads the
+// header and Spegel reads "ns" query.
+type p2pTransport struct {
+	inner    http.RoundTripper
+	registry string
+	ns       string
+}
+
+func (tr *p2pTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if tr.registry != "" {
+		req.Header.Set(dragonflyRegistryHeader, tr.registry)
+	}
+	if tr.ns != "" {
+		q := req.URL.Query()
+		q.Set("ns", tr.ns)
+		req.URL.RawQuery = q.Encode()
+	}
+	return tr.inner.RoundTrip(req)
+}
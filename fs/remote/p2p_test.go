@@ -0,0 +1,272 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestP2PProxy(t *testing.T) {
+	const (
+		registryHost = "p2pregistry.example.com"
+		sharedBlob   = "shared"
+		otherBlob    = "other"
+	)
+	var (
+		served  int
+		servedM sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g := r.Header.Get(dragonflyRegistryHeader); g != "https://"+registryHost {
+			t.Errorf("unexpected registry header %q", g)
+		}
+		if g := r.URL.Query().Get("ns"); g != registryHost {
+			t.Errorf("unexpected ns query %q", g)
+		}
+		if r.URL.Path != "/v2/library/test/blobs/"+digest.FromString(sharedBlob).String() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		servedM.Lock()
+		served++
+		servedM.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(sharedBlob))
+	}))
+	defer srv.Close()
+
+	refspec, err := reference.Parse(registryHost + "/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	tr := &switchRoundTripper{broken: make(map[string]bool)}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	r, err := NewResolver(config.BlobConfig{P2P: config.P2PConfig{Endpoint: srv.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer r.Close()
+
+	// The P2P proxy serves the blob shared by peers
+	f, size, err := r.resolveFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: digest.FromString(sharedBlob)})
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if size != int64(len(sharedBlob)) {
+		t.Fatalf("unexpected size %d; want %d", size, len(sharedBlob))
+	}
+	mr, err := f.fetch(context.Background(), []region{{b: 1, e: 3}}, false)
+	if err != nil {
+		t.Fatalf("failed to fetch blob: %v", err)
+	}
+	defer mr.Close()
+	reg, p, err := mr.Next()
+	if err != nil {
+		t.Fatalf("failed to get part: %v", err)
+	}
+	data, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("failed to read part: %v", err)
+	}
+	if reg != (region{1, 3}) || !bytes.Equal(data, []byte(sharedBlob[1:4])) {
+		t.Errorf("unexpected part %+v %q; want %q", reg, string(data), sharedBlob[1:4])
+	}
+	servedM.Lock()
+	if served == 0 {
+		t.Errorf("blob must be served by the P2P proxy")
+	}
+	servedM.Unlock()
+
+	// The registry serves the blob not found on the proxy
+	f, _, err = r.resolveFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: digest.FromString(otherBlob)})
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	mr2, err := f.fetch(context.Background(), []region{{b: 0, e: 3}}, false)
+	if err != nil {
+		t.Fatalf("failed to fetch blob: %v", err)
+	}
+	mr2.Close()
+	if got := tr.lastHost(); got != registryHost {
+		t.Errorf("blob is served by %q; want %q", got, registryHost)
+	}
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.health.isHealthy(u.Host) {
+		t.Errorf("P2P proxy must not be marked as unhealthy on missing blobs")
+	}
+}
+
+func TestP2PProxyRetry(t *testing.T) {
+	const registryHost = "p2pretry.example.com"
+	var (
+		shared   bool // the proxy serves the blob
+		slowBody bool // the proxy sends the body later than the timeout
+		slowHdr  bool // the proxy sends the header later than the timeout
+		served   int
+		mu       sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		s, slow, slowH := shared, slowBody, slowHdr
+		if s {
+			served++
+		}
+		mu.Unlock()
+		if slowH {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		if !s {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if slow {
+			w = &delayedBodyWriter{ResponseWriter: w, delay: 1500 * time.Millisecond}
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("test"))
+	}))
+	defer srv.Close()
+	servedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return served
+	}
+
+	refspec, err := reference.Parse(registryHost + "/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	tr := &switchRoundTripper{broken: make(map[string]bool)}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	r, err := NewResolver(config.BlobConfig{
+		P2P:                          config.P2PConfig{Endpoint: srv.URL, TimeoutSec: 1},
+		MirrorHealthCheckIntervalSec: 1,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer r.Close()
+	f, _, err := r.resolveFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: digest.FromString("test")})
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	fetchAndCheck := func() {
+		mr, err := f.fetch(context.Background(), []region{{b: 0, e: 3}}, false)
+		if err != nil {
+			t.Fatalf("failed to fetch blob: %v", err)
+		}
+		defer mr.Close()
+		_, p, err := mr.Next()
+		if err != nil {
+			t.Fatalf("failed to get part: %v", err)
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		if string(data) != "test" {
+			t.Errorf("unexpected data %q; want %q", string(data), "test")
+		}
+	}
+
+	// The blob missing on the proxy isn't requested to the proxy again for a while
+	fetchAndCheck()
+	mu.Lock()
+	shared = true
+	mu.Unlock()
+	fetchAndCheck()
+	if n := servedCount(); n != 0 {
+		t.Errorf("proxy must not be retried soon after the failure but served %d requests", n)
+	}
+
+	// The proxy is retried after the interval
+	time.Sleep(1100 * time.Millisecond)
+	fetchAndCheck()
+	if servedCount() == 0 {
+		t.Errorf("proxy must be retried after the interval")
+	}
+
+	// The timeout doesn't cover reading bodies
+	mu.Lock()
+	slowBody = true
+	mu.Unlock()
+	n := servedCount()
+	fetchAndCheck()
+	if servedCount() == n {
+		t.Errorf("blob must be served by the P2P proxy")
+	}
+
+	// The proxy which doesn't respond in time falls back to the registry
+	mu.Lock()
+	slowBody, slowHdr = false, true
+	mu.Unlock()
+	tr.mu.Lock()
+	tr.last = ""
+	tr.mu.Unlock()
+	fetchAndCheck()
+	if got := tr.lastHost(); got != registryHost {
+		t.Errorf("blob is served by %q; want %q", got, registryHost)
+	}
+}
+
+// delayedBodyWriter sends the header immediately and the body after the delay.
+type delayedBodyWriter struct {
+	http.ResponseWriter
+	delay   time.Duration
+	written bool
+}
+
+func (w *delayedBodyWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		w.ResponseWriter.(http.Flusher).Flush()
+		time.Sleep(w.delay)
+	}
+	return w.ResponseWriter.Write(p)
+}
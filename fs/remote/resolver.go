@@ -62,7 +62,7 @@ const (
 	defaultMaxWaitMSec = 300000
 )
 
-func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
+func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) (*Resolver, error) {
 	if cfg.ChunkSize == 0 { // zero means "use default chunk size"
 		cfg.ChunkSize = defaultChunkSize
 	}
@@ -84,16 +84,43 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	if cfg.MaxWaitMSec == 0 {
 		cfg.MaxWaitMSec = defaultMaxWaitMSec
 	}
+	if cfg.MirrorHealthCheckIntervalSec == 0 {
+		cfg.MirrorHealthCheckIntervalSec = defaultMirrorHealthCheckIntervalSec
+	}
+
+	p2p, err := newP2PProxy(cfg.P2P)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Resolver{
 		blobConfig: cfg,
 		handlers:   handlers,
-	}
+		limiters:   newBandwidthLimiters(cfg.BandwidthLimit),
+		p2p:        p2p,
+		health:     newHostHealth(),
+	}, nil
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
 	handlers   map[string]Handler
+
+	// limiters are bandwidth limiters of registry hosts. These are shared among blobs.
+	limiters map[string]*bandwidthLimiter
+
+	// p2p is the node-local P2P proxy tried before the registry. nil if not configured.
+	p2p *p2pProxy
+
+	// health is the health of registry hosts. This is shared among blobs.
+	health *hostHealth
+}
+
+// Close stops the health checks of registry hosts. The resolver must not be used
+// after Close.
+func (r *Resolver) Close() error {
+	r.health.close()
+	return nil
 }
 
 type fetcher interface {
@@ -116,18 +143,25 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		time.Duration(blobConfig.FetchTimeoutSec)*time.Second,
+		blobConfig.MaxParallelRangeFetches,
+		blobConfig.CoalesceGapSize), nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
 	blobConfig := &r.blobConfig
 	fc := &fetcherConfig{
-		hosts:       hosts,
-		refspec:     refspec,
-		desc:        desc,
-		maxRetries:  blobConfig.MaxRetries,
-		minWaitMSec: time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
-		maxWaitMSec: time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+		hosts:               hosts,
+		refspec:             refspec,
+		desc:                desc,
+		maxRetries:          blobConfig.MaxRetries,
+		minWaitMSec:         time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
+		maxWaitMSec:         time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+		forceSingleRange:    blobConfig.ForceSingleRangeMode,
+		healthCheckInterval: time.Duration(blobConfig.MirrorHealthCheckIntervalSec) * time.Second,
+		hedgeDelay:          time.Duration(blobConfig.MirrorHedgeDelayMSec) * time.Millisecond,
+		limiters:            r.limiters,
+		health:              r.health,
 	}
 	var handlersErr error
 	for name, p := range r.handlers {
@@ -143,6 +177,20 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 	}
 
 	log.G(ctx).WithError(handlersErr).WithField("ref", refspec.String()).WithField("digest", desc.Digest).Debugf("using default handler")
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.p2p != nil {
+		// Try the P2P proxy first and fall back to mirrors and the registry
+		p2pHost := r.p2p.registryHost(refspec, reghosts)
+		fc.p2pHost = &p2pHost
+		return newMirroredFetcher(ctx, fc, reghosts)
+	}
+	if len(reghosts) > 1 {
+		// Fail over among mirrors and the registry
+		return newMirroredFetcher(ctx, fc, reghosts)
+	}
 	hf, size, err := newHTTPFetcher(ctx, fc)
 	if err != nil {
 		return nil, 0, err
@@ -160,6 +208,18 @@ type fetcherConfig struct {
 	maxRetries  int
 	minWaitMSec time.Duration
 	maxWaitMSec time.Duration
+
+	forceSingleRange    bool
+	healthCheckInterval time.Duration
+	hedgeDelay          time.Duration
+
+	limiters map[string]*bandwidthLimiter
+
+	// health is the health of registry hosts used by mirroredFetcher.
+	health *hostHealth
+
+	// p2pHost is the P2P proxy which is tried before the hosts if non-nil.
+	p2pHost *docker.RegistryHost
 }
 
 func jitter(duration time.Duration) time.Duration {
@@ -262,6 +322,7 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 			blobURL: blobURL,
 			digest:  digest,
 			timeout: timeout,
+			limiter: limiterForHost(fc.limiters, host.Host),
 		}, size, nil
 	}
 
@@ -303,7 +364,10 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			return nil, err
 		}
 
-		// re-authorize and send the request
+		// re-authorize and send the request. The authorizer re-runs the auth handshake
+		// so that expired or revoked tokens are refreshed.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
 		return roundTrip(req.Clone(ctx))
 	}
 
@@ -405,6 +469,7 @@ type httpFetcher struct {
 	singleRange   bool
 	singleRangeMu sync.Mutex
 	timeout       time.Duration
+	limiter       *bandwidthLimiter
 }
 
 type multipartReadCloser interface {
@@ -465,7 +530,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Length: %w", err)
 		}
-		return newSinglePartReader(region{0, size - 1}, res.Body), nil
+		return newSinglePartReader(region{0, size - 1}, f.limiter.throttle(ctx, res.Body)), nil
 	} else if res.StatusCode == http.StatusPartialContent {
 		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 		if err != nil {
@@ -473,7 +538,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		}
 		if strings.HasPrefix(mediaType, "multipart/") {
 			// We are getting a set of chunks as a multipart body.
-			return newMultiPartReader(res.Body, params["boundary"]), nil
+			return newMultiPartReader(f.limiter.throttle(ctx, res.Body), params["boundary"]), nil
 		}
 
 		// We are getting single range
@@ -481,7 +546,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Range: %w", err)
 		}
-		return newSinglePartReader(reg, res.Body), nil
+		return newSinglePartReader(reg, f.limiter.throttle(ctx, res.Body)), nil
 	} else if retry && res.StatusCode == http.StatusForbidden {
 		log.G(ctx).Infof("Received status code: %v. Refreshing URL and retrying...", res.Status)
 
@@ -644,8 +709,9 @@ func parseRange(header string) (region, int64, error) {
 type Option func(*options)
 
 type options struct {
-	ctx       context.Context
-	cacheOpts []cache.Option
+	ctx        context.Context
+	cacheOpts  []cache.Option
+	background bool
 }
 
 func WithContext(ctx context.Context) Option {
@@ -660,6 +726,14 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// WithBackgroundFetch marks the read as a background fetch. Background fetches are
+// limited by the background bandwidth limit of the registry host.
+func WithBackgroundFetch() Option {
+	return func(opts *options) {
+		opts.background = true
+	}
+}
+
 // NOTE: ported from https://github.com/containerd/containerd/blob/v1.5.2/remotes/docker/scope.go#L29-L42
 // TODO: import this from containerd package once we drop support to continerd v1.4.x
 //
@@ -703,10 +777,22 @@ func (r *remoteFetcher) genID(reg region) string {
 	return r.r.GenID(reg.b, reg.size())
 }
 
+// closeFetcher closes the fetcher if it's provided by a Handler and implements io.Closer.
+func closeFetcher(f fetcher) error {
+	if rf, ok := f.(*remoteFetcher); ok {
+		if c, ok := rf.r.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	return nil
+}
+
 type Handler interface {
 	Handle(ctx context.Context, desc ocispec.Descriptor) (fetcher Fetcher, size int64, err error)
 }
 
+// Fetcher fetches the contents of a blob provided by a Handler. If the Fetcher
+// implements io.Closer, it's closed when the blob is closed or refreshed.
 type Fetcher interface {
 	Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error)
 	Check() error
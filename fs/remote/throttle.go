@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"golang.org/x/time/rate"
+)
+
+// minBurstBytes is the minimal burst of bandwidth limiters. Too small burst increases
+// the number of small reads from the connection.
+const minBurstBytes = 64 * 1024
+
+// bandwidthLimiter limits the download rate from a registry host. On-demand fetches
+// and background fetches are limited separately. nil limiter means no limit.
+type bandwidthLimiter struct {
+	onDemand   *rate.Limiter
+	background *rate.Limiter
+}
+
+func newBandwidthLimiters(cfg map[string]config.BandwidthLimitConfig) map[string]*bandwidthLimiter {
+	limiters := make(map[string]*bandwidthLimiter)
+	for host, c := range cfg {
+		if c.OnDemandBytesPerSec <= 0 && c.BackgroundBytesPerSec <= 0 {
+			continue
+		}
+		limiters[host] = &bandwidthLimiter{
+			onDemand:   newLimiter(c.OnDemandBytesPerSec),
+			background: newLimiter(c.BackgroundBytesPerSec),
+		}
+	}
+	return limiters
+}
+
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := bytesPerSec
+	if burst < minBurstBytes {
+		burst = minBurstBytes
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// limiterForHost returns the limiter of the registry host or nil if the host isn't limited.
+func limiterForHost(limiters map[string]*bandwidthLimiter, host string) *bandwidthLimiter {
+	if l, ok := limiters[host]; ok {
+		return l
+	}
+	if host == "registry-1.docker.io" {
+		return limiters["docker.io"]
+	}
+	return nil
+}
+
+type backgroundFetchKey struct{}
+
+// withBackgroundFetch marks the context as a background fetch.
+func withBackgroundFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundFetchKey{}, true)
+}
+
+func isBackgroundFetch(ctx context.Context) bool {
+	b, _ := ctx.Value(backgroundFetchKey{}).(bool)
+	return b
+}
+
+// throttle limits the rate of reading the body based on the kind of the fetch.
+func (l *bandwidthLimiter) throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return body
+	}
+	lim := l.onDemand
+	if isBackgroundFetch(ctx) {
+		lim = l.background
+	}
+	if lim == nil {
+		return body
+	}
+	return &throttledReadCloser{ReadCloser: body, ctx: ctx, lim: lim}
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	ctx context.Context
+	lim *rate.Limiter
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	if b := r.lim.Burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if wErr := r.lim.WaitN(r.ctx, n); wErr != nil {
+			return n, wErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	limiters := newBandwidthLimiters(map[string]config.BandwidthLimitConfig{
+		"docker.io":             {BackgroundBytesPerSec: minBurstBytes},
+		"unlimited.example.com": {},
+	})
+	if l := limiterForHost(limiters, "unlimited.example.com"); l != nil {
+		t.Errorf("host without limits must not be limited")
+	}
+	l := limiterForHost(limiters, "registry-1.docker.io")
+	if l == nil {
+		t.Fatalf("docker.io must be limited")
+	}
+
+	data := make([]byte, 2*minBurstBytes)
+	read := func(ctx context.Context) time.Duration {
+		start := time.Now()
+		if _, err := io.Copy(io.Discard, l.throttle(ctx, io.NopCloser(bytes.NewReader(data)))); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		return time.Since(start)
+	}
+
+	// On-demand fetches aren't limited.
+	if d := read(context.Background()); d > 500*time.Millisecond {
+		t.Errorf("on-demand fetch must not be limited; took %v", d)
+	}
+
+	// Background fetches are limited. The first minBurstBytes is the burst so reading
+	// the remaining takes about 1s.
+	if d := read(withBackgroundFetch(context.Background())); d < 500*time.Millisecond {
+		t.Errorf("background fetch must be limited; took %v", d)
+	}
+}
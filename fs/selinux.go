@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// selinuxfsMount is where selinuxfs is mounted when SELinux is enabled.
+const selinuxfsMount = "/sys/fs/selinux"
+
+func isSELinuxEnabled() bool {
+	_, err := os.Stat(selinuxfsMount + "/enforce")
+	return err == nil
+}
+
+// selinuxMountOptions returns FUSE mount options applying the SELinux contexts.
+// Contexts containing commas (e.g. MCS categories) are quoted.
+func selinuxMountOptions(context, fscontext string) ([]string, error) {
+	if context != "" && fscontext != "" {
+		return nil, fmt.Errorf("SELinux context and fscontext can't be used together")
+	}
+	var opts []string
+	for _, o := range []struct{ name, value string }{
+		{"context", context},
+		{"fscontext", fscontext},
+	} {
+		if o.value == "" {
+			continue
+		}
+		if strings.ContainsAny(o.value, "\"\n") || strings.Count(o.value, ":") < 2 {
+			return nil, fmt.Errorf("invalid SELinux %s %q", o.name, o.value)
+		}
+		v := o.value
+		if strings.Contains(v, ",") {
+			v = `"` + v + `"`
+		}
+		opts = append(opts, o.name+"="+v)
+	}
+	return opts, nil
+}
@@ -0,0 +1,250 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package contentstore provides a resolve handler which serves blobs already stored in
+// the local containerd content store (e.g. pulled by normal "pull") or fully fetched by
+// the snapshotter before, without fetching them from the network.
+package contentstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Option is an option of NewResolveHandler.
+type Option func(*options)
+
+type options struct {
+	keepDir     string
+	keepMaxSize int64
+}
+
+// WithKeptBlobs makes the handler keep blobs of layers fully fetched by the snapshotter
+// in the content store at dir (see Keep) and serve them as well. The least recently
+// kept blobs are removed when the total size exceeds maxSize bytes.
+func WithKeptBlobs(dir string, maxSize int64) Option {
+	return func(o *options) {
+		o.keepDir, o.keepMaxSize = dir, maxSize
+	}
+}
+
+// provider is the part of content.Store used by the handler.
+type provider interface {
+	Info(ctx context.Context, dgst digest.Digest) (content.Info, error)
+	ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error)
+}
+
+// ResolveHandler serves blobs from the content store.
+type ResolveHandler struct {
+	stores []provider
+
+	kept        content.Store // nil if blobs aren't kept
+	keptMaxSize int64
+}
+
+// NewResolveHandler returns a resolve handler serving blobs from the content store of
+// containerd at root (e.g. "/var/lib/containerd/io.containerd.content.v1.content"). The
+// content store is only read because it's owned by containerd. root can be empty if
+// only kept blobs are served.
+func NewResolveHandler(root string, opts ...Option) (*ResolveHandler, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := new(ResolveHandler)
+	if root != "" {
+		if _, err := os.Stat(filepath.Join(root, "blobs")); err != nil {
+			return nil, fmt.Errorf("failed to open content store %q: %w", root, err)
+		}
+		r.stores = append(r.stores, &readOnlyStore{root})
+	}
+	if o.keepDir != "" {
+		kept, err := local.NewStore(o.keepDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open content store %q: %w", o.keepDir, err)
+		}
+		r.stores = append(r.stores, kept)
+		r.kept, r.keptMaxSize = kept, o.keepMaxSize
+	}
+	return r, nil
+}
+
+func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	for _, s := range r.stores {
+		info, err := s.Info(ctx, desc.Digest)
+		if err != nil {
+			continue
+		}
+		if desc.Size != 0 && desc.Size != info.Size {
+			return nil, 0, fmt.Errorf("invalid size of blob %v %d; want %d", desc.Digest, info.Size, desc.Size)
+		}
+		return &fetcher{store: s, desc: ocispec.Descriptor{Digest: desc.Digest, Size: info.Size}}, info.Size, nil
+	}
+	return nil, 0, fmt.Errorf("blob %v isn't in the content store: %w", desc.Digest, errdefs.ErrNotFound)
+}
+
+// Keep stores the blob of a layer fully fetched by the snapshotter so that the blob is
+// served locally when the layer is resolved again (e.g. after the restart). ra must
+// provide the (compressed) contents of the blob, which are verified with the digest.
+// This is a no-op if the handler doesn't keep blobs.
+func (r *ResolveHandler) Keep(ctx context.Context, desc ocispec.Descriptor, ra io.ReaderAt) error {
+	if r.kept == nil || desc.Size > r.keptMaxSize {
+		return nil
+	}
+	if _, err := r.kept.Info(ctx, desc.Digest); err == nil {
+		return nil // already kept
+	}
+	desc = ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size}
+	ref := "keep-" + desc.Digest.String()
+	if err := content.WriteBlob(ctx, r.kept, ref, io.NewSectionReader(ra, 0, desc.Size), desc); err != nil {
+		if !errdefs.IsUnavailable(err) { // being kept by another call
+			r.kept.Abort(ctx, ref) // don't resume from the broken contents
+		}
+		return fmt.Errorf("failed to keep blob %v: %w", desc.Digest, err)
+	}
+	return r.evictKept(ctx)
+}
+
+// evictKept removes the least recently kept blobs until the total size fits keptMaxSize.
+func (r *ResolveHandler) evictKept(ctx context.Context) error {
+	var (
+		infos []content.Info
+		total int64
+	)
+	if err := r.kept.Walk(ctx, func(info content.Info) error {
+		infos = append(infos, info)
+		total += info.Size
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	for _, info := range infos {
+		if total <= r.keptMaxSize {
+			break
+		}
+		if err := r.kept.Delete(ctx, info.Digest); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+		log.G(ctx).WithField("digest", info.Digest).Debug("removed kept blob")
+		total -= info.Size
+	}
+	return nil
+}
+
+// readOnlyStore reads blobs in the content store of containerd without modifying it.
+type readOnlyStore struct {
+	root string
+}
+
+func (s *readOnlyStore) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+func (s *readOnlyStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	p, err := s.blobPath(dgst)
+	if err != nil {
+		return content.Info{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("content %v: %w", dgst, errdefs.ErrNotFound)
+		}
+		return content.Info{}, err
+	}
+	return content.Info{Digest: dgst, Size: fi.Size(), CreatedAt: fi.ModTime(), UpdatedAt: fi.ModTime()}, nil
+}
+
+func (s *readOnlyStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	p, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("content %v: %w", desc.Digest, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReaderAt{File: f, size: fi.Size()}, nil
+}
+
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (f *fileReaderAt) Size() int64 { return f.size }
+
+type fetcher struct {
+	store provider
+	desc  ocispec.Descriptor
+}
+
+// Fetch opens the blob on each call so that the fetcher doesn't keep the file open.
+func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	ra, err := f.store.ReaderAt(ctx, f.desc)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		Reader: io.NewSectionReader(ra, off, size),
+		Closer: ra,
+	}, nil
+}
+
+// Check returns an error if the blob has been removed from the content store
+// (e.g. by garbage collection).
+func (f *fetcher) Check() error {
+	_, err := f.store.Info(context.Background(), f.desc.Digest)
+	return err
+}
+
+// GenID returns the ID based on the digest so that the cache is shared among images
+// containing the same blob.
+func (f *fetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.desc.Digest, off, size)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package contentstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestResolveHandler(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	blobsDir := filepath.Join(root, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewResolveHandler(root)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	blob := []byte("dummy blob")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+
+	if _, _, err := h.Handle(ctx, desc); err == nil {
+		t.Fatalf("blob missing in the content store must not be served")
+	}
+	blobPath := filepath.Join(blobsDir, desc.Digest.Encoded())
+	if err := os.WriteFile(blobPath, blob, 0600); err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+
+	f, size, err := h.Handle(ctx, ocispec.Descriptor{Digest: desc.Digest})
+	if err != nil {
+		t.Fatalf("failed to handle blob: %v", err)
+	}
+	if size != int64(len(blob)) {
+		t.Fatalf("unexpected size %d; want %d", size, len(blob))
+	}
+	checkFetch(t, f, blob)
+	if err := f.Check(); err != nil {
+		t.Errorf("failed to check: %v", err)
+	}
+	if _, _, err := h.Handle(ctx, ocispec.Descriptor{Digest: desc.Digest, Size: 1}); err == nil {
+		t.Errorf("blob with the wrong size must not be served")
+	}
+	if err := h.Keep(ctx, desc, bytes.NewReader(blob)); err != nil {
+		t.Errorf("keep must be no-op without kept blobs: %v", err)
+	}
+	if err := os.Remove(blobPath); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	if err := f.Check(); err == nil {
+		t.Errorf("check must fail after the blob is removed")
+	}
+
+	// The content store of containerd isn't modified
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "blobs" {
+		t.Errorf("content store is modified: %v", entries)
+	}
+	if _, err := NewResolveHandler(filepath.Join(root, "notexist")); err == nil {
+		t.Errorf("content store must exist")
+	}
+}
+
+func TestKeep(t *testing.T) {
+	ctx := context.Background()
+	h, err := NewResolveHandler("", WithKeptBlobs(t.TempDir(), 20))
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	descOf := func(b []byte) ocispec.Descriptor {
+		return ocispec.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+	}
+	blobA, blobB, blobC := []byte("blob A...."), []byte("blob B...."), []byte("blob C....")
+
+	// Corrupted contents aren't kept
+	if err := h.Keep(ctx, descOf(blobA), bytes.NewReader(blobB)); err == nil {
+		t.Errorf("corrupted blob must not be kept")
+	}
+	if _, _, err := h.Handle(ctx, descOf(blobA)); err == nil {
+		t.Errorf("corrupted blob must not be served")
+	}
+	// Blobs larger than the max size aren't kept
+	large := []byte(strings.Repeat("x", 21))
+	if err := h.Keep(ctx, descOf(large), bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.Handle(ctx, descOf(large)); err == nil {
+		t.Errorf("too large blob must not be kept")
+	}
+
+	for _, b := range [][]byte{blobA, blobB, blobC} {
+		if err := h.Keep(ctx, descOf(b), bytes.NewReader(b)); err != nil {
+			t.Fatalf("failed to keep blob: %v", err)
+		}
+		f, _, err := h.Handle(ctx, descOf(b))
+		if err != nil {
+			t.Fatalf("kept blob must be served: %v", err)
+		}
+		checkFetch(t, f, b)
+		time.Sleep(10 * time.Millisecond) // blobs are evicted in the order they are kept
+	}
+	// The oldest one is evicted
+	if _, _, err := h.Handle(ctx, descOf(blobA)); err == nil {
+		t.Errorf("oldest blob must be evicted")
+	}
+	for _, b := range [][]byte{blobB, blobC} {
+		if _, _, err := h.Handle(ctx, descOf(b)); err != nil {
+			t.Errorf("blob %q must be kept: %v", string(b), err)
+		}
+	}
+}
+
+func checkFetch(t *testing.T, f interface {
+	Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error)
+}, blob []byte) {
+	rc, err := f.Fetch(context.Background(), 2, 5)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(data) != string(blob[2:7]) {
+		t.Errorf("unexpected data %q; want %q", string(data), string(blob[2:7]))
+	}
+}
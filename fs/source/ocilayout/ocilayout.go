@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ocilayout provides a resolve handler which lazily serves blobs of images
+// stored in OCI layout directories (e.g. on local or NFS-mounted storage) instead of
+// registries.
+package ocilayout
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ResolveHandler serves blobs of images referred as "oci-layout://<dir>[:<tag>]"
+// from "<dir>/blobs/<alg>/<encoded>".
+type ResolveHandler struct{}
+
+func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	dir, ok := source.OCILayoutDir(desc.Annotations)
+	if !ok {
+		return nil, 0, fmt.Errorf("blob %v isn't stored in OCI layout", desc.Digest)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, 0, err
+	}
+	p := filepath.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat blob %v in OCI layout %q: %w", desc.Digest, dir, err)
+	}
+	if desc.Size != 0 && desc.Size != fi.Size() {
+		return nil, 0, fmt.Errorf("invalid size of blob %v %d; want %d", desc.Digest, fi.Size(), desc.Size)
+	}
+	return &fetcher{path: p, digest: desc.Digest}, fi.Size(), nil
+}
+
+type fetcher struct {
+	path   string
+	digest digest.Digest
+}
+
+// Fetch opens the blob file on each call so that the blob on shared storage can be
+// served even after the storage is remounted.
+func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		Reader: io.NewSectionReader(file, off, size),
+		Closer: file,
+	}, nil
+}
+
+func (f *fetcher) Check() error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+// GenID returns the ID based on the digest so that the cache is shared among layout
+// directories storing the same blob.
+func (f *fetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.digest, off, size)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
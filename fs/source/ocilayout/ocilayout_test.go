@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocilayout
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestResolveHandler(t *testing.T) {
+	dir := t.TempDir()
+	blob := []byte("dummy blob")
+	dgst := digest.FromBytes(blob)
+	blobDir := filepath.Join(dir, "blobs", dgst.Algorithm().String())
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blobDir, dgst.Encoded()), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := source.OCILayoutScheme + dir + ":latest"
+	sources, err := source.FromDefaultLabels(func(reference.Spec) ([]docker.RegistryHost, error) {
+		t.Fatalf("registry must not be used")
+		return nil, nil
+	})(map[string]string{
+		"containerd.io/snapshot/remote/stargz.reference": ref,
+		"containerd.io/snapshot/remote/stargz.digest":    dgst.String(),
+	})
+	if err != nil {
+		t.Fatalf("failed to get sources: %v", err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("unexpected number of sources %d; want 1", len(sources))
+	}
+	if _, err := sources[0].Hosts(sources[0].Name); err == nil {
+		t.Errorf("image in OCI layout must not have registry hosts")
+	}
+
+	f, size, err := new(ResolveHandler).Handle(context.Background(), sources[0].Target)
+	if err != nil {
+		t.Fatalf("failed to handle blob: %v", err)
+	}
+	if size != int64(len(blob)) {
+		t.Fatalf("unexpected size %d; want %d", size, len(blob))
+	}
+	rc, err := f.Fetch(context.Background(), 2, 5)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(data) != string(blob[2:7]) {
+		t.Errorf("unexpected data %q; want %q", string(data), string(blob[2:7]))
+	}
+	if err := f.Check(); err != nil {
+		t.Errorf("failed to check: %v", err)
+	}
+}
@@ -19,6 +19,7 @@ package source
 import (
 	"context"
 	"fmt"
+	"path"
 	"strings"
 
 	"github.com/containerd/containerd/images"
@@ -58,9 +59,19 @@ type Source struct {
 	// the manifest.
 	// Currently, only layer digests (Manifest.Layers.Digest) will be used.
 	Manifest ocispec.Manifest
+
+	// VerifiedManifestDesc is the descriptor of the manifest containing the blob
+	// whose signature has been verified and VerifiedManifest is that manifest.
+	// These are empty if the signature isn't verified. The filesystem uses the
+	// same manifest for other checks (e.g. the strict verification of the TOC digest).
+	VerifiedManifestDesc ocispec.Descriptor
+	VerifiedManifest     ocispec.Manifest
 }
 
 const (
+	// encAnnotationPrefix is the prefix of annotations of layers encrypted by ocicrypt.
+	encAnnotationPrefix = "org.opencontainers.image.enc."
+
 	// targetRefLabel is a label which contains image reference.
 	targetRefLabel = "containerd.io/snapshot/remote/stargz.reference"
 
@@ -88,10 +99,17 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 		if !ok {
 			return nil, fmt.Errorf("reference hasn't been passed")
 		}
-		refspec, err := reference.Parse(refStr)
+		hosts := hosts
+		refspec, isLayout, err := parseReference(refStr)
 		if err != nil {
 			return nil, err
 		}
+		if isLayout {
+			// Blobs are provided by the OCI layout handler; no registry serves them.
+			hosts = func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+				return nil, fmt.Errorf("image %q is stored in an OCI layout", refspec.String())
+			}
+		}
 
 		digestStr, ok := labels[targetDigestLabel]
 		if !ok {
@@ -112,6 +130,9 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 				}
 				if d.String() != target.String() {
 					desc := ocispec.Descriptor{Digest: d}
+					if isLayout {
+						desc.Annotations = map[string]string{targetRefLabel: refStr}
+					}
 					if urls, ok := labels[targetImageURLsLabelPrefix+fmt.Sprintf("%d", i)]; ok {
 						desc.URLs = strings.Split(urls, ",")
 					}
@@ -139,6 +160,48 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 	}
 }
 
+// OCILayoutScheme is the scheme of references of images stored in OCI layout
+// directories ("oci-layout://<dir>[:<tag>]"). <dir> must be an absolute path.
+const OCILayoutScheme = "oci-layout://"
+
+// OCILayoutDir returns the OCI layout directory which stores the blob if the blob is
+// contained in an image stored in an OCI layout. labels are annotations of the blob
+// descriptor provided by GetSources.
+func OCILayoutDir(labels map[string]string) (string, bool) {
+	ref, ok := labels[targetRefLabel]
+	if !ok {
+		return "", false
+	}
+	dir, _, ok := parseOCILayoutRef(ref)
+	return dir, ok
+}
+
+func parseOCILayoutRef(ref string) (dir, tag string, ok bool) {
+	if !strings.HasPrefix(ref, OCILayoutScheme) {
+		return "", "", false
+	}
+	dir = strings.TrimPrefix(ref, OCILayoutScheme)
+	// The directory can contain ':' so the tag follows the last ':' of the last element.
+	if i := strings.LastIndex(dir, ":"); i > strings.LastIndex(dir, "/") {
+		dir, tag = dir[:i], dir[i+1:]
+	}
+	return dir, tag, true
+}
+
+// parseReference parses the image reference. References of images in OCI layouts are
+// converted to "oci-layout/<dir>[:<tag>]" so that they can be treated as reference.Spec.
+func parseReference(ref string) (refspec reference.Spec, isLayout bool, err error) {
+	dir, tag, ok := parseOCILayoutRef(ref)
+	if !ok {
+		refspec, err = reference.Parse(ref)
+		return refspec, false, err
+	}
+	if !path.IsAbs(dir) {
+		return reference.Spec{}, false, fmt.Errorf("OCI layout directory %q must be an absolute path", dir)
+	}
+	return reference.Spec{Locator: "oci-layout" + path.Clean(dir), Object: tag}, true, nil
+}
+
 // AppendDefaultLabelsHandlerWrapper makes a handler which appends image's basic
 // information to each layer descriptor as annotations during unpack. These
 // annotations will be passed to this remote snapshotter as labels and used to
@@ -152,6 +215,7 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 			}
 			switch desc.MediaType {
 			case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+				layerIndex := 0
 				for i := range children {
 					c := &children[i]
 					if images.IsLayerType(c.MediaType) {
@@ -160,6 +224,9 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 						}
 						c.Annotations[targetRefLabel] = ref
 						c.Annotations[targetDigestLabel] = c.Digest.String()
+						c.Annotations[config.TargetManifestDigestLabel] = desc.Digest.String()
+						c.Annotations[config.TargetLayerIndexLabel] = fmt.Sprintf("%d", layerIndex)
+						layerIndex++
 						var layers string
 						for i, l := range children[i:] {
 							if images.IsLayerType(l.MediaType) {
@@ -178,6 +245,14 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 						}
 						c.Annotations[targetImageLayersLabel] = strings.TrimSuffix(layers, ",")
 						c.Annotations[config.TargetPrefetchSizeLabel] = fmt.Sprintf("%d", prefetchSize)
+						if mode, ok := desc.Annotations[config.TargetBackgroundFetchLabel]; ok {
+							// The mode of the background fetch specified to the image is
+							// applied to the layers unless they specify their own mode.
+							if _, ok := c.Annotations[config.TargetBackgroundFetchLabel]; !ok {
+								c.Annotations[config.TargetBackgroundFetchLabel] = mode
+							}
+						}
+						appendEncryptionLabels(c.Annotations)
 
 						// store URL in annotation to let containerd to pass it to the snapshotter
 						c.Annotations[targetURLsLabel] = appendWithValidation(targetURLsLabel, c.URLs)
@@ -189,6 +264,23 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 	}
 }
 
+// appendEncryptionLabels passes the annotations of the encrypted layer (e.g. wrapped
+// keys) to the snapshotter. Annotations exceeding the size limitation of labels are
+// skipped, in which case the layer can't be decrypted with the keys in them.
+func appendEncryptionLabels(annotations map[string]string) {
+	enc := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, encAnnotationPrefix) {
+			enc[config.TargetEncryptionLabelPrefix+strings.TrimPrefix(k, encAnnotationPrefix)] = v
+		}
+	}
+	for k, v := range enc {
+		if err := labels.Validate(k, v); err == nil {
+			annotations[k] = v
+		}
+	}
+}
+
 func appendWithValidation(key string, values []string) string {
 	var v string
 	for _, u := range values {
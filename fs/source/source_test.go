@@ -0,0 +1,42 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import "testing"
+
+func TestParseOCILayoutRef(t *testing.T) {
+	for _, tt := range []struct {
+		ref     string
+		wantDir string
+		wantTag string
+		wantOK  bool
+	}{
+		{ref: "oci-layout:///images/foo", wantDir: "/images/foo", wantOK: true},
+		{ref: "oci-layout:///images/foo:v1", wantDir: "/images/foo", wantTag: "v1", wantOK: true},
+		{ref: "oci-layout:///images/2023-01-01T00:00:00/foo", wantDir: "/images/2023-01-01T00:00:00/foo", wantOK: true},
+		{ref: "oci-layout:///images/a:b/foo:v1", wantDir: "/images/a:b/foo", wantTag: "v1", wantOK: true},
+		{ref: "example.com/foo:v1"},
+	} {
+		t.Run(tt.ref, func(t *testing.T) {
+			dir, tag, ok := parseOCILayoutRef(tt.ref)
+			if dir != tt.wantDir || tag != tt.wantTag || ok != tt.wantOK {
+				t.Errorf("parseOCILayoutRef(%q) = (%q, %q, %v); want (%q, %q, %v)",
+					tt.ref, dir, tag, ok, tt.wantDir, tt.wantTag, tt.wantOK)
+			}
+		})
+	}
+}
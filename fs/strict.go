@@ -0,0 +1,203 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/hashicorp/go-multierror"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestCacheTTL is the duration a manifest fetched for the strict verification is
+// reused for the other layers of the image.
+const manifestCacheTTL = time.Minute
+
+// manifestCache caches layer descriptors of manifests fetched from registries.
+type manifestCache struct {
+	entries map[string]*manifestEntry
+	mu      sync.Mutex
+}
+
+type manifestEntry struct {
+	once    sync.Once
+	layers  []ocispec.Descriptor
+	err     error
+	expires time.Time
+}
+
+// manifestTOCDigest returns the TOC digest of the layer recorded in the annotations
+// of the layer descriptor in the image manifest. The manifest is fetched from the
+// registry by the digest passed through the labels, or by the reference if the
+// digest isn't passed, so that TOC digests passed through labels or embedded in
+// the blob aren't trusted. An error is returned if the manifest doesn't record the
+// TOC digest or it doesn't match the one passed through the labels.
+func (fs *filesystem) manifestTOCDigest(ctx context.Context, srcs []source.Source, labels map[string]string) (digest.Digest, error) {
+	manifestDigest, ok := labels[config.TargetManifestDigestLabel]
+	if !ok {
+		manifestDigest = labels[criManifestDigestLabel]
+	}
+	var allErr error
+	for _, src := range srcs {
+		layers, err := fs.manifestLayers(ctx, src, manifestDigest)
+		if err != nil {
+			allErr = multierror.Append(allErr, fmt.Errorf("failed to get manifest of %q: %w", src.Name, err))
+			continue
+		}
+		var (
+			desc  ocispec.Descriptor
+			found bool
+		)
+		for _, l := range layers {
+			if l.Digest == src.Target.Digest {
+				desc, found = l, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("layer %v isn't contained in the manifest of %q", src.Target.Digest, src.Name)
+		}
+		tocDigest, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]
+		if !ok {
+			return "", fmt.Errorf("manifest of %q doesn't record TOC digest of layer %v", src.Name, src.Target.Digest)
+		}
+		if passed, ok := labels[estargz.TOCJSONDigestAnnotation]; ok && passed != tocDigest {
+			return "", fmt.Errorf("TOC digest %q of layer %v doesn't match %q recorded in the manifest", passed, src.Target.Digest, tocDigest)
+		}
+		dgst, err := digest.Parse(tocDigest)
+		if err != nil {
+			return "", fmt.Errorf("invalid TOC digest %q in the manifest: %w", tocDigest, err)
+		}
+		return dgst, nil
+	}
+	return "", allErr
+}
+
+// manifestLayers returns the layer descriptors in the manifest of the source image.
+// If the signature of the manifest has been verified, that manifest is used so that
+// the TOC digest is taken from the signed manifest.
+func (fs *filesystem) manifestLayers(ctx context.Context, src source.Source, manifestDigest string) ([]ocispec.Descriptor, error) {
+	if verified := src.VerifiedManifestDesc.Digest; verified != "" {
+		if manifestDigest != "" && manifestDigest != verified.String() {
+			return nil, fmt.Errorf("verified manifest %q doesn't match the pulled one %q", verified, manifestDigest)
+		}
+		return src.VerifiedManifest.Layers, nil
+	}
+	return fs.manifests.layers(ctx, src, manifestDigest)
+}
+
+// layers returns the layer descriptors in the manifest of the source image. If the
+// manifest digest is specified, the manifest (or the index) of the digest is used.
+func (c *manifestCache) layers(ctx context.Context, src source.Source, manifestDigest string) ([]ocispec.Descriptor, error) {
+	ref := src.Name.String()
+	if manifestDigest != "" {
+		ref = src.Name.Locator + "@" + manifestDigest
+	}
+	c.mu.Lock()
+	e, ok := c.entries[ref]
+	if !ok || time.Now().After(e.expires) {
+		for k, old := range c.entries {
+			if time.Now().After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		e = &manifestEntry{expires: time.Now().Add(manifestCacheTTL)}
+		c.entries[ref] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() {
+		e.layers, e.err = fetchManifestLayers(ctx, src, ref)
+	})
+	if e.err != nil {
+		// Don't reuse failures which can be caused by transient errors.
+		c.mu.Lock()
+		if c.entries[ref] == e {
+			delete(c.entries, ref)
+		}
+		c.mu.Unlock()
+	}
+	return e.layers, e.err
+}
+
+func fetchManifestLayers(ctx context.Context, src source.Source, ref string) ([]ocispec.Descriptor, error) {
+	hosts := src.Hosts
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != src.Name.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, src.Name.String())
+			}
+			return hosts(src.Name)
+		},
+	})
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := containerdutil.FetchManifestPlatform(ctx, &verifyingFetcher{fetcher}, desc, platforms.DefaultSpec())
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
+
+// verifyingFetcher verifies that the fetched contents match the digest of the
+// descriptor. The error is returned on EOF.
+type verifyingFetcher struct {
+	remotes.Fetcher
+}
+
+func (f *verifyingFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	r, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{ReadCloser: r, v: desc.Digest.Verifier(), dgst: desc.Digest}, nil
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	v    digest.Verifier
+	dgst digest.Digest
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.v.Write(p[:n])
+	if err == io.EOF && !r.v.Verified() {
+		return n, fmt.Errorf("contents don't match digest %v", r.dgst)
+	}
+	return n, err
+}
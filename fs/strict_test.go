@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestManifestTOCDigest(t *testing.T) {
+	var (
+		manifests = make(map[string][]byte) // tag or digest -> manifest
+		tampered  = make(map[string][]byte) // contents served instead of the manifest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		data, ok := manifests[name]
+		if !ok || !strings.Contains(req.URL.Path, "/manifests/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dgst := digest.FromBytes(data)
+		if d, ok := tampered[name]; ok {
+			data = d
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+	push := func(tag string, layers ...ocispec.Descriptor) digest.Digest {
+		data, err := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: layers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst := digest.FromBytes(data)
+		manifests[tag], manifests[dgst.String()] = data, data
+		return dgst
+	}
+	layerDesc := func(name string, tocDigest digest.Digest) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString(name)}
+		if tocDigest != "" {
+			desc.Annotations = map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest.String()}
+		}
+		return desc
+	}
+	src := func(t *testing.T, tag string, target digest.Digest) []source.Source {
+		refspec, err := reference.Parse(srv.Listener.Addr().String() + "/test:" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []source.Source{{
+			Hosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       srv.Client(),
+					Host:         srv.Listener.Addr().String(),
+					Scheme:       "http",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+				}}, nil
+			},
+			Name:   refspec,
+			Target: ocispec.Descriptor{Digest: target},
+		}}
+	}
+
+	var (
+		tocA         = digest.FromString("toc-a")
+		tocB         = digest.FromString("toc-b")
+		layerA       = layerDesc("a", tocA)
+		legacy       = layerDesc("legacy", "")
+		oldA         = layerDesc("a", tocB) // the same layer annotated differently in another manifest
+		pinned       = push("old", oldA)
+		_            = push("latest", layerA, legacy)
+		tamperedDgst = push("tampered", layerA)
+	)
+	tampered[tamperedDgst.String()] = []byte(`{"layers":[]}`)
+
+	// The manifest verified by the signature isn't fetched again.
+	var (
+		tocC     = digest.FromString("toc-c")
+		verified = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("verified")}
+	)
+
+	tests := []struct {
+		name     string
+		tag      string
+		target   digest.Digest
+		labels   map[string]string
+		verified []ocispec.Descriptor // layers of the verified manifest
+		want     digest.Digest
+		wantErr  bool
+	}{
+		{name: "annotated", tag: "latest", target: layerA.Digest, want: tocA},
+		{name: "label_matches", tag: "latest", target: layerA.Digest, labels: map[string]string{estargz.TOCJSONDigestAnnotation: tocA.String()}, want: tocA},
+		{name: "label_mismatches", tag: "latest", target: layerA.Digest, labels: map[string]string{estargz.TOCJSONDigestAnnotation: tocB.String()}, wantErr: true},
+		{name: "not_annotated", tag: "latest", target: legacy.Digest, wantErr: true},
+		{name: "not_contained", tag: "latest", target: digest.FromString("unknown"), wantErr: true},
+		{name: "pinned_manifest", tag: "latest", target: layerA.Digest, labels: map[string]string{config.TargetManifestDigestLabel: pinned.String()}, want: tocB},
+		{name: "tampered_manifest", tag: "latest", target: layerA.Digest, labels: map[string]string{config.TargetManifestDigestLabel: tamperedDgst.String()}, wantErr: true},
+		{name: "verified_manifest", tag: "latest", target: layerA.Digest, labels: map[string]string{config.TargetManifestDigestLabel: verified.Digest.String()}, verified: []ocispec.Descriptor{layerDesc("a", tocC)}, want: tocC},
+		{name: "verified_other_manifest", tag: "latest", target: layerA.Digest, labels: map[string]string{config.TargetManifestDigestLabel: pinned.String()}, verified: []ocispec.Descriptor{layerDesc("a", tocC)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{manifests: &manifestCache{entries: make(map[string]*manifestEntry)}}
+			labels := tt.labels
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			srcs := src(t, tt.tag, tt.target)
+			if tt.verified != nil {
+				srcs[0].VerifiedManifestDesc = verified
+				srcs[0].VerifiedManifest = ocispec.Manifest{Layers: tt.verified}
+			}
+			got, err := fs.manifestTOCDigest(context.Background(), srcs, labels)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("verification must fail; got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("TOC digest = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
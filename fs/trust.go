@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+const (
+	// RegistryTrustSigned requires the TOC digest recorded in the signed image
+	// manifest.
+	RegistryTrustSigned = "signed"
+
+	// RegistryTrustEmbedded trusts the TOC digest passed through the labels or
+	// embedded in the blob.
+	RegistryTrustEmbedded = "embedded"
+
+	// RegistryTrustUntrusted disables lazy pull.
+	RegistryTrustUntrusted = "untrusted"
+)
+
+// ValidateRegistryTrust checks the patterns and the trusts of the config.
+func ValidateRegistryTrust(cfgs []config.RegistryTrustConfig) error {
+	for i, c := range cfgs {
+		if len(c.Hosts) == 0 {
+			return fmt.Errorf("no host is specified in registry trust #%d", i)
+		}
+		for _, h := range c.Hosts {
+			if _, err := path.Match(h, ""); err != nil {
+				return fmt.Errorf("invalid host pattern %q: %w", h, err)
+			}
+		}
+		switch c.Trust {
+		case RegistryTrustSigned, RegistryTrustEmbedded, RegistryTrustUntrusted:
+		default:
+			return fmt.Errorf("unknown trust %q of registry trust #%d", c.Trust, i)
+		}
+	}
+	return nil
+}
+
+// RegistryTrustOf returns the trust of the registry host according to the config.
+// Empty string is returned if no entry matches the host.
+func RegistryTrustOf(cfgs []config.RegistryTrustConfig, host string) string {
+	for _, c := range cfgs {
+		for _, h := range c.Hosts {
+			if ok, _ := path.Match(h, host); ok {
+				return c.Trust
+			}
+		}
+	}
+	return ""
+}
+
+// strictVerificationOf returns whether layers from the host must be verified with
+// the TOC digest recorded in the image manifest.
+func (fs *filesystem) strictVerificationOf(host string) bool {
+	switch RegistryTrustOf(fs.registryTrust, host) {
+	case RegistryTrustSigned:
+		return true
+	case RegistryTrustEmbedded:
+		return false
+	}
+	return fs.strictVerification
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestRegistryTrust(t *testing.T) {
+	for _, cfgs := range [][]config.RegistryTrustConfig{
+		{{Trust: RegistryTrustSigned}},
+		{{Hosts: []string{"["}, Trust: RegistryTrustSigned}},
+		{{Hosts: []string{"example.com"}, Trust: "unknown"}},
+	} {
+		if err := ValidateRegistryTrust(cfgs); err == nil {
+			t.Errorf("invalid config %+v must be rejected", cfgs)
+		}
+	}
+
+	cfgs := []config.RegistryTrustConfig{
+		{Hosts: []string{"registry.example.com", "*.internal.example.com"}, Trust: RegistryTrustSigned},
+		{Hosts: []string{"docker.io"}, Trust: RegistryTrustEmbedded},
+		{Hosts: []string{"*"}, Trust: RegistryTrustUntrusted},
+	}
+	if err := ValidateRegistryTrust(cfgs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host   string
+		trust  string
+		strict bool
+	}{
+		{host: "registry.example.com", trust: RegistryTrustSigned, strict: true},
+		{host: "a.internal.example.com", trust: RegistryTrustSigned, strict: true},
+		{host: "docker.io", trust: RegistryTrustEmbedded, strict: false},
+		{host: "ghcr.io", trust: RegistryTrustUntrusted, strict: true},
+	} {
+		if trust := RegistryTrustOf(cfgs, tt.host); trust != tt.trust {
+			t.Errorf("trust of %q = %q; want %q", tt.host, trust, tt.trust)
+		}
+		fs := &filesystem{registryTrust: cfgs, strictVerification: true}
+		if strict := fs.strictVerificationOf(tt.host); strict != tt.strict {
+			t.Errorf("strict verification of %q = %v; want %v", tt.host, strict, tt.strict)
+		}
+	}
+	if trust := RegistryTrustOf(cfgs[:2], "ghcr.io"); trust != "" {
+		t.Errorf("trust of unmatched host must be empty; got %q", trust)
+	}
+	if fs := (&filesystem{}); fs.strictVerificationOf("ghcr.io") {
+		t.Errorf("unmatched host must follow strict_verification")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff/apply"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Unpack fetches the layer and applies it to the mounts with containerd's applier.
+// This is used for layers which can't be lazily pulled (e.g. non-eStargz layers)
+// so that the other layers of the image can still be lazily pulled.
+func (fs *filesystem) Unpack(ctx context.Context, mounts []mount.Mount, labels map[string]string) (ocispec.Descriptor, error) {
+	if !fs.unpackNonLazyLayers {
+		return ocispec.Descriptor{}, fmt.Errorf("unpacking layers is disabled: %w", errdefs.ErrNotImplemented)
+	}
+
+	// This is a prioritized task as well as mounting layers.
+	fs.backgroundTaskManager.DoPrioritizedTask()
+	defer fs.backgroundTaskManager.DonePrioritizedTask()
+
+	src, err := fs.getSources(labels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	} else if len(src) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("source must be passed")
+	}
+
+	// Nothing is applied until the blob is opened so we can try all sources here.
+	var (
+		br   *blobReaderAt
+		desc ocispec.Descriptor
+		rErr = fmt.Errorf("failed to open layer")
+	)
+	for _, s := range src {
+		br, desc, err = fs.openBlob(ctx, s)
+		if err == nil {
+			break
+		}
+		rErr = fmt.Errorf("failed to open layer %q from %q: %v: %w", s.Target.Digest, s.Name, err, rErr)
+	}
+	if br == nil {
+		return ocispec.Descriptor{}, rErr
+	}
+	defer br.Close()
+
+	start := time.Now()
+	diff, err := apply.NewFileSystemApplier(&blobProvider{br}).Apply(ctx, desc, mounts)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to apply layer %q: %w", desc.Digest, err)
+	}
+	if err := br.verify(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	log.G(ctx).WithField("digest", desc.Digest).WithField("diffID", diff.Digest).
+		WithField("latency", time.Since(start).Milliseconds()).Debug("unpacked layer")
+	return diff, nil
+}
+
+// openBlob opens the layer blob of the source. Resolve handlers are tried before
+// the registry. The media type of the returned descriptor is detected from the
+// contents because it isn't passed through labels.
+func (fs *filesystem) openBlob(ctx context.Context, s source.Source) (*blobReaderAt, ocispec.Descriptor, error) {
+	desc := s.Target
+	rc, size, err := fs.openBlobWithHandlers(ctx, desc)
+	if err != nil {
+		rc, size, err = openBlobFromRegistry(ctx, s)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+	}
+	desc.Size = size
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(10)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, ocispec.Descriptor{}, err
+	}
+	switch compression.DetectCompression(magic) {
+	case compression.Gzip:
+		desc.MediaType = ocispec.MediaTypeImageLayerGzip
+	case compression.Zstd:
+		desc.MediaType = ocispec.MediaTypeImageLayerZstd
+	default:
+		desc.MediaType = ocispec.MediaTypeImageLayer
+	}
+	return &blobReaderAt{
+		r:        br,
+		closer:   rc,
+		size:     size,
+		dgst:     desc.Digest,
+		digester: desc.Digest.Algorithm().Digester(),
+	}, desc, nil
+}
+
+func (fs *filesystem) openBlobWithHandlers(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, int64, error) {
+	rErr := fmt.Errorf("no handler provides the blob")
+	for name, h := range fs.resolveHandlers {
+		f, size, err := h.Handle(ctx, desc)
+		if err != nil {
+			rErr = fmt.Errorf("handler %q: %v: %w", name, err, rErr)
+			continue
+		}
+		rc, err := f.Fetch(ctx, 0, size)
+		if err != nil {
+			rErr = fmt.Errorf("handler %q: %v: %w", name, err, rErr)
+			continue
+		}
+		return rc, size, nil
+	}
+	return nil, 0, rErr
+}
+
+func openBlobFromRegistry(ctx context.Context, s source.Source) (io.ReadCloser, int64, error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != s.Name.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, s.Name.String())
+			}
+			return s.Hosts(s.Name)
+		},
+	})
+	ref := s.Name.Locator + "@" + s.Target.Digest.String()
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	desc.URLs = s.Target.URLs
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, desc.Size, nil
+}
+
+// blobProvider provides the blob to the applier. The blob isn't closed by the
+// applier so that the rest of it can be verified after applied.
+type blobProvider struct {
+	br *blobReaderAt
+}
+
+func (p *blobProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return &nopCloserReaderAt{p.br}, nil
+}
+
+type nopCloserReaderAt struct {
+	*blobReaderAt
+}
+
+func (r *nopCloserReaderAt) Close() error { return nil }
+
+// blobReaderAt is a content.ReaderAt which reads the blob stream from the beginning
+// to the end. Random access isn't supported.
+type blobReaderAt struct {
+	r        io.Reader
+	closer   io.Closer
+	size     int64
+	off      int64
+	dgst     digest.Digest
+	digester digest.Digester
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off != b.off {
+		return 0, fmt.Errorf("non-sequential read at %d (current offset %d)", off, b.off)
+	} else if off >= b.size {
+		return 0, io.EOF
+	}
+	if remain := b.size - off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	n, err := io.ReadFull(b.r, p)
+	b.digester.Hash().Write(p[:n])
+	b.off += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // the blob is smaller than the size
+	}
+	return n, err
+}
+
+func (b *blobReaderAt) Size() int64 {
+	return b.size
+}
+
+func (b *blobReaderAt) Close() error {
+	return b.closer.Close()
+}
+
+// verify reads the rest of the blob and verifies the digest of the entire blob.
+func (b *blobReaderAt) verify() error {
+	if _, err := io.Copy(io.Discard, io.NewSectionReader(b, b.off, b.size-b.off)); err != nil {
+		return fmt.Errorf("failed to read the rest of the blob: %w", err)
+	}
+	if d := b.digester.Digest(); d != b.dgst {
+		return fmt.Errorf("invalid digest %v of the blob; want %v", d, b.dgst)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/nydus"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	"github.com/containerd/stargz-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ztocIndexCache caches the ztocs discovered through the referrers of image manifests
+// so that the referrers are looked up once for all layers of an image. Images without
+// the index are cached as well.
+type ztocIndexCache struct {
+	entries map[string]*ztocIndexEntry
+	mu      sync.Mutex
+}
+
+type ztocIndexEntry struct {
+	once    sync.Once
+	ztocs   map[digest.Digest]digest.Digest
+	err     error
+	expires time.Time
+}
+
+// withDiscoveredZtoc looks up the ztoc of the layer in the latest ztoc index pushed as a
+// referrer of the image manifest (by `ctr-remote image ztoc --push-referrer`) if the
+// layer is passed without TOC or ztoc digest. If the ztoc is found, the sources and the
+// labels annotated with the ztoc digests are returned. Otherwise, they are returned as is.
+func (fs *filesystem) withDiscoveredZtoc(ctx context.Context, src []source.Source, labels map[string]string) ([]source.Source, map[string]string) {
+	if fs.ztocIndexes == nil {
+		return src, labels
+	}
+	for _, k := range []string{estargz.TOCJSONDigestAnnotation, config.TargetZtocDigestLabel,
+		nydus.LayerAnnotationNydusBootstrap, nydus.LayerAnnotationNydusBlob} {
+		if _, ok := labels[k]; ok {
+			return src, labels
+		}
+	}
+	manifestDigest, ok := labels[config.TargetManifestDigestLabel]
+	if !ok {
+		manifestDigest = labels[criManifestDigestLabel]
+	}
+	for i, s := range src {
+		ztocs, err := fs.ztocIndexes.ztocs(ctx, s, manifestDigest)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to discover ztoc index of %q", s.Name)
+			continue
+		}
+		z, ok := ztocs[s.Target.Digest]
+		if !ok {
+			continue
+		}
+		log.G(ctx).WithField("ztoc", z).Debugf("discovered ztoc of the layer")
+		newSrc := append([]source.Source{}, src...)
+		newSrc[i].Target.Annotations = withZtocAnnotation(s.Target.Annotations, z)
+		// The other layers are pre-resolved with their ztocs as well.
+		newSrc[i].Manifest.Layers = append([]ocispec.Descriptor{}, s.Manifest.Layers...)
+		for j, l := range newSrc[i].Manifest.Layers {
+			if lz, ok := ztocs[l.Digest]; ok {
+				newSrc[i].Manifest.Layers[j].Annotations = withZtocAnnotation(l.Annotations, lz)
+			}
+		}
+		return newSrc, withZtocAnnotation(labels, z)
+	}
+	return src, labels
+}
+
+// withZtocAnnotation returns a copy of the annotations with the ztoc digest.
+func withZtocAnnotation(annotations map[string]string, z digest.Digest) map[string]string {
+	res := make(map[string]string, len(annotations)+1)
+	for k, v := range annotations {
+		res[k] = v
+	}
+	res[config.TargetZtocDigestLabel] = z.String()
+	return res
+}
+
+// ztocs returns the digests of ztocs keyed by the digests of the layers of the source
+// image. If the manifest digest is specified, the referrers of the manifest (or the
+// manifest for the current platform in the index of the digest) are used.
+func (c *ztocIndexCache) ztocs(ctx context.Context, src source.Source, manifestDigest string) (map[digest.Digest]digest.Digest, error) {
+	ref := src.Name.String()
+	if manifestDigest != "" {
+		ref = src.Name.Locator + "@" + manifestDigest
+	}
+	c.mu.Lock()
+	e, ok := c.entries[ref]
+	if !ok || time.Now().After(e.expires) {
+		for k, old := range c.entries {
+			if time.Now().After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		e = &ztocIndexEntry{expires: time.Now().Add(manifestCacheTTL)}
+		c.entries[ref] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() {
+		e.ztocs, e.err = fetchZtocReferrer(ctx, src, ref)
+	})
+	if e.err != nil {
+		// Don't reuse failures which can be caused by transient errors.
+		c.mu.Lock()
+		if c.entries[ref] == e {
+			delete(c.entries, ref)
+		}
+		c.mu.Unlock()
+	}
+	return e.ztocs, e.err
+}
+
+func fetchZtocReferrer(ctx context.Context, src source.Source, ref string) (map[digest.Digest]digest.Digest, error) {
+	srcHosts := src.Hosts
+	hosts := func(host string) ([]docker.RegistryHost, error) {
+		if host != src.Name.Hostname() {
+			return nil, fmt.Errorf("unexpected host %q for image ref %q", host, src.Name.String())
+		}
+		return srcHosts(src.Name)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	if images.IsIndexType(desc.MediaType) {
+		p, err := referrers.Fetch(ctx, resolver, ref, desc)
+		if err != nil {
+			return nil, err
+		}
+		var idx ocispec.Index
+		if err := json.Unmarshal(p, &idx); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, m := range idx.Manifests {
+			if images.IsManifestType(m.MediaType) && (m.Platform == nil || platforms.Default().Match(*m.Platform)) {
+				desc, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("manifest for the current platform isn't found in %q", ref)
+		}
+	}
+	return ztoc.FetchReferrer(ctx, resolver, ref, desc.Digest, referrers.WithRegistryHosts(hosts))
+}
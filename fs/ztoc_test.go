@@ -0,0 +1,210 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	"github.com/containerd/stargz-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDiscoverZtoc(t *testing.T) {
+	var (
+		manifests = make(map[string][]byte) // digest -> manifest
+		refs      = make(map[string][]byte) // subject digest -> referrers
+		requests  = make(map[string]int)    // path -> number of requests
+		mu        sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[req.URL.Path]++
+		name := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		var (
+			data      []byte
+			ok        bool
+			mediaType = ocispec.MediaTypeImageManifest
+		)
+		if strings.Contains(req.URL.Path, "/referrers/") {
+			data, ok = refs[name]
+			if !ok {
+				data, ok = []byte(`{"schemaVersion":2,"manifests":[]}`), true
+			}
+			mediaType = ocispec.MediaTypeImageIndex
+		} else if strings.Contains(req.URL.Path, "/manifests/") {
+			data, ok = manifests[name]
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+	push := func(v interface{}) digest.Digest {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst := digest.FromBytes(data)
+		manifests[dgst.String()] = data
+		return dgst
+	}
+	layer := func(name string) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString(name)}
+	}
+	ztocOf := func(l ocispec.Descriptor) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   ztoc.MediaTypeZtoc,
+			Digest:      digest.FromString("ztoc-" + l.Digest.String()),
+			Annotations: map[string]string{ztoc.LayerDigestAnnotation: l.Digest.String()},
+		}
+	}
+	pushIndex := func(subject digest.Digest, ztocs ...ocispec.Descriptor) {
+		dgst := push(referrers.Manifest{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: ztoc.IndexArtifactType,
+			Config:       ocispec.Descriptor{MediaType: ztoc.MediaTypeIndexConfig},
+			Layers:       ztocs,
+		})
+		data, err := json.Marshal(referrers.Index{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []referrers.Descriptor{{
+				Descriptor:   ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst, Size: int64(len(manifests[dgst.String()]))},
+				ArtifactType: ztoc.IndexArtifactType,
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs[subject.String()] = data
+	}
+
+	var (
+		layerA, layerB, layerC = layer("a"), layer("b"), layer("c")
+		indexed                = push(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layerA, layerB, layerC}})
+		notIndexed             = push(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layerA}})
+	)
+	pushIndex(indexed, ztocOf(layerA), ztocOf(layerB))
+
+	src := func(target ocispec.Descriptor) []source.Source {
+		refspec, err := reference.Parse(srv.Listener.Addr().String() + "/test:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []source.Source{{
+			Hosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       srv.Client(),
+					Host:         srv.Listener.Addr().String(),
+					Scheme:       "http",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+				}}, nil
+			},
+			Name:     refspec,
+			Target:   target,
+			Manifest: ocispec.Manifest{Layers: []ocispec.Descriptor{target, layerB, layerC}},
+		}}
+	}
+	tests := []struct {
+		name     string
+		disabled bool
+		target   ocispec.Descriptor
+		labels   map[string]string
+		want     digest.Digest
+	}{
+		{name: "indexed", target: layerA, labels: map[string]string{config.TargetManifestDigestLabel: indexed.String()}, want: ztocOf(layerA).Digest},
+		{name: "cri_manifest_digest", target: layerA, labels: map[string]string{criManifestDigestLabel: indexed.String()}, want: ztocOf(layerA).Digest},
+		{name: "layer_not_indexed", target: layerC, labels: map[string]string{config.TargetManifestDigestLabel: indexed.String()}},
+		{name: "manifest_not_indexed", target: layerA, labels: map[string]string{config.TargetManifestDigestLabel: notIndexed.String()}},
+		{name: "estargz", target: layerA, labels: map[string]string{config.TargetManifestDigestLabel: indexed.String(), estargz.TOCJSONDigestAnnotation: digest.FromString("toc").String()}},
+		{name: "disabled", disabled: true, target: layerA, labels: map[string]string{config.TargetManifestDigestLabel: indexed.String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{}
+			if !tt.disabled {
+				fs.ztocIndexes = &ztocIndexCache{entries: make(map[string]*ztocIndexEntry)}
+			}
+			mu.Lock()
+			requests = make(map[string]int)
+			mu.Unlock()
+			for i := 0; i < 2; i++ {
+				labels := make(map[string]string)
+				for k, v := range tt.labels {
+					labels[k] = v
+				}
+				gotSrc, gotLabels := fs.withDiscoveredZtoc(context.Background(), src(tt.target), labels)
+				if len(labels) != len(tt.labels) {
+					t.Errorf("passed labels must not be modified")
+				}
+				got := gotLabels[config.TargetZtocDigestLabel]
+				if got != tt.want.String() && !(got == "" && tt.want == "") {
+					t.Fatalf("ztoc label = %q; want %q", got, tt.want)
+				}
+				if g := gotSrc[0].Target.Annotations[config.TargetZtocDigestLabel]; g != got {
+					t.Errorf("ztoc annotation of the target = %q; want %q", g, got)
+				}
+				if tt.want == "" {
+					continue
+				}
+				for _, l := range gotSrc[0].Manifest.Layers {
+					var want string
+					if l.Digest != layerC.Digest {
+						want = ztocOf(l).Digest.String()
+					}
+					if g := l.Annotations[config.TargetZtocDigestLabel]; g != want {
+						t.Errorf("ztoc annotation of layer %v = %q; want %q", l.Digest, g, want)
+					}
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !tt.disabled && tt.name != "estargz" && len(requests) == 0 {
+				t.Errorf("referrers must be looked up")
+			}
+			for p, n := range requests {
+				if tt.disabled || tt.name == "estargz" {
+					t.Errorf("registry must not be accessed but %q is requested", p)
+				} else if n > 2 { // HEAD and GET
+					t.Errorf("referrers must be cached but %q is requested %d times", p, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ReferenceTypeAnnotation is the annotation of a manifest in an index which
+	// indicates the type of the manifest (e.g. attestation manifests created by
+	// BuildKit).
+	ReferenceTypeAnnotation = "vnd.docker.reference.type"
+
+	// ReferenceDigestAnnotation is the annotation of a manifest in an index which
+	// contains the digest of the manifest that the manifest refers to.
+	ReferenceDigestAnnotation = "vnd.docker.reference.digest"
+
+	// AttestationManifestType is the value of ReferenceTypeAnnotation of attestation
+	// manifests (e.g. provenance and SBOM).
+	AttestationManifestType = "attestation-manifest"
+
+	// manifestGCLabelPrefix is the prefix of GC reference labels of manifests in an
+	// index, followed by the position of the manifest.
+	manifestGCLabelPrefix = "containerd.io/gc.ref.content.m."
+)
+
+// Option is an option of IndexConvertFunc.
+type Option func(*options)
+
+type options struct {
+	keepUnconvertedPlatforms bool
+	convertHook              func(orig, converted ocispec.Descriptor)
+}
+
+// WithKeepUnconvertedPlatforms keeps manifests of platforms not matching the
+// platform matcher in the converted index as they are instead of removing them.
+func WithKeepUnconvertedPlatforms() Option {
+	return func(o *options) {
+		o.keepUnconvertedPlatforms = true
+	}
+}
+
+// WithConvertHook registers a function called with every image manifest and index
+// kept in the converted image, and its descriptor after conversion. Both descriptors
+// are the same if the manifest isn't modified. Attestation manifests aren't passed.
+// This can be used to re-attach referrers of the source manifests to the converted
+// ones.
+func WithConvertHook(f func(orig, converted ocispec.Descriptor)) Option {
+	return func(o *options) {
+		o.convertHook = f
+	}
+}
+
+// IndexConvertFunc returns a convert func which can be passed to
+// converter.WithIndexConvertFunc. This is the same as converter.DefaultIndexConvertFunc
+// except that it preserves the structure of an image index: attestation manifests
+// (e.g. provenance and SBOM created by BuildKit) of the converted manifests are kept
+// and re-attached to the converted manifests, and annotations of the index are kept.
+// Manifests of unconverted platforms are kept if WithKeepUnconvertedPlatforms is
+// specified.
+//
+// Note that attestation manifests aren't modified so statements in them still
+// describe the source manifests.
+func IndexConvertFunc(layerConvertFunc converter.ConvertFunc, docker2oci bool, platformMC platforms.MatchComparer, opts ...Option) converter.ConvertFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	convertManifest := converter.DefaultIndexConvertFunc(layerConvertFunc, docker2oci, platformMC)
+	hook := func(orig ocispec.Descriptor, converted *ocispec.Descriptor) {
+		if o.convertHook == nil {
+			return
+		}
+		if converted == nil {
+			converted = &orig
+		}
+		o.convertHook(orig, *converted)
+	}
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsIndexType(desc.MediaType) {
+			newDesc, err := convertManifest(ctx, cs, desc)
+			if err != nil {
+				return nil, err
+			}
+			if images.IsManifestType(desc.MediaType) {
+				hook(desc, newDesc)
+			}
+			return newDesc, nil
+		}
+		newDesc, err := convertIndex(ctx, cs, desc, convertManifest, docker2oci, platformMC, o.keepUnconvertedPlatforms, hook)
+		if err != nil {
+			return nil, err
+		}
+		hook(desc, newDesc)
+		return newDesc, nil
+	}
+}
+
+func convertIndex(ctx context.Context, cs content.Store, desc ocispec.Descriptor, convertManifest converter.ConvertFunc,
+	docker2oci bool, platformMC platforms.MatchComparer, keepUnconverted bool, hook func(ocispec.Descriptor, *ocispec.Descriptor)) (*ocispec.Descriptor, error) {
+
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	p, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(p, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index %v: %w", desc.Digest, err)
+	}
+	modified := false
+	if images.IsDockerType(index.MediaType) && docker2oci {
+		index.MediaType = converter.ConvertDockerMediaTypeToOCI(index.MediaType)
+		modified = true
+	}
+
+	var (
+		newManifests = make([]*ocispec.Descriptor, len(index.Manifests)) // nil if removed
+		converted    = make(map[digest.Digest]ocispec.Descriptor)        // source digest -> kept manifest
+		mu           sync.Mutex
+	)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, m := range index.Manifests {
+		i, m := i, m
+		if isAttestation(m) {
+			continue // handled after their subjects are converted
+		}
+		if m.Platform != nil && !platformMC.Match(*m.Platform) {
+			if keepUnconverted {
+				mu.Lock()
+				newManifests[i] = &m
+				converted[m.Digest] = m
+				mu.Unlock()
+			}
+			continue
+		}
+		eg.Go(func() error {
+			newM, err := convertManifest(egCtx, cs, m)
+			if err != nil {
+				return err
+			}
+			if newM == nil {
+				newM = &m
+			}
+			mu.Lock()
+			newManifests[i] = newM
+			converted[m.Digest] = *newM
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	for i, m := range index.Manifests {
+		m := m
+		if !isAttestation(m) {
+			if newManifests[i] != nil {
+				hook(m, newManifests[i])
+			}
+			continue
+		}
+		subject, ok := converted[digest.Digest(m.Annotations[ReferenceDigestAnnotation])]
+		if !ok {
+			continue // the subject has been removed
+		}
+		m.Annotations = copyAnnotations(m.Annotations)
+		m.Annotations[ReferenceDigestAnnotation] = subject.Digest.String()
+		newManifests[i] = &m
+	}
+
+	var result []ocispec.Descriptor
+	for i, m := range newManifests {
+		if m == nil || m.Digest != index.Manifests[i].Digest ||
+			m.MediaType != index.Manifests[i].MediaType ||
+			m.Annotations[ReferenceDigestAnnotation] != index.Manifests[i].Annotations[ReferenceDigestAnnotation] {
+			modified = true
+		}
+		if m != nil {
+			result = append(result, *m)
+		}
+	}
+	if !modified {
+		return nil, nil
+	}
+	index.Manifests = result
+
+	labels := make(map[string]string)
+	for k, v := range info.Labels {
+		labels[k] = v
+	}
+	for k := range labels {
+		if strings.HasPrefix(k, manifestGCLabelPrefix) {
+			delete(labels, k)
+		}
+	}
+	for i, m := range index.Manifests {
+		labels[fmt.Sprintf("%s%d", manifestGCLabelPrefix, i)] = m.Digest.String()
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	newDesc := desc
+	if images.IsDockerType(desc.MediaType) && docker2oci {
+		newDesc.MediaType = converter.ConvertDockerMediaTypeToOCI(desc.MediaType)
+	}
+	newDesc.Digest = digest.FromBytes(b)
+	newDesc.Size = int64(len(b))
+	if err := content.WriteBlob(ctx, cs, newDesc.Digest.String(), bytes.NewReader(b), newDesc, content.WithLabels(labels)); err != nil {
+		return nil, fmt.Errorf("failed to write index: %w", err)
+	}
+	return &newDesc, nil
+}
+
+// isAttestation returns true if the descriptor in an index is an attestation manifest.
+func isAttestation(desc ocispec.Descriptor) bool {
+	return desc.Annotations[ReferenceTypeAnnotation] == AttestationManifestType
+}
+
+func copyAnnotations(a map[string]string) map[string]string {
+	c := make(map[string]string, len(a))
+	for k, v := range a {
+		c[k] = v
+	}
+	return c
+}
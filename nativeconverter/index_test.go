@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIndexConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), &testLabelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64 := writeTestManifest(ctx, t, cs, "amd64")
+	arm64 := writeTestManifest(ctx, t, cs, "arm64")
+	attestation := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{}),
+		Layers: []ocispec.Descriptor{
+			writeTestBlob(ctx, t, cs, "application/vnd.in-toto+json", []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)),
+		},
+	})
+	attestation.Platform = &ocispec.Platform{OS: "unknown", Architecture: "unknown"}
+	attestation.Annotations = map[string]string{
+		ReferenceTypeAnnotation:   AttestationManifestType,
+		ReferenceDigestAnnotation: amd64.Digest.String(),
+	}
+	armAttestation := attestation
+	armAttestation.Annotations = map[string]string{
+		ReferenceTypeAnnotation:   AttestationManifestType,
+		ReferenceDigestAnnotation: arm64.Digest.String(),
+	}
+	indexDesc := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   []ocispec.Descriptor{amd64, arm64, attestation, armAttestation},
+		Annotations: map[string]string{"org.opencontainers.image.source": "https://example.com/foo"},
+	})
+
+	// layerConvertFunc replaces the contents of the layers.
+	layerConvertFunc := func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			return nil, nil
+		}
+		p, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		newDesc := writeTestBlob(ctx, t, cs, desc.MediaType, append([]byte("converted-"), p...))
+		return &newDesc, nil
+	}
+	platformMC := platforms.Only(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+
+	for _, tt := range []struct {
+		name            string
+		keepUnconverted bool
+		want            []digest.Digest // digests of subjects of attestations; empty for non-attestations
+		keptARM         bool
+	}{
+		{name: "default", want: []digest.Digest{"", amd64.Digest}},
+		{name: "keep-unconverted", keepUnconverted: true, want: []digest.Digest{"", "", amd64.Digest, arm64.Digest}, keptARM: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.keepUnconverted {
+				opts = append(opts, WithKeepUnconvertedPlatforms())
+			}
+			hooked := make(map[digest.Digest]digest.Digest)
+			opts = append(opts, WithConvertHook(func(orig, converted ocispec.Descriptor) {
+				hooked[orig.Digest] = converted.Digest
+			}))
+			newDesc, err := IndexConvertFunc(layerConvertFunc, true, platformMC, opts...)(ctx, cs, indexDesc)
+			if err != nil {
+				t.Fatalf("failed to convert: %v", err)
+			}
+			if newDesc == nil {
+				t.Fatalf("index must be converted")
+			}
+			var index ocispec.Index
+			p, err := content.ReadBlob(ctx, cs, *newDesc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(p, &index); err != nil {
+				t.Fatal(err)
+			}
+			if index.Annotations["org.opencontainers.image.source"] != "https://example.com/foo" {
+				t.Errorf("annotations of the index must be kept: %+v", index.Annotations)
+			}
+			if len(index.Manifests) != len(tt.want) {
+				t.Fatalf("unexpected manifests: %+v", index.Manifests)
+			}
+			newAMD64 := index.Manifests[0]
+			if newAMD64.Digest == amd64.Digest || newAMD64.Platform == nil || newAMD64.Platform.Architecture != "amd64" {
+				t.Errorf("amd64 manifest must be converted: %+v", newAMD64)
+			}
+			if hooked[amd64.Digest] != newAMD64.Digest || hooked[indexDesc.Digest] != newDesc.Digest {
+				t.Errorf("unexpected hook calls: %+v", hooked)
+			}
+			if tt.keptARM {
+				if index.Manifests[1].Digest != arm64.Digest || hooked[arm64.Digest] != arm64.Digest {
+					t.Errorf("arm64 manifest must be kept as is: %+v", index.Manifests[1])
+				}
+			} else if _, ok := hooked[arm64.Digest]; ok {
+				t.Errorf("removed manifest must not be hooked")
+			}
+			for i, subject := range tt.want {
+				m := index.Manifests[i]
+				if subject == "" {
+					if isAttestation(m) {
+						t.Errorf("manifest %d must not be an attestation: %+v", i, m)
+					}
+					continue
+				}
+				if !isAttestation(m) || m.Digest != attestation.Digest {
+					t.Fatalf("manifest %d must be the attestation: %+v", i, m)
+				}
+				want := subject.String()
+				if subject == amd64.Digest {
+					want = newAMD64.Digest.String()
+				}
+				if got := m.Annotations[ReferenceDigestAnnotation]; got != want {
+					t.Errorf("attestation %d must refer to %v; got %v", i, want, got)
+				}
+			}
+			info, err := cs.Info(ctx, newDesc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range index.Manifests {
+				if k := fmt.Sprintf("%s%d", manifestGCLabelPrefix, i); info.Labels[k] != m.Digest.String() {
+					t.Errorf("unexpected GC label %q: %q", k, info.Labels[k])
+				}
+			}
+		})
+	}
+}
+
+func writeTestManifest(ctx context.Context, t *testing.T, cs content.Store, arch string) ocispec.Descriptor {
+	layer := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayer, []byte("layer-"+arch))
+	config := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Architecture: arch,
+		OS:           "linux",
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	desc := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	desc.Platform = &ocispec.Platform{OS: "linux", Architecture: arch}
+	return desc
+}
+
+func writeTestJSON(ctx context.Context, t *testing.T, cs content.Store, mediaType string, v interface{}) ocispec.Descriptor {
+	p, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestBlob(ctx, t, cs, mediaType, p)
+}
+
+func writeTestBlob(ctx context.Context, t *testing.T, cs content.Store, mediaType string, p []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(p), Size: int64(len(p))}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// testLabelStore is a label store of the local content store on memory.
+type testLabelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func (s *testLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[dgst], nil
+}
+
+func (s *testLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = labels
+	return nil
+}
+
+func (s *testLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return labels, nil
+}
@@ -14,5 +14,6 @@
    limitations under the License.
 */
 
-// Package nativeconverter requires this empty file to pass golangci-lint
+// Package nativeconverter provides functions to convert images, which are shared by the
+// layer converters in the subpackages.
 package nativeconverter
@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"fmt"
+)
+
+// lz4BlockDecompress decompresses the LZ4 block (without frame) to dst and returns the
+// size of the decompressed data.
+// See also: https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+func lz4BlockDecompress(dst, src []byte) (int, error) {
+	var si, di int
+	readLength := func(l int) (int, error) {
+		if l != 15 {
+			return l, nil
+		}
+		for {
+			if si >= len(src) {
+				return 0, fmt.Errorf("lz4: truncated length")
+			}
+			b := src[si]
+			si++
+			l += int(b)
+			if b != 255 {
+				return l, nil
+			}
+		}
+	}
+	for si < len(src) {
+		token := src[si]
+		si++
+
+		// Literals
+		litLen, err := readLength(int(token >> 4))
+		if err != nil {
+			return 0, err
+		}
+		if si+litLen > len(src) || di+litLen > len(dst) {
+			return 0, fmt.Errorf("lz4: invalid literal length %d", litLen)
+		}
+		di += copy(dst[di:], src[si:si+litLen])
+		si += litLen
+		if si == len(src) {
+			break // The last sequence contains only literals.
+		}
+
+		// Match
+		if si+2 > len(src) {
+			return 0, fmt.Errorf("lz4: truncated offset")
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, fmt.Errorf("lz4: invalid offset %d", offset)
+		}
+		matchLen, err := readLength(int(token & 0xf))
+		if err != nil {
+			return 0, err
+		}
+		matchLen += 4
+		if di+matchLen > len(dst) {
+			return 0, fmt.Errorf("lz4: output overflow")
+		}
+		// The match can overlap with the output so copy byte by byte.
+		for i := 0; i < matchLen; i++ {
+			dst[di] = dst[di-offset]
+			di++
+		}
+	}
+	return di, nil
+}
@@ -0,0 +1,362 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package nydus provides a reader of Nydus (https://nydus.dev) images.
+//
+// A Nydus image consists of blob layers containing chunks of file contents and a
+// bootstrap layer (the topmost layer) containing the RAFS metadata of the whole
+// filesystem of the image. This package supports RAFS v5 bootstraps.
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// LayerAnnotationNydusBlob is an annotation of a Nydus blob layer.
+	LayerAnnotationNydusBlob = "containerd.io/snapshot/nydus-blob"
+
+	// LayerAnnotationNydusBootstrap is an annotation of a Nydus bootstrap layer.
+	LayerAnnotationNydusBootstrap = "containerd.io/snapshot/nydus-bootstrap"
+
+	// MediaTypeNydusBlob is the media type of Nydus blob layers.
+	MediaTypeNydusBlob = "application/vnd.oci.image.layer.nydus.blob.v1"
+
+	// BootstrapFileName is the path of the bootstrap in the bootstrap layer.
+	BootstrapFileName = "image/image.boot"
+)
+
+const (
+	superBlockSize = 8192
+	rafsMagic      = 0x52414653
+	rafsV5         = 0x500
+	alignment      = 8
+	rootIno        = 1
+)
+
+// Flags of the super block.
+const (
+	flagCompressionNone = 0x1
+	flagCompressionLZ4  = 0x2
+	flagDigesterBlake3  = 0x4
+	flagDigesterSHA256  = 0x8
+	flagCompressionGzip = 0x40
+	flagCompressionZstd = 0x80
+)
+
+// File types and mode bits of inodes.
+const (
+	modeTypeMask = 0170000
+	modeSocket   = 0140000
+	modeSymlink  = 0120000
+	modeRegular  = 0100000
+	modeBlock    = 0060000
+	modeDir      = 0040000
+	modeChar     = 0020000
+	modeFifo     = 0010000
+	modeSetuid   = 04000
+	modeSetgid   = 02000
+	modeSticky   = 01000
+)
+
+// Flags of inodes.
+const (
+	inodeFlagSymlink = 0x1
+	inodeFlagXattr   = 0x4
+)
+
+// Flags of chunks.
+const (
+	chunkFlagCompressed = 0x1
+)
+
+type superBlock struct {
+	Magic                    uint32
+	Version                  uint32
+	SBSize                   uint32
+	BlockSize                uint32
+	Flags                    uint64
+	InodesCount              uint64
+	InodeTableOffset         uint64
+	PrefetchTableOffset      uint64
+	BlobTableOffset          uint64
+	InodeTableEntries        uint32
+	PrefetchTableEntries     uint32
+	BlobTableSize            uint32
+	ExtendedBlobTableEntries uint32
+	ExtendedBlobTableOffset  uint64
+}
+
+type inode struct {
+	Digest      [32]byte
+	Parent      uint64
+	Ino         uint64
+	UID         uint32
+	GID         uint32
+	ProjID      uint32
+	Mode        uint32
+	Size        uint64
+	Blocks      uint64
+	Flags       uint64
+	Nlink       uint32
+	ChildIndex  uint32
+	ChildCount  uint32
+	NameSize    uint16
+	SymlinkSize uint16
+	Rdev        uint32
+	MtimeNsec   uint32
+	Mtime       uint64
+	Reserved    [8]byte
+}
+
+type chunkInfo struct {
+	BlockID            [32]byte
+	BlobIndex          uint32
+	Flags              uint32
+	CompressedSize     uint32
+	UncompressedSize   uint32
+	CompressedOffset   uint64
+	UncompressedOffset uint64
+	FileOffset         uint64
+	Index              uint32
+	Reserved           uint32
+}
+
+var (
+	inodeSize     = int64(binary.Size(inode{}))
+	chunkInfoSize = int64(binary.Size(chunkInfo{}))
+)
+
+// Bootstrap is a parsed RAFS v5 bootstrap.
+type Bootstrap struct {
+	sb      superBlock
+	sr      *io.SectionReader
+	blobIDs []string
+}
+
+// ParseBootstrap parses the super block and the blob table of the bootstrap.
+func ParseBootstrap(sr *io.SectionReader) (*Bootstrap, error) {
+	var sb superBlock
+	if err := binary.Read(io.NewSectionReader(sr, 0, superBlockSize), binary.LittleEndian, &sb); err != nil {
+		return nil, fmt.Errorf("failed to read super block: %w", err)
+	}
+	if sb.Magic != rafsMagic {
+		return nil, fmt.Errorf("invalid magic number %#x of bootstrap", sb.Magic)
+	}
+	if sb.Version != rafsV5 {
+		return nil, fmt.Errorf("unsupported RAFS version %#x; only v5 is supported", sb.Version)
+	}
+	switch c := sb.Flags & (flagCompressionNone | flagCompressionLZ4 | flagCompressionGzip | flagCompressionZstd); c {
+	case flagCompressionNone, flagCompressionLZ4, flagCompressionGzip, flagCompressionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression flags %#x", c)
+	}
+
+	p := make([]byte, sb.BlobTableSize)
+	if _, err := sr.ReadAt(p, int64(sb.BlobTableOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read blob table: %w", err)
+	}
+	var blobIDs []string
+	for len(p) >= 8 {
+		// Each entry is readahead offset (u32), readahead size (u32) and NUL-terminated blob ID.
+		p = p[8:]
+		i := bytes.IndexByte(p, 0)
+		if i < 0 {
+			i = len(p)
+		}
+		if i == 0 {
+			break // padding
+		}
+		blobIDs = append(blobIDs, string(p[:i]))
+		if i < len(p) {
+			i++
+		}
+		p = p[i:]
+	}
+	return &Bootstrap{sb: sb, sr: sr, blobIDs: blobIDs}, nil
+}
+
+// BlobIDs returns the IDs of blobs referred by the bootstrap. The ID of a blob is the
+// hex-encoded sha256 digest of the blob layer.
+func (b *Bootstrap) BlobIDs() []string {
+	return b.blobIDs
+}
+
+// inodeOffset returns the offset of the inode in the bootstrap.
+func (b *Bootstrap) inodeOffset(ino uint32) (int64, error) {
+	if ino < rootIno || ino > b.sb.InodeTableEntries {
+		return 0, fmt.Errorf("inode %d not found", ino)
+	}
+	var off uint32
+	if err := binary.Read(io.NewSectionReader(b.sr, int64(b.sb.InodeTableOffset)+int64(ino-1)*4, 4), binary.LittleEndian, &off); err != nil {
+		return 0, fmt.Errorf("failed to read inode table: %w", err)
+	}
+	if off == 0 {
+		return 0, fmt.Errorf("inode %d not found", ino)
+	}
+	return int64(off) << 3, nil
+}
+
+// rawInode is the inode and its trailing data.
+type rawInode struct {
+	inode
+	name    string
+	symlink string
+	xattrs  map[string][]byte
+	chunks  []chunkInfo
+}
+
+func (b *Bootstrap) readInode(ino uint32) (*rawInode, error) {
+	off, err := b.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	r := &rawInode{}
+	if err := binary.Read(io.NewSectionReader(b.sr, off, inodeSize), binary.LittleEndian, &r.inode); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", ino, err)
+	}
+	off += inodeSize
+	name := make([]byte, r.NameSize)
+	if _, err := b.sr.ReadAt(name, off); err != nil {
+		return nil, fmt.Errorf("failed to read the name of inode %d: %w", ino, err)
+	}
+	r.name = string(name)
+	off += align(int64(r.NameSize))
+	if r.Flags&inodeFlagSymlink != 0 {
+		symlink := make([]byte, r.SymlinkSize)
+		if _, err := b.sr.ReadAt(symlink, off); err != nil {
+			return nil, fmt.Errorf("failed to read the symlink of inode %d: %w", ino, err)
+		}
+		r.symlink = string(symlink)
+		off += align(int64(r.SymlinkSize))
+	}
+	if r.Flags&inodeFlagXattr != 0 {
+		var size uint64
+		if err := binary.Read(io.NewSectionReader(b.sr, off, 8), binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("failed to read xattrs of inode %d: %w", ino, err)
+		}
+		p := make([]byte, size)
+		if _, err := b.sr.ReadAt(p, off+8); err != nil {
+			return nil, fmt.Errorf("failed to read xattrs of inode %d: %w", ino, err)
+		}
+		if r.xattrs, err = parseXattrs(p); err != nil {
+			return nil, fmt.Errorf("invalid xattrs of inode %d: %w", ino, err)
+		}
+		off += 8 + align(int64(size))
+	}
+	if r.Mode&modeTypeMask == modeRegular && r.ChildCount > 0 {
+		r.chunks = make([]chunkInfo, r.ChildCount)
+		if err := binary.Read(io.NewSectionReader(b.sr, off, chunkInfoSize*int64(r.ChildCount)), binary.LittleEndian, r.chunks); err != nil {
+			return nil, fmt.Errorf("failed to read chunks of inode %d: %w", ino, err)
+		}
+	}
+	return r, nil
+}
+
+// prefetchInodes returns the inodes listed in the prefetch table.
+func (b *Bootstrap) prefetchInodes() ([]uint32, error) {
+	if b.sb.PrefetchTableEntries == 0 {
+		return nil, nil
+	}
+	inos := make([]uint32, b.sb.PrefetchTableEntries)
+	if err := binary.Read(io.NewSectionReader(b.sr, int64(b.sb.PrefetchTableOffset), int64(len(inos))*4), binary.LittleEndian, inos); err != nil {
+		return nil, fmt.Errorf("failed to read prefetch table: %w", err)
+	}
+	return inos, nil
+}
+
+// parseXattrs parses xattr pairs. Each pair is the size (u32) and "<name>\0<value>".
+func parseXattrs(p []byte) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	for len(p) > 0 {
+		if len(p) < 4 {
+			return nil, fmt.Errorf("truncated xattr")
+		}
+		size := binary.LittleEndian.Uint32(p)
+		p = p[4:]
+		if uint32(len(p)) < size {
+			return nil, fmt.Errorf("truncated xattr")
+		}
+		pair := p[:size]
+		p = p[size:]
+		i := bytes.IndexByte(pair, 0)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid xattr pair")
+		}
+		xattrs[string(pair[:i])] = pair[i+1:]
+	}
+	return xattrs, nil
+}
+
+func align(n int64) int64 {
+	return (n + alignment - 1) &^ (alignment - 1)
+}
+
+// fileMode converts the mode of the inode to os.FileMode.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & modeTypeMask {
+	case modeDir:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeBlock:
+		mode |= os.ModeDevice
+	case modeChar:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case modeFifo:
+		mode |= os.ModeNamedPipe
+	case modeSocket:
+		mode |= os.ModeSocket
+	}
+	if m&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// ReadBootstrapLayer extracts the bootstrap from the bootstrap layer (gzip-compressed tar).
+func ReadBootstrapLayer(r io.Reader) ([]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress bootstrap layer: %w", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%q not found in bootstrap layer", BootstrapFileName)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse bootstrap layer: %w", err)
+		}
+		if cleanName(h.Name) == BootstrapFileName {
+			return io.ReadAll(tr)
+		}
+	}
+}
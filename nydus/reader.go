@@ -0,0 +1,465 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const maxWalkDepth = 10000
+
+// Blob is a Nydus blob layer referred by the bootstrap.
+type Blob interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// reader provides metadata of the whole filesystem of a Nydus image based on the bootstrap.
+type reader struct {
+	sr     *io.SectionReader
+	bs     *Bootstrap
+	blobs  []Blob
+	digest digest.Digest
+	nodes  map[uint32]*node
+	owner  bool
+
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderOnce sync.Once
+	zstdDecoderErr  error
+}
+
+type node struct {
+	attr     metadata.Attr
+	children map[string]uint32
+	chunks   []chunk
+	prefetch bool
+}
+
+// chunk is a range of the file contents. hole is true if the range is a hole.
+type chunk struct {
+	offset int64
+	size   int64
+	digest string
+	info   chunkInfo
+	hole   bool
+}
+
+// NewReader returns a metadata reader of the filesystem of the Nydus image. sr is the
+// bootstrap layer, bs is the bootstrap and blobs are the blob layers corresponding to
+// bs.BlobIDs(). dgst is the digest of the bootstrap layer and is used as the TOC digest
+// for verification. Blobs are closed when the reader is closed.
+func NewReader(sr *io.SectionReader, bs *Bootstrap, blobs []Blob, dgst digest.Digest) (metadata.Reader, error) {
+	if len(blobs) != len(bs.blobIDs) {
+		return nil, fmt.Errorf("%d blobs are required but got %d", len(bs.blobIDs), len(blobs))
+	}
+	r := &reader{
+		sr:     sr,
+		bs:     bs,
+		blobs:  blobs,
+		digest: dgst,
+		nodes:  make(map[uint32]*node),
+		owner:  true,
+	}
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reader) init() error {
+	// ids maps inode numbers of hardlinks to the first inode in the table.
+	ids := make(map[uint64]uint32)
+	var walk func(ino uint32, ri *rawInode, depth int) (uint32, error)
+	walk = func(ino uint32, ri *rawInode, depth int) (uint32, error) {
+		if depth > maxWalkDepth {
+			return 0, fmt.Errorf("tree is too deep (depth:%d)", depth)
+		}
+		if id, ok := ids[ri.Ino]; ok && ri.Mode&modeTypeMask != modeDir {
+			return id, nil // hardlink
+		}
+		ids[ri.Ino] = ino
+		n := &node{attr: r.attr(ri)}
+		r.nodes[ino] = n
+		switch ri.Mode & modeTypeMask {
+		case modeDir:
+			n.children = make(map[string]uint32)
+			for i := uint32(0); i < ri.ChildCount; i++ {
+				cino := ri.ChildIndex + i
+				if _, ok := r.nodes[cino]; ok {
+					return 0, fmt.Errorf("inode %d is referred multiple times", cino)
+				}
+				cri, err := r.bs.readInode(cino)
+				if err != nil {
+					return 0, err
+				}
+				cid, err := walk(cino, cri, depth+1)
+				if err != nil {
+					return 0, err
+				}
+				n.children[cri.name] = cid
+			}
+		case modeRegular:
+			n.chunks = r.chunks(ri)
+		}
+		return ino, nil
+	}
+	root, err := r.bs.readInode(rootIno)
+	if err != nil {
+		return err
+	}
+	if root.Mode&modeTypeMask != modeDir {
+		return fmt.Errorf("root inode isn't a directory")
+	}
+	if _, err := walk(rootIno, root, 0); err != nil {
+		return err
+	}
+
+	prefetch, err := r.bs.prefetchInodes()
+	if err != nil {
+		return err
+	}
+	var mark func(id uint32)
+	mark = func(id uint32) {
+		n, ok := r.nodes[id]
+		if !ok || n.prefetch {
+			return
+		}
+		n.prefetch = true
+		for _, cid := range n.children {
+			mark(cid)
+		}
+	}
+	for _, ino := range prefetch {
+		mark(ino)
+	}
+	return nil
+}
+
+func (r *reader) attr(ri *rawInode) (attr metadata.Attr) {
+	attr.Size = int64(ri.Size)
+	attr.ModTime = time.Unix(int64(ri.Mtime), int64(ri.MtimeNsec))
+	attr.LinkName = ri.symlink
+	attr.Mode = fileMode(ri.Mode)
+	attr.UID = int(ri.UID)
+	attr.GID = int(ri.GID)
+	attr.DevMajor = int((ri.Rdev >> 8) & 0xfff)
+	attr.DevMinor = int((ri.Rdev & 0xff) | ((ri.Rdev >> 12) & 0xfff00))
+	attr.Xattrs = ri.xattrs
+	attr.NumLink = int(ri.Nlink)
+	if ri.Mode&modeTypeMask != modeRegular {
+		attr.Size = 0
+	}
+	return
+}
+
+// chunks returns ranges of the file contents. Holes are filled with ranges of zeros.
+func (r *reader) chunks(ri *rawInode) (chunks []chunk) {
+	infos := append([]chunkInfo{}, ri.chunks...)
+	sort.Slice(infos, func(i, j int) bool { return infos[i].FileOffset < infos[j].FileOffset })
+	size := int64(ri.Size)
+	blockSize := int64(r.bs.sb.BlockSize)
+	if blockSize <= 0 {
+		blockSize = 1 << 20
+	}
+	addHole := func(off, end int64) {
+		for off < end {
+			n := end - off
+			if n > blockSize {
+				n = blockSize
+			}
+			chunks = append(chunks, chunk{offset: off, size: n, digest: zeroDigest(n), hole: true})
+			off += n
+		}
+	}
+	var off int64
+	for _, info := range infos {
+		foff := int64(info.FileOffset)
+		if foff < off || foff >= size {
+			continue // overlapping or out of the file
+		}
+		addHole(off, foff)
+		csize := int64(info.UncompressedSize)
+		if foff+csize > size {
+			csize = size - foff
+		}
+		c := chunk{offset: foff, size: csize, info: info}
+		if r.bs.sb.Flags&flagDigesterSHA256 != 0 {
+			c.digest = digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(info.BlockID[:])).String()
+		}
+		chunks = append(chunks, c)
+		off = foff + csize
+	}
+	addHole(off, size)
+	return
+}
+
+var (
+	zeroDigests   = make(map[int64]string)
+	zeroDigestsMu sync.Mutex
+)
+
+func zeroDigest(size int64) string {
+	zeroDigestsMu.Lock()
+	defer zeroDigestsMu.Unlock()
+	if d, ok := zeroDigests[size]; ok {
+		return d
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, zeroReader{}, size); err != nil {
+		return ""
+	}
+	d := digest.NewDigest(digest.SHA256, h).String()
+	zeroDigests[size] = d
+	return d
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (r *reader) node(id uint32) (*node, error) {
+	n, ok := r.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("entry %d not found", id)
+	}
+	return n, nil
+}
+
+func (r *reader) RootID() uint32 {
+	return rootIno
+}
+
+// TOCDigest returns the digest of the bootstrap layer. This is empty if the digests of
+// chunks can't be verified (i.e. the digester isn't sha256) or this is a blob layer.
+func (r *reader) TOCDigest() digest.Digest {
+	if r.bs == nil || r.bs.sb.Flags&flagDigesterSHA256 == 0 {
+		return ""
+	}
+	return r.digest
+}
+
+// GetOffset returns 0 for entries listed in the prefetch table of the bootstrap and the
+// size of the bootstrap layer for others. This makes only the entries in the prefetch table
+// prefetched.
+func (r *reader) GetOffset(id uint32) (offset int64, err error) {
+	n, err := r.node(id)
+	if err != nil {
+		return 0, err
+	}
+	if n.prefetch {
+		return 0, nil
+	}
+	return r.sr.Size(), nil
+}
+
+func (r *reader) GetAttr(id uint32) (attr metadata.Attr, err error) {
+	n, err := r.node(id)
+	if err != nil {
+		return attr, err
+	}
+	return n.attr, nil
+}
+
+func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Attr, err error) {
+	n, err := r.node(pid)
+	if err != nil {
+		return 0, attr, err
+	}
+	id, ok := n.children[base]
+	if !ok {
+		return 0, attr, fmt.Errorf("child %q of entry %d not found", base, pid)
+	}
+	return id, r.nodes[id].attr, nil
+}
+
+func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
+	n, err := r.node(id)
+	if err != nil {
+		return err
+	}
+	for name, cid := range n.children {
+		if !f(name, cid, r.nodes[cid].attr.Mode) {
+			break
+		}
+	}
+	return nil
+}
+
+func (r *reader) OpenFile(id uint32) (metadata.File, error) {
+	n, err := r.node(id)
+	if err != nil {
+		return nil, err
+	}
+	if !n.attr.Mode.IsRegular() {
+		return nil, fmt.Errorf("entry %d isn't a regular file", id)
+	}
+	return &file{r: r, n: n}, nil
+}
+
+// Clone returns a reader sharing the metadata and the blobs. sr is ignored because the
+// contents are read from the blob layers.
+func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
+	return &reader{
+		sr:     r.sr,
+		bs:     r.bs,
+		blobs:  r.blobs,
+		digest: r.digest,
+		nodes:  r.nodes,
+	}, nil
+}
+
+func (r *reader) Close() (retErr error) {
+	if !r.owner {
+		return nil
+	}
+	for _, b := range r.blobs {
+		if err := b.Close(); err != nil {
+			retErr = err
+		}
+	}
+	return
+}
+
+// readChunk reads the uncompressed data of the chunk.
+func (r *reader) readChunk(c chunk) ([]byte, error) {
+	p := make([]byte, c.size)
+	if c.hole {
+		return p, nil
+	}
+	info := c.info
+	if int(info.BlobIndex) >= len(r.blobs) {
+		return nil, fmt.Errorf("blob %d not found", info.BlobIndex)
+	}
+	raw := make([]byte, info.CompressedSize)
+	if n, err := r.blobs[info.BlobIndex].ReadAt(raw, int64(info.CompressedOffset)); n != len(raw) {
+		return nil, fmt.Errorf("failed to read chunk from blob %q: %w", r.bs.blobIDs[info.BlobIndex], err)
+	}
+	if info.Flags&chunkFlagCompressed == 0 {
+		copy(p, raw)
+		return p, nil
+	}
+	uncompressed := make([]byte, info.UncompressedSize)
+	switch r.bs.sb.Flags & (flagCompressionNone | flagCompressionLZ4 | flagCompressionGzip | flagCompressionZstd) {
+	case flagCompressionLZ4:
+		if _, err := lz4BlockDecompress(uncompressed, raw); err != nil {
+			return nil, err
+		}
+	case flagCompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(zr, uncompressed); err != nil {
+			return nil, err
+		}
+	case flagCompressionZstd:
+		r.zstdDecoderOnce.Do(func() {
+			r.zstdDecoder, r.zstdDecoderErr = zstd.NewReader(nil)
+		})
+		if r.zstdDecoderErr != nil {
+			return nil, r.zstdDecoderErr
+		}
+		var err error
+		if uncompressed, err = r.zstdDecoder.DecodeAll(raw, uncompressed[:0]); err != nil {
+			return nil, err
+		}
+	default:
+		copy(uncompressed, raw)
+	}
+	copy(p, uncompressed)
+	return p, nil
+}
+
+type file struct {
+	r *reader
+	n *node
+}
+
+func (f *file) chunk(offset int64) (int, bool) {
+	chunks := f.n.chunks
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].offset+chunks[i].size > offset
+	})
+	if i == len(chunks) || offset < chunks[i].offset {
+		return 0, false
+	}
+	return i, true
+}
+
+func (f *file) ChunkEntryForOffset(offset int64) (off int64, size int64, dgst string, ok bool) {
+	i, ok := f.chunk(offset)
+	if !ok {
+		return 0, 0, "", false
+	}
+	c := f.n.chunks[i]
+	return c.offset, c.size, c.digest, true
+}
+
+func (f *file) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		i, ok := f.chunk(off + int64(n))
+		if !ok {
+			return n, io.EOF
+		}
+		c := f.n.chunks[i]
+		data, err := f.r.readChunk(c)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[off+int64(n)-c.offset:])
+	}
+	return n, nil
+}
+
+func cleanName(name string) string {
+	// Remove leading "/" and "./"
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// NewBlobLayerReader returns a metadata reader of a Nydus blob layer. This provides an
+// empty directory because the bootstrap layer provides the whole filesystem of the image.
+func NewBlobLayerReader(sr *io.SectionReader) (metadata.Reader, error) {
+	return &reader{
+		sr: sr,
+		nodes: map[uint32]*node{
+			rootIno: {
+				attr:     metadata.Attr{Mode: os.ModeDir | 0755, NumLink: 2},
+				children: make(map[string]uint32),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,307 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testInode struct {
+	name     string
+	ino      uint64
+	mode     uint32
+	size     uint64
+	nlink    uint32
+	children [2]uint32 // index and count
+	symlink  string
+	xattrs   map[string]string
+	chunks   []chunkInfo
+}
+
+type testBlob struct {
+	*bytes.Reader
+}
+
+func (testBlob) Close() error { return nil }
+
+// buildBootstrap builds a RAFS v5 bootstrap. inodes are stored in the inode table in order.
+func buildBootstrap(t *testing.T, flags uint64, blobIDs []string, prefetch []uint32, inodes []testInode) []byte {
+	var blobTable bytes.Buffer
+	for _, id := range blobIDs {
+		binary.Write(&blobTable, binary.LittleEndian, [2]uint32{})
+		blobTable.WriteString(id + "\x00")
+	}
+	pad(&blobTable)
+	var prefetchTable bytes.Buffer
+	binary.Write(&prefetchTable, binary.LittleEndian, prefetch)
+	pad(&prefetchTable)
+
+	inodeTableOffset := int64(superBlockSize)
+	inodeTableSize := align(int64(len(inodes)) * 4)
+	prefetchTableOffset := inodeTableOffset + inodeTableSize
+	blobTableOffset := prefetchTableOffset + int64(prefetchTable.Len())
+	inodesOffset := blobTableOffset + int64(blobTable.Len())
+
+	var inodeData bytes.Buffer
+	var inodeTable []uint32
+	for _, in := range inodes {
+		inodeTable = append(inodeTable, uint32((inodesOffset+int64(inodeData.Len()))>>3))
+		var iflags uint64
+		if in.symlink != "" {
+			iflags |= inodeFlagSymlink
+		}
+		if len(in.xattrs) > 0 {
+			iflags |= inodeFlagXattr
+		}
+		childIndex, childCount := in.children[0], in.children[1]
+		if len(in.chunks) > 0 {
+			childCount = uint32(len(in.chunks))
+		}
+		binary.Write(&inodeData, binary.LittleEndian, inode{
+			Ino:         in.ino,
+			Mode:        in.mode,
+			Size:        in.size,
+			Flags:       iflags,
+			Nlink:       in.nlink,
+			ChildIndex:  childIndex,
+			ChildCount:  childCount,
+			NameSize:    uint16(len(in.name)),
+			SymlinkSize: uint16(len(in.symlink)),
+			Mtime:       1000,
+		})
+		inodeData.WriteString(in.name)
+		pad(&inodeData)
+		if in.symlink != "" {
+			inodeData.WriteString(in.symlink)
+			pad(&inodeData)
+		}
+		if len(in.xattrs) > 0 {
+			var x bytes.Buffer
+			for k, v := range in.xattrs {
+				binary.Write(&x, binary.LittleEndian, uint32(len(k)+1+len(v)))
+				x.WriteString(k + "\x00" + v)
+			}
+			binary.Write(&inodeData, binary.LittleEndian, uint64(x.Len()))
+			pad(&x)
+			inodeData.Write(x.Bytes())
+		}
+		binary.Write(&inodeData, binary.LittleEndian, in.chunks)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, superBlock{
+		Magic:                rafsMagic,
+		Version:              rafsV5,
+		SBSize:               superBlockSize,
+		BlockSize:            1 << 20,
+		Flags:                flags,
+		InodesCount:          uint64(len(inodes)),
+		InodeTableOffset:     uint64(inodeTableOffset),
+		PrefetchTableOffset:  uint64(prefetchTableOffset),
+		BlobTableOffset:      uint64(blobTableOffset),
+		InodeTableEntries:    uint32(len(inodes)),
+		PrefetchTableEntries: uint32(len(prefetch)),
+		BlobTableSize:        uint32(blobTable.Len()),
+	})
+	buf.Write(make([]byte, superBlockSize-buf.Len()))
+	binary.Write(&buf, binary.LittleEndian, inodeTable)
+	buf.Write(make([]byte, int(prefetchTableOffset)-buf.Len()))
+	buf.Write(prefetchTable.Bytes())
+	buf.Write(blobTable.Bytes())
+	buf.Write(inodeData.Bytes())
+	return buf.Bytes()
+}
+
+func pad(b *bytes.Buffer) {
+	b.Write(make([]byte, align(int64(b.Len()))-int64(b.Len())))
+}
+
+// addChunk appends the chunk to the blob and returns the chunk info.
+func addChunk(t *testing.T, blob *bytes.Buffer, blobIndex uint32, fileOffset uint64, data []byte, compress bool) chunkInfo {
+	info := chunkInfo{
+		BlockID:          sha256.Sum256(data),
+		BlobIndex:        blobIndex,
+		UncompressedSize: uint32(len(data)),
+		CompressedOffset: uint64(blob.Len()),
+		FileOffset:       fileOffset,
+	}
+	p := data
+	if compress {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = enc.EncodeAll(data, nil)
+		info.Flags |= chunkFlagCompressed
+	}
+	info.CompressedSize = uint32(len(p))
+	blob.Write(p)
+	return info
+}
+
+func TestReader(t *testing.T) {
+	var blob0, blob1 bytes.Buffer
+	data1 := bytes.Repeat([]byte("0123456789"), 10000)
+	data2 := []byte("hello")
+	a1 := addChunk(t, &blob0, 0, 0, data1[:60000], true)
+	a2 := addChunk(t, &blob1, 1, 60000, data1[60000:], false)
+	b1 := addChunk(t, &blob1, 1, 100, data2, true) // The first 100 bytes are a hole
+	blobIDs := []string{"blob0", "blob1"}
+
+	bootstrap := buildBootstrap(t, flagCompressionZstd|flagDigesterSHA256, blobIDs, []uint32{3}, []testInode{
+		{name: "/", ino: 1, mode: modeDir | 0755, nlink: 3, children: [2]uint32{2, 3}},
+		{name: "a", ino: 2, mode: modeRegular | 0644, size: uint64(len(data1)), nlink: 2, chunks: []chunkInfo{a1, a2}, xattrs: map[string]string{"user.foo": "bar"}},
+		{name: "d", ino: 3, mode: modeDir | 0755, nlink: 2, children: [2]uint32{5, 3}},
+		{name: "link", ino: 4, mode: modeSymlink | 0777, nlink: 1, symlink: "d/b"},
+		{name: "b", ino: 5, mode: modeRegular | 0600, size: 100 + uint64(len(data2)), nlink: 1, chunks: []chunkInfo{b1}},
+		{name: "empty", ino: 6, mode: modeRegular | 0600, nlink: 1},
+		{name: "hardlink", ino: 2, mode: modeRegular | 0644, size: uint64(len(data1)), nlink: 2, chunks: []chunkInfo{a1, a2}},
+	})
+
+	// Wrap the bootstrap with the bootstrap layer
+	var layer bytes.Buffer
+	zw := gzip.NewWriter(&layer)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: BootstrapFileName, Mode: 0644, Size: int64(len(bootstrap))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(bootstrap); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadBootstrapLayer(bytes.NewReader(layer.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read bootstrap layer: %v", err)
+	}
+	bs, err := ParseBootstrap(io.NewSectionReader(bytes.NewReader(p), 0, int64(len(p))))
+	if err != nil {
+		t.Fatalf("failed to parse bootstrap: %v", err)
+	}
+	if ids := bs.BlobIDs(); len(ids) != 2 || ids[0] != "blob0" || ids[1] != "blob1" {
+		t.Fatalf("unexpected blob IDs %v", ids)
+	}
+	layerDgst := digest.FromBytes(layer.Bytes())
+	r, err := NewReader(io.NewSectionReader(bytes.NewReader(layer.Bytes()), 0, int64(layer.Len())), bs,
+		[]Blob{testBlob{bytes.NewReader(blob0.Bytes())}, testBlob{bytes.NewReader(blob1.Bytes())}}, layerDgst)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	defer r.Close()
+	if r.TOCDigest() != layerDgst {
+		t.Errorf("unexpected TOC digest %v; want %v", r.TOCDigest(), layerDgst)
+	}
+
+	lookup := func(names ...string) uint32 {
+		id := r.RootID()
+		for _, name := range names {
+			var err error
+			if id, _, err = r.GetChild(id, name); err != nil {
+				t.Fatalf("failed to get %v: %v", names, err)
+			}
+		}
+		return id
+	}
+	readFile := func(id uint32) []byte {
+		attr, err := r.GetAttr(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := r.OpenFile(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		for off := int64(0); off < attr.Size; {
+			coff, csize, dgst, ok := f.ChunkEntryForOffset(off)
+			if !ok || coff != off {
+				t.Fatalf("unexpected chunk at %d", off)
+			}
+			p := make([]byte, csize)
+			if n, err := f.ReadAt(p, coff); n != len(p) {
+				t.Fatalf("failed to read chunk at %d: %v", coff, err)
+			}
+			if digest.FromBytes(p).String() != dgst {
+				t.Fatalf("unexpected digest of chunk at %d", coff)
+			}
+			data = append(data, p...)
+			off += csize
+		}
+		return data
+	}
+
+	if got := readFile(lookup("a")); !bytes.Equal(got, data1) {
+		t.Errorf("unexpected contents of a")
+	}
+	if got := readFile(lookup("d", "b")); !bytes.Equal(got, append(make([]byte, 100), data2...)) {
+		t.Errorf("unexpected contents of d/b %q", got)
+	}
+	if got := readFile(lookup("d", "empty")); len(got) != 0 {
+		t.Errorf("unexpected contents of d/empty %q", got)
+	}
+	if lookup("d", "hardlink") != lookup("a") {
+		t.Errorf("hardlink must point to a")
+	}
+	if _, attr, _ := r.GetChild(r.RootID(), "a"); string(attr.Xattrs["user.foo"]) != "bar" || attr.NumLink != 2 || attr.Mode.Perm() != 0644 {
+		t.Errorf("unexpected attr of a: %+v", attr)
+	}
+	if _, attr, _ := r.GetChild(r.RootID(), "link"); attr.LinkName != "d/b" || attr.Mode&os.ModeSymlink == 0 {
+		t.Errorf("unexpected attr of link: %+v", attr)
+	}
+	for _, c := range []struct {
+		names    []string
+		prefetch bool
+	}{{[]string{"link"}, false}, {[]string{"d"}, true}, {[]string{"d", "b"}, true}} {
+		off, err := r.GetOffset(lookup(c.names...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (off == 0) != c.prefetch {
+			t.Errorf("unexpected offset of %v: %d", c.names, off)
+		}
+	}
+}
+
+func TestLZ4BlockDecompress(t *testing.T) {
+	// "abcabcabcabcx": literals "abc", match (offset 3, length 9), literals "x"
+	src := []byte{0x35, 'a', 'b', 'c', 0x03, 0x00, 0x10, 'x'}
+	dst := make([]byte, 13)
+	n, err := lz4BlockDecompress(dst, src)
+	if err != nil {
+		t.Fatalf("failed to decompress: %v", err)
+	}
+	if got := string(dst[:n]); got != "abcabcabcabcx" {
+		t.Errorf("unexpected data %q", got)
+	}
+	if _, err := lz4BlockDecompress(dst, []byte{0x15, 'a', 0x05, 0x00}); err == nil {
+		t.Errorf("invalid offset must be an error")
+	}
+}
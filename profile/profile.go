@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package profile provides file access profiles of images recorded by the analyzer.
+// A profile can be published to a registry as an OCI artifact which refers to the
+// profiled image so that the recording and the conversion of the image can be done
+// separately.
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/recorder"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ArtifactType is the artifact type of the profile.
+	ArtifactType = "application/vnd.containerd.stargz.profile.v1"
+
+	// MediaTypeRecord is the media type of the record of file accesses
+	// (newline-delimited JSON of recorder.Entry).
+	MediaTypeRecord = "application/vnd.containerd.stargz.profile.record.v1+json"
+)
+
+// Push pushes the record to the repository of ref as a profile of the subject manifest.
+func Push(ctx context.Context, resolver remotes.Resolver, ref string, subject ocispec.Descriptor, record []byte, opts ...referrers.Option) (referrers.Descriptor, error) {
+	config := ocispec.Descriptor{
+		MediaType: referrers.MediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(referrers.EmptyJSON),
+		Size:      int64(len(referrers.EmptyJSON)),
+	}
+	recordDesc := ocispec.Descriptor{
+		MediaType: MediaTypeRecord,
+		Digest:    digest.FromBytes(record),
+		Size:      int64(len(record)),
+	}
+	return referrers.Push(ctx, resolver, ref, referrers.Manifest{
+		ArtifactType: ArtifactType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{recordDesc},
+		Subject: &ocispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Annotations: map[string]string{
+			ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+	}, map[digest.Digest][]byte{
+		config.Digest:     referrers.EmptyJSON,
+		recordDesc.Digest: record,
+	}, opts...)
+}
+
+// Fetch fetches the latest profile of the subject manifest from the repository of ref and
+// returns the record. If no profile is found, an error wrapping errdefs.ErrNotFound is returned.
+func Fetch(ctx context.Context, resolver remotes.Resolver, ref string, subject digest.Digest, opts ...referrers.Option) ([]byte, error) {
+	profiles, err := referrers.List(ctx, resolver, ref, subject, ArtifactType, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("profile of %v: %w", subject, errdefs.ErrNotFound)
+	}
+	latest := profiles[0]
+	for _, p := range profiles[1:] {
+		// RFC3339 timestamps in UTC can be compared as strings
+		if p.Annotations[ocispec.AnnotationCreated] >= latest.Annotations[ocispec.AnnotationCreated] {
+			latest = p
+		}
+	}
+	m, err := referrers.FetchManifest(ctx, resolver, ref, latest.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range m.Layers {
+		if l.MediaType == MediaTypeRecord {
+			return referrers.Fetch(ctx, resolver, ref, l)
+		}
+	}
+	return nil, fmt.Errorf("record isn't found in profile %v", latest.Digest)
+}
+
+// LayerFiles parses the record and returns the accessed files of each layer of the
+// manifest. Files are listed in the order of the first access.
+func LayerFiles(record io.Reader, manifestDigest digest.Digest, manifest ocispec.Manifest) (map[digest.Digest][]string, error) {
+	// TODO: this should be indexed by layer "index" (not "digest")
+	layerLogs := make(map[digest.Digest][]string, len(manifest.Layers))
+	added := make(map[digest.Digest]map[string]struct{}, len(manifest.Layers))
+	dec := json.NewDecoder(record)
+	for dec.More() {
+		var e recorder.Entry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		if e.LayerIndex != nil && *e.LayerIndex < len(manifest.Layers) &&
+			e.ManifestDigest == manifestDigest.String() {
+			dgst := manifest.Layers[*e.LayerIndex].Digest
+			if added[dgst] == nil {
+				added[dgst] = map[string]struct{}{}
+			}
+			if _, ok := added[dgst][e.Path]; !ok {
+				added[dgst][e.Path] = struct{}{}
+				layerLogs[dgst] = append(layerLogs[dgst], e.Path)
+			}
+		}
+	}
+	return layerLogs, nil
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package profile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/recorder"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLayerFiles(t *testing.T) {
+	manifestDgst := digest.FromString("manifest")
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			{Digest: digest.FromString("layer0")},
+			{Digest: digest.FromString("layer1")},
+		},
+	}
+	var buf bytes.Buffer
+	r := recorder.New(&buf)
+	for _, e := range []struct {
+		path     string
+		manifest digest.Digest
+		idx      int
+	}{
+		{"bin/sh", manifestDgst, 0},
+		{"etc/passwd", manifestDgst, 1},
+		{"bin/sh", manifestDgst, 0}, // duplicated
+		{"lib/libc.so", manifestDgst, 0},
+		{"other", digest.FromString("other"), 0}, // other manifest
+		{"outofrange", manifestDgst, 2},
+	} {
+		idx := e.idx
+		if err := r.Record(&recorder.Entry{Path: e.path, ManifestDigest: e.manifest.String(), LayerIndex: &idx}); err != nil {
+			t.Fatalf("failed to record: %v", err)
+		}
+	}
+
+	got, err := LayerFiles(&buf, manifestDgst, manifest)
+	if err != nil {
+		t.Fatalf("failed to parse record: %v", err)
+	}
+	want := map[digest.Digest][]string{
+		manifest.Layers[0].Digest: {"bin/sh", "lib/libc.so"},
+		manifest.Layers[1].Digest: {"etc/passwd"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected files %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,420 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package admin provides the admin API of the snapshotter. The API is served
+// as JSON over HTTP, typically on a Unix domain socket, and is used by tools
+// like ctr-remote to manage the running snapshotter.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/store"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// CacheUsagePath is the endpoint which reports the disk usage of the layer caches.
+	CacheUsagePath = "/cache/usage"
+
+	// CachePrunePath is the endpoint which removes unreferenced layer caches.
+	CachePrunePath = "/cache/prune"
+
+	// LayerPrunePath is the endpoint which releases unused layers and removes their data.
+	LayerPrunePath = "/layers/prune"
+
+	// ImagePrewarmPath is the endpoint which resolves an image and fetches its
+	// layers in background.
+	ImagePrewarmPath = "/images/prewarm"
+
+	// OrphanCleanupPath is the endpoint which cleans up mounts, snapshot directories
+	// and layer caches which don't belong to live snapshots.
+	OrphanCleanupPath = "/orphans/cleanup"
+
+	// LayerResidentPath is the endpoint which fetches all remaining contents of
+	// mounted layers so that they can be used without the registry.
+	LayerResidentPath = "/layers/resident"
+
+	// ImageStatsPath is the endpoint which reports the statistics of fetches and
+	// cache hits per image.
+	ImageStatsPath = "/images/stats"
+
+	// BackgroundFetchPausePath is the endpoint which pauses background fetches of
+	// layers of an image or of all layers.
+	BackgroundFetchPausePath = "/background-fetch/pause"
+
+	// BackgroundFetchResumePath is the endpoint which resumes paused background fetches.
+	BackgroundFetchResumePath = "/background-fetch/resume"
+
+	// BackgroundFetchStatusPath is the endpoint which reports paused background fetches.
+	BackgroundFetchStatusPath = "/background-fetch/status"
+)
+
+// CacheManager manages the layer caches of the snapshotter.
+type CacheManager interface {
+	CacheUsage(ctx context.Context) ([]layer.CacheUsage, error)
+	PruneCache(ctx context.Context, filter func(layer.CacheUsage) bool) ([]layer.CacheUsage, error)
+}
+
+// LayerPruner releases layers which aren't used anymore.
+type LayerPruner interface {
+	Prune(ctx context.Context) (store.PruneResult, error)
+}
+
+// ImagePrewarmer resolves images and fetches them in background before they are mounted.
+type ImagePrewarmer interface {
+	PrewarmImage(ctx context.Context, ref string, keep time.Duration) (PrewarmResult, error)
+}
+
+// OrphanCleaner cleans up leftovers of crashes (e.g. zombie mounts).
+type OrphanCleaner interface {
+	CleanupOrphans(ctx context.Context) (OrphanCleanupResult, error)
+}
+
+// ResidentMaker fetches and verifies all remaining contents of mounted layers.
+// progress must be called at least once for each matched layer and must not be
+// called after MakeResident returns.
+type ResidentMaker interface {
+	MakeResident(ctx context.Context, req ResidentRequest, progress func(ResidentProgress)) error
+}
+
+// ImageStatsReporter reports the statistics of the images whose layers have been mounted.
+type ImageStatsReporter interface {
+	ImageStats(ctx context.Context) ([]layermetrics.ImageStats, error)
+}
+
+// BackgroundFetchController pauses and resumes background fetches of layers. An empty
+// reference means all layers.
+type BackgroundFetchController interface {
+	PauseBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error)
+	ResumeBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error)
+	BackgroundFetchStatus(ctx context.Context) (layer.BackgroundFetchStatus, error)
+}
+
+// BackgroundFetchRequest is the request for BackgroundFetchPausePath and
+// BackgroundFetchResumePath. The response is layer.BackgroundFetchStatus after the
+// request is applied.
+type BackgroundFetchRequest struct {
+	// Reference limits the request to the layers of the specified image reference.
+	// If empty, background fetches of all layers are paused or resumed. Resuming all
+	// layers lifts the pauses of specific images as well.
+	Reference string `json:"reference,omitempty"`
+}
+
+// ResidentRequest is the request for LayerResidentPath. Mounted layers matching
+// all of the specified fields are made resident.
+type ResidentRequest struct {
+	// Reference limits the layers to ones of the specified image reference.
+	Reference string `json:"reference,omitempty"`
+
+	// Digest limits the layers to the one of the specified digest.
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+// ResidentProgress is the progress of a layer being made resident. The response
+// of LayerResidentPath is a stream of this (newline-delimited JSON).
+type ResidentProgress struct {
+	Reference string        `json:"reference"`
+	Digest    digest.Digest `json:"digest"`
+
+	// Size is the size of the layer blob.
+	Size int64 `json:"size"`
+
+	// Fetched is the size of the layer blob fetched so far.
+	Fetched int64 `json:"fetched"`
+
+	// Done is true when all contents of the layer are cached and verified or when
+	// making the layer resident failed.
+	Done bool `json:"done,omitempty"`
+
+	// Error is the reason of the failure.
+	Error string `json:"error,omitempty"`
+}
+
+// OrphanCleanupResult is the response of OrphanCleanupPath.
+type OrphanCleanupResult struct {
+	snapshot.OrphanCleanupResult
+
+	// Caches are the removed layer caches which weren't used by the snapshotter.
+	Caches []layer.CacheUsage `json:"caches,omitempty"`
+}
+
+// PrewarmRequest is the request for ImagePrewarmPath.
+type PrewarmRequest struct {
+	// Reference is the reference of the image to prewarm.
+	Reference string `json:"reference"`
+
+	// Keep is the minimum duration to keep the prewarmed layers after they are
+	// fetched. If zero, they are kept only until eviction from the resolver cache.
+	Keep time.Duration `json:"keep,omitempty"`
+}
+
+// PrewarmResult is the response of ImagePrewarmPath.
+type PrewarmResult struct {
+	// Reference is the reference of the prewarmed image.
+	Reference string `json:"reference"`
+
+	// Layers are the digests of the layers being fetched in background.
+	Layers []digest.Digest `json:"layers"`
+}
+
+// PruneRequest is the request for CachePrunePath.
+type PruneRequest struct {
+	// Reference limits the pruned caches to ones of the specified image reference.
+	Reference string `json:"reference,omitempty"`
+
+	// OlderThan limits the pruned caches to ones not modified for the specified duration.
+	OlderThan time.Duration `json:"olderThan,omitempty"`
+}
+
+// Register registers handlers of the admin API to the mux. Only the APIs that
+// the target implements are registered.
+func Register(ctx context.Context, m *http.ServeMux, target interface{}) {
+	if cm, ok := target.(CacheManager); ok {
+		m.HandleFunc(CacheUsagePath, cacheUsageHandler(ctx, cm))
+		m.HandleFunc(CachePrunePath, cachePruneHandler(ctx, cm))
+	}
+	if lp, ok := target.(LayerPruner); ok {
+		m.HandleFunc(LayerPrunePath, layerPruneHandler(ctx, lp))
+	}
+	if ip, ok := target.(ImagePrewarmer); ok {
+		m.HandleFunc(ImagePrewarmPath, imagePrewarmHandler(ctx, ip))
+	}
+	if oc, ok := target.(OrphanCleaner); ok {
+		m.HandleFunc(OrphanCleanupPath, orphanCleanupHandler(ctx, oc))
+	}
+	if rm, ok := target.(ResidentMaker); ok {
+		m.HandleFunc(LayerResidentPath, layerResidentHandler(ctx, rm))
+	}
+	if sr, ok := target.(ImageStatsReporter); ok {
+		m.HandleFunc(ImageStatsPath, imageStatsHandler(ctx, sr))
+	}
+	if bc, ok := target.(BackgroundFetchController); ok {
+		m.HandleFunc(BackgroundFetchPausePath, backgroundFetchHandler(ctx, "pause", bc.PauseBackgroundFetch))
+		m.HandleFunc(BackgroundFetchResumePath, backgroundFetchHandler(ctx, "resume", bc.ResumeBackgroundFetch))
+		m.HandleFunc(BackgroundFetchStatusPath, backgroundFetchStatusHandler(ctx, bc))
+	}
+}
+
+func cacheUsageHandler(ctx context.Context, cm CacheManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		usage, err := cm.CacheUsage(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get cache usage")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, usage)
+	}
+}
+
+func cachePruneHandler(ctx context.Context, cm CacheManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PruneRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		pruned, err := cm.PruneCache(ctx, func(u layer.CacheUsage) bool {
+			if req.Reference != "" && u.Reference != req.Reference {
+				return false
+			}
+			if req.OlderThan > 0 && now.Sub(u.ModTime) < req.OlderThan {
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to prune cache")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, pruned)
+	}
+}
+
+func layerPruneHandler(ctx context.Context, lp LayerPruner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := lp.Prune(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to prune layers")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, res)
+	}
+}
+
+func imagePrewarmHandler(ctx context.Context, ip ImagePrewarmer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PrewarmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		} else if req.Reference == "" {
+			http.Error(w, "reference must be specified", http.StatusBadRequest)
+			return
+		}
+		res, err := ip.PrewarmImage(ctx, req.Reference, req.Keep)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to prewarm image %q", req.Reference)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, res)
+	}
+}
+
+func orphanCleanupHandler(ctx context.Context, oc OrphanCleaner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := oc.CleanupOrphans(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to clean up orphans")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, res)
+	}
+}
+
+func layerResidentHandler(ctx context.Context, rm ResidentMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ResidentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		} else if req.Reference == "" && req.Digest == "" {
+			http.Error(w, "reference or digest must be specified", http.StatusBadRequest)
+			return
+		}
+		// Layers are fetched even if the client goes away so the context of the
+		// request isn't used.
+		var (
+			enc     = json.NewEncoder(w)
+			flusher = w.(http.Flusher)
+			started bool
+		)
+		err := rm.MakeResident(ctx, req, func(p ResidentProgress) {
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				started = true
+			}
+			if err := enc.Encode(p); err != nil {
+				return // the client went away
+			}
+			flusher.Flush()
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to make layers resident")
+			if !started {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}
+}
+
+func imageStatsHandler(ctx context.Context, sr ImageStatsReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := sr.ImageStats(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get image stats")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, stats)
+	}
+}
+
+func backgroundFetchHandler(ctx context.Context, op string, f func(context.Context, string) (layer.BackgroundFetchStatus, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req BackgroundFetchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		st, err := f(ctx, req.Reference)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to %s background fetch", op)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, st)
+	}
+}
+
+func backgroundFetchStatusHandler(ctx context.Context, bc BackgroundFetchController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st, err := bc.BackgroundFetchStatus(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get background fetch status")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(ctx, w, st)
+	}
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to write response")
+	}
+}
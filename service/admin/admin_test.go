@@ -0,0 +1,372 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/store"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testCacheManager struct {
+	usage []layer.CacheUsage
+}
+
+func (m *testCacheManager) CacheUsage(ctx context.Context) ([]layer.CacheUsage, error) {
+	return m.usage, nil
+}
+
+func (m *testCacheManager) PruneCache(ctx context.Context, filter func(layer.CacheUsage) bool) (pruned []layer.CacheUsage, _ error) {
+	var remain []layer.CacheUsage
+	for _, u := range m.usage {
+		if !u.InUse && filter(u) {
+			pruned = append(pruned, u)
+		} else {
+			remain = append(remain, u)
+		}
+	}
+	m.usage = remain
+	return pruned, nil
+}
+
+// newTestClient serves the admin API on a Unix domain socket and returns the client of that.
+func newTestClient(t *testing.T, target interface{}) *Client {
+	addr := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	m := http.NewServeMux()
+	Register(context.Background(), m, target)
+	srv := &http.Server{Handler: m}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return NewClient(addr)
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	cm := &testCacheManager{
+		usage: []layer.CacheUsage{
+			{Directory: "a", Reference: "example.com/a:1", Size: 10, ModTime: now, InUse: true},
+			{Directory: "b", Reference: "example.com/a:1", Size: 20, ModTime: now.Add(-48 * time.Hour)},
+			{Directory: "c", Reference: "example.com/b:1", Size: 30, ModTime: now.Add(-48 * time.Hour)},
+			{Directory: "d", Reference: "example.com/b:1", Size: 40, ModTime: now},
+		},
+	}
+	c := newTestClient(t, cm)
+	ctx := context.Background()
+
+	usage, err := c.CacheUsage(ctx)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if len(usage) != 4 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	for _, tt := range []struct {
+		req  PruneRequest
+		want []string
+	}{
+		{req: PruneRequest{Reference: "example.com/a:1"}, want: []string{"b"}},
+		{req: PruneRequest{OlderThan: 24 * time.Hour}, want: []string{"c"}},
+		{req: PruneRequest{}, want: []string{"d"}},
+	} {
+		pruned, err := c.PruneCache(ctx, tt.req)
+		if err != nil {
+			t.Fatalf("failed to prune: %v", err)
+		}
+		var got []string
+		for _, u := range pruned {
+			got = append(got, u.Directory)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("prune %+v: got %v; want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+type testLayerPruner struct {
+	res store.PruneResult
+}
+
+func (p *testLayerPruner) Prune(ctx context.Context) (store.PruneResult, error) {
+	return p.res, nil
+}
+
+func TestPruneLayers(t *testing.T) {
+	dgst := digest.FromString("layer")
+	lp := &testLayerPruner{
+		res: store.PruneResult{
+			Layers: []store.PrunedLayer{{Reference: "example.com/a:1", Digest: dgst, Reason: "not used"}},
+			Caches: []layer.CacheUsage{{Directory: "a", Digest: dgst}},
+		},
+	}
+	c := newTestClient(t, lp)
+	res, err := c.PruneLayers(context.Background())
+	if err != nil {
+		t.Fatalf("failed to prune layers: %v", err)
+	}
+	if len(res.Layers) != 1 || res.Layers[0] != lp.res.Layers[0] {
+		t.Errorf("unexpected pruned layers %+v; want %+v", res.Layers, lp.res.Layers)
+	}
+	if len(res.Caches) != 1 || res.Caches[0].Directory != "a" {
+		t.Errorf("unexpected pruned caches %+v; want %+v", res.Caches, lp.res.Caches)
+	}
+}
+
+type testImagePrewarmer struct {
+	prewarmed []string
+}
+
+func (p *testImagePrewarmer) PrewarmImage(ctx context.Context, ref string, keep time.Duration) (PrewarmResult, error) {
+	p.prewarmed = append(p.prewarmed, ref)
+	return PrewarmResult{Reference: ref, Layers: []digest.Digest{digest.FromString(ref)}}, nil
+}
+
+func TestPrewarmImage(t *testing.T) {
+	ip := &testImagePrewarmer{}
+	c := newTestClient(t, ip)
+	ref := "example.com/a:1"
+	res, err := c.PrewarmImage(context.Background(), PrewarmRequest{Reference: ref, Keep: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to prewarm: %v", err)
+	}
+	if res.Reference != ref || len(res.Layers) != 1 || res.Layers[0] != digest.FromString(ref) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if len(ip.prewarmed) != 1 || ip.prewarmed[0] != ref {
+		t.Errorf("prewarmed %v; want %v", ip.prewarmed, []string{ref})
+	}
+	if _, err := c.PrewarmImage(context.Background(), PrewarmRequest{}); err == nil {
+		t.Errorf("prewarming empty reference must fail")
+	}
+}
+
+type testOrphanCleaner struct {
+	res   OrphanCleanupResult
+	calls int
+}
+
+func (c *testOrphanCleaner) CleanupOrphans(ctx context.Context) (OrphanCleanupResult, error) {
+	c.calls++
+	return c.res, nil
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	oc := &testOrphanCleaner{
+		res: OrphanCleanupResult{
+			OrphanCleanupResult: snapshot.OrphanCleanupResult{
+				Unmounted: []string{"/snapshots/1/fs"},
+				Removed:   []string{"/snapshots/1"},
+			},
+			Caches: []layer.CacheUsage{{Directory: "a"}},
+		},
+	}
+	c := newTestClient(t, oc)
+	res, err := c.CleanupOrphans(context.Background())
+	if err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if oc.calls != 1 {
+		t.Errorf("cleanup is called %d times; want 1", oc.calls)
+	}
+	if len(res.Unmounted) != 1 || res.Unmounted[0] != "/snapshots/1/fs" ||
+		len(res.Removed) != 1 || res.Removed[0] != "/snapshots/1" || len(res.Restored) != 0 {
+		t.Errorf("unexpected result %+v; want %+v", res, oc.res)
+	}
+	if len(res.Caches) != 1 || res.Caches[0].Directory != "a" {
+		t.Errorf("unexpected removed caches %+v; want %+v", res.Caches, oc.res.Caches)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	c := newTestClient(t, struct{}{})
+	if _, err := c.CacheUsage(context.Background()); err == nil {
+		t.Errorf("cache API must not be served by the target which doesn't manage caches")
+	}
+	if _, err := c.PruneLayers(context.Background()); err == nil {
+		t.Errorf("layer API must not be served by the target which doesn't prune layers")
+	}
+	if _, err := c.PrewarmImage(context.Background(), PrewarmRequest{Reference: "example.com/a:1"}); err == nil {
+		t.Errorf("prewarm API must not be served by the target which doesn't prewarm images")
+	}
+	if _, err := c.CleanupOrphans(context.Background()); err == nil {
+		t.Errorf("orphan API must not be served by the target which doesn't clean up orphans")
+	}
+	if err := c.MakeResident(context.Background(), ResidentRequest{Reference: "example.com/a:1"}, func(ResidentProgress) {}); err == nil {
+		t.Errorf("resident API must not be served by the target which doesn't make layers resident")
+	}
+	if _, err := c.ImageStats(context.Background()); err == nil {
+		t.Errorf("stats API must not be served by the target which doesn't report image stats")
+	}
+	if _, err := c.PauseBackgroundFetch(context.Background(), BackgroundFetchRequest{}); err == nil {
+		t.Errorf("background fetch API must not be served by the target which doesn't control background fetches")
+	}
+}
+
+type testResidentMaker struct {
+	layers []ResidentProgress
+}
+
+func (m *testResidentMaker) MakeResident(ctx context.Context, req ResidentRequest, progress func(ResidentProgress)) error {
+	var matched bool
+	for _, l := range m.layers {
+		if (req.Reference == "" || l.Reference == req.Reference) && (req.Digest == "" || l.Digest == req.Digest) {
+			matched = true
+			progress(l)
+			l.Fetched, l.Done = l.Size, true
+			progress(l)
+		}
+	}
+	if !matched {
+		return fmt.Errorf("no mounted layer matches the request")
+	}
+	return nil
+}
+
+func TestMakeResident(t *testing.T) {
+	rm := &testResidentMaker{
+		layers: []ResidentProgress{
+			{Reference: "example.com/a:1", Digest: digest.FromString("a1"), Size: 10},
+			{Reference: "example.com/a:1", Digest: digest.FromString("a2"), Size: 20, Fetched: 5},
+			{Reference: "example.com/b:1", Digest: digest.FromString("b1"), Size: 30},
+		},
+	}
+	c := newTestClient(t, rm)
+	ctx := context.Background()
+
+	var got []ResidentProgress
+	if err := c.MakeResident(ctx, ResidentRequest{Reference: "example.com/a:1"}, func(p ResidentProgress) {
+		got = append(got, p)
+	}); err != nil {
+		t.Fatalf("failed to make layers resident: %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("unexpected progress %+v", got)
+	}
+	for i, p := range got {
+		if p.Reference != "example.com/a:1" || p.Done != (i%2 == 1) {
+			t.Errorf("unexpected progress %+v", p)
+		}
+	}
+	if p := got[3]; p.Digest != digest.FromString("a2") || p.Fetched != 20 {
+		t.Errorf("unexpected final progress %+v", p)
+	}
+
+	if err := c.MakeResident(ctx, ResidentRequest{Reference: "example.com/c:1"}, func(ResidentProgress) {}); err == nil {
+		t.Errorf("request matching no layer must fail")
+	}
+	if err := c.MakeResident(ctx, ResidentRequest{}, func(ResidentProgress) {}); err == nil {
+		t.Errorf("request without reference nor digest must fail")
+	}
+}
+
+type testImageStatsReporter struct {
+	stats []layermetrics.ImageStats
+}
+
+func (r *testImageStatsReporter) ImageStats(ctx context.Context) ([]layermetrics.ImageStats, error) {
+	return r.stats, nil
+}
+
+func TestImageStats(t *testing.T) {
+	ratio := 0.75
+	sr := &testImageStatsReporter{
+		stats: []layermetrics.ImageStats{
+			{Image: "example.com/a:1", Namespace: "k8s.io", Size: 100, OnDemandBytes: 10, CacheHitBytes: 30, CacheMissBytes: 10, CacheHitRatio: &ratio},
+			{Image: "example.com/b:1", Namespace: "k8s.io", Size: 200, BackgroundBytes: 200},
+		},
+	}
+	c := newTestClient(t, sr)
+	stats, err := c.ImageStats(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get image stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if st := stats[0]; st.Image != "example.com/a:1" || st.Size != 100 || st.OnDemandBytes != 10 ||
+		st.CacheHitRatio == nil || *st.CacheHitRatio != ratio {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if st := stats[1]; st.BackgroundBytes != 200 || st.CacheHitRatio != nil {
+		t.Errorf("ratio must be omitted if nothing is read; got %+v", st)
+	}
+}
+
+type testBackgroundFetchController struct {
+	st layer.BackgroundFetchStatus
+}
+
+func (bc *testBackgroundFetchController) PauseBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error) {
+	if ref == "" {
+		bc.st.Paused = true
+	} else {
+		bc.st.PausedImages = append(bc.st.PausedImages, ref)
+	}
+	return bc.st, nil
+}
+
+func (bc *testBackgroundFetchController) ResumeBackgroundFetch(ctx context.Context, ref string) (layer.BackgroundFetchStatus, error) {
+	if ref != "" {
+		return layer.BackgroundFetchStatus{}, fmt.Errorf("unexpected reference %q", ref)
+	}
+	bc.st = layer.BackgroundFetchStatus{}
+	return bc.st, nil
+}
+
+func (bc *testBackgroundFetchController) BackgroundFetchStatus(ctx context.Context) (layer.BackgroundFetchStatus, error) {
+	return bc.st, nil
+}
+
+func TestBackgroundFetch(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, &testBackgroundFetchController{})
+	if st, err := c.PauseBackgroundFetch(ctx, BackgroundFetchRequest{Reference: "example.com/a:1"}); err != nil {
+		t.Fatalf("failed to pause background fetch: %v", err)
+	} else if st.Paused || len(st.PausedImages) != 1 || st.PausedImages[0] != "example.com/a:1" {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, err := c.PauseBackgroundFetch(ctx, BackgroundFetchRequest{}); err != nil {
+		t.Fatalf("failed to pause background fetch: %v", err)
+	}
+	if st, err := c.BackgroundFetchStatus(ctx); err != nil {
+		t.Fatalf("failed to get background fetch status: %v", err)
+	} else if !st.Paused || len(st.PausedImages) != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, err := c.ResumeBackgroundFetch(ctx, BackgroundFetchRequest{Reference: "example.com/b:1"}); err == nil {
+		t.Errorf("error of the controller must be returned")
+	}
+	if st, err := c.ResumeBackgroundFetch(ctx, BackgroundFetchRequest{}); err != nil {
+		t.Fatalf("failed to resume background fetch: %v", err)
+	} else if st.Paused || len(st.PausedImages) != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
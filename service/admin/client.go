@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/store"
+)
+
+// Client is a client of the admin API.
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a client of the admin API served on the specified Unix domain socket.
+func NewClient(address string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", address)
+				},
+			},
+		},
+	}
+}
+
+// CacheUsage returns the disk usage of the layer caches.
+func (c *Client) CacheUsage(ctx context.Context) (usage []layer.CacheUsage, _ error) {
+	err := c.do(ctx, http.MethodGet, CacheUsagePath, nil, &usage)
+	return usage, err
+}
+
+// PruneCache removes unreferenced layer caches matching the request and returns the removed ones.
+func (c *Client) PruneCache(ctx context.Context, req PruneRequest) (pruned []layer.CacheUsage, _ error) {
+	err := c.do(ctx, http.MethodPost, CachePrunePath, req, &pruned)
+	return pruned, err
+}
+
+// PruneLayers releases unused layers and removes unused caches.
+func (c *Client) PruneLayers(ctx context.Context) (res store.PruneResult, _ error) {
+	err := c.do(ctx, http.MethodPost, LayerPrunePath, nil, &res)
+	return res, err
+}
+
+// PrewarmImage resolves the image and lets the snapshotter fetch its layers in background.
+func (c *Client) PrewarmImage(ctx context.Context, req PrewarmRequest) (res PrewarmResult, _ error) {
+	err := c.do(ctx, http.MethodPost, ImagePrewarmPath, req, &res)
+	return res, err
+}
+
+// CleanupOrphans cleans up mounts, snapshot directories and layer caches which
+// don't belong to live snapshots.
+func (c *Client) CleanupOrphans(ctx context.Context) (res OrphanCleanupResult, _ error) {
+	err := c.do(ctx, http.MethodPost, OrphanCleanupPath, nil, &res)
+	return res, err
+}
+
+// MakeResident fetches all remaining contents of the mounted layers matching the
+// request. progress is called with the progress of each layer until all layers
+// are done.
+func (c *Client) MakeResident(ctx context.Context, req ResidentRequest, progress func(ResidentProgress)) error {
+	resp, err := c.request(ctx, http.MethodPost, LayerResidentPath, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var p ResidentProgress
+		if err := dec.Decode(&p); err != nil {
+			return fmt.Errorf("failed to decode response from %q: %w", LayerResidentPath, err)
+		}
+		progress(p)
+	}
+	return nil
+}
+
+// ImageStats returns the statistics of fetches and cache hits of the images whose
+// layers have been mounted.
+func (c *Client) ImageStats(ctx context.Context) (stats []layermetrics.ImageStats, _ error) {
+	err := c.do(ctx, http.MethodGet, ImageStatsPath, nil, &stats)
+	return stats, err
+}
+
+// PauseBackgroundFetch pauses background fetches of the layers matching the request
+// and returns the status after the pause.
+func (c *Client) PauseBackgroundFetch(ctx context.Context, req BackgroundFetchRequest) (st layer.BackgroundFetchStatus, _ error) {
+	err := c.do(ctx, http.MethodPost, BackgroundFetchPausePath, req, &st)
+	return st, err
+}
+
+// ResumeBackgroundFetch resumes background fetches of the layers matching the request
+// and returns the status after the resume.
+func (c *Client) ResumeBackgroundFetch(ctx context.Context, req BackgroundFetchRequest) (st layer.BackgroundFetchStatus, _ error) {
+	err := c.do(ctx, http.MethodPost, BackgroundFetchResumePath, req, &st)
+	return st, err
+}
+
+// BackgroundFetchStatus returns whether background fetches are paused.
+func (c *Client) BackgroundFetchStatus(ctx context.Context) (st layer.BackgroundFetchStatus, _ error) {
+	err := c.do(ctx, http.MethodGet, BackgroundFetchStatusPath, nil, &st)
+	return st, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, reqBody, respBody interface{}) error {
+	resp, err := c.request(ctx, method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if respBody == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return fmt.Errorf("failed to decode response from %q: %w", path, err)
+	}
+	return nil
+}
+
+// request sends the request to the path and returns the response if it succeeds.
+func (c *Client) request(ctx context.Context, method, path string, reqBody interface{}) (*http.Response, error) {
+	var body io.Reader
+	if reqBody != nil {
+		b, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	// The host is ignored as the client always connects to the Unix domain socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %q: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("unexpected status code %d from %q: %s", resp.StatusCode, path, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
@@ -18,7 +18,9 @@ package service
 
 import (
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/service/policy"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/containerd/stargz-snapshotter/service/signature"
 )
 
 type Config struct {
@@ -30,8 +32,59 @@ type Config struct {
 	// CRIKeychainConfig is config for CRI-based keychain.
 	CRIKeychainConfig `toml:"cri_keychain"`
 
+	// ECRKeychainConfig is config for Amazon ECR keychain.
+	ECRKeychainConfig `toml:"ecr_keychain"`
+
+	// CredentialProviderKeychainConfig is config for kubelet credential provider plugins.
+	CredentialProviderKeychainConfig `toml:"credential_provider_keychain"`
+
 	// ResolverConfig is config for resolving registries.
 	ResolverConfig `toml:"resolver"`
+
+	// SignatureVerificationConfig is config for verifying image signatures before mounting.
+	SignatureVerificationConfig `toml:"signature_verification"`
+
+	// LazyPullPolicyConfig is config for the policy deciding how images are pulled.
+	LazyPullPolicyConfig `toml:"lazy_pull_policy"`
+
+	// PodFetchPriorityConfig is config for tuning fetches of images by the annotations
+	// of pods pulling them.
+	PodFetchPriorityConfig `toml:"pod_fetch_priority"`
+
+	// TransferServiceConfig is config for images pulled by the transfer service of
+	// containerd.
+	TransferServiceConfig `toml:"transfer_service"`
+
+	// OrphanCleanupIntervalSec is the interval (in sec) to clean up mounts, snapshot
+	// directories and layer caches which don't belong to live snapshots (e.g. left by
+	// a crash). 0 disables the periodic cleanup. Orphaned mounts and snapshot
+	// directories are also cleaned up at startup.
+	OrphanCleanupIntervalSec int64 `toml:"orphan_cleanup_interval_sec"`
+
+	// NamespaceConfigs overrides parts of the config for snapshots of each containerd
+	// namespace (e.g. "k8s.io", "buildkit" or "default").
+	NamespaceConfigs map[string]NamespaceConfig `toml:"namespace"`
+}
+
+// NamespaceConfig is config overridden for snapshots of a containerd namespace. Unset
+// fields follow the global config.
+type NamespaceConfig struct {
+	// ResolverConfig replaces the config for resolving registries (e.g. mirrors and
+	// the directory of hosts.toml files which can contain credentials in headers).
+	// Keychains are shared among namespaces.
+	ResolverConfig *ResolverConfig `toml:"resolver"`
+
+	// NoPrefetch overrides noprefetch.
+	NoPrefetch *bool `toml:"noprefetch"`
+
+	// NoBackgroundFetch overrides no_background_fetch.
+	NoBackgroundFetch *bool `toml:"no_background_fetch"`
+
+	// HTTPCacheType and FSCacheType override http_cache_type and
+	// filesystem_cache_type. "memory" doesn't write the contents of layers to
+	// the disk.
+	HTTPCacheType string `toml:"http_cache_type"`
+	FSCacheType   string `toml:"filesystem_cache_type"`
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -42,6 +95,14 @@ type KubeconfigKeychainConfig struct {
 	// KubeconfigPath is the path to kubeconfig which can be used to sync
 	// secrets on the cluster into this snapshotter.
 	KubeconfigPath string `toml:"kubeconfig_path"`
+
+	// Namespace is the namespace to watch secrets. Empty means all namespaces.
+	Namespace string `toml:"namespace"`
+
+	// ScopeToImageNamespace makes secrets to be used only for images pulled by pods in
+	// the same namespace as the secret. Namespaces of images are got through CRI so
+	// this requires CRI-based keychain.
+	ScopeToImageNamespace bool `toml:"scope_to_image_namespace"`
 }
 
 // CRIKeychainConfig is config for CRI-based keychain.
@@ -53,5 +114,58 @@ type CRIKeychainConfig struct {
 	ImageServicePath string `toml:"image_service_path"`
 }
 
+// PodFetchPriorityConfig is config for tuning fetches of images by the annotations of
+// pods pulling them. Annotations of pods are got through CRI so this requires CRI-based
+// keychain.
+type PodFetchPriorityConfig struct {
+	// Enable enables tuning fetches by the annotations of pods.
+	Enable bool `toml:"enable"`
+
+	// PriorityClasses maps values of PriorityClassAnnotation to prefetch modes
+	// ("aggressive", "normal" or "off"). "latency-critical" is mapped to "aggressive"
+	// and "best-effort" is mapped to "off" by default.
+	PriorityClasses map[string]string `toml:"priority_classes"`
+}
+
+// TransferServiceConfig is config for images pulled by the transfer service of
+// containerd (e.g. "ctr image pull" and nerdctl with containerd v2), which doesn't
+// pass the image reference and the layer digests to the snapshotter.
+type TransferServiceConfig struct {
+	// ReconstructLabels reconstructs the missing labels of layers from the manifests
+	// in the content store of containerd so that the layers can be lazily pulled.
+	ReconstructLabels bool `toml:"reconstruct_labels"`
+
+	// ContainerdAddress is the path to the unix socket of containerd serving the
+	// content store. Defaults to "/run/containerd/containerd.sock".
+	ContainerdAddress string `toml:"containerd_address"`
+}
+
+// ECRKeychainConfig is config for Amazon ECR keychain.
+type ECRKeychainConfig struct {
+	// EnableKeychain enables the keychain which gets credentials of ECR registries
+	// using the AWS credentials of the node (e.g. the instance role or IRSA).
+	EnableKeychain bool `toml:"enable_keychain"`
+}
+
+// CredentialProviderKeychainConfig is config for the keychain which executes
+// kubelet image credential provider plugins.
+type CredentialProviderKeychainConfig struct {
+	// EnableKeychain enables the keychain using credential provider plugins.
+	EnableKeychain bool `toml:"enable_keychain"`
+
+	// ConfigPath is the path to the CredentialProviderConfig file of kubelet
+	// (--image-credential-provider-config).
+	ConfigPath string `toml:"config_path"`
+
+	// BinDir is the directory of the plugin binaries (--image-credential-provider-bin-dir).
+	BinDir string `toml:"bin_dir"`
+}
+
 // ResolverConfig is config for resolving registries.
 type ResolverConfig resolver.Config
+
+// SignatureVerificationConfig is config for verifying image signatures before mounting.
+type SignatureVerificationConfig signature.Config
+
+// LazyPullPolicyConfig is config for the policy deciding how images are pulled.
+type LazyPullPolicyConfig policy.Config
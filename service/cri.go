@@ -80,7 +80,7 @@ func sourceFromCRILabels(hosts source.RegistryHosts) source.GetSources {
 			{
 				Hosts:    hosts,
 				Name:     refspec,
-				Target:   ocispec.Descriptor{Digest: target},
+				Target:   ocispec.Descriptor{Digest: target, Annotations: labels},
 				Manifest: ocispec.Manifest{Layers: layers},
 			},
 		}, nil
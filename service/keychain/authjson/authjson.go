@@ -0,0 +1,188 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package authjson provides a keychain which reads credentials from the auth.json
+// file of containers/image (used by Podman, Buildah and CRI-O). See containers-auth.json(5).
+package authjson
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+)
+
+type options struct {
+	authFilePath string
+}
+
+type Option func(*options)
+
+// WithAuthFilePath specifies the path to the auth.json file. By default,
+// $REGISTRY_AUTH_FILE, ${XDG_RUNTIME_DIR}/containers/auth.json and
+// $HOME/.config/containers/auth.json are searched in this order.
+func WithAuthFilePath(path string) Option {
+	return func(opts *options) {
+		opts.authFilePath = path
+	}
+}
+
+type authFile struct {
+	Auths map[string]authEntry `json:"auths"`
+}
+
+type authEntry struct {
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// NewAuthJSONKeychain provides a keychain which reads credentials from auth.json.
+// The file is read on each authentication so updates of the file are applied
+// without restarting.
+func NewAuthJSONKeychain(ctx context.Context, opts ...Option) resolver.Credential {
+	var aOpts options
+	for _, o := range opts {
+		o(&aOpts)
+	}
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		paths := []string{aOpts.authFilePath}
+		if aOpts.authFilePath == "" {
+			paths = defaultAuthFilePaths()
+		}
+		for _, p := range paths {
+			username, secret, err := credentials(p, host, refspec)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to read auth file %q", p)
+				continue
+			}
+			if username != "" || secret != "" {
+				return username, secret, nil
+			}
+		}
+		return "", "", nil
+	}
+}
+
+func defaultAuthFilePaths() (paths []string) {
+	if p := os.Getenv("REGISTRY_AUTH_FILE"); p != "" {
+		return []string{p}
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "containers", "auth.json"))
+	} else {
+		// Podman uses this path when XDG_RUNTIME_DIR isn't set (e.g. rootful podman).
+		paths = append(paths, filepath.Join("/run/containers", fmt.Sprintf("%d", os.Getuid()), "auth.json"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "containers", "auth.json"))
+	}
+	return paths
+}
+
+func credentials(path, host string, refspec reference.Spec) (string, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var f authFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return "", "", err
+	}
+	auths := make(map[string]authEntry, len(f.Auths))
+	for k, v := range f.Auths {
+		auths[normalizeKey(k)] = v
+	}
+	for _, key := range lookupKeys(host, refspec) {
+		e, ok := auths[key]
+		if !ok {
+			continue
+		}
+		if e.IdentityToken != "" {
+			return "", e.IdentityToken, nil
+		}
+		if e.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth of %q: %w", key, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("invalid auth of %q: must be formatted as \"username:password\"", key)
+		}
+		return parts[0], parts[1], nil
+	}
+	return "", "", nil
+}
+
+// lookupKeys returns keys of auth.json to search for the credentials of the host.
+// If the host is the registry of refspec, namespaces of the repository are searched
+// from the most specific one.
+func lookupKeys(host string, refspec reference.Spec) (keys []string) {
+	host = normalizeHost(host)
+	if normalizeHost(refspec.Hostname()) == host {
+		repo := strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/")
+		for {
+			keys = append(keys, host+"/"+repo)
+			i := strings.LastIndex(repo, "/")
+			if i < 0 {
+				break
+			}
+			repo = repo[:i]
+		}
+	}
+	return append(keys, host)
+}
+
+// normalizeKey normalizes a key in auth.json. Keys are formatted as
+// "host[/namespace...]" but keys of the legacy format (e.g. "https://index.docker.io/v1/")
+// are also allowed. Only the host is used for keys of the legacy format.
+func normalizeKey(key string) string {
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(key, scheme) {
+			key = strings.TrimPrefix(key, scheme)
+			if i := strings.Index(key, "/"); i >= 0 {
+				key = key[:i]
+			}
+			break
+		}
+	}
+	parts := strings.SplitN(key, "/", 2)
+	host := normalizeHost(parts[0])
+	if len(parts) == 2 {
+		return host + "/" + parts[1]
+	}
+	return host
+}
+
+func normalizeHost(host string) string {
+	switch host {
+	case "registry-1.docker.io", "index.docker.io":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,327 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package credentialprovider provides a keychain which gets credentials by
+// executing kubelet image credential provider plugins. The same config file
+// (--image-credential-provider-config) and plugin binaries
+// (--image-credential-provider-bin-dir) as kubelet can be used.
+// See also: https://kubernetes.io/docs/tasks/administer-cluster/kubelet-credential-provider/
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	requestKind  = "CredentialProviderRequest"
+	responseKind = "CredentialProviderResponse"
+
+	// execTimeout is the timeout of an execution of a plugin.
+	execTimeout = time.Minute
+
+	globalCacheKey = "global"
+)
+
+// supportedAPIVersions are the versions of CredentialProviderRequest and
+// CredentialProviderResponse supported by this keychain.
+var supportedAPIVersions = map[string]bool{
+	"credentialprovider.kubelet.k8s.io/v1":       true,
+	"credentialprovider.kubelet.k8s.io/v1beta1":  true,
+	"credentialprovider.kubelet.k8s.io/v1alpha1": true,
+}
+
+// config is CredentialProviderConfig of kubelet (kubelet.config.k8s.io).
+type config struct {
+	Providers []providerConfig `json:"providers"`
+}
+
+type providerConfig struct {
+	Name                 string           `json:"name"`
+	MatchImages          []string         `json:"matchImages"`
+	DefaultCacheDuration *metav1.Duration `json:"defaultCacheDuration"`
+	APIVersion           string           `json:"apiVersion"`
+	Args                 []string         `json:"args"`
+	Env                  []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"env"`
+}
+
+type request struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type response struct {
+	APIVersion    string                `json:"apiVersion"`
+	Kind          string                `json:"kind"`
+	CacheKeyType  string                `json:"cacheKeyType"`
+	CacheDuration *metav1.Duration      `json:"cacheDuration"`
+	Auth          map[string]authConfig `json:"auth"`
+}
+
+type authConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// NewCredentialProviderKeychain provides a keychain which executes the credential
+// provider plugins configured in the kubelet CredentialProviderConfig file at
+// configPath. Plugin binaries are looked up in binDir. Credentials are cached as
+// specified by the responses of the plugins.
+func NewCredentialProviderKeychain(ctx context.Context, configPath, binDir string) (resolver.Credential, error) {
+	providers, err := loadConfig(configPath, binDir)
+	if err != nil {
+		return nil, err
+	}
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		if host != refspec.Hostname() {
+			return "", "", nil // don't pass creds of the image to mirrors
+		}
+		image := refspec.String()
+		for _, p := range providers {
+			if !p.match(image) {
+				continue
+			}
+			username, secret, err := p.credentials(ctx, image)
+			if err != nil {
+				// Other keychains may have the creds so don't fail.
+				log.G(ctx).WithError(err).WithField("provider", p.Name).Warnf("failed to get credentials of %q", image)
+				continue
+			}
+			if username != "" || secret != "" {
+				return username, secret, nil
+			}
+		}
+		return "", "", nil
+	}, nil
+}
+
+func loadConfig(configPath, binDir string) ([]*provider, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg config
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode credential provider config %q: %w", configPath, err)
+	}
+	var providers []*provider
+	for _, pc := range cfg.Providers {
+		if pc.Name == "" || strings.ContainsAny(pc.Name, `/\`) || pc.Name == "." || pc.Name == ".." {
+			return nil, fmt.Errorf("invalid provider name %q", pc.Name)
+		}
+		if !supportedAPIVersions[pc.APIVersion] {
+			return nil, fmt.Errorf("unsupported apiVersion %q of provider %q", pc.APIVersion, pc.Name)
+		}
+		if len(pc.MatchImages) == 0 {
+			return nil, fmt.Errorf("matchImages of provider %q must be specified", pc.Name)
+		}
+		for _, m := range pc.MatchImages {
+			if _, err := parseImage(m); err != nil {
+				return nil, fmt.Errorf("invalid matchImages %q of provider %q: %w", m, pc.Name, err)
+			}
+		}
+		if pc.DefaultCacheDuration == nil || pc.DefaultCacheDuration.Duration < 0 {
+			return nil, fmt.Errorf("defaultCacheDuration of provider %q must be specified", pc.Name)
+		}
+		providers = append(providers, &provider{
+			providerConfig: pc,
+			path:           filepath.Join(binDir, pc.Name),
+			cache:          make(map[string]*cachedAuth),
+		})
+	}
+	return providers, nil
+}
+
+type provider struct {
+	providerConfig
+	path string
+
+	cache   map[string]*cachedAuth // indexed by the cache key
+	cacheMu sync.Mutex
+	execMu  sync.Mutex
+}
+
+type cachedAuth struct {
+	auth      map[string]authConfig
+	expiresAt time.Time
+}
+
+func (p *provider) match(image string) bool {
+	for _, m := range p.MatchImages {
+		if matchImage(m, image) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *provider) credentials(ctx context.Context, image string) (string, string, error) {
+	if auth, ok := p.cached(image); ok {
+		username, secret := findAuth(auth, image)
+		return username, secret, nil
+	}
+
+	// Serialize executions so that concurrent resolutions don't run the plugin many times.
+	p.execMu.Lock()
+	defer p.execMu.Unlock()
+	if auth, ok := p.cached(image); ok {
+		username, secret := findAuth(auth, image)
+		return username, secret, nil
+	}
+	resp, err := p.exec(ctx, image)
+	if err != nil {
+		return "", "", err
+	}
+	duration := p.DefaultCacheDuration.Duration
+	if resp.CacheDuration != nil {
+		duration = resp.CacheDuration.Duration
+	}
+	if duration > 0 {
+		var key string
+		switch resp.CacheKeyType {
+		case "Image":
+			key = image
+		case "Registry":
+			key = registryOf(image)
+		case "Global":
+			key = globalCacheKey
+		default:
+			return "", "", fmt.Errorf("unknown cacheKeyType %q", resp.CacheKeyType)
+		}
+		p.cacheMu.Lock()
+		p.cache[key] = &cachedAuth{auth: resp.Auth, expiresAt: time.Now().Add(duration)}
+		p.cacheMu.Unlock()
+	}
+	username, secret := findAuth(resp.Auth, image)
+	return username, secret, nil
+}
+
+func (p *provider) cached(image string) (map[string]authConfig, bool) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	now := time.Now()
+	for _, key := range []string{image, registryOf(image), globalCacheKey} {
+		c, ok := p.cache[key]
+		if !ok {
+			continue
+		}
+		if now.After(c.expiresAt) {
+			delete(p.cache, key)
+			continue
+		}
+		return c.auth, true
+	}
+	return nil, false
+}
+
+func (p *provider) exec(ctx context.Context, image string) (*response, error) {
+	req, err := json.Marshal(request{APIVersion: p.APIVersion, Kind: requestKind, Image: image})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.path, p.Args...)
+	cmd.Env = os.Environ()
+	for _, e := range p.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to execute %q: %v: %w", p.path, strings.TrimSpace(stderr.String()), err)
+	}
+	var resp response
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response of %q: %w", p.path, err)
+	}
+	if resp.Kind != responseKind || resp.APIVersion != p.APIVersion {
+		return nil, fmt.Errorf("unexpected response %s %q of %q; want %s %q", resp.Kind, resp.APIVersion, p.path, responseKind, p.APIVersion)
+	}
+	return &resp, nil
+}
+
+// findAuth returns the creds of the most specific key matching the image.
+func findAuth(auth map[string]authConfig, image string) (username, secret string) {
+	var matched string
+	for k, a := range auth {
+		if len(k) > len(matched) && matchImage(k, image) {
+			matched, username, secret = k, a.Username, a.Password
+		}
+	}
+	return
+}
+
+func registryOf(image string) string {
+	return strings.SplitN(image, "/", 2)[0]
+}
+
+func parseImage(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	return url.Parse(s)
+}
+
+// matchImage reports if the image matches the pattern in the same way as kubelet
+// matches matchImages. Each dot-separated part of the host can be a glob pattern
+// (e.g. "*.registry.io"). The port must equal and the path of the pattern must
+// be a prefix of the image's path.
+func matchImage(pattern, image string) bool {
+	p, err := parseImage(pattern)
+	if err != nil {
+		return false
+	}
+	i, err := parseImage(image)
+	if err != nil {
+		return false
+	}
+	if p.Scheme != i.Scheme || p.Port() != i.Port() {
+		return false
+	}
+	pParts, iParts := strings.Split(p.Hostname(), "."), strings.Split(i.Hostname(), ".")
+	if len(pParts) != len(iParts) {
+		return false
+	}
+	for n := range pParts {
+		if ok, err := filepath.Match(pParts[n], iParts[n]); err != nil || !ok {
+			return false
+		}
+	}
+	return strings.HasPrefix(i.Path, p.Path)
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package credentialprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchImage(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		image   string
+		want    bool
+	}{
+		{pattern: "registry.io", image: "registry.io/foo/bar:latest", want: true},
+		{pattern: "registry.io", image: "other.io/foo/bar:latest"},
+		{pattern: "*.registry.io", image: "a.registry.io/foo", want: true},
+		{pattern: "*.registry.io", image: "registry.io/foo"},
+		{pattern: "*.registry.io", image: "a.b.registry.io/foo"},
+		{pattern: "*.*.registry.io", image: "a.b.registry.io/foo", want: true},
+		{pattern: "reg*.io", image: "registry.io/foo", want: true},
+		{pattern: "*", image: "localhost/foo", want: true},
+		{pattern: "*", image: "registry.io/foo"},
+		{pattern: "registry.io:5000", image: "registry.io:5000/foo", want: true},
+		{pattern: "registry.io:5000", image: "registry.io/foo"},
+		{pattern: "registry.io", image: "registry.io:5000/foo"},
+		{pattern: "registry.io/foo", image: "registry.io/foo/bar", want: true},
+		{pattern: "registry.io/foo", image: "registry.io/baz/bar"},
+		{pattern: "https://registry.io", image: "registry.io/foo", want: true},
+		{pattern: "http://registry.io", image: "registry.io/foo"},
+		{pattern: "[", image: "registry.io/foo"},
+	} {
+		if got := matchImage(tt.pattern, tt.image); got != tt.want {
+			t.Errorf("matchImage(%q, %q) = %v; want %v", tt.pattern, tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestFindAuth(t *testing.T) {
+	auth := map[string]authConfig{
+		"registry.io":         {Username: "registry", Password: "pass1"},
+		"registry.io/foo":     {Username: "foo", Password: "pass2"},
+		"registry.io/foo/bar": {Username: "bar", Password: "pass3"},
+		"*.registry.io":       {Username: "sub", Password: "pass4"},
+	}
+	for _, tt := range []struct {
+		image        string
+		wantUsername string
+		wantSecret   string
+	}{
+		{image: "registry.io/baz:latest", wantUsername: "registry", wantSecret: "pass1"},
+		{image: "registry.io/foo/baz:latest", wantUsername: "foo", wantSecret: "pass2"},
+		{image: "registry.io/foo/bar/baz:latest", wantUsername: "bar", wantSecret: "pass3"},
+		{image: "a.registry.io/foo:latest", wantUsername: "sub", wantSecret: "pass4"},
+		{image: "other.io/foo:latest"},
+	} {
+		username, secret := findAuth(auth, tt.image)
+		if username != tt.wantUsername || secret != tt.wantSecret {
+			t.Errorf("findAuth(%q) = %q:%q; want %q:%q", tt.image, username, secret, tt.wantUsername, tt.wantSecret)
+		}
+	}
+}
+
+// testPlugin is a credential provider plugin which records its executions in
+// $COUNT_FILE and responds the creds of registry.io with $CACHE_KEY_TYPE.
+const testPlugin = `#!/bin/sh
+cat > /dev/null
+echo >> "$COUNT_FILE"
+echo '{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"'"$CACHE_KEY_TYPE"'","cacheDuration":"1h","auth":{"registry.io":{"username":"user","password":"pass"}}}'
+`
+
+func TestCredentialsCache(t *testing.T) {
+	for _, tt := range []struct {
+		cacheKeyType string
+		// wantExecs are the total numbers of executions after each step
+		wantExecs [4]int
+	}{
+		{cacheKeyType: "Image", wantExecs: [4]int{1, 1, 2, 3}},
+		{cacheKeyType: "Registry", wantExecs: [4]int{1, 1, 1, 2}},
+		{cacheKeyType: "Global", wantExecs: [4]int{1, 1, 1, 1}},
+	} {
+		t.Run(tt.cacheKeyType, func(t *testing.T) {
+			p, countFile := newTestProvider(t, tt.cacheKeyType)
+			execs := func() int {
+				data, err := os.ReadFile(countFile)
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatalf("failed to read count file: %v", err)
+				}
+				return strings.Count(string(data), "\n")
+			}
+			for i, step := range []struct {
+				image        string
+				wantUsername string
+				wantSecret   string
+			}{
+				{image: "registry.io/foo:latest", wantUsername: "user", wantSecret: "pass"},
+				{image: "registry.io/foo:latest", wantUsername: "user", wantSecret: "pass"},
+				{image: "registry.io/bar:latest", wantUsername: "user", wantSecret: "pass"},
+				{image: "other.io/foo:latest"},
+			} {
+				username, secret, err := p.credentials(context.Background(), step.image)
+				if err != nil {
+					t.Fatalf("step %d: failed to get credentials: %v", i, err)
+				}
+				if username != step.wantUsername || secret != step.wantSecret {
+					t.Errorf("step %d: got %q:%q for %q; want %q:%q", i, username, secret, step.image, step.wantUsername, step.wantSecret)
+				}
+				if n := execs(); n != tt.wantExecs[i] {
+					t.Errorf("step %d: plugin executed %d times; want %d", i, n, tt.wantExecs[i])
+				}
+			}
+
+			// Expired creds must be fetched again
+			p.cacheMu.Lock()
+			for _, c := range p.cache {
+				c.expiresAt = time.Now().Add(-time.Second)
+			}
+			p.cacheMu.Unlock()
+			username, secret, err := p.credentials(context.Background(), "registry.io/foo:latest")
+			if err != nil {
+				t.Fatalf("failed to get credentials after expiration: %v", err)
+			}
+			if username != "user" || secret != "pass" {
+				t.Errorf("got %q:%q after expiration; want %q:%q", username, secret, "user", "pass")
+			}
+			if n, want := execs(), tt.wantExecs[3]+1; n != want {
+				t.Errorf("plugin executed %d times after expiration; want %d", n, want)
+			}
+		})
+	}
+}
+
+func newTestProvider(t *testing.T, cacheKeyType string) (p *provider, countFile string) {
+	tmp := t.TempDir()
+	binDir := filepath.Join(tmp, "bin")
+	if err := os.Mkdir(binDir, 0755); err != nil {
+		t.Fatalf("failed to create bin dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "test-plugin"), []byte(testPlugin), 0755); err != nil {
+		t.Fatalf("failed to write plugin: %v", err)
+	}
+	countFile = filepath.Join(tmp, "count")
+	configPath := filepath.Join(tmp, "config.yaml")
+	config := fmt.Sprintf(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: test-plugin
+  matchImages: ["*.io"]
+  defaultCacheDuration: 10m
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  env:
+  - name: COUNT_FILE
+    value: %q
+  - name: CACHE_KEY_TYPE
+    value: %s
+`, countFile, cacheKeyType)
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	providers, err := loadConfig(configPath, binDir)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if len(providers) != 1 {
+		t.Fatalf("got %d providers; want 1", len(providers))
+	}
+	return providers[0], countFile
+}
@@ -30,11 +30,106 @@ import (
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 )
 
+type options struct {
+	imageNamespaces  *ImageNamespaces
+	imageAnnotations *ImageAnnotations
+}
+
+type Option func(*options)
+
+// WithImageAnnotations records annotations of pods that pull images through CRI to a.
+func WithImageAnnotations(a *ImageAnnotations) Option {
+	return func(opts *options) {
+		opts.imageAnnotations = a
+	}
+}
+
+// WithImageNamespaces records namespaces of pods that pull images through CRI to n.
+func WithImageNamespaces(n *ImageNamespaces) Option {
+	return func(opts *options) {
+		opts.imageNamespaces = n
+	}
+}
+
+// ImageNamespaces records Kubernetes namespaces of pods that pulled each image through
+// CRI PullImage API. This can be used for scoping credentials to namespaces.
+type ImageNamespaces struct {
+	namespaces map[string]map[string]struct{}
+	mu         sync.Mutex
+}
+
+func NewImageNamespaces() *ImageNamespaces {
+	return &ImageNamespaces{namespaces: make(map[string]map[string]struct{})}
+}
+
+// Namespaces returns namespaces of pods that pulled the image.
+func (n *ImageNamespaces) Namespaces(refspec reference.Spec) (namespaces []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ns := range n.namespaces[refspec.String()] {
+		namespaces = append(namespaces, ns)
+	}
+	return
+}
+
+func (n *ImageNamespaces) add(refspec reference.Spec, namespace string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.namespaces[refspec.String()]; !ok {
+		n.namespaces[refspec.String()] = make(map[string]struct{})
+	}
+	n.namespaces[refspec.String()][namespace] = struct{}{}
+}
+
+func (n *ImageNamespaces) remove(refspec reference.Spec) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.namespaces, refspec.String())
+}
+
+// ImageAnnotations records annotations of the pod that pulled each image most recently
+// through CRI PullImage API. This can be used for tuning the snapshotter per pod.
+type ImageAnnotations struct {
+	annotations map[string]map[string]string
+	mu          sync.Mutex
+}
+
+func NewImageAnnotations() *ImageAnnotations {
+	return &ImageAnnotations{annotations: make(map[string]map[string]string)}
+}
+
+// Annotations returns annotations of the pod that pulled the image.
+func (a *ImageAnnotations) Annotations(refspec reference.Spec) map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.annotations[refspec.String()]
+}
+
+func (a *ImageAnnotations) add(refspec reference.Spec, annotations map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.annotations[refspec.String()] = annotations
+}
+
+func (a *ImageAnnotations) remove(refspec reference.Spec) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.annotations, refspec.String())
+}
+
 // NewCRIKeychain provides creds passed through CRI PullImage API.
 // This also returns a CRI image service server that works as a proxy backed by the specified CRI service.
 // This server reads all PullImageRequest and uses PullImageRequest.AuthConfig for authenticating snapshots.
-func NewCRIKeychain(ctx context.Context, connectCRI func() (runtime.ImageServiceClient, error)) (resolver.Credential, runtime.ImageServiceServer) {
-	server := &instrumentedService{config: make(map[string]*runtime.AuthConfig)}
+func NewCRIKeychain(ctx context.Context, connectCRI func() (runtime.ImageServiceClient, error), opts ...Option) (resolver.Credential, runtime.ImageServiceServer) {
+	var cOpts options
+	for _, o := range opts {
+		o(&cOpts)
+	}
+	server := &instrumentedService{
+		config:           make(map[string]*runtime.AuthConfig),
+		imageNamespaces:  cOpts.imageNamespaces,
+		imageAnnotations: cOpts.imageAnnotations,
+	}
 	go func() {
 		log.G(ctx).Debugf("Waiting for CRI service is started...")
 		for i := 0; i < 100; i++ {
@@ -60,6 +155,9 @@ type instrumentedService struct {
 
 	config   map[string]*runtime.AuthConfig
 	configMu sync.Mutex
+
+	imageNamespaces  *ImageNamespaces
+	imageAnnotations *ImageAnnotations
 }
 
 func (in *instrumentedService) credentials(host string, refspec reference.Spec) (string, string, error) {
@@ -110,6 +208,12 @@ func (in *instrumentedService) PullImage(ctx context.Context, r *runtime.PullIma
 	in.configMu.Lock()
 	in.config[refspec.String()] = r.GetAuth()
 	in.configMu.Unlock()
+	if ns := r.GetSandboxConfig().GetMetadata().GetNamespace(); in.imageNamespaces != nil && ns != "" {
+		in.imageNamespaces.add(refspec, ns)
+	}
+	if in.imageAnnotations != nil {
+		in.imageAnnotations.add(refspec, r.GetSandboxConfig().GetAnnotations())
+	}
 	return cri.PullImage(ctx, r)
 }
 
@@ -125,6 +229,12 @@ func (in *instrumentedService) RemoveImage(ctx context.Context, r *runtime.Remov
 	in.configMu.Lock()
 	delete(in.config, refspec.String())
 	in.configMu.Unlock()
+	if in.imageNamespaces != nil {
+		in.imageNamespaces.remove(refspec)
+	}
+	if in.imageAnnotations != nil {
+		in.imageAnnotations.remove(refspec)
+	}
 	return cri.RemoveImage(ctx, r)
 }
 
@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cri
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"google.golang.org/grpc"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestImageAnnotations(t *testing.T) {
+	a := NewImageAnnotations()
+	in := &instrumentedService{
+		cri:              &testImageService{},
+		config:           make(map[string]*runtime.AuthConfig),
+		imageAnnotations: a,
+	}
+	pull := func(image string, annotations map[string]string) {
+		if _, err := in.PullImage(context.Background(), &runtime.PullImageRequest{
+			Image:         &runtime.ImageSpec{Image: image},
+			SandboxConfig: &runtime.PodSandboxConfig{Annotations: annotations},
+		}); err != nil {
+			t.Fatalf("failed to pull %q: %v", image, err)
+		}
+	}
+	annotationsOf := func(ref string) map[string]string {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.Annotations(refspec)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		image string
+		ref   string
+	}{
+		{name: "normalized", image: "ubuntu", ref: "docker.io/library/ubuntu:latest"},
+		{name: "fully_qualified", image: "example.com/foo:1", ref: "example.com/foo:1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pull(tt.image, map[string]string{"key": "first"})
+			if got := annotationsOf(tt.ref)["key"]; got != "first" {
+				t.Errorf("annotation = %q; want %q", got, "first")
+			}
+
+			// The pod that pulled the image most recently wins.
+			pull(tt.image, map[string]string{"key": "second"})
+			if got := annotationsOf(tt.ref)["key"]; got != "second" {
+				t.Errorf("annotation = %q; want %q", got, "second")
+			}
+
+			if _, err := in.RemoveImage(context.Background(), &runtime.RemoveImageRequest{
+				Image: &runtime.ImageSpec{Image: tt.image},
+			}); err != nil {
+				t.Fatalf("failed to remove %q: %v", tt.image, err)
+			}
+			if got := annotationsOf(tt.ref); got != nil {
+				t.Errorf("annotations of the removed image must be removed; got %v", got)
+			}
+		})
+	}
+
+	if got := annotationsOf("example.com/unknown:1"); got != nil {
+		t.Errorf("annotations of unknown image must be empty; got %v", got)
+	}
+}
+
+// testImageService is a CRI image service which accepts pulls and removals of images.
+type testImageService struct {
+	runtime.ImageServiceClient
+}
+
+func (s *testImageService) PullImage(ctx context.Context, r *runtime.PullImageRequest, opts ...grpc.CallOption) (*runtime.PullImageResponse, error) {
+	return &runtime.PullImageResponse{ImageRef: r.GetImage().GetImage()}, nil
+}
+
+func (s *testImageService) RemoveImage(ctx context.Context, r *runtime.RemoveImageRequest, opts ...grpc.CallOption) (*runtime.RemoveImageResponse, error) {
+	return &runtime.RemoveImageResponse{}, nil
+}
@@ -25,6 +25,10 @@ import (
 	"github.com/docker/cli/cli/config"
 )
 
+// NewDockerconfigKeychain provides a keychain which reads credentials from the docker
+// config file ($DOCKER_CONFIG/config.json or ~/.docker/config.json). When credHelpers
+// or credsStore is configured for the host, the credential helper
+// (docker-credential-<name> in $PATH) is executed to get the credentials.
 func NewDockerconfigKeychain(ctx context.Context) resolver.Credential {
 	return func(host string, refspec reference.Spec) (string, string, error) {
 		cf, err := config.Load("")
@@ -39,7 +43,10 @@ func NewDockerconfigKeychain(ctx context.Context) resolver.Credential {
 		}
 		ac, err := cf.GetAuthConfig(host)
 		if err != nil {
-			return "", "", err
+			// The credential helper can be missing or fail (e.g. helper binary isn't
+			// installed). Other keychains may have the creds so don't fail.
+			log.G(ctx).WithError(err).WithField("host", host).Warnf("failed to get creds from docker config")
+			return "", "", nil
 		}
 		if ac.IdentityToken != "" {
 			return "", ac.IdentityToken, nil
@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ecr provides a keychain which gets credentials of Amazon ECR registries
+// using the AWS credentials of the node (e.g. the instance role or IRSA).
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshMargin is the duration before the expiration of the token when the token is
+// refreshed. ECR tokens are valid for 12 hours.
+const refreshMargin = 30 * time.Minute
+
+// ecrHostPattern matches ECR registry hosts and captures the account ID and the region.
+// NOTE: ported from https://github.com/awslabs/amazon-ecr-credential-helper/blob/v0.6.0/ecr-login/api/client.go
+var ecrHostPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.(?:amazonaws\.com(?:\.cn)?|sc2s\.sgov\.gov|c2s\.ic\.gov)$`)
+
+// tokenGetter is the subset of ECR API used by this keychain.
+type tokenGetter interface {
+	GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error)
+}
+
+type options struct {
+	loadOptions []func(*awsconfig.LoadOptions) error
+}
+
+type Option func(*options)
+
+// WithLoadOptions specifies options for loading the AWS config. By default, the
+// credentials are got from the default credential chain (environment variables,
+// shared config files, web identity token (IRSA) and EC2 instance role).
+func WithLoadOptions(opts ...func(*awsconfig.LoadOptions) error) Option {
+	return func(o *options) {
+		o.loadOptions = append(o.loadOptions, opts...)
+	}
+}
+
+// NewECRKeychain provides a keychain which gets credentials of ECR registries by
+// calling GetAuthorizationToken API. The credentials are cached until shortly
+// before they expire. Non-ECR hosts are ignored.
+func NewECRKeychain(ctx context.Context, opts ...Option) resolver.Credential {
+	var eOpts options
+	for _, o := range opts {
+		o(&eOpts)
+	}
+	kc := &keychain{
+		cache: make(map[string]*authToken),
+		newClient: func(ctx context.Context, region string) (tokenGetter, error) {
+			cfg, err := awsconfig.LoadDefaultConfig(ctx, append(eOpts.loadOptions, awsconfig.WithRegion(region))...)
+			if err != nil {
+				return nil, err
+			}
+			return ecr.NewFromConfig(cfg), nil
+		},
+		clients: make(map[string]tokenGetter),
+		nowFunc: time.Now,
+	}
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		username, secret, err := kc.credentials(ctx, host)
+		if err != nil {
+			// Other keychains may have the creds so don't fail.
+			log.G(ctx).WithError(err).WithField("host", host).Warn("failed to get ECR credentials")
+			return "", "", nil
+		}
+		return username, secret, nil
+	}
+}
+
+type keychain struct {
+	cache   map[string]*authToken // indexed by host
+	cacheMu sync.Mutex
+
+	// fetchGroup deduplicates concurrent fetches of the token of the same host.
+	fetchGroup singleflight.Group
+
+	newClient func(ctx context.Context, region string) (tokenGetter, error)
+	clients   map[string]tokenGetter // indexed by region
+	clientsMu sync.Mutex
+
+	nowFunc func() time.Time
+}
+
+type authToken struct {
+	username  string
+	secret    string
+	expiresAt time.Time
+}
+
+func (kc *keychain) credentials(ctx context.Context, host string) (string, string, error) {
+	m := ecrHostPattern.FindStringSubmatch(host)
+	if m == nil {
+		return "", "", nil // not an ECR registry
+	}
+	account, region := m[1], m[2]
+
+	kc.cacheMu.Lock()
+	t, ok := kc.cache[host]
+	kc.cacheMu.Unlock()
+	if ok && kc.nowFunc().Before(t.expiresAt.Add(-refreshMargin)) {
+		return t.username, t.secret, nil
+	}
+
+	// The lock of the cache isn't held during the API call so that other hosts aren't blocked.
+	v, err, _ := kc.fetchGroup.Do(host, func() (interface{}, error) {
+		t, err := kc.fetchToken(ctx, account, region)
+		if err != nil {
+			return nil, err
+		}
+		kc.cacheMu.Lock()
+		kc.cache[host] = t
+		kc.cacheMu.Unlock()
+		log.G(ctx).WithField("host", host).WithField("expiresAt", t.expiresAt).Debug("got ECR credentials")
+		return t, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	t = v.(*authToken)
+	return t.username, t.secret, nil
+}
+
+// fetchToken gets the authorization token of the registry of the account by calling
+// GetAuthorizationToken API.
+func (kc *keychain) fetchToken(ctx context.Context, account, region string) (*authToken, error) {
+	client, err := kc.client(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ECR client for %q: %w", region, err)
+	}
+	out, err := client.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []string{account},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authorization token: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return nil, fmt.Errorf("no authorization data is returned")
+	}
+	data := out.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(data.AuthorizationToken))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode authorization token: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid authorization token")
+	}
+	t := &authToken{username: parts[0], secret: parts[1]}
+	if data.ExpiresAt != nil {
+		t.expiresAt = *data.ExpiresAt
+	} else {
+		t.expiresAt = kc.nowFunc().Add(12 * time.Hour)
+	}
+	return t, nil
+}
+
+func (kc *keychain) client(ctx context.Context, region string) (tokenGetter, error) {
+	kc.clientsMu.Lock()
+	defer kc.clientsMu.Unlock()
+	if c, ok := kc.clients[region]; ok {
+		return c, nil
+	}
+	c, err := kc.newClient(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	kc.clients[region] = c
+	return c, nil
+}
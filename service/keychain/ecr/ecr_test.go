@@ -0,0 +1,182 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+const (
+	testHost  = "123456789012.dkr.ecr.us-west-2.amazonaws.com"
+	otherHost = "210987654321.dkr.ecr.us-west-2.amazonaws.com"
+)
+
+func TestCredentials(t *testing.T) {
+	now := time.Now()
+	tg := &testTokenGetter{expiresIn: 12 * time.Hour, now: func() time.Time { return now }}
+	var regions []string
+	kc := &keychain{
+		cache: make(map[string]*authToken),
+		newClient: func(ctx context.Context, region string) (tokenGetter, error) {
+			regions = append(regions, region)
+			return tg, nil
+		},
+		clients: make(map[string]tokenGetter),
+		nowFunc: func() time.Time { return now },
+	}
+	check := func(name, wantSecret string, wantCalls int) {
+		username, secret, err := kc.credentials(context.Background(), testHost)
+		if err != nil {
+			t.Fatalf("%s: failed to get credentials: %v", name, err)
+		}
+		if username != "AWS" || secret != wantSecret {
+			t.Errorf("%s: unexpected credentials %q:%q; want %q:%q", name, username, secret, "AWS", wantSecret)
+		}
+		if n := tg.callCount(); n != wantCalls {
+			t.Errorf("%s: API called %d times; want %d", name, n, wantCalls)
+		}
+	}
+
+	// Non-ECR hosts are ignored
+	if username, secret, err := kc.credentials(context.Background(), "example.com"); err != nil || username != "" || secret != "" {
+		t.Fatalf("non-ECR host must be ignored; got %q:%q, %v", username, secret, err)
+	}
+
+	check("initial", "secret1", 1)
+	if len(regions) != 1 || regions[0] != "us-west-2" {
+		t.Errorf("unexpected regions of clients %v", regions)
+	}
+
+	// Cached token is used until shortly before the expiration
+	now = now.Add(11 * time.Hour)
+	check("cache hit", "secret1", 1)
+
+	// Expiring token is refreshed
+	now = now.Add(45 * time.Minute)
+	check("refresh", "secret2", 2)
+
+	// Failing to refresh the token
+	now = now.Add(12 * time.Hour)
+	tg.setErr(fmt.Errorf("unauthorized"))
+	if _, _, err := kc.credentials(context.Background(), testHost); err == nil {
+		t.Fatalf("error of the API must be returned")
+	}
+	tg.setErr(nil)
+	check("recover", "secret4", 4)
+	if len(regions) != 1 {
+		t.Errorf("client must be reused; created %d", len(regions))
+	}
+}
+
+func TestCredentialsConcurrent(t *testing.T) {
+	tg := &testTokenGetter{expiresIn: 12 * time.Hour, now: time.Now, wait: make(chan struct{})}
+	kc := &keychain{
+		cache: make(map[string]*authToken),
+		newClient: func(ctx context.Context, region string) (tokenGetter, error) {
+			return tg, nil
+		},
+		clients: make(map[string]tokenGetter),
+		nowFunc: time.Now,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, secret, err := kc.credentials(context.Background(), testHost); err != nil || secret != "secret1" {
+				t.Errorf("unexpected credentials %q, %v", secret, err)
+			}
+		}()
+	}
+
+	// Cached tokens of other hosts are available during the API call
+	kc.cacheMu.Lock()
+	kc.cache[otherHost] = &authToken{username: "AWS", secret: "other", expiresAt: time.Now().Add(time.Hour)}
+	kc.cacheMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, secret, err := kc.credentials(context.Background(), otherHost); err != nil || secret != "other" {
+			t.Errorf("unexpected credentials of the other host %q, %v", secret, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("cached credentials must not be blocked by the API call")
+	}
+
+	close(tg.wait)
+	wg.Wait()
+	if n := tg.callCount(); n != 1 {
+		t.Errorf("concurrent fetches must be deduplicated; API called %d times", n)
+	}
+}
+
+// testTokenGetter issues tokens whose secrets are numbered by the calls.
+type testTokenGetter struct {
+	expiresIn time.Duration
+	now       func() time.Time
+	wait      chan struct{} // if non-nil, the API call blocks until this is closed
+
+	calls int
+	err   error
+	mu    sync.Mutex
+}
+
+func (tg *testTokenGetter) GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	if tg.wait != nil {
+		<-tg.wait
+	}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.calls++
+	if tg.err != nil {
+		return nil, tg.err
+	}
+	if len(params.RegistryIds) != 1 || params.RegistryIds[0] != "123456789012" {
+		return nil, fmt.Errorf("unexpected registry IDs %v", params.RegistryIds)
+	}
+	token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:secret%d", tg.calls)))
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []types.AuthorizationData{{
+			AuthorizationToken: aws.String(token),
+			ExpiresAt:          aws.Time(tg.now().Add(tg.expiresIn)),
+		}},
+	}, nil
+}
+
+func (tg *testTokenGetter) setErr(err error) {
+	tg.mu.Lock()
+	tg.err = err
+	tg.mu.Unlock()
+}
+
+func (tg *testTokenGetter) callCount() int {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.calls
+}
@@ -43,7 +43,9 @@ import (
 const dockerconfigSelector = "type=" + string(corev1.SecretTypeDockerConfigJson)
 
 type options struct {
-	kubeconfigPath string
+	kubeconfigPath  string
+	namespace       string
+	imageNamespaces func(reference.Spec) []string
 }
 
 type Option func(*options)
@@ -54,6 +56,24 @@ func WithKubeconfigPath(path string) Option {
 	}
 }
 
+// WithNamespace makes the keychain watch only secrets in the namespace. By default,
+// secrets in all namespaces are watched.
+func WithNamespace(namespace string) Option {
+	return func(opts *options) {
+		opts.namespace = namespace
+	}
+}
+
+// WithImageNamespaces scopes credentials to namespaces of images. f returns the
+// namespaces which use the image (e.g. namespaces of pods that pulled the image)
+// and only secrets in these namespaces are used for the image. If f returns no
+// namespace, no credential is provided for the image.
+func WithImageNamespaces(f func(reference.Spec) []string) Option {
+	return func(opts *options) {
+		opts.imageNamespaces = f
+	}
+}
+
 // NewKubeconfigKeychain provides a keychain which can sync its contents with
 // kubernetes API server by fetching all `kubernetes.io/dockerconfigjson`
 // secrets in the cluster with provided kubeconfig. It's OK that config provides
@@ -64,19 +84,24 @@ func WithKubeconfigPath(path string) Option {
 // containerized apiserver) where stargz snapshotter needs to start before
 // everything, including booting containerd/kubelet/apiserver and configuring
 // users/roles.
+// Secrets are kept in sync using an informer so rotated secrets are used for the
+// following authentications (including re-authentications of mounted layers).
+// When multiple secrets have creds of a registry, the most recently synced one is used.
 // TODO: support update of kubeconfig file
 func NewKubeconfigKeychain(ctx context.Context, opts ...Option) resolver.Credential {
 	var kcOpts options
 	for _, o := range opts {
 		o(&kcOpts)
 	}
-	kc := newKeychain(ctx, kcOpts.kubeconfigPath)
+	kc := newKeychain(ctx, kcOpts.kubeconfigPath, kcOpts.namespace)
+	kc.imageNamespaces = kcOpts.imageNamespaces
 	return kc.credentials
 }
 
-func newKeychain(ctx context.Context, kubeconfigPath string) *keychain {
+func newKeychain(ctx context.Context, kubeconfigPath, namespace string) *keychain {
 	kc := &keychain{
-		config: make(map[string]*dcfile.ConfigFile),
+		config:    make(map[string]*secretConfig),
+		namespace: namespace,
 	}
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("kubeconfig", kubeconfigPath))
 	go func() {
@@ -126,8 +151,14 @@ func newKeychain(ctx context.Context, kubeconfigPath string) *keychain {
 }
 
 type keychain struct {
-	config   map[string]*dcfile.ConfigFile
+	config   map[string]*secretConfig // indexed by "<namespace>/<name>" of the secret
 	configMu sync.Mutex
+	syncSeq  uint64
+
+	// namespace is the namespace to watch. Empty means all namespaces.
+	namespace string
+
+	imageNamespaces func(reference.Spec) []string
 
 	// the following entries are used for syncing secrets with API server.
 	// these fields are lazily filled after kubeconfig file is provided.
@@ -140,18 +171,46 @@ func (kc *keychain) credentials(host string, refspec reference.Spec) (string, st
 		// Creds of "docker.io" is stored keyed by "https://index.docker.io/v1/".
 		host = "https://index.docker.io/v1/"
 	}
+	var namespaces map[string]struct{}
+	if kc.imageNamespaces != nil {
+		namespaces = make(map[string]struct{})
+		for _, ns := range kc.imageNamespaces(refspec) {
+			namespaces[ns] = struct{}{}
+		}
+	}
 	kc.configMu.Lock()
 	defer kc.configMu.Unlock()
+	var (
+		username, secret string
+		latest           uint64
+	)
 	for _, cfg := range kc.config {
+		if namespaces != nil {
+			if _, ok := namespaces[cfg.namespace]; !ok {
+				continue // not allowed for this image
+			}
+		}
+		if cfg.seq < latest {
+			continue // prefer the most recently synced secret
+		}
 		if acfg, err := cfg.GetAuthConfig(host); err == nil {
 			if acfg.IdentityToken != "" {
-				return "", acfg.IdentityToken, nil
+				username, secret, latest = "", acfg.IdentityToken, cfg.seq
 			} else if !(acfg.Username == "" && acfg.Password == "") {
-				return acfg.Username, acfg.Password, nil
+				username, secret, latest = acfg.Username, acfg.Password, cfg.seq
 			}
 		}
 	}
-	return "", "", nil
+	return username, secret, nil
+}
+
+// secretConfig is the docker config stored in a secret.
+type secretConfig struct {
+	*dcfile.ConfigFile
+	namespace string
+
+	// seq is the order of syncing this secret. Larger is newer.
+	seq uint64
 }
 
 func (kc *keychain) startSyncSecrets(ctx context.Context, client kubernetes.Interface) error {
@@ -159,18 +218,19 @@ func (kc *keychain) startSyncSecrets(ctx context.Context, client kubernetes.Inte
 	// don't let panics crash the process
 	defer utilruntime.HandleCrash()
 
-	// get informed on `kubernetes.io/dockerconfigjson` secrets in all namespaces
+	// get informed on `kubernetes.io/dockerconfigjson` secrets in the namespace (or all
+	// namespaces if not specified)
 	informer := cache.NewSharedIndexInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 				// TODO: support legacy image secret `kubernetes.io/dockercfg`
 				options.FieldSelector = dockerconfigSelector
-				return client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, options)
+				return client.CoreV1().Secrets(kc.namespace).List(ctx, options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 				// TODO: support legacy image secret `kubernetes.io/dockercfg`
 				options.FieldSelector = dockerconfigSelector
-				return client.CoreV1().Secrets(metav1.NamespaceAll).Watch(ctx, options)
+				return client.CoreV1().Secrets(kc.namespace).Watch(ctx, options)
 			},
 		},
 		&corev1.Secret{},
@@ -211,7 +271,12 @@ func (kc *keychain) startSyncSecrets(ctx context.Context, client kubernetes.Inte
 	kc.informer = informer
 	kc.queue = queue
 
-	// keep on syncing secrets
+	// keep on syncing secrets. The queue is shut down on cancellation so the
+	// worker blocked on it returns.
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
 	wait.Until(kc.runWorker, time.Second, ctx.Done())
 
 	return nil
@@ -255,7 +320,12 @@ func (kc *keychain) processNextItem() bool {
 		return true
 	}
 	kc.configMu.Lock()
-	kc.config[key.(string)] = configFile
+	kc.syncSeq++
+	kc.config[key.(string)] = &secretConfig{
+		ConfigFile: configFile,
+		namespace:  obj.(*corev1.Secret).Namespace,
+		seq:        kc.syncSeq,
+	}
 	kc.configMu.Unlock()
 
 	return true
@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	dcfile "github.com/docker/cli/cli/config/configfile"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testHost = "registry.io"
+
+func TestWithNamespace(t *testing.T) {
+	kc, client := startTestKeychain(t, WithNamespace("ns1"))
+	createSecret(t, client, "ns2", "secret", "user2")
+	createSecret(t, client, "ns1", "secret", "user1")
+	waitForCreds(t, kc, "example/image:latest", "user1")
+	if n := numConfigs(kc); n != 1 {
+		t.Errorf("synced %d secrets; want only the one in the namespace", n)
+	}
+}
+
+func TestWithImageNamespaces(t *testing.T) {
+	kc, client := startTestKeychain(t, WithImageNamespaces(func(refspec reference.Spec) []string {
+		switch refspec.Locator {
+		case testHost + "/ns1/image":
+			return []string{"ns1"}
+		case testHost + "/shared/image":
+			return []string{"ns1", "ns2"}
+		}
+		return nil
+	}))
+	createSecret(t, client, "ns1", "secret", "user1")
+	createSecret(t, client, "ns2", "secret", "user2")
+	waitForCreds(t, kc, "shared/image:latest", "user2") // the most recently synced one
+	checkCreds(t, kc, "ns1/image:latest", "user1")
+	checkCreds(t, kc, "unknown/image:latest", "")
+}
+
+func TestRotation(t *testing.T) {
+	kc, client := startTestKeychain(t)
+	createSecret(t, client, "ns1", "secret", "user1")
+	waitForCreds(t, kc, "example/image:latest", "user1")
+	createSecret(t, client, "ns2", "secret", "user2")
+	waitForCreds(t, kc, "example/image:latest", "user2")
+
+	// The rotated secret is newer than the others
+	updateSecret(t, client, "ns1", "secret", "user3")
+	waitForCreds(t, kc, "example/image:latest", "user3")
+
+	// Creds of the deleted secret aren't used anymore
+	if err := client.CoreV1().Secrets("ns1").Delete(context.Background(), "secret", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete secret: %v", err)
+	}
+	waitForCreds(t, kc, "example/image:latest", "user2")
+}
+
+func TestPreferNewerSecret(t *testing.T) {
+	kc := &keychain{config: map[string]*secretConfig{
+		"ns1/old":   {ConfigFile: dockerConfig(t, "old"), namespace: "ns1", seq: 1},
+		"ns1/newer": {ConfigFile: dockerConfig(t, "newer"), namespace: "ns1", seq: 3},
+		"ns2/new":   {ConfigFile: dockerConfig(t, "new"), namespace: "ns2", seq: 2},
+	}}
+	checkCreds(t, kc, "example/image:latest", "newer")
+	kc.imageNamespaces = func(reference.Spec) []string { return []string{"ns2"} }
+	checkCreds(t, kc, "example/image:latest", "new")
+}
+
+func startTestKeychain(t *testing.T, opts ...Option) (*keychain, kubernetes.Interface) {
+	var kcOpts options
+	for _, o := range opts {
+		o(&kcOpts)
+	}
+	kc := &keychain{
+		config:          make(map[string]*secretConfig),
+		namespace:       kcOpts.namespace,
+		imageNamespaces: kcOpts.imageNamespaces,
+	}
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := kc.startSyncSecrets(ctx, client); err != nil {
+			t.Errorf("failed to sync secrets: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return kc, client
+}
+
+func dockerConfigJSON(username string) []byte {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":pass"))
+	return []byte(fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, testHost, auth))
+}
+
+func newSecret(namespace, name, username string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfigJSON(username)},
+	}
+}
+
+func createSecret(t *testing.T, client kubernetes.Interface, namespace, name, username string) {
+	if _, err := client.CoreV1().Secrets(namespace).Create(context.Background(), newSecret(namespace, name, username), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create secret: %v", err)
+	}
+}
+
+func updateSecret(t *testing.T, client kubernetes.Interface, namespace, name, username string) {
+	if _, err := client.CoreV1().Secrets(namespace).Update(context.Background(), newSecret(namespace, name, username), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update secret: %v", err)
+	}
+}
+
+func numConfigs(kc *keychain) int {
+	kc.configMu.Lock()
+	defer kc.configMu.Unlock()
+	return len(kc.config)
+}
+
+func getCreds(t *testing.T, kc *keychain, image string) string {
+	refspec, err := reference.Parse(testHost + "/" + image)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", image, err)
+	}
+	username, _, err := kc.credentials(testHost, refspec)
+	if err != nil {
+		t.Fatalf("failed to get creds: %v", err)
+	}
+	return username
+}
+
+func checkCreds(t *testing.T, kc *keychain, image, wantUsername string) {
+	if username := getCreds(t, kc, image); username != wantUsername {
+		t.Errorf("username of %q = %q; want %q", image, username, wantUsername)
+	}
+}
+
+func waitForCreds(t *testing.T, kc *keychain, image, wantUsername string) {
+	var username string
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		if username = getCreds(t, kc, image); username == wantUsername {
+			return
+		}
+	}
+	t.Fatalf("username of %q = %q; want %q", image, username, wantUsername)
+}
+
+func dockerConfig(t *testing.T, username string) *dcfile.ConfigFile {
+	cfg := dcfile.New("")
+	if err := cfg.LoadFromReader(bytes.NewReader(dockerConfigJSON(username))); err != nil {
+		t.Fatalf("failed to load docker config: %v", err)
+	}
+	return cfg
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+// orphanCleaner implements admin.OrphanCleaner. Layer caches which aren't used
+// by the filesystem are removed as well as orphans of the snapshotter.
+type orphanCleaner struct {
+	sn snbase.OrphanCleaner
+	cm admin.CacheManager // nil if the filesystem doesn't manage caches
+}
+
+func (c *orphanCleaner) CleanupOrphans(ctx context.Context) (admin.OrphanCleanupResult, error) {
+	var res admin.OrphanCleanupResult
+	sres, err := c.sn.CleanupOrphans(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.OrphanCleanupResult = sres
+	if c.cm != nil {
+		// Caches are removed when they are released so unused ones are leftovers.
+		if res.Caches, err = c.cm.PruneCache(ctx, nil); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// run cleans up orphans periodically until the context is done.
+func (c *orphanCleaner) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		res, err := c.CleanupOrphans(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to clean up orphans")
+			continue
+		}
+		if len(res.Unmounted) > 0 || len(res.Removed) > 0 || len(res.Caches) > 0 {
+			log.G(ctx).Infof("cleaned up orphans: unmounted=%v, removed=%v, restored=%v, caches=%d",
+				res.Unmounted, res.Removed, res.Restored, len(res.Caches))
+		}
+	}
+}
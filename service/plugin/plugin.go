@@ -32,6 +32,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/service"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
 	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/keychain/ecr"
 	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	grpc "google.golang.org/grpc"
@@ -76,13 +77,27 @@ func init() {
 
 			// Configure keychain
 			credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
+			var imageNamespaces *cri.ImageNamespaces
 			if config.Config.KubeconfigKeychainConfig.EnableKeychain {
 				var opts []kubeconfig.Option
 				if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
 					opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
 				}
+				if ns := config.Config.KubeconfigKeychainConfig.Namespace; ns != "" {
+					opts = append(opts, kubeconfig.WithNamespace(ns))
+				}
+				if config.Config.KubeconfigKeychainConfig.ScopeToImageNamespace {
+					if !(config.CRIKeychainImageServicePath != "" && config.Config.CRIKeychainConfig.EnableKeychain) {
+						log.G(ctx).Warn("scope_to_image_namespace requires CRI-based keychain; kubeconfig-based keychain provides no creds")
+					}
+					imageNamespaces = cri.NewImageNamespaces()
+					opts = append(opts, kubeconfig.WithImageNamespaces(imageNamespaces.Namespaces))
+				}
 				credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
 			}
+			if config.Config.ECRKeychainConfig.EnableKeychain {
+				credsFuncs = append(credsFuncs, ecr.NewECRKeychain(ctx))
+			}
 			if addr := config.CRIKeychainImageServicePath; config.Config.CRIKeychainConfig.EnableKeychain && addr != "" {
 				// connects to the backend CRI service (defaults to containerd socket)
 				criAddr := ic.Address
@@ -112,7 +127,7 @@ func init() {
 					}
 					return runtime.NewImageServiceClient(conn), nil
 				}
-				criCreds, criServer := cri.NewCRIKeychain(ctx, connectCRI)
+				criCreds, criServer := cri.NewCRIKeychain(ctx, connectCRI, cri.WithImageNamespaces(imageNamespaces))
 				// Create a gRPC server
 				rpc := grpc.NewServer()
 				runtime.RegisterImageServiceServer(rpc, criServer)
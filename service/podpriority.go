@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/reference"
+)
+
+const (
+	// PrefetchAnnotation is a pod annotation which specifies how the layers of the
+	// images of the pod are fetched ("aggressive", "normal" or "off").
+	PrefetchAnnotation = "stargz-snapshotter.containerd.io/prefetch"
+
+	// PriorityClassAnnotation is a pod annotation which specifies the priority class
+	// of the pod. The class is mapped to a prefetch mode by PodFetchPriorityConfig.
+	// PrefetchAnnotation takes precedence over this.
+	PriorityClassAnnotation = "stargz-snapshotter.containerd.io/priority-class"
+)
+
+// prefetch modes of pods mapped to the modes of the background fetch of layers.
+var prefetchModes = map[string]string{
+	"aggressive": "full", // fetch the entire layers at the mount prior to other images
+	"normal":     "on",
+	"off":        "off",
+}
+
+var defaultPriorityClasses = map[string]string{
+	"latency-critical": "aggressive",
+	"best-effort":      "off",
+}
+
+// podBackgroundFetchMode returns the function which decides the mode of the background
+// fetch of an image from the annotations of the pod which pulled the image.
+func podBackgroundFetchMode(cfg PodFetchPriorityConfig, annotations func(reference.Spec) map[string]string) (func(reference.Spec) (string, bool), error) {
+	classes := cfg.PriorityClasses
+	if classes == nil {
+		classes = defaultPriorityClasses
+	}
+	for class, mode := range classes {
+		if _, ok := prefetchModes[mode]; !ok {
+			return nil, fmt.Errorf("unknown prefetch mode %q of priority class %q", mode, class)
+		}
+	}
+	return func(image reference.Spec) (string, bool) {
+		a := annotations(image)
+		mode, ok := a[PrefetchAnnotation]
+		if !ok {
+			if mode, ok = classes[a[PriorityClassAnnotation]]; !ok {
+				return "", false
+			}
+		}
+		bgMode, ok := prefetchModes[mode]
+		return bgMode, ok
+	}, nil
+}
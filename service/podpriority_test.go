@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestPodBackgroundFetchMode(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		classes     map[string]string
+		annotations map[string]string
+		wantMode    string
+		wantOK      bool
+		wantErr     bool
+	}{
+		{
+			name:        "aggressive",
+			annotations: map[string]string{PrefetchAnnotation: "aggressive"},
+			wantMode:    "full",
+			wantOK:      true,
+		},
+		{
+			name:        "normal",
+			annotations: map[string]string{PrefetchAnnotation: "normal"},
+			wantMode:    "on",
+			wantOK:      true,
+		},
+		{
+			name:        "off",
+			annotations: map[string]string{PrefetchAnnotation: "off"},
+			wantMode:    "off",
+			wantOK:      true,
+		},
+		{
+			name:        "unknown_prefetch_mode",
+			annotations: map[string]string{PrefetchAnnotation: "unknown"},
+		},
+		{
+			name:        "default_latency_critical",
+			annotations: map[string]string{PriorityClassAnnotation: "latency-critical"},
+			wantMode:    "full",
+			wantOK:      true,
+		},
+		{
+			name:        "default_best_effort",
+			annotations: map[string]string{PriorityClassAnnotation: "best-effort"},
+			wantMode:    "off",
+			wantOK:      true,
+		},
+		{
+			name:        "unknown_priority_class",
+			annotations: map[string]string{PriorityClassAnnotation: "unknown"},
+		},
+		{
+			name:        "custom_priority_class",
+			classes:     map[string]string{"batch": "off"},
+			annotations: map[string]string{PriorityClassAnnotation: "batch"},
+			wantMode:    "off",
+			wantOK:      true,
+		},
+		{
+			name:        "custom_classes_replace_defaults",
+			classes:     map[string]string{"batch": "off"},
+			annotations: map[string]string{PriorityClassAnnotation: "latency-critical"},
+		},
+		{
+			name: "prefetch_annotation_precedes_priority_class",
+			annotations: map[string]string{
+				PrefetchAnnotation:      "normal",
+				PriorityClassAnnotation: "latency-critical",
+			},
+			wantMode: "on",
+			wantOK:   true,
+		},
+		{
+			name:        "unknown_prefetch_mode_doesnt_fall_back_to_priority_class",
+			annotations: map[string]string{PrefetchAnnotation: "unknown", PriorityClassAnnotation: "latency-critical"},
+		},
+		{
+			name: "no_annotation",
+		},
+		{
+			name:    "invalid_priority_class_config",
+			classes: map[string]string{"batch": "full"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := reference.Parse("example.com/foo:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := podBackgroundFetchMode(PodFetchPriorityConfig{Enable: true, PriorityClasses: tt.classes}, func(refspec reference.Spec) map[string]string {
+				if refspec != image {
+					t.Errorf("annotations of unexpected image %q are requested", refspec)
+				}
+				return tt.annotations
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("invalid config must be rejected")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("failed to configure: %v", err)
+			}
+			mode, ok := f(image)
+			if ok != tt.wantOK || mode != tt.wantMode {
+				t.Errorf("got mode %q (%v); want %q (%v)", mode, ok, tt.wantMode, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy decides per image whether it is lazily pulled, fully
+// downloaded or rejected.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/snapshots"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	defaultDecisionTTL    = time.Minute
+)
+
+// Decision is the result of the policy evaluation for an image.
+type Decision string
+
+const (
+	// DecisionLazy lazily pulls the image.
+	DecisionLazy Decision = "lazy"
+
+	// DecisionFull doesn't lazily pull the image but lets containerd to download
+	// and unpack it in the ordinary way.
+	DecisionFull Decision = "full"
+
+	// DecisionReject refuses to prepare the layers of the image.
+	DecisionReject Decision = "reject"
+)
+
+// Config is config for the policy deciding how images are pulled.
+type Config struct {
+	// Enable enables the policy.
+	Enable bool `toml:"enable"`
+
+	// Default is the decision used when no rule matches and no webhook is
+	// configured. Defaults to "lazy".
+	Default Decision `toml:"default"`
+
+	// Rules is the list of rules. The first rule matching the image is used.
+	Rules []RuleConfig `toml:"rule"`
+
+	// Webhook is an external evaluator called when no rule matches.
+	Webhook WebhookConfig `toml:"webhook"`
+}
+
+// RuleConfig is a rule deciding how matching images are pulled. An image matches
+// the rule when it matches all of the specified conditions.
+type RuleConfig struct {
+	// Registries is a list of host patterns (e.g. "*.example.com") matched with
+	// path.Match against the host of the image.
+	Registries []string `toml:"registries"`
+
+	// Repositories is a list of repository patterns (e.g. "ghcr.io/myorg/*")
+	// matched with path.Match against "<host>/<repository>".
+	Repositories []string `toml:"repositories"`
+
+	// Labels is a set of snapshot labels and value patterns the layer must have.
+	Labels map[string]string `toml:"labels"`
+
+	// Decision is the decision for matching images.
+	Decision Decision `toml:"decision"`
+}
+
+// WebhookConfig is config for the external evaluator.
+//
+// The webhook receives a POST request with JSON body of WebhookRequest and
+// must respond with JSON body of WebhookResponse.
+type WebhookConfig struct {
+	// URL is the endpoint of the webhook. Empty disables the webhook.
+	URL string `toml:"url"`
+
+	// TimeoutSec is the timeout of a request to the webhook. Defaults to 5s.
+	TimeoutSec int64 `toml:"timeout_sec"`
+
+	// FailureDecision is the decision used when the webhook fails. Defaults
+	// to "full".
+	FailureDecision Decision `toml:"failure_decision"`
+}
+
+// WebhookRequest is the request body sent to the webhook.
+type WebhookRequest struct {
+	Reference string            `json:"reference"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// WebhookResponse is the response body expected from the webhook.
+type WebhookResponse struct {
+	Decision Decision `json:"decision"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// Engine evaluates the policy for images.
+type Engine struct {
+	defaultDecision Decision
+	rules           []RuleConfig
+
+	webhookURL      string
+	webhookClient   *http.Client
+	failureDecision Decision
+
+	decisions   map[string]cachedDecision
+	decisionsMu sync.Mutex
+	ttl         time.Duration
+}
+
+type cachedDecision struct {
+	decision Decision
+	expires  time.Time
+}
+
+// NewEngine returns a policy engine based on the config.
+func NewEngine(cfg Config) (*Engine, error) {
+	e := &Engine{
+		defaultDecision: cfg.Default,
+		rules:           cfg.Rules,
+		webhookURL:      cfg.Webhook.URL,
+		failureDecision: cfg.Webhook.FailureDecision,
+		decisions:       make(map[string]cachedDecision),
+		ttl:             defaultDecisionTTL,
+	}
+	if e.defaultDecision == "" {
+		e.defaultDecision = DecisionLazy
+	}
+	if e.failureDecision == "" {
+		e.failureDecision = DecisionFull
+	}
+	if err := e.defaultDecision.validate(); err != nil {
+		return nil, fmt.Errorf("invalid default decision: %w", err)
+	}
+	if err := e.failureDecision.validate(); err != nil {
+		return nil, fmt.Errorf("invalid webhook failure decision: %w", err)
+	}
+	for i, r := range cfg.Rules {
+		if err := r.Decision.validate(); err != nil {
+			return nil, fmt.Errorf("invalid decision of rule #%d: %w", i, err)
+		}
+		patterns := append(append([]string{}, r.Registries...), r.Repositories...)
+		for _, v := range r.Labels {
+			patterns = append(patterns, v)
+		}
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in rule #%d: %w", p, i, err)
+			}
+		}
+	}
+	timeout := time.Duration(cfg.Webhook.TimeoutSec) * time.Second
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	e.webhookClient = &http.Client{Timeout: timeout}
+	return e, nil
+}
+
+func (d Decision) validate() error {
+	switch d {
+	case DecisionLazy, DecisionFull, DecisionReject:
+		return nil
+	}
+	return fmt.Errorf("unknown decision %q", d)
+}
+
+// Evaluate returns the decision for the image.
+func (e *Engine) Evaluate(ctx context.Context, refspec reference.Spec, labels map[string]string) Decision {
+	for _, r := range e.rules {
+		if r.match(refspec, labels) {
+			return r.Decision
+		}
+	}
+	if e.webhookURL == "" {
+		return e.defaultDecision
+	}
+
+	key := refspec.String()
+	e.decisionsMu.Lock()
+	c, ok := e.decisions[key]
+	e.decisionsMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.decision
+	}
+	d, err := e.callWebhook(ctx, refspec, labels)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("ref", key).
+			Warnf("failed to evaluate policy with webhook; using %q", e.failureDecision)
+		return e.failureDecision
+	}
+	e.decisionsMu.Lock()
+	for k, old := range e.decisions {
+		if time.Now().After(old.expires) {
+			delete(e.decisions, k)
+		}
+	}
+	e.decisions[key] = cachedDecision{decision: d, expires: time.Now().Add(e.ttl)}
+	e.decisionsMu.Unlock()
+	return d
+}
+
+func (e *Engine) callWebhook(ctx context.Context, refspec reference.Spec, labels map[string]string) (Decision, error) {
+	body, err := json.Marshal(WebhookRequest{Reference: refspec.String(), Labels: labels})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.webhookClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %v", resp.Status)
+	}
+	var res WebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("invalid response: %w", err)
+	}
+	if err := res.Decision.validate(); err != nil {
+		return "", err
+	}
+	log.G(ctx).WithField("ref", refspec.String()).WithField("reason", res.Reason).
+		Debugf("webhook decided %q", res.Decision)
+	return res.Decision, nil
+}
+
+func (r RuleConfig) match(refspec reference.Spec, labels map[string]string) bool {
+	if len(r.Registries) > 0 && !matchAny(r.Registries, refspec.Hostname()) {
+		return false
+	}
+	if len(r.Repositories) > 0 && !matchAny(r.Repositories, refspec.Locator) {
+		return false
+	}
+	for k, pattern := range r.Labels {
+		v, ok := labels[k]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, v); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FileSystem wraps the filesystem so that the policy is applied before mounting
+// layers. getSources is used to get the image reference of the layer.
+func (e *Engine) FileSystem(fs snapshot.FileSystem, getSources source.GetSources) snapshot.FileSystem {
+	return &filesystem{FileSystem: fs, engine: e, getSources: getSources}
+}
+
+type filesystem struct {
+	snapshot.FileSystem
+	engine     *Engine
+	getSources source.GetSources
+}
+
+func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	src, err := fs.getSources(labels)
+	if err != nil || len(src) == 0 {
+		// Let the underlying filesystem report the error.
+		return fs.FileSystem.Mount(ctx, mountpoint, labels)
+	}
+	refspec := src[0].Name
+	namespace, _ := namespaces.Namespace(ctx)
+	switch d := fs.engine.Evaluate(ctx, refspec, labels); d {
+	case DecisionLazy:
+		return fs.FileSystem.Mount(ctx, mountpoint, labels)
+	case DecisionReject:
+		commonmetrics.IncImageLayerPullCount(refspec.String(), namespace, commonmetrics.RejectedPull)
+		return fmt.Errorf("image %q is rejected by policy: %w", refspec, snapshot.ErrRejected)
+	default:
+		commonmetrics.IncImageLayerPullCount(refspec.String(), namespace, commonmetrics.FallbackPull)
+		return fmt.Errorf("policy requires image %q to be fully downloaded", refspec)
+	}
+}
+
+// Unpack lets the underlying filesystem unpack the layer only if the image is
+// lazily pulled. Otherwise, containerd pulls the layer as required by the policy.
+func (fs *filesystem) Unpack(ctx context.Context, mounts []mount.Mount, labels map[string]string) (ocispec.Descriptor, error) {
+	u, ok := fs.FileSystem.(snapshot.Unpacker)
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("unpacking layers isn't supported: %w", errdefs.ErrNotImplemented)
+	}
+	src, err := fs.getSources(labels)
+	if err != nil || len(src) == 0 {
+		// Let the underlying filesystem report the error.
+		return u.Unpack(ctx, mounts, labels)
+	}
+	if d := fs.engine.Evaluate(ctx, src[0].Name, labels); d != DecisionLazy {
+		return ocispec.Descriptor{}, fmt.Errorf("image %q isn't lazily pulled by the policy (%q): %w", src[0].Name, d, errdefs.ErrNotImplemented)
+	}
+	return u.Unpack(ctx, mounts, labels)
+}
+
+// Usage returns the usage reported by the underlying filesystem.
+func (fs *filesystem) Usage(ctx context.Context, mountpoint string) (snapshots.Usage, error) {
+	r, ok := fs.FileSystem.(snapshot.UsageReporter)
+	if !ok {
+		return snapshots.Usage{}, fmt.Errorf("usage isn't reported: %w", errdefs.ErrNotImplemented)
+	}
+	return r.Usage(ctx, mountpoint)
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+const testRefLabel = "test.ref"
+
+func TestEvaluate(t *testing.T) {
+	var webhookCalls int
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls++
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Reference {
+		case "webhook.example.com/lazy:latest":
+			json.NewEncoder(w).Encode(WebhookResponse{Decision: DecisionLazy})
+		case "webhook.example.com/reject:latest":
+			json.NewEncoder(w).Encode(WebhookResponse{Decision: DecisionReject, Reason: "untrusted"})
+		case "webhook.example.com/invalid:latest":
+			json.NewEncoder(w).Encode(WebhookResponse{Decision: "unknown"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer webhook.Close()
+
+	rules := []RuleConfig{
+		{Registries: []string{"*.internal.example.com"}, Decision: DecisionLazy},
+		{Repositories: []string{"docker.io/library/*"}, Labels: map[string]string{"team": "infra-*"}, Decision: DecisionLazy},
+		{Repositories: []string{"docker.io/library/*"}, Decision: DecisionFull},
+		{Registries: []string{"evil.example.com"}, Decision: DecisionReject},
+	}
+	tests := []struct {
+		name   string
+		config Config
+		ref    string
+		labels map[string]string
+		want   Decision
+	}{
+		{name: "default", config: Config{}, ref: "example.com/foo:latest", want: DecisionLazy},
+		{name: "configured_default", config: Config{Default: DecisionFull}, ref: "example.com/foo:latest", want: DecisionFull},
+		{name: "registry", config: Config{Rules: rules, Default: DecisionReject}, ref: "reg.internal.example.com/foo:latest", want: DecisionLazy},
+		{name: "repository_and_labels", config: Config{Rules: rules}, ref: "docker.io/library/ubuntu:22.04", labels: map[string]string{"team": "infra-a"}, want: DecisionLazy},
+		{name: "repository", config: Config{Rules: rules}, ref: "docker.io/library/ubuntu:22.04", labels: map[string]string{"team": "app"}, want: DecisionFull},
+		{name: "reject", config: Config{Rules: rules}, ref: "evil.example.com/foo:latest", want: DecisionReject},
+		{name: "unmatched", config: Config{Rules: rules, Default: DecisionReject}, ref: "docker.io/other/ubuntu:22.04", want: DecisionReject},
+		{name: "rule_before_webhook", config: Config{Rules: rules, Webhook: WebhookConfig{URL: webhook.URL}}, ref: "evil.example.com/foo:latest", want: DecisionReject},
+		{name: "webhook_lazy", config: Config{Webhook: WebhookConfig{URL: webhook.URL}, Default: DecisionReject}, ref: "webhook.example.com/lazy:latest", want: DecisionLazy},
+		{name: "webhook_reject", config: Config{Webhook: WebhookConfig{URL: webhook.URL}}, ref: "webhook.example.com/reject:latest", want: DecisionReject},
+		{name: "webhook_invalid", config: Config{Webhook: WebhookConfig{URL: webhook.URL}}, ref: "webhook.example.com/invalid:latest", want: DecisionFull},
+		{name: "webhook_failure", config: Config{Webhook: WebhookConfig{URL: webhook.URL}}, ref: "webhook.example.com/error:latest", want: DecisionFull},
+		{name: "webhook_failure_configured", config: Config{Webhook: WebhookConfig{URL: webhook.URL, FailureDecision: DecisionReject}}, ref: "webhook.example.com/error:latest", want: DecisionReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewEngine(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refspec, err := reference.Parse(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Evaluate(context.Background(), refspec, tt.labels); got != tt.want {
+				t.Errorf("decision = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Decisions of the webhook are cached
+	e, err := NewEngine(Config{Webhook: WebhookConfig{URL: webhook.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refspec, err := reference.Parse("webhook.example.com/lazy:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookCalls = 0
+	for i := 0; i < 3; i++ {
+		if got := e.Evaluate(context.Background(), refspec, nil); got != DecisionLazy {
+			t.Fatalf("decision = %q; want %q", got, DecisionLazy)
+		}
+	}
+	if webhookCalls != 1 {
+		t.Errorf("webhook called %d times; want 1", webhookCalls)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Default: "unknown"},
+		{Webhook: WebhookConfig{FailureDecision: "unknown"}},
+		{Rules: []RuleConfig{{Decision: "unknown"}}},
+		{Rules: []RuleConfig{{Repositories: []string{"["}, Decision: DecisionLazy}}},
+	} {
+		if _, err := NewEngine(cfg); err == nil {
+			t.Errorf("config %+v must be invalid", cfg)
+		}
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	e, err := NewEngine(Config{Rules: []RuleConfig{
+		{Registries: []string{"lazy.example.com"}, Decision: DecisionLazy},
+		{Registries: []string{"full.example.com"}, Decision: DecisionFull},
+		{Registries: []string{"reject.example.com"}, Decision: DecisionReject},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getSources := func(labels map[string]string) ([]source.Source, error) {
+		refspec, err := reference.Parse(labels[testRefLabel])
+		if err != nil {
+			return nil, err
+		}
+		return []source.Source{{Name: refspec}}, nil
+	}
+	tests := []struct {
+		ref         string
+		wantMounted bool
+		wantErr     bool
+		wantReject  bool
+	}{
+		{ref: "lazy.example.com/foo:latest", wantMounted: true},
+		{ref: "full.example.com/foo:latest", wantErr: true},
+		{ref: "reject.example.com/foo:latest", wantErr: true, wantReject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			base := &testFs{}
+			err := e.FileSystem(base, getSources).Mount(context.Background(), "/dummy", map[string]string{testRefLabel: tt.ref})
+			if base.mounted != tt.wantMounted {
+				t.Errorf("mounted = %v; want %v", base.mounted, tt.wantMounted)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("wantErr = %v; got %v", tt.wantErr, err)
+			}
+			if errors.Is(err, snapshot.ErrRejected) != tt.wantReject {
+				t.Errorf("wantReject = %v; got %v", tt.wantReject, err)
+			}
+		})
+	}
+}
+
+type testFs struct {
+	snapshot.FileSystem
+	mounted bool
+}
+
+func (fs *testFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mounted = true
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/containerd/stargz-snapshotter/service/policy"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// prewarmFilesystem is a filesystem which can fetch layers before they are mounted.
+type prewarmFilesystem interface {
+	Prewarm(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, manifest ocispec.Manifest, keep time.Duration) error
+}
+
+// imagePrewarmer implements admin.ImagePrewarmer.
+type imagePrewarmer struct {
+	fs     prewarmFilesystem
+	hosts  source.RegistryHosts
+	engine *policy.Engine // nil if lazy pull policy is disabled
+}
+
+func (p *imagePrewarmer) PrewarmImage(ctx context.Context, ref string, keep time.Duration) (admin.PrewarmResult, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return admin.PrewarmResult{}, fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	if p.engine != nil {
+		if d := p.engine.Evaluate(ctx, refspec, nil); d != policy.DecisionLazy {
+			return admin.PrewarmResult{}, fmt.Errorf("image %q isn't lazily pulled by the policy (%q)", ref, d)
+		}
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != refspec.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, refspec.String())
+			}
+			return p.hosts(refspec)
+		},
+	})
+	_, img, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return admin.PrewarmResult{}, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return admin.PrewarmResult{}, err
+	}
+	manifest, err := containerdutil.FetchManifestPlatform(ctx, fetcher, img, platforms.DefaultSpec())
+	if err != nil {
+		return admin.PrewarmResult{}, fmt.Errorf("failed to fetch manifest of %q: %w", ref, err)
+	}
+	if err := p.fs.Prewarm(ctx, p.hosts, refspec, manifest, keep); err != nil {
+		return admin.PrewarmResult{}, err
+	}
+	res := admin.PrewarmResult{Reference: refspec.String()}
+	for _, l := range manifest.Layers {
+		res.Layers = append(res.Layers, l.Digest)
+	}
+	log.G(ctx).WithField("ref", refspec.String()).Infof("prewarming %d layers", len(res.Layers))
+	return res, nil
+}
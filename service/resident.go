@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+)
+
+// residentProgressInterval is the interval of reporting the progress of layers.
+const residentProgressInterval = time.Second
+
+// residentFilesystem is a filesystem which lists mounted layers.
+type residentFilesystem interface {
+	MountedLayers() []stargzfs.MountedLayer
+}
+
+// residentMaker implements admin.ResidentMaker.
+type residentMaker struct {
+	fs residentFilesystem
+}
+
+func (m *residentMaker) MakeResident(ctx context.Context, req admin.ResidentRequest, progress func(admin.ResidentProgress)) error {
+	var (
+		targets []stargzfs.MountedLayer
+		added   = make(map[string]struct{})
+	)
+	for _, l := range m.fs.MountedLayers() {
+		if req.Reference != "" && l.Reference != req.Reference {
+			continue
+		}
+		dgst := l.Layer.Info().Digest
+		if req.Digest != "" && dgst != req.Digest {
+			continue
+		}
+		// The same layer can be mounted at multiple mountpoints.
+		key := l.Reference + "@" + dgst.String()
+		if _, ok := added[key]; ok {
+			continue
+		}
+		added[key] = struct{}{}
+		targets = append(targets, l)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no mounted layer matches the request")
+	}
+
+	var (
+		wg         sync.WaitGroup
+		progressMu sync.Mutex
+	)
+	report := func(l stargzfs.MountedLayer, done bool, err error) {
+		info := l.Layer.Info()
+		p := admin.ResidentProgress{
+			Reference: l.Reference,
+			Digest:    info.Digest,
+			Size:      info.Size,
+			Fetched:   info.FetchedSize,
+			Done:      done,
+		}
+		if err != nil {
+			p.Error = err.Error()
+		}
+		progressMu.Lock()
+		progress(p)
+		progressMu.Unlock()
+	}
+	for _, l := range targets {
+		l := l
+		report(l, false, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				doneCh    = make(chan struct{})
+				stoppedCh = make(chan struct{})
+			)
+			go func() {
+				defer close(stoppedCh)
+				t := time.NewTicker(residentProgressInterval)
+				defer t.Stop()
+				for {
+					select {
+					case <-t.C:
+						report(l, false, nil)
+					case <-doneCh:
+						return
+					}
+				}
+			}()
+			start := time.Now()
+			err := l.Layer.MakeResident()
+			close(doneCh)
+			<-stoppedCh // the final progress must come last
+			if err != nil {
+				log.G(ctx).WithError(err).WithField("digest", l.Layer.Info().Digest).Warn("failed to make layer resident")
+			} else {
+				log.G(ctx).WithField("digest", l.Layer.Info().Digest).Infof("made layer resident in %v", time.Since(start))
+			}
+			report(l, true, err)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,300 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/auth"
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+)
+
+const (
+	// defaultTokenExpiresIn is the lifetime of tokens which don't have "expires_in".
+	// Docs: https://docs.docker.com/registry/spec/auth/token/#token-response-fields
+	defaultTokenExpiresIn = 60 * time.Second
+
+	// tokenRefreshRatio is the ratio of the remaining lifetime of a token when the
+	// token is refreshed. Tokens are refreshed before expiration so that requests
+	// (e.g. long-running reads on FUSE mounts) don't fail with expired tokens.
+	tokenRefreshRatio = 0.2
+)
+
+// authorizer is a docker.Authorizer that refreshes bearer tokens ahead of their
+// expiration. Unlike containerd's authorizer, which caches tokens until the process
+// ends, this re-runs the auth handshake (including getting the credentials) when
+// the registry rejects the token.
+type authorizer struct {
+	client      *http.Client
+	credentials func(host string) (string, string, error)
+
+	handlers map[string]*authHandler
+	mu       sync.Mutex
+
+	// rewriteScope rewrites each scope of bearer tokens (e.g. the repository of the
+	// image rewritten by registries.conf). nil means scopes are used as is.
+	rewriteScope func(scope string) string
+
+	// nowFunc returns the current time. Used for tests.
+	nowFunc func() time.Time
+}
+
+func newAuthorizer(client *http.Client, credentials func(host string) (string, string, error)) *authorizer {
+	return &authorizer{
+		client:      client,
+		credentials: credentials,
+		handlers:    make(map[string]*authHandler),
+		nowFunc:     time.Now,
+	}
+}
+
+// Authorize sets the authorization header to the request.
+func (a *authorizer) Authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	ah := a.handlers[req.URL.Host]
+	a.mu.Unlock()
+	if ah == nil {
+		return nil // no auth challenge has been received
+	}
+	v, err := ah.authorize(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", v)
+	return nil
+}
+
+// AddResponses handles the auth challenge of the response. The existing handler
+// of the host is always replaced because the challenge means the current
+// authorization (if any) has been rejected.
+func (a *authorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	last := responses[len(responses)-1]
+	host := last.Request.URL.Host
+
+	for _, c := range auth.ParseAuthHeader(last.Header) {
+		switch c.Scheme {
+		case auth.BearerAuth:
+			if err := invalidAuthorization(c, responses); err != nil {
+				a.mu.Lock()
+				delete(a.handlers, host)
+				a.mu.Unlock()
+				return err
+			}
+			username, secret, err := a.getCredentials(host)
+			if err != nil {
+				return err
+			}
+			common, err := auth.GenerateTokenOptions(ctx, host, username, secret, c)
+			if err != nil {
+				return err
+			}
+			a.setHandler(ctx, host, &authHandler{
+				client:       a.client,
+				scheme:       c.Scheme,
+				common:       common,
+				tokens:       make(map[string]*token),
+				rewriteScope: a.rewriteScope,
+				nowFunc:      a.nowFunc,
+			})
+			return nil
+		case auth.BasicAuth:
+			username, secret, err := a.getCredentials(host)
+			if err != nil {
+				return err
+			}
+			if username != "" && secret != "" {
+				a.setHandler(ctx, host, &authHandler{
+					scheme:  c.Scheme,
+					common:  auth.TokenOptions{Username: username, Secret: secret},
+					nowFunc: a.nowFunc,
+				})
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("failed to find supported auth scheme: %w", errdefs.ErrNotImplemented)
+}
+
+func (a *authorizer) getCredentials(host string) (string, string, error) {
+	if a.credentials == nil {
+		return "", "", nil
+	}
+	return a.credentials(host)
+}
+
+func (a *authorizer) setHandler(ctx context.Context, host string, ah *authHandler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.handlers[host]; ok {
+		log.G(ctx).WithField("host", host).Debugf("authorization has been rejected; re-authorizing")
+	}
+	a.handlers[host] = ah
+}
+
+// authHandler authorizes requests to a registry host.
+type authHandler struct {
+	client *http.Client
+	scheme auth.AuthenticationScheme
+	common auth.TokenOptions
+
+	// tokens caches bearer tokens indexed by scopes
+	tokens   map[string]*token
+	tokensMu sync.Mutex
+
+	rewriteScope func(scope string) string
+
+	nowFunc func() time.Time
+}
+
+// token is a bearer token. wg is done when the token is fetched.
+type token struct {
+	wg        sync.WaitGroup
+	value     string
+	err       error
+	refreshAt time.Time
+}
+
+func (ah *authHandler) authorize(ctx context.Context) (string, error) {
+	switch ah.scheme {
+	case auth.BasicAuth:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(ah.common.Username+":"+ah.common.Secret)), nil
+	case auth.BearerAuth:
+		return ah.bearer(ctx)
+	default:
+		return "", fmt.Errorf("failed to find supported auth scheme: %s: %w", string(ah.scheme), errdefs.ErrNotImplemented)
+	}
+}
+
+func (ah *authHandler) bearer(ctx context.Context) (string, error) {
+	to := ah.common
+	to.Scopes = docker.GetTokenScopes(ctx, to.Scopes)
+	if ah.rewriteScope != nil {
+		scopes := make([]string, len(to.Scopes))
+		for i, s := range to.Scopes {
+			scopes[i] = ah.rewriteScope(s)
+		}
+		to.Scopes = docker.GetTokenScopes(context.Background(), scopes) // sort and deduplicate
+	}
+	scoped := strings.Join(to.Scopes, " ")
+
+	ah.tokensMu.Lock()
+	if t, ok := ah.tokens[scoped]; ok {
+		ah.tokensMu.Unlock()
+		t.wg.Wait()
+		if t.err == nil && ah.nowFunc().Before(t.refreshAt) {
+			return "Bearer " + t.value, nil
+		}
+		ah.tokensMu.Lock()
+		if ah.tokens[scoped] == t {
+			delete(ah.tokens, scoped) // expiring or failed; refresh it
+		}
+		ah.tokensMu.Unlock()
+		return ah.bearer(ctx)
+	}
+	t := &token{}
+	t.wg.Add(1)
+	ah.tokens[scoped] = t
+	ah.tokensMu.Unlock()
+
+	issuedAt := ah.nowFunc()
+	v, expiresIn, err := fetchToken(ctx, ah.client, to)
+	if err != nil {
+		t.err = err
+		t.wg.Done()
+		return "", err
+	}
+	t.value = v
+	t.refreshAt = issuedAt.Add(time.Duration(float64(expiresIn) * (1 - tokenRefreshRatio)))
+	t.wg.Done()
+	return "Bearer " + v, nil
+}
+
+// fetchToken fetches a bearer token and its lifetime.
+// NOTE: the flow is ported from https://github.com/containerd/containerd/blob/v1.6.6/remotes/docker/authorizer.go#L270-L331
+func fetchToken(ctx context.Context, client *http.Client, to auth.TokenOptions) (string, time.Duration, error) {
+	if to.Secret != "" {
+		// credential information is provided, use oauth POST endpoint
+		resp, err := auth.FetchTokenWithOAuth(ctx, client, nil, "containerd-client", to)
+		if err == nil {
+			return resp.AccessToken, expiresIn(resp.ExpiresIn), nil
+		}
+		var errStatus remoteerrors.ErrUnexpectedStatus
+		if !errors.As(err, &errStatus) {
+			return "", 0, fmt.Errorf("failed to fetch oauth token: %w", err)
+		}
+		// Registries without support for POST may return 404 for POST /v2/token.
+		// As of September 2017, GCR is known to return 404.
+		// As of February 2018, JFrog Artifactory is known to return 401.
+		// As of January 2022, ACR is known to return 400.
+		if !((errStatus.StatusCode == 405 && to.Username != "") || errStatus.StatusCode == 404 || errStatus.StatusCode == 401 || errStatus.StatusCode == 400) {
+			return "", 0, fmt.Errorf("failed to fetch oauth token: %w", err)
+		}
+	}
+	resp, err := auth.FetchToken(ctx, client, nil, to)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	v := resp.Token
+	if v == "" {
+		v = resp.AccessToken
+	}
+	return v, expiresIn(resp.ExpiresIn), nil
+}
+
+func expiresIn(sec int) time.Duration {
+	if sec <= 0 {
+		return defaultTokenExpiresIn
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// invalidAuthorization returns an error if the same request has been rejected with the
+// error in the challenge.
+// NOTE: ported from https://github.com/containerd/containerd/blob/v1.6.6/remotes/docker/authorizer.go#L333-L361
+func invalidAuthorization(c auth.Challenge, responses []*http.Response) error {
+	errStr := c.Parameters["error"]
+	if errStr == "" {
+		return nil
+	}
+
+	n := len(responses)
+	if n == 1 || (n > 1 && !sameRequest(responses[n-2].Request, responses[n-1].Request)) {
+		return nil
+	}
+
+	return fmt.Errorf("server message: %s: %w", errStr, docker.ErrInvalidAuthorization)
+}
+
+func sameRequest(r1, r2 *http.Request) bool {
+	if r1.Method != r2.Method {
+		return false
+	}
+	if *r1.URL != *r2.URL {
+		return false
+	}
+	return true
+}
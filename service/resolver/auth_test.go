@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTokenRegistry is a registry which requires bearer tokens. Only the latest
+// issued token is valid.
+type testTokenRegistry struct {
+	srv    *httptest.Server
+	issued int
+	valid  string
+	mu     sync.Mutex
+}
+
+func newTestTokenRegistry() *testTokenRegistry {
+	r := &testTokenRegistry{}
+	r.srv = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *testTokenRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		r.issued++
+		r.valid = fmt.Sprintf("token%d", r.issued)
+		fmt.Fprintf(w, `{"token":%q,"expires_in":60}`, r.valid)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+r.valid {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *testTokenRegistry) revoke() {
+	r.mu.Lock()
+	r.valid = ""
+	r.mu.Unlock()
+}
+
+func (r *testTokenRegistry) issuedTokens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.issued
+}
+
+func TestAuthorizerRefresh(t *testing.T) {
+	reg := newTestTokenRegistry()
+	defer reg.srv.Close()
+
+	now := time.Now()
+	a := newAuthorizer(reg.srv.Client(), nil)
+	a.nowFunc = func() time.Time { return now }
+
+	get := func() *http.Response {
+		req, err := http.NewRequest("GET", reg.srv.URL+"/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Authorize(context.Background(), req); err != nil {
+			t.Fatalf("failed to authorize: %v", err)
+		}
+		res, err := reg.srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("failed to request: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	getWithAuth := func() {
+		res := get()
+		if res.StatusCode == http.StatusUnauthorized {
+			if err := a.AddResponses(context.Background(), []*http.Response{res}); err != nil {
+				t.Fatalf("failed to add responses: %v", err)
+			}
+			res = get()
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %v", res.Status)
+		}
+	}
+
+	// Initial handshake
+	getWithAuth()
+	if n := reg.issuedTokens(); n != 1 {
+		t.Fatalf("issued %d tokens; want 1", n)
+	}
+
+	// Cached token is used
+	now = now.Add(30 * time.Second)
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Fatalf("cached token must be used; got %v", res.Status)
+	}
+	if n := reg.issuedTokens(); n != 1 {
+		t.Fatalf("issued %d tokens; want 1", n)
+	}
+
+	// Token is refreshed ahead of expiry
+	now = now.Add(20 * time.Second)
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Fatalf("token must be refreshed; got %v", res.Status)
+	}
+	if n := reg.issuedTokens(); n != 2 {
+		t.Fatalf("issued %d tokens; want 2", n)
+	}
+
+	// Handshake is re-run when the token is rejected
+	reg.revoke()
+	getWithAuth()
+	if n := reg.issuedTokens(); n != 3 {
+		t.Fatalf("issued %d tokens; want 3", n)
+	}
+}
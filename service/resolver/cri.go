@@ -111,7 +111,7 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 	if len(paths) > 0 {
 		return func(ref reference.Spec) ([]docker.RegistryHost, error) {
 			hostOptions := dconfig.HostOptions{}
-			hostOptions.Credentials = multiCredsFuncs(ref, append(credsFuncs, func(host string, ref reference.Spec) (string, string, error) {
+			credentials := multiCredsFuncs(ref, append(credsFuncs, func(host string, ref reference.Spec) (string, string, error) {
 				config := config.Configs[host]
 				if config.Auth != nil {
 					return ParseAuth(toRuntimeAuthConfig(*config.Auth), host)
@@ -119,7 +119,14 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 				return "", "", nil
 			})...)
 			hostOptions.HostDir = hostDirFromRoots(paths)
-			return dconfig.ConfigureHosts(ctx, hostOptions)(ref.Hostname())
+			hosts, err := dconfig.ConfigureHosts(ctx, hostOptions)(ref.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			for i := range hosts {
+				hosts[i].Authorizer = newAuthorizer(hosts[i].Client, credentials) // refreshes tokens
+			}
+			return hosts, nil
 		}
 	}
 	return func(ref reference.Spec) ([]docker.RegistryHost, error) {
@@ -155,9 +162,7 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 			}
 
 			client := rclient.StandardClient()
-			authorizer := docker.NewDockerAuthorizer(
-				docker.WithAuthClient(client),
-				docker.WithAuthCreds(multiCredsFuncs(ref, credsFuncs...)))
+			authorizer := newAuthorizer(client, multiCredsFuncs(ref, credsFuncs...))
 
 			if u.Path == "" {
 				u.Path = "/v2"
@@ -0,0 +1,262 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/pelletier/go-toml"
+)
+
+// DefaultRegistriesConfPath is the default path to registries.conf.
+const DefaultRegistriesConfPath = "/etc/containers/registries.conf"
+
+const (
+	pullFromMirrorAll        = "all"
+	pullFromMirrorDigestOnly = "digest-only"
+	pullFromMirrorTagOnly    = "tag-only"
+)
+
+// RegistriesConf is the configuration of registries in the format of
+// containers-registries.conf(5) (version 2) used by Podman and CRI-O.
+// Only mirrors, rewrites of locations and blocking of registries are supported.
+type RegistriesConf struct {
+	Registries []RegistryConf `toml:"registry"`
+}
+
+// RegistryConf is the configuration of a registry (or a namespace of a registry).
+type RegistryConf struct {
+	// Prefix is the prefix of image references this configuration applies to. This can
+	// start with a wildcard ("*.example.com") to match subdomains. Default is Location.
+	Prefix string `toml:"prefix"`
+
+	// Location is the location where images matching Prefix are pulled from. The prefix
+	// of image references is replaced with Location.
+	Location string `toml:"location"`
+
+	// Insecure is true means use http scheme instead of https.
+	Insecure bool `toml:"insecure"`
+
+	// Blocked is true means images matching Prefix must not be pulled.
+	Blocked bool `toml:"blocked"`
+
+	// MirrorByDigestOnly is true means the mirrors are used only for images
+	// referenced by digests.
+	MirrorByDigestOnly bool `toml:"mirror-by-digest-only"`
+
+	Mirrors []RegistryMirrorConf `toml:"mirror"`
+}
+
+// RegistryMirrorConf is the configuration of a mirror of a registry.
+type RegistryMirrorConf struct {
+	// Location is the location of the mirror. The prefix of image references is replaced
+	// with Location.
+	Location string `toml:"location"`
+
+	// Insecure is true means use http scheme instead of https.
+	Insecure bool `toml:"insecure"`
+
+	// PullFromMirror is "all", "digest-only" or "tag-only". This overrides
+	// MirrorByDigestOnly of the registry.
+	PullFromMirror string `toml:"pull-from-mirror"`
+}
+
+// LoadRegistriesConf loads registries.conf from the path. Drop-in files in
+// "registries.conf.d" directory next to the file are also loaded in lexical order.
+// A registry in a drop-in file overrides the one with the same prefix.
+func LoadRegistriesConf(path string) (*RegistriesConf, error) {
+	var rc RegistriesConf
+	if err := rc.load(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	dropIns, err := filepath.Glob(filepath.Join(filepath.Dir(path), "registries.conf.d", "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dropIns)
+	for _, p := range dropIns {
+		if err := rc.load(p); err != nil {
+			return nil, err
+		}
+	}
+	return &rc, nil
+}
+
+func (rc *RegistriesConf) load(path string) error {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	var c RegistriesConf
+	if err := tree.Unmarshal(&c); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	for _, r := range c.Registries {
+		if r.Prefix == "" {
+			r.Prefix = r.Location
+		}
+		if r.Prefix == "" {
+			return fmt.Errorf("prefix or location must be specified for a registry in %q", path)
+		}
+		if strings.HasPrefix(r.Prefix, "*.") && r.Location != "" {
+			return fmt.Errorf("location can't be specified for the wildcard prefix %q in %q", r.Prefix, path)
+		}
+		replaced := false
+		for i, cur := range rc.Registries {
+			if cur.Prefix == r.Prefix {
+				rc.Registries[i], replaced = r, true
+				break
+			}
+		}
+		if !replaced {
+			rc.Registries = append(rc.Registries, r)
+		}
+	}
+	return nil
+}
+
+// lookup returns the registry configuration for the locator ("host/repository") and
+// the prefix of the locator matched to the configuration. The longest prefix wins.
+func (rc *RegistriesConf) lookup(locator string) (*RegistryConf, string) {
+	var (
+		res     *RegistryConf
+		matched string
+	)
+	host := strings.SplitN(locator, "/", 2)[0]
+	for i, r := range rc.Registries {
+		var m string
+		if strings.HasPrefix(r.Prefix, "*.") {
+			if strings.HasSuffix(host, r.Prefix[1:]) {
+				m = host
+			}
+		} else if locator == r.Prefix || strings.HasPrefix(locator, r.Prefix+"/") {
+			m = r.Prefix
+		}
+		if m == "" {
+			continue
+		}
+		if res == nil || len(r.Prefix) > len(res.Prefix) {
+			res, matched = &rc.Registries[i], m
+		}
+	}
+	return res, matched
+}
+
+// RegistryHostsFromRegistriesConf creates RegistryHosts based on registries.conf.
+// Registries that aren't configured in rc are resolved based on cfg.
+func RegistryHostsFromRegistriesConf(rc *RegistriesConf, cfg Config, credsFuncs ...Credential) source.RegistryHosts {
+	pool := newTransportPool(cfg.Transport)
+	fallback := registryHostsFromConfig(cfg, pool, credsFuncs...)
+	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
+		r, prefix := rc.lookup(ref.Locator)
+		if r == nil {
+			return fallback(ref)
+		}
+		if r.Blocked {
+			return nil, fmt.Errorf("registry %q is blocked by registries.conf", prefix)
+		}
+		byDigest := ref.Digest() != ""
+		for _, m := range r.Mirrors {
+			pull := m.PullFromMirror
+			if pull == "" {
+				pull = pullFromMirrorAll
+				if r.MirrorByDigestOnly {
+					pull = pullFromMirrorDigestOnly
+				}
+			}
+			if (pull == pullFromMirrorDigestOnly && !byDigest) || (pull == pullFromMirrorTagOnly && byDigest) {
+				continue
+			}
+			h, err := newRewrittenRegistryHost(ref, prefix, m.Location, m.Insecure, pool, credsFuncs...)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, h)
+		}
+		location := r.Location
+		if location == "" {
+			location = prefix
+		}
+		h, err := newRewrittenRegistryHost(ref, prefix, location, r.Insecure, pool, credsFuncs...)
+		if err != nil {
+			return nil, err
+		}
+		return append(hosts, h), nil
+	}
+}
+
+// newRewrittenRegistryHost returns the registry host which serves the image of ref with
+// replacing the prefix of the locator with location.
+func newRewrittenRegistryHost(ref reference.Spec, prefix, location string, insecure bool, pool *transportPool, credsFuncs ...Credential) (docker.RegistryHost, error) {
+	locator := location + strings.TrimPrefix(ref.Locator, prefix)
+	parts := strings.SplitN(locator, "/", 2)
+	h, err := newRegistryHost(ref, MirrorConfig{Host: parts[0], Insecure: insecure}, pool, credsFuncs...)
+	if err != nil {
+		return docker.RegistryHost{}, err
+	}
+	repo := strings.TrimPrefix(ref.Locator, ref.Hostname()+"/")
+	if len(parts) == 2 && parts[1] != repo {
+		h.Client.Transport = &rewriteTransport{
+			RoundTripper: h.Client.Transport,
+			host:         h.Host,
+			from:         h.Path + "/" + repo + "/",
+			to:           h.Path + "/" + parts[1] + "/",
+		}
+		if a, ok := h.Authorizer.(*authorizer); ok {
+			a.rewriteScope = rewriteRepositoryScope(repo, parts[1])
+		}
+	}
+	return h, nil
+}
+
+// rewriteRepositoryScope returns a function to rewrite the repository in the scope of
+// tokens (e.g. "repository:foo/bar:pull") so that the token is valid for the requests
+// rewritten by rewriteTransport.
+func rewriteRepositoryScope(from, to string) func(string) string {
+	prefix := "repository:" + from + ":"
+	return func(scope string) string {
+		if strings.HasPrefix(scope, prefix) {
+			return "repository:" + to + ":" + strings.TrimPrefix(scope, prefix)
+		}
+		return scope
+	}
+}
+
+// rewriteTransport rewrites the repository in the path of requests to the registry.
+type rewriteTransport struct {
+	http.RoundTripper
+	host string
+	from string
+	to   string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host && strings.HasPrefix(req.URL.Path, t.from) {
+		req = req.Clone(req.Context())
+		req.URL.Path = t.to + strings.TrimPrefix(req.URL.Path, t.from)
+		req.URL.RawPath = ""
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+const testRegistriesConf = `
+unqualified-search-registries = ["docker.io"]
+
+[[registry]]
+prefix = "docker.io/library"
+location = "mirror.example.com/hub/library"
+
+[[registry]]
+prefix = "example.com"
+location = "example.com"
+insecure = true
+
+[[registry.mirror]]
+location = "mirror.example.com"
+
+[[registry.mirror]]
+location = "digest-mirror.example.com"
+pull-from-mirror = "digest-only"
+
+[[registry]]
+location = "blocked.example.com"
+blocked = true
+`
+
+const testRegistriesConfDropIn = `
+[[registry]]
+prefix = "*.internal.example.com"
+
+[[registry.mirror]]
+location = "cache.example.com"
+`
+
+func TestRegistriesConf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registries.conf")
+	if err := os.WriteFile(path, []byte(testRegistriesConf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "registries.conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "registries.conf.d", "00-internal.conf"), []byte(testRegistriesConfDropIn), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := LoadRegistriesConf(path)
+	if err != nil {
+		t.Fatalf("failed to load registries.conf: %v", err)
+	}
+	hosts := RegistryHostsFromRegistriesConf(rc, Config{})
+
+	type host struct {
+		host   string
+		scheme string
+		path   string // path of the fetched blob
+	}
+	for _, tt := range []struct {
+		ref     string
+		want    []host
+		blocked bool
+	}{
+		{
+			ref:  "docker.io/library/ubuntu:22.04",
+			want: []host{{"mirror.example.com", "https", "/v2/hub/library/ubuntu/blobs/"}},
+		},
+		{
+			ref:  "docker.io/foo/bar:1",
+			want: []host{{"registry-1.docker.io", "https", "/v2/foo/bar/blobs/"}},
+		},
+		{
+			ref: "example.com/foo:1",
+			want: []host{
+				{"mirror.example.com", "https", "/v2/foo/blobs/"},
+				{"example.com", "http", "/v2/foo/blobs/"},
+			},
+		},
+		{
+			ref: "example.com/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			want: []host{
+				{"mirror.example.com", "https", "/v2/foo/blobs/"},
+				{"digest-mirror.example.com", "https", "/v2/foo/blobs/"},
+				{"example.com", "http", "/v2/foo/blobs/"},
+			},
+		},
+		{
+			ref: "a.internal.example.com/foo:1",
+			want: []host{
+				{"cache.example.com", "https", "/v2/foo/blobs/"},
+				{"a.internal.example.com", "https", "/v2/foo/blobs/"},
+			},
+		},
+		{
+			ref:     "blocked.example.com/foo:1",
+			blocked: true,
+		},
+	} {
+		refspec, err := reference.Parse(tt.ref)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tt.ref, err)
+		}
+		got, err := hosts(refspec)
+		if tt.blocked {
+			if err == nil {
+				t.Errorf("%q: must be blocked", tt.ref)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%q: failed to get hosts: %v", tt.ref, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%q: unexpected number of hosts %d; want %d", tt.ref, len(got), len(tt.want))
+		}
+		repo := refspec.Locator[len(refspec.Hostname())+1:]
+		for i, h := range got {
+			gotPath := "/v2/" + repo + "/blobs/"
+			if rt, ok := h.Client.Transport.(*rewriteTransport); ok {
+				rec := &recordTransport{}
+				rt.RoundTripper = rec
+				req, _ := http.NewRequest(http.MethodGet, h.Scheme+"://"+h.Host+gotPath, nil)
+				rt.RoundTrip(req)
+				gotPath = rec.path
+			}
+			if g := (host{h.Host, h.Scheme, gotPath}); g != tt.want[i] {
+				t.Errorf("%q: unexpected host[%d] %+v; want %+v", tt.ref, i, g, tt.want[i])
+			}
+		}
+	}
+}
+
+type recordTransport struct {
+	path string
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.path = req.URL.Path
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestRegistriesConfTokenScope(t *testing.T) {
+	reg := newTestScopedRegistry("mirror/ubuntu")
+	defer reg.srv.Close()
+	host := strings.TrimPrefix(reg.srv.URL, "http://")
+
+	rc := &RegistriesConf{Registries: []RegistryConf{
+		{Prefix: "docker.io/library", Location: host + "/mirror"},
+	}}
+	refspec, err := reference.Parse("docker.io/library/ubuntu:22.04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := RegistryHostsFromRegistriesConf(rc, Config{})(refspec)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("unexpected number of hosts %d; want 1", len(hosts))
+	}
+	h := hosts[0]
+
+	// The scope of the original repository is passed as done by the fetcher
+	ctx, err := docker.ContextWithRepositoryScope(context.Background(), refspec, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, h.Scheme+"://"+h.Host+h.Path+"/library/ubuntu/blobs/sha256:0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Authorizer.Authorize(ctx, req); err != nil {
+			t.Fatalf("failed to authorize: %v", err)
+		}
+		res, err := h.Client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := get()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %v; want %v", res.Status, http.StatusUnauthorized)
+	}
+	if err := h.Authorizer.AddResponses(ctx, []*http.Response{res}); err != nil {
+		t.Fatalf("failed to add responses: %v", err)
+	}
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Fatalf("token must be valid for the rewritten repository; got %v", res.Status)
+	}
+}
+
+// testScopedRegistry is a registry which serves only the repository. Tokens are
+// issued only for the scopes of the repository and are valid only for it.
+type testScopedRegistry struct {
+	srv    *httptest.Server
+	repo   string
+	tokens map[string]bool
+	mu     sync.Mutex
+}
+
+func newTestScopedRegistry(repo string) *testScopedRegistry {
+	r := &testScopedRegistry{repo: repo, tokens: make(map[string]bool)}
+	r.srv = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *testScopedRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scope := "repository:" + r.repo + ":pull"
+	if req.URL.Path == "/token" {
+		for _, s := range req.URL.Query()["scope"] {
+			if s != scope {
+				w.WriteHeader(http.StatusForbidden) // unknown repository
+				return
+			}
+		}
+		v := fmt.Sprintf("token%d", len(r.tokens))
+		r.tokens[v] = true
+		fmt.Fprintf(w, `{"token":%q}`, v)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/"+r.repo+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !r.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope=%q`, r.srv.URL, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,291 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+const testHostsToml = `
+server = "https://registry.example.com"
+
+[host."https://mirror.example.com"]
+  capabilities = ["pull"]
+  skip_verify = true
+`
+
+func TestRegistryHostsFromConfigPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "registry.example.com"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "registry.example.com", "hosts.toml"), []byte(testHostsToml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hosts := RegistryHostsFromConfig(Config{
+		ConfigPath: root,
+		Host: map[string]HostConfig{
+			"registry.example.com": {Mirrors: []MirrorConfig{{Host: "ignored.example.com"}}},
+			"other.example.com":    {Mirrors: []MirrorConfig{{Host: "othermirror.example.com"}}},
+		},
+	})
+
+	tests := []struct {
+		ref      string
+		want     []string
+		wantCaps []docker.HostCapabilities
+	}{
+		{
+			ref:  "registry.example.com/foo:latest",
+			want: []string{"mirror.example.com", "registry.example.com"},
+			wantCaps: []docker.HostCapabilities{
+				docker.HostCapabilityPull,
+				docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+			},
+		},
+		{
+			// not configured in the config path
+			ref:  "other.example.com/foo:latest",
+			want: []string{"othermirror.example.com", "other.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			refspec, err := reference.Parse(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := hosts(refspec)
+			if err != nil {
+				t.Fatalf("failed to get hosts: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("unexpected num of hosts %d; want %d", len(got), len(tt.want))
+			}
+			for i, h := range got {
+				if h.Host != tt.want[i] {
+					t.Errorf("host[%d] = %q; want %q", i, h.Host, tt.want[i])
+				}
+				if tt.wantCaps != nil && h.Capabilities != tt.wantCaps[i] {
+					t.Errorf("host[%d] capabilities = %v; want %v", i, h.Capabilities, tt.wantCaps[i])
+				}
+				if _, ok := h.Client.Transport.(*rhttp.RoundTripper); !ok {
+					t.Errorf("host[%d] must retry requests", i)
+				}
+			}
+			if tt.wantCaps != nil {
+				tr := got[0].Client.Transport.(*rhttp.RoundTripper).Client.HTTPClient.Transport.(*http.Transport)
+				if !tr.TLSClientConfig.InsecureSkipVerify {
+					t.Errorf("skip_verify must be applied to the mirror")
+				}
+			}
+		})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var gotURL, gotAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL, gotAuth = r.URL.String(), r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://user:pass@", 1)
+
+	hosts := RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			"registry.example.com": {Mirrors: []MirrorConfig{{
+				Host:     "registry.example.com",
+				Insecure: true,
+				Proxy:    proxyURL,
+				NoProxy:  []string{"blob.example.com"},
+			}}},
+		},
+	})
+	refspec, err := reference.Parse("registry.example.com/foo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	res, err := reghosts[0].Client.Get("http://registry.example.com/v2/")
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	res.Body.Close()
+	if gotURL != "http://registry.example.com/v2/" {
+		t.Errorf("proxy got %q; want request to the registry", gotURL)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")); gotAuth != want {
+		t.Errorf("Proxy-Authorization = %q; want %q", gotAuth, want)
+	}
+
+	pf, err := proxyFunc(proxyURL, []string{"blob.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "https://blob.example.com/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := pf(req); err != nil || u != nil {
+		t.Errorf("no_proxy host must be connected directly; got %v (%v)", u, err)
+	}
+
+	if _, err := proxyFunc("proxy.example.com:3128", nil); err == nil {
+		t.Errorf("proxy without scheme must be rejected")
+	}
+}
+
+func TestDial(t *testing.T) {
+	// Registry served over a unix socket
+	sock := filepath.Join(t.TempDir(), "registry.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotHost string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	// Registry served over TLS on a non-standard port with a certificate for "example.com"
+	var gotSNI string
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tlsSrv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			gotSNI = hello.ServerName
+			return nil, nil
+		},
+	}
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	tlsAddr := strings.TrimPrefix(tlsSrv.URL, "https://")
+
+	hosts := RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			"registry.example.com": {Mirrors: []MirrorConfig{
+				{Host: "mirror.example.com", Insecure: true, Dial: "unix://" + sock},
+				{Host: "tls.example.com", Dial: tlsAddr, ServerName: "example.com"},
+			}},
+		},
+	})
+	refspec, err := reference.Parse("registry.example.com/foo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+
+	res, err := reghosts[0].Client.Get("http://mirror.example.com/v2/")
+	if err != nil {
+		t.Fatalf("failed to request via unix socket: %v", err)
+	}
+	res.Body.Close()
+	if gotHost != "mirror.example.com" {
+		t.Errorf("unexpected host %q; want %q", gotHost, "mirror.example.com")
+	}
+
+	// The certificate of the test server is trusted only by the server's client.
+	htr := reghosts[1].Client.Transport.(*rhttp.RoundTripper).Client.HTTPClient.Transport.(*http.Transport)
+	htr.TLSClientConfig = tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig
+	res, err = reghosts[1].Client.Get("https://tls.example.com/v2/")
+	if err != nil {
+		t.Fatalf("failed to request over TLS: %v", err)
+	}
+	res.Body.Close()
+	if gotSNI != "example.com" {
+		t.Errorf("unexpected server name %q; want %q", gotSNI, "example.com")
+	}
+
+	if _, err := newRegistryHost(refspec, MirrorConfig{Host: "mirror.example.com", Dial: "mirror.example.com"}, newTransportPool(TransportConfig{})); err == nil {
+		t.Errorf("dial target without port must be rejected")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	hosts := RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			"registry.example.com": {Mirrors: []MirrorConfig{{Host: "mirror.example.com"}}},
+		},
+		Transport: TransportConfig{
+			DisableHTTP2:        true,
+			MaxConnsPerHost:     4,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeoutSec:  10,
+		},
+	})
+	transportOf := func(ref string) []*http.Transport {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reghosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get hosts: %v", err)
+		}
+		var trs []*http.Transport
+		for _, h := range reghosts {
+			trs = append(trs, h.Client.Transport.(*rhttp.RoundTripper).Client.HTTPClient.Transport.(*http.Transport))
+		}
+		return trs
+	}
+	trs1 := transportOf("registry.example.com/foo:latest")
+	trs2 := transportOf("registry.example.com/bar:latest")
+	if len(trs1) != 2 || len(trs2) != 2 {
+		t.Fatalf("unexpected number of hosts %d, %d; want 2", len(trs1), len(trs2))
+	}
+	for i := range trs1 {
+		if trs1[i] != trs2[i] {
+			t.Errorf("transport of host #%d must be reused", i)
+		}
+	}
+	if trs1[0] == trs1[1] {
+		t.Errorf("transports of different hosts mustn't be shared")
+	}
+	htr := trs1[0]
+	if htr.ForceAttemptHTTP2 || htr.TLSNextProto == nil || len(htr.TLSNextProto) != 0 {
+		t.Errorf("HTTP/2 must be disabled")
+	}
+	if htr.MaxConnsPerHost != 4 || htr.MaxIdleConnsPerHost != 8 || htr.IdleConnTimeout != 10*time.Second {
+		t.Errorf("unexpected transport config: max conns %d, max idle conns %d, idle timeout %v",
+			htr.MaxConnsPerHost, htr.MaxIdleConnsPerHost, htr.IdleConnTimeout)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const defaultDialTimeout = 30 * time.Second
+
+// TransportConfig is config of HTTP connections to registry hosts.
+type TransportConfig struct {
+	// DisableHTTP2 disables HTTP/2 so that each request to the host uses an
+	// HTTP/1.1 connection. This is useful for registries which throttle per
+	// connection.
+	DisableHTTP2 bool `toml:"disable_http2"`
+
+	// MaxConnsPerHost limits the number of connections to each host (including
+	// blob storages which registries redirect to). 0 means no limit.
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+
+	// MaxIdleConnsPerHost is the number of idle connections kept for each host.
+	// 0 means the default of go-cleanhttp (GOMAXPROCS + 1).
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+
+	// IdleConnTimeoutSec is the duration to keep idle connections. 0 means the
+	// default (90 seconds).
+	IdleConnTimeoutSec int `toml:"idle_conn_timeout_sec"`
+
+	// KeepAliveSec is the interval of TCP keep-alive probes. 0 means the default
+	// (30 seconds) and a negative value disables keep-alives.
+	KeepAliveSec int `toml:"keep_alive_sec"`
+}
+
+func (cfg TransportConfig) dialer() *net.Dialer {
+	keepAlive := 30 * time.Second
+	if cfg.KeepAliveSec != 0 {
+		keepAlive = time.Duration(cfg.KeepAliveSec) * time.Second // negative disables keep-alives
+	}
+	return &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: keepAlive,
+	}
+}
+
+// newTransport returns a transport configured by cfg.
+func (cfg TransportConfig) newTransport() *http.Transport {
+	htr := cleanhttp.DefaultPooledTransport()
+	htr.DialContext = cfg.dialer().DialContext
+	cfg.apply(htr)
+	return htr
+}
+
+// apply applies cfg to the transport except the dialer.
+func (cfg TransportConfig) apply(htr *http.Transport) {
+	if cfg.MaxConnsPerHost > 0 {
+		htr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		htr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeoutSec > 0 {
+		htr.IdleConnTimeout = time.Duration(cfg.IdleConnTimeoutSec) * time.Second
+	}
+	if cfg.DisableHTTP2 {
+		htr.ForceAttemptHTTP2 = false
+		// A non-nil empty map disables HTTP/2 upgrades via ALPN.
+		htr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+}
+
+// transportPool shares transports among registry hosts with the same configuration
+// so that connections are reused across layers (and images) from the same hosts.
+type transportPool struct {
+	cfg TransportConfig
+
+	transports   map[string]*http.Transport
+	transportsMu sync.Mutex
+}
+
+func newTransportPool(cfg TransportConfig) *transportPool {
+	return &transportPool{
+		cfg:        cfg,
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+// get returns the transport for the host.
+func (p *transportPool) get(h MirrorConfig, scheme string) (*http.Transport, error) {
+	key := strings.Join([]string{scheme, h.Host, h.Proxy, strings.Join(h.NoProxy, ","), h.Dial, h.ServerName}, "\x00")
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+	if htr, ok := p.transports[key]; ok {
+		return htr, nil
+	}
+	htr := p.cfg.newTransport()
+	if h.Proxy != "" {
+		proxy, err := proxyFunc(h.Proxy, h.NoProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy config for host %q: %w", h.Host, err)
+		}
+		htr.Proxy = proxy
+	}
+	if h.Dial != "" || h.ServerName != "" {
+		if err := configureDialer(htr, h, scheme, p.cfg.dialer()); err != nil {
+			return nil, fmt.Errorf("invalid dial config for host %q: %w", h.Host, err)
+		}
+	}
+	p.transports[key] = htr
+	return htr, nil
+}
@@ -18,14 +18,23 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"path/filepath"
+	"time"
 
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/snapshots"
 	stargzfs "github.com/containerd/stargz-snapshotter/fs"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/containerd/stargz-snapshotter/service/policy"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/containerd/stargz-snapshotter/service/signature"
+	"github.com/containerd/stargz-snapshotter/service/transfer"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/snapshot/overlayutils"
 	"github.com/hashicorp/go-multierror"
@@ -34,9 +43,12 @@ import (
 type Option func(*options)
 
 type options struct {
-	credsFuncs    []resolver.Credential
-	registryHosts source.RegistryHosts
-	fsOpts        []stargzfs.Option
+	credsFuncs     []resolver.Credential
+	registryHosts  source.RegistryHosts
+	fsOpts         []stargzfs.Option
+	adminMux       *http.ServeMux
+	podAnnotations func(reference.Spec) map[string]string
+	contentStore   content.Store
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
@@ -60,6 +72,29 @@ func WithFilesystemOptions(opts ...stargzfs.Option) Option {
 	}
 }
 
+// WithAdminMux registers the handlers of the admin API to the specified mux.
+func WithAdminMux(m *http.ServeMux) Option {
+	return func(o *options) {
+		o.adminMux = m
+	}
+}
+
+// WithPodAnnotations specifies the function which returns the annotations of the pod
+// which pulled the image. This is used for tuning fetches by PodFetchPriorityConfig.
+func WithPodAnnotations(f func(image reference.Spec) map[string]string) Option {
+	return func(o *options) {
+		o.podAnnotations = f
+	}
+}
+
+// WithContainerdContentStore specifies the content store of containerd used for
+// reconstructing labels of layers pulled by the transfer service.
+func WithContainerdContentStore(cs content.Store) Option {
+	return func(o *options) {
+		o.contentStore = cs
+	}
+}
+
 // NewStargzSnapshotterService returns stargz snapshotter.
 func NewStargzSnapshotterService(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
 	var sOpts options
@@ -81,26 +116,111 @@ func NewStargzSnapshotterService(ctx context.Context, root string, config *Confi
 	if userxattr {
 		opq = layer.OverlayOpaqueUser
 	}
+	imageSources := imageSourcesOf(hosts)
+	getSources := imageSources
+	var verifier *signature.Verifier
+	if config.SignatureVerificationConfig.Enable {
+		verifier, err = signature.NewVerifier(signature.Config(config.SignatureVerificationConfig),
+			signature.WithRequireSigned(func(refspec reference.Spec) bool {
+				return stargzfs.RegistryTrustOf(config.RegistryTrust, refspec.Hostname()) == stargzfs.RegistryTrustSigned
+			}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure signature verification: %w", err)
+		}
+		getSources = verifier.VerifySources(ctx, getSources)
+	}
+	nsConfigs := make(map[string]stargzfs.NamespaceConfig, len(config.NamespaceConfigs))
+	for ns, c := range config.NamespaceConfigs {
+		nsc := stargzfs.NamespaceConfig{
+			NoPrefetch:        c.NoPrefetch,
+			NoBackgroundFetch: c.NoBackgroundFetch,
+			CachePolicy:       layer.CachePolicy{HTTPCacheType: c.HTTPCacheType, FSCacheType: c.FSCacheType},
+		}
+		if c.ResolverConfig != nil {
+			nsc.GetSources = imageSourcesOf(resolver.RegistryHostsFromConfig(resolver.Config(*c.ResolverConfig), sOpts.credsFuncs...))
+			if verifier != nil {
+				nsc.GetSources = verifier.VerifySources(ctx, nsc.GetSources)
+			}
+		}
+		nsConfigs[ns] = nsc
+	}
+
 	// Configure filesystem and snapshotter
-	fsOpts := append(sOpts.fsOpts, stargzfs.WithGetSources(sources(
-		sourceFromCRILabels(hosts),      // provides source info based on CRI labels
-		source.FromDefaultLabels(hosts), // provides source info based on default labels
-	)), stargzfs.WithOverlayOpaqueType(opq))
+	fsOpts := append(sOpts.fsOpts, stargzfs.WithGetSources(getSources), stargzfs.WithOverlayOpaqueType(opq),
+		stargzfs.WithNamespaceConfigs(nsConfigs))
+	if config.PodFetchPriorityConfig.Enable {
+		if sOpts.podAnnotations == nil {
+			return nil, fmt.Errorf("pod_fetch_priority requires annotations of pods (e.g. CRI-based keychain)")
+		}
+		f, err := podBackgroundFetchMode(config.PodFetchPriorityConfig, sOpts.podAnnotations)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure pod fetch priority: %w", err)
+		}
+		fsOpts = append(fsOpts, stargzfs.WithBackgroundFetchModeFunc(f))
+	}
 	fs, err := stargzfs.NewFilesystem(fsRoot(root), config.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
 
+	var (
+		snFs   snbase.FileSystem = fs
+		engine *policy.Engine
+	)
+	if config.LazyPullPolicyConfig.Enable {
+		engine, err = policy.NewEngine(policy.Config(config.LazyPullPolicyConfig))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure lazy pull policy: %w", err)
+		}
+		snFs = engine.FileSystem(fs, imageSources)
+	}
+	if config.TransferServiceConfig.ReconstructLabels {
+		if sOpts.contentStore == nil {
+			return nil, fmt.Errorf("reconstruct_labels requires the content store of containerd")
+		}
+		// Reconstruct labels before other wrappers need the image information.
+		snFs = transfer.NewReconstructor(sOpts.contentStore).FileSystem(snFs, imageSources)
+	}
+	if sOpts.adminMux != nil {
+		admin.Register(ctx, sOpts.adminMux, fs)
+		if pfs, ok := fs.(prewarmFilesystem); ok {
+			admin.Register(ctx, sOpts.adminMux, &imagePrewarmer{fs: pfs, hosts: hosts, engine: engine})
+		}
+		if rfs, ok := fs.(residentFilesystem); ok {
+			admin.Register(ctx, sOpts.adminMux, &residentMaker{fs: rfs})
+		}
+	}
+
 	var snapshotter snapshots.Snapshotter
 
-	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snbase.AsynchronousRemove)
+	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), snFs, snbase.AsynchronousRemove)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
 	}
+	if sn, ok := snapshotter.(snbase.OrphanCleaner); ok {
+		oc := &orphanCleaner{sn: sn}
+		if cm, ok := fs.(admin.CacheManager); ok {
+			oc.cm = cm
+		}
+		if sOpts.adminMux != nil {
+			admin.Register(ctx, sOpts.adminMux, oc)
+		}
+		if interval := config.OrphanCleanupIntervalSec; interval > 0 {
+			go oc.run(ctx, time.Duration(interval)*time.Second)
+		}
+	}
 
 	return snapshotter, err
 }
 
+// imageSourcesOf returns the function to get sources of layers using the registry hosts.
+func imageSourcesOf(hosts source.RegistryHosts) source.GetSources {
+	return sources(
+		sourceFromCRILabels(hosts),      // provides source info based on CRI labels
+		source.FromDefaultLabels(hosts), // provides source info based on default labels
+	)
+}
+
 func snapshotterRoot(root string) string {
 	return filepath.Join(root, "snapshotter")
 }
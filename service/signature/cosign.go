@@ -0,0 +1,276 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// signatureAnnotation contains the base64-encoded signature of the layer
+	// (the simple signing payload) in the cosign signature manifest.
+	signatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// certificateAnnotation contains the PEM-encoded keyless signing certificate.
+	certificateAnnotation = "dev.sigstore.cosign/certificate"
+
+	// chainAnnotation contains the PEM-encoded chain of the signing certificate.
+	chainAnnotation = "dev.sigstore.cosign/chain"
+
+	// bundleAnnotation contains the transparency log entry of the signature.
+	bundleAnnotation = "dev.sigstore.cosign/bundle"
+
+	// simpleSigningType is the type of the cosign simple signing payload.
+	simpleSigningType = "cosign container image signature"
+)
+
+var (
+	// oidIssuer is the certificate extension containing the OIDC issuer as a raw string.
+	oidIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+	// oidIssuerV2 is the certificate extension containing the OIDC issuer as a DER-encoded string.
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// simpleSigning is the payload signed by cosign.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// bundle is a transparency log entry of a signature, signed by the log.
+type bundle struct {
+	SignedEntryTimestamp []byte        `json:"SignedEntryTimestamp"`
+	Payload              bundlePayload `json:"Payload"`
+}
+
+// bundlePayload is the signed part of the bundle. The fields are ordered so that
+// its JSON encoding is canonical.
+type bundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of a transparency log entry.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content []byte `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifySignature verifies the signature of the payload according to the policy
+// and checks that the payload refers to the manifest digest.
+func (p *policy) verifySignature(payload []byte, sigB64 string, annotations map[string]string, dgst digest.Digest) error {
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	var (
+		pub  = p.publicKey
+		cert *x509.Certificate
+	)
+	if p.roots != nil {
+		if cert, err = parseCertificate(annotations[certificateAnnotation]); err != nil {
+			return err
+		}
+		pub = cert.PublicKey
+	}
+	if err := verifyRaw(pub, payload, sig); err != nil {
+		return err
+	}
+	var signedAt time.Time
+	if p.rekorKey != nil {
+		if signedAt, err = p.verifyBundle(annotations[bundleAnnotation], payload, sig); err != nil {
+			return fmt.Errorf("failed to verify transparency log entry: %w", err)
+		}
+	}
+	if cert != nil {
+		if err := p.verifyCertificate(cert, annotations[chainAnnotation], signedAt); err != nil {
+			return err
+		}
+	}
+
+	var ss simpleSigning
+	if err := json.Unmarshal(payload, &ss); err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if ss.Critical.Type != simpleSigningType {
+		return fmt.Errorf("unexpected signature payload type %q", ss.Critical.Type)
+	}
+	if ss.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("signature is for %q, not for %q", ss.Critical.Image.DockerManifestDigest, dgst)
+	}
+	return nil
+}
+
+// verifyBundle checks that the bundle is signed by the transparency log and
+// records the signature. The time when the entry was logged is returned.
+func (p *policy) verifyBundle(bundleJSON string, payload, sig []byte) (time.Time, error) {
+	if bundleJSON == "" {
+		return time.Time{}, fmt.Errorf("signature isn't logged")
+	}
+	var b bundle
+	if err := json.Unmarshal([]byte(bundleJSON), &b); err != nil {
+		return time.Time{}, err
+	}
+	var canonical bytes.Buffer
+	enc := json.NewEncoder(&canonical)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(b.Payload); err != nil {
+		return time.Time{}, err
+	}
+	if err := verifyRaw(p.rekorKey, bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), b.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("invalid signed entry timestamp: %w", err)
+	}
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, err
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("unsupported log entry kind %q", entry.Kind)
+	}
+	h := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(h[:]) {
+		return time.Time{}, fmt.Errorf("log entry doesn't record the payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, sig) {
+		return time.Time{}, fmt.Errorf("log entry doesn't record the signature")
+	}
+	return time.Unix(b.Payload.IntegratedTime, 0), nil
+}
+
+// verifyCertificate checks that the keyless signing certificate was valid at
+// the time of signing and that it was issued to the expected identity.
+func (p *policy) verifyCertificate(cert *x509.Certificate, chainPEM string, signedAt time.Time) error {
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(chainPEM))
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("untrusted signing certificate: %w", err)
+	}
+
+	var issuer string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err != nil {
+				return fmt.Errorf("invalid issuer extension: %w", err)
+			}
+		case ext.Id.Equal(oidIssuer) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	if issuer != p.issuer {
+		return fmt.Errorf("signing certificate is issued by %q, not by %q", issuer, p.issuer)
+	}
+
+	var identities []string
+	identities = append(identities, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	for _, id := range identities {
+		if p.identity.MatchString(id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signing certificate identities %v don't match %q", identities, p.identity)
+}
+
+func verifyRaw(pub interface{}, data, sig []byte) error {
+	h := sha256.Sum256(data)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, h[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) != nil &&
+			rsa.VerifyPSS(k, crypto.SHA256, h[:], sig, nil) != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
+
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	if certPEM == "" {
+		return nil, fmt.Errorf("signing certificate isn't provided")
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("invalid signing certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
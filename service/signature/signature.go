@@ -0,0 +1,478 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package signature verifies cosign (sigstore) signatures of images before
+// their layers are lazily mounted.
+package signature
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// defaultResultTTL is the duration a verification result of an image
+	// reference is reused for the other layers of that image.
+	defaultResultTTL = time.Minute
+
+	// maxManifestSize is the maximum size of manifests and signature payloads
+	// read during verification.
+	maxManifestSize = 4 << 20
+
+	// criManifestDigestLabel is a label which contains the digest of the manifest
+	// of the layer passed through CRI.
+	criManifestDigestLabel = "containerd.io/snapshot/cri.manifest-digest"
+)
+
+// Config is config for verifying signatures of images before mounting them.
+type Config struct {
+	// Enable enables signature verification.
+	Enable bool `toml:"enable"`
+
+	// RejectUnmatched refuses to lazily mount images whose repository doesn't
+	// match any policy. By default, such images are mounted without verification.
+	RejectUnmatched bool `toml:"reject_unmatched"`
+
+	// Policies is the list of policies. The first policy matching the repository
+	// of an image is used.
+	Policies []PolicyConfig `toml:"policy"`
+}
+
+// PolicyConfig is a verification policy applied to a set of repositories.
+type PolicyConfig struct {
+	// Repositories is a list of repository patterns (e.g. "ghcr.io/myorg/*")
+	// this policy applies to. Patterns are matched with path.Match against
+	// "<host>/<repository>".
+	Repositories []string `toml:"repositories"`
+
+	// PublicKey is the path to a PEM-encoded public key. Setting this enables
+	// keyed verification.
+	PublicKey string `toml:"public_key"`
+
+	// FulcioRoots is the path to PEM-encoded certificates trusted for issuing
+	// signing certificates. Setting this enables keyless verification.
+	FulcioRoots string `toml:"fulcio_roots"`
+
+	// RekorPublicKey is the path to the PEM-encoded public key of the
+	// transparency log. This is required for keyless verification and, when
+	// set for keyed verification, signatures must also be logged.
+	RekorPublicKey string `toml:"rekor_public_key"`
+
+	// Identity is a regular expression that one of the email or URI subject
+	// alternative names of the keyless signing certificate must match.
+	Identity string `toml:"identity"`
+
+	// Issuer is the OIDC issuer that must be recorded in the keyless signing
+	// certificate.
+	Issuer string `toml:"issuer"`
+}
+
+// Verifier checks whether an image is signed according to the configured policies.
+type Verifier struct {
+	policies        []*policy
+	rejectUnmatched bool
+	requireSigned   func(reference.Spec) bool // nil if not specified
+
+	results   map[string]*result
+	resultsMu sync.Mutex
+	ttl       time.Duration
+}
+
+type result struct {
+	once     sync.Once
+	desc     ocispec.Descriptor
+	manifest ocispec.Manifest
+	err      error
+	expires  time.Time
+}
+
+// Option is an option of the verifier.
+type Option func(v *Verifier)
+
+// WithRequireSigned refuses images whose repository doesn't match any policy if f
+// returns true for the reference, regardless of RejectUnmatched.
+func WithRequireSigned(f func(reference.Spec) bool) Option {
+	return func(v *Verifier) {
+		v.requireSigned = f
+	}
+}
+
+// NewVerifier returns a verifier based on the config.
+func NewVerifier(cfg Config, opts ...Option) (*Verifier, error) {
+	v := &Verifier{
+		rejectUnmatched: cfg.RejectUnmatched,
+		results:         make(map[string]*result),
+		ttl:             defaultResultTTL,
+	}
+	for _, o := range opts {
+		o(v)
+	}
+	for i, pc := range cfg.Policies {
+		p, err := newPolicy(pc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature policy #%d: %w", i, err)
+		}
+		v.policies = append(v.policies, p)
+	}
+	return v, nil
+}
+
+// VerifySources wraps GetSources and drops sources whose image isn't signed
+// according to the policies. The error is returned when no source is left so
+// that the layer isn't lazily mounted. Verified sources carry the verified manifest
+// so that the filesystem uses the same manifest for other checks.
+func (v *Verifier) VerifySources(ctx context.Context, getSources source.GetSources) source.GetSources {
+	return func(labels map[string]string) ([]source.Source, error) {
+		srcs, err := getSources(labels)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			verified []source.Source
+			allErr   error
+		)
+		for _, s := range srcs {
+			desc, manifest, err := v.verify(ctx, s)
+			if err != nil {
+				log.G(ctx).WithError(err).WithField("ref", s.Name.String()).
+					Warn("refusing to lazily mount image because of signature verification failure")
+				allErr = err
+				continue
+			}
+			if desc.Digest != "" {
+				s.VerifiedManifestDesc, s.VerifiedManifest = desc, manifest
+			}
+			verified = append(verified, s)
+		}
+		if len(verified) == 0 {
+			return nil, fmt.Errorf("signature verification failed: %w", allErr)
+		}
+		return verified, nil
+	}
+}
+
+// Verify checks that the manifest of the source is signed according to the policy
+// of its repository and that it contains the target layer. The manifest is the one
+// pulled by containerd, whose digest is passed through the labels, so the tag of the
+// reference isn't trusted even if it's moved after the pull. The manifest is signed
+// by itself or through the signed index referred by the reference.
+func (v *Verifier) Verify(ctx context.Context, src source.Source) error {
+	_, _, err := v.verify(ctx, src)
+	return err
+}
+
+// verify verifies the source and returns the verified manifest and its descriptor.
+// The descriptor is empty if the source isn't verified because no policy matches.
+func (v *Verifier) verify(ctx context.Context, src source.Source) (ocispec.Descriptor, ocispec.Manifest, error) {
+	p := v.policyFor(src.Name)
+	if p == nil {
+		if v.rejectUnmatched || (v.requireSigned != nil && v.requireSigned(src.Name)) {
+			return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("no signature policy matches %q", src.Name.Locator)
+		}
+		return ocispec.Descriptor{}, ocispec.Manifest{}, nil
+	}
+	manifestDigest, err := manifestDigestOf(src)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+
+	key := src.Name.Locator + "@" + manifestDigest.String()
+	v.resultsMu.Lock()
+	r, ok := v.results[key]
+	if !ok || time.Now().After(r.expires) {
+		for k, old := range v.results {
+			if time.Now().After(old.expires) {
+				delete(v.results, k)
+			}
+		}
+		r = &result{expires: time.Now().Add(v.ttl)}
+		v.results[key] = r
+	}
+	v.resultsMu.Unlock()
+	r.once.Do(func() {
+		r.desc, r.manifest, r.err = p.verifyImage(ctx, src, manifestDigest)
+	})
+	if r.err != nil {
+		// Don't reuse failures which can be caused by transient errors.
+		v.resultsMu.Lock()
+		if v.results[key] == r {
+			delete(v.results, key)
+		}
+		v.resultsMu.Unlock()
+		return ocispec.Descriptor{}, ocispec.Manifest{}, r.err
+	}
+
+	var (
+		signed ocispec.Descriptor
+		found  bool
+	)
+	for _, l := range r.manifest.Layers {
+		if l.Digest == src.Target.Digest {
+			signed, found = l, true
+			break
+		}
+	}
+	if !found {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("layer %q isn't contained in the signed manifest %q", src.Target.Digest, manifestDigest)
+	}
+	// The TOC digest used for verifying the layer must be the signed one.
+	signedTOC, isSigned := signed.Annotations[estargz.TOCJSONDigestAnnotation]
+	passedTOC, isPassed := src.Target.Annotations[estargz.TOCJSONDigestAnnotation]
+	if isSigned && !isPassed {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("signed TOC digest of layer %q isn't passed", src.Target.Digest)
+	} else if isPassed && passedTOC != signedTOC {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("TOC digest of layer %q isn't signed", src.Target.Digest)
+	}
+	return r.desc, r.manifest, nil
+}
+
+// manifestDigestOf returns the digest of the manifest pulled by containerd which is
+// passed through the labels.
+func manifestDigestOf(src source.Source) (digest.Digest, error) {
+	d, ok := src.Target.Annotations[config.TargetManifestDigestLabel]
+	if !ok {
+		d, ok = src.Target.Annotations[criManifestDigestLabel]
+	}
+	if !ok {
+		return "", fmt.Errorf("digest of the manifest of layer %q isn't passed", src.Target.Digest)
+	}
+	dgst, err := digest.Parse(d)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest digest %q: %w", d, err)
+	}
+	return dgst, nil
+}
+
+func (v *Verifier) policyFor(refspec reference.Spec) *policy {
+	for _, p := range v.policies {
+		for _, pattern := range p.repositories {
+			if ok, _ := path.Match(pattern, refspec.Locator); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+type policy struct {
+	repositories []string
+	publicKey    interface{}
+	roots        *x509.CertPool
+	rekorKey     interface{}
+	identity     *regexp.Regexp
+	issuer       string
+}
+
+func newPolicy(pc PolicyConfig) (p *policy, err error) {
+	if len(pc.Repositories) == 0 {
+		return nil, fmt.Errorf("no repository is specified")
+	}
+	for _, r := range pc.Repositories {
+		if _, err := path.Match(r, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", r, err)
+		}
+	}
+	p = &policy{
+		repositories: pc.Repositories,
+		issuer:       pc.Issuer,
+	}
+	if (pc.PublicKey == "") == (pc.FulcioRoots == "") {
+		return nil, fmt.Errorf("exactly one of public_key or fulcio_roots must be specified")
+	}
+	if pc.PublicKey != "" {
+		if p.publicKey, err = readPublicKey(pc.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if pc.FulcioRoots != "" {
+		data, err := os.ReadFile(pc.FulcioRoots)
+		if err != nil {
+			return nil, err
+		}
+		p.roots = x509.NewCertPool()
+		if !p.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %q", pc.FulcioRoots)
+		}
+		if pc.RekorPublicKey == "" {
+			return nil, fmt.Errorf("rekor_public_key is required for keyless verification")
+		}
+		if pc.Identity == "" || pc.Issuer == "" {
+			return nil, fmt.Errorf("identity and issuer are required for keyless verification")
+		}
+		if p.identity, err = regexp.Compile("^(?:" + pc.Identity + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid identity: %w", err)
+		}
+	}
+	if pc.RekorPublicKey != "" {
+		if p.rekorKey, err = readPublicKey(pc.RekorPublicKey); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// verifyImage verifies the signature of the manifest of the digest and returns the
+// manifest and its descriptor. If the manifest isn't signed, the reference must refer to a signed index
+// which lists the manifest.
+func (p *policy) verifyImage(ctx context.Context, src source.Source, manifestDigest digest.Digest) (ocispec.Descriptor, ocispec.Manifest, error) {
+	hosts := src.Hosts
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			return hosts(src.Name)
+		},
+	})
+	ref := src.Name.Locator + "@" + manifestDigest.String()
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	if !images.IsManifestType(desc.MediaType) {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("unsupported media type %q of manifest %q", desc.MediaType, manifestDigest)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, fetcher, desc, &manifest); err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("failed to fetch manifest %q: %w", manifestDigest, err)
+	}
+	sigErr := p.verifySignatures(ctx, resolver, src.Name, desc.Digest)
+	if sigErr == nil {
+		return desc, manifest, nil
+	}
+	if err := p.verifyIndex(ctx, resolver, src.Name, desc.Digest); err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("manifest %q isn't signed (%v) nor listed by a signed index: %w", manifestDigest, sigErr, err)
+	}
+	return desc, manifest, nil
+}
+
+// verifyIndex checks that the reference refers to a signed index which lists the
+// manifest (e.g. multi-platform images signed by the digest of the index).
+func (p *policy) verifyIndex(ctx context.Context, resolver remotes.Resolver, refspec reference.Spec, manifestDigest digest.Digest) error {
+	_, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %w", refspec, err)
+	}
+	if !images.IsIndexType(desc.MediaType) {
+		return fmt.Errorf("%q doesn't refer to an index", refspec)
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return err
+	}
+	var index ocispec.Index
+	if err := fetchJSON(ctx, fetcher, desc, &index); err != nil {
+		return fmt.Errorf("failed to fetch index: %w", err)
+	}
+	listed := false
+	for _, m := range index.Manifests {
+		if m.Digest == manifestDigest {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		return fmt.Errorf("index %q doesn't list manifest %q", desc.Digest, manifestDigest)
+	}
+	return p.verifySignatures(ctx, resolver, refspec, desc.Digest)
+}
+
+// verifySignatures checks that at least one cosign signature of the manifest
+// digest satisfies the policy.
+func (p *policy) verifySignatures(ctx context.Context, resolver remotes.Resolver, refspec reference.Spec, dgst digest.Digest) error {
+	sigRef := fmt.Sprintf("%s:%s-%s.sig", refspec.Locator, dgst.Algorithm(), dgst.Encoded())
+	_, sigDesc, err := resolver.Resolve(ctx, sigRef)
+	if err != nil {
+		return fmt.Errorf("no signature found for %q: %w", dgst, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, sigRef)
+	if err != nil {
+		return err
+	}
+	var sigManifest ocispec.Manifest
+	if err := fetchJSON(ctx, fetcher, sigDesc, &sigManifest); err != nil {
+		return fmt.Errorf("failed to fetch signature manifest: %w", err)
+	}
+	allErr := fmt.Errorf("no signature layer found")
+	for _, l := range sigManifest.Layers {
+		sig, ok := l.Annotations[signatureAnnotation]
+		if !ok {
+			continue
+		}
+		payload, err := fetchBlob(ctx, fetcher, l)
+		if err != nil {
+			allErr = err
+			continue
+		}
+		if err := p.verifySignature(payload, sig, l.Annotations, dgst); err != nil {
+			allErr = err
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid signature for %q: %w", dgst, allErr)
+}
+
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v interface{}) error {
+	data, err := fetchBlob(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// fetchBlob fetches the blob and checks it against the digest of the descriptor.
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxManifestSize {
+		return nil, fmt.Errorf("blob %q is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if got := desc.Digest.Algorithm().FromBytes(data); got != desc.Digest {
+		return nil, fmt.Errorf("digest mismatch of blob: want %q, got %q", desc.Digest, got)
+	}
+	return data, nil
+}
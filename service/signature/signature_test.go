@@ -0,0 +1,468 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testIdentity = "signer@example.com"
+	testIssuer   = "https://issuer.example.com"
+)
+
+// testRegistry is a minimal read-only registry serving manifests and blobs.
+type testRegistry struct {
+	srv       *httptest.Server
+	manifests map[string]ocispec.Descriptor // tag or digest -> descriptor
+	blobs     map[digest.Digest][]byte
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		manifests: make(map[string]ocispec.Descriptor),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+	r.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		elems := strings.Split(req.URL.Path, "/")
+		if len(elems) < 3 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		kind, name := elems[len(elems)-2], elems[len(elems)-1]
+		var (
+			data []byte
+			desc ocispec.Descriptor
+			ok   bool
+		)
+		switch kind {
+		case "manifests":
+			if desc, ok = r.manifests[name]; ok {
+				data = r.blobs[desc.Digest]
+			}
+		case "blobs":
+			data, ok = r.blobs[digest.Digest(name)]
+			desc = ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.Digest(name)}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", desc.MediaType)
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *testRegistry) add(mediaType string, v interface{}) ocispec.Descriptor {
+	data, ok := v.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			panic(err)
+		}
+	}
+	dgst := digest.FromBytes(data)
+	r.blobs[dgst] = data
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+	r.manifests[dgst.String()] = desc
+	return desc
+}
+
+func (r *testRegistry) tag(tag string, desc ocispec.Descriptor) {
+	r.manifests[tag] = desc
+}
+
+// source returns the source of the target layer of the manifest pulled with the reference.
+func (r *testRegistry) source(t *testing.T, ref string, target ocispec.Descriptor, manifest digest.Digest) source.Source {
+	refspec, err := reference.Parse(r.srv.Listener.Addr().String() + "/" + ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	for k, v := range target.Annotations {
+		labels[k] = v
+	}
+	if manifest != "" {
+		labels[config.TargetManifestDigestLabel] = manifest.String()
+	}
+	target.Annotations = labels
+	return source.Source{
+		Hosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       r.srv.Client(),
+				Host:         r.srv.Listener.Addr().String(),
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+			}}, nil
+		},
+		Name:   refspec,
+		Target: target,
+	}
+}
+
+// sign pushes a cosign signature of dgst with the specified annotations.
+func (r *testRegistry) sign(dgst digest.Digest, payload []byte, annotations map[string]string) {
+	layer := r.add("application/vnd.dev.cosign.simplesigning.v1+json", payload)
+	layer.Annotations = annotations
+	sig := r.add(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	r.tag(fmt.Sprintf("%s-%s.sig", dgst.Algorithm(), dgst.Encoded()), sig)
+}
+
+func testPayload(dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, dgst, simpleSigningType))
+}
+
+func signRaw(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	h := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func genKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePublicKey(t *testing.T, dir, name string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, name, "PUBLIC KEY", der)
+}
+
+// testImage pushes an image with a layer and returns the manifest and layer descriptors.
+func testImage(r *testRegistry, tag string) (ocispec.Descriptor, ocispec.Descriptor) {
+	layer := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromString("layer-" + tag),
+		Size:        10,
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: digest.FromString("toc-" + tag).String()},
+	}
+	m := r.add(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config")},
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	r.tag(tag, m)
+	return m, layer
+}
+
+func TestKeyedVerification(t *testing.T) {
+	dir := t.TempDir()
+	key, otherKey := genKey(t), genKey(t)
+	r := newTestRegistry(t)
+
+	signed, signedLayer := testImage(r, "signed")
+	payload := testPayload(signed.Digest)
+	r.sign(signed.Digest, payload, map[string]string{
+		signatureAnnotation: base64.StdEncoding.EncodeToString(signRaw(t, key, payload)),
+	})
+
+	otherSigned, otherSignedLayer := testImage(r, "othersigned")
+	payload = testPayload(otherSigned.Digest)
+	r.sign(otherSigned.Digest, payload, map[string]string{
+		signatureAnnotation: base64.StdEncoding.EncodeToString(signRaw(t, otherKey, payload)),
+	})
+
+	// The signature covers another image.
+	tampered, tamperedLayer := testImage(r, "tampered")
+	payload = testPayload(signed.Digest)
+	r.sign(tampered.Digest, payload, map[string]string{
+		signatureAnnotation: base64.StdEncoding.EncodeToString(signRaw(t, key, payload)),
+	})
+
+	unsigned, unsignedLayer := testImage(r, "unsigned")
+
+	badTOC := signedLayer
+	badTOC.Annotations = map[string]string{estargz.TOCJSONDigestAnnotation: digest.FromString("dummy").String()}
+	noTOC := signedLayer
+	noTOC.Annotations = nil
+
+	// The manifest is signed through the index.
+	inIndex, inIndexLayer := testImage(r, "inindex")
+	index := r.add(ocispec.MediaTypeImageIndex, ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{inIndex},
+	})
+	r.tag("index", index)
+	payload = testPayload(index.Digest)
+	r.sign(index.Digest, payload, map[string]string{
+		signatureAnnotation: base64.StdEncoding.EncodeToString(signRaw(t, key, payload)),
+	})
+
+	v, err := NewVerifier(Config{
+		Enable: true,
+		Policies: []PolicyConfig{{
+			Repositories: []string{r.srv.Listener.Addr().String() + "/verified/*"},
+			PublicKey:    writePublicKey(t, dir, "cosign.pub", key),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		ref      string
+		target   ocispec.Descriptor
+		manifest digest.Digest
+		wantErr  bool
+	}{
+		{name: "signed", ref: "verified/img:signed", target: signedLayer, manifest: signed.Digest},
+		{name: "signed_by_digest", ref: "verified/img@" + signed.Digest.String(), target: signedLayer, manifest: signed.Digest},
+		{name: "signed_index", ref: "verified/img:index", target: inIndexLayer, manifest: inIndex.Digest},
+		{name: "not_in_signed_index", ref: "verified/img:index", target: unsignedLayer, manifest: unsigned.Digest, wantErr: true},
+		{name: "unknown_layer", ref: "verified/img:signed", target: unsignedLayer, manifest: signed.Digest, wantErr: true},
+		{name: "unsigned_toc", ref: "verified/img:signed", target: badTOC, manifest: signed.Digest, wantErr: true},
+		{name: "missing_toc", ref: "verified/img:signed", target: noTOC, manifest: signed.Digest, wantErr: true},
+		{name: "tag_moved", ref: "verified/img:signed", target: unsignedLayer, manifest: unsigned.Digest, wantErr: true},
+		{name: "no_manifest_digest", ref: "verified/img:signed", target: signedLayer, wantErr: true},
+		{name: "wrong_key", ref: "verified/img:othersigned", target: otherSignedLayer, manifest: otherSigned.Digest, wantErr: true},
+		{name: "tampered", ref: "verified/img:tampered", target: tamperedLayer, manifest: tampered.Digest, wantErr: true},
+		{name: "unsigned", ref: "verified/img:unsigned", target: unsignedLayer, manifest: unsigned.Digest, wantErr: true},
+		{name: "unmatched", ref: "other/img:unsigned", target: unsignedLayer, manifest: unsigned.Digest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Verify(context.Background(), r.source(t, tt.ref, tt.target, tt.manifest))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Verified sources carry the manifest whose signature is verified.
+	srcs, err := v.VerifySources(context.Background(), func(map[string]string) ([]source.Source, error) {
+		return []source.Source{r.source(t, "verified/img:index", inIndexLayer, inIndex.Digest)}, nil
+	})(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := srcs[0].VerifiedManifestDesc.Digest; got != inIndex.Digest || len(srcs[0].VerifiedManifest.Layers) != 1 {
+		t.Errorf("verified manifest %v must be passed; got %v", inIndex.Digest, got)
+	}
+
+	WithRequireSigned(func(refspec reference.Spec) bool {
+		return refspec.Locator == r.srv.Listener.Addr().String()+"/other/img"
+	})(v)
+	if err := v.Verify(context.Background(), r.source(t, "other/img:unsigned", unsignedLayer, unsigned.Digest)); err == nil {
+		t.Fatalf("unmatched image required to be signed must be rejected")
+	}
+	if err := v.Verify(context.Background(), r.source(t, "another/img:unsigned", unsignedLayer, unsigned.Digest)); err != nil {
+		t.Fatalf("unmatched image not required to be signed must be allowed: %v", err)
+	}
+
+	v.rejectUnmatched = true
+	if err := v.Verify(context.Background(), r.source(t, "other/img:unsigned", unsignedLayer, unsigned.Digest)); err == nil {
+		t.Fatalf("unmatched image must be rejected")
+	}
+}
+
+func TestKeylessVerification(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRegistry(t)
+
+	// Certificate authority
+	caKey := genKey(t)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootsPath := writePEM(t, dir, "fulcio.pem", "CERTIFICATE", caDER)
+
+	rekorKey := genKey(t)
+	rekorPath := writePublicKey(t, dir, "rekor.pub", rekorKey)
+
+	// Short-lived signing certificate which has already expired
+	signedAt := time.Now().Add(-30 * time.Minute)
+	issuerExt, err := asn1.Marshal(testIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := genKey(t)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signedAt.Add(-time.Minute),
+		NotAfter:        signedAt.Add(9 * time.Minute),
+		EmailAddresses:  []string{testIdentity},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuerV2, Value: issuerExt}},
+	}, caCert, &signKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}))
+
+	newBundle := func(payload, sig []byte) string {
+		var entry hashedRekord
+		entry.Kind = "hashedrekord"
+		h := sha256.Sum256(payload)
+		entry.Spec.Data.Hash.Algorithm = "sha256"
+		entry.Spec.Data.Hash.Value = hex.EncodeToString(h[:])
+		entry.Spec.Signature.Content = sig
+		body, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := bundlePayload{
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: signedAt.Unix(),
+			LogID:          "0123456789abcdef",
+			LogIndex:       42,
+		}
+		canonical, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(bundle{SignedEntryTimestamp: signRaw(t, rekorKey, canonical), Payload: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	signed, signedLayer := testImage(r, "signed")
+	payload := testPayload(signed.Digest)
+	sig := signRaw(t, signKey, payload)
+	r.sign(signed.Digest, payload, map[string]string{
+		signatureAnnotation:   base64.StdEncoding.EncodeToString(sig),
+		certificateAnnotation: leafPEM,
+		bundleAnnotation:      newBundle(payload, sig),
+	})
+
+	unlogged, unloggedLayer := testImage(r, "unlogged")
+	payload = testPayload(unlogged.Digest)
+	sig = signRaw(t, signKey, payload)
+	r.sign(unlogged.Digest, payload, map[string]string{
+		signatureAnnotation:   base64.StdEncoding.EncodeToString(sig),
+		certificateAnnotation: leafPEM,
+	})
+
+	// The log entry records another signature
+	misLogged, misLoggedLayer := testImage(r, "mislogged")
+	payload = testPayload(misLogged.Digest)
+	sig = signRaw(t, signKey, payload)
+	r.sign(misLogged.Digest, payload, map[string]string{
+		signatureAnnotation:   base64.StdEncoding.EncodeToString(sig),
+		certificateAnnotation: leafPEM,
+		bundleAnnotation:      newBundle(testPayload(signed.Digest), sig),
+	})
+
+	tests := []struct {
+		name     string
+		identity string
+		issuer   string
+		ref      string
+		target   ocispec.Descriptor
+		manifest digest.Digest
+		wantErr  bool
+	}{
+		{name: "signed", identity: testIdentity, issuer: testIssuer, ref: "img:signed", target: signedLayer, manifest: signed.Digest},
+		{name: "identity_regexp", identity: `.*@example\.com`, issuer: testIssuer, ref: "img:signed", target: signedLayer, manifest: signed.Digest},
+		{name: "wrong_identity", identity: "other@example.com", issuer: testIssuer, ref: "img:signed", target: signedLayer, manifest: signed.Digest, wantErr: true},
+		{name: "wrong_issuer", identity: testIdentity, issuer: "https://other.example.com", ref: "img:signed", target: signedLayer, manifest: signed.Digest, wantErr: true},
+		{name: "unlogged", identity: testIdentity, issuer: testIssuer, ref: "img:unlogged", target: unloggedLayer, manifest: unlogged.Digest, wantErr: true},
+		{name: "mislogged", identity: testIdentity, issuer: testIssuer, ref: "img:mislogged", target: misLoggedLayer, manifest: misLogged.Digest, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVerifier(Config{
+				Enable: true,
+				Policies: []PolicyConfig{{
+					Repositories:   []string{"*/img"},
+					FulcioRoots:    rootsPath,
+					RekorPublicKey: rekorPath,
+					Identity:       tt.identity,
+					Issuer:         tt.issuer,
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = v.Verify(context.Background(), r.source(t, tt.ref, tt.target, tt.manifest))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package transfer supports images pulled by the transfer service of containerd
+// (e.g. "ctr image pull" and nerdctl with containerd v2). Unlike the handler of
+// the client-side pull, the transfer service doesn't annotate layers with the image
+// reference and the layer digests so the snapshotter receives only the chain ID and
+// the inherited annotations of the layer. This package reconstructs the missing
+// labels from the manifests in the content store of containerd.
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// targetSnapshotLabel is the label containing the chain ID of the layer being
+	// pulled. containerd passes this label regardless of the pull path.
+	targetSnapshotLabel = "containerd.io/snapshot.ref"
+
+	// configGCLabel is the GC reference label of the config which only manifests have.
+	configGCLabel = "containerd.io/gc.ref.content.config"
+
+	// distributionSourceLabelPrefix is the prefix of the labels of the content
+	// indicating the repositories on the registry (the suffix) where it's from.
+	distributionSourceLabelPrefix = "containerd.io/distribution.source."
+
+	// inheritedLabelPrefix is the prefix of the annotations of layers which
+	// containerd passes to snapshotters as labels.
+	inheritedLabelPrefix = "containerd.io/snapshot/"
+)
+
+// Reconstructor reconstructs labels of layers from the content store of containerd.
+type Reconstructor struct {
+	cs content.Store
+
+	// manifests caches the parsed manifests which are immutable.
+	manifests   map[digest.Digest]*manifestEntry
+	manifestsMu sync.Mutex
+
+	// index is the index of layers of the manifests in each namespace.
+	index   map[string]*chainIndex
+	indexMu sync.Mutex
+}
+
+// chainIndex indexes layers by their chain IDs. Each layer points to the most
+// recently stored manifest containing it.
+type chainIndex struct {
+	manifests map[digest.Digest]struct{}     // manifests already indexed
+	layers    map[digest.Digest]indexedLayer // indexed by the chain ID
+}
+
+type indexedLayer struct {
+	ref       string
+	manifest  ocispec.Descriptor
+	createdAt time.Time
+	layers    []ocispec.Descriptor
+	i         int
+}
+
+type manifestEntry struct {
+	mediaType string
+	layers    []ocispec.Descriptor
+	chainIDs  []digest.Digest
+}
+
+// NewReconstructor returns a reconstructor using the content store of containerd.
+func NewReconstructor(cs content.Store) *Reconstructor {
+	return &Reconstructor{
+		cs:        cs,
+		manifests: make(map[digest.Digest]*manifestEntry),
+		index:     make(map[string]*chainIndex),
+	}
+}
+
+// Labels returns the labels of the layer with the chain ID which are necessary to
+// lazily pull it. They are reconstructed from the most recently stored manifest
+// containing the layer because that's most likely of the image being pulled.
+// Manifests without the distribution source label are skipped.
+//
+// Layers are looked up from the index of the manifests in the namespace. Each call
+// only lists the manifests to index the ones stored since the previous call. The
+// index is rebuilt if a manifest is removed.
+func (r *Reconstructor) Labels(ctx context.Context, chainID digest.Digest) (map[string]string, error) {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		return nil, fmt.Errorf("namespace of layer %q is unknown", chainID)
+	}
+	ctx = namespaces.WithNamespace(ctx, ns)
+	var infos []content.Info
+	if err := r.cs.Walk(ctx, func(info content.Info) error {
+		infos = append(infos, info)
+		return nil
+	}, fmt.Sprintf("labels.%q", configGCLabel)); err != nil {
+		return nil, fmt.Errorf("failed to walk manifests: %w", err)
+	}
+
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+	idx := r.index[ns]
+	if idx == nil || idx.hasRemoved(infos) {
+		idx = &chainIndex{
+			manifests: make(map[digest.Digest]struct{}),
+			layers:    make(map[digest.Digest]indexedLayer),
+		}
+		r.index[ns] = idx
+	}
+	for _, info := range infos {
+		if _, ok := idx.manifests[info.Digest]; ok {
+			continue
+		}
+		ref, ok := sourceRef(info)
+		if !ok {
+			continue // the label may be added later
+		}
+		e, err := r.manifest(ctx, info)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("skipping manifest %v", info.Digest)
+			continue
+		}
+		idx.add(ref, info, e)
+	}
+	l, ok := idx.layers[chainID]
+	if !ok {
+		return nil, fmt.Errorf("no manifest with the distribution source contains layer %q: %w", chainID, errdefs.ErrNotFound)
+	}
+	return layerLabels(ctx, l.ref, l.manifest, l.layers, l.i)
+}
+
+// add indexes the layers of the manifest unless they are indexed with newer manifests.
+func (idx *chainIndex) add(ref string, info content.Info, e *manifestEntry) {
+	idx.manifests[info.Digest] = struct{}{}
+	for i, c := range e.chainIDs {
+		if l, ok := idx.layers[c]; ok && !info.CreatedAt.After(l.createdAt) {
+			continue
+		}
+		idx.layers[c] = indexedLayer{
+			ref:       ref,
+			manifest:  ocispec.Descriptor{MediaType: e.mediaType, Digest: info.Digest, Size: info.Size},
+			createdAt: info.CreatedAt,
+			layers:    e.layers,
+			i:         i,
+		}
+	}
+}
+
+// hasRemoved reports if any of the indexed manifests isn't contained in the infos.
+func (idx *chainIndex) hasRemoved(infos []content.Info) bool {
+	current := make(map[digest.Digest]struct{}, len(infos))
+	for _, info := range infos {
+		current[info.Digest] = struct{}{}
+	}
+	for d := range idx.manifests {
+		if _, ok := current[d]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reconstructor) manifest(ctx context.Context, info content.Info) (*manifestEntry, error) {
+	r.manifestsMu.Lock()
+	e, ok := r.manifests[info.Digest]
+	r.manifestsMu.Unlock()
+	if ok {
+		return e, nil
+	}
+	p, err := content.ReadBlob(ctx, r.cs, ocispec.Descriptor{Digest: info.Digest, Size: info.Size})
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	p, err = content.ReadBlob(ctx, r.cs, manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var image ocispec.Image
+	if err := json.Unmarshal(p, &image); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	var layers []ocispec.Descriptor
+	for _, l := range manifest.Layers {
+		if images.IsLayerType(l.MediaType) {
+			layers = append(layers, l)
+		}
+	}
+	if len(layers) != len(image.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("number of layers (%d) doesn't match the diffIDs (%d)", len(layers), len(image.RootFS.DiffIDs))
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = ocispec.MediaTypeImageManifest
+	}
+	e = &manifestEntry{
+		mediaType: mediaType,
+		layers:    layers,
+		chainIDs:  identity.ChainIDs(append([]digest.Digest{}, image.RootFS.DiffIDs...)),
+	}
+	r.manifestsMu.Lock()
+	r.manifests[info.Digest] = e
+	r.manifestsMu.Unlock()
+	return e, nil
+}
+
+// sourceRef returns the reference of the manifest based on its distribution source label.
+func sourceRef(info content.Info) (string, bool) {
+	var keys []string
+	for k := range info.Labels {
+		if strings.HasPrefix(k, distributionSourceLabelPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		host := strings.TrimPrefix(k, distributionSourceLabelPrefix)
+		repo := strings.Split(info.Labels[k], ",")[0]
+		ref := fmt.Sprintf("%s/%s@%s", host, repo, info.Digest)
+		if _, err := reference.Parse(ref); err == nil {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// layerLabels returns the labels of the i-th layer of the manifest. These are the
+// same as the ones passed through source.AppendDefaultLabelsHandlerWrapper except
+// that the prefetch size isn't specified so the default of the filesystem is used.
+func layerLabels(ctx context.Context, ref string, desc ocispec.Descriptor, layers []ocispec.Descriptor, i int) (map[string]string, error) {
+	children, err := source.AppendDefaultLabelsHandlerWrapper(ref, 0)(images.HandlerFunc(
+		func(context.Context, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			// Copy annotations not to modify the cached manifest
+			res := make([]ocispec.Descriptor, len(layers))
+			for i, l := range layers {
+				res[i] = l
+				res[i].Annotations = make(map[string]string, len(l.Annotations))
+				for k, v := range l.Annotations {
+					res[i].Annotations[k] = v
+				}
+			}
+			return res, nil
+		})).Handle(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for k, v := range children[i].Annotations {
+		if strings.HasPrefix(k, inheritedLabelPrefix) {
+			labels[k] = v
+		}
+	}
+	delete(labels, config.TargetPrefetchSizeLabel)
+	return labels, nil
+}
+
+// FileSystem wraps the filesystem so that labels of layers are reconstructed before
+// mounting if they don't contain the information of the image. getSources is used
+// to check whether the labels contain it.
+func (r *Reconstructor) FileSystem(fs snapshot.FileSystem, getSources source.GetSources) snapshot.FileSystem {
+	return &filesystem{FileSystem: fs, r: r, getSources: getSources}
+}
+
+type filesystem struct {
+	snapshot.FileSystem
+	r          *Reconstructor
+	getSources source.GetSources
+}
+
+func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.reconstruct(ctx, labels)
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+// Unpack lets the underlying filesystem unpack the layer with the reconstructed labels.
+func (fs *filesystem) Unpack(ctx context.Context, mounts []mount.Mount, labels map[string]string) (ocispec.Descriptor, error) {
+	u, ok := fs.FileSystem.(snapshot.Unpacker)
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("unpacking layers isn't supported: %w", errdefs.ErrNotImplemented)
+	}
+	fs.reconstruct(ctx, labels)
+	return u.Unpack(ctx, mounts, labels)
+}
+
+// Usage returns the usage reported by the underlying filesystem.
+func (fs *filesystem) Usage(ctx context.Context, mountpoint string) (snapshots.Usage, error) {
+	r, ok := fs.FileSystem.(snapshot.UsageReporter)
+	if !ok {
+		return snapshots.Usage{}, fmt.Errorf("usage isn't reported: %w", errdefs.ErrNotImplemented)
+	}
+	return r.Usage(ctx, mountpoint)
+}
+
+// reconstruct adds the reconstructed labels to the labels in place so that the
+// snapshotter stores them with the snapshot and they are available on restore.
+// Existing labels are kept.
+func (fs *filesystem) reconstruct(ctx context.Context, labels map[string]string) {
+	if _, err := fs.getSources(labels); err == nil {
+		return // the labels contain the image information
+	}
+	chainID, err := digest.Parse(labels[targetSnapshotLabel])
+	if err != nil {
+		return // not a layer being pulled
+	}
+	l, err := fs.r.Labels(ctx, chainID)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("labels of the image are missing (e.g. pulled by the transfer service) " +
+			"and can't be reconstructed; the layer can't be lazily pulled")
+		return
+	}
+	for k, v := range l {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	log.G(ctx).WithField("chainID", chainID).Info("reconstructed labels of the image missing in the snapshot labels")
+}
@@ -0,0 +1,272 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testRefLabel    = "containerd.io/snapshot/remote/stargz.reference"
+	testDigestLabel = "containerd.io/snapshot/remote/stargz.digest"
+	testTOCLabel    = "containerd.io/snapshot/stargz/toc.digest"
+)
+
+func TestReconstruct(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	cs, err := local.NewLabeledStore(t.TempDir(), &testLabelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := []ocispec.Descriptor{
+		writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, []byte("layer-0"), nil),
+		writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, []byte("layer-1"), nil),
+	}
+	layers[1].Annotations = map[string]string{testTOCLabel: digest.FromString("toc").String()}
+	diffIDs := []digest.Digest{digest.FromString("diff-0"), digest.FromString("diff-1")}
+	chainIDs := identity.ChainIDs(append([]digest.Digest{}, diffIDs...))
+	cfg := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	}, nil)
+	writeManifest := func(labels map[string]string) ocispec.Descriptor {
+		l := map[string]string{configGCLabel: cfg.Digest.String()}
+		for k, v := range labels {
+			l[k] = v
+		}
+		return writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    cfg,
+			Layers:    layers,
+		}, l)
+	}
+	manifest := writeManifest(map[string]string{distributionSourceLabelPrefix + "example.com": "foo/bar"})
+
+	mounted := &testFileSystem{}
+	fs := NewReconstructor(cs).FileSystem(mounted, func(labels map[string]string) ([]source.Source, error) {
+		if _, ok := labels[testRefLabel]; !ok {
+			return nil, fmt.Errorf("no source")
+		}
+		return []source.Source{{}}, nil
+	})
+
+	labels := map[string]string{
+		targetSnapshotLabel: chainIDs[1].String(),
+		testTOCLabel:        digest.FromString("toc").String(),
+	}
+	if err := fs.Mount(ctx, "/mnt", labels); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		testRefLabel:                     "example.com/foo/bar@" + manifest.Digest.String(),
+		testDigestLabel:                  layers[1].Digest.String(),
+		config.TargetManifestDigestLabel: manifest.Digest.String(),
+		config.TargetLayerIndexLabel:     "1",
+	} {
+		if got := mounted.labels[k]; got != want {
+			t.Errorf("label %q = %q; want %q", k, got, want)
+		}
+	}
+	if _, ok := mounted.labels[config.TargetPrefetchSizeLabel]; ok {
+		t.Errorf("prefetch size must not be specified")
+	}
+	if _, ok := labels[testRefLabel]; !ok {
+		t.Errorf("labels must be reconstructed in place to be stored with the snapshot")
+	}
+
+	// Labels containing the image information are kept as is.
+	labels = map[string]string{targetSnapshotLabel: chainIDs[0].String(), testRefLabel: "example.com/other:latest"}
+	if err := fs.Mount(ctx, "/mnt", labels); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounted.labels) != 2 || mounted.labels[testRefLabel] != "example.com/other:latest" {
+		t.Errorf("labels with the image information must not be modified: %+v", mounted.labels)
+	}
+
+	// Unknown layers are passed to the filesystem as is to fall back.
+	labels = map[string]string{targetSnapshotLabel: digest.FromString("unknown").String()}
+	if err := fs.Mount(ctx, "/mnt", labels); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounted.labels) != 1 {
+		t.Errorf("labels of unknown layers must not be modified: %+v", mounted.labels)
+	}
+}
+
+func TestLabelsIndex(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	root := t.TempDir()
+	cs, err := local.NewLabeledStore(root, &testLabelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newImage := func(name string, age time.Duration, diffIDs ...digest.Digest) ocispec.Descriptor {
+		var layers []ocispec.Descriptor
+		for _, d := range diffIDs {
+			layers = append(layers, writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, []byte(d), nil))
+		}
+		cfg := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+			RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		}, nil)
+		manifest := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      cfg,
+			Layers:      layers,
+			Annotations: map[string]string{"name": name},
+		}, map[string]string{configGCLabel: cfg.Digest.String(), distributionSourceLabelPrefix + "example.com": name})
+		// The creation time of the local store is the modification time of the blob.
+		created := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(root, "blobs", "sha256", manifest.Digest.Encoded()), created, created); err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+	var (
+		base  = digest.FromString("base")
+		app   = digest.FromString("app")
+		other = digest.FromString("other")
+	)
+	baseChain := identity.ChainID([]digest.Digest{base})
+	otherChain := identity.ChainID([]digest.Digest{base, other})
+	r := NewReconstructor(cs)
+	checkRef := func(chainID digest.Digest, want string) {
+		t.Helper()
+		labels, err := r.Labels(ctx, chainID)
+		if want == "" {
+			if !errdefs.IsNotFound(err) {
+				t.Errorf("layer %v must not be found; got %v, %v", chainID, labels, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("failed to get labels of %v: %v", chainID, err)
+		} else if labels[testRefLabel] != want {
+			t.Errorf("reference of %v = %q; want %q", chainID, labels[testRefLabel], want)
+		}
+	}
+
+	older := newImage("older", 2*time.Hour, base, app)
+	newer := newImage("newer", time.Hour, base)
+	checkRef(baseChain, "example.com/newer@"+newer.Digest.String())
+	checkRef(identity.ChainID([]digest.Digest{base, app}), "example.com/older@"+older.Digest.String())
+	checkRef(otherChain, "")
+
+	// New manifests are indexed by the following lookups
+	latest := newImage("latest", 0, base, other)
+	checkRef(otherChain, "example.com/latest@"+latest.Digest.String())
+	checkRef(baseChain, "example.com/latest@"+latest.Digest.String())
+
+	// Layers of removed manifests are looked up from the remaining ones
+	if err := cs.Delete(ctx, latest.Digest); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(baseChain, "example.com/newer@"+newer.Digest.String())
+	checkRef(otherChain, "")
+}
+
+type testFileSystem struct {
+	labels map[string]string
+}
+
+func (fs *testFileSystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.labels = make(map[string]string)
+	for k, v := range labels {
+		fs.labels[k] = v
+	}
+	return nil
+}
+
+func (fs *testFileSystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+
+func (fs *testFileSystem) Unmount(ctx context.Context, mountpoint string) error {
+	return nil
+}
+
+func writeTestJSON(ctx context.Context, t *testing.T, cs content.Store, mediaType string, v interface{}, labels map[string]string) ocispec.Descriptor {
+	p, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestBlob(ctx, t, cs, mediaType, p, labels)
+}
+
+func writeTestBlob(ctx context.Context, t *testing.T, cs content.Store, mediaType string, p []byte, labels map[string]string) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(p), Size: int64(len(p))}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc, content.WithLabels(labels)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// testLabelStore is a label store of the local content store on memory.
+type testLabelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func (s *testLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[dgst], nil
+}
+
+func (s *testLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = labels
+	return nil
+}
+
+func (s *testLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return labels, nil
+}
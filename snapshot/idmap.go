@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+)
+
+const (
+	// LabelUIDMapping is a label which contains the UID mapping of the user
+	// namespace of the container using the snapshot, formatted as
+	// "<container ID>:<host ID>:<size>[,...]". This is the same label as containerd uses.
+	LabelUIDMapping = "containerd.io/snapshot/uidmapping"
+
+	// LabelGIDMapping is a label which contains the GID mapping of the user
+	// namespace of the container using the snapshot. The format is the same as
+	// LabelUIDMapping.
+	LabelGIDMapping = "containerd.io/snapshot/gidmapping"
+
+	// idMappedDir is the directory in the snapshot directory where ID-mapped
+	// views of remote parent snapshots are mounted.
+	idMappedDir = "idmapped"
+)
+
+// mappedRoot returns the host ID mapped to the root of the container. -1 is
+// returned if the mapping is empty.
+func mappedRoot(mapping string) (int, error) {
+	if mapping == "" {
+		return -1, nil
+	}
+	for _, e := range strings.Split(mapping, ",") {
+		f := strings.Split(e, ":")
+		if len(f) != 3 {
+			return -1, fmt.Errorf("mapping %q must be <container ID>:<host ID>:<size>", e)
+		}
+		var v [3]uint32
+		for i := range f {
+			n, err := strconv.ParseUint(f[i], 10, 32)
+			if err != nil {
+				return -1, err
+			}
+			v[i] = uint32(n)
+		}
+		if v[0] == 0 && v[2] > 0 {
+			return int(v[1]), nil
+		}
+	}
+	return -1, fmt.Errorf("root isn't mapped in %q", mapping)
+}
+
+// idMappedLowers returns lower directories and additional mount options for
+// the snapshot which is used by a user-namespaced container.
+//
+// If all parents are normal snapshots, uidmap and gidmap options are returned
+// so that containerd creates ID-mapped mounts of the lower directories. FUSE
+// mounts can't be ID-mapped by the kernel so, if all parents are remote
+// snapshots, the remote layers are mounted again with shifted owners and
+// these views are used as lower directories instead.
+func (o *snapshotter) idMappedLowers(ctx context.Context, key string, s storage.Snapshot, parentPaths []string) ([]string, []string, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer t.Rollback()
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	uidmap, gidmap := info.Labels[LabelUIDMapping], info.Labels[LabelGIDMapping]
+	if uidmap == "" && gidmap == "" {
+		return parentPaths, nil, nil
+	}
+
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	parents := make([]snapshots.Info, len(s.ParentIDs))
+	var remote int
+	for i, id := range s.ParentIDs {
+		if _, parents[i], _, err = storage.GetInfo(ctx, ids[id]); err != nil {
+			return nil, nil, fmt.Errorf("failed to get info of parent %q: %w", ids[id], err)
+		}
+		if _, ok := parents[i].Labels[remoteLabel]; ok {
+			remote++
+		}
+	}
+	if remote == 0 {
+		var options []string
+		if uidmap != "" {
+			options = append(options, "uidmap="+uidmap)
+		}
+		if gidmap != "" {
+			options = append(options, "gidmap="+gidmap)
+		}
+		return parentPaths, options, nil
+	} else if remote < len(parents) {
+		return nil, nil, fmt.Errorf("ID-mapped snapshot %q on both remote and normal snapshots: %w", key, errdefs.ErrNotImplemented)
+	}
+
+	o.idMappedMu.Lock()
+	defer o.idMappedMu.Unlock()
+	lowers := make([]string, len(parents))
+	for i, p := range parents {
+		mp := filepath.Join(o.root, "snapshots", s.ID, idMappedDir, strconv.Itoa(i))
+		lowers[i] = mp
+		if mounted, err := mountinfo.Mounted(mp); err == nil && mounted {
+			continue
+		}
+		if err := os.MkdirAll(mp, 0755); err != nil {
+			return nil, nil, err
+		}
+		labels := make(map[string]string, len(p.Labels)+2)
+		for k, v := range p.Labels {
+			labels[k] = v
+		}
+		delete(labels, LabelUIDMapping)
+		delete(labels, LabelGIDMapping)
+		if uidmap != "" {
+			labels[LabelUIDMapping] = uidmap
+		}
+		if gidmap != "" {
+			labels[LabelGIDMapping] = gidmap
+		}
+		log.G(ctx).WithField("mountpoint", mp).Debugf("mounting ID-mapped view of %q", p.Name)
+		if err := o.fs.Mount(ctx, mp, labels); err != nil {
+			return nil, nil, fmt.Errorf("failed to mount ID-mapped view of %q: %w", p.Name, err)
+		}
+	}
+	return lowers, nil, nil
+}
+
+// unmountIDMapped unmounts ID-mapped views of remote snapshots mounted in the
+// snapshot directory.
+func (o *snapshotter) unmountIDMapped(ctx context.Context, dir string) {
+	views, err := filepath.Glob(filepath.Join(dir, idMappedDir, "*"))
+	if err != nil {
+		return
+	}
+	for _, mp := range views {
+		if err := o.fs.Unmount(ctx, mp); err != nil {
+			log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
+		}
+	}
+}
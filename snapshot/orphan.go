@@ -0,0 +1,217 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+)
+
+// statMountTimeout is the timeout to check if a FUSE mount is alive. The FUSE
+// server of the mount can be hanging, so mounts not responding in time are left.
+const statMountTimeout = 5 * time.Second
+
+// OrphanCleanupResult is the result of CleanupOrphans.
+type OrphanCleanupResult struct {
+	// Unmounted are the mountpoints unmounted because they didn't belong to live
+	// snapshots or their FUSE servers were dead.
+	Unmounted []string `json:"unmounted,omitempty"`
+
+	// Removed are the snapshot directories removed because they didn't belong to
+	// live snapshots.
+	Removed []string `json:"removed,omitempty"`
+
+	// Restored are the keys of the remote snapshots mounted again after their dead
+	// mounts are unmounted.
+	Restored []string `json:"restored,omitempty"`
+}
+
+// OrphanCleaner is implemented by the snapshotter returned by NewSnapshotter.
+// Orphans are also cleaned up when the snapshotter starts.
+type OrphanCleaner interface {
+	CleanupOrphans(ctx context.Context) (OrphanCleanupResult, error)
+}
+
+// CleanupOrphans unmounts and removes mounts and directories under the snapshots
+// directory which don't belong to live snapshots (e.g. left by a crash). Dead
+// FUSE mounts of live remote snapshots are unmounted and mounted again.
+func (o *snapshotter) CleanupOrphans(ctx context.Context) (OrphanCleanupResult, error) {
+	var res OrphanCleanupResult
+	dirs, err := o.cleanupDirectories(ctx, false)
+	if err != nil {
+		return res, err
+	}
+	for _, dir := range dirs {
+		// Let the filesystem finalize the layer if it's still registered.
+		mp := filepath.Join(dir, "fs")
+		if err := o.fs.Unmount(ctx, mp); err == nil {
+			res.Unmounted = append(res.Unmounted, mp)
+		}
+		o.unmountIDMapped(ctx, dir)
+
+		// Mounts unknown to the filesystem (e.g. of the previous run) block the removal.
+		res.Unmounted = append(res.Unmounted, detachMounts(ctx, dir)...)
+		if err := os.RemoveAll(dir); err != nil {
+			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove orphaned snapshot directory")
+			continue
+		}
+		res.Removed = append(res.Removed, dir)
+	}
+
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(filepath.Join(o.root, "snapshots")))
+	if err != nil {
+		return res, err
+	}
+	var remotes map[string]snapshots.Info // mountpoints of remote snapshots
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.FSType, "fuse") || o.mountProber.isAlive(m.Mountpoint) {
+			continue
+		}
+		if remotes == nil {
+			if remotes, err = o.remoteSnapshots(ctx); err != nil {
+				return res, err
+			}
+		}
+		log.G(ctx).WithField("mountpoint", m.Mountpoint).Warn("unmounting dead mount")
+		if err := o.fs.Unmount(ctx, m.Mountpoint); err != nil {
+			if err := syscall.Unmount(m.Mountpoint, syscall.MNT_DETACH); err != nil {
+				log.G(ctx).WithError(err).WithField("mountpoint", m.Mountpoint).Warn("failed to unmount dead mount")
+				continue
+			}
+		}
+		res.Unmounted = append(res.Unmounted, m.Mountpoint)
+		info, ok := remotes[m.Mountpoint]
+		if !ok {
+			continue
+		}
+		if err := o.prepareRemoteSnapshot(ctx, info.Name, info.Labels); err != nil {
+			// The snapshot will be reported as unavailable when it's used again.
+			log.G(ctx).WithError(err).WithField("key", info.Name).Warn("failed to restore remote snapshot")
+			continue
+		}
+		res.Restored = append(res.Restored, info.Name)
+	}
+	return res, nil
+}
+
+// remoteSnapshots returns remote snapshots indexed by their mountpoints.
+func (o *snapshotter) remoteSnapshots(ctx context.Context) (map[string]snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	remotes := make(map[string]snapshots.Info)
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[remoteLabel]; !ok {
+			return nil
+		}
+		id, _, _, err := storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+		remotes[o.upperPath(id)] = info
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return remotes, nil
+}
+
+// detachMounts lazily unmounts all mounts under the directory. Nested mounts are
+// unmounted first.
+func detachMounts(ctx context.Context, dir string) (unmounted []string) {
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(dir))
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to get mounts")
+		return nil
+	}
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	for _, m := range mounts {
+		if err := syscall.Unmount(m.Mountpoint, syscall.MNT_DETACH); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", m.Mountpoint).Warn("failed to unmount")
+			continue
+		}
+		unmounted = append(unmounted, m.Mountpoint)
+	}
+	return unmounted
+}
+
+// mountProber checks if FUSE mounts are alive. The zero value is ready to use.
+type mountProber struct {
+	// inFlight is the mountpoints being checked. The check of a mount whose FUSE
+	// server is hanging never returns so it's never started again for the mount.
+	inFlight map[string]struct{}
+	mu       sync.Mutex
+
+	// timeout and statfs are used for tests. Zero values mean the defaults.
+	timeout time.Duration
+	statfs  func(mountpoint string) error
+}
+
+// isAlive returns false if the FUSE server of the mount is dead. Mounts not
+// responding in time, including the ones still being checked by the previous
+// calls, are assumed to be alive.
+func (p *mountProber) isAlive(mountpoint string) bool {
+	p.mu.Lock()
+	if _, ok := p.inFlight[mountpoint]; ok {
+		p.mu.Unlock()
+		return true
+	}
+	if p.inFlight == nil {
+		p.inFlight = make(map[string]struct{})
+	}
+	p.inFlight[mountpoint] = struct{}{}
+	p.mu.Unlock()
+
+	statfs, timeout := p.statfs, p.timeout
+	if statfs == nil {
+		statfs = func(mountpoint string) error {
+			var st syscall.Statfs_t
+			return syscall.Statfs(mountpoint, &st)
+		}
+	}
+	if timeout == 0 {
+		timeout = statMountTimeout
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		err := statfs(mountpoint)
+		p.mu.Lock()
+		delete(p.inFlight, mountpoint)
+		p.mu.Unlock()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return !errors.Is(err, syscall.ENOTCONN)
+	case <-time.After(timeout):
+		return true
+	}
+}
@@ -18,10 +18,12 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/containerd/containerd/errdefs"
@@ -32,6 +34,8 @@ import (
 	"github.com/containerd/continuity/fs"
 	"github.com/containerd/stargz-snapshotter/snapshot/overlayutils"
 	"github.com/moby/sys/mountinfo"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
@@ -69,6 +73,31 @@ type FileSystem interface {
 	Unmount(ctx context.Context, mountpoint string) error
 }
 
+// Unpacker can be implemented by a FileSystem which can unpack layers that fail
+// to be mounted (e.g. non-eStargz layers) by itself.
+//
+// Unpack() fetches the layer specified by the labels and applies it to the mounts
+// of the snapshot. The digest of the uncompressed layer (diffID) must be returned.
+// If this returns an error wrapping errdefs.ErrNotImplemented, the snapshotter
+// assumes nothing is applied. Otherwise, if Unpack() fails, the applied contents
+// are cleaned up and containerd falls back to unpacking the layer.
+type Unpacker interface {
+	Unpack(ctx context.Context, mounts []mount.Mount, labels map[string]string) (ocispec.Descriptor, error)
+}
+
+// UsageReporter can be implemented by a FileSystem to report the local disk usage
+// (e.g. caches) of the remote snapshot mounted at the mountpoint. This is reported
+// as the usage of the committed remote snapshot instead of the usage recorded at
+// the commit, which doesn't include contents fetched after the mount.
+type UsageReporter interface {
+	Usage(ctx context.Context, mountpoint string) (snapshots.Usage, error)
+}
+
+// ErrRejected can be returned (possibly wrapped) by FileSystem.Mount when the
+// layer must not be used at all. In this case, Prepare fails instead of falling
+// back to a local snapshot.
+var ErrRejected = errors.New("layer is rejected")
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove bool
@@ -101,6 +130,10 @@ type snapshotter struct {
 	fs        FileSystem
 	userxattr bool // whether to enable "userxattr" mount option
 	noRestore bool
+
+	idMappedMu sync.Mutex // serializes mounting ID-mapped views of remote snapshots
+
+	mountProber mountProber // checks FUSE mounts found by CleanupOrphans
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -155,6 +188,11 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
 		return nil, fmt.Errorf("failed to restore remote snapshot: %w", err)
 	}
+	if res, err := o.CleanupOrphans(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to clean up orphans")
+	} else if len(res.Removed) > 0 {
+		log.G(ctx).Infof("removed orphaned snapshot directories %v", res.Removed)
+	}
 
 	return o, nil
 }
@@ -227,6 +265,16 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 		}
 
 		usage = snapshots.Usage(du)
+	} else if _, ok := info.Labels[remoteLabel]; ok {
+		if r, ok := o.fs.(UsageReporter); ok {
+			ru, err := r.Usage(ctx, upperPath)
+			if err != nil {
+				// The layer can be unmounted in the meantime (e.g. removed).
+				log.G(ctx).WithError(err).WithField("key", key).Debug("failed to get usage of remote snapshot")
+			} else {
+				usage = ru
+			}
+		}
 	}
 
 	return usage, nil
@@ -252,9 +300,24 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		//       or not, using the key `remoteSnapshotLogKey` defined in the above. This
 		//       log is used by tests in this project.
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("parent", parent))
-		if err := o.prepareRemoteSnapshot(lCtx, key, base.Labels); err != nil {
+		if err := o.prepareRemoteSnapshot(lCtx, key, base.Labels); errors.Is(err, ErrRejected) {
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
+				WithError(err).Warn("layer is rejected; refusing to prepare snapshot")
+			if rErr := o.Remove(ctx, key); rErr != nil {
+				log.G(lCtx).WithError(rErr).Warn("failed to remove rejected snapshot")
+			}
+			return nil, err
+		} else if err != nil {
 			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
 				WithError(err).Warn("failed to prepare remote snapshot")
+			if u, ok := o.fs.(Unpacker); ok {
+				unpacked, err := o.unpackSnapshot(lCtx, u, key, parent, target, s, base.Labels, opts)
+				if err != nil {
+					return nil, err
+				} else if unpacked {
+					return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+				}
+			}
 		} else {
 			base.Labels[remoteLabel] = remoteLabelVal // Mark this snapshot as remote
 			err := o.commit(ctx, true, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
@@ -270,7 +333,7 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 			return nil, err
 		}
 	}
-	return o.mounts(ctx, s, parent)
+	return o.mounts(ctx, key, s, parent)
 }
 
 func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
@@ -278,7 +341,7 @@ func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snap
 	if err != nil {
 		return nil, err
 	}
-	return o.mounts(ctx, s, parent)
+	return o.mounts(ctx, key, s, parent)
 }
 
 // Mounts returns the mounts for the transaction identified by key. Can be
@@ -295,7 +358,7 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 	if err != nil {
 		return nil, fmt.Errorf("failed to get active mount: %w", err)
 	}
-	return o.mounts(ctx, s, key)
+	return o.mounts(ctx, key, s, key)
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
@@ -430,7 +493,7 @@ func (o *snapshotter) cleanupDirectories(ctx context.Context, cleanupCommitted b
 
 func (o *snapshotter) getCleanupDirectories(ctx context.Context, t storage.Transactor, cleanupCommitted bool) ([]string, error) {
 	ids, err := storage.IDMap(ctx)
-	if err != nil {
+	if err != nil && !errdefs.IsNotFound(err) { // not found if no snapshot has been created
 		return nil, err
 	}
 
@@ -469,6 +532,7 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	if err := o.fs.Unmount(ctx, mp); err != nil {
 		log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
 	}
+	o.unmountIDMapped(ctx, dir)
 	if err := os.RemoveAll(dir); err != nil {
 		return fmt.Errorf("failed to remove directory %q: %w", dir, err)
 	}
@@ -520,6 +584,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		return storage.Snapshot{}, fmt.Errorf("failed to create snapshot: %w", err)
 	}
 
+	uid, gid := -1, -1
 	if len(s.ParentIDs) > 0 {
 		st, err := os.Stat(o.upperPath(s.ParentIDs[0]))
 		if err != nil {
@@ -527,11 +592,27 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		}
 
 		stat := st.Sys().(*syscall.Stat_t)
-
-		if err := os.Lchown(filepath.Join(td, "fs"), int(stat.Uid), int(stat.Gid)); err != nil {
-			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
-			}
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return storage.Snapshot{}, err
+		}
+	}
+	// The root of ID-mapped snapshots is owned by the root of the user namespace.
+	if mapped, err := mappedRoot(base.Labels[LabelUIDMapping]); err != nil {
+		return storage.Snapshot{}, fmt.Errorf("invalid uid mapping: %w", err)
+	} else if mapped != -1 {
+		uid = mapped
+	}
+	if mapped, err := mappedRoot(base.Labels[LabelGIDMapping]); err != nil {
+		return storage.Snapshot{}, fmt.Errorf("invalid gid mapping: %w", err)
+	} else if mapped != -1 {
+		gid = mapped
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(filepath.Join(td, "fs"), uid, gid); err != nil {
 			return storage.Snapshot{}, fmt.Errorf("failed to chown: %w", err)
 		}
 	}
@@ -569,12 +650,25 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 	return td, nil
 }
 
-func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey string) ([]mount.Mount, error) {
+func (o *snapshotter) mounts(ctx context.Context, key string, s storage.Snapshot, checkKey string) ([]mount.Mount, error) {
 	// Make sure that all layers lower than the target layer are available
 	if checkKey != "" && !o.checkAvailability(ctx, checkKey) {
 		return nil, fmt.Errorf("layer %q unavailable: %w", s.ID, errdefs.ErrUnavailable)
 	}
 
+	parentPaths := make([]string, len(s.ParentIDs))
+	for i := range s.ParentIDs {
+		parentPaths[i] = o.upperPath(s.ParentIDs[i])
+	}
+	var idMapOptions []string
+	if len(s.ParentIDs) > 0 {
+		var err error
+		parentPaths, idMapOptions, err = o.idMappedLowers(ctx, key, s, parentPaths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if len(s.ParentIDs) == 0 {
 		// if we only have one layer/no parents then just return a bind mount as overlay
 		// will not work
@@ -604,25 +698,21 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	} else if len(s.ParentIDs) == 1 {
 		return []mount.Mount{
 			{
-				Source: o.upperPath(s.ParentIDs[0]),
+				Source: parentPaths[0],
 				Type:   "bind",
-				Options: []string{
+				Options: append([]string{
 					"ro",
 					"rbind",
-				},
+				}, idMapOptions...),
 			},
 		}, nil
 	}
 
-	parentPaths := make([]string, len(s.ParentIDs))
-	for i := range s.ParentIDs {
-		parentPaths[i] = o.upperPath(s.ParentIDs[i])
-	}
-
 	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
 	if o.userxattr {
 		options = append(options, "userxattr")
 	}
+	options = append(options, idMapOptions...)
 	return []mount.Mount{
 		{
 			Type:    "overlay",
@@ -671,6 +761,60 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 	return o.fs.Mount(ctx, mountpoint, labels)
 }
 
+// unpackSnapshot lets the filesystem unpack the layer to the active snapshot and
+// commits it as a normal snapshot. This returns false if the layer isn't unpacked
+// and containerd can fall back to unpacking the layer. The unpacked layer must
+// match the chain ID of the target.
+func (o *snapshotter) unpackSnapshot(ctx context.Context, u Unpacker, key, parent, target string, s storage.Snapshot, labels map[string]string, opts []snapshots.Opt) (bool, error) {
+	mounts, err := o.mounts(ctx, key, s, parent)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get mounts for unpacking layer")
+		return false, nil
+	}
+	diff, err := u.Unpack(ctx, mounts, labels)
+	if errdefs.IsNotImplemented(err) {
+		return false, nil // nothing is unpacked
+	}
+	if err == nil {
+		chainID := diff.Digest
+		if parent != "" {
+			chainID = digest.FromString(parent + " " + diff.Digest.String())
+		}
+		if chainID.String() != target {
+			err = fmt.Errorf("unpacked layer (diffID %v) doesn't match the target %q", diff.Digest, target)
+		}
+	}
+	if err == nil {
+		err = o.commit(ctx, false, target, key, opts...)
+		if err == nil || errdefs.IsAlreadyExists(err) {
+			log.G(ctx).WithField("diffID", diff.Digest).Info("unpacked layer")
+			return true, nil
+		}
+		// Don't fallback here because the snapshot may have been committed.
+		return false, fmt.Errorf("failed to commit unpacked snapshot: %w", err)
+	}
+	log.G(ctx).WithError(err).Warn("failed to unpack layer")
+
+	// Let containerd unpack the layer to a clean directory.
+	if rErr := removeContents(o.upperPath(s.ID)); rErr != nil {
+		return false, fmt.Errorf("failed to clean up the snapshot after unpack failure: %v: %w", err, rErr)
+	}
+	return false, nil
+}
+
+func removeContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // checkAvailability checks avaiability of the specified layer and all lower
 // layers using filesystem's checking functionality.
 func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
@@ -19,11 +19,14 @@ package snapshot
 import (
 	"context"
 	_ "crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/mount"
@@ -31,6 +34,8 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -102,6 +107,357 @@ func TestRemotePrepare(t *testing.T) {
 	}
 }
 
+func TestRemoteUsage(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	want := snapshots.Usage{Size: 4096, Inodes: 2}
+	ufs := &usageFs{bindFs: bindFileSystem(t).(*bindFs), usage: want}
+	sn, err := NewSnapshotter(context.TODO(), root, ufs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+
+	// The usage of the remote snapshot is reported by the filesystem.
+	u, err := sn.Usage(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if u != want {
+		t.Errorf("usage = %+v; want %+v", u, want)
+	}
+	if len(ufs.queried) != 1 || ufs.mounted[ufs.queried[0]] == nil {
+		t.Errorf("usage must be queried with the mountpoint of the snapshot; got %v", ufs.queried)
+	}
+
+	// Normal snapshots aren't reported by the filesystem.
+	key := "/tmp/prepareActive"
+	mounts, err := sn.Prepare(ctx, key, target)
+	if err != nil {
+		t.Fatalf("failed to prepare active snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, key)
+	if len(mounts) != 1 {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+	ufs.queried = nil
+	if _, err := sn.Usage(ctx, key); err != nil {
+		t.Fatalf("failed to get usage of active snapshot: %v", err)
+	}
+	if len(ufs.queried) != 0 {
+		t.Errorf("usage of the active snapshot must not be queried to the filesystem")
+	}
+}
+
+func TestRemotePrepareRejected(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, rejectFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Rejected layers must not fall back to local snapshots.
+	key := "/tmp/prepareRejected"
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: "testTarget",
+	})); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Prepare must fail with ErrRejected; got %v", err)
+	}
+	if _, err := sn.Stat(ctx, key); !errdefs.IsNotFound(err) {
+		t.Fatalf("rejected snapshot must be removed; got %v", err)
+	}
+}
+
+func TestRemotePrepareUnpack(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	diffID := digest.FromString("unpacked layer")
+	tests := []struct {
+		name     string
+		target   string
+		unpacked bool
+	}{
+		{name: "matching", target: diffID.String(), unpacked: true},
+		{name: "mismatching", target: digest.FromString("other layer").String(), unpacked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := os.MkdirTemp("", "overlay")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			sn, err := NewSnapshotter(context.TODO(), root, &unpackFs{diffID: diffID})
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			key := "/tmp/prepareUnpack"
+			mounts, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+				targetSnapshotLabel: tt.target,
+			}))
+			if !tt.unpacked {
+				if err != nil {
+					t.Fatalf("Prepare must fall back to a local snapshot; got %v", err)
+				}
+				if len(mounts) != 1 || mounts[0].Type != "bind" {
+					t.Fatalf("unexpected mounts %+v", mounts)
+				}
+				if entries, err := os.ReadDir(mounts[0].Source); err != nil || len(entries) != 0 {
+					t.Fatalf("snapshot must be clean after unpack failure; got %d entries: %v", len(entries), err)
+				}
+				return
+			}
+			if !errdefs.IsAlreadyExists(err) {
+				t.Fatalf("Prepare must fail with AlreadyExists; got %v", err)
+			}
+			info, err := sn.Stat(ctx, tt.target)
+			if err != nil {
+				t.Fatalf("failed to stat unpacked snapshot: %v", err)
+			}
+			if info.Kind != snapshots.KindCommitted {
+				t.Errorf("snapshot Kind is %q; want %q", info.Kind, snapshots.KindCommitted)
+			}
+			if _, ok := info.Labels[remoteLabel]; ok {
+				t.Errorf("unpacked snapshot must not be marked as remote")
+			}
+			if _, err := sn.Stat(ctx, key); !errdefs.IsNotFound(err) {
+				t.Errorf("active snapshot must be removed after unpack; got %v", err)
+			}
+			view := "/tmp/viewUnpack"
+			vMounts, err := sn.View(ctx, view, tt.target)
+			if err != nil {
+				t.Fatalf("failed to view unpacked snapshot: %v", err)
+			}
+			defer sn.Remove(ctx, view)
+			if len(vMounts) != 1 {
+				t.Fatalf("unexpected mounts %+v", vMounts)
+			}
+			data, err := os.ReadFile(filepath.Join(vMounts[0].Source, remoteSampleFile))
+			if err != nil || string(data) != remoteSampleFileContents {
+				t.Errorf("unexpected unpacked contents %q: %v", string(data), err)
+			}
+		})
+	}
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Orphaned directories left before the start are removed.
+	leftover := filepath.Join(root, "snapshots", "998")
+	if err := os.MkdirAll(filepath.Join(leftover, "fs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sn, err := NewSnapshotter(context.TODO(), root, dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("orphaned directory must be removed at startup: %v", err)
+	}
+
+	key := "/tmp/liveSnapshot"
+	mounts, err := sn.Prepare(ctx, key, "")
+	if err != nil {
+		t.Fatalf("failed to prepare snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, key)
+
+	// Emulate a mount left by a crash which isn't known to the filesystem.
+	orphan := filepath.Join(root, "snapshots", "999")
+	mp := filepath.Join(orphan, "fs")
+	if err := os.MkdirAll(mp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount(t.TempDir(), mp, "none", syscall.MS_BIND, ""); err != nil {
+		t.Fatalf("failed to bind mount: %v", err)
+	}
+	oc, ok := sn.(OrphanCleaner)
+	if !ok {
+		t.Fatalf("snapshotter must implement OrphanCleaner")
+	}
+	res, err := oc.CleanupOrphans(ctx)
+	if err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if len(res.Unmounted) != 1 || res.Unmounted[0] != mp {
+		t.Errorf("unmounted %v; want %v", res.Unmounted, []string{mp})
+	}
+	if len(res.Removed) != 1 || res.Removed[0] != orphan {
+		t.Errorf("removed %v; want %v", res.Removed, []string{orphan})
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned directory must be removed: %v", err)
+	}
+	if _, err := os.Stat(mounts[0].Source); err != nil {
+		t.Errorf("directory of the live snapshot must not be removed: %v", err)
+	}
+}
+
+func TestMountProber(t *testing.T) {
+	var (
+		calls   = make(map[string]int)
+		callsMu sync.Mutex
+		hanging = make(chan struct{})
+	)
+	p := &mountProber{
+		timeout: 10 * time.Millisecond,
+		statfs: func(mountpoint string) error {
+			callsMu.Lock()
+			calls[mountpoint]++
+			callsMu.Unlock()
+			if mountpoint == "hanging" {
+				<-hanging
+			}
+			return syscall.ENOTCONN
+		},
+	}
+	getCalls := func(mountpoint string) int {
+		callsMu.Lock()
+		defer callsMu.Unlock()
+		return calls[mountpoint]
+	}
+
+	if p.isAlive("dead") {
+		t.Errorf("mount must be dead")
+	}
+	for i := 0; i < 3; i++ {
+		if !p.isAlive("hanging") {
+			t.Errorf("hanging mount must be assumed to be alive")
+		}
+	}
+	if n := getCalls("hanging"); n != 1 {
+		t.Errorf("hanging mount must not be checked again while the check is in flight; checked %d times", n)
+	}
+
+	// The mount is checked again once the previous check returns.
+	close(hanging)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.isAlive("hanging") {
+		if time.Now().After(deadline) {
+			t.Fatalf("mount must be checked again after the previous check returns")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := getCalls("hanging"); n != 2 {
+		t.Errorf("mount must be checked again once; checked %d times", n)
+	}
+}
+
+func TestIDMapped(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	bfs := bindFileSystem(t).(*bindFs)
+	sn, err := NewSnapshotter(context.TODO(), root, bfs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	idMapLabels := snapshots.WithLabels(map[string]string{
+		LabelUIDMapping: "0:1000:65536",
+		LabelGIDMapping: "0:2000:65536",
+	})
+
+	// ID-mapped snapshot on remote snapshots uses ID-mapped views of them.
+	lower := prepareWithTarget(t, sn, "lowerTarget", "/tmp/prepareLower", "", nil)
+	upper := prepareWithTarget(t, sn, "upperTarget", "/tmp/prepareUpper", lower, nil)
+	remoteKey := "/tmp/idmappedRemote"
+	mounts, err := sn.Prepare(ctx, remoteKey, upper, idMapLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := getBasePath(ctx, sn, root, remoteKey)
+	views := []string{filepath.Join(bp, idMappedDir, "0"), filepath.Join(bp, idMappedDir, "1")}
+	wantOptions := []string{
+		"workdir=" + filepath.Join(bp, "work"),
+		"upperdir=" + filepath.Join(bp, "fs"),
+		"lowerdir=" + views[0] + ":" + views[1],
+	}
+	if fmt.Sprint(mounts[0].Options) != fmt.Sprint(wantOptions) {
+		t.Errorf("options = %v; want %v", mounts[0].Options, wantOptions)
+	}
+	for i, target := range []string{upper, lower} {
+		labels, ok := bfs.mounted[views[i]]
+		if !ok {
+			t.Fatalf("ID-mapped view %q isn't mounted", views[i])
+		}
+		if labels[targetSnapshotLabel] != target || labels[LabelUIDMapping] != "0:1000:65536" || labels[LabelGIDMapping] != "0:2000:65536" {
+			t.Errorf("unexpected labels of ID-mapped view of %q: %v", target, labels)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(bp, "fs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 2000 {
+		t.Errorf("upper directory is owned by %d:%d; want 1000:2000", st.Uid, st.Gid)
+	}
+	if _, err := sn.Mounts(ctx, remoteKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Remove(ctx, remoteKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.(snapshots.Cleaner).Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range views {
+		if _, ok := bfs.mounted[v]; ok {
+			t.Errorf("ID-mapped view %q must be unmounted", v)
+		}
+	}
+
+	// ID-mapped snapshot on normal snapshots is ID-mapped by containerd.
+	if _, err := sn.Prepare(ctx, "/tmp/localActive", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "/tmp/local", "/tmp/localActive"); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err = sn.Prepare(ctx, "/tmp/idmappedLocal", "/tmp/local", idMapLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := mounts[0].Options
+	if len(opts) < 2 || opts[len(opts)-2] != "uidmap=0:1000:65536" || opts[len(opts)-1] != "gidmap=0:2000:65536" {
+		t.Errorf("ID-mapping options must be specified: %v", opts)
+	}
+
+	// Mixing remote and normal snapshots isn't supported.
+	if _, err := sn.Prepare(ctx, "/tmp/mixedActive", upper); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "/tmp/mixed", "/tmp/mixedActive"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.Prepare(ctx, "/tmp/idmappedMixed", "/tmp/mixed", idMapLabels); !errdefs.IsNotImplemented(err) {
+		t.Errorf("ID-mapped snapshot on mixed snapshots must fail; got %v", err)
+	}
+}
+
 func TestRemoteOverlay(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -382,9 +738,10 @@ func bindFileSystem(t *testing.T) FileSystem {
 		t.Fatalf("failed to write sample file of bind filesystem: %q", err)
 	}
 	return &bindFs{
-		root:   root,
-		t:      t,
-		broken: make(map[string]bool),
+		root:    root,
+		t:       t,
+		broken:  make(map[string]bool),
+		mounted: make(map[string]map[string]string),
 	}
 }
 
@@ -393,12 +750,14 @@ type bindFs struct {
 	root         string
 	checkFailure bool
 	broken       map[string]bool
+	mounted      map[string]map[string]string // mountpoint -> labels
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
 	if _, ok := labels[brokenLabel]; ok {
 		fs.broken[mountpoint] = true
 	}
+	fs.mounted[mountpoint] = labels
 	if err := syscall.Mount(fs.root, mountpoint, "none", syscall.MS_BIND, ""); err != nil {
 		fs.t.Fatalf("failed to bind mount %q to %q: %v", fs.root, mountpoint, err)
 	}
@@ -415,9 +774,22 @@ func (fs *bindFs) Check(ctx context.Context, mountpoint string, labels map[strin
 }
 
 func (fs *bindFs) Unmount(ctx context.Context, mountpoint string) error {
+	delete(fs.mounted, mountpoint)
 	return syscall.Unmount(mountpoint, 0)
 }
 
+// usageFs reports the specified usage for all remote snapshots.
+type usageFs struct {
+	*bindFs
+	usage   snapshots.Usage
+	queried []string
+}
+
+func (fs *usageFs) Usage(ctx context.Context, mountpoint string) (snapshots.Usage, error) {
+	fs.queried = append(fs.queried, mountpoint)
+	return fs.usage, nil
+}
+
 func dummyFileSystem() FileSystem { return &dummyFs{} }
 
 type dummyFs struct{}
@@ -434,6 +806,30 @@ func (fs *dummyFs) Unmount(ctx context.Context, mountpoint string) error {
 	return fmt.Errorf("dummy")
 }
 
+// unpackFs fails to mount layers but unpacks them with the specified diffID.
+type unpackFs struct {
+	dummyFs
+	diffID digest.Digest
+}
+
+func (fs *unpackFs) Unpack(ctx context.Context, mounts []mount.Mount, labels map[string]string) (ocispec.Descriptor, error) {
+	if len(mounts) != 1 || mounts[0].Type != "bind" {
+		return ocispec.Descriptor{}, fmt.Errorf("unexpected mounts %+v", mounts)
+	}
+	if err := os.WriteFile(filepath.Join(mounts[0].Source, remoteSampleFile), []byte(remoteSampleFileContents), 0600); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: fs.diffID}, nil
+}
+
+func rejectFileSystem() FileSystem { return &rejectFs{} }
+
+type rejectFs struct{ dummyFs }
+
+func (fs *rejectFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fmt.Errorf("rejected by test: %w", ErrRejected)
+}
+
 // =============================================================================
 // Tests backword-comaptibility of overlayfs snapshotter.
 
@@ -58,13 +58,15 @@ const (
 
 func Mount(ctx context.Context, mountpoint string, layerManager *LayerManager, debug bool) error {
 	timeSec := time.Second
-	rawFS := fusefs.NewNodeFS(&rootnode{
-		fs: &fs{
-			layerManager: layerManager,
-			nodeMap:      new(idMap),
-			layerMap:     new(idMap),
-		},
-	}, &fusefs.Options{
+	sfs := &fs{
+		layerManager: layerManager,
+		nodeMap:      new(idMap),
+		layerMap:     new(idMap),
+	}
+	layerManager.setReleaseHook(func(refspec reference.Spec, dgst digest.Digest) {
+		sfs.forgetLayer(refspec, dgst)
+	})
+	rawFS := fusefs.NewNodeFS(&rootnode{fs: sfs}, &fusefs.Options{
 		AttrTimeout:     &timeSec,
 		EntryTimeout:    &timeSec,
 		NullPermissions: true,
@@ -105,6 +107,24 @@ type fs struct {
 	knownNodeMu sync.Mutex
 }
 
+// forgetLayer marks the root node of the layer as released so that the node is
+// removed once it's forgotten by the kernel. This returns false if the node of the
+// layer isn't registered.
+func (fs *fs) forgetLayer(refspec reference.Spec, dgst digest.Digest) bool {
+	fs.knownNodeMu.Lock()
+	defer fs.knownNodeMu.Unlock()
+	lh, ok := fs.knownNode[refspec.String()][dgst.String()]
+	if !ok {
+		return false
+	}
+	lh.release()
+	delete(fs.knownNode[refspec.String()], dgst.String())
+	if len(fs.knownNode[refspec.String()]) == 0 {
+		delete(fs.knownNode, refspec.String())
+	}
+	return true
+}
+
 type layerReleasable struct {
 	n        fusefs.InodeEmbedder
 	released bool
@@ -284,19 +304,10 @@ func (n *refnode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.EIO
 	}
 	if current == 0 {
-		n.fs.knownNodeMu.Lock()
-		lh, ok := n.fs.knownNode[n.ref.String()][targetDigest.String()]
-		if !ok {
-			n.fs.knownNodeMu.Unlock()
-			log.G(ctx).WithError(err).Warnf("node of layer %v/%v is not registered", n.ref, targetDigest)
+		if !n.fs.forgetLayer(n.ref, targetDigest) {
+			log.G(ctx).Warnf("node of layer %v/%v is not registered", n.ref, targetDigest)
 			return syscall.EIO
 		}
-		lh.release()
-		delete(n.fs.knownNode[n.ref.String()], targetDigest.String())
-		if len(n.fs.knownNode[n.ref.String()]) == 0 {
-			delete(n.fs.knownNode, n.ref.String())
-		}
-		n.fs.knownNodeMu.Unlock()
 	}
 	log.G(ctx).WithField("refcounter", current).Infof("layer %v/%v is marked as RELEASE", n.ref, targetDigest)
 	return syscall.ENOENT
@@ -405,7 +416,7 @@ func (n *layernode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 		var cn *fusefs.Inode
 		var errno syscall.Errno
 		err = n.fs.layerMap.add(func(id uint32) (releasable, error) {
-			root, err := l.RootNode(id)
+			root, err := l.RootNode(id, layer.IDMap{})
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,245 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultStorageDriver     = "overlay"
+	defaultUnusedLayerTTLSec = 600
+
+	// gcRetryInterval is the interval to check the configuration again when
+	// the periodic garbage collection is disabled.
+	gcRetryInterval = time.Minute
+)
+
+// GCConfig is the configuration of the garbage collection of layers.
+type GCConfig struct {
+	// IntervalSec is the interval of the periodic garbage collection.
+	// 0 disables the periodic garbage collection.
+	IntervalSec int64 `toml:"interval_sec"`
+
+	// UnusedLayerTTLSec is the duration after which layers that are looked up
+	// but not marked as "using" by containers/storage are released.
+	UnusedLayerTTLSec int64 `toml:"unused_layer_ttl_sec"`
+
+	// StorageRoot is the root directory of containers/storage (e.g. /var/lib/containers/storage).
+	// If specified, layers that are marked as "using" but aren't recorded in the layer store
+	// of containers/storage (e.g. their images were removed without releasing the layers)
+	// are also released.
+	StorageRoot string `toml:"storage_root"`
+
+	// StorageDriver is the storage driver of containers/storage. Default is "overlay".
+	StorageDriver string `toml:"storage_driver"`
+}
+
+// PrunedLayer is a layer released by the garbage collection.
+type PrunedLayer struct {
+	Reference string        `json:"reference"`
+	Digest    digest.Digest `json:"digest"`
+
+	// Reason is the reason why the layer is released.
+	Reason string `json:"reason"`
+}
+
+// PruneResult is the result of the garbage collection.
+type PruneResult struct {
+	// Layers are the released layers.
+	Layers []PrunedLayer `json:"layers"`
+
+	// Caches are the removed cache directories.
+	Caches []layer.CacheUsage `json:"caches"`
+}
+
+// SetGCConfig updates the configuration of the garbage collection.
+func (r *LayerManager) SetGCConfig(cfg GCConfig) {
+	r.mu.Lock()
+	r.gcConfig = cfg
+	r.mu.Unlock()
+	select {
+	case r.gcConfigChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (r *LayerManager) setReleaseHook(f func(reference.Spec, digest.Digest)) {
+	r.mu.Lock()
+	r.releaseHook = f
+	r.mu.Unlock()
+}
+
+// RunGC runs the garbage collection periodically until the context is canceled.
+func (r *LayerManager) RunGC(ctx context.Context) {
+	for {
+		r.mu.Lock()
+		interval := time.Duration(r.gcConfig.IntervalSec) * time.Second
+		r.mu.Unlock()
+		wait := interval
+		if wait <= 0 {
+			wait = gcRetryInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.gcConfigChanged:
+			continue
+		case <-ctx.Done():
+			return
+		}
+		if interval <= 0 {
+			continue
+		}
+		res, err := r.Prune(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to garbage collect layers")
+			continue
+		}
+		log.G(ctx).Debugf("garbage collected %d layers and %d caches", len(res.Layers), len(res.Caches))
+	}
+}
+
+// Prune releases layers that aren't used by containers/storage and removes caches
+// that aren't used by any layer. Caches of the released layers are removed by a
+// future call of Prune once they are evicted from the resolver.
+func (r *LayerManager) Prune(ctx context.Context) (PruneResult, error) {
+	r.mu.Lock()
+	cfg := r.gcConfig
+	r.mu.Unlock()
+
+	var referenced map[digest.Digest]struct{}
+	if cfg.StorageRoot != "" {
+		var err error
+		referenced, err = storageLayers(cfg.StorageRoot, cfg.StorageDriver)
+		if err != nil {
+			return PruneResult{}, fmt.Errorf("failed to get layers of containers/storage: %w", err)
+		}
+	}
+	ttl := time.Duration(cfg.UnusedLayerTTLSec) * time.Second
+	if ttl == 0 {
+		ttl = defaultUnusedLayerTTLSec * time.Second
+	}
+
+	var res PruneResult
+	var (
+		released []reference.Spec
+		forget   []func()
+	)
+	now := time.Now()
+	r.mu.Lock()
+	releaseHook := r.releaseHook
+	for ref, layers := range r.layer {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			r.mu.Unlock()
+			return PruneResult{}, fmt.Errorf("invalid reference %q: %w", ref, err)
+		}
+		for d, l := range layers {
+			dgst := digest.Digest(d)
+			var reason string
+			if count := r.refcounter[ref][d]; count > 0 {
+				if referenced == nil {
+					continue
+				}
+				if _, ok := referenced[dgst]; ok {
+					continue
+				}
+				reason = "not found in containers/storage"
+				for i := 0; i < count; i++ {
+					released = append(released, refspec)
+				}
+				delete(r.refcounter[ref], d)
+				if len(r.refcounter[ref]) == 0 {
+					delete(r.refcounter, ref)
+				}
+			} else {
+				if now.Sub(r.resolvedAt[layerKey(refspec, dgst)]) < ttl {
+					continue
+				}
+				reason = "not used"
+			}
+			r.removeLayerLocked(refspec, dgst, l)
+			forget = append(forget, func() {
+				if releaseHook != nil {
+					releaseHook(refspec, dgst)
+				}
+			})
+			res.Layers = append(res.Layers, PrunedLayer{Reference: ref, Digest: dgst, Reason: reason})
+			log.G(ctx).Infof("layer %v/%v is released by garbage collection (%s)", ref, dgst, reason)
+		}
+	}
+	r.mu.Unlock()
+	for _, f := range forget {
+		f()
+	}
+	for _, refspec := range released {
+		r.refPool.release(refspec)
+	}
+
+	caches, err := r.PruneCache(ctx, nil)
+	res.Caches = caches
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// CacheUsage returns the disk usage of the layer caches.
+func (r *LayerManager) CacheUsage(ctx context.Context) ([]layer.CacheUsage, error) {
+	return r.currentConfig().resolver.CacheUsage()
+}
+
+// PruneCache removes layer caches which aren't used by any layer and match the filter.
+func (r *LayerManager) PruneCache(ctx context.Context, filter func(layer.CacheUsage) bool) ([]layer.CacheUsage, error) {
+	return r.currentConfig().resolver.PruneCache(filter)
+}
+
+// storageLayers returns the compressed digests of layers recorded in the layer store
+// of containers/storage.
+func storageLayers(root, driver string) (map[digest.Digest]struct{}, error) {
+	if driver == "" {
+		driver = defaultStorageDriver
+	}
+	f, err := os.Open(filepath.Join(root, driver+"-layers", "layers.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var layers []struct {
+		CompressedDigest digest.Digest `json:"compressed-diff-digest,omitempty"`
+	}
+	if err := json.NewDecoder(f).Decode(&layers); err != nil {
+		return nil, err
+	}
+	res := make(map[digest.Digest]struct{}, len(layers))
+	for _, l := range layers {
+		if l.CompressedDigest != "" {
+			res[l.CompressedDigest] = struct{}{}
+		}
+	}
+	return res, nil
+}
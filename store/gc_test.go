@@ -0,0 +1,293 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const testLayersJSON = `[
+  {"id": "a", "compressed-diff-digest": "sha256:aaaa"},
+  {"id": "b"},
+  {"id": "c", "compressed-diff-digest": "sha256:cccc"}
+]`
+
+func TestStorageLayers(t *testing.T) {
+	root := t.TempDir()
+	for _, driver := range []string{"overlay", "vfs"} {
+		if err := os.MkdirAll(filepath.Join(root, driver+"-layers"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "overlay-layers", "layers.json"), []byte(testLayersJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "vfs-layers", "layers.json"), []byte(`[{"compressed-diff-digest": "sha256:dddd"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		driver  string
+		want    []digest.Digest
+		wantErr bool
+	}{
+		{driver: "", want: []digest.Digest{"sha256:aaaa", "sha256:cccc"}},
+		{driver: "overlay", want: []digest.Digest{"sha256:aaaa", "sha256:cccc"}},
+		{driver: "vfs", want: []digest.Digest{"sha256:dddd"}},
+		{driver: "btrfs", wantErr: true},
+	} {
+		got, err := storageLayers(root, tt.driver)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("driver %q: must fail without layers.json", tt.driver)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("driver %q: failed to get layers: %v", tt.driver, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("driver %q: got layers %v; want %v", tt.driver, got, tt.want)
+		}
+		for _, d := range tt.want {
+			if _, ok := got[d]; !ok {
+				t.Errorf("driver %q: layer %v not found in %v", tt.driver, d, got)
+			}
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	storageRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(storageRoot, "overlay-layers"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(storageRoot, "overlay-layers", "layers.json"), []byte(testLayersJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		usedInStorage    = digest.Digest("sha256:aaaa")
+		usedNotInStorage = digest.Digest("sha256:bbbb")
+		unusedOld        = digest.Digest("sha256:cccc")
+		unusedRecent     = digest.Digest("sha256:dddd")
+	)
+	for _, tt := range []struct {
+		name        string
+		cfg         GCConfig
+		wantRemoved map[digest.Digest]string // reasons of the removed layers
+	}{
+		{
+			name: "without_storage",
+			cfg:  GCConfig{UnusedLayerTTLSec: 60},
+			wantRemoved: map[digest.Digest]string{
+				unusedOld: "not used",
+			},
+		},
+		{
+			name: "with_storage",
+			cfg:  GCConfig{UnusedLayerTTLSec: 60, StorageRoot: storageRoot},
+			wantRemoved: map[digest.Digest]string{
+				usedNotInStorage: "not found in containers/storage",
+				unusedOld:        "not used",
+			},
+		},
+		{
+			name: "default_ttl",
+			cfg:  GCConfig{},
+			wantRemoved: map[digest.Digest]string{
+				unusedOld: "not used",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			r := newTestGCManager(t)
+			refspec, err := reference.Parse("example.com/test/image:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers := make(map[digest.Digest]*testLayer)
+			for _, d := range []digest.Digest{usedInStorage, usedNotInStorage, unusedOld, unusedRecent} {
+				layers[d] = &testLayer{}
+				r.cacheLayer(refspec, d, layers[d])
+			}
+			r.use(refspec, usedInStorage)
+			r.use(refspec, usedNotInStorage)
+			r.resolvedAt[layerKey(refspec, unusedOld)] = time.Now().Add(-time.Hour)
+			var hooked []digest.Digest
+			r.setReleaseHook(func(_ reference.Spec, dgst digest.Digest) {
+				hooked = append(hooked, dgst)
+			})
+			r.SetGCConfig(tt.cfg)
+
+			res, err := r.Prune(ctx)
+			if err != nil {
+				t.Fatalf("failed to prune: %v", err)
+			}
+			if len(res.Layers) != len(tt.wantRemoved) {
+				t.Errorf("pruned %+v; want %v", res.Layers, tt.wantRemoved)
+			}
+			for _, pl := range res.Layers {
+				if reason, ok := tt.wantRemoved[pl.Digest]; !ok || pl.Reason != reason {
+					t.Errorf("unexpected pruned layer %+v; want %v", pl, tt.wantRemoved)
+				}
+				if pl.Reference != refspec.String() {
+					t.Errorf("reference of pruned layer %q; want %q", pl.Reference, refspec.String())
+				}
+			}
+			if len(hooked) != len(tt.wantRemoved) {
+				t.Errorf("release hook called for %v; want %v", hooked, tt.wantRemoved)
+			}
+			for d, l := range layers {
+				_, removed := tt.wantRemoved[d]
+				if removed != (l.done == 1) {
+					t.Errorf("layer %v: done %d times; removed = %v", d, l.done, removed)
+				}
+				if cached := r.getCachedLayer(refspec, d) != nil; cached == removed {
+					t.Errorf("layer %v: cached = %v; removed = %v", d, cached, removed)
+				}
+			}
+			if _, removed := tt.wantRemoved[usedNotInStorage]; removed {
+				if _, ok := r.refcounter[refspec.String()][usedNotInStorage.String()]; ok {
+					t.Errorf("refcount of the released layer must be removed")
+				}
+				if n := r.refPool.refcounter[refspec.String()].count; n != 1 {
+					t.Errorf("ref must be released once by the released layer; count = %d", n)
+				}
+			}
+
+			// Layers kept must survive another run
+			res, err = r.Prune(ctx)
+			if err != nil {
+				t.Fatalf("failed to prune again: %v", err)
+			}
+			if len(res.Layers) != 0 {
+				t.Errorf("kept layers must not be pruned again; pruned %+v", res.Layers)
+			}
+		})
+	}
+}
+
+func TestPruneMissingStorage(t *testing.T) {
+	r := newTestGCManager(t)
+	refspec, err := reference.Parse("example.com/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testLayer{}
+	r.cacheLayer(refspec, "sha256:aaaa", l)
+	r.use(refspec, "sha256:aaaa")
+	r.SetGCConfig(GCConfig{StorageRoot: t.TempDir()})
+	if _, err := r.Prune(context.Background()); err == nil {
+		t.Errorf("prune must fail without the layer store of containers/storage")
+	}
+	if l.done != 0 || r.getCachedLayer(refspec, "sha256:aaaa") == nil {
+		t.Errorf("layers must be kept on failure")
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	r := newTestGCManager(t)
+	refspec, err := reference.Parse("example.com/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.cacheLayer(refspec, "sha256:aaaa", &testLayer{})
+	r.cacheLayer(refspec, "sha256:bbbb", &testLayer{})
+	r.use(refspec, "sha256:bbbb")
+	r.resolvedAt[layerKey(refspec, "sha256:aaaa")] = time.Now().Add(-time.Hour)
+	released := make(chan digest.Digest, 2)
+	r.setReleaseHook(func(_ reference.Spec, dgst digest.Digest) {
+		released <- dgst
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.RunGC(ctx)
+		close(done)
+	}()
+
+	// The periodic GC is disabled by default
+	select {
+	case d := <-released:
+		t.Fatalf("layer %v must not be released while GC is disabled", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Enabling it takes effect without waiting for the retry interval
+	r.SetGCConfig(GCConfig{IntervalSec: 1, UnusedLayerTTLSec: 60})
+	select {
+	case d := <-released:
+		if d != "sha256:aaaa" {
+			t.Errorf("released %v; want %v", d, "sha256:aaaa")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unused layer must be released by the periodic GC")
+	}
+	var kept []string
+	r.mu.Lock()
+	for d := range r.layer[refspec.String()] {
+		kept = append(kept, d)
+	}
+	r.mu.Unlock()
+	sort.Strings(kept)
+	if len(kept) != 1 || kept[0] != "sha256:bbbb" {
+		t.Errorf("kept layers %v; want [sha256:bbbb]", kept)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunGC must return when the context is canceled")
+	}
+}
+
+func newTestGCManager(t *testing.T) *LayerManager {
+	hosts := source.RegistryHosts(nil)
+	refPool, err := newRefPool(context.Background(), t.TempDir(), hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LayerManager{
+		refPool:           refPool,
+		metricsController: layermetrics.NewLayerMetrics(nil),
+		config:            &layerConfig{hosts: hosts, resolver: &testResolver{}},
+		resolvedAt:        make(map[string]time.Time),
+		gcConfigChanged:   make(chan struct{}, 1),
+	}
+}
+
+type testLayer struct {
+	layer.Layer
+	done int
+}
+
+func (l *testLayer) Done() { l.done++ }
@@ -30,6 +30,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
@@ -38,6 +39,8 @@ import (
 	"github.com/docker/go-metrics"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -48,7 +51,25 @@ const (
 	defaultMaxConcurrency = 2
 )
 
-func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHosts, metadataStore metadata.Store, cfg config.Config) (*LayerManager, error) {
+type Option func(*options)
+
+type options struct {
+	metricsLogLevel *logrus.Level
+}
+
+// WithMetricsLogLevel specifies the log level of the common metrics. Default is
+// logrus.DebugLevel.
+func WithMetricsLogLevel(logLevel logrus.Level) Option {
+	return func(opts *options) {
+		opts.metricsLogLevel = &logLevel
+	}
+}
+
+func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHosts, metadataStore metadata.Store, cfg config.Config, opts ...Option) (*LayerManager, error) {
+	var lmOpts options
+	for _, o := range opts {
+		o(&lmOpts)
+	}
 	refPool, err := newRefPool(ctx, root, hosts)
 	if err != nil {
 		return nil, err
@@ -58,56 +79,138 @@ func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHost
 		maxConcurrency = defaultMaxConcurrency
 	}
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
-	r, err := layer.NewResolver(root, tm, cfg, nil, metadataStore, layer.OverlayOpaqueAll) // TODO: support IPFS
-	if err != nil {
-		return nil, fmt.Errorf("failed to setup resolver: %w", err)
+	var resolveSem *semaphore.Weighted
+	if cfg.MaxResolveConcurrency > 0 {
+		resolveSem = semaphore.NewWeighted(cfg.MaxResolveConcurrency)
 	}
 	var ns *metrics.Namespace
 	if !cfg.NoPrometheus {
 		ns = metrics.NewNamespace("stargz", "fs", nil)
+		logLevel := logrus.DebugLevel
+		if lmOpts.metricsLogLevel != nil {
+			logLevel = *lmOpts.metricsLogLevel
+		}
+		commonmetrics.Register(logLevel) // Register common metrics. This will happen only once.
 	}
 	c := layermetrics.NewLayerMetrics(ns)
 	if ns != nil {
 		metrics.Register(ns)
 	}
-	return &LayerManager{
+	r := &LayerManager{
+		root:                  root,
 		refPool:               refPool,
-		hosts:                 hosts,
-		resolver:              r,
-		prefetchSize:          cfg.PrefetchSize,
-		noprefetch:            cfg.NoPrefetch,
-		noBackgroundFetch:     cfg.NoBackgroundFetch,
+		metadataStore:         metadataStore,
 		backgroundTaskManager: tm,
-		allowNoVerification:   cfg.AllowNoVerification,
-		disableVerification:   cfg.DisableVerification,
 		metricsController:     c,
 		resolveLock:           new(namedmutex.NamedMutex),
+		resolveSem:            resolveSem,
 		layer:                 make(map[string]map[string]layer.Layer),
 		refcounter:            make(map[string]map[string]int),
-	}, nil
+		resolvedAt:            make(map[string]time.Time),
+		gcConfigChanged:       make(chan struct{}, 1),
+		newResolver: func(cfg config.Config) (layerResolver, error) {
+			return layer.NewResolver(root, tm, cfg, nil, metadataStore, layer.OverlayOpaqueAll) // TODO: support IPFS
+		},
+	}
+	if err := r.Reload(ctx, hosts, cfg); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // LayerManager manages layers of images and their resource lifetime.
 type LayerManager struct {
-	refPool *refPool
-	hosts   source.RegistryHosts
+	root          string
+	refPool       *refPool
+	metadataStore metadata.Store
 
-	resolver              *layer.Resolver
-	prefetchSize          int64
-	noprefetch            bool
-	noBackgroundFetch     bool
 	backgroundTaskManager *task.BackgroundTaskManager
-	allowNoVerification   bool
-	disableVerification   bool
 	metricsController     *layermetrics.Controller
 	resolveLock           *namedmutex.NamedMutex
+	resolveSem            *semaphore.Weighted // limits layers resolved in background; nil if unlimited
+
+	// config is the configuration used for resolving new layers.
+	config   *layerConfig
+	configMu sync.Mutex
+
+	// newResolver creates the resolver of layers on each Reload.
+	newResolver func(cfg config.Config) (layerResolver, error)
 
 	layer      map[string]map[string]layer.Layer
 	refcounter map[string]map[string]int
 
+	// resolvedAt records when each layer is resolved. This is keyed by the
+	// reference and the digest of the layer.
+	resolvedAt map[string]time.Time
+
+	// releaseHook is called when a layer is released by the garbage collection.
+	releaseHook func(reference.Spec, digest.Digest)
+
+	gcConfig        GCConfig
+	gcConfigChanged chan struct{}
+
 	mu sync.Mutex
 }
 
+// layerConfig is the configuration of LayerManager that can be updated by Reload.
+type layerConfig struct {
+	hosts               source.RegistryHosts
+	resolver            layerResolver
+	prefetchSize        int64
+	noprefetch          bool
+	noBackgroundFetch   bool
+	allowNoVerification bool
+	disableVerification bool
+}
+
+// layerResolver resolves layers and manages their caches. This is implemented by *layer.Resolver.
+type layerResolver interface {
+	Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, esgzOpts ...metadata.Option) (layer.Layer, error)
+	CacheUsage() ([]layer.CacheUsage, error)
+	PruneCache(filter func(layer.CacheUsage) bool) ([]layer.CacheUsage, error)
+	Close() error
+}
+
+// Reload updates the registry hosts and the configuration used for resolving layers.
+// The new configuration is applied only to layers resolved after this call. Layers
+// that are already resolved (including the mounted ones) keep using the configuration
+// with which they were resolved. The resolver of the previous configuration is closed
+// so the layers and blobs cached by it are closed once they are released.
+//
+// MaxConcurrency, MaxResolveConcurrency, NoPrometheus and the metadata store can't be changed by Reload. The
+// values passed to NewLayerManager are kept.
+func (r *LayerManager) Reload(ctx context.Context, hosts source.RegistryHosts, cfg config.Config) error {
+	res, err := r.newResolver(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to setup resolver: %w", err)
+	}
+	r.refPool.setHosts(hosts)
+	r.configMu.Lock()
+	old := r.config
+	r.config = &layerConfig{
+		hosts:               hosts,
+		resolver:            res,
+		prefetchSize:        cfg.PrefetchSize,
+		noprefetch:          cfg.NoPrefetch,
+		noBackgroundFetch:   cfg.NoBackgroundFetch,
+		allowNoVerification: cfg.AllowNoVerification,
+		disableVerification: cfg.DisableVerification,
+	}
+	r.configMu.Unlock()
+	if old != nil {
+		if err := old.resolver.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close the old resolver")
+		}
+	}
+	return nil
+}
+
+func (r *LayerManager) currentConfig() *layerConfig {
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+	return r.config
+}
+
 func (r *LayerManager) cacheLayer(refspec reference.Spec, dgst digest.Digest, l layer.Layer) (_ layer.Layer, added bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -121,6 +224,7 @@ func (r *LayerManager) cacheLayer(refspec reference.Spec, dgst digest.Digest, l
 		return cl, false // already exists
 	}
 	r.layer[refspec.String()][dgst.String()] = l
+	r.resolvedAt[layerKey(refspec, dgst)] = time.Now()
 	return l, true
 }
 
@@ -193,10 +297,18 @@ func (r *LayerManager) getLayer(ctx context.Context, refspec reference.Spec, dgs
 		go func() {
 			// Avoids to get canceled by client.
 			ctx := context.Background()
-			gotL, err := r.resolveLayer(ctx, refspec, l)
 			if l.Digest.String() != target.Digest.String() {
-				return // This is not target layer
+				// This is not target layer
+				if r.resolveSem != nil {
+					if err := r.resolveSem.Acquire(ctx, 1); err != nil {
+						return
+					}
+					defer r.resolveSem.Release(1)
+				}
+				r.resolveLayer(ctx, refspec, l)
+				return
 			}
+			gotL, err := r.resolveLayer(ctx, refspec, l)
 			if err != nil {
 				errChan <- fmt.Errorf("failed to resolve layer %q / %q: %w", refspec, l.Digest, err)
 				return
@@ -227,7 +339,7 @@ func (r *LayerManager) getLayer(ctx context.Context, refspec reference.Spec, dgs
 }
 
 func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec, target ocispec.Descriptor) (layer.Layer, error) {
-	key := refspec.String() + "/" + target.Digest.String()
+	key := layerKey(refspec, target.Digest)
 
 	// Wait if resolving this layer is already running.
 	r.resolveLock.Lock(key)
@@ -240,6 +352,7 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 	}
 
 	// Resolve this layer.
+	cfg := r.currentConfig()
 	var esgzOpts []metadata.Option
 	if target.Annotations != nil {
 		if tocOffsetStr, ok := target.Annotations[zstdchunked.ManifestPositionAnnotation]; ok {
@@ -251,7 +364,7 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 			}
 		}
 	}
-	l, err := r.resolver.Resolve(ctx, r.hosts, refspec, target, esgzOpts...)
+	l, err := cfg.resolver.Resolve(ctx, cfg.hosts, refspec, target, esgzOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -261,7 +374,7 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 	if labels == nil {
 		labels = make(map[string]string)
 	}
-	if r.disableVerification {
+	if cfg.disableVerification {
 		// Skip if verification is disabled completely
 		l.SkipVerify()
 		log.G(ctx).Debugf("Verification forcefully skipped")
@@ -284,11 +397,11 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 
 	// Prefetch this layer. We prefetch several layers in parallel. The first
 	// Check() for this layer waits for the prefetch completion.
-	if !r.noprefetch {
+	if !cfg.noprefetch {
 		go func() {
 			r.backgroundTaskManager.DoPrioritizedTask()
 			defer r.backgroundTaskManager.DonePrioritizedTask()
-			if err := l.Prefetch(r.prefetchSize); err != nil {
+			if err := l.Prefetch(cfg.prefetchSize); err != nil {
 				log.G(ctx).WithError(err).Debug("failed to prefetched layer")
 				return
 			}
@@ -300,7 +413,7 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 	// reader for this so prioritized tasks(Mount, Check, etc...) can
 	// interrupt the reading. This can avoid disturbing prioritized tasks
 	// about NW traffic.
-	if !r.noBackgroundFetch {
+	if !cfg.noBackgroundFetch {
 		go func() {
 			if err := l.BackgroundFetch(); err != nil {
 				log.G(ctx).WithError(err).Debug("failed to fetch whole layer")
@@ -336,7 +449,7 @@ func (r *LayerManager) release(ctx context.Context, refspec reference.Spec, dgst
 	i := r.refcounter[refspec.String()][dgst.String()]
 	if i <= 0 {
 		// No reference to this layer. release it.
-		delete(r.refcounter, dgst.String())
+		delete(r.refcounter[refspec.String()], dgst.String())
 		if len(r.refcounter[refspec.String()]) == 0 {
 			delete(r.refcounter, refspec.String())
 		}
@@ -347,11 +460,7 @@ func (r *LayerManager) release(ctx context.Context, refspec reference.Spec, dgst
 		if !ok {
 			return 0, fmt.Errorf("layer of digest %q/%q is not registered (ref=%d)", refspec, dgst, i)
 		}
-		l.Done()
-		delete(r.layer[refspec.String()], dgst.String())
-		if len(r.layer[refspec.String()]) == 0 {
-			delete(r.layer, refspec.String())
-		}
+		r.removeLayerLocked(refspec, dgst, l)
 		log.G(ctx).WithField("refcounter", i).Infof("layer %v/%v is released due to no reference", refspec, dgst)
 	}
 	return i, nil
@@ -377,6 +486,23 @@ func (r *LayerManager) use(refspec reference.Spec, dgst digest.Digest) int {
 	return r.refcounter[refspec.String()][dgst.String()]
 }
 
+// removeLayerLocked releases the layer and removes it from the manager.
+// r.mu must be held.
+func (r *LayerManager) removeLayerLocked(refspec reference.Spec, dgst digest.Digest, l layer.Layer) {
+	key := layerKey(refspec, dgst)
+	l.Done()
+	r.metricsController.Remove(key)
+	delete(r.resolvedAt, key)
+	delete(r.layer[refspec.String()], dgst.String())
+	if len(r.layer[refspec.String()]) == 0 {
+		delete(r.layer, refspec.String())
+	}
+}
+
+func layerKey(refspec reference.Spec, dgst digest.Digest) string {
+	return refspec.String() + "/" + dgst.String()
+}
+
 func colon2dash(s string) string {
 	return strings.ReplaceAll(s, ":", "-")
 }
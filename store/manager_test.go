@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+func TestReloadClosesOldResolver(t *testing.T) {
+	ctx := context.Background()
+	hosts := source.RegistryHosts(nil)
+	refPool, err := newRefPool(ctx, t.TempDir(), hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolvers []*testResolver
+	r := &LayerManager{
+		refPool: refPool,
+		newResolver: func(cfg config.Config) (layerResolver, error) {
+			res := &testResolver{}
+			resolvers = append(resolvers, res)
+			return res, nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.Reload(ctx, hosts, config.Config{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(resolvers) != 3 {
+		t.Fatalf("resolver must be created on each reload; created %d", len(resolvers))
+	}
+	for i, res := range resolvers[:2] {
+		if res.closed != 1 {
+			t.Errorf("old resolver %d must be closed once; closed %d", i, res.closed)
+		}
+	}
+	if res := resolvers[2]; res.closed != 0 || r.currentConfig().resolver != res {
+		t.Errorf("current resolver must be used and not closed; closed %d", res.closed)
+	}
+}
+
+type testResolver struct {
+	layerResolver
+	closed int
+}
+
+func (r *testResolver) Close() error {
+	r.closed++
+	return nil
+}
+
+func (r *testResolver) PruneCache(filter func(layer.CacheUsage) bool) ([]layer.CacheUsage, error) {
+	return nil, nil
+}
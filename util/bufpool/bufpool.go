@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bufpool provides pools of byte slices classified by their sizes so
+// that buffers of various sizes (e.g. chunks of layers) can be reused without
+// holding large buffers for small data.
+package bufpool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minClassShift = 12 // 4KiB
+	maxClassShift = 24 // 16MiB
+)
+
+// pools[i] pools slices whose capacity is 1<<(minClassShift+i).
+var pools [maxClassShift - minClassShift + 1]sync.Pool
+
+// Get returns a slice whose length is size. The contents of the slice are
+// undefined. The slice should be returned with Put after use. Larger slices
+// than the max size class are allocated every time.
+func Get(size int) *[]byte {
+	c := class(size)
+	if c < 0 {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := pools[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<(minClassShift+c))
+	return &b
+}
+
+// Put returns the slice got from Get to the pool. The slice mustn't be used
+// after that.
+func Put(b *[]byte) {
+	c := class(cap(*b))
+	if c < 0 || cap(*b) != 1<<(minClassShift+c) {
+		return // not allocated by Get
+	}
+	pools[c].Put(b)
+}
+
+// class returns the index of the smallest size class which can hold size bytes.
+// -1 is returned if size exceeds the max size class.
+func class(size int) int {
+	if size > 1<<maxClassShift {
+		return -1
+	}
+	if size <= 1<<minClassShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minClassShift
+}
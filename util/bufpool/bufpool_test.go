@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bufpool
+
+import "testing"
+
+func TestGet(t *testing.T) {
+	for _, tt := range []struct {
+		size    int
+		wantCap int
+	}{
+		{size: 0, wantCap: 4 << 10},
+		{size: 1, wantCap: 4 << 10},
+		{size: 4 << 10, wantCap: 4 << 10},
+		{size: 4<<10 + 1, wantCap: 8 << 10},
+		{size: 3 << 20, wantCap: 4 << 20},
+		{size: 16 << 20, wantCap: 16 << 20},
+		{size: 16<<20 + 1, wantCap: 16<<20 + 1}, // not pooled
+	} {
+		for i := 0; i < 2; i++ { // the second one can be pooled one
+			b := Get(tt.size)
+			if len(*b) != tt.size || cap(*b) != tt.wantCap {
+				t.Errorf("Get(%d) = len:%d,cap:%d; want len:%d,cap:%d", tt.size, len(*b), cap(*b), tt.size, tt.wantCap)
+			}
+			Put(b)
+		}
+	}
+}
+
+func TestPutForeign(t *testing.T) {
+	b := make([]byte, 5000)
+	Put(&b) // must be ignored
+	if got := Get(5000); cap(*got) != 8<<10 {
+		t.Errorf("foreign slice is pooled: cap:%d", cap(*got))
+	}
+}
@@ -92,6 +92,16 @@ func (c *TTLCache) Remove(key string) {
 	c.evictLocked(key)
 }
 
+// RemoveAll removes all contents from the cache. OnEvicted callback will be called for each
+// content when nobody refers to it.
+func (c *TTLCache) RemoveAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.m {
+		c.evictLocked(key)
+	}
+}
+
 func (c *TTLCache) evictLocked(key string) {
 	if rc, ok := c.m[key]; ok {
 		delete(c.m, key)
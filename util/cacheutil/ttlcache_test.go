@@ -92,6 +92,31 @@ func TestTTLRemove(t *testing.T) {
 	}
 }
 
+// TestTTLRemoveAll tests RemoveAll API
+func TestTTLRemoveAll(t *testing.T) {
+	var evicted []string
+	c := NewTTLCache(time.Hour)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	done1()
+	_, done2, _ := c.Add("key2", "abcd2")
+
+	c.RemoveAll()
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Fatalf("only unreferenced content must be evicted; got %v", evicted)
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatalf("removed content must not be got")
+	}
+
+	done2()
+	if len(evicted) != 2 || evicted[1] != "key2" {
+		t.Fatalf("content must be evicted after the reference is discarded; got %v", evicted)
+	}
+}
+
 // TestTTLRemoveOverwritten tests old gc doesn't affect overwritten content
 func TestTTLRemoveOverwritten(t *testing.T) {
 	var evicted []string
@@ -0,0 +1,200 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package referrers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// errAPINotSupported is returned when the registry doesn't support the Referrers API.
+var errAPINotSupported = errors.New("referrers API isn't supported")
+
+// Option is an option of Push, List and Copy.
+type Option func(*options)
+
+type options struct {
+	hosts docker.RegistryHosts
+}
+
+// WithRegistryHosts enables the Referrers API ("/v2/<name>/referrers/<digest>") of
+// OCI Distribution Spec v1.1 using the hosts. Registries supporting the API index
+// pushed referrers by themselves so the referrers index of the tag schema isn't updated
+// for them. The tag schema is used as the fallback for registries without the support.
+func WithRegistryHosts(hosts docker.RegistryHosts) Option {
+	return func(o *options) {
+		o.hosts = hosts
+	}
+}
+
+// listAPI lists referrers of the subject using the Referrers API. An error wrapping
+// errAPINotSupported is returned if the registry doesn't support the API.
+func listAPI(ctx context.Context, hosts docker.RegistryHosts, ref string, subject digest.Digest) ([]Descriptor, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	regHosts, err := hosts(refspec.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	repo := strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/")
+	scope := "repository:" + repo + ":pull"
+	rErr := errAPINotSupported
+	for _, host := range regHosts {
+		if !host.Capabilities.Has(docker.HostCapabilityResolve) {
+			continue // mirrors don't serve referrers of the upstream
+		}
+		u := fmt.Sprintf("%s://%s/%s/referrers/%s", host.Scheme, path.Join(host.Host, host.Path), repo, subject)
+		res, err := listHost(ctx, host, scope, u)
+		if err != nil {
+			if !errors.Is(err, errAPINotSupported) {
+				rErr = fmt.Errorf("failed to list referrers on host %q: %w", host.Host, err)
+			}
+			continue // Try another
+		}
+		return res, nil
+	}
+	return nil, rErr
+}
+
+// listHost lists referrers at the URL of the Referrers API following pagination.
+func listHost(ctx context.Context, host docker.RegistryHost, scope, u string) ([]Descriptor, error) {
+	var res []Descriptor
+	for first := true; u != ""; first = false {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		resp, err := do(ctx, host, scope, req)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := readIndex(resp)
+		resp.Body.Close()
+		if err != nil {
+			if first && errors.Is(err, errAPINotSupported) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to list referrers at %q: %v", u, err)
+		}
+		res = append(res, idx.Manifests...)
+		if u, err = nextLink(req.URL, resp.Header.Get("Link")); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func readIndex(resp *http.Response) (Index, error) {
+	var idx Index
+	if resp.StatusCode == http.StatusNotFound {
+		return idx, errAPINotSupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return idx, fmt.Errorf("unexpected status code %v", resp.Status)
+	}
+	// Registries without the support can return an unrelated page with 200.
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mt != ocispec.MediaTypeImageIndex {
+		return idx, errAPINotSupported
+	}
+	p, err := io.ReadAll(io.LimitReader(resp.Body, maxContentSize))
+	if err != nil {
+		return idx, err
+	}
+	if err := json.Unmarshal(p, &idx); err != nil {
+		return idx, fmt.Errorf("failed to parse referrers: %w", err)
+	}
+	return idx, nil
+}
+
+// nextLink returns the URL of the next page indicated by the Link header or an empty
+// string if there is no next page.
+func nextLink(base *url.URL, link string) (string, error) {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		next := false
+		for _, p := range parts[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(p), `"`, "") == "rel=next" {
+				next = true
+			}
+		}
+		if !next {
+			continue
+		}
+		u, err := base.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			return "", fmt.Errorf("invalid link %q: %w", link, err)
+		}
+		return u.String(), nil
+	}
+	return "", nil
+}
+
+// do sends the request to the host, authorizing it with the authorizer of the host.
+func do(ctx context.Context, host docker.RegistryHost, scope string, req *http.Request) (*http.Response, error) {
+	ctx = docker.WithScope(ctx, scope)
+	client := host.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	send := func() (*http.Response, error) {
+		r := req.Clone(ctx)
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, r); err != nil {
+				return nil, err
+			}
+		}
+		return client.Do(r)
+	}
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && host.Authorizer != nil {
+		// prepare authorization for the host and retry
+		if err := host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			if errdefs.IsNotImplemented(err) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			return nil, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return send()
+	}
+	return resp, nil
+}
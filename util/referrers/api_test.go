@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package referrers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReferrersAPI(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		t.Run(fmt.Sprintf("supported=%v", supported), func(t *testing.T) {
+			ctx := context.Background()
+			reg := newTestRegistry()
+			srv := httptest.NewServer(referrersHandler(t, reg, supported))
+			defer srv.Close()
+			opt := WithRegistryHosts(func(string) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       srv.Client(),
+					Host:         strings.TrimPrefix(srv.URL, "http://"),
+					Scheme:       "http",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+				}}, nil
+			})
+			ref := "example.com/foo:latest"
+			subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("subject"), Size: 7}
+			config := ocispec.Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digest.FromBytes(EmptyJSON), Size: int64(len(EmptyJSON))}
+			for _, a := range []string{"application/a", "application/b", "application/a"} {
+				data := a + "-" + strconv.Itoa(len(reg.blobs))
+				l := ocispec.Descriptor{MediaType: "application/test", Digest: digest.FromString(data), Size: int64(len(data))}
+				if _, err := Push(ctx, reg, ref, Manifest{
+					ArtifactType: a,
+					Config:       config,
+					Layers:       []ocispec.Descriptor{l},
+					Subject:      &subject,
+				}, map[digest.Digest][]byte{config.Digest: EmptyJSON, l.Digest: []byte(data)}, opt); err != nil {
+					t.Fatalf("failed to push artifact: %v", err)
+				}
+			}
+			if _, ok := reg.tags["example.com/foo:"+FallbackTag(subject.Digest)]; ok == supported {
+				t.Errorf("the fallback tag must be used only if the API isn't supported")
+			}
+			all, err := List(ctx, reg, ref, subject.Digest, "", opt)
+			if err != nil {
+				t.Fatalf("failed to list referrers: %v", err)
+			}
+			if len(all) != 3 {
+				t.Fatalf("unexpected referrers: %+v", all)
+			}
+			res, err := List(ctx, reg, ref, subject.Digest, "application/a", opt)
+			if err != nil {
+				t.Fatalf("failed to list referrers: %v", err)
+			}
+			if len(res) != 2 || res[0].ArtifactType != "application/a" || res[1].ArtifactType != "application/a" {
+				t.Fatalf("unexpected referrers: %+v", res)
+			}
+		})
+	}
+}
+
+// referrersHandler serves the Referrers API listing manifests in the registry. A page
+// contains only one referrer to test pagination.
+func referrersHandler(t *testing.T, reg *testRegistry, supported bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/v2/foo/referrers/"
+		if !supported || !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		subject := digest.Digest(strings.TrimPrefix(r.URL.Path, prefix))
+		var res []Descriptor
+		reg.mu.Lock()
+		for dgst, p := range reg.blobs {
+			var m Manifest
+			if json.Unmarshal(p, &m) != nil || m.Subject == nil || m.Subject.Digest != subject {
+				continue
+			}
+			res = append(res, Descriptor{
+				Descriptor:   ocispec.Descriptor{MediaType: m.MediaType, Digest: dgst, Size: int64(len(p))},
+				ArtifactType: m.ArtifactType,
+			})
+		}
+		reg.mu.Unlock()
+		sort.Slice(res, func(i, j int) bool { return res[i].Digest < res[j].Digest })
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		idx := Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []Descriptor{}}
+		idx.SchemaVersion = 2
+		if page < len(res) {
+			idx.Manifests = res[page : page+1]
+		}
+		if page+1 < len(res) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		if err := json.NewEncoder(w).Encode(idx); err != nil {
+			t.Errorf("failed to write referrers: %v", err)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package referrers provides helpers to push and discover artifacts that refer to
+// an image manifest (a.k.a. "subject") in a registry.
+//
+// Referrers are discovered using the Referrers API defined by OCI Distribution Spec
+// v1.1 if it's enabled by WithRegistryHosts and supported by the registry. Otherwise,
+// they are recorded using the tag schema of the spec (an image index tagged
+// "<alg>-<encoded digest of the subject>") which is supported by any registry.
+package referrers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeEmptyJSON is the media type of the empty config of artifacts.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// maxContentSize is the maximum size of the content fetched into memory.
+	maxContentSize = 64 * 1024 * 1024
+)
+
+// EmptyJSON is the content of the empty config of artifacts.
+var EmptyJSON = []byte("{}")
+
+// Descriptor is a descriptor with artifact type. This corresponds to the
+// descriptor defined in OCI Image Spec v1.1.
+type Descriptor struct {
+	ocispec.Descriptor
+
+	// ArtifactType is the artifact type of the referred manifest.
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// Manifest is an image manifest of an artifact which refers to the subject.
+// This corresponds to the image manifest defined in OCI Image Spec v1.1.
+type Manifest struct {
+	specs.Versioned
+
+	MediaType    string               `json:"mediaType,omitempty"`
+	ArtifactType string               `json:"artifactType,omitempty"`
+	Config       ocispec.Descriptor   `json:"config"`
+	Layers       []ocispec.Descriptor `json:"layers"`
+	Subject      *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations  map[string]string    `json:"annotations,omitempty"`
+}
+
+// Index is a list of referrers.
+type Index struct {
+	specs.Versioned
+
+	MediaType string       `json:"mediaType,omitempty"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// FallbackTag returns the tag of the referrers index of the subject.
+func FallbackTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// Push pushes the blobs and the artifact manifest to the repository of ref and registers
+// the manifest as a referrer of m.Subject. blobs must contain the contents of the config
+// and layers of the manifest.
+func Push(ctx context.Context, resolver remotes.Resolver, ref string, m Manifest, blobs map[digest.Digest][]byte, opts ...Option) (Descriptor, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if m.Subject == nil {
+		return Descriptor{}, fmt.Errorf("subject must be specified")
+	}
+	repo, err := repository(ref)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	m.SchemaVersion = 2
+	m.MediaType = ocispec.MediaTypeImageManifest
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc := Descriptor{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   m.MediaType,
+			Digest:      digest.FromBytes(mb),
+			Size:        int64(len(mb)),
+			Annotations: m.Annotations,
+		},
+		ArtifactType: m.ArtifactType,
+	}
+
+	pusher, err := resolver.Pusher(ctx, repo+"@"+desc.Digest.String())
+	if err != nil {
+		return Descriptor{}, err
+	}
+	for _, b := range append([]ocispec.Descriptor{m.Config}, m.Layers...) {
+		p, ok := blobs[b.Digest]
+		if !ok {
+			return Descriptor{}, fmt.Errorf("content of blob %v is not provided", b.Digest)
+		}
+		if err := pushContent(ctx, pusher, b, p); err != nil {
+			return Descriptor{}, fmt.Errorf("failed to push blob %v: %w", b.Digest, err)
+		}
+	}
+	if err := pushContent(ctx, pusher, desc.Descriptor, mb); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to push manifest: %w", err)
+	}
+
+	if o.hosts != nil {
+		// The registry supporting the Referrers API indexes the manifest by itself.
+		if _, err := listAPI(ctx, o.hosts, ref, m.Subject.Digest); err == nil {
+			return desc, nil
+		} else if !errors.Is(err, errAPINotSupported) {
+			return Descriptor{}, err
+		}
+	}
+
+	// Register the manifest to the referrers index of the subject
+	idx, err := fetchIndex(ctx, resolver, repo, m.Subject.Digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	for _, d := range idx.Manifests {
+		if d.Digest == desc.Digest {
+			return desc, nil // already registered
+		}
+	}
+	idx.SchemaVersion = 2
+	idx.MediaType = ocispec.MediaTypeImageIndex
+	idx.Manifests = append(idx.Manifests, desc)
+	ib, err := json.Marshal(idx)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	idxPusher, err := resolver.Pusher(ctx, repo+":"+FallbackTag(m.Subject.Digest))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := pushContent(ctx, idxPusher, ocispec.Descriptor{
+		MediaType: idx.MediaType,
+		Digest:    digest.FromBytes(ib),
+		Size:      int64(len(ib)),
+	}, ib); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to push referrers index: %w", err)
+	}
+	return desc, nil
+}
+
+// List returns referrers of the subject in the repository of ref. If artifactType
+// isn't empty, only referrers of the artifact type are returned.
+func List(ctx context.Context, resolver remotes.Resolver, ref string, subject digest.Digest, artifactType string, opts ...Option) ([]Descriptor, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	repo, err := repository(ref)
+	if err != nil {
+		return nil, err
+	}
+	var all []Descriptor
+	if o.hosts != nil {
+		all, err = listAPI(ctx, o.hosts, ref, subject)
+		if err != nil && !errors.Is(err, errAPINotSupported) {
+			return nil, err
+		}
+	}
+	if o.hosts == nil || err != nil {
+		idx, err := fetchIndex(ctx, resolver, repo, subject)
+		if err != nil {
+			return nil, err
+		}
+		all = idx.Manifests
+	}
+	var res []Descriptor
+	for _, d := range all {
+		if artifactType == "" || d.ArtifactType == artifactType {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// Copy copies the referrers of the subject in the repository of srcRef to the
+// repository of dstRef as referrers of newSubject (e.g. the image converted from the
+// subject) and returns the copied ones.
+func Copy(ctx context.Context, resolver remotes.Resolver, srcRef string, subject digest.Digest, dstRef string, newSubject ocispec.Descriptor, opts ...Option) ([]Descriptor, error) {
+	refs, err := List(ctx, resolver, srcRef, subject, "", opts...)
+	if err != nil {
+		return nil, err
+	}
+	newSubject = ocispec.Descriptor{
+		MediaType: newSubject.MediaType,
+		Digest:    newSubject.Digest,
+		Size:      newSubject.Size,
+	}
+	var copied []Descriptor
+	for _, r := range refs {
+		m, err := FetchManifest(ctx, resolver, srcRef, r.Descriptor)
+		if err != nil {
+			return copied, err
+		}
+		blobs := make(map[digest.Digest][]byte)
+		for _, b := range append([]ocispec.Descriptor{m.Config}, m.Layers...) {
+			p, err := Fetch(ctx, resolver, srcRef, b)
+			if err != nil {
+				return copied, fmt.Errorf("failed to fetch blob %v of referrer %v: %w", b.Digest, r.Digest, err)
+			}
+			blobs[b.Digest] = p
+		}
+		m.Subject = &newSubject
+		desc, err := Push(ctx, resolver, dstRef, m, blobs, opts...)
+		if err != nil {
+			return copied, fmt.Errorf("failed to copy referrer %v: %w", r.Digest, err)
+		}
+		copied = append(copied, desc)
+	}
+	return copied, nil
+}
+
+// FetchManifest fetches the artifact manifest from the repository of ref.
+func FetchManifest(ctx context.Context, resolver remotes.Resolver, ref string, desc ocispec.Descriptor) (Manifest, error) {
+	var m Manifest
+	p, err := Fetch(ctx, resolver, ref, desc)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(p, &m); err != nil {
+		return m, fmt.Errorf("failed to parse manifest %v: %w", desc.Digest, err)
+	}
+	return m, nil
+}
+
+// Fetch fetches the content from the repository of ref and verifies it.
+func Fetch(ctx context.Context, resolver remotes.Resolver, ref string, desc ocispec.Descriptor) ([]byte, error) {
+	repo, err := repository(ref)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, repo+"@"+desc.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	return fetch(ctx, fetcher, desc)
+}
+
+func fetchIndex(ctx context.Context, resolver remotes.Resolver, repo string, subject digest.Digest) (Index, error) {
+	var idx Index
+	name, desc, err := resolver.Resolve(ctx, repo+":"+FallbackTag(subject))
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return idx, nil // no referrer
+		}
+		return idx, fmt.Errorf("failed to resolve referrers of %v: %w", subject, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return idx, err
+	}
+	p, err := fetch(ctx, fetcher, desc)
+	if err != nil {
+		return idx, fmt.Errorf("failed to fetch referrers of %v: %w", subject, err)
+	}
+	if err := json.Unmarshal(p, &idx); err != nil {
+		return idx, fmt.Errorf("failed to parse referrers of %v: %w", subject, err)
+	}
+	return idx, nil
+}
+
+func fetch(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxContentSize {
+		return nil, fmt.Errorf("content %v is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	r, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	p, err := io.ReadAll(io.LimitReader(r, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	if dgst := digest.FromBytes(p); dgst != desc.Digest {
+		return nil, fmt.Errorf("digest mismatch: %v; want %v", dgst, desc.Digest)
+	}
+	return p, nil
+}
+
+func pushContent(ctx context.Context, pusher remotes.Pusher, desc ocispec.Descriptor, p []byte) error {
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+	if _, err := w.Write(p); err != nil {
+		return err
+	}
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// repository returns the repository name (without tag and digest) of ref.
+func repository(ref string) (string, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	return refspec.Locator, nil
+}
@@ -0,0 +1,213 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package referrers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPushAndList(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry()
+	ref := "example.com/foo:latest"
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject"),
+		Size:      7,
+	}
+	config := ocispec.Descriptor{
+		MediaType: MediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(EmptyJSON),
+		Size:      int64(len(EmptyJSON)),
+	}
+	push := func(artifactType, data string) Descriptor {
+		l := ocispec.Descriptor{MediaType: "application/test", Digest: digest.FromString(data), Size: int64(len(data))}
+		desc, err := Push(ctx, reg, ref, Manifest{
+			ArtifactType: artifactType,
+			Config:       config,
+			Layers:       []ocispec.Descriptor{l},
+			Subject:      &subject,
+		}, map[digest.Digest][]byte{config.Digest: EmptyJSON, l.Digest: []byte(data)})
+		if err != nil {
+			t.Fatalf("failed to push artifact: %v", err)
+		}
+		return desc
+	}
+
+	if res, err := List(ctx, reg, ref, subject.Digest, ""); err != nil || len(res) != 0 {
+		t.Fatalf("unexpected referrers before push: %v, %v", res, err)
+	}
+	a := push("application/a", "aaa")
+	push("application/b", "bbb")
+	push("application/a", "aaa") // pushing the same artifact twice must be idempotent
+
+	all, err := List(ctx, reg, ref, subject.Digest, "")
+	if err != nil {
+		t.Fatalf("failed to list referrers: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("unexpected number of referrers %d; want 2", len(all))
+	}
+	res, err := List(ctx, reg, ref, subject.Digest, "application/a")
+	if err != nil {
+		t.Fatalf("failed to list referrers: %v", err)
+	}
+	if len(res) != 1 || res[0].Digest != a.Digest {
+		t.Fatalf("unexpected referrers: %+v", res)
+	}
+	m, err := FetchManifest(ctx, reg, ref, res[0].Descriptor)
+	if err != nil {
+		t.Fatalf("failed to fetch manifest: %v", err)
+	}
+	if m.Subject == nil || m.Subject.Digest != subject.Digest || m.ArtifactType != "application/a" {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	p, err := Fetch(ctx, reg, ref, m.Layers[0])
+	if err != nil {
+		t.Fatalf("failed to fetch blob: %v", err)
+	}
+	if string(p) != "aaa" {
+		t.Fatalf("unexpected blob %q; want %q", string(p), "aaa")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry()
+	srcRef, dstRef := "example.com/foo:latest", "example.com/bar:latest"
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("subject"), Size: 7}
+	newSubject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("converted"),
+		Size:      9,
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}
+	config := ocispec.Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digest.FromBytes(EmptyJSON), Size: int64(len(EmptyJSON))}
+	l := ocispec.Descriptor{MediaType: "application/spdx+json", Digest: digest.FromString("sbom"), Size: 4}
+	if _, err := Push(ctx, reg, srcRef, Manifest{
+		ArtifactType: "application/spdx+json",
+		Config:       config,
+		Layers:       []ocispec.Descriptor{l},
+		Subject:      &subject,
+		Annotations:  map[string]string{"a": "b"},
+	}, map[digest.Digest][]byte{config.Digest: EmptyJSON, l.Digest: []byte("sbom")}); err != nil {
+		t.Fatalf("failed to push artifact: %v", err)
+	}
+
+	copied, err := Copy(ctx, reg, srcRef, subject.Digest, dstRef, newSubject)
+	if err != nil {
+		t.Fatalf("failed to copy referrers: %v", err)
+	}
+	if len(copied) != 1 || copied[0].ArtifactType != "application/spdx+json" {
+		t.Fatalf("unexpected copied referrers: %+v", copied)
+	}
+	res, err := List(ctx, reg, dstRef, newSubject.Digest, "")
+	if err != nil || len(res) != 1 || res[0].Digest != copied[0].Digest {
+		t.Fatalf("unexpected referrers of the new subject: %+v, %v", res, err)
+	}
+	m, err := FetchManifest(ctx, reg, dstRef, res[0].Descriptor)
+	if err != nil {
+		t.Fatalf("failed to fetch manifest: %v", err)
+	}
+	if m.Subject == nil || m.Subject.Digest != newSubject.Digest || m.Subject.Platform != nil || m.Annotations["a"] != "b" {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	if res, err := List(ctx, reg, dstRef, subject.Digest, ""); err != nil || len(res) != 0 {
+		t.Fatalf("referrers must not be attached to the old subject in the target: %+v, %v", res, err)
+	}
+}
+
+// testRegistry is an in-memory registry implementing remotes.Resolver.
+type testRegistry struct {
+	blobs map[digest.Digest][]byte
+	tags  map[string]ocispec.Descriptor
+	mu    sync.Mutex
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		blobs: make(map[digest.Digest][]byte),
+		tags:  make(map[string]ocispec.Descriptor),
+	}
+}
+
+func (r *testRegistry) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	desc, ok := r.tags[ref]
+	if !ok {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%q: %w", ref, errdefs.ErrNotFound)
+	}
+	return ref, desc, nil
+}
+
+func (r *testRegistry) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		p, ok := r.blobs[desc.Digest]
+		if !ok {
+			return nil, fmt.Errorf("%v: %w", desc.Digest, errdefs.ErrNotFound)
+		}
+		return io.NopCloser(bytes.NewReader(p)), nil
+	}), nil
+}
+
+func (r *testRegistry) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return remotes.PusherFunc(func(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+		return &testWriter{r: r, ref: ref, desc: desc}, nil
+	}), nil
+}
+
+type testWriter struct {
+	r    *testRegistry
+	ref  string
+	desc ocispec.Descriptor
+	buf  bytes.Buffer
+}
+
+func (w *testWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) Digest() digest.Digest       { return digest.FromBytes(w.buf.Bytes()) }
+func (w *testWriter) Truncate(size int64) error   { return fmt.Errorf("unsupported") }
+func (w *testWriter) Status() (content.Status, error) {
+	return content.Status{Ref: w.ref, Offset: int64(w.buf.Len()), Total: w.desc.Size}, nil
+}
+func (w *testWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if dgst := w.Digest(); dgst != expected || int64(w.buf.Len()) != size {
+		return fmt.Errorf("unexpected content %v (%d bytes); want %v (%d bytes)", dgst, w.buf.Len(), expected, size)
+	}
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	w.r.blobs[expected] = w.buf.Bytes()
+	if w.desc.MediaType == ocispec.MediaTypeImageIndex && !strings.Contains(w.ref, "@") {
+		w.r.tags[w.ref] = w.desc
+	}
+	return nil
+}
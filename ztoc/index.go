@@ -0,0 +1,69 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/util/referrers"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexedLayers returns the digests of ztocs in the layers of the index keyed by the
+// digests of the indexed layers.
+func IndexedLayers(layers []ocispec.Descriptor) (map[digest.Digest]digest.Digest, error) {
+	ztocs := make(map[digest.Digest]digest.Digest)
+	for _, l := range layers {
+		if l.MediaType != MediaTypeZtoc {
+			continue
+		}
+		layerDgst, err := digest.Parse(l.Annotations[LayerDigestAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer digest of ztoc %v: %w", l.Digest, err)
+		}
+		ztocs[layerDgst] = l.Digest
+	}
+	return ztocs, nil
+}
+
+// FetchReferrer fetches the latest index pushed to the repository of ref as a referrer
+// of the image manifest and returns the digests of ztocs keyed by the digests of the
+// layers. An empty map is returned if the manifest has no index.
+func FetchReferrer(ctx context.Context, resolver remotes.Resolver, ref string, manifest digest.Digest, opts ...referrers.Option) (map[digest.Digest]digest.Digest, error) {
+	indexes, err := referrers.List(ctx, resolver, ref, manifest, IndexArtifactType, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		return map[digest.Digest]digest.Digest{}, nil
+	}
+	latest := indexes[0]
+	for _, i := range indexes[1:] {
+		// RFC3339 timestamps in UTC can be compared as strings
+		if i.Annotations[ocispec.AnnotationCreated] >= latest.Annotations[ocispec.AnnotationCreated] {
+			latest = i
+		}
+	}
+	m, err := referrers.FetchManifest(ctx, resolver, ref, latest.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return IndexedLayers(m.Layers)
+}
@@ -0,0 +1,634 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// This file implements a gzip (DEFLATE, RFC1951 and RFC1952) decoder which can start
+// decompression from the boundary of any DEFLATE block. compress/flate can't be used
+// for this purpose because it doesn't expose the boundaries of blocks.
+
+const (
+	windowSize = 1 << 15 // max distance of back-references
+	maxBits    = 15      // max length of Huffman codes
+	fastBits   = 9       // Huffman codes up to this length are decoded with a table
+
+	maxLitCodes  = 286
+	maxDistCodes = 30
+)
+
+var errInvalidDeflate = errors.New("invalid deflate data")
+
+// bitReader reads bits from the compressed stream in LSB-first order.
+type bitReader struct {
+	r     io.ByteReader
+	pos   int64 // offset of the next byte read from r
+	bits  uint64
+	nbits uint
+	err   error
+}
+
+// bitOffset returns the offset of the next unread bit in the compressed stream.
+func (br *bitReader) bitOffset() int64 {
+	return br.pos*8 - int64(br.nbits)
+}
+
+func (br *bitReader) fill() {
+	for br.nbits <= 56 {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			br.err = err
+			return
+		}
+		br.bits |= uint64(b) << br.nbits
+		br.nbits += 8
+		br.pos++
+	}
+}
+
+func (br *bitReader) need(n uint) error {
+	if br.nbits < n {
+		br.fill()
+		if br.nbits < n {
+			if br.err == nil || br.err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return br.err
+		}
+	}
+	return nil
+}
+
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if err := br.need(n); err != nil {
+		return 0, err
+	}
+	v := uint32(br.bits & (1<<n - 1))
+	br.bits >>= n
+	br.nbits -= n
+	return v, nil
+}
+
+func (br *bitReader) alignByte() {
+	n := br.nbits % 8
+	br.bits >>= n
+	br.nbits -= n
+}
+
+// readByte reads a byte from the byte-aligned stream.
+func (br *bitReader) readByte() (byte, error) {
+	v, err := br.readBits(8)
+	return byte(v), err
+}
+
+// atEOF returns true if no more byte is available.
+func (br *bitReader) atEOF() bool {
+	if br.nbits >= 8 {
+		return false
+	}
+	br.fill()
+	return br.nbits < 8
+}
+
+// huffman is a canonical Huffman code.
+type huffman struct {
+	count  [maxBits + 1]uint16
+	symbol []uint16
+
+	// fast maps the next fastBits bits to (symbol << 4 | length). length is 0 if the
+	// code is longer than fastBits.
+	fast [1 << fastBits]uint16
+}
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbol: make([]uint16, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+	left := 1
+	for l := 1; l <= maxBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return nil, fmt.Errorf("over-subscribed Huffman code: %w", errInvalidDeflate)
+		}
+	}
+	var offs [maxBits + 2]uint16
+	for l := 1; l <= maxBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	var nextCode [maxBits + 1]int
+	code := 0
+	for l := 1; l <= maxBits; l++ {
+		nextCode[l] = code
+		code = (code + int(h.count[l])) << 1
+	}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		h.symbol[offs[l]] = uint16(sym)
+		offs[l]++
+		c := nextCode[l]
+		nextCode[l]++
+		if l <= fastBits {
+			rev := reverseBits(uint16(c), uint(l))
+			for i := int(rev); i < len(h.fast); i += 1 << l {
+				h.fast[i] = uint16(sym)<<4 | uint16(l)
+			}
+		}
+	}
+	return h, nil
+}
+
+func reverseBits(c uint16, n uint) uint16 {
+	var r uint16
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | c&1
+		c >>= 1
+	}
+	return r
+}
+
+func (h *huffman) decode(br *bitReader) (uint16, error) {
+	if br.nbits < fastBits {
+		br.fill()
+	}
+	if e := h.fast[br.bits&(1<<fastBits-1)]; e&0xf != 0 && uint(e&0xf) <= br.nbits {
+		br.bits >>= e & 0xf
+		br.nbits -= uint(e & 0xf)
+		return e >> 4, nil
+	}
+	// Slow path: decode bit by bit.
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxBits; l++ {
+		b, err := br.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return h.symbol[index+(code-first)], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, fmt.Errorf("invalid Huffman code: %w", errInvalidDeflate)
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// order of code length codes in dynamic block headers
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLit, fixedDist *huffman
+)
+
+func init() {
+	var l [288]uint8
+	for i := range l {
+		switch {
+		case i < 144:
+			l[i] = 8
+		case i < 256:
+			l[i] = 9
+		case i < 280:
+			l[i] = 7
+		default:
+			l[i] = 8
+		}
+	}
+	var err error
+	if fixedLit, err = newHuffman(l[:]); err != nil {
+		panic(err)
+	}
+	var d [30]uint8
+	for i := range d {
+		d[i] = 5
+	}
+	if fixedDist, err = newHuffman(d[:]); err != nil {
+		panic(err)
+	}
+}
+
+type decoderState int
+
+const (
+	stateMemberHeader decoderState = iota
+	stateBlockHeader
+	stateStored
+	stateHuffman
+	stateTrailer
+	stateEOF
+)
+
+// decoder decompresses gzip streams. It supports multi-member streams.
+type decoder struct {
+	br    bitReader
+	state decoderState
+	final bool // the current block is the final block of the member
+
+	stored        int // remaining bytes of the current stored block
+	lit, dist     *huffman
+	buf           []byte // holds the window followed by unread data
+	rpos          int    // offset of unread data in buf
+	out           int64  // offset in the uncompressed stream of the end of buf
+	crc           hash.Hash32
+	crcPos        int // offset in buf of data not added to crc yet
+	size          uint32
+	verifyTrailer bool // false if the decoder started in the middle of a member
+
+	// onBlock is called at the beginning of every DEFLATE block if non-nil.
+	onBlock func(in, out int64, d *decoder)
+}
+
+// newDecoder creates a decoder which decompresses the gzip stream from the beginning.
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{
+		br:            bitReader{r: bufio.NewReader(r)},
+		state:         stateMemberHeader,
+		verifyTrailer: true,
+		crc:           crc32.NewIEEE(),
+	}
+}
+
+// newDecoderAt creates a decoder which starts decompression at the checkpoint. r is the
+// compressed stream starting at the byte of the checkpoint (i.e. cp.In / 8).
+func newDecoderAt(r io.Reader, cp *Checkpoint) (*decoder, error) {
+	d := &decoder{
+		br:     bitReader{r: bufio.NewReader(r), pos: cp.In / 8},
+		state:  stateBlockHeader,
+		buf:    append(make([]byte, 0, 2*windowSize), cp.Window...),
+		rpos:   len(cp.Window),
+		out:    cp.Out,
+		crc:    crc32.NewIEEE(),
+		crcPos: len(cp.Window),
+	}
+	if _, err := d.br.readBits(uint(cp.In % 8)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// window returns the last 32KiB of the uncompressed data.
+func (d *decoder) window() []byte {
+	w := d.buf
+	if len(w) > windowSize {
+		w = w[len(w)-windowSize:]
+	}
+	return append([]byte{}, w...)
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for d.rpos == len(d.buf) {
+		if d.state == stateEOF {
+			return 0, io.EOF
+		}
+		if err := d.step(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf[d.rpos:])
+	d.rpos += n
+	return n, nil
+}
+
+// emit appends a decompressed byte to the buffer.
+func (d *decoder) emit(b byte) {
+	d.buf = append(d.buf, b)
+	d.out++
+}
+
+// updateCRC adds the decompressed data to the checksum of the member.
+func (d *decoder) updateCRC() {
+	if d.verifyTrailer {
+		d.crc.Write(d.buf[d.crcPos:])
+	}
+	d.size += uint32(len(d.buf) - d.crcPos)
+	d.crcPos = len(d.buf)
+}
+
+// compact discards read data not needed as the window.
+func (d *decoder) compact() {
+	if d.rpos < 2*windowSize {
+		return
+	}
+	d.updateCRC()
+	n := copy(d.buf, d.buf[d.rpos-windowSize:])
+	d.buf = d.buf[:n]
+	d.rpos = windowSize
+	d.crcPos = n
+}
+
+// step decompresses the next part of the stream.
+func (d *decoder) step() error {
+	d.compact()
+	switch d.state {
+	case stateMemberHeader:
+		return d.readMemberHeader()
+	case stateBlockHeader:
+		return d.readBlockHeader()
+	case stateStored:
+		return d.readStored()
+	case stateHuffman:
+		return d.readHuffman()
+	case stateTrailer:
+		return d.readTrailer()
+	}
+	return io.EOF
+}
+
+func (d *decoder) readMemberHeader() error {
+	var h [10]byte
+	for i := range h {
+		b, err := d.br.readByte()
+		if err != nil {
+			return fmt.Errorf("failed to read gzip header: %w", err)
+		}
+		h[i] = b
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 {
+		return fmt.Errorf("invalid gzip header")
+	}
+	flg := h[3]
+	if flg&0x04 != 0 { // FEXTRA
+		lo, err := d.br.readByte()
+		if err != nil {
+			return err
+		}
+		hi, err := d.br.readByte()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(lo)|int(hi)<<8; i++ {
+			if _, err := d.br.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flg&f == 0 {
+			continue
+		}
+		for {
+			b, err := d.br.readByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flg&0x02 != 0 { // FHCRC
+		if _, err := d.br.readBits(16); err != nil {
+			return err
+		}
+	}
+	d.crc.Reset()
+	d.crcPos = len(d.buf)
+	d.size = 0
+	d.verifyTrailer = true
+	d.state = stateBlockHeader
+	return nil
+}
+
+func (d *decoder) readBlockHeader() error {
+	if d.onBlock != nil {
+		d.onBlock(d.br.bitOffset(), d.out, d)
+	}
+	h, err := d.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	d.final = h&1 == 1
+	switch h >> 1 {
+	case 0:
+		d.br.alignByte()
+		v, err := d.br.readBits(32)
+		if err != nil {
+			return err
+		}
+		if uint16(v) != ^uint16(v>>16) {
+			return fmt.Errorf("invalid stored block length: %w", errInvalidDeflate)
+		}
+		d.stored = int(uint16(v))
+		d.state = stateStored
+	case 1:
+		d.lit, d.dist = fixedLit, fixedDist
+		d.state = stateHuffman
+	case 2:
+		if err := d.readDynamicTables(); err != nil {
+			return err
+		}
+		d.state = stateHuffman
+	default:
+		return fmt.Errorf("invalid block type: %w", errInvalidDeflate)
+	}
+	return nil
+}
+
+func (d *decoder) readDynamicTables() error {
+	v, err := d.br.readBits(14)
+	if err != nil {
+		return err
+	}
+	nlen, ndist, ncode := int(v&0x1f)+257, int(v>>5&0x1f)+1, int(v>>10)+4
+	if nlen > maxLitCodes || ndist > maxDistCodes {
+		return fmt.Errorf("too many length or distance codes: %w", errInvalidDeflate)
+	}
+	var clen [19]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := d.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		clen[codeLengthOrder[i]] = uint8(l)
+	}
+	ch, err := newHuffman(clen[:])
+	if err != nil {
+		return err
+	}
+	lengths := make([]uint8, nlen+ndist)
+	for i := 0; i < len(lengths); {
+		sym, err := ch.decode(&d.br)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return fmt.Errorf("repeat with no first length: %w", errInvalidDeflate)
+			}
+			l = lengths[i-1]
+			rep, err = d.br.readBits(2)
+			rep += 3
+		case 17:
+			rep, err = d.br.readBits(3)
+			rep += 3
+		default:
+			rep, err = d.br.readBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > len(lengths) {
+			return fmt.Errorf("too many lengths: %w", errInvalidDeflate)
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return fmt.Errorf("no end-of-block code: %w", errInvalidDeflate)
+	}
+	if d.lit, err = newHuffman(lengths[:nlen]); err != nil {
+		return err
+	}
+	if d.dist, err = newHuffman(lengths[nlen:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *decoder) endBlock() {
+	if d.final {
+		d.state = stateTrailer
+	} else {
+		d.state = stateBlockHeader
+	}
+}
+
+func (d *decoder) readStored() error {
+	// Bytes of stored blocks are read from the byte-aligned bit buffer.
+	for i := 0; i < windowSize && d.stored > 0; i++ {
+		b, err := d.br.readByte()
+		if err != nil {
+			return err
+		}
+		d.emit(b)
+		d.stored--
+	}
+	if d.stored == 0 {
+		d.endBlock()
+	}
+	return nil
+}
+
+func (d *decoder) readHuffman() error {
+	for start := d.out; d.out-start < windowSize; {
+		sym, err := d.lit.decode(&d.br)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			d.emit(byte(sym))
+			continue
+		}
+		if sym == 256 {
+			d.endBlock()
+			return nil
+		}
+		sym -= 257
+		if sym >= 29 {
+			return fmt.Errorf("invalid length code: %w", errInvalidDeflate)
+		}
+		e, err := d.br.readBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(e)
+		dsym, err := d.dist.decode(&d.br)
+		if err != nil {
+			return err
+		}
+		if dsym >= 30 {
+			return fmt.Errorf("invalid distance code: %w", errInvalidDeflate)
+		}
+		e, err = d.br.readBits(uint(distExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[dsym]) + int(e)
+		if dist > len(d.buf) {
+			return fmt.Errorf("distance too far back: %w", errInvalidDeflate)
+		}
+		from := len(d.buf) - dist
+		for i := 0; i < length; i++ {
+			d.emit(d.buf[from+i])
+		}
+	}
+	return nil
+}
+
+func (d *decoder) readTrailer() error {
+	d.updateCRC()
+	d.br.alignByte()
+	crc, err := d.br.readBits(32)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip trailer: %w", err)
+	}
+	size, err := d.br.readBits(32)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip trailer: %w", err)
+	}
+	if d.verifyTrailer && (crc != d.crc.Sum32() || size != d.size) {
+		return fmt.Errorf("gzip checksum mismatch")
+	}
+	if d.isNextMember() {
+		d.state = stateMemberHeader
+	} else {
+		d.state = stateEOF
+	}
+	return nil
+}
+
+// isNextMember returns true if another gzip member follows. Trailing data other than
+// gzip members (e.g. padding) is ignored.
+func (d *decoder) isNextMember() bool {
+	if d.br.atEOF() {
+		return false
+	}
+	return d.br.nbits >= 16 && d.br.bits&0xffff == 0x8b1f
+}
@@ -0,0 +1,309 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// reader provides metadata of a gzip-compressed tar layer based on the ztoc.
+// File contents are decompressed from the nearest checkpoint.
+type reader struct {
+	sr     *io.SectionReader
+	z      *Ztoc
+	digest digest.Digest
+	nodes  []*node
+}
+
+type node struct {
+	e        *estargz.TOCEntry
+	children map[string]uint32
+	chunks   []*estargz.TOCEntry
+}
+
+const rootID = 0
+
+// NewReader returns a metadata reader of the layer blob sr based on z. dgst is the
+// digest of the ztoc blob and is used as the TOC digest for verification.
+func NewReader(sr *io.SectionReader, z *Ztoc, dgst digest.Digest) (metadata.Reader, error) {
+	if z.CompressedSize != 0 && sr.Size() != z.CompressedSize {
+		return nil, fmt.Errorf("invalid size of layer %d; ztoc is for %d bytes", sr.Size(), z.CompressedSize)
+	}
+	r := &reader{sr: sr, z: z, digest: dgst}
+	r.nodes = []*node{{
+		e:        &estargz.TOCEntry{Type: "dir", Mode: 0755, NumLink: 2},
+		children: make(map[string]uint32),
+	}}
+	ids := map[string]uint32{"": rootID}
+	var lastReg *node
+	for _, e := range z.Entries {
+		if e.Type == "chunk" {
+			if lastReg == nil || lastReg.e.Name != e.Name {
+				return nil, fmt.Errorf("chunk of %q doesn't follow the file", e.Name)
+			}
+			lastReg.chunks = append(lastReg.chunks, e)
+			continue
+		}
+		name := cleanEntryName(e.Name)
+		if name == "" {
+			if e.Type == "dir" {
+				root := *e
+				root.NumLink = r.nodes[rootID].e.NumLink
+				r.nodes[rootID].e = &root
+			}
+			continue
+		}
+		pid, err := r.parentID(ids, path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		base := path.Base(name)
+		if e.Type == "hardlink" {
+			id, ok := ids[cleanEntryName(e.LinkName)]
+			if !ok {
+				return nil, fmt.Errorf("hardlink target %q of %q not found", e.LinkName, name)
+			}
+			r.nodes[id].e.NumLink++
+			r.nodes[pid].children[base] = id
+			ids[name] = id
+			continue
+		}
+		if id, ok := ids[name]; ok && e.Type == "dir" && r.nodes[id].e.Type == "dir" {
+			// The directory has been implicitly created by a child; fill the attributes.
+			ent := *e
+			ent.NumLink = r.nodes[id].e.NumLink
+			r.nodes[id].e = &ent
+			continue
+		}
+		ent := *e
+		ent.Name = name
+		n := &node{e: &ent}
+		if ent.Type == "dir" {
+			ent.NumLink = 2
+			n.children = make(map[string]uint32)
+			r.nodes[pid].e.NumLink++
+		} else {
+			ent.NumLink = 1
+		}
+		if ent.Type == "reg" {
+			n.chunks = []*estargz.TOCEntry{&ent}
+			lastReg = n
+		}
+		id := uint32(len(r.nodes))
+		r.nodes = append(r.nodes, n)
+		r.nodes[pid].children[base] = id
+		ids[name] = id
+	}
+	return r, nil
+}
+
+// parentID returns the ID of the directory. Missing directories are created.
+func (r *reader) parentID(ids map[string]uint32, dir string) (uint32, error) {
+	if dir == "." || dir == "/" {
+		return rootID, nil
+	}
+	if id, ok := ids[dir]; ok {
+		if r.nodes[id].children == nil {
+			return 0, fmt.Errorf("%q isn't a directory", dir)
+		}
+		return id, nil
+	}
+	pid, err := r.parentID(ids, path.Dir(dir))
+	if err != nil {
+		return 0, err
+	}
+	id := uint32(len(r.nodes))
+	r.nodes = append(r.nodes, &node{
+		e:        &estargz.TOCEntry{Name: dir, Type: "dir", Mode: 0755, NumLink: 2},
+		children: make(map[string]uint32),
+	})
+	r.nodes[pid].children[path.Base(dir)] = id
+	r.nodes[pid].e.NumLink++
+	ids[dir] = id
+	return id, nil
+}
+
+func (r *reader) node(id uint32) (*node, error) {
+	if int(id) >= len(r.nodes) {
+		return nil, fmt.Errorf("entry %d not found", id)
+	}
+	return r.nodes[id], nil
+}
+
+func (r *reader) RootID() uint32 {
+	return rootID
+}
+
+func (r *reader) TOCDigest() digest.Digest {
+	return r.digest
+}
+
+// GetOffset returns the offset in the layer blob of the checkpoint where the
+// decompression of the file starts.
+func (r *reader) GetOffset(id uint32) (offset int64, err error) {
+	n, err := r.node(id)
+	if err != nil {
+		return 0, err
+	}
+	if cp := r.checkpoint(n.e.Offset); cp != nil {
+		return cp.In / 8, nil
+	}
+	return 0, nil
+}
+
+func (r *reader) GetAttr(id uint32) (attr metadata.Attr, err error) {
+	n, err := r.node(id)
+	if err != nil {
+		return attr, err
+	}
+	attrFromTOCEntry(n.e, &attr)
+	return attr, nil
+}
+
+func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Attr, err error) {
+	n, err := r.node(pid)
+	if err != nil {
+		return 0, attr, err
+	}
+	id, ok := n.children[base]
+	if !ok {
+		return 0, attr, fmt.Errorf("child %q of entry %d not found", base, pid)
+	}
+	attrFromTOCEntry(r.nodes[id].e, &attr)
+	return id, attr, nil
+}
+
+func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
+	n, err := r.node(id)
+	if err != nil {
+		return err
+	}
+	for name, cid := range n.children {
+		if !f(name, cid, r.nodes[cid].e.Stat().Mode()) {
+			break
+		}
+	}
+	return nil
+}
+
+func (r *reader) OpenFile(id uint32) (metadata.File, error) {
+	n, err := r.node(id)
+	if err != nil {
+		return nil, err
+	}
+	if n.e.Type != "reg" {
+		return nil, fmt.Errorf("entry %d isn't a regular file", id)
+	}
+	return &file{r: r, n: n}, nil
+}
+
+func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
+	return NewReader(sr, r.z, r.digest)
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+// checkpoint returns the last checkpoint before the offset in the uncompressed stream.
+// nil is returned if the decompression must start from the beginning of the stream.
+func (r *reader) checkpoint(off int64) *Checkpoint {
+	i := sort.Search(len(r.z.Checkpoints), func(i int) bool {
+		return r.z.Checkpoints[i].Out > off
+	})
+	if i == 0 {
+		return nil
+	}
+	return &r.z.Checkpoints[i-1]
+}
+
+// readAt reads the uncompressed stream at the offset.
+func (r *reader) readAt(p []byte, off int64) (int, error) {
+	var (
+		d   *decoder
+		err error
+	)
+	start := int64(0)
+	if cp := r.checkpoint(off); cp != nil {
+		d, err = newDecoderAt(io.NewSectionReader(r.sr, cp.In/8, r.sr.Size()-cp.In/8), cp)
+		if err != nil {
+			return 0, err
+		}
+		start = cp.Out
+	} else {
+		d = newDecoder(io.NewSectionReader(r.sr, 0, r.sr.Size()))
+	}
+	if _, err := io.CopyN(io.Discard, d, off-start); err != nil {
+		return 0, fmt.Errorf("failed to decompress the layer: %w", err)
+	}
+	return io.ReadFull(d, p)
+}
+
+type file struct {
+	r *reader
+	n *node
+}
+
+func (f *file) ChunkEntryForOffset(offset int64) (off int64, size int64, dgst string, ok bool) {
+	chunks := f.n.chunks
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].ChunkOffset+chunks[i].ChunkSize > offset
+	})
+	if i == len(chunks) || offset < chunks[i].ChunkOffset {
+		return 0, 0, "", false
+	}
+	return chunks[i].ChunkOffset, chunks[i].ChunkSize, chunks[i].ChunkDigest, true
+}
+
+func (f *file) ReadAt(p []byte, off int64) (n int, err error) {
+	size := f.n.e.Size
+	if off >= size {
+		return 0, io.EOF
+	}
+	if remain := size - off; int64(len(p)) > remain {
+		p = p[:remain]
+		err = io.EOF
+	}
+	n, rErr := f.r.readAt(p, f.n.e.Offset+off)
+	if rErr != nil {
+		return n, rErr
+	}
+	return n, err
+}
+
+func attrFromTOCEntry(src *estargz.TOCEntry, dst *metadata.Attr) *metadata.Attr {
+	dst.Size = src.Size
+	dst.ModTime, _ = time.Parse(time.RFC3339, src.ModTime3339)
+	dst.LinkName = src.LinkName
+	dst.Mode = src.Stat().Mode()
+	dst.UID = src.UID
+	dst.GID = src.GID
+	dst.DevMajor = src.DevMajor
+	dst.DevMinor = src.DevMinor
+	dst.Xattrs = src.Xattrs
+	dst.NumLink = src.NumLink
+	return dst
+}
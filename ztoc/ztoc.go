@@ -0,0 +1,290 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ztoc provides the index (ztoc) of an ordinary gzip-compressed tar layer.
+// A ztoc contains the TOC of the layer and checkpoints of the gzip stream where
+// decompression can start, so the layer can be lazily pulled without converting it
+// to eStargz (i.e. without changing the digest of the layer).
+// This is inspired by SOCI (https://github.com/awslabs/soci-snapshotter).
+//
+// Ztocs of an image are grouped by an index. The index is an OCI image manifest
+// whose layers are ztocs and whose annotation points to the manifest of the image.
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// MediaTypeZtoc is the media type of ztocs. A ztoc is a gzip-compressed JSON of Ztoc.
+	MediaTypeZtoc = "application/vnd.stargz.ztoc.v1+json+gzip"
+
+	// MediaTypeIndexConfig is the media type of the config of the index.
+	MediaTypeIndexConfig = "application/vnd.stargz.ztoc.index.config.v1+json"
+
+	// LayerDigestAnnotation is an annotation of a ztoc descriptor in the index. This
+	// contains the digest of the layer indexed by the ztoc.
+	LayerDigestAnnotation = "containerd.io/snapshot/stargz/ztoc.layer.digest"
+
+	// IndexArtifactType is the artifact type of the index pushed as a referrer of the
+	// manifest of the indexed image.
+	IndexArtifactType = "application/vnd.stargz.ztoc.index.v1"
+
+	// ImageManifestAnnotation is an annotation of the index. This contains the digest
+	// of the manifest of the image indexed by the index.
+	ImageManifestAnnotation = "containerd.io/snapshot/stargz/ztoc.image.manifest"
+
+	// Version is the version of the ztoc format.
+	Version = "1"
+
+	defaultSpanSize  = 4 << 20
+	defaultChunkSize = 4 << 20
+)
+
+// Ztoc is the index of a gzip-compressed tar layer.
+type Ztoc struct {
+	Version string `json:"version"`
+
+	// CompressedSize is the size of the layer.
+	CompressedSize int64 `json:"compressedSize"`
+
+	// UncompressedSize is the size of the tar archive.
+	UncompressedSize int64 `json:"uncompressedSize"`
+
+	// Entries are the TOC of the tar archive. The format is the same as eStargz
+	// TOCEntry except that Offset is the offset of the file contents in the
+	// *uncompressed* tar archive. Contents are divided into chunks (of "chunk" type
+	// following the first entry) to be verified using ChunkDigest.
+	Entries []*estargz.TOCEntry `json:"entries"`
+
+	// Checkpoints are points in the gzip stream where decompression can start, sorted
+	// by the offset.
+	Checkpoints []Checkpoint `json:"checkpoints"`
+}
+
+// Checkpoint is a point in the gzip stream where decompression can start.
+type Checkpoint struct {
+	// In is the offset in bits of the beginning of a DEFLATE block.
+	In int64 `json:"in"`
+
+	// Out is the offset in the uncompressed stream corresponding to In.
+	Out int64 `json:"out"`
+
+	// Window is the uncompressed data preceding Out (up to 32KiB) which the following
+	// data can refer to.
+	Window []byte `json:"window"`
+}
+
+type options struct {
+	spanSize  int64
+	chunkSize int64
+}
+
+// Option is an option for building ztocs.
+type Option func(o *options)
+
+// WithSpanSize specifies the approximate distance in the uncompressed stream between
+// checkpoints. Smaller span makes random access faster but the ztoc larger.
+func WithSpanSize(spanSize int64) Option {
+	return func(o *options) {
+		o.spanSize = spanSize
+	}
+}
+
+// WithChunkSize specifies the size of chunks of file contents.
+func WithChunkSize(chunkSize int64) Option {
+	return func(o *options) {
+		o.chunkSize = chunkSize
+	}
+}
+
+// Build builds the ztoc of the gzip-compressed tar layer.
+func Build(r io.Reader, opts ...Option) (*Ztoc, error) {
+	o := options{spanSize: defaultSpanSize, chunkSize: defaultChunkSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cr := &countingReader{r: r}
+	d := newDecoder(cr)
+	z := &Ztoc{Version: Version}
+	var lastOut int64
+	d.onBlock = func(in, out int64, d *decoder) {
+		if out-lastOut < o.spanSize {
+			return
+		}
+		z.Checkpoints = append(z.Checkpoints, Checkpoint{In: in, Out: out, Window: d.window()})
+		lastOut = out
+	}
+	ur := &countingReader{r: d}
+	tr := tar.NewReader(ur)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse tar: %w", err)
+		}
+		e, err := entryFromHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		z.Entries = append(z.Entries, e)
+		if e.Type != "reg" {
+			continue
+		}
+		e.Offset = ur.n
+		chunkEntry := e
+		for off := int64(0); off == 0 || off < h.Size; off += o.chunkSize {
+			size := h.Size - off
+			if size > o.chunkSize {
+				size = o.chunkSize
+			}
+			if off > 0 {
+				chunkEntry = &estargz.TOCEntry{
+					Name:   e.Name,
+					Type:   "chunk",
+					Offset: e.Offset + off,
+				}
+				z.Entries = append(z.Entries, chunkEntry)
+			}
+			chunkEntry.ChunkOffset = off
+			chunkEntry.ChunkSize = size
+			hash := sha256.New()
+			if _, err := io.CopyN(hash, tr, size); err != nil {
+				return nil, fmt.Errorf("failed to read %q: %w", e.Name, err)
+			}
+			chunkEntry.ChunkDigest = digest.NewDigest(digest.SHA256, hash).String()
+		}
+	}
+	// Read the remaining data (e.g. padding) for verifying the checksum of the stream.
+	if _, err := io.Copy(io.Discard, ur); err != nil {
+		return nil, fmt.Errorf("failed to read the layer: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return nil, fmt.Errorf("failed to read the layer: %w", err)
+	}
+	z.CompressedSize = cr.n
+	z.UncompressedSize = ur.n
+	return z, nil
+}
+
+func entryFromHeader(h *tar.Header) (*estargz.TOCEntry, error) {
+	e := &estargz.TOCEntry{
+		Name:        cleanEntryName(h.Name),
+		Mode:        h.Mode,
+		UID:         h.Uid,
+		GID:         h.Gid,
+		Uname:       h.Uname,
+		Gname:       h.Gname,
+		ModTime3339: h.ModTime.UTC().Format(time.RFC3339),
+	}
+	if len(h.PAXRecords) > 0 {
+		for k, v := range h.PAXRecords {
+			if !strings.HasPrefix(k, "SCHILY.xattr.") {
+				continue
+			}
+			if e.Xattrs == nil {
+				e.Xattrs = make(map[string][]byte)
+			}
+			e.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = []byte(v)
+		}
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		e.Type = "hardlink"
+		e.LinkName = cleanEntryName(h.Linkname)
+	case tar.TypeSymlink:
+		e.Type = "symlink"
+		e.LinkName = h.Linkname
+	case tar.TypeDir:
+		e.Type = "dir"
+	case tar.TypeReg, tar.TypeRegA:
+		e.Type = "reg"
+		e.Size = h.Size
+	case tar.TypeChar:
+		e.Type = "char"
+		e.DevMajor = int(h.Devmajor)
+		e.DevMinor = int(h.Devminor)
+	case tar.TypeBlock:
+		e.Type = "block"
+		e.DevMajor = int(h.Devmajor)
+		e.DevMinor = int(h.Devminor)
+	case tar.TypeFifo:
+		e.Type = "fifo"
+	default:
+		return nil, fmt.Errorf("unsupported input tar entry %q", h.Typeflag)
+	}
+	return e, nil
+}
+
+func cleanEntryName(name string) string {
+	// Remove leading "/" and "./" as eStargz does
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Marshal encodes the ztoc as a blob of MediaTypeZtoc.
+func Marshal(z *Ztoc) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(z); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the blob of MediaTypeZtoc.
+func Unmarshal(r io.Reader) (*Ztoc, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress ztoc: %w", err)
+	}
+	defer zr.Close()
+	var z Ztoc
+	if err := json.NewDecoder(zr).Decode(&z); err != nil {
+		return nil, fmt.Errorf("failed to decode ztoc: %w", err)
+	}
+	if z.Version != Version {
+		return nil, fmt.Errorf("unsupported ztoc version %q", z.Version)
+	}
+	return &z, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testFile struct {
+	name     string
+	contents []byte
+	linkTo   string
+}
+
+func testFiles() []testFile {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	text := func(n int) []byte {
+		var b bytes.Buffer
+		for b.Len() < n {
+			fmt.Fprintf(&b, "line %d of the text %d\n", rnd.Intn(1000), rnd.Intn(10))
+		}
+		return b.Bytes()[:n]
+	}
+	return []testFile{
+		{name: "empty"},
+		{name: "dir/small", contents: []byte("small")},
+		{name: "dir/text", contents: text(300000)},
+		{name: "dir/sub/random", contents: random(200000)},
+		{name: "dir/hardlink", linkTo: "dir/text"},
+		{name: "large", contents: append(text(500000), random(100000)...)},
+	}
+}
+
+func buildTar(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		h := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents)), Typeflag: tar.TypeReg}
+		if f.linkTo != "" {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeLink, f.linkTo, 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, level int, members int, data []byte) []byte {
+	var buf bytes.Buffer
+	step := len(data)/members + 1
+	for off := 0; off < len(data); off += step {
+		end := off + step
+		if end > len(data) {
+			end = len(data)
+		}
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestZtoc(t *testing.T) {
+	files := testFiles()
+	tarBytes := buildTar(t, files)
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression, gzip.HuffmanOnly} {
+		for _, members := range []int{1, 3} {
+			t.Run(fmt.Sprintf("level=%d,members=%d", level, members), func(t *testing.T) {
+				blob := compress(t, level, members, tarBytes)
+
+				// The decoder decompresses the whole stream
+				all, err := io.ReadAll(newDecoder(bytes.NewReader(blob)))
+				if err != nil {
+					t.Fatalf("failed to decompress: %v", err)
+				}
+				if !bytes.Equal(all, tarBytes) {
+					t.Fatalf("unexpected decompressed data")
+				}
+
+				z, err := Build(bytes.NewReader(blob), WithSpanSize(64*1024), WithChunkSize(100000))
+				if err != nil {
+					t.Fatalf("failed to build ztoc: %v", err)
+				}
+				if len(z.Checkpoints) == 0 {
+					t.Fatalf("no checkpoint")
+				}
+				if z.CompressedSize != int64(len(blob)) || z.UncompressedSize != int64(len(tarBytes)) {
+					t.Fatalf("unexpected sizes (%d, %d); want (%d, %d)", z.CompressedSize, z.UncompressedSize, len(blob), len(tarBytes))
+				}
+				p, err := Marshal(z)
+				if err != nil {
+					t.Fatalf("failed to marshal: %v", err)
+				}
+				z, err = Unmarshal(bytes.NewReader(p))
+				if err != nil {
+					t.Fatalf("failed to unmarshal: %v", err)
+				}
+				r, err := NewReader(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))), z, digest.FromBytes(p))
+				if err != nil {
+					t.Fatalf("failed to create reader: %v", err)
+				}
+				checkFiles(t, r.(*reader), files)
+			})
+		}
+	}
+}
+
+func checkFiles(t *testing.T, r *reader, files []testFile) {
+	lookup := func(name string) uint32 {
+		id := r.RootID()
+		for _, base := range splitPath(name) {
+			var err error
+			id, _, err = r.GetChild(id, base)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", name, err)
+			}
+		}
+		return id
+	}
+	contents := make(map[string][]byte)
+	for _, f := range files {
+		c := f.contents
+		if f.linkTo != "" {
+			c = contents[f.linkTo]
+			if lookup(f.name) != lookup(f.linkTo) {
+				t.Errorf("hardlink %q must point to %q", f.name, f.linkTo)
+			}
+		}
+		contents[f.name] = c
+		id := lookup(f.name)
+		attr, err := r.GetAttr(id)
+		if err != nil {
+			t.Fatalf("failed to get attr of %q: %v", f.name, err)
+		}
+		if attr.Size != int64(len(c)) {
+			t.Errorf("unexpected size of %q %d; want %d", f.name, attr.Size, len(c))
+		}
+		fr, err := r.OpenFile(id)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", f.name, err)
+		}
+		// Read chunk by chunk and verify the digests
+		for off := int64(0); off < int64(len(c)); {
+			coff, csize, dgst, ok := fr.ChunkEntryForOffset(off)
+			if !ok || coff != off {
+				t.Fatalf("unexpected chunk of %q at %d: (%d, %d, %v)", f.name, off, coff, csize, ok)
+			}
+			p := make([]byte, csize)
+			if n, err := fr.ReadAt(p, coff); err != nil && err != io.EOF || n != int(csize) {
+				t.Fatalf("failed to read chunk of %q at %d (%d bytes): %v", f.name, coff, n, err)
+			}
+			if digest.FromBytes(p).String() != dgst {
+				t.Errorf("unexpected digest of chunk of %q at %d", f.name, coff)
+			}
+			off += csize
+		}
+		// Random access
+		for _, off := range []int{0, len(c) / 3, len(c) - 10} {
+			if off < 0 {
+				continue
+			}
+			p := make([]byte, 10)
+			n, err := fr.ReadAt(p, int64(off))
+			if err != nil && err != io.EOF {
+				t.Fatalf("failed to read %q at %d: %v", f.name, off, err)
+			}
+			if want := c[off:min(off+10, len(c))]; !bytes.Equal(p[:n], want) {
+				t.Errorf("unexpected contents of %q at %d: %q; want %q", f.name, off, p[:n], want)
+			}
+		}
+	}
+	if id := lookup("dir"); id != 0 {
+		attr, err := r.GetAttr(id)
+		if err != nil || !attr.Mode.IsDir() || attr.NumLink != 3 {
+			t.Errorf("unexpected implicit directory: %+v, %v", attr, err)
+		}
+	}
+}
+
+func splitPath(name string) (s []string) {
+	for _, b := range bytes.Split([]byte(name), []byte("/")) {
+		s = append(s, string(b))
+	}
+	return
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}